@@ -138,7 +138,7 @@ func runMigrations() error {
 			id INTEGER PRIMARY KEY AUTOINCREMENT, ipn TEXT NOT NULL,
 			type TEXT NOT NULL CHECK(type IN ('receive','issue','adjust','transfer','return','scrap')),
 			qty REAL NOT NULL, reference TEXT, notes TEXT,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP, lot_id INTEGER
 		)`,
 		`CREATE TABLE IF NOT EXISTS purchase_orders (
 			id TEXT PRIMARY KEY, vendor_id TEXT NOT NULL,
@@ -619,6 +619,491 @@ func runMigrations() error {
 		FOREIGN KEY (invoice_id) REFERENCES invoices(id) ON DELETE CASCADE
 	)`)
 
+	// Reservation ledger: qty_reserved on inventory is the sum of open rows here
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS inventory_reservations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ref_type TEXT NOT NULL,
+		ref_id TEXT NOT NULL,
+		ipn TEXT NOT NULL,
+		qty REAL NOT NULL DEFAULT 0 CHECK(qty >= 0),
+		qty_consumed REAL NOT NULL DEFAULT 0 CHECK(qty_consumed >= 0),
+		status TEXT DEFAULT 'open' CHECK(status IN ('open','consumed','released')),
+		created_by TEXT DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		closed_at DATETIME
+	)`)
+
+	// Routings: work centers, per-assembly routing templates and the
+	// operations instantiated from them for each work order
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS work_centers (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		description TEXT DEFAULT '',
+		labor_rate REAL DEFAULT 0 CHECK(labor_rate >= 0),
+		active INTEGER DEFAULT 1,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS routing_steps (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		assembly_ipn TEXT NOT NULL,
+		seq INTEGER NOT NULL CHECK(seq > 0),
+		name TEXT NOT NULL,
+		work_center_id TEXT DEFAULT '',
+		instructions TEXT DEFAULT '',
+		std_minutes REAL DEFAULT 0 CHECK(std_minutes >= 0),
+		UNIQUE(assembly_ipn, seq)
+	)`)
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS wo_operations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		wo_id TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		work_center_id TEXT DEFAULT '',
+		instructions TEXT DEFAULT '',
+		status TEXT DEFAULT 'pending' CHECK(status IN ('pending','in_progress','completed','skipped')),
+		qty_good INTEGER DEFAULT 0 CHECK(qty_good >= 0),
+		qty_scrap INTEGER DEFAULT 0 CHECK(qty_scrap >= 0),
+		started_at DATETIME, started_by TEXT DEFAULT '',
+		completed_at DATETIME, completed_by TEXT DEFAULT '',
+		notes TEXT DEFAULT '',
+		UNIQUE(wo_id, seq),
+		FOREIGN KEY (wo_id) REFERENCES work_orders(id) ON DELETE CASCADE
+	)`)
+
+	// Labor clock-ins. minutes is the split share accrued so far: while a user
+	// is clocked into several jobs at once, elapsed time is divided evenly
+	// between them. accrued_at marks how far minutes has been brought up to.
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS labor_entries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		wo_id TEXT NOT NULL,
+		operation_id INTEGER,
+		username TEXT NOT NULL,
+		clock_in DATETIME NOT NULL,
+		clock_out DATETIME,
+		accrued_at DATETIME NOT NULL,
+		minutes REAL DEFAULT 0 CHECK(minutes >= 0),
+		notes TEXT DEFAULT '',
+		FOREIGN KEY (wo_id) REFERENCES work_orders(id) ON DELETE CASCADE
+	)`)
+
+	// Lots: one row per received batch of a part (or per WO output).
+	// inventory_transactions.lot_id links movements to the lot they drew
+	// from, which is what forward and backward traces follow.
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS inventory_lots (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ipn TEXT NOT NULL,
+		lot_number TEXT NOT NULL,
+		date_code TEXT DEFAULT '',
+		vendor_id TEXT DEFAULT '',
+		po_id TEXT DEFAULT '',
+		po_line_id INTEGER,
+		receiving_inspection_id INTEGER,
+		wo_id TEXT DEFAULT '',
+		qty_received REAL DEFAULT 0 CHECK(qty_received >= 0),
+		qty_on_hand REAL DEFAULT 0 CHECK(qty_on_hand >= 0),
+		status TEXT DEFAULT 'available' CHECK(status IN ('inspection','available','hold','quarantine','depleted')),
+		received_at DATETIME,
+		notes TEXT DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+
+	// MRP: each run stores its time-phased requirements and the planned
+	// orders it produced. Planned POs are firmed into po_suggestions, which
+	// go through the normal suggestion review to become purchase orders.
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS mrp_runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		status TEXT DEFAULT 'running' CHECK(status IN ('running','completed','failed')),
+		trigger_type TEXT DEFAULT 'manual' CHECK(trigger_type IN ('manual','scheduled')),
+		horizon_days INTEGER DEFAULT 90,
+		default_lead_time_days INTEGER DEFAULT 7,
+		notes TEXT DEFAULT '',
+		created_by TEXT DEFAULT '',
+		started_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		completed_at DATETIME,
+		item_count INTEGER DEFAULT 0,
+		planned_po_count INTEGER DEFAULT 0,
+		planned_wo_count INTEGER DEFAULT 0,
+		error TEXT DEFAULT ''
+	)`)
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS mrp_requirements (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		run_id INTEGER NOT NULL,
+		ipn TEXT NOT NULL,
+		period TEXT NOT NULL,
+		gross_req REAL DEFAULT 0,
+		scheduled_receipts REAL DEFAULT 0,
+		projected_on_hand REAL DEFAULT 0,
+		net_req REAL DEFAULT 0,
+		planned_receipt REAL DEFAULT 0,
+		planned_release TEXT DEFAULT '',
+		FOREIGN KEY (run_id) REFERENCES mrp_runs(id) ON DELETE CASCADE
+	)`)
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS mrp_planned_orders (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		run_id INTEGER NOT NULL,
+		order_type TEXT NOT NULL CHECK(order_type IN ('po','wo')),
+		ipn TEXT NOT NULL,
+		qty REAL NOT NULL CHECK(qty > 0),
+		release_date TEXT NOT NULL,
+		due_date TEXT NOT NULL,
+		vendor_id TEXT DEFAULT '',
+		unit_price REAL DEFAULT 0,
+		status TEXT DEFAULT 'planned' CHECK(status IN ('planned','firmed','cancelled')),
+		suggestion_id INTEGER,
+		wo_id TEXT DEFAULT '',
+		notes TEXT DEFAULT '',
+		FOREIGN KEY (run_id) REFERENCES mrp_runs(id) ON DELETE CASCADE
+	)`)
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS mrp_item_settings (
+		ipn TEXT PRIMARY KEY,
+		lot_sizing TEXT DEFAULT 'lot_for_lot' CHECK(lot_sizing IN ('lot_for_lot','fixed','min')),
+		lot_qty REAL DEFAULT 0 CHECK(lot_qty >= 0),
+		lead_time_days INTEGER,
+		safety_stock REAL
+	)`)
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS po_suggestions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		wo_id TEXT DEFAULT '',
+		vendor_id TEXT NOT NULL,
+		status TEXT DEFAULT 'pending' CHECK(status IN ('pending','approved','rejected')),
+		notes TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		reviewed_by TEXT,
+		reviewed_at DATETIME,
+		po_id TEXT,
+		mrp_run_id INTEGER,
+		source TEXT DEFAULT ''
+	)`)
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS po_suggestion_lines (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		suggestion_id INTEGER NOT NULL,
+		ipn TEXT NOT NULL,
+		mpn TEXT,
+		manufacturer TEXT,
+		qty_needed REAL NOT NULL,
+		estimated_unit_price REAL DEFAULT 0,
+		notes TEXT,
+		on_hand REAL,
+		on_order REAL,
+		demand REAL,
+		reorder_point REAL,
+		reorder_qty REAL,
+		FOREIGN KEY (suggestion_id) REFERENCES po_suggestions(id) ON DELETE CASCADE
+	)`)
+
+	// As-built genealogy: what went into each serial, either a child serial
+	// built on another WO or a qty from a lot. A child serial can only be
+	// installed in one parent.
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS serial_components (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		parent_serial TEXT NOT NULL,
+		component_type TEXT NOT NULL CHECK(component_type IN ('serial','lot')),
+		child_serial TEXT DEFAULT '',
+		lot_id INTEGER,
+		ipn TEXT DEFAULT '',
+		qty REAL DEFAULT 1 CHECK(qty > 0),
+		wo_id TEXT DEFAULT '',
+		installed_by TEXT DEFAULT '',
+		installed_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+
+	// Partial WO completions and scrap. Each event backflushes components and
+	// remembers the range of inventory_transactions it wrote so it can be
+	// undone.
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS wo_completions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		wo_id TEXT NOT NULL,
+		event_type TEXT NOT NULL CHECK(event_type IN ('complete','scrap')),
+		qty INTEGER NOT NULL CHECK(qty > 0),
+		reason_code TEXT DEFAULT '',
+		notes TEXT DEFAULT '',
+		output_lot_id INTEGER,
+		closed_wo INTEGER DEFAULT 0,
+		first_txn_id INTEGER DEFAULT 0,
+		last_txn_id INTEGER DEFAULT 0,
+		reservation_changes TEXT DEFAULT '{}',
+		created_by TEXT DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		reversed_at DATETIME,
+		reversed_by TEXT DEFAULT ''
+	)`)
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS scrap_reasons (
+		code TEXT PRIMARY KEY,
+		description TEXT DEFAULT '',
+		active INTEGER DEFAULT 1,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+
+	// Structured test results: limits per IPN and measurement name, and each
+	// reading of a test record with the limits it was judged against.
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS test_specs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ipn TEXT NOT NULL,
+		test_type TEXT DEFAULT '',
+		name TEXT NOT NULL,
+		unit TEXT DEFAULT '',
+		low_limit REAL,
+		high_limit REAL,
+		required INTEGER DEFAULT 1,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(ipn, test_type, name)
+	)`)
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS test_measurements (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		test_record_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		value REAL NOT NULL,
+		unit TEXT DEFAULT '',
+		low_limit REAL,
+		high_limit REAL,
+		spec_id INTEGER,
+		result TEXT NOT NULL CHECK(result IN ('pass','fail','none')),
+		notes TEXT DEFAULT '',
+		FOREIGN KEY (test_record_id) REFERENCES test_records(id) ON DELETE CASCADE
+	)`)
+
+	// Print templates with their version history
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS print_templates (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		doc_type TEXT NOT NULL,
+		name TEXT NOT NULL,
+		description TEXT DEFAULT '',
+		is_default INTEGER DEFAULT 0,
+		current_version INTEGER NOT NULL DEFAULT 0,
+		created_by TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(doc_type, name)
+	)`)
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS print_template_versions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		template_id INTEGER NOT NULL,
+		version INTEGER NOT NULL,
+		body TEXT NOT NULL,
+		change_note TEXT DEFAULT '',
+		created_by TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(template_id, version),
+		FOREIGN KEY (template_id) REFERENCES print_templates(id) ON DELETE CASCADE
+	)`)
+
+	// Rework orders: a work order raised against an NCR dispositioned as
+	// rework, with the affected serials and the replacement material issued
+	// to it. Its labor and material cost roll up onto the NCR.
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS rework_orders (
+		wo_id TEXT PRIMARY KEY,
+		ncr_id TEXT NOT NULL,
+		instructions TEXT DEFAULT '',
+		lot_id INTEGER,
+		from_stock INTEGER DEFAULT 0,
+		created_by TEXT DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (wo_id) REFERENCES work_orders(id) ON DELETE CASCADE
+	)`)
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS rework_units (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		wo_id TEXT NOT NULL,
+		serial_number TEXT NOT NULL,
+		UNIQUE(wo_id, serial_number),
+		FOREIGN KEY (wo_id) REFERENCES work_orders(id) ON DELETE CASCADE
+	)`)
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS rework_materials (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		wo_id TEXT NOT NULL,
+		ipn TEXT NOT NULL,
+		qty REAL NOT NULL CHECK(qty > 0),
+		unit_cost REAL DEFAULT 0,
+		issued_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		returned_at DATETIME,
+		FOREIGN KEY (wo_id) REFERENCES work_orders(id) ON DELETE CASCADE
+	)`)
+
+	// Kit picks: material pulled from stock for a work order and moved to
+	// its staging location. Backflush and completion draw from staging first;
+	// what is left over can be returned to stock.
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS wo_picks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		wo_id TEXT NOT NULL,
+		ipn TEXT NOT NULL,
+		lot_id INTEGER,
+		from_location TEXT DEFAULT '',
+		staging_location TEXT NOT NULL,
+		qty REAL NOT NULL CHECK(qty > 0),
+		qty_returned REAL DEFAULT 0 CHECK(qty_returned >= 0),
+		qty_consumed REAL DEFAULT 0 CHECK(qty_consumed >= 0),
+		picked_by TEXT DEFAULT '',
+		picked_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (wo_id) REFERENCES work_orders(id) ON DELETE CASCADE
+	)`)
+
+	// Locations: site -> area -> bin. inventory.qty_on_hand stays the total
+	// for the IPN; inventory_locations holds the part of it that is in a known
+	// location, and the rest is unassigned.
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS locations (
+		code TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		type TEXT NOT NULL CHECK(type IN ('site','area','bin')),
+		parent_code TEXT DEFAULT '',
+		active INTEGER DEFAULT 1,
+		notes TEXT DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS inventory_locations (
+		ipn TEXT NOT NULL,
+		location_code TEXT NOT NULL,
+		qty_on_hand REAL DEFAULT 0 CHECK(qty_on_hand >= 0),
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (ipn, location_code),
+		FOREIGN KEY (location_code) REFERENCES locations(code)
+	)`)
+
+	// Cycle counting: IPNs are classed A/B/C by transaction value and counted
+	// at their class's frequency. Counts outside tolerance wait for approval
+	// before the adjustment is posted.
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS cycle_count_classes (
+		class TEXT PRIMARY KEY CHECK(class IN ('A','B','C')),
+		value_pct REAL NOT NULL CHECK(value_pct > 0 AND value_pct <= 100),
+		frequency_days INTEGER NOT NULL CHECK(frequency_days > 0),
+		tolerance_pct REAL DEFAULT 0 CHECK(tolerance_pct >= 0)
+	)`)
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS cycle_count_items (
+		ipn TEXT PRIMARY KEY,
+		abc_class TEXT NOT NULL CHECK(abc_class IN ('A','B','C')),
+		annual_value REAL DEFAULT 0,
+		classified_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_counted_at DATETIME
+	)`)
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS cycle_count_tasks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ipn TEXT NOT NULL,
+		abc_class TEXT NOT NULL,
+		scheduled_date TEXT NOT NULL,
+		status TEXT DEFAULT 'open' CHECK(status IN ('open','pending_approval','completed','rejected','cancelled')),
+		expected_qty REAL,
+		counted_qty REAL,
+		variance_qty REAL,
+		variance_pct REAL,
+		unit_cost REAL DEFAULT 0,
+		variance_value REAL,
+		within_tolerance INTEGER,
+		counted_by TEXT DEFAULT '',
+		counted_at DATETIME,
+		reviewed_by TEXT DEFAULT '',
+		reviewed_at DATETIME,
+		review_notes TEXT DEFAULT '',
+		notes TEXT DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+
+	// Cost layers: stock of an IPN at the cost it came in at. Consumption
+	// relieves them FIFO or at the moving average (app setting
+	// costing_method) and logs the cost taken in cost_layer_issues.
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS cost_layers (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ipn TEXT NOT NULL,
+		source_type TEXT NOT NULL CHECK(source_type IN ('opening','receipt','wo','return','adjust')),
+		source_ref TEXT DEFAULT '',
+		qty_received REAL NOT NULL,
+		qty_remaining REAL NOT NULL CHECK(qty_remaining >= 0),
+		unit_cost REAL DEFAULT 0,
+		original_cost REAL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS cost_layer_issues (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		layer_id INTEGER,
+		ipn TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		reference TEXT DEFAULT '',
+		qty REAL NOT NULL,
+		unit_cost REAL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+
+	// Moisture-sensitive lots: every open, dry storage and bake of a reel,
+	// with the floor exposure it had built up at that point
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS msl_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		lot_id INTEGER NOT NULL,
+		ipn TEXT NOT NULL,
+		event TEXT NOT NULL CHECK(event IN ('open','dry','bake')),
+		exposure_hours REAL DEFAULT 0,
+		notes TEXT DEFAULT '',
+		created_by TEXT DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+
+	// Stock that isn't simply ours: customer-owned stock held here (part of
+	// inventory.qty_on_hand) and our stock consigned to a contract
+	// manufacturer (not on hand). ownership_moves is the ledger behind it.
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS inventory_ownership (
+		ipn TEXT NOT NULL,
+		owner_type TEXT NOT NULL CHECK(owner_type IN ('customer','consigned')),
+		owner TEXT NOT NULL,
+		qty REAL NOT NULL DEFAULT 0 CHECK(qty >= 0),
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (ipn, owner_type, owner)
+	)`)
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS ownership_moves (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ipn TEXT NOT NULL,
+		owner_type TEXT NOT NULL CHECK(owner_type IN ('customer','consigned')),
+		owner TEXT NOT NULL,
+		type TEXT NOT NULL CHECK(type IN ('receive','issue','return','ship_to_cm','cm_consumed','return_from_cm')),
+		qty REAL NOT NULL,
+		reference TEXT DEFAULT '',
+		notes TEXT DEFAULT '',
+		created_by TEXT DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+
+	// Handheld scanner sessions: the state built up by successive scans,
+	// the lines committed at the end and every scan made, for audit.
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS scan_sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		mode TEXT NOT NULL CHECK(mode IN ('receive','issue','pick','move','count')),
+		status TEXT DEFAULT 'open' CHECK(status IN ('open','committing','committed','cancelled')),
+		reference TEXT DEFAULT '',
+		location TEXT DEFAULT '',
+		to_location TEXT DEFAULT '',
+		pending_ipn TEXT DEFAULT '',
+		pending_lot_id INTEGER,
+		pending_lot_number TEXT DEFAULT '',
+		pending_date_code TEXT DEFAULT '',
+		pending_qty REAL,
+		username TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		closed_at DATETIME
+	)`)
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS scan_session_lines (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		session_id INTEGER NOT NULL,
+		ipn TEXT NOT NULL,
+		lot_id INTEGER,
+		lot_number TEXT DEFAULT '',
+		date_code TEXT DEFAULT '',
+		qty REAL NOT NULL CHECK(qty >= 0),
+		location TEXT DEFAULT '',
+		to_location TEXT DEFAULT '',
+		reference TEXT DEFAULT '',
+		status TEXT DEFAULT 'pending' CHECK(status IN ('pending','committed','failed')),
+		error TEXT DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	tables = append(tables, `CREATE TABLE IF NOT EXISTS scan_session_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		session_id INTEGER NOT NULL,
+		scan_id TEXT DEFAULT '',
+		code TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		message TEXT DEFAULT '',
+		username TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+
 	for _, t := range tables {
 		if _, err := db.Exec(t); err != nil {
 			return fmt.Errorf("migration error: %w\nSQL: %s", err, t)
@@ -633,8 +1118,19 @@ func runMigrations() error {
 		"ALTER TABLE notifications ADD COLUMN emailed INTEGER DEFAULT 0",
 		"ALTER TABLE notifications ADD COLUMN user_id TEXT DEFAULT ''",
 		"ALTER TABLE work_orders ADD COLUMN due_date TEXT DEFAULT ''",
+		"ALTER TABLE inventory_transactions ADD COLUMN lot_id INTEGER",
+		"ALTER TABLE work_centers ADD COLUMN labor_rate REAL DEFAULT 0",
 		"ALTER TABLE work_orders ADD COLUMN qty_good INTEGER DEFAULT 0",
 		"ALTER TABLE work_orders ADD COLUMN qty_scrap INTEGER DEFAULT 0",
+		"ALTER TABLE work_orders ADD COLUMN parent_wo_id TEXT DEFAULT ''",
+		"ALTER TABLE work_orders ADD COLUMN child_wo_override INTEGER DEFAULT 0",
+		"ALTER TABLE ncrs ADD COLUMN disposition TEXT DEFAULT ''",
+		"ALTER TABLE ncrs ADD COLUMN rework_labor_cost REAL DEFAULT 0",
+		"ALTER TABLE ncrs ADD COLUMN rework_material_cost REAL DEFAULT 0",
+		"ALTER TABLE inventory_lots ADD COLUMN location TEXT DEFAULT ''",
+		"ALTER TABLE inventory_transactions ADD COLUMN location TEXT DEFAULT ''",
+		"ALTER TABLE inventory_transactions ADD COLUMN to_location TEXT DEFAULT ''",
+		"ALTER TABLE test_records ADD COLUMN ncr_id TEXT DEFAULT ''",
 		"ALTER TABLE users ADD COLUMN email TEXT DEFAULT ''",
 		"ALTER TABLE users ADD COLUMN failed_login_attempts INTEGER DEFAULT 0",
 		"ALTER TABLE users ADD COLUMN locked_until DATETIME DEFAULT NULL",
@@ -652,10 +1148,31 @@ func runMigrations() error {
 		"ALTER TABLE invoices ADD COLUMN tax REAL DEFAULT 0",
 		"ALTER TABLE invoices ADD COLUMN notes TEXT DEFAULT ''",
 		"ALTER TABLE invoices RENAME COLUMN total_amount TO total",
+		// Reorder point suggestions and the stock position behind each line
+		"ALTER TABLE po_suggestions ADD COLUMN source TEXT DEFAULT ''",
+		"ALTER TABLE po_suggestion_lines ADD COLUMN on_hand REAL",
+		"ALTER TABLE po_suggestion_lines ADD COLUMN on_order REAL",
+		"ALTER TABLE po_suggestion_lines ADD COLUMN demand REAL",
+		"ALTER TABLE po_suggestion_lines ADD COLUMN reorder_point REAL",
+		"ALTER TABLE po_suggestion_lines ADD COLUMN reorder_qty REAL",
+		// MSL floor life clock of a lot; the level is taken from the part when
+		// the lot is first opened
+		"ALTER TABLE inventory_lots ADD COLUMN msl_level TEXT DEFAULT ''",
+		"ALTER TABLE inventory_lots ADD COLUMN msl_floor_life_hours REAL",
+		"ALTER TABLE inventory_lots ADD COLUMN msl_state TEXT DEFAULT 'sealed'",
+		"ALTER TABLE inventory_lots ADD COLUMN msl_exposure_hours REAL DEFAULT 0",
+		"ALTER TABLE inventory_lots ADD COLUMN msl_opened_at DATETIME",
+		// Shelf life; expired lots are quarantined
+		"ALTER TABLE inventory_lots ADD COLUMN expires_at DATE",
+		// Customer a WO builds for; its customer-owned stock is kitted first
+		"ALTER TABLE work_orders ADD COLUMN customer TEXT DEFAULT ''",
 	}
 	for _, s := range alterStmts {
 		db.Exec(s) // ignore errors (column already exists)
 	}
+	if err := migrateLotStatusCheck(); err != nil {
+		return fmt.Errorf("migration error: %w", err)
+	}
 
 	// Enhanced audit logging migrations - MUST run BEFORE indexes
 	auditMigrations := []string{
@@ -691,6 +1208,7 @@ func runMigrations() error {
 		"CREATE INDEX IF NOT EXISTS idx_po_lines_ipn ON po_lines(ipn)",
 		"CREATE INDEX IF NOT EXISTS idx_work_orders_status ON work_orders(status)",
 		"CREATE INDEX IF NOT EXISTS idx_work_orders_assembly_ipn ON work_orders(assembly_ipn)",
+		"CREATE INDEX IF NOT EXISTS idx_work_orders_parent_wo_id ON work_orders(parent_wo_id)",
 		"CREATE INDEX IF NOT EXISTS idx_wo_serials_wo_id ON wo_serials(wo_id)",
 		"CREATE INDEX IF NOT EXISTS idx_test_records_serial_number ON test_records(serial_number)",
 		"CREATE INDEX IF NOT EXISTS idx_test_records_ipn ON test_records(ipn)",
@@ -746,7 +1264,44 @@ func runMigrations() error {
 		"CREATE INDEX IF NOT EXISTS idx_shipment_lines_shipment_id ON shipment_lines(shipment_id)",
 		"CREATE INDEX IF NOT EXISTS idx_field_reports_status ON field_reports(status)",
 		"CREATE INDEX IF NOT EXISTS idx_email_log_sent_at ON email_log(sent_at)",
-		
+		"CREATE INDEX IF NOT EXISTS idx_inventory_reservations_ipn_status ON inventory_reservations(ipn, status)",
+		"CREATE INDEX IF NOT EXISTS idx_inventory_reservations_ref ON inventory_reservations(ref_type, ref_id)",
+		"CREATE INDEX IF NOT EXISTS idx_routing_steps_assembly_ipn ON routing_steps(assembly_ipn)",
+		"CREATE INDEX IF NOT EXISTS idx_wo_operations_wo_id ON wo_operations(wo_id)",
+		"CREATE INDEX IF NOT EXISTS idx_labor_entries_wo_id ON labor_entries(wo_id)",
+		"CREATE INDEX IF NOT EXISTS idx_labor_entries_username_open ON labor_entries(username, clock_out)",
+		"CREATE INDEX IF NOT EXISTS idx_inventory_lots_ipn_status ON inventory_lots(ipn, status)",
+		"CREATE INDEX IF NOT EXISTS idx_inventory_lots_wo_id ON inventory_lots(wo_id)",
+		"CREATE INDEX IF NOT EXISTS idx_inventory_lots_expires_at ON inventory_lots(expires_at)",
+		"CREATE INDEX IF NOT EXISTS idx_msl_events_lot_id ON msl_events(lot_id)",
+		"CREATE INDEX IF NOT EXISTS idx_ownership_moves_reference ON ownership_moves(reference, ipn)",
+		"CREATE INDEX IF NOT EXISTS idx_inventory_transactions_lot_id ON inventory_transactions(lot_id)",
+		"CREATE INDEX IF NOT EXISTS idx_inventory_transactions_reference ON inventory_transactions(reference)",
+		"CREATE INDEX IF NOT EXISTS idx_mrp_requirements_run_ipn ON mrp_requirements(run_id, ipn)",
+		"CREATE INDEX IF NOT EXISTS idx_mrp_planned_orders_run_id ON mrp_planned_orders(run_id)",
+		"CREATE INDEX IF NOT EXISTS idx_po_suggestions_status ON po_suggestions(status)",
+		"CREATE INDEX IF NOT EXISTS idx_po_suggestion_lines_suggestion_id ON po_suggestion_lines(suggestion_id)",
+		"CREATE INDEX IF NOT EXISTS idx_serial_components_parent ON serial_components(parent_serial)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_serial_components_child ON serial_components(child_serial) WHERE component_type = 'serial'",
+		"CREATE INDEX IF NOT EXISTS idx_serial_components_lot_id ON serial_components(lot_id)",
+		"CREATE INDEX IF NOT EXISTS idx_wo_completions_wo_id ON wo_completions(wo_id)",
+		"CREATE INDEX IF NOT EXISTS idx_test_measurements_record ON test_measurements(test_record_id)",
+		"CREATE INDEX IF NOT EXISTS idx_test_measurements_name ON test_measurements(name)",
+		"CREATE INDEX IF NOT EXISTS idx_rework_orders_ncr_id ON rework_orders(ncr_id)",
+		"CREATE INDEX IF NOT EXISTS idx_rework_materials_wo_id ON rework_materials(wo_id)",
+		"CREATE INDEX IF NOT EXISTS idx_wo_picks_wo_id ON wo_picks(wo_id, ipn)",
+		"CREATE INDEX IF NOT EXISTS idx_locations_parent_code ON locations(parent_code)",
+		"CREATE INDEX IF NOT EXISTS idx_inventory_locations_location ON inventory_locations(location_code)",
+		"CREATE INDEX IF NOT EXISTS idx_cycle_count_tasks_date ON cycle_count_tasks(scheduled_date, status)",
+		"CREATE INDEX IF NOT EXISTS idx_cycle_count_tasks_ipn ON cycle_count_tasks(ipn)",
+		"CREATE INDEX IF NOT EXISTS idx_cost_layers_ipn ON cost_layers(ipn, qty_remaining)",
+		"CREATE INDEX IF NOT EXISTS idx_cost_layers_source_ref ON cost_layers(source_ref)",
+		"CREATE INDEX IF NOT EXISTS idx_cost_layer_issues_reference ON cost_layer_issues(reference)",
+		"CREATE INDEX IF NOT EXISTS idx_cost_layer_issues_ipn ON cost_layer_issues(ipn)",
+		"CREATE INDEX IF NOT EXISTS idx_scan_sessions_username_status ON scan_sessions(username, status)",
+		"CREATE INDEX IF NOT EXISTS idx_scan_session_lines_session_id ON scan_session_lines(session_id)",
+		"CREATE INDEX IF NOT EXISTS idx_scan_session_events_session_id ON scan_session_events(session_id, scan_id)",
+
 		// Performance optimization: Composite indexes for common query patterns
 		"CREATE INDEX IF NOT EXISTS idx_inventory_ipn_qty_on_hand ON inventory(ipn, qty_on_hand)",
 		"CREATE INDEX IF NOT EXISTS idx_inventory_ipn_qty_reserved ON inventory(ipn, qty_reserved)",
@@ -797,6 +1352,37 @@ func runMigrations() error {
 		}
 	}
 
+	// Carry pre-ledger reservations forward so the derived qty_reserved total
+	// doesn't drop to zero for IPNs that were reserved before the ledger
+	// existed. This runs once, while the ledger is still empty.
+	var ledgerRows int
+	db.QueryRow("SELECT COUNT(*) FROM inventory_reservations").Scan(&ledgerRows)
+	if ledgerRows == 0 {
+		if _, err := db.Exec(`INSERT INTO inventory_reservations (ref_type, ref_id, ipn, qty, created_by)
+			SELECT 'legacy', 'pre-ledger', ipn, qty_reserved, 'system' FROM inventory WHERE qty_reserved > 0`); err != nil {
+			log.Printf("Reservation ledger migration warning: %v", err)
+		}
+	}
+
+	// Stock that predates cost layers (or was loaded without them) opens a
+	// layer at its last PO price
+	if _, err := db.Exec(`INSERT INTO cost_layers (ipn, source_type, qty_received, qty_remaining, unit_cost, original_cost)
+		SELECT i.ipn, 'opening', i.qty_on_hand, i.qty_on_hand, p.price, p.price FROM inventory i,
+		(SELECT ii.ipn, COALESCE((SELECT pl.unit_price FROM po_lines pl JOIN purchase_orders po ON po.id = pl.po_id
+			WHERE pl.ipn = ii.ipn AND pl.unit_price > 0 ORDER BY po.created_at DESC, pl.id DESC LIMIT 1), 0) AS price FROM inventory ii) p
+		WHERE p.ipn = i.ipn AND i.qty_on_hand > 0 AND i.ipn NOT IN (SELECT DISTINCT ipn FROM cost_layers)`); err != nil {
+		log.Printf("Cost layer migration warning: %v", err)
+	}
+
+	// Start the scrap reason list with a default set the first time
+	var reasonCount int
+	db.QueryRow("SELECT COUNT(*) FROM scrap_reasons").Scan(&reasonCount)
+	if reasonCount == 0 {
+		for _, sr := range defaultScrapReasons {
+			db.Exec("INSERT OR IGNORE INTO scrap_reasons (code, description) VALUES (?, ?)", sr.Code, sr.Description)
+		}
+	}
+
 	// Initialize advanced search tables
 	if err := InitSearchTables(db); err != nil {
 		log.Printf("Search tables migration warning: %v", err)
@@ -965,6 +1551,38 @@ func seedDB() {
 }
 
 // ID generation helpers
+// migrateLotStatusCheck rebuilds inventory_lots in databases created before
+// lots could be quarantined, since SQLite can't alter a CHECK constraint.
+// The table is copied under its stored definition with the new status
+// allowed; its indexes are recreated with the others.
+func migrateLotStatusCheck() error {
+	var schema string
+	if err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type='table' AND name='inventory_lots'").Scan(&schema); err != nil {
+		return err
+	}
+	if strings.Contains(schema, "'quarantine'") {
+		return nil
+	}
+	schema = strings.Replace(schema, "'hold','depleted'", "'hold','quarantine','depleted'", 1)
+	schema = strings.Replace(schema, "inventory_lots", "inventory_lots_new", 1)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, s := range []string{
+		schema,
+		"INSERT INTO inventory_lots_new SELECT * FROM inventory_lots",
+		"DROP TABLE inventory_lots",
+		"ALTER TABLE inventory_lots_new RENAME TO inventory_lots",
+	} {
+		if _, err := tx.Exec(s); err != nil {
+			return fmt.Errorf("rebuilding inventory_lots: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
 func nextID(prefix string, table string, digits int) string {
 	year := time.Now().Format("2006")
 	pattern := prefix + "-" + year + "-%"
@@ -89,6 +89,12 @@ func setupAdvancedSearchTestDB(t *testing.T) *sql.DB {
 			description TEXT,
 			mpn TEXT,
 			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE inventory_locations (
+			ipn TEXT NOT NULL,
+			location_code TEXT NOT NULL,
+			qty_on_hand REAL DEFAULT 0,
+			PRIMARY KEY (ipn, location_code)
 		)
 	`)
 	if err != nil {
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ATPEvent is one planned move of an IPN's stock: an open PO line or WO
+// bringing it in, or an open sales order line or a WO's unreserved
+// component need taking it out. Projected is the stock after it.
+type ATPEvent struct {
+	Date      string  `json:"date"`
+	Source    string  `json:"source"`
+	Reference string  `json:"reference"`
+	Qty       float64 `json:"qty"`
+	Projected float64 `json:"projected"`
+}
+
+// ATPProjection is the time-phased stock of an IPN. It starts from the
+// stock we own on hand less what is reserved and what sits in lots that
+// can't be issued; supply without a date is listed under Undated and not
+// counted.
+type ATPProjection struct {
+	IPN       string     `json:"ipn"`
+	OnHand    float64    `json:"on_hand"`
+	Reserved  float64    `json:"reserved"`
+	Unusable  float64    `json:"unusable"`
+	Start     float64    `json:"start"`
+	Events    []ATPEvent `json:"events"`
+	Undated   []ATPEvent `json:"undated"`
+	Qty       float64    `json:"qty,omitempty"`
+	Available *string    `json:"available_date"`
+	Date      string     `json:"date,omitempty"`
+	ATP       *float64   `json:"atp,omitempty"`
+	CanShip   *bool      `json:"can_ship,omitempty"`
+	today     string
+}
+
+// projectATP builds the projection of ipn as of now. Sales order
+// excludeSO's own lines are left out so the order can be checked against
+// everything else.
+func projectATP(ipn, excludeSO string, now time.Time) (ATPProjection, error) {
+	today := now.Format("2006-01-02")
+	p := ATPProjection{IPN: ipn, Events: []ATPEvent{}, Undated: []ATPEvent{}, today: today}
+	db.QueryRow("SELECT COALESCE(qty_on_hand,0), COALESCE(qty_reserved,0) FROM inventory WHERE ipn=?", ipn).Scan(&p.OnHand, &p.Reserved)
+	customer, _ := ownershipQty(db, ipn)
+	p.OnHand = math.Max(0, p.OnHand-customer)
+	p.Unusable = unusableLotStock(db, ipn, now)
+	p.Start = p.OnHand - p.Reserved - p.Unusable
+
+	var events []ATPEvent
+	add := func(date, source, ref string, qty float64) {
+		e := ATPEvent{Date: date, Source: source, Reference: ref, Qty: qty}
+		switch {
+		case len(date) < 10:
+			e.Date = ""
+			p.Undated = append(p.Undated, e)
+			return
+		case date[:10] < today:
+			// Late supply is still expected, from today on
+			e.Date = today
+		default:
+			e.Date = date[:10]
+		}
+		events = append(events, e)
+	}
+
+	rows, err := db.Query(`SELECT p.id, COALESCE(p.expected_date,''), l.qty_ordered - l.qty_received FROM po_lines l
+		JOIN purchase_orders p ON p.id = l.po_id
+		WHERE l.ipn = ? AND p.status IN ('sent','confirmed','partial') AND l.qty_ordered > l.qty_received`, ipn)
+	if err != nil {
+		return p, err
+	}
+	for rows.Next() {
+		var ref, date string
+		var qty float64
+		rows.Scan(&ref, &date, &qty)
+		add(date, "po", ref, qty)
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT id, COALESCE(due_date,''), qty - COALESCE(qty_good,0) - COALESCE(qty_scrap,0) FROM work_orders
+		WHERE assembly_ipn = ? AND status IN ('draft','open','in_progress','on_hold') AND qty - COALESCE(qty_good,0) - COALESCE(qty_scrap,0) > 0`, ipn)
+	if err != nil {
+		return p, err
+	}
+	for rows.Next() {
+		var ref, date string
+		var qty float64
+		rows.Scan(&ref, &date, &qty)
+		add(date, "wo", ref, qty)
+	}
+	rows.Close()
+
+	if err := addWOComponentDemand(ipn, today, add); err != nil {
+		return p, err
+	}
+
+	// Confirmed orders not yet allocated; allocated ones are reserved.
+	// Orders carry no ship date, so their demand is due now.
+	rows, err = db.Query(`SELECT o.id, SUM(l.qty - l.qty_allocated) FROM sales_order_lines l
+		JOIN sales_orders o ON o.id = l.sales_order_id
+		WHERE l.ipn = ? AND o.status = 'confirmed' AND o.id != ? AND l.qty > l.qty_allocated GROUP BY o.id`, ipn, excludeSO)
+	if err != nil {
+		return p, err
+	}
+	for rows.Next() {
+		var ref string
+		var qty float64
+		rows.Scan(&ref, &qty)
+		events = append(events, ATPEvent{Date: today, Source: "so", Reference: ref, Qty: -qty})
+	}
+	rows.Close()
+
+	// Demand goes before supply on the same day
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Date != events[j].Date {
+			return events[i].Date < events[j].Date
+		}
+		return events[i].Qty < events[j].Qty
+	})
+	running := p.Start
+	for i := range events {
+		running += events[i].Qty
+		events[i].Projected = running
+	}
+	p.Events = append(p.Events, events...)
+	return p, nil
+}
+
+// addWOComponentDemand adds what open WOs still need of ipn as a component
+// on their due date, or now if they have none. As in MRP, what was already
+// issued or picked and not used by the units built is netted off, and so is
+// what is reserved to the WO, as that is already out of the opening stock.
+func addWOComponentDemand(ipn, today string, add func(date, source, ref string, qty float64)) error {
+	type openWO struct {
+		id, assembly, due string
+		qty, built        float64
+	}
+	var wos []openWO
+	rows, err := db.Query(`SELECT id, assembly_ipn, COALESCE(due_date,''), qty - COALESCE(qty_good,0), COALESCE(qty_good,0) + COALESCE(qty_scrap,0)
+		FROM work_orders WHERE status IN ('draft','open','in_progress','on_hold') AND qty > COALESCE(qty_good,0) AND assembly_ipn != ?`, ipn)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var wo openWO
+		rows.Scan(&wo.id, &wo.assembly, &wo.due, &wo.qty, &wo.built)
+		wos = append(wos, wo)
+	}
+	rows.Close()
+	if len(wos) == 0 {
+		return nil
+	}
+
+	issued := map[string]float64{}
+	rows, err = db.Query(`SELECT reference, SUM(CASE type WHEN 'issue' THEN qty ELSE -qty END) FROM inventory_transactions
+		WHERE ipn = ? AND type IN ('issue','return') GROUP BY reference`, ipn)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var ref string
+		var qty float64
+		rows.Scan(&ref, &qty)
+		issued[ref] = qty
+	}
+	rows.Close()
+
+	reserved := map[string]float64{}
+	rows, err = db.Query(`SELECT ref_id, SUM(qty) FROM inventory_reservations
+		WHERE ipn = ? AND ref_type = 'work_order' AND status = 'open' GROUP BY ref_id`, ipn)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var ref string
+		var qty float64
+		rows.Scan(&ref, &qty)
+		reserved[ref] = qty
+	}
+	rows.Close()
+
+	// Qty of ipn per unit of each assembly, one BOM read per assembly
+	per := map[string]float64{}
+	for _, wo := range wos {
+		if _, ok := per[wo.assembly]; ok {
+			continue
+		}
+		per[wo.assembly] = 0
+		tree, err := buildBOMTree(wo.assembly, 0, 0)
+		if err != nil {
+			continue
+		}
+		for _, c := range tree.Children {
+			if c.IPN == ipn {
+				per[wo.assembly] += c.Qty
+			}
+		}
+	}
+
+	for _, wo := range wos {
+		qtyPer := per[wo.assembly]
+		if qtyPer <= 0 {
+			continue
+		}
+		need := wo.qty * qtyPer
+		if wip := issued[wo.id] - wo.built*qtyPer; wip > 0 {
+			need -= wip
+		}
+		need -= reserved[wo.id]
+		if need <= 1e-9 {
+			continue
+		}
+		date := wo.due
+		if len(date) < 10 {
+			date = today
+		}
+		add(date, "wo_component", wo.id, -need)
+	}
+	return nil
+}
+
+// projectedOn is the projected stock at the end of date.
+func (p *ATPProjection) projectedOn(date string) float64 {
+	q := p.Start
+	for _, e := range p.Events {
+		if e.Date > date {
+			break
+		}
+		q = e.Projected
+	}
+	return q
+}
+
+// atpOn is how much can be promised for date without leaving any later
+// demand short: the lowest projected stock from date on.
+func (p *ATPProjection) atpOn(date string) float64 {
+	if date < p.today {
+		date = p.today
+	}
+	atp := p.projectedOn(date)
+	for _, e := range p.Events {
+		if e.Date > date && e.Projected < atp {
+			atp = e.Projected
+		}
+	}
+	return math.Max(0, atp)
+}
+
+// earliest is the first date qty can be promised for, nil if the planned
+// supply never covers it.
+func (p *ATPProjection) earliest(qty float64) *string {
+	dates := []string{p.today}
+	for _, e := range p.Events {
+		if e.Date > dates[len(dates)-1] {
+			dates = append(dates, e.Date)
+		}
+	}
+	for _, d := range dates {
+		if p.atpOn(d) >= qty-1e-9 {
+			date := d
+			return &date
+		}
+	}
+	return nil
+}
+
+// shortfall explains why qty of the IPN can't be promised now, including
+// when it can be.
+func (p *ATPProjection) shortfall(qty float64) string {
+	msg := fmt.Sprintf("insufficient inventory for %s: need %g, available %g", p.IPN, qty, math.Min(p.atpOn(p.today), math.Max(0, p.Start)))
+	if d := p.earliest(qty); d != nil {
+		return msg + ", available from " + *d
+	}
+	return msg + ", not covered by planned supply"
+}
+
+// QuoteLineATP tells sales whether a quote line can ship from stock now,
+// and if not, from when.
+type QuoteLineATP struct {
+	AvailableNow  float64 `json:"available_now"`
+	AvailableDate *string `json:"available_date"`
+}
+
+// attachQuoteATP fills in the ATP of each quote line.
+func attachQuoteATP(lines []QuoteLine) {
+	now := time.Now()
+	for i, l := range lines {
+		p, err := projectATP(l.IPN, "", now)
+		if err != nil {
+			continue
+		}
+		lines[i].ATP = &QuoteLineATP{AvailableNow: p.atpOn(p.today), AvailableDate: p.earliest(float64(l.Qty))}
+	}
+}
+
+// handleInventoryATP returns the projection of an IPN. With ?qty= it gives
+// the earliest date that qty is available; with ?date= as well it says
+// whether qty can ship by then.
+func handleInventoryATP(w http.ResponseWriter, r *http.Request, ipn string) {
+	ve := &ValidationErrors{}
+	var qty float64
+	if v := r.URL.Query().Get("qty"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n <= 0 {
+			ve.Add("qty", "must be a positive number")
+		}
+		qty = n
+	}
+	date := r.URL.Query().Get("date")
+	validateDate(ve, "date", date)
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	p, err := projectATP(ipn, "", time.Now())
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if qty > 0 {
+		p.Qty = qty
+		p.Available = p.earliest(qty)
+	}
+	if date != "" {
+		atp := p.atpOn(date)
+		p.Date, p.ATP = date, &atp
+		if qty > 0 {
+			ok := atp >= qty-1e-9
+			p.CanShip = &ok
+		}
+	}
+	jsonResp(w, p)
+}
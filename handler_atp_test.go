@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAvailableToPromise(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+
+	day := func(n int) string { return time.Now().AddDate(0, 0, n).Format("2006-01-02") }
+	stmts := []string{
+		`INSERT INTO inventory (ipn, qty_on_hand, qty_reserved) VALUES ('WID-1', 50, 10)`,
+		`INSERT INTO inventory_reservations (ref_type, ref_id, ipn, qty) VALUES ('work_order', 'WO-9', 'WID-1', 10)`,
+		`INSERT INTO purchase_orders (id, vendor_id, status, expected_date) VALUES ('PO-1', 'V-1', 'sent', '` + day(10) + `'),
+			('PO-2', 'V-1', 'confirmed', NULL), ('PO-3', 'V-1', 'draft', '` + day(2) + `')`,
+		`INSERT INTO po_lines (po_id, ipn, qty_ordered, qty_received) VALUES ('PO-1', 'WID-1', 100, 0), ('PO-2', 'WID-1', 30, 0), ('PO-3', 'WID-1', 500, 0)`,
+		`INSERT INTO work_orders (id, assembly_ipn, qty, qty_good, status, due_date) VALUES ('WO-1', 'WID-1', 25, 5, 'in_progress', '` + day(20) + `')`,
+		`INSERT INTO sales_orders (id, customer, status) VALUES ('SO-A', 'Acme', 'confirmed'), ('SO-B', 'Bolt', 'confirmed')`,
+		`INSERT INTO sales_order_lines (sales_order_id, ipn, qty) VALUES ('SO-A', 'WID-1', 60), ('SO-B', 'WID-1', 30)`,
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("seed failed: %v\n%s", err, s)
+		}
+	}
+
+	// 40 free now, both orders due now, the PO in 10 days and the WO in 20;
+	// the undated PO isn't counted and the draft PO isn't supply yet
+	p, err := projectATP("WID-1", "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Start != 40 || len(p.Events) != 4 || len(p.Undated) != 1 || p.Undated[0].Reference != "PO-2" {
+		t.Fatalf("unexpected projection: %+v", p)
+	}
+	if last := p.Events[3]; last.Reference != "WO-1" || last.Qty != 20 || last.Projected != 70 {
+		t.Errorf("expected the WO's remaining 20 to end at 70, got %+v", last)
+	}
+	if atp := p.atpOn(day(0)); atp != 0 {
+		t.Errorf("expected nothing to promise today, got %v", atp)
+	}
+	if d := p.earliest(50); d == nil || *d != day(10) {
+		t.Errorf("expected 50 from %s, got %v", day(10), d)
+	}
+	if d := p.earliest(70); d == nil || *d != day(20) {
+		t.Errorf("expected 70 from %s, got %v", day(20), d)
+	}
+	if d := p.earliest(71); d != nil {
+		t.Errorf("expected 71 never covered, got %s", *d)
+	}
+
+	w := httptest.NewRecorder()
+	handleInventoryATP(w, httptest.NewRequest("GET", "/api/v1/inventory/WID-1/atp?qty=50&date="+day(5), nil), "WID-1")
+	var resp struct {
+		Data ATPProjection `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != 200 || resp.Data.Available == nil || *resp.Data.Available != day(10) || resp.Data.CanShip == nil || *resp.Data.CanShip {
+		t.Errorf("expected 50 not by %s but from %s: %s", day(5), day(10), w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handleInventoryATP(w, httptest.NewRequest("GET", "/api/v1/inventory/WID-1/atp?qty=0", nil), "WID-1")
+	if w.Code != 400 {
+		t.Errorf("expected a zero qty to be refused, got %d", w.Code)
+	}
+
+	// SO-B's 30 would fit the free 40, but SO-A was confirmed first
+	w = httptest.NewRecorder()
+	handleAllocateSalesOrder(w, httptest.NewRequest("POST", "/api/v1/sales-orders/SO-B/allocate", nil), "SO-B")
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "available from "+day(10)) {
+		t.Errorf("expected allocation refused with a date, got %d %s", w.Code, w.Body.String())
+	}
+	db.Exec("UPDATE sales_orders SET status='draft' WHERE id='SO-A'")
+	w = httptest.NewRecorder()
+	handleAllocateSalesOrder(w, httptest.NewRequest("POST", "/api/v1/sales-orders/SO-B/allocate", nil), "SO-B")
+	if w.Code != 200 {
+		t.Fatalf("allocate failed: %d %s", w.Code, w.Body.String())
+	}
+
+	lines := []QuoteLine{{IPN: "WID-1", Qty: 60}, {IPN: "NEW-1", Qty: 1}}
+	attachQuoteATP(lines)
+	if a := lines[0].ATP; a == nil || a.AvailableNow != 10 || a.AvailableDate == nil || *a.AvailableDate != day(10) {
+		t.Errorf("unexpected quote ATP: %+v", lines[0].ATP)
+	}
+	if a := lines[1].ATP; a == nil || a.AvailableNow != 0 || a.AvailableDate != nil {
+		t.Errorf("expected an unstocked part to have no date, got %+v", lines[1].ATP)
+	}
+}
+
+func TestAvailableToPromiseLeavesOutUnusableLots(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+
+	day := func(n int) string { return time.Now().AddDate(0, 0, n).Format("2006-01-02") }
+	stmts := []string{
+		`INSERT INTO inventory (ipn, qty_on_hand) VALUES ('PASTE-1', 100)`,
+		`INSERT INTO inventory_lots (ipn, lot_number, qty_received, qty_on_hand, expires_at) VALUES ('PASTE-1', 'JAR-OLD', 30, 30, '` + day(-1) + `'),
+			('PASTE-1', 'JAR-NEW', 50, 50, '` + day(60) + `')`,
+		`INSERT INTO inventory_lots (ipn, lot_number, qty_received, qty_on_hand, status) VALUES ('PASTE-1', 'JAR-QA', 15, 15, 'quarantine')`,
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("seed failed: %v\n%s", err, s)
+		}
+	}
+
+	// The expired and quarantined jars can't ship; the fresh jar and the
+	// untracked 5 can
+	p, err := projectATP("PASTE-1", "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Unusable != 45 || p.Start != 55 {
+		t.Fatalf("expected 45 unusable and 55 to start from, got %+v", p)
+	}
+	if d := p.earliest(56); d != nil {
+		t.Errorf("expected 56 never covered, got %s", *d)
+	}
+}
+
+func TestAvailableToPromiseTakesOutWOComponentDemand(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+
+	dir := t.TempDir()
+	oldPartsDir := partsDir
+	partsDir = dir
+	defer func() { partsDir = oldPartsDir }()
+	createBOMFile(t, dir, "ASY-1", [][]string{
+		{"IPN", "qty", "ref"},
+		{"RES-1", "2", "R1,R2"},
+	})
+
+	day := func(n int) string { return time.Now().AddDate(0, 0, n).Format("2006-01-02") }
+	stmts := []string{
+		`INSERT INTO inventory (ipn, qty_on_hand, qty_reserved) VALUES ('RES-1', 100, 6)`,
+		`INSERT INTO work_orders (id, assembly_ipn, qty, qty_good, status, due_date) VALUES ('WO-1', 'ASY-1', 10, 2, 'in_progress', '` + day(5) + `'),
+			('WO-2', 'ASY-1', 4, 0, 'open', NULL), ('WO-3', 'ASY-1', 50, 0, 'completed', '` + day(5) + `')`,
+		`INSERT INTO inventory_reservations (ref_type, ref_id, ipn, qty) VALUES ('work_order', 'WO-1', 'RES-1', 6)`,
+		`INSERT INTO inventory_transactions (ipn, type, qty, reference) VALUES ('RES-1', 'issue', 8, 'WO-1')`,
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("seed failed: %v\n%s", err, s)
+		}
+	}
+
+	// WO-1 needs 16 for its last 8 units: 4 issued beyond the 2 built and 6
+	// reserved leave 6. Undated WO-2 needs 8 now; the closed WO-3 nothing.
+	p, err := projectATP("RES-1", "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Start != 94 || len(p.Events) != 2 {
+		t.Fatalf("unexpected projection: %+v", p)
+	}
+	if e := p.Events[0]; e.Reference != "WO-2" || e.Source != "wo_component" || e.Date != day(0) || e.Qty != -8 {
+		t.Errorf("expected WO-2's 8 due now, got %+v", e)
+	}
+	if e := p.Events[1]; e.Reference != "WO-1" || e.Date != day(5) || e.Qty != -6 || e.Projected != 80 {
+		t.Errorf("expected WO-1's 6 on %s ending at 80, got %+v", day(5), e)
+	}
+	if atp := p.atpOn(day(0)); atp != 80 {
+		t.Errorf("expected 80 to promise today, got %v", atp)
+	}
+}
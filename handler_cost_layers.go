@@ -0,0 +1,404 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// CostLayer is stock of an IPN that came in at one cost: a receipt at its
+// PO price, a WO's output at the component cost it consumed, a return, or
+// stock found by an adjustment. Consumption relieves the oldest layers
+// first. Under the average method every open layer of an IPN carries the
+// moving-average cost; OriginalCost keeps what the layer came in at.
+type CostLayer struct {
+	ID           int     `json:"id"`
+	IPN          string  `json:"ipn"`
+	Source       string  `json:"source"`
+	SourceRef    string  `json:"source_ref"`
+	QtyReceived  float64 `json:"qty_received"`
+	QtyRemaining float64 `json:"qty_remaining"`
+	UnitCost     float64 `json:"unit_cost"`
+	OriginalCost float64 `json:"original_cost"`
+	CreatedAt    string  `json:"created_at"`
+}
+
+// CostLayerIssue is stock taken out of a layer and the cost it took with
+// it. LayerID is nil for stock that had no layer to come out of.
+type CostLayerIssue struct {
+	ID        int     `json:"id"`
+	LayerID   *int    `json:"layer_id"`
+	IPN       string  `json:"ipn"`
+	Kind      string  `json:"kind"`
+	Reference string  `json:"reference"`
+	Qty       float64 `json:"qty"`
+	UnitCost  float64 `json:"unit_cost"`
+	Cost      float64 `json:"cost"`
+	CreatedAt string  `json:"created_at"`
+}
+
+type CostingSettings struct {
+	Method string `json:"method"`
+}
+
+const costingMethodKey = "costing_method"
+
+// costingMethod returns the company's costing method, fifo unless set.
+func costingMethod(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}) string {
+	var m string
+	q.QueryRow("SELECT value FROM app_settings WHERE key=?", costingMethodKey).Scan(&m)
+	if m == "" {
+		return "fifo"
+	}
+	return m
+}
+
+// currentUnitCost is what stock of ipn is worth now: the moving average, or
+// under FIFO the newest layer's cost, falling back to the last PO price.
+func currentUnitCost(tx *sql.Tx, ipn string) float64 {
+	var qty, value, newest float64
+	tx.QueryRow("SELECT COALESCE(SUM(qty_remaining),0), COALESCE(SUM(qty_remaining*unit_cost),0) FROM cost_layers WHERE ipn=? AND qty_remaining > 0",
+		ipn).Scan(&qty, &value)
+	if costingMethod(tx) == "average" && qty > 0 {
+		return value / qty
+	}
+	if tx.QueryRow("SELECT unit_cost FROM cost_layers WHERE ipn=? ORDER BY id DESC LIMIT 1", ipn).Scan(&newest) == nil {
+		return newest
+	}
+	return lastPOUnitPrice(tx, ipn)
+}
+
+// addCostLayer puts qty of ipn into a new layer. Under the average method
+// the IPN's open layers are then re-costed at the new average.
+func addCostLayer(tx *sql.Tx, ipn, source, ref string, qty, unitCost float64, now string) error {
+	if qty <= 0 {
+		return nil
+	}
+	_, err := tx.Exec(`INSERT INTO cost_layers (ipn, source_type, source_ref, qty_received, qty_remaining, unit_cost, original_cost, created_at)
+		VALUES (?,?,?,?,?,?,?,?)`, ipn, source, ref, qty, qty, unitCost, unitCost, now)
+	if err != nil {
+		return fmt.Errorf("failed to add cost layer for %s: %w", ipn, err)
+	}
+	if costingMethod(tx) == "average" {
+		return averageCostLayers(tx, ipn)
+	}
+	return nil
+}
+
+// averageCostLayers re-costs the open layers of ipn at their average cost.
+func averageCostLayers(tx *sql.Tx, ipn string) error {
+	var qty, value float64
+	tx.QueryRow("SELECT COALESCE(SUM(qty_remaining),0), COALESCE(SUM(qty_remaining*unit_cost),0) FROM cost_layers WHERE ipn=? AND qty_remaining > 0",
+		ipn).Scan(&qty, &value)
+	if qty <= 0 {
+		return nil
+	}
+	_, err := tx.Exec("UPDATE cost_layers SET unit_cost=? WHERE ipn=? AND qty_remaining > 0", value/qty, ipn)
+	return err
+}
+
+// relieveCostLayers takes qty of ipn out of its layers, oldest first, and
+// records what each draw cost against reference. Reversals undo the latest
+// stock first, starting with the reference's own layers. Stock with no
+// layer left is costed at the current cost. It returns the total cost
+// relieved.
+func relieveCostLayers(tx *sql.Tx, ipn string, qty float64, kind, reference, now string) (float64, error) {
+	type open struct {
+		id        int
+		remaining float64
+		unitCost  float64
+	}
+	order := "id"
+	if kind == "reversal" {
+		order = "(source_ref = ?) DESC, id DESC"
+	}
+	args := []interface{}{ipn}
+	if kind == "reversal" {
+		args = append(args, reference)
+	}
+	rows, err := tx.Query("SELECT id, qty_remaining, unit_cost FROM cost_layers WHERE ipn=? AND qty_remaining > 0 ORDER BY "+order, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load cost layers for %s: %w", ipn, err)
+	}
+	var layers []open
+	for rows.Next() {
+		var l open
+		rows.Scan(&l.id, &l.remaining, &l.unitCost)
+		layers = append(layers, l)
+	}
+	rows.Close()
+
+	total := 0.0
+	remaining := qty
+	record := func(layerID interface{}, q, unitCost float64) error {
+		_, err := tx.Exec(`INSERT INTO cost_layer_issues (layer_id, ipn, kind, reference, qty, unit_cost, created_at) VALUES (?,?,?,?,?,?,?)`,
+			layerID, ipn, kind, reference, q, unitCost, now)
+		total += q * unitCost
+		return err
+	}
+	for _, l := range layers {
+		if remaining <= 1e-9 {
+			break
+		}
+		take := math.Min(l.remaining, remaining)
+		if _, err := tx.Exec("UPDATE cost_layers SET qty_remaining = MAX(0, qty_remaining - ?) WHERE id=?", take, l.id); err != nil {
+			return 0, fmt.Errorf("failed to relieve cost layer %d: %w", l.id, err)
+		}
+		if err := record(l.id, take, l.unitCost); err != nil {
+			return 0, err
+		}
+		remaining -= take
+	}
+	if remaining > 1e-9 {
+		if err := record(nil, remaining, currentUnitCost(tx, ipn)); err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// syncCostLayers brings the layers of ipn in line with its on-hand qty
+// after stock moved, the way fitLocatedStock does for locations. Stock that
+// left is relieved as kind against reference; stock that arrived goes into
+// a layer at unitCost, or when that is zero at the cost it was issued to
+// reference at (for returns) or the current cost. Layers carry the stock
+// we own: customer-owned stock is left out and stock consigned to a CM is
+// counted. Databases without cost layers are left alone.
+func syncCostLayers(tx *sql.Tx, ipn, kind, reference string, unitCost float64, now string) error {
+	var onHand, layered float64
+	if tx.QueryRow("SELECT qty_on_hand FROM inventory WHERE ipn=?", ipn).Scan(&onHand) != nil {
+		return nil
+	}
+	if tx.QueryRow("SELECT COALESCE(SUM(qty_remaining),0) FROM cost_layers WHERE ipn=?", ipn).Scan(&layered) != nil {
+		return nil
+	}
+	customer, consigned := ownershipQty(tx, ipn)
+	diff := math.Max(0, onHand-customer+consigned) - layered
+	if diff < -1e-9 {
+		_, err := relieveCostLayers(tx, ipn, -diff, kind, reference, now)
+		return err
+	}
+	if diff <= 1e-9 {
+		return nil
+	}
+
+	source := "adjust"
+	switch kind {
+	case "receipt", "wo":
+		source = kind
+	case "return", "reversal":
+		source = "return"
+	}
+	if unitCost <= 0 && source == "return" && reference != "" {
+		var qty, cost float64
+		tx.QueryRow("SELECT COALESCE(SUM(qty),0), COALESCE(SUM(qty*unit_cost),0) FROM cost_layer_issues WHERE ipn=? AND reference=?",
+			ipn, reference).Scan(&qty, &cost)
+		if qty > 0 {
+			unitCost = cost / qty
+		}
+	}
+	if unitCost <= 0 {
+		unitCost = currentUnitCost(tx, ipn)
+	}
+	return addCostLayer(tx, ipn, source, reference, diff, unitCost, now)
+}
+
+// woWIPCost is the component cost a WO has consumed and not yet
+// capitalized into its output or returned to stock.
+func woWIPCost(tx *sql.Tx, woID string) float64 {
+	var consumed, out float64
+	tx.QueryRow("SELECT COALESCE(SUM(qty*unit_cost),0) FROM cost_layer_issues WHERE reference=? AND kind IN ('issue','scrap','reversal')",
+		woID).Scan(&consumed)
+	tx.QueryRow("SELECT COALESCE(SUM(qty_received*original_cost),0) FROM cost_layers WHERE source_ref=? AND source_type IN ('wo','return')",
+		woID).Scan(&out)
+	return math.Max(0, consumed-out)
+}
+
+// costIssueMark returns the id of the latest cost layer draw, so the draws
+// made after it can be told apart.
+func costIssueMark(tx *sql.Tx) int {
+	var id int
+	tx.QueryRow("SELECT COALESCE(MAX(id),0) FROM cost_layer_issues").Scan(&id)
+	return id
+}
+
+// capitalizeWO puts qty of a WO's output into a layer carrying the
+// component cost the WO consumed. A partial completion carries what was
+// backflushed for it (drawn after mark) plus its share of the rest of the
+// WIP, such as picked material, spread over the units not yet capitalized.
+// Closing the WO (final) capitalizes whatever is left, so the cost of
+// scrapped units is absorbed by the good ones.
+// inventory.qty_on_hand is left to the caller.
+func capitalizeWO(tx *sql.Tx, woID, ipn string, qty float64, mark int, final bool, now string) error {
+	if qty <= 0 {
+		return nil
+	}
+	var woQty, capitalized, reversed, backflushed float64
+	tx.QueryRow("SELECT qty FROM work_orders WHERE id=?", woID).Scan(&woQty)
+	if tx.QueryRow("SELECT COALESCE(SUM(qty_received),0) FROM cost_layers WHERE source_ref=? AND source_type='wo'", woID).Scan(&capitalized) != nil {
+		return nil
+	}
+	wip := woWIPCost(tx, woID)
+	cost := wip
+	if !final {
+		tx.QueryRow("SELECT COALESCE(SUM(qty),0) FROM cost_layer_issues WHERE reference=? AND ipn=? AND kind='reversal'", woID, ipn).Scan(&reversed)
+		tx.QueryRow("SELECT COALESCE(SUM(qty*unit_cost),0) FROM cost_layer_issues WHERE reference=? AND kind='issue' AND id > ?",
+			woID, mark).Scan(&backflushed)
+		backflushed = math.Min(backflushed, wip)
+		left := math.Max(qty, woQty-capitalized+reversed)
+		cost = backflushed + (wip-backflushed)*qty/left
+	}
+	return addCostLayer(tx, ipn, "wo", woID, qty, cost/qty, now)
+}
+
+const costLayerColumns = `id, ipn, source_type, COALESCE(source_ref,''), qty_received, qty_remaining, unit_cost, original_cost, created_at`
+
+func loadCostLayers(where string, args ...interface{}) ([]CostLayer, error) {
+	rows, err := db.Query("SELECT "+costLayerColumns+" FROM cost_layers WHERE "+where+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	layers := []CostLayer{}
+	for rows.Next() {
+		var l CostLayer
+		if err := rows.Scan(&l.ID, &l.IPN, &l.Source, &l.SourceRef, &l.QtyReceived, &l.QtyRemaining, &l.UnitCost, &l.OriginalCost, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		l.UnitCost = math.Round(l.UnitCost*10000) / 10000
+		layers = append(layers, l)
+	}
+	return layers, rows.Err()
+}
+
+// layerValues returns the layered qty and value of every IPN with open
+// layers.
+func layerValues() (map[string][2]float64, error) {
+	rows, err := db.Query("SELECT ipn, SUM(qty_remaining), SUM(qty_remaining*unit_cost) FROM cost_layers WHERE qty_remaining > 0 GROUP BY ipn")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := map[string][2]float64{}
+	for rows.Next() {
+		var ipn string
+		var qty, value float64
+		rows.Scan(&ipn, &qty, &value)
+		values[ipn] = [2]float64{qty, value}
+	}
+	return values, rows.Err()
+}
+
+// handleInventoryCostLayers lists the layers of an IPN, open ones only
+// unless ?all=true, with the draws taken from them.
+func handleInventoryCostLayers(w http.ResponseWriter, r *http.Request, ipn string) {
+	where := "ipn=? AND qty_remaining > 0"
+	if r.URL.Query().Get("all") == "true" {
+		where = "ipn=?"
+	}
+	layers, err := loadCostLayers(where, ipn)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	var qty, value float64
+	for _, l := range layers {
+		if l.QtyRemaining > 0 {
+			qty += l.QtyRemaining
+			value += l.QtyRemaining * l.UnitCost
+		}
+	}
+
+	rows, err := db.Query(`SELECT id, layer_id, ipn, kind, COALESCE(reference,''), qty, unit_cost, created_at
+		FROM cost_layer_issues WHERE ipn=? ORDER BY id DESC LIMIT 100`, ipn)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	issues := []CostLayerIssue{}
+	for rows.Next() {
+		var i CostLayerIssue
+		var layerID sql.NullInt64
+		rows.Scan(&i.ID, &layerID, &i.IPN, &i.Kind, &i.Reference, &i.Qty, &i.UnitCost, &i.CreatedAt)
+		if layerID.Valid {
+			id := int(layerID.Int64)
+			i.LayerID = &id
+		}
+		i.Cost = roundCost(i.Qty * i.UnitCost)
+		issues = append(issues, i)
+	}
+
+	unit := 0.0
+	if qty > 0 {
+		unit = math.Round(value/qty*10000) / 10000
+	}
+	jsonResp(w, map[string]interface{}{"ipn": ipn, "method": costingMethod(db), "qty": qty, "value": roundCost(value),
+		"unit_cost": unit, "layers": layers, "issues": issues})
+}
+
+func handleGetCostingSettings(w http.ResponseWriter, r *http.Request) {
+	jsonResp(w, CostingSettings{Method: costingMethod(db)})
+}
+
+// handlePutCostingSettings switches the costing method. Moving to average
+// re-costs every IPN's open layers at their average straight away; moving
+// to FIFO keeps the layers at the cost they carry.
+func handlePutCostingSettings(w http.ResponseWriter, r *http.Request) {
+	var s CostingSettings
+	if err := decodeBody(r, &s); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	s.Method = strings.ToLower(s.Method)
+	ve := &ValidationErrors{}
+	requireField(ve, "method", s.Method)
+	validateEnum(ve, "method", s.Method, validCostingMethods)
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	var ipns []string
+	rows, err := db.Query("SELECT DISTINCT ipn FROM cost_layers WHERE qty_remaining > 0")
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	for rows.Next() {
+		var ipn string
+		rows.Scan(&ipn)
+		ipns = append(ipns, ipn)
+	}
+	rows.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`INSERT INTO app_settings (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value`,
+		costingMethodKey, s.Method); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if s.Method == "average" {
+		for _, ipn := range ipns {
+			if err = averageCostLayers(tx, ipn); err != nil {
+				jsonErr(w, err.Error(), 500)
+				return
+			}
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, getUsername(r), "updated", "settings", "costing", "Set inventory costing method to "+s.Method)
+	jsonResp(w, s)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+type costLayersResp struct {
+	Method   string           `json:"method"`
+	Qty      float64          `json:"qty"`
+	Value    float64          `json:"value"`
+	UnitCost float64          `json:"unit_cost"`
+	Layers   []CostLayer      `json:"layers"`
+	Issues   []CostLayerIssue `json:"issues"`
+}
+
+func costLayers(t *testing.T, ipn string) costLayersResp {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleInventoryCostLayers(w, httptest.NewRequest("GET", "/api/v1/inventory/"+ipn+"/cost-layers", nil), ipn)
+	if w.Code != 200 {
+		t.Fatalf("cost layers failed: %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Data costLayersResp `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp.Data
+}
+
+func issuedCost(reference, ipn string) float64 {
+	var cost float64
+	db.QueryRow("SELECT COALESCE(SUM(qty*unit_cost),0) FROM cost_layer_issues WHERE reference=? AND ipn=?", reference, ipn).Scan(&cost)
+	return math.Round(cost*10000) / 10000
+}
+
+func TestCostLayersFIFOAndAverage(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+
+	stmts := []string{
+		`INSERT INTO inventory (ipn, qty_on_hand) VALUES ('IC-1', 0)`,
+		`INSERT INTO purchase_orders (id, vendor_id, status, created_at) VALUES ('PO-1', 'V-1', 'sent', '2026-01-01 00:00:00'),
+			('PO-2', 'V-1', 'sent', '2026-02-01 00:00:00'), ('PO-3', 'V-1', 'sent', '2026-03-01 00:00:00')`,
+		`INSERT INTO po_lines (id, po_id, ipn, qty_ordered, unit_price) VALUES (1, 'PO-1', 'IC-1', 10, 2), (2, 'PO-2', 'IC-1', 10, 3), (3, 'PO-3', 'IC-1', 20, 3.5)`,
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("seed failed: %v\n%s", err, s)
+		}
+	}
+	receive := func(po, line, qty string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handleReceivePO(w, httptest.NewRequest("POST", "/api/v1/pos/"+po+"/receive",
+			bytes.NewBufferString(`{"lines":[{"id":`+line+`,"qty":`+qty+`}],"skip_inspection":true}`)), po)
+		if w.Code != 200 {
+			t.Fatalf("receive %s failed: %d %s", po, w.Code, w.Body.String())
+		}
+	}
+	receive("PO-1", "1", "10")
+	receive("PO-2", "2", "10")
+	if l := costLayers(t, "IC-1"); len(l.Layers) != 2 || l.Layers[0].UnitCost != 2 || l.Layers[1].UnitCost != 3 || l.Method != "fifo" || l.Value != 50 {
+		t.Fatalf("unexpected layers after receipts: %+v", l)
+	}
+
+	// FIFO: the issue comes out of the oldest layer, and the return goes
+	// back in at the cost it left at
+	postTransact(t, `{"ipn":"IC-1","type":"issue","qty":10,"reference":"JOB-1"}`)
+	if c := issuedCost("JOB-1", "IC-1"); c != 20 {
+		t.Errorf("expected 10 issued at 2, got %v", c)
+	}
+	postTransact(t, `{"ipn":"IC-1","type":"return","qty":10,"reference":"JOB-1"}`)
+	l := costLayers(t, "IC-1")
+	if len(l.Layers) != 2 || l.Layers[0].UnitCost != 3 || l.Layers[1].Source != "return" || l.Layers[1].UnitCost != 2 || l.Qty != 20 {
+		t.Fatalf("unexpected layers after return: %+v", l)
+	}
+
+	// Average: open layers take the average, receipts re-average
+	w := httptest.NewRecorder()
+	handlePutCostingSettings(w, httptest.NewRequest("PUT", "/api/v1/settings/costing", bytes.NewBufferString(`{"method":"lifo"}`)))
+	if w.Code != 400 {
+		t.Errorf("expected 400 for an unknown method, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handlePutCostingSettings(w, httptest.NewRequest("PUT", "/api/v1/settings/costing", bytes.NewBufferString(`{"method":"average"}`)))
+	if w.Code != 200 {
+		t.Fatalf("settings update failed: %d %s", w.Code, w.Body.String())
+	}
+	if l := costLayers(t, "IC-1"); l.Method != "average" || l.UnitCost != 2.5 || l.Layers[0].OriginalCost != 3 {
+		t.Fatalf("unexpected layers after switching to average: %+v", l)
+	}
+	receive("PO-3", "3", "20")
+	postTransact(t, `{"ipn":"IC-1","type":"issue","qty":4,"reference":"JOB-2"}`)
+	if c := issuedCost("JOB-2", "IC-1"); c != 12 {
+		t.Errorf("expected 4 issued at an average of 3, got %v", c)
+	}
+	if l := costLayers(t, "IC-1"); l.Qty != 36 || l.Value != 108 || len(l.Issues) != 2 {
+		t.Errorf("unexpected layers after average issue: %+v", l)
+	}
+
+	w = httptest.NewRecorder()
+	handleReportInventoryValuation(w, httptest.NewRequest("GET", "/api/v1/reports/inventory-valuation", nil))
+	var val struct {
+		Data InvValuationReport `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &val)
+	if val.Data.GrandTotal != 108 || val.Data.Method != "average" {
+		t.Errorf("expected valuation of 108 at average cost, got %s", w.Body.String())
+	}
+}
+
+func TestCostLayersWOCapitalization(t *testing.T) {
+	oldDB, oldPartsDir := db, partsDir
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB; partsDir = oldPartsDir }()
+	seedCompletionWO(t)
+	db.Exec(`INSERT INTO cost_layers (ipn, source_type, qty_received, qty_remaining, unit_cost, original_cost, created_at) VALUES
+		('RES-1', 'opening', 60, 60, 1, 1, '2026-01-01 00:00:00'), ('RES-1', 'receipt', 40, 40, 1.5, 1.5, '2026-02-01 00:00:00'),
+		('CAP-1', 'opening', 50, 50, 0.2, 0.2, '2026-01-01 00:00:00')`)
+
+	// Each completion carries what was backflushed for it; scrapped units'
+	// material is absorbed when the WO closes
+	postWOEvent(t, "complete", `{"qty":4}`)
+	postWOEvent(t, "scrap", `{"qty":2,"reason_code":"SOLDER"}`)
+	_, closing := postWOEvent(t, "complete", `{"qty":4}`)
+	if closing.Data.WOStatus != "completed" {
+		t.Fatalf("expected WO completed, got %+v", closing.Data)
+	}
+	l := costLayers(t, "ASY-1")
+	if len(l.Layers) != 2 || l.Layers[0].UnitCost != 2.2 || l.Layers[1].UnitCost != 3.3 || l.Layers[1].SourceRef != "WO-1" {
+		t.Fatalf("unexpected output layers: %+v", l.Layers)
+	}
+	if c := issuedCost("WO-1", "RES-1"); c != 20 {
+		t.Errorf("expected 20 RES-1 issued at 1, got %v", c)
+	}
+
+	// Undo takes the latest output back out and returns the components at
+	// the cost they were issued at
+	if w := undoEvent(t, closing.Data.UndoID); w.Code != 200 {
+		t.Fatalf("undo failed: %d %s", w.Code, w.Body.String())
+	}
+	if l := costLayers(t, "ASY-1"); len(l.Layers) != 1 || l.Layers[0].UnitCost != 2.2 || l.Qty != 4 {
+		t.Errorf("expected the 2.2 layer left, got %+v", l.Layers)
+	}
+	if l := costLayers(t, "RES-1"); l.Qty != 88 || l.Layers[len(l.Layers)-1].Source != "return" || l.Layers[len(l.Layers)-1].UnitCost != 1 {
+		t.Errorf("expected RES-1 returned at 1, got %+v", l)
+	}
+	tx, _ := db.Begin()
+	wip := woWIPCost(tx, "WO-1")
+	tx.Rollback()
+	if math.Abs(wip-4.4) > 1e-9 {
+		t.Errorf("expected the scrapped units' 4.4 left in WIP, got %v", wip)
+	}
+}
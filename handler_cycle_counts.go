@@ -0,0 +1,823 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CycleCountClass holds the settings of an ABC class. IPNs are ranked by
+// transaction value; those making up the first value_pct percent of the
+// total fall in A, up to B's value_pct in B, and the rest in C.
+type CycleCountClass struct {
+	Class         string  `json:"class"`
+	ValuePct      float64 `json:"value_pct"`
+	FrequencyDays int     `json:"frequency_days"`
+	TolerancePct  float64 `json:"tolerance_pct"`
+	ItemCount     int     `json:"item_count"`
+}
+
+// CycleCountItem is the current class of an IPN.
+type CycleCountItem struct {
+	IPN           string  `json:"ipn"`
+	Class         string  `json:"abc_class"`
+	AnnualValue   float64 `json:"annual_value"`
+	ClassifiedAt  string  `json:"classified_at"`
+	LastCountedAt *string `json:"last_counted_at"`
+	NextDue       string  `json:"next_due"`
+}
+
+// CycleCountTask is one IPN to count on a day. The expected qty is taken
+// when the count is entered, so counters count blind.
+type CycleCountTask struct {
+	ID              int      `json:"id"`
+	IPN             string   `json:"ipn"`
+	Class           string   `json:"abc_class"`
+	ScheduledDate   string   `json:"scheduled_date"`
+	Status          string   `json:"status"`
+	ExpectedQty     *float64 `json:"expected_qty"`
+	CountedQty      *float64 `json:"counted_qty"`
+	VarianceQty     *float64 `json:"variance_qty"`
+	VariancePct     *float64 `json:"variance_pct"`
+	UnitCost        float64  `json:"unit_cost"`
+	VarianceValue   *float64 `json:"variance_value"`
+	WithinTolerance *bool    `json:"within_tolerance"`
+	CountedBy       string   `json:"counted_by"`
+	CountedAt       *string  `json:"counted_at"`
+	ReviewedBy      string   `json:"reviewed_by"`
+	ReviewedAt      *string  `json:"reviewed_at"`
+	ReviewNotes     string   `json:"review_notes"`
+	Notes           string   `json:"notes"`
+	CreatedAt       string   `json:"created_at"`
+}
+
+// CycleCountAccuracy sums up the counts of a period or class. A count is
+// accurate when it is within its class's tolerance; value accuracy is one
+// less the absolute variance value over the expected value.
+type CycleCountAccuracy struct {
+	Key              string  `json:"key"`
+	Counts           int     `json:"counts"`
+	Accurate         int     `json:"accurate"`
+	AccuracyPct      float64 `json:"accuracy_pct"`
+	ExpectedValue    float64 `json:"expected_value"`
+	NetVarianceValue float64 `json:"net_variance_value"`
+	AbsVarianceValue float64 `json:"abs_variance_value"`
+	ValueAccuracyPct float64 `json:"value_accuracy_pct"`
+}
+
+const (
+	cycleCountLookbackDays   = 365
+	cycleCountReclassifyDays = 30
+)
+
+var cycleCountDefaults = []CycleCountClass{
+	{Class: "A", ValuePct: 80, FrequencyDays: 30, TolerancePct: 1},
+	{Class: "B", ValuePct: 95, FrequencyDays: 90, TolerancePct: 2},
+	{Class: "C", ValuePct: 100, FrequencyDays: 180, TolerancePct: 5},
+}
+
+// lastPOPriceSQL is the most recent non-zero PO price of inventory row i.
+const lastPOPriceSQL = `COALESCE((SELECT pl.unit_price FROM po_lines pl JOIN purchase_orders po ON po.id = pl.po_id
+	WHERE pl.ipn = i.ipn AND pl.unit_price > 0 ORDER BY po.created_at DESC, pl.id DESC LIMIT 1), 0)`
+
+// loadCycleCountClasses returns the A, B and C settings, falling back to
+// the defaults for classes that haven't been set.
+func loadCycleCountClasses() map[string]CycleCountClass {
+	classes := map[string]CycleCountClass{}
+	for _, c := range cycleCountDefaults {
+		classes[c.Class] = c
+	}
+	rows, err := db.Query("SELECT class, value_pct, frequency_days, tolerance_pct FROM cycle_count_classes")
+	if err != nil {
+		return classes
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c CycleCountClass
+		if rows.Scan(&c.Class, &c.ValuePct, &c.FrequencyDays, &c.TolerancePct) == nil {
+			classes[c.Class] = c
+		}
+	}
+	return classes
+}
+
+// classifyABC ranks every inventory IPN by the value of the stock it
+// received and issued over the last lookbackDays, at its last PO price, and
+// stores its class. When a count was last taken is kept.
+func classifyABC(lookbackDays int, now time.Time) (map[string]int, error) {
+	classes := loadCycleCountClasses()
+	since := now.AddDate(0, 0, -lookbackDays).Format("2006-01-02 15:04:05")
+	rows, err := db.Query(`SELECT i.ipn, `+lastPOPriceSQL+` * COALESCE((SELECT SUM(ABS(t.qty)) FROM inventory_transactions t
+		WHERE t.ipn = i.ipn AND t.type IN ('receive','issue') AND t.created_at >= ?), 0) FROM inventory i`, since)
+	if err != nil {
+		return nil, err
+	}
+	type ranked struct {
+		ipn   string
+		value float64
+	}
+	var items []ranked
+	total := 0.0
+	for rows.Next() {
+		var it ranked
+		rows.Scan(&it.ipn, &it.value)
+		items = append(items, it)
+		total += it.value
+	}
+	rows.Close()
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].value != items[j].value {
+			return items[i].value > items[j].value
+		}
+		return items[i].ipn < items[j].ipn
+	})
+
+	ts := now.Format("2006-01-02 15:04:05")
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	counts := map[string]int{"A": 0, "B": 0, "C": 0}
+	cum := 0.0
+	for _, it := range items {
+		// An IPN's class is set by the share of value ranked above it
+		class := "C"
+		if it.value > 0 {
+			share := cum / total * 100
+			if share < classes["A"].ValuePct {
+				class = "A"
+			} else if share < classes["B"].ValuePct {
+				class = "B"
+			}
+		}
+		cum += it.value
+		counts[class]++
+		if _, err := tx.Exec(`INSERT INTO cycle_count_items (ipn, abc_class, annual_value, classified_at) VALUES (?,?,?,?)
+			ON CONFLICT(ipn) DO UPDATE SET abc_class=excluded.abc_class, annual_value=excluded.annual_value, classified_at=excluded.classified_at`,
+			it.ipn, class, roundCost(it.value*365/float64(lookbackDays)), ts); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM cycle_count_items WHERE ipn NOT IN (SELECT ipn FROM inventory)"); err != nil {
+		return nil, err
+	}
+	return counts, tx.Commit()
+}
+
+// generateCycleCounts schedules the day's counts. Each class counts its
+// IPNs once per frequency_days, spread evenly: a day gets at most
+// ceil(items / frequency_days) of a class, never-counted and longest-ago
+// counted IPNs first. IPNs with a count already open are skipped, and
+// running it again for the same day adds nothing.
+func generateCycleCounts(date string) ([]CycleCountTask, error) {
+	day, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return nil, err
+	}
+	classes := loadCycleCountClasses()
+	type candidate struct {
+		ipn, class string
+		last       sql.NullString
+	}
+	rows, err := db.Query(`SELECT ipn, abc_class, last_counted_at FROM cycle_count_items
+		WHERE ipn NOT IN (SELECT ipn FROM cycle_count_tasks WHERE status IN ('open','pending_approval'))
+		ORDER BY last_counted_at IS NOT NULL, last_counted_at, ipn`)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		rows.Scan(&c.ipn, &c.class, &c.last)
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+
+	quota := map[string]int{}
+	for class, c := range classes {
+		var items, scheduled int
+		db.QueryRow("SELECT COUNT(*) FROM cycle_count_items WHERE abc_class=?", class).Scan(&items)
+		db.QueryRow("SELECT COUNT(*) FROM cycle_count_tasks WHERE abc_class=? AND scheduled_date=? AND status != 'cancelled'", class, date).Scan(&scheduled)
+		quota[class] = int(math.Ceil(float64(items)/float64(c.FrequencyDays))) - scheduled
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var ids []int64
+	for _, c := range candidates {
+		if quota[c.class] <= 0 {
+			continue
+		}
+		if c.last.Valid && len(c.last.String) >= 10 {
+			last, err := time.Parse("2006-01-02", c.last.String[:10])
+			if err == nil && last.AddDate(0, 0, classes[c.class].FrequencyDays).After(day) {
+				continue
+			}
+		}
+		res, err := tx.Exec("INSERT INTO cycle_count_tasks (ipn, abc_class, scheduled_date, created_at) VALUES (?,?,?,?)", c.ipn, c.class, date, now)
+		if err != nil {
+			return nil, err
+		}
+		id, _ := res.LastInsertId()
+		ids = append(ids, id)
+		quota[c.class]--
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return []CycleCountTask{}, nil
+	}
+	return loadCycleCountTasks("id >= ? AND scheduled_date = ?", ids[0], date)
+}
+
+// runScheduledCycleCounts reclassifies when the classes are missing or more
+// than cycleCountReclassifyDays old, then schedules today's counts.
+func runScheduledCycleCounts(now time.Time) (int, error) {
+	var last sql.NullString
+	db.QueryRow("SELECT MIN(classified_at) FROM cycle_count_items").Scan(&last)
+	stale := now.AddDate(0, 0, -cycleCountReclassifyDays).Format("2006-01-02 15:04:05")
+	if !last.Valid || last.String < stale {
+		if _, err := classifyABC(cycleCountLookbackDays, now); err != nil {
+			return 0, err
+		}
+	}
+	tasks, err := generateCycleCounts(now.Format("2006-01-02"))
+	return len(tasks), err
+}
+
+// startCycleCountScheduler schedules counts once a day at runTime (HH:MM).
+// It is off unless ZRP_CYCLE_COUNT_TIME is set.
+func startCycleCountScheduler(runTime string) {
+	if runTime == "" {
+		return
+	}
+	err := runDaily(runTime, func() {
+		n, err := runScheduledCycleCounts(time.Now())
+		if err != nil {
+			log.Printf("Scheduled cycle counts failed: %v", err)
+		} else {
+			log.Printf("Scheduled %d cycle counts", n)
+		}
+	})
+	if err != nil {
+		log.Printf("ZRP_CYCLE_COUNT_TIME: %v; scheduled cycle counts are off", err)
+	}
+}
+
+const cycleCountTaskColumns = `id, ipn, abc_class, scheduled_date, status, expected_qty, counted_qty, variance_qty, variance_pct,
+	COALESCE(unit_cost,0), variance_value, within_tolerance, COALESCE(counted_by,''), counted_at, COALESCE(reviewed_by,''),
+	reviewed_at, COALESCE(review_notes,''), COALESCE(notes,''), created_at`
+
+func scanCycleCountTask(row interface{ Scan(...interface{}) error }) (CycleCountTask, error) {
+	var t CycleCountTask
+	var expected, counted, varQty, varPct, varValue sql.NullFloat64
+	var within sql.NullBool
+	var countedAt, reviewedAt sql.NullString
+	err := row.Scan(&t.ID, &t.IPN, &t.Class, &t.ScheduledDate, &t.Status, &expected, &counted, &varQty, &varPct,
+		&t.UnitCost, &varValue, &within, &t.CountedBy, &countedAt, &t.ReviewedBy, &reviewedAt, &t.ReviewNotes, &t.Notes, &t.CreatedAt)
+	nf := func(n sql.NullFloat64) *float64 {
+		if !n.Valid {
+			return nil
+		}
+		v := n.Float64
+		return &v
+	}
+	t.ExpectedQty, t.CountedQty, t.VarianceQty, t.VariancePct, t.VarianceValue = nf(expected), nf(counted), nf(varQty), nf(varPct), nf(varValue)
+	if within.Valid {
+		t.WithinTolerance = &within.Bool
+	}
+	t.CountedAt, t.ReviewedAt = sp(countedAt), sp(reviewedAt)
+	return t, err
+}
+
+func loadCycleCountTasks(where string, args ...interface{}) ([]CycleCountTask, error) {
+	rows, err := db.Query("SELECT "+cycleCountTaskColumns+" FROM cycle_count_tasks WHERE "+where+" ORDER BY scheduled_date, abc_class, ipn, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tasks := []CycleCountTask{}
+	for rows.Next() {
+		t, err := scanCycleCountTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
+
+func loadCycleCountTask(idStr string) (CycleCountTask, error) {
+	return scanCycleCountTask(db.QueryRow("SELECT "+cycleCountTaskColumns+" FROM cycle_count_tasks WHERE id=?", idStr))
+}
+
+// postCycleCountAdjust moves the IPN's on-hand qty by the counted variance
+// with an adjust transaction referencing the count. Stock that moved since
+// the count keeps its movement.
+func postCycleCountAdjust(tx *sql.Tx, t CycleCountTask, notes, now string) error {
+	if *t.VarianceQty == 0 {
+		return nil
+	}
+	var onHand float64
+	if err := tx.QueryRow("SELECT qty_on_hand FROM inventory WHERE ipn=?", t.IPN).Scan(&onHand); err != nil {
+		return fmt.Errorf("%s is not in inventory", t.IPN)
+	}
+	qty := math.Max(0, onHand+*t.VarianceQty)
+	if notes == "" {
+		notes = fmt.Sprintf("Cycle count: counted %g, expected %g", *t.CountedQty, *t.ExpectedQty)
+	}
+	if _, err := tx.Exec("INSERT INTO inventory_transactions (ipn,type,qty,reference,notes,created_at) VALUES (?,'adjust',?,?,?,?)",
+		t.IPN, qty, "CC-"+strconv.Itoa(t.ID), notes, now); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE inventory SET qty_on_hand=?, updated_at=? WHERE ipn=?", qty, now, t.IPN); err != nil {
+		return err
+	}
+	if err := fitLocatedStock(tx, t.IPN); err != nil {
+		return err
+	}
+	return syncCostLayers(tx, t.IPN, "adjust", "CC-"+strconv.Itoa(t.ID), 0, now)
+}
+
+func handleListCycleCountClasses(w http.ResponseWriter, r *http.Request) {
+	classes := loadCycleCountClasses()
+	counts := map[string]int{}
+	rows, err := db.Query("SELECT abc_class, COUNT(*) FROM cycle_count_items GROUP BY abc_class")
+	if err == nil {
+		for rows.Next() {
+			var class string
+			var n int
+			rows.Scan(&class, &n)
+			counts[class] = n
+		}
+		rows.Close()
+	}
+	list := []CycleCountClass{}
+	for _, name := range []string{"A", "B", "C"} {
+		c := classes[name]
+		c.ItemCount = counts[name]
+		list = append(list, c)
+	}
+	jsonResp(w, list)
+}
+
+func handleUpdateCycleCountClass(w http.ResponseWriter, r *http.Request, class string) {
+	classes := loadCycleCountClasses()
+	c, ok := classes[class]
+	if !ok {
+		jsonErr(w, "class must be A, B or C", 404)
+		return
+	}
+	var body struct {
+		ValuePct      *float64 `json:"value_pct"`
+		FrequencyDays *int     `json:"frequency_days"`
+		TolerancePct  *float64 `json:"tolerance_pct"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	if body.ValuePct != nil {
+		c.ValuePct = *body.ValuePct
+	}
+	if body.FrequencyDays != nil {
+		c.FrequencyDays = *body.FrequencyDays
+	}
+	if body.TolerancePct != nil {
+		c.TolerancePct = *body.TolerancePct
+	}
+	classes[class] = c
+
+	ve := &ValidationErrors{}
+	if c.ValuePct <= 0 || c.ValuePct > 100 {
+		ve.Add("value_pct", "must be between 0 and 100")
+	} else if class == "C" && c.ValuePct != 100 {
+		ve.Add("value_pct", "class C takes the rest, so must be 100")
+	} else if classes["A"].ValuePct >= classes["B"].ValuePct {
+		ve.Add("value_pct", "class A must cover less of the value than class B")
+	}
+	validateIntRange(ve, "frequency_days", c.FrequencyDays, 1, 3650)
+	if c.TolerancePct < 0 {
+		ve.Add("tolerance_pct", "must be non-negative")
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	_, err := db.Exec(`INSERT INTO cycle_count_classes (class, value_pct, frequency_days, tolerance_pct) VALUES (?,?,?,?)
+		ON CONFLICT(class) DO UPDATE SET value_pct=excluded.value_pct, frequency_days=excluded.frequency_days, tolerance_pct=excluded.tolerance_pct`,
+		class, c.ValuePct, c.FrequencyDays, c.TolerancePct)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, getUsername(r), "updated", "cycle_count_class", class,
+		fmt.Sprintf("Class %s: %g%% of value, counted every %d days, %g%% tolerance", class, c.ValuePct, c.FrequencyDays, c.TolerancePct))
+	jsonResp(w, c)
+}
+
+func handleClassifyCycleCounts(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		LookbackDays int `json:"lookback_days"`
+	}
+	if r.ContentLength > 0 {
+		if err := decodeBody(r, &body); err != nil {
+			jsonErr(w, "invalid body", 400)
+			return
+		}
+	}
+	if body.LookbackDays == 0 {
+		body.LookbackDays = cycleCountLookbackDays
+	}
+	ve := &ValidationErrors{}
+	validateIntRange(ve, "lookback_days", body.LookbackDays, 1, 3650)
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+	counts, err := classifyABC(body.LookbackDays, time.Now())
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, getUsername(r), "created", "cycle_count_class", "ABC",
+		fmt.Sprintf("ABC classification: %d A, %d B, %d C", counts["A"], counts["B"], counts["C"]))
+	jsonResp(w, map[string]interface{}{"lookback_days": body.LookbackDays, "counts": counts})
+}
+
+// handleListCycleCountItems lists the classified IPNs with when each is
+// next due for a count.
+func handleListCycleCountItems(w http.ResponseWriter, r *http.Request) {
+	classes := loadCycleCountClasses()
+	query := "SELECT ipn, abc_class, annual_value, classified_at, last_counted_at FROM cycle_count_items"
+	var args []interface{}
+	if class := r.URL.Query().Get("class"); class != "" {
+		query += " WHERE abc_class=?"
+		args = append(args, class)
+	}
+	rows, err := db.Query(query+" ORDER BY abc_class, annual_value DESC, ipn", args...)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	items := []CycleCountItem{}
+	for rows.Next() {
+		var it CycleCountItem
+		var last sql.NullString
+		rows.Scan(&it.IPN, &it.Class, &it.AnnualValue, &it.ClassifiedAt, &last)
+		it.LastCountedAt = sp(last)
+		it.NextDue = time.Now().Format("2006-01-02")
+		if last.Valid && len(last.String) >= 10 {
+			if t, err := time.Parse("2006-01-02", last.String[:10]); err == nil {
+				it.NextDue = t.AddDate(0, 0, classes[it.Class].FrequencyDays).Format("2006-01-02")
+			}
+		}
+		items = append(items, it)
+	}
+	jsonResp(w, items)
+}
+
+func handleGenerateCycleCounts(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Date string `json:"date"`
+	}
+	if r.ContentLength > 0 {
+		if err := decodeBody(r, &body); err != nil {
+			jsonErr(w, "invalid body", 400)
+			return
+		}
+	}
+	if body.Date == "" {
+		body.Date = time.Now().Format("2006-01-02")
+	}
+	ve := &ValidationErrors{}
+	validateDate(ve, "date", body.Date)
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+	tasks, err := generateCycleCounts(body.Date)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if len(tasks) > 0 {
+		logAudit(db, getUsername(r), "created", "cycle_count", body.Date, fmt.Sprintf("Scheduled %d cycle counts for %s", len(tasks), body.Date))
+	}
+	jsonResp(w, tasks)
+}
+
+func handleListCycleCountTasks(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	where := []string{"1=1"}
+	var args []interface{}
+	for param, col := range map[string]string{"status": "status", "date": "scheduled_date", "class": "abc_class", "ipn": "ipn"} {
+		if v := q.Get(param); v != "" {
+			where = append(where, col+" = ?")
+			args = append(args, v)
+		}
+	}
+	tasks, err := loadCycleCountTasks(strings.Join(where, " AND "), args...)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	jsonResp(w, tasks)
+}
+
+func handleGetCycleCountTask(w http.ResponseWriter, r *http.Request, id string) {
+	t, err := loadCycleCountTask(id)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "count not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	jsonResp(w, t)
+}
+
+// handleCountCycleCountTask records a count. The variance against the
+// on-hand qty is checked against the class tolerance: within it the
+// adjustment is posted straight away, outside it the count waits for
+// approval.
+func handleCountCycleCountTask(w http.ResponseWriter, r *http.Request, id string) {
+	var body struct {
+		CountedQty *float64 `json:"counted_qty"`
+		Notes      string   `json:"notes"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	t, err := loadCycleCountTask(id)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "count not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	ve := &ValidationErrors{}
+	if body.CountedQty == nil {
+		ve.Add("counted_qty", "is required")
+	} else if *body.CountedQty < 0 {
+		ve.Add("counted_qty", "must not be negative")
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+	t, status, err := countCycleCountTask(t, *body.CountedQty, body.Notes, getUsername(r), nil)
+	if err != nil {
+		jsonErr(w, err.Error(), status)
+		return
+	}
+	jsonResp(w, t)
+}
+
+// countCycleCountTask records counted as the count of an open task by
+// user. posted, if not nil, runs in the same database transaction. It
+// returns the updated task, or the HTTP status to report with an error.
+func countCycleCountTask(t CycleCountTask, counted float64, notes, user string, posted func(*sql.Tx) error) (CycleCountTask, int, error) {
+	ve := &ValidationErrors{}
+	if t.Status != "open" {
+		ve.Add("status", "count is "+t.Status)
+	}
+	var expected float64
+	if err := db.QueryRow("SELECT qty_on_hand FROM inventory WHERE ipn=?", t.IPN).Scan(&expected); err != nil {
+		ve.Add("ipn", t.IPN+" is not in inventory")
+	}
+	if ve.HasErrors() {
+		return t, 400, ve
+	}
+
+	variance := counted - expected
+	pct := 0.0
+	if expected != 0 {
+		pct = math.Round(variance/expected*10000) / 100
+	} else if variance != 0 {
+		pct = 100
+	}
+	within := math.Abs(pct) <= loadCycleCountClasses()[t.Class].TolerancePct
+	t.ExpectedQty, t.CountedQty, t.VarianceQty = &expected, &counted, &variance
+	status := "pending_approval"
+	if within {
+		status = "completed"
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	tx, err := db.Begin()
+	if err != nil {
+		return t, 500, err
+	}
+	defer tx.Rollback()
+	unitCost := lastPOUnitPrice(tx, t.IPN)
+	_, err = tx.Exec(`UPDATE cycle_count_tasks SET status=?, expected_qty=?, counted_qty=?, variance_qty=?, variance_pct=?, unit_cost=?,
+		variance_value=?, within_tolerance=?, counted_by=?, counted_at=?, notes=? WHERE id=?`,
+		status, expected, counted, variance, pct, unitCost, roundCost(variance*unitCost), within, user, now, notes, t.ID)
+	if err == nil && within {
+		if err = postCycleCountAdjust(tx, t, notes, now); err == nil {
+			_, err = tx.Exec("UPDATE cycle_count_items SET last_counted_at=? WHERE ipn=?", now, t.IPN)
+		}
+	}
+	if err == nil && posted != nil {
+		err = posted(tx)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return t, 500, err
+	}
+	id := strconv.Itoa(t.ID)
+	logAudit(db, user, "counted", "cycle_count", id, fmt.Sprintf("Cycle count %s: %s counted %g, expected %g (%s)", id, t.IPN, counted, expected, status))
+	t, err = loadCycleCountTask(id)
+	if err != nil {
+		return t, 500, err
+	}
+	return t, 200, nil
+}
+
+// handleReviewCycleCountTask approves or rejects a count outside tolerance.
+// Approving posts the adjustment; rejecting schedules a recount for today.
+func handleReviewCycleCountTask(w http.ResponseWriter, r *http.Request, id, action string) {
+	var body struct {
+		Notes string `json:"notes"`
+	}
+	if r.ContentLength > 0 {
+		if err := decodeBody(r, &body); err != nil {
+			jsonErr(w, "invalid body", 400)
+			return
+		}
+	}
+	t, err := loadCycleCountTask(id)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "count not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if t.Status != "pending_approval" {
+		jsonErr(w, "count is "+t.Status+", not pending approval", 400)
+		return
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	user := getUsername(r)
+	status := "completed"
+	if action == "reject" {
+		status = "rejected"
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE cycle_count_tasks SET status=?, reviewed_by=?, reviewed_at=?, review_notes=? WHERE id=?", status, user, now, body.Notes, t.ID)
+	if err == nil && action == "approve" {
+		if err = postCycleCountAdjust(tx, t, body.Notes, now); err == nil {
+			_, err = tx.Exec("UPDATE cycle_count_items SET last_counted_at=? WHERE ipn=?", now, t.IPN)
+		}
+	}
+	if err == nil && action == "reject" {
+		_, err = tx.Exec("INSERT INTO cycle_count_tasks (ipn, abc_class, scheduled_date, notes, created_at) VALUES (?,?,?,?,?)",
+			t.IPN, t.Class, now[:10], "Recount of CC-"+id, now)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, user, action+"d", "cycle_count", id, fmt.Sprintf("Cycle count %s for %s %sd", id, t.IPN, action))
+	t, _ = loadCycleCountTask(id)
+	jsonResp(w, t)
+}
+
+// handleReportCycleCountAccuracy reports count accuracy over time. Every
+// entered count is included, whether or not its variance was approved.
+func handleReportCycleCountAccuracy(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	period := q.Get("period")
+	if period == "" {
+		period = "month"
+	}
+	ve := &ValidationErrors{}
+	validateEnum(ve, "period", period, []string{"week", "month"})
+	validateDate(ve, "from", q.Get("from"))
+	validateDate(ve, "to", q.Get("to"))
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+	where := []string{"counted_at IS NOT NULL"}
+	var args []interface{}
+	if from := q.Get("from"); from != "" {
+		where = append(where, "counted_at >= ?")
+		args = append(args, from)
+	}
+	if to := q.Get("to"); to != "" {
+		where = append(where, "counted_at < date(?, '+1 day')")
+		args = append(args, to)
+	}
+	if class := q.Get("class"); class != "" {
+		where = append(where, "abc_class = ?")
+		args = append(args, class)
+	}
+	tasks, err := loadCycleCountTasks(strings.Join(where, " AND "), args...)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+
+	overall := &CycleCountAccuracy{Key: "all"}
+	byPeriod := map[string]*CycleCountAccuracy{}
+	byClass := map[string]*CycleCountAccuracy{}
+	add := func(m map[string]*CycleCountAccuracy, key string, t CycleCountTask) {
+		a, ok := m[key]
+		if !ok {
+			a = &CycleCountAccuracy{Key: key}
+			m[key] = a
+		}
+		a.add(t)
+	}
+	for _, t := range tasks {
+		counted, _ := time.Parse("2006-01-02", (*t.CountedAt)[:10])
+		key := counted.Format("2006-01")
+		if period == "week" {
+			y, wk := counted.ISOWeek()
+			key = fmt.Sprintf("%d-W%02d", y, wk)
+		}
+		overall.add(t)
+		add(byPeriod, key, t)
+		add(byClass, t.Class, t)
+	}
+	periods := sortedAccuracy(byPeriod)
+	classes := sortedAccuracy(byClass)
+	overall.finish()
+
+	if q.Get("format") == "csv" {
+		writeCSV(w, "cycle-count-accuracy", []string{"Period", "Counts", "Accurate", "Accuracy %", "Expected Value", "Net Variance", "Abs Variance", "Value Accuracy %"}, func(cw *csv.Writer) {
+			for _, a := range periods {
+				cw.Write([]string{a.Key, strconv.Itoa(a.Counts), strconv.Itoa(a.Accurate), fmt.Sprintf("%.2f", a.AccuracyPct),
+					fmt.Sprintf("%.2f", a.ExpectedValue), fmt.Sprintf("%.2f", a.NetVarianceValue), fmt.Sprintf("%.2f", a.AbsVarianceValue), fmt.Sprintf("%.2f", a.ValueAccuracyPct)})
+			}
+		})
+		return
+	}
+	jsonResp(w, map[string]interface{}{"period": period, "overall": overall, "by_period": periods, "by_class": classes})
+}
+
+func (a *CycleCountAccuracy) add(t CycleCountTask) {
+	a.Counts++
+	if t.WithinTolerance != nil && *t.WithinTolerance {
+		a.Accurate++
+	}
+	if t.ExpectedQty != nil {
+		a.ExpectedValue += *t.ExpectedQty * t.UnitCost
+	}
+	if t.VarianceValue != nil {
+		a.NetVarianceValue += *t.VarianceValue
+		a.AbsVarianceValue += math.Abs(*t.VarianceValue)
+	}
+}
+
+func (a *CycleCountAccuracy) finish() {
+	if a.Counts > 0 {
+		a.AccuracyPct = math.Round(float64(a.Accurate)/float64(a.Counts)*10000) / 100
+	}
+	a.ValueAccuracyPct = 100
+	if a.ExpectedValue > 0 {
+		a.ValueAccuracyPct = math.Round(math.Max(0, 1-a.AbsVarianceValue/a.ExpectedValue)*10000) / 100
+	}
+	a.ExpectedValue, a.NetVarianceValue, a.AbsVarianceValue = roundCost(a.ExpectedValue), roundCost(a.NetVarianceValue), roundCost(a.AbsVarianceValue)
+}
+
+func sortedAccuracy(m map[string]*CycleCountAccuracy) []CycleCountAccuracy {
+	list := []CycleCountAccuracy{}
+	for _, a := range m {
+		a.finish()
+		list = append(list, *a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func generateCounts(t *testing.T, date string) []CycleCountTask {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleGenerateCycleCounts(w, httptest.NewRequest("POST", "/api/v1/cycle-counts/generate", bytes.NewBufferString(`{"date":"`+date+`"}`)))
+	if w.Code != 200 {
+		t.Fatalf("generate failed: %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Data []CycleCountTask `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp.Data
+}
+
+func postCount(t *testing.T, task CycleCountTask, action, body string) (*httptest.ResponseRecorder, CycleCountTask) {
+	t.Helper()
+	id := strconv.Itoa(task.ID)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/v1/cycle-counts/tasks/"+id+"/"+action, bytes.NewBufferString(body))
+	if action == "count" {
+		handleCountCycleCountTask(w, req, id)
+	} else {
+		handleReviewCycleCountTask(w, req, id, action)
+	}
+	var resp struct {
+		Data CycleCountTask `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp.Data
+}
+
+func TestCycleCounting(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+
+	now := time.Now()
+	ts := now.AddDate(0, -1, 0).Format("2006-01-02 15:04:05")
+	stmts := []string{
+		`INSERT INTO inventory (ipn, qty_on_hand) VALUES ('A-1', 100), ('B-1', 50), ('C-1', 20), ('C-2', 5)`,
+		`INSERT INTO purchase_orders (id, vendor_id, status, created_at) VALUES ('PO-1', 'V-1', 'received', '2026-01-01 00:00:00')`,
+		`INSERT INTO po_lines (po_id, ipn, qty_ordered, unit_price) VALUES ('PO-1', 'A-1', 1, 10), ('PO-1', 'B-1', 1, 1), ('PO-1', 'C-1', 1, 0.1)`,
+		`INSERT INTO inventory_transactions (ipn, type, qty, created_at) VALUES ('A-1', 'issue', 80, '` + ts + `'), ('B-1', 'issue', 150, '` + ts + `'),
+			('C-1', 'receive', 500, '` + ts + `'), ('A-1', 'adjust', 1000, '` + ts + `'), ('C-2', 'issue', 1000, '2020-01-01 00:00:00')`,
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("seed failed: %v\n%s", err, s)
+		}
+	}
+
+	// 800 of 1000 in A-1 makes it A; B-1 takes the share up to 95%
+	w := httptest.NewRecorder()
+	handleClassifyCycleCounts(w, httptest.NewRequest("POST", "/api/v1/cycle-counts/classify", nil))
+	if w.Code != 200 {
+		t.Fatalf("classify failed: %d %s", w.Code, w.Body.String())
+	}
+	classes := map[string]string{}
+	rows, _ := db.Query("SELECT ipn, abc_class FROM cycle_count_items")
+	for rows.Next() {
+		var ipn, class string
+		rows.Scan(&ipn, &class)
+		classes[ipn] = class
+	}
+	rows.Close()
+	if classes["A-1"] != "A" || classes["B-1"] != "B" || classes["C-1"] != "C" || classes["C-2"] != "C" {
+		t.Fatalf("unexpected classes: %v", classes)
+	}
+
+	for class, body := range map[string]string{"A": `{"value_pct":96}`, "C": `{"value_pct":90}`, "B": `{"frequency_days":0}`} {
+		w = httptest.NewRecorder()
+		handleUpdateCycleCountClass(w, httptest.NewRequest("PUT", "/api/v1/cycle-counts/classes/"+class, bytes.NewBufferString(body)), class)
+		if w.Code != 400 {
+			t.Errorf("%s %s: expected 400, got %d", class, body, w.Code)
+		}
+	}
+	w = httptest.NewRecorder()
+	handleUpdateCycleCountClass(w, httptest.NewRequest("PUT", "/api/v1/cycle-counts/classes/A", bytes.NewBufferString(`{"frequency_days":1}`)), "A")
+	if w.Code != 200 {
+		t.Fatalf("class update failed: %d %s", w.Code, w.Body.String())
+	}
+
+	// One of each class today; running it again adds nothing
+	today, tomorrow := now.Format("2006-01-02"), now.AddDate(0, 0, 1).Format("2006-01-02")
+	tasks := generateCounts(t, today)
+	if len(tasks) != 3 || tasks[0].IPN != "A-1" || tasks[1].IPN != "B-1" || tasks[2].IPN != "C-1" || tasks[0].ExpectedQty != nil {
+		t.Fatalf("unexpected tasks: %+v", tasks)
+	}
+	if again := generateCounts(t, today); len(again) != 0 {
+		t.Errorf("expected no more counts today, got %+v", again)
+	}
+
+	// Within tolerance: done, nothing to adjust
+	if w, task := postCount(t, tasks[0], "count", `{"counted_qty":100}`); w.Code != 200 || task.Status != "completed" || !*task.WithinTolerance {
+		t.Fatalf("unexpected A-1 count: %d %s", w.Code, w.Body.String())
+	}
+	// 10% short waits for approval, then adjusts
+	w, task := postCount(t, tasks[1], "count", `{"counted_qty":45}`)
+	if w.Code != 200 || task.Status != "pending_approval" || *task.VariancePct != -10 || *task.VarianceValue != -5 || onHand("B-1") != 50 {
+		t.Fatalf("unexpected B-1 count: %d %s", w.Code, w.Body.String())
+	}
+	if w, _ := postCount(t, tasks[1], "count", `{"counted_qty":45}`); w.Code != 400 {
+		t.Errorf("expected a second count to be refused, got %d", w.Code)
+	}
+	if w, _ := postCount(t, tasks[0], "approve", ``); w.Code != 400 {
+		t.Errorf("expected approving a completed count to be refused, got %d", w.Code)
+	}
+	if w, task := postCount(t, tasks[1], "approve", `{"notes":"Found damaged"}`); w.Code != 200 || task.Status != "completed" || onHand("B-1") != 45 {
+		t.Fatalf("approve failed: %d %s (%g on hand)", w.Code, w.Body.String(), onHand("B-1"))
+	}
+	var ref string
+	db.QueryRow("SELECT reference FROM inventory_transactions WHERE ipn='B-1' AND type='adjust'").Scan(&ref)
+	if ref != "CC-"+strconv.Itoa(tasks[1].ID) {
+		t.Errorf("expected the adjustment to reference the count, got %q", ref)
+	}
+	// Rejecting leaves stock alone and asks for a recount
+	postCount(t, tasks[2], "count", `{"counted_qty":30}`)
+	if w, task := postCount(t, tasks[2], "reject", ``); w.Code != 200 || task.Status != "rejected" || onHand("C-1") != 20 {
+		t.Fatalf("reject failed: %d %s", w.Code, w.Body.String())
+	}
+	recount, _ := loadCycleCountTasks("ipn='C-1' AND status='open'")
+	if len(recount) != 1 || recount[0].ScheduledDate != today {
+		t.Errorf("expected a recount of C-1 today, got %+v", recount)
+	}
+
+	// Tomorrow A-1 is due again and C-2 is the C count, since C-1 is open
+	if tasks := generateCounts(t, tomorrow); len(tasks) != 2 || tasks[0].IPN != "A-1" || tasks[1].IPN != "C-2" {
+		t.Errorf("unexpected tasks tomorrow: %+v", tasks)
+	}
+
+	w = httptest.NewRecorder()
+	handleReportCycleCountAccuracy(w, httptest.NewRequest("GET", "/api/v1/reports/cycle-count-accuracy?from="+today, nil))
+	var report struct {
+		Data struct {
+			Overall  CycleCountAccuracy   `json:"overall"`
+			ByPeriod []CycleCountAccuracy `json:"by_period"`
+			ByClass  []CycleCountAccuracy `json:"by_class"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &report)
+	o := report.Data.Overall
+	if o.Counts != 3 || o.Accurate != 1 || o.AccuracyPct != 33.33 || o.ExpectedValue != 1052 || o.AbsVarianceValue != 6 || o.ValueAccuracyPct != 99.43 {
+		t.Errorf("unexpected accuracy: %s", w.Body.String())
+	}
+	if len(report.Data.ByPeriod) != 1 || report.Data.ByPeriod[0].Key != now.Format("2006-01") || len(report.Data.ByClass) != 3 {
+		t.Errorf("unexpected breakdown: %s", w.Body.String())
+	}
+}
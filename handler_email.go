@@ -239,6 +239,9 @@ func emailNotificationsForRecent() {
 }
 
 func emailConfigEnabled() bool {
+	if db == nil {
+		return false
+	}
 	var enabled int
 	err := db.QueryRow("SELECT enabled FROM email_config WHERE id=1").Scan(&enabled)
 	return err == nil && enabled == 1
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lotFEFOOrder puts the lots that expire first at the front; lots without
+// an expiry date follow, oldest first.
+const lotFEFOOrder = `ORDER BY expires_at IS NULL, expires_at, COALESCE(received_at, created_at), id`
+
+// lotNotExpired keeps lots that haven't reached their expiry date. A lot is
+// expired from its expiry date on.
+const lotNotExpired = `(expires_at IS NULL OR expires_at > ?)`
+
+func expiryToday(now time.Time) string {
+	return now.Format("2006-01-02")
+}
+
+// partShelfLifeDays reads a part's shelf life from its shelf_life_days or
+// shelf_life column, 0 if it has none.
+func partShelfLifeDays(ipn string) int {
+	fields, err := getPartByIPN(partsDir, ipn)
+	if err != nil {
+		return 0
+	}
+	for k, v := range fields {
+		switch strings.ToLower(k) {
+		case "shelf_life_days", "shelf_life":
+			days, _ := strconv.Atoi(strings.TrimSpace(v))
+			return days
+		}
+	}
+	return 0
+}
+
+// defaultLotExpiry is the expiry date of a lot received at receivedAt (now
+// if nil) from the part's shelf life, or nil if the part has none.
+func defaultLotExpiry(ipn string, receivedAt *string) *string {
+	days := partShelfLifeDays(ipn)
+	if days <= 0 {
+		return nil
+	}
+	from := time.Now()
+	if receivedAt != nil {
+		if t, err := parseLaborTime(*receivedAt, time.Local); err == nil {
+			from = t
+		}
+	}
+	expires := from.AddDate(0, 0, days).Format("2006-01-02")
+	return &expires
+}
+
+// validateExpiryDate checks an expires_at given by the client.
+func validateExpiryDate(ve *ValidationErrors, v string) {
+	if _, err := time.Parse("2006-01-02", v); err != nil {
+		ve.Add("expires_at", "must be a date (YYYY-MM-DD)")
+	}
+}
+
+// checkUsableStock refuses to take qty of ipn when part of the stock on
+// hand is in lots that can't be issued and the rest can't cover it. Call it
+// before inventory.qty_on_hand is drawn down. The error is meant for the
+// client.
+func checkUsableStock(tx *sql.Tx, ipn string, qty float64, now time.Time) error {
+	unusable := unusableLotStock(tx, ipn, now)
+	if unusable <= 0 {
+		return nil
+	}
+	var onHand float64
+	tx.QueryRow("SELECT COALESCE(qty_on_hand,0) FROM inventory WHERE ipn=?", ipn).Scan(&onHand)
+	if usable := onHand - unusable; qty > usable+1e-9 {
+		return fmt.Errorf("only %g of %s is usable; %g is in lots that are expired, quarantined, on hold or past their floor life", usable, ipn, unusable)
+	}
+	return nil
+}
+
+// unusableLotStock returns the qty of ipn on hand in lots that can't be
+// issued: quarantined, on hold, expired or past their MSL floor life.
+// Accepts either the db or an open transaction.
+func unusableLotStock(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, ipn string, now time.Time) float64 {
+	rows, err := q.Query(`SELECT status, `+lotNotExpired+`, qty_on_hand, `+lotMSLColumns+` FROM inventory_lots
+		WHERE ipn=? AND qty_on_hand > 0 AND status IN ('available','hold','quarantine')`, expiryToday(now), ipn)
+	if err != nil {
+		return 0
+	}
+	defer rows.Close()
+	unusable := 0.0
+	for rows.Next() {
+		var status string
+		var fresh bool
+		var qty float64
+		var msl lotMSLRow
+		rows.Scan(append([]interface{}{&status, &fresh, &qty}, msl.targets()...)...)
+		if m := msl.status(now); status != "available" || !fresh || (m != nil && m.Exceeded) {
+			unusable += qty
+		}
+	}
+	return unusable
+}
+
+// closeLotPicks picks the lots a WO close consumes qty of ipn from, once
+// qty_on_hand has been drawn down. The material was reserved to the build,
+// so lots that expired, went past their floor life or were quarantined while
+// it was on the line don't block the close: usable lots go first, then
+// untracked stock, then those lots.
+func closeLotPicks(tx *sql.Tx, ipn string, qty float64, now time.Time) ([]LotPick, error) {
+	var onHand, inLots float64
+	tx.QueryRow("SELECT COALESCE(qty_on_hand,0) FROM inventory WHERE ipn=?", ipn).Scan(&onHand)
+	tx.QueryRow("SELECT COALESCE(SUM(qty_on_hand),0) FROM inventory_lots WHERE ipn=? AND qty_on_hand > 0 AND status IN ('available','hold','quarantine')", ipn).Scan(&inLots)
+	untracked := onHand + qty - inLots
+	rows, err := tx.Query(`SELECT id, status, `+lotNotExpired+`, qty_on_hand, `+lotMSLColumns+` FROM inventory_lots
+		WHERE ipn=? AND qty_on_hand > 0 AND status IN ('available','hold','quarantine') `+lotFEFOOrder, expiryToday(now), ipn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load lots for %s: %w", ipn, err)
+	}
+	var usable, unusable []LotPick
+	for rows.Next() {
+		var p LotPick
+		var status string
+		var fresh bool
+		var msl lotMSLRow
+		rows.Scan(append([]interface{}{&p.LotID, &status, &fresh, &p.Qty}, msl.targets()...)...)
+		if m := msl.status(now); status != "available" || !fresh || (m != nil && m.Exceeded) {
+			unusable = append(unusable, p)
+		} else {
+			usable = append(usable, p)
+		}
+	}
+	rows.Close()
+
+	var picks []LotPick
+	remaining := qty
+	take := func(lots []LotPick) {
+		for _, p := range lots {
+			if remaining <= 1e-9 {
+				return
+			}
+			if p.Qty > remaining {
+				p.Qty = remaining
+			}
+			remaining -= p.Qty
+			picks = append(picks, p)
+		}
+	}
+	take(usable)
+	if untracked > 0 {
+		remaining -= untracked
+	}
+	take(unusable)
+	return picks, nil
+}
+
+// quarantineExpiredLots moves available lots that have reached their
+// expiry date into quarantine and returns them.
+func quarantineExpiredLots(user string, now time.Time) ([]InventoryLot, error) {
+	rows, err := db.Query("SELECT "+lotColumns+" FROM inventory_lots WHERE status='available' AND qty_on_hand > 0 AND NOT "+lotNotExpired+" ORDER BY id",
+		expiryToday(now))
+	if err != nil {
+		return nil, err
+	}
+	lots := []InventoryLot{}
+	for rows.Next() {
+		l, err := scanLot(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		lots = append(lots, l)
+	}
+	rows.Close()
+
+	for i, l := range lots {
+		if _, err := db.Exec("UPDATE inventory_lots SET status='quarantine' WHERE id=? AND status='available'", l.ID); err != nil {
+			return nil, err
+		}
+		lots[i].Status = "quarantine"
+		logAudit(db, user, "quarantined", "lot", strconv.Itoa(l.ID), fmt.Sprintf("Quarantined lot %s of %s, expired %s (%g on hand)",
+			l.LotNumber, l.IPN, *l.ExpiresAt, l.QtyOnHand))
+	}
+	return lots, nil
+}
+
+// expiringLots loads lots with stock that expire within days of now,
+// expired ones included, soonest first.
+func expiringLots(days int, now time.Time) ([]InventoryLot, error) {
+	rows, err := db.Query("SELECT "+lotColumns+` FROM inventory_lots
+		WHERE expires_at IS NOT NULL AND expires_at <= ? AND qty_on_hand > 0 AND status IN ('available','hold','quarantine') `+lotFEFOOrder,
+		expiryToday(now.AddDate(0, 0, days)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lots := []InventoryLot{}
+	for rows.Next() {
+		l, err := scanLot(rows)
+		if err != nil {
+			return nil, err
+		}
+		lots = append(lots, l)
+	}
+	return lots, rows.Err()
+}
+
+// lotExpiryAlerts warns about lots expiring within warnDays and flags
+// expired ones.
+func lotExpiryAlerts(warnDays int) []pendingNotif {
+	now := time.Now()
+	lots, err := expiringLots(warnDays, now)
+	if err != nil {
+		return nil
+	}
+	today := expiryToday(now)
+	var pending []pendingNotif
+	for _, l := range lots {
+		msg := fmt.Sprintf("%s lot %s: %g on hand, expires %s", l.IPN, l.LotNumber, l.QtyOnHand, *l.ExpiresAt)
+		if *l.ExpiresAt <= today {
+			pending = append(pending, pendingNotif{ntype: "lot_expired", severity: "error", title: "Lot Expired: " + l.LotNumber,
+				message: stringPtr(msg), recordID: stringPtr(strconv.Itoa(l.ID)), module: stringPtr("inventory")})
+		} else {
+			pending = append(pending, pendingNotif{ntype: "lot_expiry", severity: "warning", title: "Lot Expiring: " + l.LotNumber,
+				message: stringPtr(msg), recordID: stringPtr(strconv.Itoa(l.ID)), module: stringPtr("inventory")})
+		}
+	}
+	return pending
+}
+
+// runLotExpiryCheck quarantines expired lots and raises the expiry
+// notifications.
+func runLotExpiryCheck(now time.Time) ([]InventoryLot, error) {
+	lots, err := quarantineExpiredLots("system", now)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range lotExpiryAlerts(30) {
+		createNotificationIfNew(p.ntype, p.severity, p.title, p.message, p.recordID, p.module)
+	}
+	return lots, nil
+}
+
+// startExpiryScheduler runs the expiry check once a day at runTime (HH:MM),
+// 01:00 by default. A runTime that doesn't parse is logged and the default
+// used, so expired lots are still quarantined.
+func startExpiryScheduler(runTime string) {
+	check := func() {
+		lots, err := runLotExpiryCheck(time.Now())
+		if err != nil {
+			log.Printf("Lot expiry check failed: %v", err)
+		} else {
+			log.Printf("Lot expiry check quarantined %d lots", len(lots))
+		}
+	}
+	if runTime == "" {
+		runTime = "01:00"
+	}
+	if err := runDaily(runTime, check); err != nil {
+		log.Printf("ZRP_EXPIRY_TIME: %v; running the lot expiry check at 01:00", err)
+		runDaily("01:00", check)
+	}
+}
+
+// handleListExpiringLots lists lots expiring within ?days= (30 by default),
+// expired ones first.
+func handleListExpiringLots(w http.ResponseWriter, r *http.Request) {
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			jsonErr(w, "days must be a non-negative number", 400)
+			return
+		}
+		days = n
+	}
+	lots, err := expiringLots(days, time.Now())
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	jsonResp(w, lots)
+}
+
+// handleQuarantineExpiredLots runs the expiry check now.
+func handleQuarantineExpiredLots(w http.ResponseWriter, r *http.Request) {
+	lots, err := quarantineExpiredLots(getUsername(r), time.Now())
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	jsonResp(w, map[string]interface{}{"quarantined": lots})
+}
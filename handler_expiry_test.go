@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLotExpiryFEFOAndQuarantine(t *testing.T) {
+	oldDB, oldPartsDir := db, partsDir
+	db = setupTestDB(t)
+	partsDir = t.TempDir()
+	defer func() { db.Close(); db = oldDB; partsDir = oldPartsDir }()
+
+	os.WriteFile(filepath.Join(partsDir, "chem.csv"), []byte("IPN,Description,shelf_life_days\nPASTE-1,Solder paste,180\n"), 0644)
+	now := time.Now()
+	day := func(n int) string { return now.AddDate(0, 0, n).Format("2006-01-02") }
+
+	// A receipt without an expiry date takes the part's shelf life
+	if w := postTransact(t, `{"ipn":"PASTE-1","type":"receive","qty":10,"lot_number":"JAR-1"}`); w.Code != 200 {
+		t.Fatalf("receive failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := postTransact(t, `{"ipn":"PASTE-1","type":"receive","qty":10,"lot_number":"JAR-2","expires_at":"`+day(10)+`"}`); w.Code != 200 {
+		t.Fatalf("receive failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := postTransact(t, `{"ipn":"PASTE-1","type":"receive","qty":5,"lot_number":"JAR-3","expires_at":"someday"}`); w.Code != 400 {
+		t.Errorf("expected a bad expiry date to be refused, got %d", w.Code)
+	}
+	var jar1, jar2 int
+	db.QueryRow("SELECT id FROM inventory_lots WHERE lot_number='JAR-1'").Scan(&jar1)
+	db.QueryRow("SELECT id FROM inventory_lots WHERE lot_number='JAR-2'").Scan(&jar2)
+	if l, _ := loadLot(jar1); l.ExpiresAt == nil || *l.ExpiresAt != day(180) {
+		t.Fatalf("expected JAR-1 to expire %s, got %v", day(180), l.ExpiresAt)
+	}
+	// An older jar that expired yesterday
+	received := now.AddDate(0, -7, 0).Format("2006-01-02 15:04:05")
+	expired := day(-1)
+	jar0 := seedLot(t, InventoryLot{IPN: "PASTE-1", LotNumber: "JAR-0", QtyReceived: 8, QtyOnHand: 8, ReceivedAt: &received, ExpiresAt: &expired})
+	db.Exec("UPDATE inventory SET qty_on_hand = qty_on_hand + 8 WHERE ipn='PASTE-1'")
+
+	// FEFO takes the jar that expires first and never the expired one
+	if w := postTransact(t, `{"ipn":"PASTE-1","type":"issue","qty":4,"reference":"WO-1"}`); w.Code != 200 {
+		t.Fatalf("issue failed: %d %s", w.Code, w.Body.String())
+	}
+	if q, _ := lotQty(t, jar2); q != 6 {
+		t.Errorf("expected 6 left in JAR-2, got %v", q)
+	}
+	if q, _ := lotQty(t, jar0); q != 8 {
+		t.Errorf("expected the expired jar untouched, got %v", q)
+	}
+	if w := postTransact(t, `{"ipn":"PASTE-1","type":"issue","lots":[{"lot_id":`+strconv.Itoa(jar0)+`,"qty":1}]}`); w.Code != 400 {
+		t.Errorf("expected picking an expired lot to be refused, got %d", w.Code)
+	}
+	// 16 usable and 8 expired on hand: the expired stock can't make up 20
+	if w := postTransact(t, `{"ipn":"PASTE-1","type":"issue","qty":20}`); w.Code != 400 || !strings.Contains(w.Body.String(), "expired") {
+		t.Errorf("expected issuing expired stock to be refused, got %d %s", w.Code, w.Body.String())
+	}
+
+	alerts := lotExpiryAlerts(30)
+	if len(alerts) != 2 || alerts[0].ntype != "lot_expired" || *alerts[0].recordID != strconv.Itoa(jar0) || alerts[1].ntype != "lot_expiry" {
+		t.Errorf("unexpected alerts: %+v", alerts)
+	}
+
+	w := httptest.NewRecorder()
+	handleQuarantineExpiredLots(w, httptest.NewRequest("POST", "/api/v1/lots/quarantine-expired", nil))
+	var run struct {
+		Data struct {
+			Quarantined []InventoryLot `json:"quarantined"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &run)
+	if len(run.Data.Quarantined) != 1 || run.Data.Quarantined[0].ID != jar0 {
+		t.Fatalf("unexpected quarantine run: %s", w.Body.String())
+	}
+	if _, s := lotQty(t, jar0); s != "quarantine" {
+		t.Errorf("expected JAR-0 quarantined, got %s", s)
+	}
+
+	w = httptest.NewRecorder()
+	handleListExpiringLots(w, httptest.NewRequest("GET", "/api/v1/lots/expiring?days=30", nil))
+	var list struct {
+		Data []InventoryLot `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Data) != 2 || list.Data[0].ID != jar0 || list.Data[1].ID != jar2 {
+		t.Errorf("unexpected expiring lots: %s", w.Body.String())
+	}
+
+	// Releasing needs a later expiry date, e.g. after recertification
+	update := func(body string) int {
+		w := httptest.NewRecorder()
+		handleUpdateLot(w, httptest.NewRequest("PUT", "/api/v1/lots/"+strconv.Itoa(jar0), bytes.NewBufferString(body)), strconv.Itoa(jar0))
+		return w.Code
+	}
+	if code := update(`{"status":"available"}`); code != 400 {
+		t.Errorf("expected releasing an expired lot to be refused, got %d", code)
+	}
+	if code := update(`{"status":"available","expires_at":"` + day(30) + `"}`); code != 200 {
+		t.Fatalf("recertified release failed: %d", code)
+	}
+	if w := postTransact(t, `{"ipn":"PASTE-1","type":"issue","qty":20}`); w.Code != 200 {
+		t.Errorf("expected the recertified jar to issue, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMigrateLotStatusCheck(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+
+	// A lots table from before quarantine, with a column added later
+	for _, s := range []string{
+		"DROP TABLE inventory_lots",
+		`CREATE TABLE inventory_lots (id INTEGER PRIMARY KEY AUTOINCREMENT, ipn TEXT NOT NULL, lot_number TEXT NOT NULL,
+			status TEXT DEFAULT 'available' CHECK(status IN ('inspection','available','hold','depleted')))`,
+		"ALTER TABLE inventory_lots ADD COLUMN expires_at DATE",
+		"INSERT INTO inventory_lots (ipn, lot_number, expires_at) VALUES ('PASTE-1', 'JAR-1', '2026-01-01')",
+	} {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("%v\n%s", err, s)
+		}
+	}
+	if _, err := db.Exec("UPDATE inventory_lots SET status='quarantine'"); err == nil {
+		t.Fatal("expected the old table to refuse quarantine")
+	}
+	if err := migrateLotStatusCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateLotStatusCheck(); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if _, err := db.Exec("UPDATE inventory_lots SET status='quarantine'"); err != nil {
+		t.Fatalf("expected quarantine allowed after migration: %v", err)
+	}
+	var lot, expires string
+	db.QueryRow("SELECT lot_number, substr(expires_at,1,10) FROM inventory_lots").Scan(&lot, &expires)
+	if lot != "JAR-1" || expires != "2026-01-01" {
+		t.Errorf("expected the lot kept, got %q %q", lot, expires)
+	}
+}
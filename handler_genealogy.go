@@ -0,0 +1,495 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SerialComponent is one line of a serial's as-built record: a child serial
+// (a sub-assembly built on another WO) or a quantity from a lot.
+type SerialComponent struct {
+	ID            int     `json:"id"`
+	ParentSerial  string  `json:"parent_serial"`
+	ComponentType string  `json:"component_type"`
+	ChildSerial   string  `json:"child_serial,omitempty"`
+	LotID         *int    `json:"lot_id,omitempty"`
+	LotNumber     string  `json:"lot_number,omitempty"`
+	IPN           string  `json:"ipn"`
+	Qty           float64 `json:"qty"`
+	WOID          string  `json:"wo_id"`
+	InstalledBy   string  `json:"installed_by"`
+	InstalledAt   string  `json:"installed_at"`
+}
+
+// SerialComponentInput is a component as entered or scanned. Code is a raw
+// scan that may be either a serial number or a lot number; otherwise one of
+// SerialNumber or LotID is given.
+type SerialComponentInput struct {
+	Code         string  `json:"code"`
+	SerialNumber string  `json:"serial_number"`
+	LotID        int     `json:"lot_id"`
+	IPN          string  `json:"ipn"`
+	Qty          float64 `json:"qty"`
+}
+
+// serialIPN returns the part number of a serial from its device record or
+// the WO that built it, and whether the serial is known at all.
+func serialIPN(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, serial string) (string, bool) {
+	var ipn string
+	if q.QueryRow("SELECT ipn FROM devices WHERE serial_number=?", serial).Scan(&ipn) == nil {
+		return ipn, true
+	}
+	if q.QueryRow("SELECT w.assembly_ipn FROM wo_serials s JOIN work_orders w ON w.id = s.wo_id WHERE s.serial_number=?",
+		serial).Scan(&ipn) == nil {
+		return ipn, true
+	}
+	return "", false
+}
+
+// serialAncestors lists the serials a serial is installed in, innermost
+// first.
+func serialAncestors(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, serial string) []string {
+	var chain []string
+	seen := map[string]bool{serial: true}
+	for len(chain) < maxTraceDepth {
+		var parent string
+		if q.QueryRow("SELECT parent_serial FROM serial_components WHERE component_type='serial' AND child_serial=?",
+			serial).Scan(&parent) != nil || seen[parent] {
+			break
+		}
+		chain = append(chain, parent)
+		seen[parent] = true
+		serial = parent
+	}
+	return chain
+}
+
+// resolveSerialComponent turns an input into a component of parent, checking
+// that it exists and can be installed. The returned error is meant for the
+// client.
+func resolveSerialComponent(tx *sql.Tx, parent, woID string, in SerialComponentInput) (SerialComponent, error) {
+	c := SerialComponent{ParentSerial: parent, WOID: woID, Qty: in.Qty}
+	code := strings.TrimSpace(in.Code)
+	if code != "" {
+		if _, ok := serialIPN(tx, code); ok {
+			in.SerialNumber = code
+		} else {
+			query := "SELECT id FROM inventory_lots WHERE lot_number=?"
+			args := []interface{}{code}
+			if in.IPN != "" {
+				query += " AND ipn=?"
+				args = append(args, in.IPN)
+			}
+			rows, err := tx.Query(query, args...)
+			if err != nil {
+				return c, err
+			}
+			var ids []int
+			for rows.Next() {
+				var id int
+				rows.Scan(&id)
+				ids = append(ids, id)
+			}
+			rows.Close()
+			switch len(ids) {
+			case 0:
+				return c, fmt.Errorf("no serial or lot matches %q", code)
+			case 1:
+				in.LotID = ids[0]
+			default:
+				return c, fmt.Errorf("lot %q exists for several parts; give ipn", code)
+			}
+		}
+	}
+
+	switch {
+	case in.SerialNumber != "":
+		child := strings.TrimSpace(in.SerialNumber)
+		if child == parent {
+			return c, fmt.Errorf("serial %s cannot be installed in itself", child)
+		}
+		ipn, ok := serialIPN(tx, child)
+		if !ok {
+			return c, fmt.Errorf("serial %s not found", child)
+		}
+		var status string
+		tx.QueryRow("SELECT status FROM wo_serials WHERE serial_number=?", child).Scan(&status)
+		if status == "failed" || status == "scrapped" {
+			return c, fmt.Errorf("serial %s is %s", child, status)
+		}
+		var installedIn string
+		if tx.QueryRow("SELECT parent_serial FROM serial_components WHERE component_type='serial' AND child_serial=?",
+			child).Scan(&installedIn) == nil {
+			return c, fmt.Errorf("serial %s is already installed in %s", child, installedIn)
+		}
+		for _, a := range serialAncestors(tx, parent) {
+			if a == child {
+				return c, fmt.Errorf("serial %s already contains %s", child, parent)
+			}
+		}
+		c.ComponentType, c.ChildSerial, c.IPN, c.Qty = "serial", child, ipn, 1
+	case in.LotID != 0:
+		lot, err := scanLot(tx.QueryRow("SELECT "+lotColumns+" FROM inventory_lots WHERE id=?", in.LotID))
+		if err != nil {
+			return c, fmt.Errorf("lot %d not found", in.LotID)
+		}
+		if lot.Status == "inspection" || lot.Status == "hold" || lot.Status == "quarantine" {
+			return c, fmt.Errorf("lot %s is %s", lot.LotNumber, lot.Status)
+		}
+		if c.Qty == 0 {
+			c.Qty = 1
+		}
+		if c.Qty < 0 {
+			return c, fmt.Errorf("lot %s: qty must be positive", lot.LotNumber)
+		}
+		id := lot.ID
+		c.ComponentType, c.LotID, c.LotNumber, c.IPN = "lot", &id, lot.LotNumber, lot.IPN
+	default:
+		return c, fmt.Errorf("component needs a code, serial_number or lot_id")
+	}
+	return c, nil
+}
+
+// addSerialComponents validates and records components of parent. Inputs
+// are checked in order, so a child serial given twice is caught too.
+// Validation errors are returned with status 400.
+func addSerialComponents(tx *sql.Tx, parent, woID string, inputs []SerialComponentInput, username string) ([]SerialComponent, int, error) {
+	now := time.Now().Format("2006-01-02 15:04:05")
+	added := []SerialComponent{}
+	for i, in := range inputs {
+		c, err := resolveSerialComponent(tx, parent, woID, in)
+		if err != nil {
+			return nil, 400, fmt.Errorf("components[%d]: %w", i, err)
+		}
+		res, err := tx.Exec(`INSERT INTO serial_components (parent_serial, component_type, child_serial, lot_id, ipn, qty, wo_id, installed_by, installed_at)
+			VALUES (?,?,?,?,?,?,?,?,?)`, c.ParentSerial, c.ComponentType, c.ChildSerial, c.LotID, c.IPN, c.Qty, c.WOID, username, now)
+		if err != nil {
+			return nil, 500, fmt.Errorf("failed to record component of %s: %w", parent, err)
+		}
+		id, _ := res.LastInsertId()
+		c.ID, c.InstalledBy, c.InstalledAt = int(id), username, now
+		added = append(added, c)
+	}
+	return added, 200, nil
+}
+
+const serialComponentColumns = `c.id, c.parent_serial, c.component_type, COALESCE(c.child_serial,''), c.lot_id, COALESCE(l.lot_number,''),
+	COALESCE(c.ipn,''), c.qty, COALESCE(c.wo_id,''), COALESCE(c.installed_by,''), c.installed_at`
+
+func loadSerialComponents(where string, args ...interface{}) ([]SerialComponent, error) {
+	rows, err := db.Query("SELECT "+serialComponentColumns+` FROM serial_components c
+		LEFT JOIN inventory_lots l ON l.id = c.lot_id WHERE `+where+" ORDER BY c.parent_serial, c.id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []SerialComponent{}
+	for rows.Next() {
+		var c SerialComponent
+		var lotID sql.NullInt64
+		if err := rows.Scan(&c.ID, &c.ParentSerial, &c.ComponentType, &c.ChildSerial, &lotID, &c.LotNumber,
+			&c.IPN, &c.Qty, &c.WOID, &c.InstalledBy, &c.InstalledAt); err != nil {
+			return nil, err
+		}
+		if lotID.Valid {
+			v := int(lotID.Int64)
+			c.LotID = &v
+		}
+		items = append(items, c)
+	}
+	return items, rows.Err()
+}
+
+// handleAddSerialComponents records components against an existing serial of
+// a WO, one scan at a time or as a list.
+func handleAddSerialComponents(w http.ResponseWriter, r *http.Request, woID, serial string) {
+	var woStatus, serialStatus string
+	if err := db.QueryRow("SELECT status FROM work_orders WHERE id=?", woID).Scan(&woStatus); err != nil {
+		jsonErr(w, "work order not found", 404)
+		return
+	}
+	if err := db.QueryRow("SELECT status FROM wo_serials WHERE wo_id=? AND serial_number=?", woID, serial).Scan(&serialStatus); err != nil {
+		jsonErr(w, "serial number not found on this work order", 404)
+		return
+	}
+	if woStatus == "cancelled" || serialStatus == "scrapped" {
+		jsonErr(w, "cannot add components to a cancelled work order or scrapped serial", 400)
+		return
+	}
+	var body struct {
+		SerialComponentInput
+		Components []SerialComponentInput `json:"components"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	inputs := body.Components
+	if len(inputs) == 0 {
+		inputs = []SerialComponentInput{body.SerialComponentInput}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+	added, code, err := addSerialComponents(tx, serial, woID, inputs, getUsername(r))
+	if err != nil {
+		jsonErr(w, err.Error(), code)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, getUsername(r), "updated", "serial", serial, fmt.Sprintf("Recorded %d component(s) in serial %s", len(added), serial))
+	jsonResp(w, added)
+}
+
+// GenealogyLot is a lot that went into a unit. Source is "as_built" when it
+// was recorded against the serial itself and "work_order" when it was issued
+// to the WO that built the serial, so it may or may not be in this unit.
+type GenealogyLot struct {
+	LotID     int     `json:"lot_id"`
+	LotNumber string  `json:"lot_number"`
+	IPN       string  `json:"ipn"`
+	DateCode  string  `json:"date_code"`
+	VendorID  string  `json:"vendor_id"`
+	Qty       float64 `json:"qty"`
+	Source    string  `json:"source"`
+}
+
+type GenealogyNode struct {
+	SerialNumber string          `json:"serial_number"`
+	IPN          string          `json:"ipn"`
+	WOID         string          `json:"wo_id"`
+	Status       string          `json:"status"`
+	Customer     string          `json:"customer"`
+	Location     string          `json:"location"`
+	DeviceStatus string          `json:"device_status"`
+	Lots         []GenealogyLot  `json:"lots"`
+	Children     []GenealogyNode `json:"children"`
+}
+
+func buildGenealogy(serial string, depth int) (GenealogyNode, error) {
+	n := GenealogyNode{SerialNumber: serial, Lots: []GenealogyLot{}, Children: []GenealogyNode{}}
+	ipn, ok := serialIPN(db, serial)
+	if !ok {
+		return n, sql.ErrNoRows
+	}
+	n.IPN = ipn
+	db.QueryRow("SELECT wo_id, status FROM wo_serials WHERE serial_number=?", serial).Scan(&n.WOID, &n.Status)
+	db.QueryRow("SELECT COALESCE(customer,''), COALESCE(location,''), COALESCE(status,'') FROM devices WHERE serial_number=?",
+		serial).Scan(&n.Customer, &n.Location, &n.DeviceStatus)
+
+	comps, err := loadSerialComponents("c.parent_serial=?", serial)
+	if err != nil {
+		return n, err
+	}
+	for _, c := range comps {
+		if c.ComponentType == "lot" && c.LotID != nil {
+			n.Lots = append(n.Lots, GenealogyLot{LotID: *c.LotID, LotNumber: c.LotNumber, IPN: c.IPN, Qty: c.Qty, Source: "as_built"})
+		}
+	}
+	if n.WOID != "" {
+		rows, err := db.Query(`SELECT lot_id, ipn, SUM(CASE type WHEN 'issue' THEN qty ELSE -qty END) FROM inventory_transactions
+			WHERE reference=? AND lot_id IS NOT NULL AND type IN ('issue','return') GROUP BY lot_id, ipn
+			HAVING SUM(CASE type WHEN 'issue' THEN qty ELSE -qty END) > 0 ORDER BY lot_id`, n.WOID)
+		if err != nil {
+			return n, err
+		}
+		for rows.Next() {
+			l := GenealogyLot{Source: "work_order"}
+			rows.Scan(&l.LotID, &l.IPN, &l.Qty)
+			n.Lots = append(n.Lots, l)
+		}
+		rows.Close()
+	}
+	for i := range n.Lots {
+		l := &n.Lots[i]
+		db.QueryRow("SELECT lot_number, COALESCE(date_code,''), COALESCE(vendor_id,'') FROM inventory_lots WHERE id=?",
+			l.LotID).Scan(&l.LotNumber, &l.DateCode, &l.VendorID)
+	}
+
+	if depth < maxTraceDepth {
+		for _, c := range comps {
+			if c.ComponentType != "serial" {
+				continue
+			}
+			child, err := buildGenealogy(c.ChildSerial, depth+1)
+			if err == sql.ErrNoRows {
+				child = GenealogyNode{SerialNumber: c.ChildSerial, IPN: c.IPN, Lots: []GenealogyLot{}, Children: []GenealogyNode{}}
+			} else if err != nil {
+				return n, err
+			}
+			n.Children = append(n.Children, child)
+		}
+	}
+	return n, nil
+}
+
+// handleSerialGenealogy renders the as-built tree below a serial and the
+// chain of units it is installed in.
+func handleSerialGenealogy(w http.ResponseWriter, r *http.Request, serial string) {
+	tree, err := buildGenealogy(serial, 0)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "serial number not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	installedIn := serialAncestors(db, serial)
+	if installedIn == nil {
+		installedIn = []string{}
+	}
+	jsonResp(w, map[string]interface{}{"serial_number": serial, "installed_in": installedIn, "tree": tree})
+}
+
+// SerialSibling is another unit built with some of the same lots.
+type SerialSibling struct {
+	SerialNumber string   `json:"serial_number"`
+	IPN          string   `json:"ipn"`
+	WOID         string   `json:"wo_id"`
+	TopSerial    string   `json:"top_serial"`
+	Customer     string   `json:"customer"`
+	SharedLots   []string `json:"shared_lots"`
+}
+
+// SerialImpact is what an RMA or NCR on a serial puts in question: the
+// unit's genealogy, every lot in it, and the other units that share a lot.
+type SerialImpact struct {
+	SerialNumber string          `json:"serial_number"`
+	InstalledIn  []string        `json:"installed_in"`
+	Tree         GenealogyNode   `json:"tree"`
+	SuspectLots  []GenealogyLot  `json:"suspect_lots"`
+	Siblings     []SerialSibling `json:"siblings"`
+}
+
+func collectGenealogy(n GenealogyNode, serials map[string]bool, lots map[int]GenealogyLot) {
+	serials[n.SerialNumber] = true
+	for _, l := range n.Lots {
+		if _, ok := lots[l.LotID]; !ok {
+			lots[l.LotID] = l
+		}
+	}
+	for _, c := range n.Children {
+		collectGenealogy(c, serials, lots)
+	}
+}
+
+func serialImpact(serial string) (*SerialImpact, error) {
+	tree, err := buildGenealogy(serial, 0)
+	if err != nil {
+		return nil, err
+	}
+	imp := &SerialImpact{SerialNumber: serial, InstalledIn: serialAncestors(db, serial), Tree: tree,
+		SuspectLots: []GenealogyLot{}, Siblings: []SerialSibling{}}
+	if imp.InstalledIn == nil {
+		imp.InstalledIn = []string{}
+	}
+	own := map[string]bool{}
+	lots := map[int]GenealogyLot{}
+	collectGenealogy(tree, own, lots)
+	for _, a := range imp.InstalledIn {
+		own[a] = true
+	}
+	lotIDs := make([]int, 0, len(lots))
+	for id := range lots {
+		lotIDs = append(lotIDs, id)
+	}
+	sort.Ints(lotIDs)
+
+	// Serials with a suspect lot in their as-built record or issued to the
+	// WO that built them
+	shared := map[string]map[string]bool{}
+	for _, id := range lotIDs {
+		rows, err := db.Query(`SELECT parent_serial FROM serial_components WHERE component_type='lot' AND lot_id=?
+			UNION SELECT s.serial_number FROM inventory_transactions t JOIN wo_serials s ON s.wo_id = t.reference
+			WHERE t.lot_id=? AND t.type='issue'`, id, id)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var sn string
+			rows.Scan(&sn)
+			if own[sn] {
+				continue
+			}
+			if shared[sn] == nil {
+				shared[sn] = map[string]bool{}
+			}
+			shared[sn][lots[id].LotNumber] = true
+		}
+		rows.Close()
+		imp.SuspectLots = append(imp.SuspectLots, lots[id])
+	}
+
+	names := make([]string, 0, len(shared))
+	for sn := range shared {
+		names = append(names, sn)
+	}
+	sort.Strings(names)
+	for _, sn := range names {
+		s := SerialSibling{SerialNumber: sn, TopSerial: sn, SharedLots: []string{}}
+		s.IPN, _ = serialIPN(db, sn)
+		db.QueryRow("SELECT wo_id FROM wo_serials WHERE serial_number=?", sn).Scan(&s.WOID)
+		if up := serialAncestors(db, sn); len(up) > 0 {
+			s.TopSerial = up[len(up)-1]
+		}
+		db.QueryRow("SELECT COALESCE(customer,'') FROM devices WHERE serial_number=?", s.TopSerial).Scan(&s.Customer)
+		for l := range shared[sn] {
+			s.SharedLots = append(s.SharedLots, l)
+		}
+		sort.Strings(s.SharedLots)
+		imp.Siblings = append(imp.Siblings, s)
+	}
+	return imp, nil
+}
+
+func writeSerialImpact(w http.ResponseWriter, serial string) {
+	if serial == "" {
+		jsonErr(w, "no serial number recorded", 400)
+		return
+	}
+	imp, err := serialImpact(serial)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "serial number "+serial+" not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	jsonResp(w, imp)
+}
+
+// handleRMAGenealogy shows the genealogy of the returned unit and the other
+// units built with the same material.
+func handleRMAGenealogy(w http.ResponseWriter, r *http.Request, id string) {
+	var serial string
+	if err := db.QueryRow("SELECT serial_number FROM rmas WHERE id=?", id).Scan(&serial); err != nil {
+		jsonErr(w, "not found", 404)
+		return
+	}
+	writeSerialImpact(w, serial)
+}
+
+// handleNCRGenealogy is handleRMAGenealogy for the serial on an NCR.
+func handleNCRGenealogy(w http.ResponseWriter, r *http.Request, id string) {
+	var serial string
+	if err := db.QueryRow("SELECT COALESCE(serial_number,'') FROM ncrs WHERE id=?", id).Scan(&serial); err != nil {
+		jsonErr(w, "not found", 404)
+		return
+	}
+	writeSerialImpact(w, serial)
+}
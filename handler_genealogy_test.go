@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func postSerial(t *testing.T, woID, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleWorkOrderAddSerial(w, httptest.NewRequest("POST", "/api/v1/workorders/"+woID+"/serials", bytes.NewBufferString(body)), woID)
+	return w
+}
+
+func postComponents(t *testing.T, woID, serial, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleAddSerialComponents(w, httptest.NewRequest("POST", "/api/v1/workorders/"+woID+"/serials/"+serial+"/components",
+		bytes.NewBufferString(body)), woID, serial)
+	return w
+}
+
+// seedGenealogy builds two ASY-1 units, each with a PCA-1 sub-assembly
+// built from resistor lot R-100. TOP-1 also has capacitors from lot C-7.
+func seedGenealogy(t *testing.T) (capLot int) {
+	t.Helper()
+	seedLot(t, InventoryLot{IPN: "RES-1", LotNumber: "R-100", VendorID: "V-1", QtyReceived: 100, QtyOnHand: 100})
+	capLot = seedLot(t, InventoryLot{IPN: "CAP-1", LotNumber: "C-7", QtyReceived: 50, QtyOnHand: 50})
+	db.Exec(`INSERT INTO work_orders (id, assembly_ipn, qty, status) VALUES ('WO-SUB', 'PCA-1', 2, 'in_progress')`)
+	db.Exec(`INSERT INTO work_orders (id, assembly_ipn, qty, status) VALUES ('WO-TOP', 'ASY-1', 2, 'in_progress')`)
+
+	for _, sn := range []string{"SUB-1", "SUB-2"} {
+		if w := postSerial(t, "WO-SUB", `{"serial_number":"`+sn+`","components":[{"code":"R-100","qty":4}]}`); w.Code != 200 {
+			t.Fatalf("adding %s failed: %d %s", sn, w.Code, w.Body.String())
+		}
+	}
+	body := `{"serial_number":"TOP-1","components":[{"serial_number":"SUB-1"},{"lot_id":` + strconv.Itoa(capLot) + `,"qty":2}]}`
+	if w := postSerial(t, "WO-TOP", body); w.Code != 200 {
+		t.Fatalf("adding TOP-1 failed: %d %s", w.Code, w.Body.String())
+	}
+	// TOP-2 is scanned together after the serial is created
+	if w := postSerial(t, "WO-TOP", `{"serial_number":"TOP-2"}`); w.Code != 200 {
+		t.Fatalf("adding TOP-2 failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := postComponents(t, "WO-TOP", "TOP-2", `{"code":"SUB-2"}`); w.Code != 200 {
+		t.Fatalf("scanning SUB-2 into TOP-2 failed: %d %s", w.Code, w.Body.String())
+	}
+	db.Exec(`INSERT INTO devices (serial_number, ipn, customer) VALUES ('TOP-1', 'ASY-1', 'Acme'), ('TOP-2', 'ASY-1', 'Beta')`)
+	return capLot
+}
+
+func TestSerialComponentValidation(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedGenealogy(t)
+
+	held := seedLot(t, InventoryLot{IPN: "CAP-1", LotNumber: "C-8", QtyReceived: 10, QtyOnHand: 10, Status: "hold"})
+	tests := []struct {
+		name, woID, serial, body string
+	}{
+		{"child already installed", "WO-TOP", "TOP-2", `{"serial_number":"SUB-1"}`},
+		{"parent into its own child", "WO-SUB", "SUB-1", `{"code":"TOP-1"}`},
+		{"itself", "WO-TOP", "TOP-2", `{"serial_number":"TOP-2"}`},
+		{"unknown code", "WO-TOP", "TOP-2", `{"code":"NOPE"}`},
+		{"unknown serial", "WO-TOP", "TOP-2", `{"serial_number":"NOPE"}`},
+		{"lot on hold", "WO-TOP", "TOP-2", `{"lot_id":` + strconv.Itoa(held) + `}`},
+		{"nothing given", "WO-TOP", "TOP-2", `{}`},
+	}
+	for _, tt := range tests {
+		if w := postComponents(t, tt.woID, tt.serial, tt.body); w.Code != 400 {
+			t.Errorf("%s: expected 400, got %d %s", tt.name, w.Code, w.Body.String())
+		}
+	}
+	if w := postComponents(t, "WO-SUB", "TOP-2", `{"code":"R-100"}`); w.Code != 404 {
+		t.Errorf("expected 404 for a serial of another WO, got %d", w.Code)
+	}
+
+	// A failed component in a new serial leaves no serial behind
+	if w := postSerial(t, "WO-TOP", `{"serial_number":"TOP-3","components":[{"code":"NOPE"}]}`); w.Code != 400 {
+		t.Errorf("expected 400 adding serial with a bad component, got %d", w.Code)
+	}
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM wo_serials WHERE serial_number='TOP-3'").Scan(&n)
+	if n != 0 {
+		t.Error("serial TOP-3 should not have been created")
+	}
+
+	w := httptest.NewRecorder()
+	handleWorkOrderSerials(w, httptest.NewRequest("GET", "/api/v1/workorders/WO-TOP/serials", nil), "WO-TOP")
+	var list struct {
+		Data []WOSerial `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Data) != 2 || len(list.Data[0].Components) != 2 || len(list.Data[1].Components) != 1 {
+		t.Errorf("expected TOP-1 with 2 components and TOP-2 with 1, got %+v", list.Data)
+	}
+}
+
+func TestSerialGenealogyAndImpact(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedGenealogy(t)
+
+	w := httptest.NewRecorder()
+	handleSerialGenealogy(w, httptest.NewRequest("GET", "/api/v1/serials/TOP-1/genealogy", nil), "TOP-1")
+	if w.Code != 200 {
+		t.Fatalf("genealogy failed: %d %s", w.Code, w.Body.String())
+	}
+	var gen struct {
+		Data struct {
+			InstalledIn []string      `json:"installed_in"`
+			Tree        GenealogyNode `json:"tree"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &gen)
+	tree := gen.Data.Tree
+	if tree.IPN != "ASY-1" || tree.Customer != "Acme" || len(tree.Lots) != 1 || tree.Lots[0].LotNumber != "C-7" {
+		t.Errorf("unexpected TOP-1 node: %+v", tree)
+	}
+	if len(tree.Children) != 1 || tree.Children[0].SerialNumber != "SUB-1" || tree.Children[0].IPN != "PCA-1" {
+		t.Fatalf("expected SUB-1 under TOP-1, got %+v", tree.Children)
+	}
+	if l := tree.Children[0].Lots; len(l) != 1 || l[0].LotNumber != "R-100" || l[0].Qty != 4 || l[0].VendorID != "V-1" {
+		t.Errorf("expected 4 from lot R-100 in SUB-1, got %+v", l)
+	}
+
+	w = httptest.NewRecorder()
+	handleSerialGenealogy(w, httptest.NewRequest("GET", "/api/v1/serials/SUB-1/genealogy", nil), "SUB-1")
+	json.Unmarshal(w.Body.Bytes(), &gen)
+	if len(gen.Data.InstalledIn) != 1 || gen.Data.InstalledIn[0] != "TOP-1" {
+		t.Errorf("expected SUB-1 installed in TOP-1, got %v", gen.Data.InstalledIn)
+	}
+
+	w = httptest.NewRecorder()
+	handleSerialGenealogy(w, httptest.NewRequest("GET", "/api/v1/serials/NOPE/genealogy", nil), "NOPE")
+	if w.Code != 404 {
+		t.Errorf("expected 404 for unknown serial, got %d", w.Code)
+	}
+
+	// An RMA on TOP-1 points at TOP-2, built with the same resistor lot
+	db.Exec(`INSERT INTO rmas (id, serial_number, customer, reason) VALUES ('RMA-1', 'TOP-1', 'Acme', 'dead')`)
+	w = httptest.NewRecorder()
+	handleRMAGenealogy(w, httptest.NewRequest("GET", "/api/v1/rmas/RMA-1/genealogy", nil), "RMA-1")
+	if w.Code != 200 {
+		t.Fatalf("RMA genealogy failed: %d %s", w.Code, w.Body.String())
+	}
+	var imp struct {
+		Data SerialImpact `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &imp)
+	if len(imp.Data.SuspectLots) != 2 {
+		t.Errorf("expected 2 suspect lots, got %+v", imp.Data.SuspectLots)
+	}
+	if len(imp.Data.Siblings) != 1 {
+		t.Fatalf("expected 1 sibling, got %+v", imp.Data.Siblings)
+	}
+	s := imp.Data.Siblings[0]
+	if s.SerialNumber != "SUB-2" || s.TopSerial != "TOP-2" || s.Customer != "Beta" || len(s.SharedLots) != 1 || s.SharedLots[0] != "R-100" {
+		t.Errorf("expected SUB-2 in Beta's TOP-2 sharing R-100, got %+v", s)
+	}
+
+	// The same from an NCR raised on the sub-assembly
+	db.Exec(`INSERT INTO ncrs (id, title, serial_number) VALUES ('NCR-1', 'cracked joint', 'SUB-2'), ('NCR-2', 'no serial', '')`)
+	w = httptest.NewRecorder()
+	handleNCRGenealogy(w, httptest.NewRequest("GET", "/api/v1/ncrs/NCR-1/genealogy", nil), "NCR-1")
+	json.Unmarshal(w.Body.Bytes(), &imp)
+	if len(imp.Data.InstalledIn) != 1 || imp.Data.InstalledIn[0] != "TOP-2" || len(imp.Data.Siblings) != 1 || imp.Data.Siblings[0].TopSerial != "TOP-1" {
+		t.Errorf("unexpected NCR impact: %+v", imp.Data)
+	}
+	w = httptest.NewRecorder()
+	handleNCRGenealogy(w, httptest.NewRequest("GET", "/api/v1/ncrs/NCR-2/genealogy", nil), "NCR-2")
+	if w.Code != 400 {
+		t.Errorf("expected 400 for NCR without serial, got %d", w.Code)
+	}
+}
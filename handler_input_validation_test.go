@@ -88,6 +88,24 @@ func setupInputValidationDB(t *testing.T) *sql.DB {
 			started_at TIMESTAMP,
 			completed_at TIMESTAMP
 		)`,
+		`CREATE TABLE routing_steps (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			assembly_ipn TEXT NOT NULL,
+			seq INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			work_center_id TEXT DEFAULT '',
+			instructions TEXT DEFAULT '',
+			std_minutes REAL DEFAULT 0
+		)`,
+		`CREATE TABLE wo_operations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			wo_id TEXT NOT NULL,
+			seq INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			work_center_id TEXT DEFAULT '',
+			instructions TEXT DEFAULT '',
+			status TEXT DEFAULT 'pending'
+		)`,
 		`CREATE TABLE inventory (
 			ipn TEXT PRIMARY KEY,
 			qty_on_hand REAL DEFAULT 0,
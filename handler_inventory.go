@@ -1,15 +1,31 @@
 package main
 
 import (
+	"database/sql"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
 )
 
+// handleListInventory lists stock per IPN. With ?location= only stock held
+// at that location and the locations under it is counted, so a site code
+// gives the site's inventory. ?by_location=true breaks each IPN down by
+// location.
 func handleListInventory(w http.ResponseWriter, r *http.Request) {
 	lowStock := r.URL.Query().Get("low_stock")
+	location := r.URL.Query().Get("location")
+	var atLocation map[string]float64
+	subtree := map[string]bool{}
+	if location != "" {
+		var exists int
+		if db.QueryRow("SELECT 1 FROM locations WHERE code=?", location).Scan(&exists) != nil { jsonErr(w, "unknown location "+location, 400); return }
+		var err error
+		if atLocation, err = subtreeStock(location); err != nil { jsonErr(w, err.Error(), 500); return }
+		subtree = locationCodesUnder(location)
+	}
 	query := "SELECT ipn,qty_on_hand,qty_reserved,COALESCE(location,''),reorder_point,reorder_qty,COALESCE(description,''),COALESCE(mpn,''),updated_at FROM inventory"
-	if lowStock == "true" {
+	if lowStock == "true" && location == "" {
 		query += " WHERE qty_on_hand <= reorder_point AND reorder_point > 0"
 	}
 	query += " ORDER BY ipn"
@@ -20,8 +36,28 @@ func handleListInventory(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var i InventoryItem
 		rows.Scan(&i.IPN, &i.QtyOnHand, &i.QtyReserved, &i.Location, &i.ReorderPoint, &i.ReorderQty, &i.Description, &i.MPN, &i.UpdatedAt)
+		if location != "" {
+			qty, ok := atLocation[i.IPN]
+			if !ok { continue }
+			i.QtyOnHand = qty
+			if lowStock == "true" && (i.ReorderPoint <= 0 || qty > i.ReorderPoint) { continue }
+		}
 		items = append(items, i)
 	}
+	rows.Close()
+	if r.URL.Query().Get("by_location") == "true" {
+		for k := range items {
+			attachLocations(&items[k])
+			if location != "" {
+				// Only the locations asked about; unassigned stock isn't in any
+				var in []LocationStock
+				for _, s := range items[k].Locations {
+					if _, ok := subtree[s.Location]; ok { in = append(in, s) }
+				}
+				items[k].Locations, items[k].QtyUnassigned = in, nil
+			}
+		}
+	}
 	if items == nil { items = []InventoryItem{} }
 	jsonResp(w, items)
 }
@@ -31,19 +67,56 @@ func handleGetInventory(w http.ResponseWriter, r *http.Request, ipn string) {
 	err := db.QueryRow("SELECT ipn,qty_on_hand,qty_reserved,COALESCE(location,''),reorder_point,reorder_qty,COALESCE(description,''),COALESCE(mpn,''),updated_at FROM inventory WHERE ipn=?", ipn).
 		Scan(&i.IPN, &i.QtyOnHand, &i.QtyReserved, &i.Location, &i.ReorderPoint, &i.ReorderQty, &i.Description, &i.MPN, &i.UpdatedAt)
 	if err != nil { jsonErr(w, "not found", 404); return }
+	attachLocations(&i)
 	jsonResp(w, i)
 }
 
 func handleInventoryTransact(w http.ResponseWriter, r *http.Request) {
 	var t InventoryTransaction
 	if err := decodeBody(r, &t); err != nil { jsonErr(w, "invalid body", 400); return }
+	if status, err := applyInventoryTransaction(t, getUsername(r), nil); err != nil { jsonErr(w, err.Error(), status); return }
+	jsonResp(w, map[string]string{"status": "ok"})
+}
 
+// applyInventoryTransaction validates and posts one inventory transaction
+// for user, returning the HTTP status to report with any error. posted, if
+// not nil, runs in the same database transaction before it commits.
+func applyInventoryTransaction(t InventoryTransaction, user string, posted func(*sql.Tx) error) (int, error) {
 	ve := &ValidationErrors{}
 	requireField(ve, "ipn", t.IPN)
 	requireField(ve, "type", t.Type)
 	validateEnum(ve, "type", t.Type, validInventoryTypes)
+	if len(t.Lots) > 0 {
+		if t.Type != "issue" { ve.Add("lots", "only allowed for issue") }
+		picked := 0.0
+		for _, p := range t.Lots { picked += p.Qty }
+		if t.Qty == 0 { t.Qty = picked }
+		if picked != t.Qty { ve.Add("lots", "picked qty must equal qty") }
+	}
+	if t.LotID != nil && t.Type != "return" { ve.Add("lot_id", "only allowed for return") }
+	validateMaxLength(ve, "lot_number", t.LotNumber, 100)
+	validateMaxLength(ve, "date_code", t.DateCode, 50)
+	if t.ExpiresAt != "" {
+		if t.Type != "receive" || t.LotNumber == "" { ve.Add("expires_at", "only allowed for a receive into a lot") }
+		validateExpiryDate(ve, t.ExpiresAt)
+	}
 	if t.Type != "adjust" && t.Qty <= 0 { ve.Add("qty", "must be positive") }
-	if ve.HasErrors() { jsonErr(w, ve.Error(), 400); return }
+	t.Customer = strings.TrimSpace(t.Customer)
+	validateMaxLength(ve, "customer", t.Customer, 255)
+	if t.Customer != "" && t.Type != "receive" && t.Type != "issue" && t.Type != "return" { ve.Add("customer", "only allowed for receive, issue and return") }
+	t.Location, t.ToLocation = strings.TrimSpace(t.Location), strings.TrimSpace(t.ToLocation)
+	if t.Type == "transfer" {
+		requireField(ve, "to_location", t.ToLocation)
+		if t.ToLocation != "" && t.ToLocation == t.Location { ve.Add("to_location", "must differ from location") }
+		if t.LotID != nil || t.LotNumber != "" { ve.Add("type", "lots can't be transferred; update the lot's location instead") }
+	} else if t.ToLocation != "" {
+		ve.Add("to_location", "only allowed for transfer")
+	}
+	if t.Type == "scrap" && t.Location != "" { ve.Add("location", "not allowed for scrap") }
+	if t.Type == "adjust" && t.Location != "" && t.Qty < 0 { ve.Add("qty", "must not be negative") }
+	if t.Location != "" { checkStockLocation(ve, "location", t.Location) }
+	if t.ToLocation != "" { checkStockLocation(ve, "to_location", t.ToLocation) }
+	if ve.HasErrors() { return 400, ve }
 
 	now := time.Now().Format("2006-01-02 15:04:05")
 
@@ -64,33 +137,142 @@ func handleInventoryTransact(w http.ResponseWriter, r *http.Request) {
 
 	// Begin transaction to ensure atomicity
 	tx, err := db.Begin()
-	if err != nil { jsonErr(w, err.Error(), 500); return }
+	if err != nil { return 500, err }
 	defer tx.Rollback() // Rollback if not committed
 
 	// Ensure inventory record exists
 	_, err = tx.Exec("INSERT OR IGNORE INTO inventory (ipn, description, mpn) VALUES (?, ?, ?)", t.IPN, desc, mpn)
-	if err != nil { jsonErr(w, err.Error(), 500); return }
+	if err != nil { return 500, err }
 
-	// Insert transaction
-	_, err = tx.Exec("INSERT INTO inventory_transactions (ipn,type,qty,reference,notes,created_at) VALUES (?,?,?,?,?,?)",
-		t.IPN, t.Type, t.Qty, t.Reference, t.Notes, now)
-	if err != nil { jsonErr(w, err.Error(), 500); return }
+	// A transfer only moves stock between locations; the total is unchanged
+	if t.Type == "transfer" {
+		have := unassignedStock(tx, t.IPN)
+		if t.Location != "" { have = stockAt(tx, t.IPN, t.Location) }
+		if t.Qty > have+1e-9 {
+			from := t.Location
+			if from == "" { from = "unassigned stock" }
+			return 400, fmt.Errorf("only %g %s in %s", have, t.IPN, from)
+		}
+		if t.Location != "" {
+			if err = addLocationStock(tx, t.IPN, t.Location, -t.Qty, now); err != nil { return 500, err }
+		}
+		if err = addLocationStock(tx, t.IPN, t.ToLocation, t.Qty, now); err != nil { return 500, err }
+		_, err = tx.Exec("INSERT INTO inventory_transactions (ipn,type,qty,reference,notes,created_at,location,to_location) VALUES (?,?,?,?,?,?,?,?)",
+			t.IPN, t.Type, t.Qty, t.Reference, t.Notes, now, t.Location, t.ToLocation)
+		if err != nil { return 500, err }
+		if posted != nil {
+			if err = posted(tx); err != nil { return 500, err }
+		}
+		if err = tx.Commit(); err != nil { return 500, err }
+		from := t.Location
+		if from == "" { from = "unassigned" }
+		logAudit(db, user, t.Type, "inventory", t.IPN, fmt.Sprintf("Inventory transfer: %g %s from %s to %s", t.Qty, t.IPN, from, t.ToLocation))
+		return 200, nil
+	}
+
+	// Stock taken from a location has to be there; an adjustment at a
+	// location sets the count there and moves the total by the difference
+	var locationDelta float64
+	if t.Location != "" {
+		switch t.Type {
+		case "receive", "return":
+			locationDelta = t.Qty
+		case "issue":
+			if have := stockAt(tx, t.IPN, t.Location); t.Qty > have+1e-9 {
+				return 400, fmt.Errorf("only %g %s in %s", have, t.IPN, t.Location)
+			}
+			locationDelta = -t.Qty
+		case "adjust":
+			locationDelta = t.Qty - stockAt(tx, t.IPN, t.Location)
+		}
+		if err = addLocationStock(tx, t.IPN, t.Location, locationDelta, now); err != nil { return 500, err }
+	}
+	var firstTxn int
+	tx.QueryRow("SELECT COALESCE(MAX(id),0) + 1 FROM inventory_transactions").Scan(&firstTxn)
+
+	// Insert transaction. Issues draw from lots (explicit picks or FIFO),
+	// receipts with a lot number start a new lot, and returns can go back
+	// into the lot they came from.
+	switch {
+	case t.Type == "issue":
+		if len(t.Lots) > 0 {
+			if err = validateLotPicks(tx, t.IPN, t.Lots); err != nil { return 400, err }
+		} else if err = checkUsableStock(tx, t.IPN, t.Qty, time.Now()); err != nil { return 400, err }
+		_, err = tx.Exec("UPDATE inventory SET qty_on_hand=qty_on_hand-?,updated_at=? WHERE ipn=?", t.Qty, now, t.IPN)
+		if err == nil { _, err = issueFromLots(tx, t.IPN, t.Qty, t.Lots, t.Type, t.Reference, t.Notes, now) }
+	case t.Type == "receive" && t.LotNumber != "":
+		var lotID int
+		lot := InventoryLot{IPN: t.IPN, LotNumber: t.LotNumber, DateCode: t.DateCode,
+			QtyReceived: t.Qty, QtyOnHand: t.Qty, Location: t.Location, ReceivedAt: &now, Notes: t.Notes}
+		if t.ExpiresAt != "" { lot.ExpiresAt = &t.ExpiresAt }
+		lotID, err = createLot(tx, lot, "")
+		if err == nil { err = recordLotTransaction(tx, lotID, t.IPN, t.Type, t.Qty, t.Reference, t.Notes, now) }
+	case t.Type == "return" && t.LotID != nil:
+		var lotIPN string
+		tx.QueryRow("SELECT ipn FROM inventory_lots WHERE id=?", *t.LotID).Scan(&lotIPN)
+		if lotIPN != t.IPN {
+			return 400, fmt.Errorf("lot_id does not belong to %s", t.IPN)
+		}
+		err = returnToLot(tx, *t.LotID, t.Qty, t.Reference, t.Notes, now)
+	default:
+		_, err = tx.Exec("INSERT INTO inventory_transactions (ipn,type,qty,reference,notes,created_at) VALUES (?,?,?,?,?,?)",
+			t.IPN, t.Type, t.Qty, t.Reference, t.Notes, now)
+	}
+	if err != nil { return 500, err }
+	if t.Location != "" {
+		_, err = tx.Exec("UPDATE inventory_transactions SET location=? WHERE id>=? AND ipn=?", t.Location, firstTxn, t.IPN)
+		if err != nil { return 500, err }
+	}
 
 	// Update inventory quantity
-	switch t.Type {
-	case "receive", "return":
+	switch {
+	case t.Type == "receive" || t.Type == "return":
 		_, err = tx.Exec("UPDATE inventory SET qty_on_hand=qty_on_hand+?,updated_at=? WHERE ipn=?", t.Qty, now, t.IPN)
-	case "issue":
-		_, err = tx.Exec("UPDATE inventory SET qty_on_hand=qty_on_hand-?,updated_at=? WHERE ipn=?", t.Qty, now, t.IPN)
-	case "adjust":
+	case t.Type == "adjust" && t.Location != "":
+		_, err = tx.Exec("UPDATE inventory SET qty_on_hand=qty_on_hand+?,updated_at=? WHERE ipn=?", locationDelta, now, t.IPN)
+	case t.Type == "adjust":
 		_, err = tx.Exec("UPDATE inventory SET qty_on_hand=?,updated_at=? WHERE ipn=?", t.Qty, now, t.IPN)
 	}
-	if err != nil { jsonErr(w, err.Error(), 500); return }
+	if err != nil { return 500, err }
+	// Stock issued or adjusted without a location comes out of unassigned
+	// stock first, then out of locations
+	if err = fitLocatedStock(tx, t.IPN); err != nil { return 500, err }
+	// Customer-owned stock is tracked apart from ours: receipts and returns
+	// for a customer add to theirs, and issues use the customer's stock
+	// first but never another customer's
+	switch {
+	case t.Type == "issue":
+		customer := t.Customer
+		if customer == "" && t.Reference != "" {
+			if refType, refID := reservationRefFromReference(tx, t.Reference); refType == "work_order" { customer = workOrderCustomer(tx, refID) }
+		}
+		if err = takeOwnedStock(tx, t.IPN, t.Qty, customer, t.Reference, t.Notes, user, now); err != nil { return 400, err }
+	case t.Customer != "":
+		err = addOwnership(tx, t.IPN, "customer", t.Customer, t.Qty, t.Type, t.Reference, t.Notes, user, now)
+	case t.Type == "return":
+		err = returnOwnedStock(tx, t.IPN, t.Qty, t.Reference, t.Notes, user, now)
+	}
+	if err != nil { return 500, err }
+	// Cost layers follow: receipts come in at the current cost, returns at
+	// the cost they were issued at
+	costKind := t.Type
+	if t.Type == "receive" { costKind = "receipt" }
+	if err = syncCostLayers(tx, t.IPN, costKind, t.Reference, 0, now); err != nil { return 500, err }
+
+	// An issue against a WO or SO draws down that reference's reservation
+	if t.Type == "issue" && t.Reference != "" {
+		refType, refID := reservationRefFromReference(tx, t.Reference)
+		if _, err = consumeReservation(tx, refType, refID, t.IPN, t.Qty); err != nil { return 500, err }
+	}
+
+	if posted != nil {
+		if err = posted(tx); err != nil { return 500, err }
+	}
 
 	// Commit transaction
-	if err = tx.Commit(); err != nil { jsonErr(w, err.Error(), 500); return }
+	if err = tx.Commit(); err != nil { return 500, err }
 
-	logAudit(db, getUsername(r), t.Type, "inventory", t.IPN, "Inventory "+t.Type+": "+t.IPN)
+	logAudit(db, user, t.Type, "inventory", t.IPN, "Inventory "+t.Type+": "+t.IPN)
 	// Capture db and ipn to avoid race with test cleanup
 	currentDB := db
 	ipnCopy := t.IPN
@@ -113,17 +295,19 @@ func handleInventoryTransact(w http.ResponseWriter, r *http.Request) {
 			emailOnLowStock(ipnCopy)
 		}
 	}()
-	jsonResp(w, map[string]string{"status": "ok"})
+	return 200, nil
 }
 
 func handleInventoryHistory(w http.ResponseWriter, r *http.Request, ipn string) {
-	rows, err := db.Query("SELECT id,ipn,type,qty,COALESCE(reference,''),COALESCE(notes,''),created_at FROM inventory_transactions WHERE ipn=? ORDER BY created_at DESC", ipn)
+	rows, err := db.Query("SELECT id,ipn,type,qty,COALESCE(reference,''),COALESCE(notes,''),created_at,lot_id FROM inventory_transactions WHERE ipn=? ORDER BY created_at DESC", ipn)
 	if err != nil { jsonErr(w, err.Error(), 500); return }
 	defer rows.Close()
 	var items []InventoryTransaction
 	for rows.Next() {
 		var t InventoryTransaction
-		rows.Scan(&t.ID, &t.IPN, &t.Type, &t.Qty, &t.Reference, &t.Notes, &t.CreatedAt)
+		var lotID sql.NullInt64
+		rows.Scan(&t.ID, &t.IPN, &t.Type, &t.Qty, &t.Reference, &t.Notes, &t.CreatedAt, &lotID)
+		if lotID.Valid { v := int(lotID.Int64); t.LotID = &v }
 		items = append(items, t)
 	}
 	if items == nil { items = []InventoryTransaction{} }
@@ -10,11 +10,24 @@ import (
 	_ "modernc.org/sqlite"
 )
 
+// useKitBOMs points partsDir at a temp dir holding a one-line, qty-1 BOM per assembly
+func useKitBOMs(t *testing.T, boms map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	oldPartsDir := partsDir
+	partsDir = dir
+	t.Cleanup(func() { partsDir = oldPartsDir })
+	for assembly, ipn := range boms {
+		createBOMFile(t, dir, assembly, [][]string{{"IPN", "qty", "ref"}, {ipn, "1", ""}})
+	}
+}
+
 // TestWorkOrderKitting_BasicReservation tests that creating a work order and kitting it reserves inventory
 func TestWorkOrderKitting_BasicReservation(t *testing.T) {
 	oldDB := db
 	db = setupTestDB(t)
 	defer func() { db.Close(); db = oldDB }()
+	useKitBOMs(t, map[string]string{"ASY-001": "PART-001"})
 
 	// Create inventory with qty=10
 	_, err := db.Exec(`INSERT INTO inventory (ipn, qty_on_hand, qty_reserved) VALUES ('PART-001', 10.0, 0.0)`)
@@ -59,6 +72,7 @@ func TestWorkOrderKitting_MultipleWOsCompetingInventory(t *testing.T) {
 	oldDB := db
 	db = setupTestDB(t)
 	defer func() { db.Close(); db = oldDB }()
+	useKitBOMs(t, map[string]string{"ASY-100": "PART-002", "ASY-101": "PART-002"})
 
 	// Create inventory with qty=10
 	_, err := db.Exec(`INSERT INTO inventory (ipn, qty_on_hand, qty_reserved) VALUES ('PART-002', 10.0, 0.0)`)
@@ -171,6 +185,10 @@ func TestWorkOrderKitting_CompletionReleasesReservation(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	_, err = db.Exec(`INSERT INTO inventory_reservations (ref_type, ref_id, ipn, qty) VALUES ('work_order', 'WO-200', 'PART-003', 5.0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// Update work order to complete status (DB schema uses "complete" not "completed")
 	updateJSON := `{
@@ -225,6 +243,10 @@ func TestWorkOrderKitting_CancellationReleasesReservation(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	_, err = db.Exec(`INSERT INTO inventory_reservations (ref_type, ref_id, ipn, qty) VALUES ('work_order', 'WO-300', 'PART-004', 7.0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// Cancel the work order
 	updateJSON := `{
@@ -264,6 +286,7 @@ func TestWorkOrderKitting_ReservedInventoryNotAvailableForOtherWOs(t *testing.T)
 	oldDB := db
 	db = setupTestDB(t)
 	defer func() { db.Close(); db = oldDB }()
+	useKitBOMs(t, map[string]string{"ASY-400": "PART-005"})
 
 	// Create inventory with qty=15, already reserved=10
 	_, err := db.Exec(`INSERT INTO inventory (ipn, qty_on_hand, qty_reserved) VALUES ('PART-005', 15.0, 10.0)`)
@@ -341,6 +364,7 @@ func TestWorkOrderKitting_SecondWOProceedsAfterFirstCompletes(t *testing.T) {
 	oldDB := db
 	db = setupTestDB(t)
 	defer func() { db.Close(); db = oldDB }()
+	useKitBOMs(t, map[string]string{"ASY-500": "PART-006", "ASY-501": "PART-006"})
 	
 	// Clear any seeded inventory to avoid interference
 	db.Exec("DELETE FROM inventory")
@@ -458,20 +482,13 @@ func TestWorkOrderKitting_SecondWOProceedsAfterFirstCompletes(t *testing.T) {
 	rows.Close()
 	t.Logf("All inventory after WO-500 completion: %v", allItems)
 
-	// NOTE: Due to simplified implementation that doesn't track per-WO reservations,
-	// WO-501 kitting also reserved from PART-006, so completion consumed all reserved inventory.
-	// In a full implementation, we'd track which WO owns which reservation.
-	// For now, we verify that consumption happens and reservations are released.
-	if onHand < 0 {
-		t.Errorf("qty_on_hand should not go negative, got %f", onHand)
+	// WO-500's 5 units were consumed; WO-501's partial kit of 5 is still held
+	if onHand != 5.0 {
+		t.Errorf("Expected qty_on_hand to be 5 after WO-500 consumed 5, got %f", onHand)
 	}
-	if reservedAfter != 0.0 {
-		t.Errorf("Expected qty_reserved to be 0 after WO-500 completion, got %f", reservedAfter)
+	if reservedAfter != 5.0 {
+		t.Errorf("Expected WO-501's 5 units to stay reserved after WO-500 completion, got %f", reservedAfter)
 	}
-	
-	// Skip the rest of the test as the simplified implementation doesn't support
-	// proper per-WO reservation tracking
-	t.Skip("Simplified implementation doesn't track per-WO reservations")
 
 	// Now WO-2 still needs 8 but only 5 are available, so it should still show partial
 	// But if we add more inventory, WO-2 should be able to proceed
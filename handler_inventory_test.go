@@ -47,6 +47,33 @@ func setupInventoryTestDB(t *testing.T) *sql.DB {
 			qty REAL NOT NULL,
 			reference TEXT,
 			notes TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			lot_id INTEGER,
+			location TEXT DEFAULT '',
+			to_location TEXT DEFAULT ''
+		);
+		CREATE TABLE inventory_lots (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ipn TEXT NOT NULL,
+			lot_number TEXT NOT NULL,
+			date_code TEXT DEFAULT '',
+			vendor_id TEXT DEFAULT '',
+			po_id TEXT DEFAULT '',
+			po_line_id INTEGER,
+			receiving_inspection_id INTEGER,
+			wo_id TEXT DEFAULT '',
+			qty_received REAL DEFAULT 0,
+			qty_on_hand REAL DEFAULT 0,
+			status TEXT DEFAULT 'available',
+			received_at DATETIME,
+			notes TEXT DEFAULT '',
+			location TEXT DEFAULT '',
+			msl_level TEXT DEFAULT '',
+			msl_floor_life_hours REAL,
+			msl_state TEXT DEFAULT 'sealed',
+			msl_exposure_hours REAL DEFAULT 0,
+			msl_opened_at DATETIME,
+			expires_at DATE,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		)
 	`)
@@ -54,6 +81,26 @@ func setupInventoryTestDB(t *testing.T) *sql.DB {
 		t.Fatalf("Failed to create inventory_transactions table: %v", err)
 	}
 
+	// Create inventory_reservations table
+	_, err = testDB.Exec(`
+		CREATE TABLE inventory_reservations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ref_type TEXT NOT NULL,
+			ref_id TEXT NOT NULL,
+			ipn TEXT NOT NULL,
+			qty REAL NOT NULL DEFAULT 0,
+			qty_consumed REAL NOT NULL DEFAULT 0,
+			status TEXT DEFAULT 'open',
+			created_by TEXT DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			closed_at DATETIME
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create inventory_reservations table: %v", err)
+	}
+
 	// Create audit_log table (match production schema)
 	_, err = testDB.Exec(`
 		CREATE TABLE audit_log (
@@ -4,7 +4,6 @@ import (
 	"database/sql"
 	"fmt"
 	"net/http"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -452,15 +451,10 @@ func handleGenerateInvoicePDF(w http.ResponseWriter, r *http.Request, id string)
 	}
 	inv.Lines = getInvoiceLines(id)
 
-	// Generate PDF content
-	pdfContent := generateInvoicePDFContent(inv)
-
-	// Set headers
-	w.Header().Set("Content-Type", "application/pdf")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"invoice_%s.pdf\"", inv.InvoiceNumber))
-	w.Header().Set("Content-Length", strconv.Itoa(len(pdfContent)))
-
-	w.Write(pdfContent)
+	data := InvoicePrint{Company: printCompany(), Generated: time.Now().Format("2006-01-02 15:04"), Invoice: inv, Subtotal: inv.Total - inv.Tax}
+	if !renderPrintDocument(w, r, "invoice", "pdf", "invoice_"+inv.InvoiceNumber, data) {
+		return
+	}
 	username := getUsername(r)
 	logAudit(db, username, "pdf", "invoices", id, fmt.Sprintf("Generated PDF for invoice %s", inv.InvoiceNumber))
 }
@@ -491,111 +485,3 @@ func updateOverdueInvoices() {
 	}
 }
 
-// Basic PDF generation - replace with proper PDF library in production
-func generateInvoicePDFContent(inv Invoice) []byte {
-	// This is a very basic PDF - in production use a proper PDF library like gofpdf
-	content := fmt.Sprintf(`%%PDF-1.4
-1 0 obj
-<<
-/Type /Catalog
-/Pages 2 0 R
->>
-endobj
-
-2 0 obj
-<<
-/Type /Pages
-/Kids [3 0 R]
-/Count 1
->>
-endobj
-
-3 0 obj
-<<
-/Type /Page
-/Parent 2 0 R
-/MediaBox [0 0 612 792]
-/Contents 4 0 R
-/Resources <<
-/Font <<
-/F1 <<
-/Type /Font
-/Subtype /Type1
-/BaseFont /Helvetica
->>
->>
->>
->>
-endobj
-
-4 0 obj
-<<
-/Length 1000
->>
-stream
-BT
-/F1 12 Tf
-50 750 Td
-(INVOICE) Tj
-0 -20 Td
-(Invoice Number: %s) Tj
-0 -20 Td
-(Customer: %s) Tj
-0 -20 Td
-(Issue Date: %s) Tj
-0 -20 Td
-(Due Date: %s) Tj
-0 -20 Td
-(Status: %s) Tj
-`, inv.InvoiceNumber, inv.Customer, inv.IssueDate, inv.DueDate, inv.Status)
-
-	// Add lines
-	yPos := 650
-	for _, line := range inv.Lines {
-		content += fmt.Sprintf(`0 %d Td
-(%s - Qty: %d @ $%.2f = $%.2f) Tj
-`, yPos-650, line.Description, line.Quantity, line.UnitPrice, line.Total)
-		yPos -= 20
-	}
-
-	content += fmt.Sprintf(`
-0 %d Td
-(Subtotal: $%.2f) Tj
-0 -20 Td
-(Tax: $%.2f) Tj
-0 -20 Td
-(Total: $%.2f) Tj
-`, yPos-650-60, inv.Total-inv.Tax, inv.Tax, inv.Total)
-
-	// Add PAID watermark if paid
-	if inv.Status == "paid" {
-		content += `
-/F1 24 Tf
-200 400 Td
-(PAID) Tj
-`
-	}
-
-	content += `
-ET
-endstream
-endobj
-
-xref
-0 5
-0000000000 65535 f 
-0000000010 00000 n 
-0000000079 00000 n 
-0000000136 00000 n 
-0000000395 00000 n 
-trailer
-<<
-/Size 5
-/Root 1 0 R
->>
-startxref
-1450
-%%EOF`
-
-	return []byte(content)
-}
\ No newline at end of file
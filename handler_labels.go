@@ -0,0 +1,338 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	labelPrinterKey     = "label_printer_address"
+	labelPrinterPort    = "9100"
+	labelPrinterTimeout = 5 * time.Second
+)
+
+// labelSources maps the record kinds labels are printed from to their
+// label type.
+var labelSources = map[string]string{
+	"lot":      "reel_label",
+	"receipt":  "reel_label",
+	"bin":      "bin_label",
+	"serial":   "serial_label",
+	"wo":       "serial_label",
+	"shipment": "carton_label",
+}
+
+// labelPart looks up what a label says about a part: the inventory record
+// first, then the parts library.
+func labelPart(ipn string) (desc, mpn, mfr string) {
+	db.QueryRow("SELECT COALESCE(description,''), COALESCE(mpn,'') FROM inventory WHERE ipn=?", ipn).Scan(&desc, &mpn)
+	if desc != "" && mpn != "" {
+		return
+	}
+	fields, err := getPartByIPN(partsDir, ipn)
+	if err != nil {
+		return
+	}
+	for k, v := range fields {
+		switch strings.ToLower(k) {
+		case "description", "desc":
+			if desc == "" {
+				desc = v
+			}
+		case "mpn", "manufacturer_part_number":
+			if mpn == "" {
+				mpn = v
+			}
+		case "manufacturer", "mfr":
+			mfr = v
+		}
+	}
+	return
+}
+
+func lotLabel(l InventoryLot, company string) LabelData {
+	d := LabelData{Company: company, IPN: l.IPN, Lot: l.LotNumber, DateCode: l.DateCode, PO: l.POID, WO: l.WOID, Location: l.Location}
+	d.Description, d.MPN, d.Manufacturer = labelPart(l.IPN)
+	qty := l.QtyOnHand
+	if qty <= 0 {
+		qty = l.QtyReceived
+	}
+	d.Qty = labelQty(qty)
+	if l.ExpiresAt != nil {
+		d.Expires = *l.ExpiresAt
+	}
+	if l.ReceivedAt != nil && len(*l.ReceivedAt) >= 10 {
+		d.Date = (*l.ReceivedAt)[:10]
+	}
+	return d
+}
+
+// loadLabels gathers the labels for a record: a lot's reel label, reel
+// labels for every lot received on a PO, an IPN's bin label, a serial's
+// label or every serial of a WO, or the cartons of a shipment.
+func loadLabels(r *http.Request, kind, id string) ([]LabelData, int, error) {
+	company := printCompany().Name
+	today := time.Now().Format("2006-01-02")
+	switch kind {
+	case "lot":
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, 400, fmt.Errorf("invalid lot id")
+		}
+		l, err := loadLot(n)
+		if err == sql.ErrNoRows {
+			return nil, 404, fmt.Errorf("lot not found")
+		} else if err != nil {
+			return nil, 500, err
+		}
+		return []LabelData{lotLabel(l, company)}, 200, nil
+
+	case "receipt":
+		var exists int
+		db.QueryRow("SELECT COUNT(*) FROM purchase_orders WHERE id=?", id).Scan(&exists)
+		if exists == 0 {
+			return nil, 404, fmt.Errorf("purchase order not found")
+		}
+		rows, err := db.Query("SELECT "+lotColumns+" FROM inventory_lots WHERE po_id=? ORDER BY id", id)
+		if err != nil {
+			return nil, 500, err
+		}
+		var lots []InventoryLot
+		for rows.Next() {
+			l, err := scanLot(rows)
+			if err != nil {
+				rows.Close()
+				return nil, 500, err
+			}
+			lots = append(lots, l)
+		}
+		rows.Close()
+		if len(lots) == 0 {
+			return nil, 404, fmt.Errorf("nothing has been received on %s", id)
+		}
+		var labels []LabelData
+		for _, l := range lots {
+			labels = append(labels, lotLabel(l, company))
+		}
+		return labels, 200, nil
+
+	case "bin":
+		d := LabelData{Company: company, IPN: id, Date: today}
+		if err := db.QueryRow("SELECT COALESCE(location,'') FROM inventory WHERE ipn=?", id).Scan(&d.Location); err == sql.ErrNoRows {
+			return nil, 404, fmt.Errorf("no inventory for %s", id)
+		} else if err != nil {
+			return nil, 500, err
+		}
+		d.Description, d.MPN, d.Manufacturer = labelPart(id)
+		return []LabelData{d}, 200, nil
+
+	case "serial", "wo":
+		q := "SELECT s.serial_number, s.wo_id, w.assembly_ipn FROM wo_serials s JOIN work_orders w ON w.id = s.wo_id WHERE "
+		if kind == "serial" {
+			q += "s.serial_number=?"
+		} else {
+			var exists int
+			db.QueryRow("SELECT COUNT(*) FROM work_orders WHERE id=?", id).Scan(&exists)
+			if exists == 0 {
+				return nil, 404, fmt.Errorf("work order not found")
+			}
+			q += "s.wo_id=? ORDER BY s.serial_number"
+		}
+		rows, err := db.Query(q, id)
+		if err != nil {
+			return nil, 500, err
+		}
+		var labels []LabelData
+		for rows.Next() {
+			d := LabelData{Company: company, Qty: "1", Date: today}
+			rows.Scan(&d.Serial, &d.WO, &d.IPN)
+			labels = append(labels, d)
+		}
+		rows.Close()
+		if len(labels) == 0 {
+			if kind == "serial" {
+				return nil, 404, fmt.Errorf("serial number not found")
+			}
+			return nil, 404, fmt.Errorf("%s has no serial numbers", id)
+		}
+		for i := range labels {
+			labels[i].Description, labels[i].MPN, labels[i].Manufacturer = labelPart(labels[i].IPN)
+		}
+		return labels, 200, nil
+
+	case "shipment":
+		cartons := 1
+		if v := r.URL.Query().Get("cartons"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 999 {
+				return nil, 400, fmt.Errorf("cartons must be a number from 1 to 999")
+			}
+			cartons = n
+		}
+		d := LabelData{Company: company, Shipment: id, Cartons: cartons, Date: today}
+		var shipDate sql.NullString
+		err := db.QueryRow("SELECT COALESCE(to_address,''), COALESCE(carrier,''), COALESCE(tracking_number,''), ship_date FROM shipments WHERE id=?", id).
+			Scan(&d.ShipTo, &d.Carrier, &d.Tracking, &shipDate)
+		if err == sql.ErrNoRows {
+			return nil, 404, fmt.Errorf("shipment not found")
+		} else if err != nil {
+			return nil, 500, err
+		}
+		if shipDate.Valid && len(shipDate.String) >= 10 {
+			d.Date = shipDate.String[:10]
+		}
+		db.QueryRow(`SELECT o.id, o.customer FROM shipment_lines l JOIN sales_orders o ON o.id = l.sales_order_id
+			WHERE l.shipment_id=? LIMIT 1`, id).Scan(&d.Order, &d.Customer)
+		labels := make([]LabelData, cartons)
+		for i := range labels {
+			labels[i] = d
+			labels[i].Carton = i + 1
+		}
+		return labels, 200, nil
+	}
+	return nil, 404, fmt.Errorf("unknown label source %q", kind)
+}
+
+// buildLabels renders the labels of a record as a ZPL job, writing any
+// error to w. ok is false if it did.
+func buildLabels(w http.ResponseWriter, r *http.Request, kind, id string) (zpl string, count int, ok bool) {
+	docType, known := labelSources[kind]
+	if !known {
+		jsonErr(w, fmt.Sprintf("unknown label source %q", kind), 404)
+		return "", 0, false
+	}
+	labels, status, err := loadLabels(r, kind, id)
+	if err != nil {
+		jsonErr(w, err.Error(), status)
+		return "", 0, false
+	}
+	name, body, err := loadPrintTemplate(docType, r.URL.Query().Get("template"))
+	if err != nil {
+		jsonErr(w, err.Error(), 404)
+		return "", 0, false
+	}
+	zpl, err = renderLabelZPL(name, body, labels)
+	if err != nil {
+		jsonErr(w, "template "+name+": "+err.Error(), 500)
+		return "", 0, false
+	}
+	return zpl, len(labels), true
+}
+
+// handleGetLabels returns the labels of a record as ZPL (the default) or a
+// PDF of label sheets for a laser printer.
+func handleGetLabels(w http.ResponseWriter, r *http.Request, kind, id string) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zpl"
+	}
+	if format != "zpl" && format != "pdf" {
+		jsonErr(w, "format must be zpl or pdf", 400)
+		return
+	}
+	zpl, _, ok := buildLabels(w, r, kind, id)
+	if !ok {
+		return
+	}
+	filename := strings.NewReplacer("/", "_", "\"", "", "\\", "_").Replace(fmt.Sprintf("labels_%s_%s", kind, id))
+	if format == "pdf" {
+		pdf := zplToPDF(zpl)
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.pdf\"", filename))
+		w.Header().Set("Content-Length", fmt.Sprint(len(pdf)))
+		w.Write(pdf)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zpl; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s.zpl\"", filename))
+	w.Write([]byte(zpl))
+}
+
+// labelPrinterAddress is the configured printer with the raw print port
+// filled in, or "" if there is none.
+func labelPrinterAddress() string {
+	addr := strings.TrimSpace(getAppSetting(labelPrinterKey))
+	if addr == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, labelPrinterPort)
+	}
+	return addr
+}
+
+// sendToLabelPrinter sends a ZPL job raw over TCP, as Zebra printers take
+// it on port 9100.
+func sendToLabelPrinter(addr, zpl string) error {
+	conn, err := net.DialTimeout("tcp", addr, labelPrinterTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(labelPrinterTimeout))
+	_, err = conn.Write([]byte(zpl))
+	return err
+}
+
+// handlePrintLabels sends the labels of a record to the label printer.
+func handlePrintLabels(w http.ResponseWriter, r *http.Request, kind, id string) {
+	addr := labelPrinterAddress()
+	if addr == "" {
+		jsonErr(w, "no label printer is configured", 400)
+		return
+	}
+	zpl, count, ok := buildLabels(w, r, kind, id)
+	if !ok {
+		return
+	}
+	if err := sendToLabelPrinter(addr, zpl); err != nil {
+		jsonErr(w, "label printer "+addr+": "+err.Error(), 502)
+		return
+	}
+	logAudit(db, getUsername(r), "printed", "labels", kind+"/"+id, fmt.Sprintf("Printed %d %s label(s) for %s %s on %s", count, labelSources[kind], kind, id, addr))
+	jsonResp(w, map[string]interface{}{"printer": addr, "labels": count, "bytes": len(zpl)})
+}
+
+func handleGetLabelPrinter(w http.ResponseWriter, r *http.Request) {
+	jsonResp(w, map[string]string{"address": getAppSetting(labelPrinterKey)})
+}
+
+// handlePutLabelPrinter sets the network label printer, as host or
+// host:port; the port defaults to 9100. An empty address turns printing
+// off.
+func handlePutLabelPrinter(w http.ResponseWriter, r *http.Request) {
+	var s struct {
+		Address string `json:"address"`
+	}
+	if err := decodeBody(r, &s); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	s.Address = strings.TrimSpace(s.Address)
+	ve := &ValidationErrors{}
+	validateMaxLength(ve, "address", s.Address, 255)
+	if s.Address != "" {
+		host, port := s.Address, labelPrinterPort
+		if h, p, err := net.SplitHostPort(s.Address); err == nil {
+			host, port = h, p
+		}
+		if n, err := strconv.Atoi(port); host == "" || strings.ContainsAny(host, " /") || err != nil || n < 1 || n > 65535 {
+			ve.Add("address", "must be a host or host:port")
+		}
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+	if err := setAppSetting(labelPrinterKey, s.Address); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, getUsername(r), "updated", "settings", "label-printer", "Set label printer to "+s.Address)
+	jsonResp(w, map[string]string{"address": s.Address})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBarcodeEncoders(t *testing.T) {
+	// The ISO 16022 example: "123456" is 142 164 186 with this error correction
+	cw := dmCodewords(dmEncodeASCII("123456"), 3, 5)
+	if want := []byte{142, 164, 186, 114, 25, 5, 88, 102}; !bytes.Equal(cw, want) {
+		t.Errorf("Data Matrix codewords: got %v, want %v", cw, want)
+	}
+	// "HELLO WORLD" as 1-M alphanumeric data
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	if ec, want := rsRemainder(data, rsDivisor(10, 0x11d, 0), 0x11d), []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}; !bytes.Equal(ec, want) {
+		t.Errorf("QR error correction: got %v, want %v", ec, want)
+	}
+
+	m, err := dataMatrixEncode("RES-0001|LOT-1|100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(m)
+	for i := 0; i < n; i++ {
+		if !m[i][0] || !m[n-1][i] || m[0][i] != (i%2 == 0) || m[i][n-1] != (i%2 == 1) {
+			t.Fatalf("Data Matrix %dx%d finder pattern broken at %d", n, n, i)
+		}
+	}
+
+	for _, s := range []string{"SN-0001", strings.Repeat("x", 150)} {
+		q, err := qrEncode(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := len(q)
+		if (n-17)%4 != 0 {
+			t.Fatalf("QR size %d is not a version", n)
+		}
+		for _, c := range [][2]int{{0, 0}, {n - 7, 0}, {0, n - 7}} {
+			for i := 0; i < 7; i++ {
+				if !q[c[1]][c[0]+i] || !q[c[1]+6][c[0]+i] || !q[c[1]+i][c[0]] || q[c[1]+1][c[0]+1] || !q[c[1]+3][c[0]+3] {
+					t.Fatalf("QR finder at %v broken", c)
+				}
+			}
+		}
+	}
+	if _, err := qrEncode(strings.Repeat("x", 300)); err == nil {
+		t.Error("expected 300 bytes to be too long for a QR code")
+	}
+}
+
+func TestLabels(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+
+	stmts := []string{
+		`INSERT INTO inventory (ipn, qty_on_hand, location, description, mpn) VALUES ('RES-1', 3000, 'A-01', '10k ^FS resistor', 'RC0402')`,
+		`INSERT INTO purchase_orders (id, vendor_id, status) VALUES ('PO-1', 'V-1', 'partial')`,
+		`INSERT INTO inventory_lots (ipn, lot_number, date_code, po_id, qty_received, qty_on_hand) VALUES ('RES-1', 'L-100', '2601', 'PO-1', 2000, 2000), ('RES-1', 'L-101', '', 'PO-1', 1000, 1000)`,
+		`INSERT INTO work_orders (id, assembly_ipn, qty, status) VALUES ('WO-1', 'ASY-1', 2, 'in_progress')`,
+		`INSERT INTO wo_serials (wo_id, serial_number) VALUES ('WO-1', 'SN-0001'), ('WO-1', 'SN-0002')`,
+		`INSERT INTO shipments (id, to_address, carrier, tracking_number) VALUES ('SH-1', 'Acme, 1 Main St', 'UPS', '1Z999')`,
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("seed failed: %v\n%s", err, s)
+		}
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		t.Helper()
+		parts := strings.Split(strings.SplitN(path, "?", 2)[0], "/")
+		w := httptest.NewRecorder()
+		handleGetLabels(w, httptest.NewRequest("GET", "/api/v1/labels/"+path, nil), parts[0], parts[1])
+		return w
+	}
+
+	// A receipt prints a reel label per lot; data can't break out of a field
+	w := get("receipt/PO-1")
+	zpl := w.Body.String()
+	if w.Code != 200 || strings.Count(zpl, "^XA") != 2 || !strings.Contains(zpl, "^FDLOT: L-100^FS") || !strings.Contains(zpl, "^FDQTY: 1000^FS") {
+		t.Fatalf("unexpected receipt labels: %d %s", w.Code, zpl)
+	}
+	if !strings.Contains(zpl, "^FD10k  FS resistor^FS") || !strings.Contains(zpl, "^BXN,6,200^FDRES-1|L-100|2000^FS") {
+		t.Errorf("unexpected reel label fields: %s", zpl)
+	}
+	if w := get("wo/WO-1"); w.Code != 200 || strings.Count(w.Body.String(), "^XA") != 2 || !strings.Contains(w.Body.String(), "^FDMA,SN-0002^FS") {
+		t.Errorf("expected a label per serial: %d %s", w.Code, w.Body.String())
+	}
+	if w := get("shipment/SH-1?cartons=3"); w.Code != 200 || !strings.Contains(w.Body.String(), "CARTON 3 OF 3") || !strings.Contains(w.Body.String(), "^FD1Z999^FS") {
+		t.Errorf("unexpected carton labels: %d %s", w.Code, w.Body.String())
+	}
+	for path, code := range map[string]int{"bin/NOPE": 404, "lot/99": 404, "serial/SN-9": 404, "pallet/1": 404, "shipment/SH-1?cartons=0": 400} {
+		if w := get(path); w.Code != code {
+			t.Errorf("%s: expected %d, got %d", path, code, w.Code)
+		}
+	}
+
+	w = get("bin/RES-1?format=pdf")
+	if w.Code != 200 || !strings.HasPrefix(w.Body.String(), "%PDF-") || !strings.Contains(w.Body.String(), "(LOC: A-01) Tj") {
+		t.Errorf("expected a PDF bin label, got %d %.200s", w.Code, w.Body.String())
+	}
+	if labels := parseZPL(builtinCartonLabel); len(labels) != 1 || labels[0].width != 812 || labels[0].height != 1218 {
+		t.Errorf("expected one 4x6 label, got %d", len(labels))
+	}
+
+	// Templates must produce a label
+	if err := checkPrintTemplate("serial_label", "{{.Serial}}"); err == nil {
+		t.Error("expected a template without ^XA to be refused")
+	}
+	if err := checkPrintTemplate("serial_label", "^XA^FD{{.Nope}}^FS^XZ"); err == nil {
+		t.Error("expected an unknown field to be refused")
+	}
+
+	// Printing without a printer fails; with one the job arrives as is
+	pw := httptest.NewRecorder()
+	handlePrintLabels(pw, httptest.NewRequest("POST", "/api/v1/labels/serial/SN-0001/print", nil), "serial", "SN-0001")
+	if pw.Code != 400 {
+		t.Errorf("expected printing with no printer to fail, got %d", pw.Code)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		b, _ := io.ReadAll(conn)
+		received <- string(b)
+	}()
+
+	sw := httptest.NewRecorder()
+	handlePutLabelPrinter(sw, httptest.NewRequest("PUT", "/api/v1/settings/label-printer", strings.NewReader(`{"address":"bad host:99999"}`)))
+	if sw.Code != 400 {
+		t.Errorf("expected a bad address to be refused, got %d", sw.Code)
+	}
+	sw = httptest.NewRecorder()
+	handlePutLabelPrinter(sw, httptest.NewRequest("PUT", "/api/v1/settings/label-printer", strings.NewReader(`{"address":"`+ln.Addr().String()+`"}`)))
+	if sw.Code != 200 {
+		t.Fatalf("set printer failed: %d %s", sw.Code, sw.Body.String())
+	}
+	pw = httptest.NewRecorder()
+	handlePrintLabels(pw, httptest.NewRequest("POST", "/api/v1/labels/serial/SN-0001/print", nil), "serial", "SN-0001")
+	if pw.Code != 200 {
+		t.Fatalf("print failed: %d %s", pw.Code, pw.Body.String())
+	}
+	select {
+	case job := <-received:
+		if !strings.HasPrefix(job, "^XA") || !strings.Contains(job, "^FDS/N SN-0001^FS") || !strings.Contains(job, "^FDWO WO-1^FS") {
+			t.Errorf("unexpected print job: %s", job)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("printer received nothing")
+	}
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LaborEntry is one clock-in of a user against a work order, optionally
+// against a specific routing operation. Minutes is the user's split share:
+// while clocked into several jobs at once, elapsed time is divided evenly
+// between them so a user never books more hours than the clock shows.
+type LaborEntry struct {
+	ID            int     `json:"id"`
+	WOID          string  `json:"wo_id"`
+	AssemblyIPN   string  `json:"assembly_ipn"`
+	OperationID   *int    `json:"operation_id"`
+	OperationName string  `json:"operation_name"`
+	Username      string  `json:"username"`
+	ClockIn       string  `json:"clock_in"`
+	ClockOut      *string `json:"clock_out"`
+	Minutes       float64 `json:"minutes"`
+	LaborRate     float64 `json:"labor_rate"`
+	Notes         string  `json:"notes"`
+}
+
+const laborTimeFormat = "2006-01-02 15:04:05"
+
+// parseLaborTime reads a stored clock timestamp as local wall time. The
+// driver may hand DATETIME columns back in either SQLite or RFC3339 form.
+func parseLaborTime(s string, loc *time.Location) (time.Time, error) {
+	var t time.Time
+	var err error
+	for _, format := range []string{laborTimeFormat, "2006-01-02T15:04:05Z"} {
+		if t, err = time.ParseInLocation(format, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return t, err
+}
+
+// accrueLabor brings every open entry of a user up to at, splitting the time
+// since the last clock event evenly across the jobs the user is clocked into.
+// Must run before any clock-in or clock-out so each interval is split by the
+// number of jobs that were actually open during it.
+func accrueLabor(tx *sql.Tx, username string, at time.Time) error {
+	rows, err := tx.Query("SELECT id, accrued_at FROM labor_entries WHERE username=? AND clock_out IS NULL", username)
+	if err != nil {
+		return fmt.Errorf("failed to load open labor for %s: %w", username, err)
+	}
+	type openEntry struct {
+		id        int
+		accruedAt string
+	}
+	var open []openEntry
+	for rows.Next() {
+		var e openEntry
+		if err := rows.Scan(&e.id, &e.accruedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		open = append(open, e)
+	}
+	rows.Close()
+
+	for _, e := range open {
+		share := 0.0
+		if since, err := parseLaborTime(e.accruedAt, at.Location()); err == nil && at.After(since) {
+			share = at.Sub(since).Minutes() / float64(len(open))
+		}
+		_, err := tx.Exec("UPDATE labor_entries SET minutes = minutes + ?, accrued_at = ? WHERE id = ?",
+			share, at.Format(laborTimeFormat), e.id)
+		if err != nil {
+			return fmt.Errorf("failed to accrue labor entry %d: %w", e.id, err)
+		}
+	}
+	return nil
+}
+
+// clockIn opens a labor entry for a user on a work order (and operation).
+func clockIn(tx *sql.Tx, woID string, operationID *int, username, notes string, at time.Time) (int, error) {
+	if err := accrueLabor(tx, username, at); err != nil {
+		return 0, err
+	}
+	ts := at.Format(laborTimeFormat)
+	res, err := tx.Exec(`INSERT INTO labor_entries (wo_id,operation_id,username,clock_in,accrued_at,minutes,notes)
+		VALUES (?,?,?,?,?,0,?)`, woID, operationID, username, ts, ts, notes)
+	if err != nil {
+		return 0, fmt.Errorf("failed to clock in: %w", err)
+	}
+	id, _ := res.LastInsertId()
+	return int(id), nil
+}
+
+// clockOut closes a labor entry after accruing the user's time up to at.
+func clockOut(tx *sql.Tx, entryID int, username string, at time.Time) error {
+	if err := accrueLabor(tx, username, at); err != nil {
+		return err
+	}
+	_, err := tx.Exec("UPDATE labor_entries SET clock_out = ? WHERE id = ?", at.Format(laborTimeFormat), entryID)
+	if err != nil {
+		return fmt.Errorf("failed to clock out: %w", err)
+	}
+	return nil
+}
+
+// clockOutWorkOrder closes every open labor entry on a work order, used when
+// the WO completes or is cancelled with people still clocked in.
+func clockOutWorkOrder(tx *sql.Tx, woID string, at time.Time) error {
+	rows, err := tx.Query("SELECT id, username FROM labor_entries WHERE wo_id=? AND clock_out IS NULL", woID)
+	if err != nil {
+		return fmt.Errorf("failed to load open labor for %s: %w", woID, err)
+	}
+	type openEntry struct {
+		id       int
+		username string
+	}
+	var open []openEntry
+	for rows.Next() {
+		var e openEntry
+		rows.Scan(&e.id, &e.username)
+		open = append(open, e)
+	}
+	rows.Close()
+	for _, e := range open {
+		if err := clockOut(tx, e.id, e.username, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const laborEntryColumns = `l.id, l.wo_id, COALESCE(wo.assembly_ipn,''), l.operation_id, COALESCE(o.name,''), l.username,
+	l.clock_in, l.clock_out, l.accrued_at, COALESCE(l.minutes,0), COALESCE(wc.labor_rate,0), COALESCE(l.notes,'')`
+
+const laborEntryJoins = ` FROM labor_entries l
+	LEFT JOIN work_orders wo ON wo.id = l.wo_id
+	LEFT JOIN wo_operations o ON o.id = l.operation_id
+	LEFT JOIN work_centers wc ON wc.id = o.work_center_id`
+
+// loadLaborEntries returns labor entries matching the filters. Open entries
+// have their minutes projected to now, split the same way a clock-out would.
+func loadLaborEntries(where []string, args []interface{}) ([]LaborEntry, error) {
+	query := "SELECT " + laborEntryColumns + laborEntryJoins
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY l.clock_in, l.id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []LaborEntry
+	accruedAt := map[int]string{}
+	for rows.Next() {
+		var e LaborEntry
+		var opID sql.NullInt64
+		var clockOutAt sql.NullString
+		var accrued string
+		if err := rows.Scan(&e.ID, &e.WOID, &e.AssemblyIPN, &opID, &e.OperationName, &e.Username,
+			&e.ClockIn, &clockOutAt, &accrued, &e.Minutes, &e.LaborRate, &e.Notes); err != nil {
+			return nil, err
+		}
+		if opID.Valid {
+			id := int(opID.Int64)
+			e.OperationID = &id
+		}
+		e.ClockOut = sp(clockOutAt)
+		if e.ClockOut == nil {
+			accruedAt[e.ID] = accrued
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(accruedAt) > 0 {
+		openPerUser := map[string]int{}
+		urows, err := db.Query("SELECT username, COUNT(*) FROM labor_entries WHERE clock_out IS NULL GROUP BY username")
+		if err != nil {
+			return nil, err
+		}
+		for urows.Next() {
+			var u string
+			var n int
+			urows.Scan(&u, &n)
+			openPerUser[u] = n
+		}
+		urows.Close()
+
+		now := time.Now()
+		for i := range entries {
+			accrued, ok := accruedAt[entries[i].ID]
+			if !ok || openPerUser[entries[i].Username] == 0 {
+				continue
+			}
+			if since, err := parseLaborTime(accrued, now.Location()); err == nil && now.After(since) {
+				entries[i].Minutes += now.Sub(since).Minutes() / float64(openPerUser[entries[i].Username])
+			}
+		}
+	}
+
+	if entries == nil {
+		entries = []LaborEntry{}
+	}
+	return entries, nil
+}
+
+func laborRequestUser(r *http.Request, requested string) string {
+	if u := strings.TrimSpace(requested); u != "" {
+		return u
+	}
+	return getUsername(r)
+}
+
+// handleClockIn starts labor for a user on a work order. The user defaults
+// to the session user; a shop-floor terminal can clock in on behalf of an
+// operator by passing username.
+func handleClockIn(w http.ResponseWriter, r *http.Request, woID string) {
+	var body struct {
+		OperationID *int   `json:"operation_id"`
+		Username    string `json:"username"`
+		Notes       string `json:"notes"`
+	}
+	if r.ContentLength != 0 {
+		if err := decodeBody(r, &body); err != nil {
+			jsonErr(w, "invalid body", 400)
+			return
+		}
+	}
+
+	ve := &ValidationErrors{}
+	validateMaxLength(ve, "username", body.Username, 255)
+	validateMaxLength(ve, "notes", body.Notes, 10000)
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	var status string
+	if err := db.QueryRow("SELECT status FROM work_orders WHERE id=?", woID).Scan(&status); err != nil {
+		jsonErr(w, "work order not found", 404)
+		return
+	}
+	if status != "open" && status != "in_progress" {
+		jsonErr(w, "cannot clock in to a work order that is "+status, 400)
+		return
+	}
+	if body.OperationID != nil {
+		var opStatus string
+		if err := db.QueryRow("SELECT status FROM wo_operations WHERE id=? AND wo_id=?", *body.OperationID, woID).Scan(&opStatus); err != nil {
+			jsonErr(w, "operation not found on this work order", 400)
+			return
+		}
+		if opStatus == "completed" || opStatus == "skipped" {
+			jsonErr(w, "operation is already "+opStatus, 400)
+			return
+		}
+	}
+
+	username := laborRequestUser(r, body.Username)
+	var existing int
+	err := db.QueryRow(`SELECT id FROM labor_entries WHERE username=? AND wo_id=? AND clock_out IS NULL
+		AND COALESCE(operation_id,0)=COALESCE(?,0)`, username, woID, body.OperationID).Scan(&existing)
+	if err == nil {
+		jsonErr(w, fmt.Sprintf("%s is already clocked in to this job (entry %d)", username, existing), 409)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+	id, err := clockIn(tx, woID, body.OperationID, username, body.Notes, time.Now())
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+
+	logAudit(db, getUsername(r), "clock_in", "workorder", woID, fmt.Sprintf("%s clocked in to WO %s", username, woID))
+	entries, _ := loadLaborEntries([]string{"l.id = ?"}, []interface{}{id})
+	if len(entries) == 0 {
+		jsonErr(w, "labor entry not found", 500)
+		return
+	}
+	jsonResp(w, entries[0])
+}
+
+// handleClockOut closes a labor entry by id.
+func handleClockOut(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		jsonErr(w, "invalid id", 400)
+		return
+	}
+	var username, woID string
+	var clockOutAt sql.NullString
+	if err := db.QueryRow("SELECT username, wo_id, clock_out FROM labor_entries WHERE id=?", id).Scan(&username, &woID, &clockOutAt); err != nil {
+		jsonErr(w, "labor entry not found", 404)
+		return
+	}
+	if clockOutAt.Valid {
+		jsonErr(w, "already clocked out", 400)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+	if err := clockOut(tx, id, username, time.Now()); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+
+	logAudit(db, getUsername(r), "clock_out", "workorder", woID, fmt.Sprintf("%s clocked out of WO %s", username, woID))
+	entries, _ := loadLaborEntries([]string{"l.id = ?"}, []interface{}{id})
+	if len(entries) == 0 {
+		jsonErr(w, "labor entry not found", 500)
+		return
+	}
+	jsonResp(w, entries[0])
+}
+
+// handleListActiveLabor lists everyone currently clocked in. Optional
+// username and wo_id filters.
+func handleListActiveLabor(w http.ResponseWriter, r *http.Request) {
+	where := []string{"l.clock_out IS NULL"}
+	var args []interface{}
+	if u := r.URL.Query().Get("username"); u != "" {
+		where = append(where, "l.username = ?")
+		args = append(args, u)
+	}
+	if wo := r.URL.Query().Get("wo_id"); wo != "" {
+		where = append(where, "l.wo_id = ?")
+		args = append(args, wo)
+	}
+	entries, err := loadLaborEntries(where, args)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	jsonResp(w, entries)
+}
+
+func laborHours(minutes float64) float64 {
+	return math.Round(minutes/60*100) / 100
+}
+
+func laborCost(e LaborEntry, defaultRate float64) float64 {
+	rate := e.LaborRate
+	if rate == 0 {
+		rate = defaultRate
+	}
+	return e.Minutes / 60 * rate
+}
+
+// handleWorkOrderLabor returns a work order's labor entries with totals per
+// operation and per user.
+func handleWorkOrderLabor(w http.ResponseWriter, r *http.Request, woID string) {
+	var exists int
+	if err := db.QueryRow("SELECT 1 FROM work_orders WHERE id=?", woID).Scan(&exists); err != nil {
+		jsonErr(w, "work order not found", 404)
+		return
+	}
+	defaultRate, _ := strconv.ParseFloat(r.URL.Query().Get("default_rate"), 64)
+
+	entries, err := loadLaborEntries([]string{"l.wo_id = ?"}, []interface{}{woID})
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+
+	type laborTotal struct {
+		Key     string  `json:"key"`
+		Minutes float64 `json:"minutes"`
+		Hours   float64 `json:"hours"`
+		Cost    float64 `json:"cost"`
+	}
+	byOp := map[string]*laborTotal{}
+	byUser := map[string]*laborTotal{}
+	add := func(m map[string]*laborTotal, key string, minutes, cost float64) {
+		if m[key] == nil {
+			m[key] = &laborTotal{Key: key}
+		}
+		m[key].Minutes += minutes
+		m[key].Cost += cost
+	}
+	var totalMinutes, totalCost float64
+	for _, e := range entries {
+		cost := laborCost(e, defaultRate)
+		totalMinutes += e.Minutes
+		totalCost += cost
+		opKey := e.OperationName
+		if opKey == "" {
+			opKey = "(work order)"
+		}
+		add(byOp, opKey, e.Minutes, cost)
+		add(byUser, e.Username, e.Minutes, cost)
+	}
+	flatten := func(m map[string]*laborTotal) []laborTotal {
+		out := []laborTotal{}
+		for _, t := range m {
+			t.Hours = laborHours(t.Minutes)
+			t.Cost = math.Round(t.Cost*100) / 100
+			out = append(out, *t)
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+		return out
+	}
+
+	jsonResp(w, map[string]interface{}{
+		"wo_id":         woID,
+		"entries":       entries,
+		"total_minutes": math.Round(totalMinutes*100) / 100,
+		"total_hours":   laborHours(totalMinutes),
+		"labor_cost":    math.Round(totalCost*100) / 100,
+		"by_operation":  flatten(byOp),
+		"by_user":       flatten(byUser),
+	})
+}
+
+// --- Labor / Actual Cost Report ---
+
+type LaborReportRow struct {
+	Key          string  `json:"key"`
+	AssemblyIPN  string  `json:"assembly_ipn"`
+	WOCount      int     `json:"wo_count"`
+	Units        int     `json:"units"`
+	LaborHours   float64 `json:"labor_hours"`
+	LaborCost    float64 `json:"labor_cost"`
+	MaterialCost float64 `json:"material_cost"`
+	ActualCost   float64 `json:"actual_cost"`
+	UnitCost     float64 `json:"unit_cost"`
+	HoursPerUnit float64 `json:"hours_per_unit"`
+}
+
+// handleReportLabor reports labor hours and cost per work order
+// (group_by=wo, default) or per assembly IPN (group_by=assembly), alongside
+// material cost from the BOM to give an actual cost per unit. Units are the
+// good quantity of completed WOs, otherwise the WO quantity.
+func handleReportLabor(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	groupBy := q.Get("group_by")
+	if groupBy == "" {
+		groupBy = "wo"
+	}
+	ve := &ValidationErrors{}
+	validateEnum(ve, "group_by", groupBy, []string{"wo", "assembly"})
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+	defaultRate, _ := strconv.ParseFloat(q.Get("default_rate"), 64)
+
+	var where []string
+	var args []interface{}
+	if from := q.Get("from"); from != "" {
+		where = append(where, "l.clock_in >= ?")
+		args = append(args, from)
+	}
+	if to := q.Get("to"); to != "" {
+		where = append(where, "l.clock_in < date(?, '+1 day')")
+		args = append(args, to)
+	}
+	if ipn := q.Get("ipn"); ipn != "" {
+		where = append(where, "wo.assembly_ipn = ?")
+		args = append(args, ipn)
+	}
+	entries, err := loadLaborEntries(where, args)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+
+	type woInfo struct {
+		ipn   string
+		units int
+	}
+	wos := map[string]woInfo{}
+	rowsByKey := map[string]*LaborReportRow{}
+	bomCost := map[string]float64{}
+	for _, e := range entries {
+		info, ok := wos[e.WOID]
+		if !ok {
+			var qty int
+			var good sql.NullInt64
+			var status string
+			db.QueryRow("SELECT qty, qty_good, status FROM work_orders WHERE id=?", e.WOID).Scan(&qty, &good, &status)
+			info = woInfo{ipn: e.AssemblyIPN, units: qty}
+			if status == "completed" && good.Valid && good.Int64 > 0 {
+				info.units = int(good.Int64)
+			}
+			wos[e.WOID] = info
+			if _, seen := bomCost[info.ipn]; !seen {
+				bomCost[info.ipn] = calcBOMCost(info.ipn, 0, 5)
+			}
+		}
+
+		key := e.WOID
+		if groupBy == "assembly" {
+			key = info.ipn
+		}
+		row := rowsByKey[key]
+		if row == nil {
+			row = &LaborReportRow{Key: key, AssemblyIPN: info.ipn}
+			rowsByKey[key] = row
+		}
+		if !ok {
+			row.WOCount++
+			row.Units += info.units
+			row.MaterialCost += bomCost[info.ipn] * float64(info.units)
+		}
+		row.LaborHours += e.Minutes / 60
+		row.LaborCost += laborCost(e, defaultRate)
+	}
+
+	report := []LaborReportRow{}
+	for _, row := range rowsByKey {
+		row.ActualCost = math.Round((row.LaborCost+row.MaterialCost)*100) / 100
+		if row.Units > 0 {
+			row.UnitCost = math.Round(row.ActualCost/float64(row.Units)*100) / 100
+			row.HoursPerUnit = math.Round(row.LaborHours/float64(row.Units)*100) / 100
+		}
+		row.LaborHours = math.Round(row.LaborHours*100) / 100
+		row.LaborCost = math.Round(row.LaborCost*100) / 100
+		row.MaterialCost = math.Round(row.MaterialCost*100) / 100
+		report = append(report, *row)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Key < report[j].Key })
+
+	if q.Get("format") == "csv" {
+		writeCSV(w, "labor", []string{"Key", "Assembly IPN", "WOs", "Units", "Labor Hours", "Labor Cost", "Material Cost", "Actual Cost", "Unit Cost", "Hours/Unit"}, func(cw *csv.Writer) {
+			for _, row := range report {
+				cw.Write([]string{row.Key, row.AssemblyIPN, strconv.Itoa(row.WOCount), strconv.Itoa(row.Units),
+					fmt.Sprintf("%.2f", row.LaborHours), fmt.Sprintf("%.2f", row.LaborCost), fmt.Sprintf("%.2f", row.MaterialCost),
+					fmt.Sprintf("%.2f", row.ActualCost), fmt.Sprintf("%.2f", row.UnitCost), fmt.Sprintf("%.2f", row.HoursPerUnit)})
+			}
+		})
+		return
+	}
+	jsonResp(w, report)
+}
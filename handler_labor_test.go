@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func seedLaborWorkOrders(t *testing.T) {
+	t.Helper()
+	stmts := []string{
+		`INSERT INTO work_orders (id, assembly_ipn, qty, status, created_at) VALUES ('WO-L1', 'PCA-L', 10, 'in_progress', '2026-01-01 00:00:00')`,
+		`INSERT INTO work_orders (id, assembly_ipn, qty, status, created_at) VALUES ('WO-L2', 'PCA-L', 4, 'open', '2026-01-01 00:00:00')`,
+		`INSERT INTO work_orders (id, assembly_ipn, qty, status, created_at) VALUES ('WO-L3', 'ASY-M', 2, 'completed', '2026-01-01 00:00:00')`,
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func laborMinutes(t *testing.T, id int) float64 {
+	t.Helper()
+	var m float64
+	if err := db.QueryRow("SELECT minutes FROM labor_entries WHERE id=?", id).Scan(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestClockInOut_SplitsConcurrentJobs(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedLaborWorkOrders(t)
+
+	base := time.Date(2026, 3, 2, 8, 0, 0, 0, time.Local)
+	at := func(h, m int) time.Time { return base.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute) }
+	step := func(fn func(tx *sql.Tx) error) {
+		t.Helper()
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fn(tx); err != nil {
+			t.Fatal(err)
+		}
+		tx.Commit()
+	}
+
+	// alice: WO-L1 08:00-10:00, WO-L2 09:00-11:00; bob: WO-L1 08:00-09:00
+	var a1, a2, b1 int
+	step(func(tx *sql.Tx) (err error) { a1, err = clockIn(tx, "WO-L1", nil, "alice", "", at(0, 0)); return })
+	step(func(tx *sql.Tx) (err error) { b1, err = clockIn(tx, "WO-L1", nil, "bob", "", at(0, 0)); return })
+	step(func(tx *sql.Tx) (err error) { a2, err = clockIn(tx, "WO-L2", nil, "alice", "", at(1, 0)); return })
+	step(func(tx *sql.Tx) error { return clockOut(tx, b1, "bob", at(1, 0)) })
+	step(func(tx *sql.Tx) error { return clockOut(tx, a1, "alice", at(2, 0)) })
+	step(func(tx *sql.Tx) error { return clockOut(tx, a2, "alice", at(3, 0)) })
+
+	// alice: 60 alone + 60 split on WO-L1 = 90; 60 split + 60 alone on WO-L2 = 90
+	if got := laborMinutes(t, a1); got != 90 {
+		t.Errorf("alice WO-L1: expected 90 minutes, got %v", got)
+	}
+	if got := laborMinutes(t, a2); got != 90 {
+		t.Errorf("alice WO-L2: expected 90 minutes, got %v", got)
+	}
+	// bob's time isn't affected by alice's concurrent jobs
+	if got := laborMinutes(t, b1); got != 60 {
+		t.Errorf("bob WO-L1: expected 60 minutes, got %v", got)
+	}
+}
+
+func TestClockInHandlers(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedLaborWorkOrders(t)
+	db.Exec(`INSERT INTO wo_operations (id, wo_id, seq, name) VALUES (7, 'WO-L1', 10, 'SMT')`)
+
+	clock := func(wo, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleClockIn(w, httptest.NewRequest("POST", "/api/v1/workorders/"+wo+"/labor/clock-in", bytes.NewBufferString(body)), wo)
+		return w
+	}
+
+	w := clock("WO-L1", `{"username":"carol","operation_id":7}`)
+	if w.Code != 200 {
+		t.Fatalf("clock-in failed: %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Data LaborEntry `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Data.OperationName != "SMT" || resp.Data.Username != "carol" || resp.Data.ClockOut != nil {
+		t.Errorf("unexpected entry: %+v", resp.Data)
+	}
+
+	tests := []struct {
+		name string
+		wo   string
+		body string
+		code int
+	}{
+		{"duplicate clock-in", "WO-L1", `{"username":"carol","operation_id":7}`, 409},
+		{"unknown work order", "WO-NOPE", `{"username":"carol"}`, 404},
+		{"completed work order", "WO-L3", `{"username":"carol"}`, 400},
+		{"operation of another WO", "WO-L2", `{"username":"carol","operation_id":7}`, 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := clock(tt.wo, tt.body); w.Code != tt.code {
+				t.Errorf("expected %d, got %d: %s", tt.code, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// Same user on a second job is fine; both show as active
+	if w := clock("WO-L2", `{"username":"carol"}`); w.Code != 200 {
+		t.Fatalf("second clock-in failed: %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handleListActiveLabor(w, httptest.NewRequest("GET", "/api/v1/labor/active?username=carol", nil))
+	var active struct {
+		Data []LaborEntry `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &active)
+	if len(active.Data) != 2 {
+		t.Fatalf("expected 2 active clock-ins, got %d", len(active.Data))
+	}
+
+	id := strconv.Itoa(resp.Data.ID)
+	w = httptest.NewRecorder()
+	handleClockOut(w, httptest.NewRequest("POST", "/api/v1/labor/"+id+"/clock-out", nil), id)
+	if w.Code != 200 {
+		t.Fatalf("clock-out failed: %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handleClockOut(w, httptest.NewRequest("POST", "/api/v1/labor/"+id+"/clock-out", nil), id)
+	if w.Code != 400 {
+		t.Errorf("expected 400 clocking out twice, got %d", w.Code)
+	}
+}
+
+func TestWorkOrderCompletion_ClocksOutLabor(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedLaborWorkOrders(t)
+
+	db.Exec(`INSERT INTO labor_entries (wo_id, username, clock_in, accrued_at) VALUES ('WO-L1', 'dave', '2026-01-01 08:00:00', '2026-01-01 08:00:00')`)
+
+	body := `{"assembly_ipn":"PCA-L","qty":10,"status":"completed","priority":"normal"}`
+	w := httptest.NewRecorder()
+	handleUpdateWorkOrder(w, httptest.NewRequest("PUT", "/api/v1/workorders/WO-L1", bytes.NewBufferString(body)), "WO-L1")
+	if w.Code != 200 {
+		t.Fatalf("completion failed: %d %s", w.Code, w.Body.String())
+	}
+	var open int
+	db.QueryRow("SELECT COUNT(*) FROM labor_entries WHERE clock_out IS NULL").Scan(&open)
+	if open != 0 {
+		t.Errorf("expected labor clocked out on completion, %d still open", open)
+	}
+}
+
+func TestReportLabor(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	oldPartsDir := partsDir
+	partsDir = ""
+	defer func() { db.Close(); db = oldDB; partsDir = oldPartsDir }()
+	seedLaborWorkOrders(t)
+
+	stmts := []string{
+		`UPDATE work_orders SET qty_good=2 WHERE id='WO-L3'`,
+		`INSERT INTO work_centers (id, name, labor_rate) VALUES ('WC-001', 'SMT', 60)`,
+		`INSERT INTO wo_operations (id, wo_id, seq, name, work_center_id) VALUES (1, 'WO-L1', 10, 'SMT', 'WC-001')`,
+		`INSERT INTO labor_entries (wo_id, operation_id, username, clock_in, clock_out, accrued_at, minutes) VALUES ('WO-L1', 1, 'alice', '2026-03-02 08:00:00', '2026-03-02 10:00:00', '2026-03-02 10:00:00', 120)`,
+		`INSERT INTO labor_entries (wo_id, username, clock_in, clock_out, accrued_at, minutes) VALUES ('WO-L2', 'bob', '2026-03-02 08:00:00', '2026-03-02 09:00:00', '2026-03-02 09:00:00', 60)`,
+		`INSERT INTO labor_entries (wo_id, username, clock_in, clock_out, accrued_at, minutes) VALUES ('WO-L3', 'bob', '2026-03-05 08:00:00', '2026-03-05 09:30:00', '2026-03-05 09:30:00', 90)`,
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := func(query string) []LaborReportRow {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handleReportLabor(w, httptest.NewRequest("GET", "/api/v1/reports/labor?"+query, nil))
+		if w.Code != 200 {
+			t.Fatalf("report failed: %d %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			Data []LaborReportRow `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Data
+	}
+
+	rows := report("default_rate=30")
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 WO rows, got %d", len(rows))
+	}
+	// WO-L1: 2h at the SMT work center rate of 60/h
+	if rows[0].Key != "WO-L1" || rows[0].LaborHours != 2 || rows[0].LaborCost != 120 || rows[0].UnitCost != 12 {
+		t.Errorf("unexpected WO-L1 row: %+v", rows[0])
+	}
+	// WO-L3 is completed, so units are its good qty
+	if rows[2].Key != "WO-L3" || rows[2].Units != 2 || rows[2].LaborCost != 45 || rows[2].HoursPerUnit != 0.75 {
+		t.Errorf("unexpected WO-L3 row: %+v", rows[2])
+	}
+
+	rows = report("group_by=assembly&default_rate=30")
+	if len(rows) != 2 || rows[1].Key != "PCA-L" {
+		t.Fatalf("unexpected assembly rows: %+v", rows)
+	}
+	if rows[1].WOCount != 2 || rows[1].Units != 14 || rows[1].LaborHours != 3 || rows[1].LaborCost != 150 {
+		t.Errorf("unexpected PCA-L row: %+v", rows[1])
+	}
+
+	if rows := report("from=2026-03-03&to=2026-03-31"); len(rows) != 1 || rows[0].Key != "WO-L3" {
+		t.Errorf("expected only WO-L3 in date range, got %+v", rows)
+	}
+
+	w := httptest.NewRecorder()
+	handleWorkOrderLabor(w, httptest.NewRequest("GET", "/api/v1/workorders/WO-L1/labor", nil), "WO-L1")
+	var wo struct {
+		Data struct {
+			TotalHours float64 `json:"total_hours"`
+			LaborCost  float64 `json:"labor_cost"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &wo)
+	if wo.Data.TotalHours != 2 || math.Abs(wo.Data.LaborCost-120) > 0.001 {
+		t.Errorf("unexpected WO labor totals: %+v", wo.Data)
+	}
+
+	w = httptest.NewRecorder()
+	handleReportLabor(w, httptest.NewRequest("GET", "/api/v1/reports/labor?format=csv", nil))
+	if !strings.HasPrefix(w.Body.String(), "Key,Assembly IPN") {
+		t.Errorf("unexpected CSV output: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Location is a place stock is kept: a site (a plant, a contract
+// manufacturer), an area within a site such as the stockroom or the SMT
+// line, or a bin within an area.
+type Location struct {
+	Code       string `json:"code"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	ParentCode string `json:"parent_code"`
+	Site       string `json:"site"`
+	Active     bool   `json:"active"`
+	Notes      string `json:"notes"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// LocationStock is the qty of an IPN held at one location.
+type LocationStock struct {
+	IPN      string  `json:"ipn,omitempty"`
+	Location string  `json:"location"`
+	Site     string  `json:"site"`
+	Qty      float64 `json:"qty"`
+}
+
+// locationSubtree selects a location's code and those of everything under
+// it. Use it as "location_code IN (" + locationSubtree + ")" with the code as
+// the argument.
+const locationSubtree = `WITH RECURSIVE sub(code) AS (SELECT ? UNION ALL
+	SELECT l.code FROM locations l JOIN sub ON l.parent_code = sub.code) SELECT code FROM sub`
+
+const locationColumns = "code, name, type, COALESCE(parent_code,''), active, COALESCE(notes,''), created_at"
+
+func scanLocation(row interface{ Scan(...interface{}) error }) (Location, error) {
+	var l Location
+	err := row.Scan(&l.Code, &l.Name, &l.Type, &l.ParentCode, &l.Active, &l.Notes, &l.CreatedAt)
+	return l, err
+}
+
+// locationSites maps every location code to the code of its site. An empty
+// map means no locations have been set up (or the table is missing).
+func locationSites() map[string]string {
+	parents := map[string]string{}
+	rows, err := db.Query("SELECT code, COALESCE(parent_code,'') FROM locations")
+	if err != nil {
+		return parents
+	}
+	for rows.Next() {
+		var code, parent string
+		rows.Scan(&code, &parent)
+		parents[code] = parent
+	}
+	rows.Close()
+
+	sites := map[string]string{}
+	for code := range parents {
+		site := code
+		for depth := 0; parents[site] != "" && depth < 5; depth++ {
+			site = parents[site]
+		}
+		sites[code] = site
+	}
+	return sites
+}
+
+func loadLocation(code string) (Location, error) {
+	l, err := scanLocation(db.QueryRow("SELECT "+locationColumns+" FROM locations WHERE code=?", code))
+	if err == nil {
+		l.Site = locationSites()[l.Code]
+	}
+	return l, err
+}
+
+// checkStockLocation adds a validation error unless code is an active
+// location.
+func checkStockLocation(ve *ValidationErrors, field, code string) {
+	var active bool
+	if err := db.QueryRow("SELECT active FROM locations WHERE code=?", code).Scan(&active); err != nil {
+		ve.Add(field, "unknown location "+code)
+	} else if !active {
+		ve.Add(field, "location "+code+" is inactive")
+	}
+}
+
+// stockAt returns the qty of ipn held at a location, not counting the
+// locations under it.
+func stockAt(tx *sql.Tx, ipn, code string) float64 {
+	var qty float64
+	tx.QueryRow("SELECT qty_on_hand FROM inventory_locations WHERE ipn=? AND location_code=?", ipn, code).Scan(&qty)
+	return qty
+}
+
+// unassignedStock returns the qty of ipn on hand that isn't in any location.
+func unassignedStock(tx *sql.Tx, ipn string) float64 {
+	var onHand, located float64
+	tx.QueryRow("SELECT qty_on_hand FROM inventory WHERE ipn=?", ipn).Scan(&onHand)
+	tx.QueryRow("SELECT COALESCE(SUM(qty_on_hand),0) FROM inventory_locations WHERE ipn=?", ipn).Scan(&located)
+	return onHand - located
+}
+
+// addLocationStock changes the qty of ipn at a location by qty, which may be
+// negative. inventory.qty_on_hand is left to the caller.
+func addLocationStock(tx *sql.Tx, ipn, code string, qty float64, now string) error {
+	// Update first: SQLite checks the qty >= 0 constraint on the row being
+	// inserted before an upsert gets to the conflict, so a negative delta
+	// can't go through ON CONFLICT.
+	res, err := tx.Exec("UPDATE inventory_locations SET qty_on_hand = qty_on_hand + ?, updated_at = ? WHERE ipn=? AND location_code=?", qty, now, ipn, code)
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 0 {
+			_, err = tx.Exec("INSERT INTO inventory_locations (ipn, location_code, qty_on_hand, updated_at) VALUES (?,?,?,?)", ipn, code, qty, now)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update %s at %s: %w", ipn, code, err)
+	}
+	return nil
+}
+
+// fitLocatedStock takes stock out of locations when they hold more of ipn
+// than is on hand, which happens when stock is issued without saying where
+// from. The IPN's default location goes first, then the others by code.
+// Databases without locations are left alone.
+func fitLocatedStock(tx *sql.Tx, ipn string) error {
+	var onHand, located float64
+	if tx.QueryRow("SELECT COALESCE(SUM(qty_on_hand),0) FROM inventory_locations WHERE ipn=?", ipn).Scan(&located) != nil || located <= 0 {
+		return nil
+	}
+	tx.QueryRow("SELECT qty_on_hand FROM inventory WHERE ipn=?", ipn).Scan(&onHand)
+	excess := located - onHand
+	if excess <= 1e-9 {
+		return nil
+	}
+	rows, err := tx.Query(`SELECT il.location_code, il.qty_on_hand FROM inventory_locations il
+		LEFT JOIN inventory i ON i.ipn = il.ipn
+		WHERE il.ipn=? AND il.qty_on_hand > 0
+		ORDER BY CASE WHEN il.location_code = COALESCE(i.location,'') THEN 0 ELSE 1 END, il.location_code`, ipn)
+	if err != nil {
+		return fmt.Errorf("failed to load locations of %s: %w", ipn, err)
+	}
+	type held struct {
+		code string
+		qty  float64
+	}
+	var list []held
+	for rows.Next() {
+		var h held
+		rows.Scan(&h.code, &h.qty)
+		list = append(list, h)
+	}
+	rows.Close()
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	for _, h := range list {
+		take := h.qty
+		if take > excess {
+			take = excess
+		}
+		if err := addLocationStock(tx, ipn, h.code, -take, now); err != nil {
+			return err
+		}
+		if excess -= take; excess <= 1e-9 {
+			break
+		}
+	}
+	return nil
+}
+
+// locationBreakdown lists where an IPN is held. Locations emptied out are
+// left off.
+func locationBreakdown(ipn string) []LocationStock {
+	list := []LocationStock{}
+	sites := locationSites()
+	rows, err := db.Query("SELECT location_code, qty_on_hand FROM inventory_locations WHERE ipn=? AND qty_on_hand > 0 ORDER BY location_code", ipn)
+	if err != nil {
+		return list
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s LocationStock
+		rows.Scan(&s.Location, &s.Qty)
+		s.Site = sites[s.Location]
+		list = append(list, s)
+	}
+	return list
+}
+
+// attachLocations fills in an inventory item's location breakdown and the
+// qty that isn't in any location.
+func attachLocations(item *InventoryItem) {
+	item.Locations = locationBreakdown(item.IPN)
+	unassigned := item.QtyOnHand
+	for _, s := range item.Locations {
+		unassigned -= s.Qty
+	}
+	item.QtyUnassigned = &unassigned
+}
+
+// subtreeStock sums the stock per IPN held at a location and everything
+// under it.
+func subtreeStock(code string) (map[string]float64, error) {
+	rows, err := db.Query(`SELECT ipn, SUM(qty_on_hand) FROM inventory_locations
+		WHERE location_code IN (`+locationSubtree+`) GROUP BY ipn`, code)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stock := map[string]float64{}
+	for rows.Next() {
+		var ipn string
+		var qty float64
+		rows.Scan(&ipn, &qty)
+		stock[ipn] = qty
+	}
+	return stock, rows.Err()
+}
+
+// locationCodesUnder returns the code of a location and of everything under
+// it.
+func locationCodesUnder(code string) map[string]bool {
+	codes := map[string]bool{}
+	rows, err := db.Query(locationSubtree, code)
+	if err != nil {
+		return codes
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c string
+		rows.Scan(&c)
+		codes[c] = true
+	}
+	return codes
+}
+
+func handleListLocations(w http.ResponseWriter, r *http.Request) {
+	query := "SELECT " + locationColumns + " FROM locations WHERE 1=1"
+	var args []interface{}
+	q := r.URL.Query()
+	if v := q.Get("type"); v != "" {
+		query += " AND type = ?"
+		args = append(args, v)
+	}
+	if v := q.Get("parent"); v != "" {
+		query += " AND parent_code = ?"
+		args = append(args, v)
+	}
+	if v := q.Get("active"); v != "" {
+		query += " AND active = ?"
+		args = append(args, v == "true" || v == "1")
+	}
+	sites := locationSites()
+	rows, err := db.Query(query+" ORDER BY code", args...)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	site := q.Get("site")
+	items := []Location{}
+	for rows.Next() {
+		l, err := scanLocation(rows)
+		if err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		l.Site = sites[l.Code]
+		if site != "" && l.Site != site {
+			continue
+		}
+		items = append(items, l)
+	}
+	jsonResp(w, items)
+}
+
+// handleGetLocation returns a location with the locations directly under it
+// and the stock held there, its sub-locations included.
+func handleGetLocation(w http.ResponseWriter, r *http.Request, code string) {
+	loc, err := loadLocation(code)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "location not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	rows, err := db.Query("SELECT "+locationColumns+" FROM locations WHERE parent_code=? ORDER BY code", code)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	children := []Location{}
+	for rows.Next() {
+		if l, err := scanLocation(rows); err == nil {
+			l.Site = loc.Site
+			children = append(children, l)
+		}
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT ipn, location_code, qty_on_hand FROM inventory_locations
+		WHERE location_code IN (`+locationSubtree+`) AND qty_on_hand > 0 ORDER BY ipn, location_code`, code)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	stock := []LocationStock{}
+	total := 0.0
+	for rows.Next() {
+		s := LocationStock{Site: loc.Site}
+		rows.Scan(&s.IPN, &s.Location, &s.Qty)
+		total += s.Qty
+		stock = append(stock, s)
+	}
+	jsonResp(w, map[string]interface{}{"location": loc, "children": children, "stock": stock, "total_qty": total})
+}
+
+// handleCreateLocation adds a site, an area under a site or a bin under an
+// area.
+func handleCreateLocation(w http.ResponseWriter, r *http.Request) {
+	var l Location
+	if err := decodeBody(r, &l); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	l.Code = strings.TrimSpace(l.Code)
+	l.ParentCode = strings.TrimSpace(l.ParentCode)
+	ve := &ValidationErrors{}
+	requireField(ve, "code", l.Code)
+	requireField(ve, "name", l.Name)
+	requireField(ve, "type", l.Type)
+	validateEnum(ve, "type", l.Type, validLocationTypes)
+	validateMaxLength(ve, "code", l.Code, 50)
+	validateMaxLength(ve, "name", l.Name, 255)
+	validateMaxLength(ve, "notes", l.Notes, 10000)
+	if strings.ContainsAny(l.Code, "/ ") {
+		ve.Add("code", "must not contain spaces or slashes")
+	}
+	wantParent := map[string]string{"area": "site", "bin": "area"}[l.Type]
+	if l.Type == "site" && l.ParentCode != "" {
+		ve.Add("parent_code", "a site has no parent")
+	} else if wantParent != "" {
+		var parentType string
+		if l.ParentCode == "" {
+			ve.Add("parent_code", "a "+l.Type+" needs a parent "+wantParent)
+		} else if db.QueryRow("SELECT type FROM locations WHERE code=?", l.ParentCode).Scan(&parentType) != nil {
+			ve.Add("parent_code", "unknown location "+l.ParentCode)
+		} else if parentType != wantParent {
+			ve.Add("parent_code", fmt.Sprintf("a %s goes in a %s, not a %s", l.Type, wantParent, parentType))
+		}
+	}
+	var exists int
+	if l.Code != "" && db.QueryRow("SELECT 1 FROM locations WHERE code=?", l.Code).Scan(&exists) == nil {
+		ve.Add("code", "location "+l.Code+" already exists")
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	_, err := db.Exec("INSERT INTO locations (code, name, type, parent_code, active, notes, created_at) VALUES (?,?,?,?,1,?,?)",
+		l.Code, l.Name, l.Type, l.ParentCode, l.Notes, now)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, getUsername(r), "created", "location", l.Code, fmt.Sprintf("Created %s %s (%s)", l.Type, l.Code, l.Name))
+	loc, _ := loadLocation(l.Code)
+	jsonResp(w, loc)
+}
+
+// handleUpdateLocation renames a location, edits its notes, or deactivates
+// it. A location can only be deactivated once it is empty and nothing active
+// is under it.
+func handleUpdateLocation(w http.ResponseWriter, r *http.Request, code string) {
+	loc, err := loadLocation(code)
+	if err != nil {
+		jsonErr(w, "location not found", 404)
+		return
+	}
+	var body struct {
+		Name   *string `json:"name"`
+		Notes  *string `json:"notes"`
+		Active *bool   `json:"active"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	ve := &ValidationErrors{}
+	if body.Name != nil {
+		requireField(ve, "name", *body.Name)
+		validateMaxLength(ve, "name", *body.Name, 255)
+		loc.Name = *body.Name
+	}
+	if body.Notes != nil {
+		validateMaxLength(ve, "notes", *body.Notes, 10000)
+		loc.Notes = *body.Notes
+	}
+	if body.Active != nil {
+		if !*body.Active && loc.Active {
+			var qty float64
+			var children int
+			db.QueryRow("SELECT COALESCE(SUM(qty_on_hand),0) FROM inventory_locations WHERE location_code IN ("+locationSubtree+")", code).Scan(&qty)
+			db.QueryRow("SELECT COUNT(*) FROM locations WHERE parent_code=? AND active=1", code).Scan(&children)
+			if qty > 0 {
+				ve.Add("active", fmt.Sprintf("%s still holds %g units", code, qty))
+			}
+			if children > 0 {
+				ve.Add("active", fmt.Sprintf("%s has %d active locations under it", code, children))
+			}
+		}
+		loc.Active = *body.Active
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+	if _, err := db.Exec("UPDATE locations SET name=?, notes=?, active=? WHERE code=?", loc.Name, loc.Notes, loc.Active, code); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, getUsername(r), "updated", "location", code, "Updated location "+code)
+	jsonResp(w, loc)
+}
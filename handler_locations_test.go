@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func createLocation(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleCreateLocation(w, httptest.NewRequest("POST", "/api/v1/locations", bytes.NewBufferString(body)))
+	return w
+}
+
+func locationQty(t *testing.T, query string) map[string]float64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleListInventory(w, httptest.NewRequest("GET", "/api/v1/inventory"+query, nil))
+	if w.Code != 200 {
+		t.Fatalf("inventory list failed: %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Data []InventoryItem `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	qty := map[string]float64{}
+	for _, i := range resp.Data {
+		qty[i.IPN] = i.QtyOnHand
+	}
+	return qty
+}
+
+func TestLocationsAndTransfers(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+
+	for _, body := range []string{
+		`{"code":"MAIN","name":"Main plant","type":"site"}`,
+		`{"code":"MAIN-STK","name":"Stockroom","type":"area","parent_code":"MAIN"}`,
+		`{"code":"MAIN-SMT","name":"SMT line","type":"area","parent_code":"MAIN"}`,
+		`{"code":"A1","name":"Shelf A1","type":"bin","parent_code":"MAIN-STK"}`,
+		`{"code":"CM1","name":"Contract manufacturer","type":"site"}`,
+	} {
+		if w := createLocation(t, body); w.Code != 200 {
+			t.Fatalf("%s: %d %s", body, w.Code, w.Body.String())
+		}
+	}
+	for _, body := range []string{
+		`{"code":"B1","name":"Bin","type":"bin","parent_code":"MAIN"}`,
+		`{"code":"X","name":"Area","type":"area"}`,
+		`{"code":"Y","name":"Site","type":"site","parent_code":"MAIN"}`,
+		`{"code":"A1","name":"Again","type":"bin","parent_code":"MAIN-STK"}`,
+		`{"code":"Z Z","name":"Spaces","type":"site"}`,
+	} {
+		if w := createLocation(t, body); w.Code != 400 {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+	if loc, _ := loadLocation("A1"); loc.Site != "MAIN" {
+		t.Errorf("expected A1 in site MAIN, got %+v", loc)
+	}
+
+	db.Exec("INSERT INTO inventory (ipn, qty_on_hand, location, reorder_point) VALUES ('RES-1', 0, 'A1', 20)")
+	db.Exec(`INSERT INTO purchase_orders (id, vendor_id, status, created_at) VALUES ('PO-1', 'V-1', 'received', '2026-01-01 00:00:00')`)
+	db.Exec(`INSERT INTO po_lines (po_id, ipn, qty_ordered, unit_price) VALUES ('PO-1', 'RES-1', 100, 0.5)`)
+	for _, body := range []string{
+		`{"ipn":"RES-1","type":"receive","qty":100,"location":"A1"}`,
+		`{"ipn":"RES-1","type":"receive","qty":20}`,
+		`{"ipn":"RES-1","type":"transfer","qty":30,"location":"A1","to_location":"MAIN-SMT"}`,
+		`{"ipn":"RES-1","type":"transfer","qty":10,"to_location":"CM1"}`,
+	} {
+		if w := postTransact(t, body); w.Code != 200 {
+			t.Fatalf("%s: %d %s", body, w.Code, w.Body.String())
+		}
+	}
+	for _, body := range []string{
+		`{"ipn":"RES-1","type":"transfer","qty":31,"location":"MAIN-SMT","to_location":"A1"}`,
+		`{"ipn":"RES-1","type":"transfer","qty":11,"to_location":"A1"}`,
+		`{"ipn":"RES-1","type":"transfer","qty":1,"location":"A1"}`,
+		`{"ipn":"RES-1","type":"transfer","qty":1,"location":"A1","to_location":"NOPE"}`,
+		`{"ipn":"RES-1","type":"receive","qty":1,"to_location":"A1"}`,
+		`{"ipn":"RES-1","type":"issue","qty":31,"location":"MAIN-SMT"}`,
+	} {
+		if w := postTransact(t, body); w.Code != 400 {
+			t.Errorf("%s: expected 400, got %d %s", body, w.Code, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handleGetInventory(w, httptest.NewRequest("GET", "/api/v1/inventory/RES-1", nil), "RES-1")
+	var item struct {
+		Data InventoryItem `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &item)
+	if item.Data.QtyOnHand != 120 || len(item.Data.Locations) != 3 || *item.Data.QtyUnassigned != 10 {
+		t.Fatalf("unexpected breakdown: %s", w.Body.String())
+	}
+	if q := locationQty(t, "?location=MAIN"); q["RES-1"] != 100 {
+		t.Errorf("expected 100 at MAIN, got %v", q)
+	}
+	if q := locationQty(t, "?location=CM1"); q["RES-1"] != 10 {
+		t.Errorf("expected 10 at CM1, got %v", q)
+	}
+
+	// An issue without a location uses unassigned stock, then the default bin
+	postTransact(t, `{"ipn":"RES-1","type":"issue","qty":15}`)
+	postTransact(t, `{"ipn":"RES-1","type":"issue","qty":5,"location":"MAIN-SMT"}`)
+	postTransact(t, `{"ipn":"RES-1","type":"adjust","qty":8,"location":"CM1"}`)
+	tx, _ := db.Begin()
+	a1, smt, cm1, rest := stockAt(tx, "RES-1", "A1"), stockAt(tx, "RES-1", "MAIN-SMT"), stockAt(tx, "RES-1", "CM1"), unassignedStock(tx, "RES-1")
+	tx.Rollback()
+	if a1 != 65 || smt != 25 || cm1 != 8 || rest != 0 || onHand("RES-1") != 98 {
+		t.Errorf("expected 65/25/8 and nothing unassigned of 98, got %g/%g/%g, %g of %g", a1, smt, cm1, rest, onHand("RES-1"))
+	}
+	var from, to string
+	db.QueryRow("SELECT location, to_location FROM inventory_transactions WHERE type='transfer' ORDER BY id LIMIT 1").Scan(&from, &to)
+	if from != "A1" || to != "MAIN-SMT" {
+		t.Errorf("expected the transfer logged from A1 to MAIN-SMT, got %q -> %q", from, to)
+	}
+
+	// Reports per site and in total
+	w = httptest.NewRecorder()
+	handleReportInventoryValuation(w, httptest.NewRequest("GET", "/api/v1/reports/inventory-valuation?site=CM1", nil))
+	var val struct {
+		Data InvValuationReport `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &val)
+	if val.Data.GrandTotal != 4 {
+		t.Errorf("expected CM1 valued at 4, got %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handleReportInventoryValuation(w, httptest.NewRequest("GET", "/api/v1/reports/inventory-valuation", nil))
+	json.Unmarshal(w.Body.Bytes(), &val)
+	if val.Data.GrandTotal != 49 || len(val.Data.BySite) != 2 || val.Data.BySite[0].Site != "CM1" || val.Data.BySite[1].Total != 45 {
+		t.Errorf("unexpected valuation split: %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handleReportInventoryValuation(w, httptest.NewRequest("GET", "/api/v1/reports/inventory-valuation?site=A1", nil))
+	if w.Code != 400 {
+		t.Errorf("expected 400 for a bin as site, got %d", w.Code)
+	}
+	for site, want := range map[string]int{"": 0, "CM1": 1, "MAIN": 0} {
+		w = httptest.NewRecorder()
+		handleReportLowStock(w, httptest.NewRequest("GET", "/api/v1/reports/low-stock?site="+site, nil))
+		var low struct {
+			Data []LowStockItem `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &low)
+		if len(low.Data) != want {
+			t.Errorf("site %q: expected %d low-stock items, got %s", site, want, w.Body.String())
+		}
+	}
+
+	// A location holding stock can't be deactivated
+	w = httptest.NewRecorder()
+	handleUpdateLocation(w, httptest.NewRequest("PUT", "/api/v1/locations/MAIN-SMT", bytes.NewBufferString(`{"active":false}`)), "MAIN-SMT")
+	if w.Code != 400 {
+		t.Errorf("expected 400 deactivating a stocked location, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handleGetLocation(w, httptest.NewRequest("GET", "/api/v1/locations/MAIN", nil), "MAIN")
+	var loc struct {
+		Data struct {
+			Children []Location `json:"children"`
+			TotalQty float64    `json:"total_qty"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &loc)
+	if len(loc.Data.Children) != 2 || loc.Data.TotalQty != 90 {
+		t.Errorf("unexpected MAIN: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,713 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InventoryLot is one received batch of a part: a reel, tray or bag from a
+// PO line, or the output of a work order. inventory.qty_on_hand stays the
+// total for the IPN; lots track the part of it that can be traced. Stock
+// from before lot tracking is simply untracked.
+type InventoryLot struct {
+	ID                    int     `json:"id"`
+	IPN                   string  `json:"ipn"`
+	LotNumber             string  `json:"lot_number"`
+	DateCode              string  `json:"date_code"`
+	VendorID              string  `json:"vendor_id"`
+	POID                  string  `json:"po_id"`
+	POLineID              *int    `json:"po_line_id"`
+	ReceivingInspectionID *int    `json:"receiving_inspection_id"`
+	WOID                  string  `json:"wo_id"`
+	QtyReceived           float64 `json:"qty_received"`
+	QtyOnHand             float64 `json:"qty_on_hand"`
+	Status                string  `json:"status"`
+	Location              string  `json:"location"`
+	ReceivedAt            *string `json:"received_at"`
+	ExpiresAt             *string `json:"expires_at"`
+	Notes                 string  `json:"notes"`
+	CreatedAt             string  `json:"created_at"`
+	MSL                   *LotMSL `json:"msl,omitempty"`
+}
+
+// LotPick is an explicit request to draw qty from a specific lot.
+type LotPick struct {
+	LotID int     `json:"lot_id"`
+	Qty   float64 `json:"qty"`
+}
+
+// LotDraw is the qty taken from one lot by an issue. LotID is nil for the
+// part of an issue that had to come from untracked stock.
+type LotDraw struct {
+	LotID     *int    `json:"lot_id"`
+	LotNumber string  `json:"lot_number"`
+	Qty       float64 `json:"qty"`
+}
+
+const lotColumns = `id, ipn, lot_number, COALESCE(date_code,''), COALESCE(vendor_id,''), COALESCE(po_id,''), po_line_id,
+	receiving_inspection_id, COALESCE(wo_id,''), qty_received, qty_on_hand, status, COALESCE(location,''), received_at, COALESCE(notes,''), created_at, expires_at, ` + lotMSLColumns
+
+func scanLot(row interface{ Scan(...interface{}) error }) (InventoryLot, error) {
+	var l InventoryLot
+	var poLine, riID sql.NullInt64
+	var ra, ea sql.NullString
+	var msl lotMSLRow
+	err := row.Scan(append([]interface{}{&l.ID, &l.IPN, &l.LotNumber, &l.DateCode, &l.VendorID, &l.POID, &poLine,
+		&riID, &l.WOID, &l.QtyReceived, &l.QtyOnHand, &l.Status, &l.Location, &ra, &l.Notes, &l.CreatedAt, &ea}, msl.targets()...)...)
+	if poLine.Valid {
+		v := int(poLine.Int64)
+		l.POLineID = &v
+	}
+	if riID.Valid {
+		v := int(riID.Int64)
+		l.ReceivingInspectionID = &v
+	}
+	l.ReceivedAt = sp(ra)
+	if ea.Valid && len(ea.String) >= 10 {
+		d := ea.String[:10]
+		l.ExpiresAt = &d
+	}
+	l.MSL = msl.status(time.Now())
+	return l, err
+}
+
+func loadLot(id int) (InventoryLot, error) {
+	return scanLot(db.QueryRow("SELECT "+lotColumns+" FROM inventory_lots WHERE id=?", id))
+}
+
+// uniqueLotNumber returns base, or base with a -2, -3... suffix if the IPN
+// already has a lot by that number. Used for generated lot numbers only;
+// vendor lot numbers are kept as given.
+func uniqueLotNumber(tx *sql.Tx, ipn, base string) string {
+	number := base
+	for n := 2; ; n++ {
+		var exists int
+		tx.QueryRow("SELECT COUNT(*) FROM inventory_lots WHERE ipn=? AND lot_number=?", ipn, number).Scan(&exists)
+		if exists == 0 {
+			return number
+		}
+		number = fmt.Sprintf("%s-%d", base, n)
+	}
+}
+
+// createLot inserts a lot and returns its ID. A blank lot number is
+// generated from defaultNumber, and without an expiry date the lot expires
+// after the part's shelf life.
+func createLot(tx *sql.Tx, l InventoryLot, defaultNumber string) (int, error) {
+	if strings.TrimSpace(l.LotNumber) == "" {
+		l.LotNumber = uniqueLotNumber(tx, l.IPN, defaultNumber)
+	}
+	if l.Status == "" {
+		l.Status = "available"
+	}
+	if l.ExpiresAt == nil {
+		l.ExpiresAt = defaultLotExpiry(l.IPN, l.ReceivedAt)
+	}
+	res, err := tx.Exec(`INSERT INTO inventory_lots (ipn, lot_number, date_code, vendor_id, po_id, po_line_id, receiving_inspection_id,
+		wo_id, qty_received, qty_on_hand, status, location, received_at, notes, expires_at) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+		l.IPN, strings.TrimSpace(l.LotNumber), l.DateCode, l.VendorID, l.POID, l.POLineID, l.ReceivingInspectionID,
+		l.WOID, l.QtyReceived, l.QtyOnHand, l.Status, l.Location, l.ReceivedAt, l.Notes, l.ExpiresAt)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create lot for %s: %w", l.IPN, err)
+	}
+	id, _ := res.LastInsertId()
+	return int(id), nil
+}
+
+// recordLotTransaction logs an inventory transaction against a lot.
+func recordLotTransaction(tx *sql.Tx, lotID int, ipn, txType string, qty float64, reference, notes, now string) error {
+	_, err := tx.Exec("INSERT INTO inventory_transactions (ipn,type,qty,reference,notes,created_at,lot_id) VALUES (?,?,?,?,?,?,?)",
+		ipn, txType, qty, reference, notes, now, lotID)
+	if err != nil {
+		return fmt.Errorf("failed to log %s of lot %d: %w", txType, lotID, err)
+	}
+	return nil
+}
+
+// validateLotPicks checks explicit picks against the lots' IPN, status,
+// remaining qty, expiry date and MSL floor life. The returned error is
+// meant for the client.
+func validateLotPicks(tx *sql.Tx, ipn string, picks []LotPick) error {
+	want := map[int]float64{}
+	for _, p := range picks {
+		if p.Qty <= 0 {
+			return fmt.Errorf("lot %d: qty must be positive", p.LotID)
+		}
+		want[p.LotID] += p.Qty
+	}
+	for lotID, qty := range want {
+		var lotIPN, status string
+		var onHand float64
+		var expires sql.NullString
+		err := tx.QueryRow("SELECT ipn, status, qty_on_hand, expires_at FROM inventory_lots WHERE id=?", lotID).Scan(&lotIPN, &status, &onHand, &expires)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("lot %d not found", lotID)
+		} else if err != nil {
+			return err
+		}
+		if lotIPN != ipn {
+			return fmt.Errorf("lot %d is %s, not %s", lotID, lotIPN, ipn)
+		}
+		if status != "available" {
+			return fmt.Errorf("lot %d is %s", lotID, status)
+		}
+		if qty > onHand+1e-9 {
+			return fmt.Errorf("lot %d has only %g left", lotID, onHand)
+		}
+		if expires.Valid && len(expires.String) >= 10 && expires.String[:10] <= expiryToday(time.Now()) {
+			return fmt.Errorf("lot %d expired on %s", lotID, expires.String[:10])
+		}
+		if err := checkLotFloorLife(tx, lotID, time.Now()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// issueFromLots draws qty of ipn out of its lots and logs one transaction per
+// lot drawn. With picks the given lots are used (validate them first);
+// otherwise the lots that expire first go first, then the oldest, skipping
+// lots that can't be issued. Whatever the lots can't cover is logged as an
+// untracked issue, but only out of stock that isn't in any lot: the rest
+// is refused while unusable lots hold it. inventory.qty_on_hand is left to
+// the caller; draw it down first so locations holding the stock are drawn
+// down.
+func issueFromLots(tx *sql.Tx, ipn string, qty float64, picks []LotPick, txType, reference, notes, now string) ([]LotDraw, error) {
+	if len(picks) == 0 {
+		at := time.Now()
+		var onHand, inLots float64
+		tx.QueryRow("SELECT COALESCE(qty_on_hand,0) FROM inventory WHERE ipn=?", ipn).Scan(&onHand)
+		tx.QueryRow("SELECT COALESCE(SUM(qty_on_hand),0) FROM inventory_lots WHERE ipn=? AND qty_on_hand > 0 AND status IN ('available','hold','quarantine')", ipn).Scan(&inLots)
+		untracked := onHand + qty - inLots
+		unusable := unusableLotStock(tx, ipn, at)
+		rows, err := tx.Query(`SELECT id, qty_on_hand, `+lotMSLColumns+` FROM inventory_lots
+			WHERE ipn=? AND status='available' AND qty_on_hand > 0 AND `+lotNotExpired+` `+lotFEFOOrder, ipn, expiryToday(at))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load lots for %s: %w", ipn, err)
+		}
+		remaining := qty
+		for rows.Next() && remaining > 1e-9 {
+			var p LotPick
+			var onHand float64
+			var msl lotMSLRow
+			rows.Scan(append([]interface{}{&p.LotID, &onHand}, msl.targets()...)...)
+			if m := msl.status(at); m != nil && m.Exceeded {
+				continue
+			}
+			p.Qty = onHand
+			if p.Qty > remaining {
+				p.Qty = remaining
+			}
+			remaining -= p.Qty
+			picks = append(picks, p)
+		}
+		rows.Close()
+		if unusable > 0 && remaining > math.Max(untracked, 0)+1e-9 {
+			return nil, fmt.Errorf("only %g of %s is usable; %g is in lots that are expired, quarantined, on hold or past their floor life",
+				qty-remaining+math.Max(untracked, 0), ipn, unusable)
+		}
+	}
+
+	draws := []LotDraw{}
+	drawn := 0.0
+	for _, p := range picks {
+		_, err := tx.Exec(`UPDATE inventory_lots SET qty_on_hand = qty_on_hand - ?,
+			status = CASE WHEN qty_on_hand - ? <= 0 THEN 'depleted' ELSE status END WHERE id = ?`, p.Qty, p.Qty, p.LotID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to draw from lot %d: %w", p.LotID, err)
+		}
+		if err := recordLotTransaction(tx, p.LotID, ipn, txType, p.Qty, reference, notes, now); err != nil {
+			return nil, err
+		}
+		id := p.LotID
+		d := LotDraw{LotID: &id, Qty: p.Qty}
+		tx.QueryRow("SELECT lot_number FROM inventory_lots WHERE id=?", p.LotID).Scan(&d.LotNumber)
+		draws = append(draws, d)
+		drawn += p.Qty
+	}
+
+	if rest := qty - drawn; rest > 1e-9 {
+		_, err := tx.Exec("INSERT INTO inventory_transactions (ipn,type,qty,reference,notes,created_at) VALUES (?,?,?,?,?,?)",
+			ipn, txType, rest, reference, notes, now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to log %s of %s: %w", txType, ipn, err)
+		}
+		draws = append(draws, LotDraw{Qty: rest})
+	}
+	if err := fitLocatedStock(tx, ipn); err != nil {
+		return nil, err
+	}
+	return draws, syncCostLayers(tx, ipn, txType, reference, 0, now)
+}
+
+// returnToLot puts qty back into a lot, e.g. unused material from a WO.
+func returnToLot(tx *sql.Tx, lotID int, qty float64, reference, notes, now string) error {
+	var ipn string
+	if err := tx.QueryRow("SELECT ipn FROM inventory_lots WHERE id=?", lotID).Scan(&ipn); err != nil {
+		return fmt.Errorf("lot %d not found", lotID)
+	}
+	_, err := tx.Exec(`UPDATE inventory_lots SET qty_on_hand = qty_on_hand + ?,
+		status = CASE WHEN status = 'depleted' THEN 'available' ELSE status END WHERE id = ?`, qty, lotID)
+	if err != nil {
+		return fmt.Errorf("failed to return to lot %d: %w", lotID, err)
+	}
+	return recordLotTransaction(tx, lotID, ipn, "return", qty, reference, notes, now)
+}
+
+func handleListLots(w http.ResponseWriter, r *http.Request) {
+	query := "SELECT " + lotColumns + " FROM inventory_lots WHERE 1=1"
+	var args []interface{}
+	for _, f := range []string{"ipn", "status", "po_id", "wo_id", "lot_number"} {
+		if v := r.URL.Query().Get(f); v != "" {
+			query += " AND " + f + " = ?"
+			args = append(args, v)
+		}
+	}
+	rows, err := db.Query(query+" ORDER BY ipn, COALESCE(received_at, created_at), id", args...)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	items := []InventoryLot{}
+	for rows.Next() {
+		l, err := scanLot(rows)
+		if err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		items = append(items, l)
+	}
+	jsonResp(w, items)
+}
+
+func handleGetLot(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		jsonErr(w, "invalid lot id", 400)
+		return
+	}
+	lot, err := loadLot(id)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "lot not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	rows, err := db.Query(`SELECT id,ipn,type,qty,COALESCE(reference,''),COALESCE(notes,''),created_at,lot_id
+		FROM inventory_transactions WHERE lot_id=? ORDER BY created_at, id`, id)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	txns := []InventoryTransaction{}
+	for rows.Next() {
+		var t InventoryTransaction
+		var lotID sql.NullInt64
+		rows.Scan(&t.ID, &t.IPN, &t.Type, &t.Qty, &t.Reference, &t.Notes, &t.CreatedAt, &lotID)
+		if lotID.Valid {
+			v := int(lotID.Int64)
+			t.LotID = &v
+		}
+		txns = append(txns, t)
+	}
+	jsonResp(w, map[string]interface{}{"lot": lot, "transactions": txns})
+}
+
+// handleUpdateLot puts a lot on hold or in quarantine or releases it, and
+// edits its date code, expiry date, storage location and notes. Lots on hold
+// or in quarantine are skipped by FIFO picking and can't be picked
+// explicitly. An expired lot can only be released with a later expiry date,
+// e.g. after it is recertified.
+func handleUpdateLot(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		jsonErr(w, "invalid lot id", 400)
+		return
+	}
+	lot, err := loadLot(id)
+	if err != nil {
+		jsonErr(w, "lot not found", 404)
+		return
+	}
+	var body struct {
+		Status    *string `json:"status"`
+		DateCode  *string `json:"date_code"`
+		ExpiresAt *string `json:"expires_at"`
+		Location  *string `json:"location"`
+		Notes     *string `json:"notes"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	ve := &ValidationErrors{}
+	if body.Status != nil {
+		validateEnum(ve, "status", *body.Status, []string{"available", "hold", "quarantine"})
+		if lot.Status == "depleted" || lot.Status == "inspection" {
+			ve.Add("status", "cannot change a lot that is "+lot.Status)
+		}
+		lot.Status = *body.Status
+	}
+	if body.DateCode != nil {
+		validateMaxLength(ve, "date_code", *body.DateCode, 50)
+		lot.DateCode = *body.DateCode
+	}
+	if body.ExpiresAt != nil {
+		lot.ExpiresAt = nil
+		if v := strings.TrimSpace(*body.ExpiresAt); v != "" {
+			validateExpiryDate(ve, v)
+			lot.ExpiresAt = &v
+		}
+	}
+	if body.Status != nil && lot.Status == "available" && lot.ExpiresAt != nil && *lot.ExpiresAt <= expiryToday(time.Now()) {
+		ve.Add("status", "lot expired on "+*lot.ExpiresAt+"; set a later expires_at to release it")
+	}
+	if body.Location != nil {
+		validateMaxLength(ve, "location", *body.Location, 100)
+		lot.Location = strings.TrimSpace(*body.Location)
+	}
+	if body.Notes != nil {
+		validateMaxLength(ve, "notes", *body.Notes, 10000)
+		lot.Notes = *body.Notes
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+	if _, err := db.Exec("UPDATE inventory_lots SET status=?, date_code=?, expires_at=?, location=?, notes=? WHERE id=?",
+		lot.Status, lot.DateCode, lot.ExpiresAt, lot.Location, lot.Notes, id); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, getUsername(r), "updated", "lot", idStr, fmt.Sprintf("Updated lot %s of %s (%s)", lot.LotNumber, lot.IPN, lot.Status))
+	jsonResp(w, lot)
+}
+
+// Forward trace: where did a lot go?
+
+type LotTraceShipment struct {
+	ShipmentID string  `json:"shipment_id"`
+	Status     string  `json:"status"`
+	ToAddress  string  `json:"to_address"`
+	ShipDate   *string `json:"ship_date"`
+}
+
+type LotTraceSerial struct {
+	SerialNumber string             `json:"serial_number"`
+	Status       string             `json:"status"`
+	Customer     string             `json:"customer"`
+	Location     string             `json:"location"`
+	DeviceStatus string             `json:"device_status"`
+	Shipments    []LotTraceShipment `json:"shipments"`
+}
+
+type LotTraceWO struct {
+	WOID        string           `json:"wo_id"`
+	AssemblyIPN string           `json:"assembly_ipn"`
+	Status      string           `json:"status"`
+	QtyIssued   float64          `json:"qty_issued"`
+	Serials     []LotTraceSerial `json:"serials"`
+	OutputLots  []LotForward     `json:"output_lots"`
+}
+
+type LotTraceSO struct {
+	SalesOrderID string  `json:"sales_order_id"`
+	Customer     string  `json:"customer"`
+	Status       string  `json:"status"`
+	Qty          float64 `json:"qty"`
+}
+
+type LotTraceRef struct {
+	Reference string  `json:"reference"`
+	Qty       float64 `json:"qty"`
+}
+
+// LotForward is a lot and everything its material went into. Output lots of
+// the work orders are traced in turn, so sub-assembly lots lead on to the
+// top-level builds.
+type LotForward struct {
+	Lot         InventoryLot  `json:"lot"`
+	WorkOrders  []LotTraceWO  `json:"work_orders"`
+	SalesOrders []LotTraceSO  `json:"sales_orders"`
+	OtherIssues []LotTraceRef `json:"other_issues"`
+}
+
+const maxTraceDepth = 10
+
+func traceLotForward(lotID int, depth int, customers map[string]bool) (LotForward, error) {
+	node := LotForward{WorkOrders: []LotTraceWO{}, SalesOrders: []LotTraceSO{}, OtherIssues: []LotTraceRef{}}
+	lot, err := loadLot(lotID)
+	if err != nil {
+		return node, err
+	}
+	node.Lot = lot
+
+	rows, err := db.Query(`SELECT COALESCE(reference,''), SUM(CASE type WHEN 'issue' THEN qty ELSE -qty END) FROM inventory_transactions
+		WHERE lot_id=? AND type IN ('issue','return') GROUP BY reference HAVING SUM(CASE type WHEN 'issue' THEN qty ELSE -qty END) > 0
+		ORDER BY reference`, lotID)
+	if err != nil {
+		return node, err
+	}
+	var refs []LotTraceRef
+	for rows.Next() {
+		var ref LotTraceRef
+		rows.Scan(&ref.Reference, &ref.Qty)
+		refs = append(refs, ref)
+	}
+	rows.Close()
+
+	for _, ref := range refs {
+		refType, refID := reservationRefFromReference(db, ref.Reference)
+		if refType == "sales_order" {
+			so := LotTraceSO{SalesOrderID: refID, Qty: ref.Qty}
+			db.QueryRow("SELECT customer, status FROM sales_orders WHERE id=?", refID).Scan(&so.Customer, &so.Status)
+			if so.Customer != "" {
+				customers[so.Customer] = true
+			}
+			node.SalesOrders = append(node.SalesOrders, so)
+			continue
+		}
+		wo := LotTraceWO{WOID: refID, QtyIssued: ref.Qty, Serials: []LotTraceSerial{}, OutputLots: []LotForward{}}
+		if err := db.QueryRow("SELECT assembly_ipn, status FROM work_orders WHERE id=?", refID).Scan(&wo.AssemblyIPN, &wo.Status); err != nil {
+			node.OtherIssues = append(node.OtherIssues, ref)
+			continue
+		}
+		if wo.Serials, err = traceWorkOrderSerials(refID, customers); err != nil {
+			return node, err
+		}
+		if depth < maxTraceDepth {
+			var outIDs []int
+			outRows, err := db.Query("SELECT id FROM inventory_lots WHERE wo_id=? ORDER BY id", refID)
+			if err != nil {
+				return node, err
+			}
+			for outRows.Next() {
+				var id int
+				outRows.Scan(&id)
+				outIDs = append(outIDs, id)
+			}
+			outRows.Close()
+			for _, id := range outIDs {
+				out, err := traceLotForward(id, depth+1, customers)
+				if err != nil {
+					return node, err
+				}
+				wo.OutputLots = append(wo.OutputLots, out)
+			}
+		}
+		node.WorkOrders = append(node.WorkOrders, wo)
+	}
+	return node, nil
+}
+
+// traceWorkOrderSerials lists a WO's serials with the device record and the
+// shipments each went out on.
+func traceWorkOrderSerials(woID string, customers map[string]bool) ([]LotTraceSerial, error) {
+	rows, err := db.Query("SELECT serial_number, status FROM wo_serials WHERE wo_id=? ORDER BY serial_number", woID)
+	if err != nil {
+		return nil, err
+	}
+	serials := []LotTraceSerial{}
+	for rows.Next() {
+		s := LotTraceSerial{Shipments: []LotTraceShipment{}}
+		rows.Scan(&s.SerialNumber, &s.Status)
+		serials = append(serials, s)
+	}
+	rows.Close()
+
+	for i := range serials {
+		s := &serials[i]
+		db.QueryRow("SELECT COALESCE(customer,''), COALESCE(location,''), COALESCE(status,'') FROM devices WHERE serial_number=?",
+			s.SerialNumber).Scan(&s.Customer, &s.Location, &s.DeviceStatus)
+		if s.Customer != "" {
+			customers[s.Customer] = true
+		}
+		shipRows, err := db.Query(`SELECT s.id, s.status, COALESCE(s.to_address,''), s.ship_date FROM shipment_lines l
+			JOIN shipments s ON s.id = l.shipment_id WHERE l.serial_number=? AND s.type='outbound' ORDER BY s.id`, s.SerialNumber)
+		if err != nil {
+			return nil, err
+		}
+		for shipRows.Next() {
+			var sh LotTraceShipment
+			var sd sql.NullString
+			shipRows.Scan(&sh.ShipmentID, &sh.Status, &sh.ToAddress, &sd)
+			sh.ShipDate = sp(sd)
+			s.Shipments = append(s.Shipments, sh)
+		}
+		shipRows.Close()
+	}
+	return serials, nil
+}
+
+// handleTraceLotForward follows a lot into work orders, their serials,
+// devices and shipments, and sales orders it was issued to directly.
+func handleTraceLotForward(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		jsonErr(w, "invalid lot id", 400)
+		return
+	}
+	customers := map[string]bool{}
+	node, err := traceLotForward(id, 0, customers)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "lot not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	list := []string{}
+	for c := range customers {
+		list = append(list, c)
+	}
+	sort.Strings(list)
+	jsonResp(w, map[string]interface{}{"trace": node, "customers": list})
+}
+
+// Backward trace: what went into a build?
+
+// WOTraceMaterial is material consumed by a work order, per lot. LotID is nil
+// for untracked stock. Lots built in-house carry the trace of the WO that
+// produced them.
+type WOTraceMaterial struct {
+	IPN        string   `json:"ipn"`
+	Qty        float64  `json:"qty"`
+	LotID      *int     `json:"lot_id"`
+	LotNumber  string   `json:"lot_number"`
+	DateCode   string   `json:"date_code"`
+	VendorID   string   `json:"vendor_id"`
+	VendorName string   `json:"vendor_name"`
+	POID       string   `json:"po_id"`
+	ProducedBy *WOTrace `json:"produced_by"`
+}
+
+type WOTrace struct {
+	WOID        string            `json:"wo_id"`
+	AssemblyIPN string            `json:"assembly_ipn"`
+	Status      string            `json:"status"`
+	Serials     []string          `json:"serials"`
+	Materials   []WOTraceMaterial `json:"materials"`
+}
+
+func traceWorkOrderBackward(woID string, depth int) (*WOTrace, error) {
+	t := &WOTrace{WOID: woID, Serials: []string{}, Materials: []WOTraceMaterial{}}
+	if err := db.QueryRow("SELECT assembly_ipn, status FROM work_orders WHERE id=?", woID).Scan(&t.AssemblyIPN, &t.Status); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT serial_number FROM wo_serials WHERE wo_id=? ORDER BY serial_number", woID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var sn string
+		rows.Scan(&sn)
+		t.Serials = append(t.Serials, sn)
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT ipn, lot_id, SUM(CASE type WHEN 'issue' THEN qty ELSE -qty END) FROM inventory_transactions
+		WHERE reference=? AND type IN ('issue','return') GROUP BY ipn, lot_id
+		HAVING SUM(CASE type WHEN 'issue' THEN qty ELSE -qty END) > 0 ORDER BY ipn, lot_id`, woID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var m WOTraceMaterial
+		var lotID sql.NullInt64
+		rows.Scan(&m.IPN, &lotID, &m.Qty)
+		if lotID.Valid {
+			v := int(lotID.Int64)
+			m.LotID = &v
+		}
+		t.Materials = append(t.Materials, m)
+	}
+	rows.Close()
+
+	for i := range t.Materials {
+		m := &t.Materials[i]
+		if m.LotID == nil {
+			continue
+		}
+		lot, err := loadLot(*m.LotID)
+		if err != nil {
+			continue
+		}
+		m.LotNumber, m.DateCode, m.VendorID, m.POID = lot.LotNumber, lot.DateCode, lot.VendorID, lot.POID
+		if m.VendorID != "" {
+			db.QueryRow("SELECT name FROM vendors WHERE id=?", m.VendorID).Scan(&m.VendorName)
+		}
+		if lot.WOID != "" && depth < maxTraceDepth {
+			if m.ProducedBy, err = traceWorkOrderBackward(lot.WOID, depth+1); err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+		}
+	}
+	return t, nil
+}
+
+// handleTraceLotBackward shows where a lot came from: the PO and vendor it
+// was received from, or the WO that built it and that WO's own materials.
+func handleTraceLotBackward(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		jsonErr(w, "invalid lot id", 400)
+		return
+	}
+	lot, err := loadLot(id)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "lot not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	var vendorName string
+	if lot.VendorID != "" {
+		db.QueryRow("SELECT name FROM vendors WHERE id=?", lot.VendorID).Scan(&vendorName)
+	}
+	var producedBy *WOTrace
+	if lot.WOID != "" {
+		if producedBy, err = traceWorkOrderBackward(lot.WOID, 0); err != nil && err != sql.ErrNoRows {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+	}
+	jsonResp(w, map[string]interface{}{"lot": lot, "vendor_name": vendorName, "produced_by": producedBy})
+}
+
+func handleTraceWorkOrder(w http.ResponseWriter, r *http.Request, woID string) {
+	t, err := traceWorkOrderBackward(woID, 0)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "work order not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	jsonResp(w, t)
+}
+
+// handleTraceSerial traces a serial number back through the WO that built
+// it to the lots it was built from.
+func handleTraceSerial(w http.ResponseWriter, r *http.Request, serial string) {
+	var woID string
+	if err := db.QueryRow("SELECT wo_id FROM wo_serials WHERE serial_number=?", serial).Scan(&woID); err != nil {
+		jsonErr(w, "serial number not found", 404)
+		return
+	}
+	t, err := traceWorkOrderBackward(woID, 0)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	jsonResp(w, map[string]interface{}{"serial_number": serial, "wo_id": woID, "trace": t})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func seedLot(t *testing.T, l InventoryLot) int {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	id, err := createLot(tx, l, "LOT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func postTransact(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleInventoryTransact(w, httptest.NewRequest("POST", "/api/v1/inventory/transact", bytes.NewBufferString(body)))
+	return w
+}
+
+func lotQty(t *testing.T, id int) (float64, string) {
+	t.Helper()
+	l, err := loadLot(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l.QtyOnHand, l.Status
+}
+
+func TestLotIssueFIFO(t *testing.T) {
+	oldDB, oldPartsDir := db, partsDir
+	db = setupTestDB(t)
+	partsDir = t.TempDir()
+	defer func() { db.Close(); db = oldDB; partsDir = oldPartsDir }()
+
+	// 70 in two lots plus 30 from before lot tracking
+	db.Exec(`INSERT INTO inventory (ipn, qty_on_hand) VALUES ('RES-1', 100)`)
+	older, newer := "2026-01-05 08:00:00", "2026-02-05 08:00:00"
+	lot2 := seedLot(t, InventoryLot{IPN: "RES-1", LotNumber: "B", QtyReceived: 40, QtyOnHand: 40, ReceivedAt: &newer})
+	lot1 := seedLot(t, InventoryLot{IPN: "RES-1", LotNumber: "A", QtyReceived: 30, QtyOnHand: 30, ReceivedAt: &older})
+
+	if w := postTransact(t, `{"ipn":"RES-1","type":"issue","qty":50,"reference":"WO-1"}`); w.Code != 200 {
+		t.Fatalf("issue failed: %d %s", w.Code, w.Body.String())
+	}
+	if q, s := lotQty(t, lot1); q != 0 || s != "depleted" {
+		t.Errorf("expected oldest lot depleted, got %v %s", q, s)
+	}
+	if q, _ := lotQty(t, lot2); q != 20 {
+		t.Errorf("expected 20 left in newer lot, got %v", q)
+	}
+
+	// The lots run out and the rest comes from untracked stock
+	if w := postTransact(t, `{"ipn":"RES-1","type":"issue","qty":40,"reference":"WO-1"}`); w.Code != 200 {
+		t.Fatalf("issue failed: %d %s", w.Code, w.Body.String())
+	}
+	var untracked float64
+	db.QueryRow("SELECT COALESCE(SUM(qty),0) FROM inventory_transactions WHERE ipn='RES-1' AND type='issue' AND lot_id IS NULL").Scan(&untracked)
+	if untracked != 20 {
+		t.Errorf("expected 20 issued untracked, got %v", untracked)
+	}
+	var onHand float64
+	db.QueryRow("SELECT qty_on_hand FROM inventory WHERE ipn='RES-1'").Scan(&onHand)
+	if onHand != 10 {
+		t.Errorf("expected 10 on hand, got %v", onHand)
+	}
+
+	w := httptest.NewRecorder()
+	handleGetLot(w, httptest.NewRequest("GET", "/api/v1/lots/"+strconv.Itoa(lot2), nil), strconv.Itoa(lot2))
+	var resp struct {
+		Data struct {
+			Lot          InventoryLot           `json:"lot"`
+			Transactions []InventoryTransaction `json:"transactions"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Data.Lot.LotNumber != "B" || len(resp.Data.Transactions) != 2 {
+		t.Errorf("expected lot B with 2 issues, got %+v", resp.Data)
+	}
+}
+
+func TestLotTransactPicksAndReturns(t *testing.T) {
+	oldDB, oldPartsDir := db, partsDir
+	db = setupTestDB(t)
+	partsDir = t.TempDir()
+	defer func() { db.Close(); db = oldDB; partsDir = oldPartsDir }()
+
+	if w := postTransact(t, `{"ipn":"CAP-1","type":"receive","qty":100,"lot_number":"V-LOT-9","date_code":"2611"}`); w.Code != 200 {
+		t.Fatalf("receive failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := postTransact(t, `{"ipn":"CAP-1","type":"receive","qty":50,"lot_number":"V-LOT-10"}`); w.Code != 200 {
+		t.Fatalf("receive failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := postTransact(t, `{"ipn":"RES-1","type":"receive","qty":10,"lot_number":"R-1"}`); w.Code != 200 {
+		t.Fatalf("receive failed: %d %s", w.Code, w.Body.String())
+	}
+	var capLot, capLot2, resLot int
+	db.QueryRow("SELECT id FROM inventory_lots WHERE lot_number='V-LOT-9'").Scan(&capLot)
+	db.QueryRow("SELECT id FROM inventory_lots WHERE lot_number='V-LOT-10'").Scan(&capLot2)
+	db.QueryRow("SELECT id FROM inventory_lots WHERE lot_number='R-1'").Scan(&resLot)
+	if l, _ := loadLot(capLot); l.QtyOnHand != 100 || l.DateCode != "2611" || l.Status != "available" {
+		t.Fatalf("unexpected received lot: %+v", l)
+	}
+
+	// Put the second CAP lot on hold
+	w := httptest.NewRecorder()
+	handleUpdateLot(w, httptest.NewRequest("PUT", "/api/v1/lots/"+strconv.Itoa(capLot2), bytes.NewBufferString(`{"status":"hold"}`)), strconv.Itoa(capLot2))
+	if w.Code != 200 {
+		t.Fatalf("hold failed: %d %s", w.Code, w.Body.String())
+	}
+
+	bad := []struct {
+		name, body string
+	}{
+		{"picks don't add up", `{"ipn":"CAP-1","type":"issue","qty":20,"lots":[{"lot_id":` + strconv.Itoa(capLot) + `,"qty":10}]}`},
+		{"lot of another part", `{"ipn":"CAP-1","type":"issue","lots":[{"lot_id":` + strconv.Itoa(resLot) + `,"qty":5}]}`},
+		{"lot on hold", `{"ipn":"CAP-1","type":"issue","lots":[{"lot_id":` + strconv.Itoa(capLot2) + `,"qty":5}]}`},
+		{"more than the lot holds", `{"ipn":"CAP-1","type":"issue","lots":[{"lot_id":` + strconv.Itoa(capLot) + `,"qty":150}]}`},
+		{"unknown lot", `{"ipn":"CAP-1","type":"issue","lots":[{"lot_id":9999,"qty":1}]}`},
+		{"picks on a receive", `{"ipn":"CAP-1","type":"receive","qty":5,"lots":[{"lot_id":` + strconv.Itoa(capLot) + `,"qty":5}]}`},
+		{"return to another part's lot", `{"ipn":"CAP-1","type":"return","qty":5,"lot_id":` + strconv.Itoa(resLot) + `}`},
+	}
+	for _, tt := range bad {
+		if w := postTransact(t, tt.body); w.Code != 400 {
+			t.Errorf("%s: expected 400, got %d %s", tt.name, w.Code, w.Body.String())
+		}
+	}
+
+	// An explicit pick takes the qty from the lot given, qty defaults to the picks
+	if w := postTransact(t, `{"ipn":"CAP-1","type":"issue","reference":"WO-7","lots":[{"lot_id":`+strconv.Itoa(capLot)+`,"qty":30}]}`); w.Code != 200 {
+		t.Fatalf("picked issue failed: %d %s", w.Code, w.Body.String())
+	}
+	if q, _ := lotQty(t, capLot); q != 70 {
+		t.Errorf("expected 70 left in picked lot, got %v", q)
+	}
+	if q, _ := lotQty(t, capLot2); q != 50 {
+		t.Errorf("expected held lot untouched, got %v", q)
+	}
+
+	// Returning into the lot puts it back
+	if w := postTransact(t, `{"ipn":"CAP-1","type":"return","qty":5,"reference":"WO-7","lot_id":`+strconv.Itoa(capLot)+`}`); w.Code != 200 {
+		t.Fatalf("return failed: %d %s", w.Code, w.Body.String())
+	}
+	if q, _ := lotQty(t, capLot); q != 75 {
+		t.Errorf("expected 75 in lot after return, got %v", q)
+	}
+	var onHand float64
+	db.QueryRow("SELECT qty_on_hand FROM inventory WHERE ipn='CAP-1'").Scan(&onHand)
+	if onHand != 125 {
+		t.Errorf("expected 125 CAP-1 on hand, got %v", onHand)
+	}
+}
+
+// completeTestWO reserves materials for a WO and completes it.
+func completeTestWO(t *testing.T, woID, assembly string, qty int, materials map[string]float64) {
+	t.Helper()
+	db.Exec("INSERT INTO work_orders (id, assembly_ipn, qty, status) VALUES (?, ?, ?, 'in_progress')", woID, assembly, qty)
+	for ipn, q := range materials {
+		db.Exec("INSERT INTO inventory_reservations (ref_type, ref_id, ipn, qty) VALUES ('work_order', ?, ?, ?)", woID, ipn, q)
+		db.Exec("UPDATE inventory SET qty_reserved = qty_reserved + ? WHERE ipn = ?", q, ipn)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := handleWorkOrderCompletion(tx, woID, assembly, qty, "tester"); err != nil {
+		t.Fatalf("completing %s: %v", woID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLotTraceThroughWorkOrders(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+
+	db.Exec(`INSERT INTO vendors (id, name) VALUES ('V-1', 'Mouser')`)
+	db.Exec(`INSERT INTO inventory (ipn, qty_on_hand) VALUES ('RES-1', 100)`)
+	resLot := seedLot(t, InventoryLot{IPN: "RES-1", LotNumber: "MR-55", VendorID: "V-1", POID: "PO-1", QtyReceived: 100, QtyOnHand: 100})
+
+	// RES-1 goes into PCA-1, PCA-1 goes into ASY-1
+	completeTestWO(t, "WO-PCA", "PCA-1", 2, map[string]float64{"RES-1": 20})
+	var pcaLot int
+	db.QueryRow("SELECT id FROM inventory_lots WHERE wo_id='WO-PCA'").Scan(&pcaLot)
+	if l, _ := loadLot(pcaLot); l.IPN != "PCA-1" || l.QtyOnHand != 2 || l.LotNumber != "WO-PCA" {
+		t.Fatalf("expected output lot WO-PCA with 2 PCA-1, got %+v", l)
+	}
+	if q, _ := lotQty(t, resLot); q != 80 {
+		t.Errorf("expected 80 left in RES-1 lot, got %v", q)
+	}
+	completeTestWO(t, "WO-ASY", "ASY-1", 1, map[string]float64{"PCA-1": 1})
+
+	db.Exec(`INSERT INTO wo_serials (wo_id, serial_number, status) VALUES ('WO-ASY', 'SN-0001', 'complete')`)
+	db.Exec(`INSERT INTO devices (serial_number, ipn, customer, location) VALUES ('SN-0001', 'ASY-1', 'Acme', 'Plant 2')`)
+	db.Exec(`INSERT INTO shipments (id, type, status, to_address) VALUES ('SHP-1', 'outbound', 'shipped', 'Acme Dock')`)
+	db.Exec(`INSERT INTO shipment_lines (shipment_id, serial_number) VALUES ('SHP-1', 'SN-0001')`)
+
+	w := httptest.NewRecorder()
+	handleTraceLotForward(w, httptest.NewRequest("GET", "/api/v1/lots/"+strconv.Itoa(resLot)+"/trace/forward", nil), strconv.Itoa(resLot))
+	if w.Code != 200 {
+		t.Fatalf("forward trace failed: %d %s", w.Code, w.Body.String())
+	}
+	var fwd struct {
+		Data struct {
+			Trace     LotForward `json:"trace"`
+			Customers []string   `json:"customers"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &fwd)
+	if len(fwd.Data.Customers) != 1 || fwd.Data.Customers[0] != "Acme" {
+		t.Errorf("expected customer Acme, got %v", fwd.Data.Customers)
+	}
+	wos := fwd.Data.Trace.WorkOrders
+	if len(wos) != 1 || wos[0].WOID != "WO-PCA" || wos[0].QtyIssued != 20 || len(wos[0].OutputLots) != 1 {
+		t.Fatalf("expected RES-1 lot issued to WO-PCA with one output lot, got %+v", wos)
+	}
+	next := wos[0].OutputLots[0].WorkOrders
+	if len(next) != 1 || next[0].WOID != "WO-ASY" || len(next[0].Serials) != 1 {
+		t.Fatalf("expected PCA-1 lot issued to WO-ASY with one serial, got %+v", next)
+	}
+	if sn := next[0].Serials[0]; sn.SerialNumber != "SN-0001" || len(sn.Shipments) != 1 || sn.Shipments[0].ShipmentID != "SHP-1" {
+		t.Errorf("expected SN-0001 shipped on SHP-1, got %+v", sn)
+	}
+
+	w = httptest.NewRecorder()
+	handleTraceSerial(w, httptest.NewRequest("GET", "/api/v1/serials/SN-0001/trace", nil), "SN-0001")
+	if w.Code != 200 {
+		t.Fatalf("serial trace failed: %d %s", w.Code, w.Body.String())
+	}
+	var back struct {
+		Data struct {
+			Trace WOTrace `json:"trace"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &back)
+	mats := back.Data.Trace.Materials
+	if len(mats) != 1 || mats[0].IPN != "PCA-1" || mats[0].ProducedBy == nil {
+		t.Fatalf("expected PCA-1 built by a WO, got %+v", mats)
+	}
+	sub := mats[0].ProducedBy.Materials
+	if len(sub) != 1 || sub[0].LotNumber != "MR-55" || sub[0].VendorName != "Mouser" || sub[0].Qty != 20 {
+		t.Errorf("expected 20 RES-1 from Mouser lot MR-55, got %+v", sub)
+	}
+
+	w = httptest.NewRecorder()
+	handleTraceSerial(w, httptest.NewRequest("GET", "/api/v1/serials/NOPE/trace", nil), "NOPE")
+	if w.Code != 404 {
+		t.Errorf("expected 404 for unknown serial, got %d", w.Code)
+	}
+}
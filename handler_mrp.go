@@ -0,0 +1,952 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MRPRun is one stored planning run. Requirements and planned orders are kept
+// per run so successive runs can be compared.
+type MRPRun struct {
+	ID                  int     `json:"id"`
+	Status              string  `json:"status"`
+	Trigger             string  `json:"trigger"`
+	HorizonDays         int     `json:"horizon_days"`
+	DefaultLeadTimeDays int     `json:"default_lead_time_days"`
+	Notes               string  `json:"notes"`
+	CreatedBy           string  `json:"created_by"`
+	StartedAt           string  `json:"started_at"`
+	CompletedAt         *string `json:"completed_at"`
+	ItemCount           int     `json:"item_count"`
+	PlannedPOCount      int     `json:"planned_po_count"`
+	PlannedWOCount      int     `json:"planned_wo_count"`
+	Error               string  `json:"error,omitempty"`
+}
+
+// MRPRequirement is one time-phased bucket of an item in a run.
+type MRPRequirement struct {
+	IPN               string  `json:"ipn"`
+	Period            string  `json:"period"`
+	GrossReq          float64 `json:"gross_req"`
+	ScheduledReceipts float64 `json:"scheduled_receipts"`
+	ProjectedOnHand   float64 `json:"projected_on_hand"`
+	NetReq            float64 `json:"net_req"`
+	PlannedReceipt    float64 `json:"planned_receipt"`
+	PlannedRelease    string  `json:"planned_release"`
+}
+
+// MRPPlannedOrder is a planned PO (buy item) or planned WO (make item).
+// Firming turns planned POs into pending po_suggestions and planned WOs into
+// draft work orders.
+type MRPPlannedOrder struct {
+	ID           int     `json:"id"`
+	RunID        int     `json:"run_id"`
+	OrderType    string  `json:"order_type"`
+	IPN          string  `json:"ipn"`
+	Qty          float64 `json:"qty"`
+	ReleaseDate  string  `json:"release_date"`
+	DueDate      string  `json:"due_date"`
+	VendorID     string  `json:"vendor_id"`
+	UnitPrice    float64 `json:"unit_price"`
+	Status       string  `json:"status"`
+	SuggestionID *int    `json:"suggestion_id"`
+	WOID         string  `json:"wo_id"`
+	Notes        string  `json:"notes"`
+}
+
+// MRPItemSetting overrides planning parameters for one IPN. Without a row,
+// safety stock is the inventory reorder point and the reorder qty is used as
+// a minimum lot.
+type MRPItemSetting struct {
+	IPN          string   `json:"ipn"`
+	LotSizing    string   `json:"lot_sizing"`
+	LotQty       float64  `json:"lot_qty"`
+	LeadTimeDays *int     `json:"lead_time_days"`
+	SafetyStock  *float64 `json:"safety_stock"`
+}
+
+var validLotSizing = []string{"lot_for_lot", "fixed", "min"}
+
+const (
+	mrpDateFormat          = "2006-01-02"
+	mrpDefaultHorizonDays  = 90
+	mrpDefaultLeadTimeDays = 7
+)
+
+// mrpMu keeps on-demand and scheduled runs from overlapping.
+var mrpMu sync.Mutex
+
+type mrpOptions struct {
+	HorizonDays         int
+	DefaultLeadTimeDays int
+	Notes               string
+	Trigger             string
+	CreatedBy           string
+}
+
+type mrpItem struct {
+	ipn       string
+	onHand    float64
+	safety    float64
+	lotSizing string
+	lotQty    float64
+	leadTime  int
+	children  []BOMNode
+	llc       int
+	gross     map[string]float64
+	sched     map[string]float64
+	vendorID  string
+	unitPrice float64
+}
+
+func (it *mrpItem) isMake() bool { return len(it.children) > 0 }
+
+// mrpLotSize rounds a net requirement up to an order quantity.
+func mrpLotSize(method string, lotQty, net float64) float64 {
+	qty := math.Ceil(net - 1e-9)
+	switch method {
+	case "fixed":
+		if lotQty > 0 {
+			return math.Ceil(net/lotQty-1e-9) * lotQty
+		}
+	case "min":
+		if qty < lotQty {
+			return lotQty
+		}
+	}
+	return qty
+}
+
+// planMRP nets demand against on-hand and scheduled receipts for every item
+// touched by demand, supply or a reorder point. Items are planned in
+// low-level-code order so a planned WO's component demand lands on its
+// children before they are netted.
+func planMRP(opts mrpOptions, today time.Time) ([]MRPRequirement, []MRPPlannedOrder, error) {
+	todayS := today.Format(mrpDateFormat)
+	horizonEnd := today.AddDate(0, 0, opts.HorizonDays).Format(mrpDateFormat)
+	// Past-due dates plan as today; anything beyond the horizon is ignored
+	bucket := func(d string) (string, bool) {
+		if len(d) > 10 {
+			d = d[:10]
+		}
+		if d == "" || d < todayS {
+			return todayS, true
+		}
+		return d, d <= horizonEnd
+	}
+
+	type invRow struct{ onHand, reorderPoint, reorderQty float64 }
+	inv := map[string]invRow{}
+	rows, err := db.Query("SELECT ipn, qty_on_hand, reorder_point, reorder_qty FROM inventory")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load inventory: %w", err)
+	}
+	for rows.Next() {
+		var ipn string
+		var v invRow
+		rows.Scan(&ipn, &v.onHand, &v.reorderPoint, &v.reorderQty)
+		inv[ipn] = v
+	}
+	rows.Close()
+
+	settings := map[string]MRPItemSetting{}
+	list, err := loadMRPItemSettings()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, s := range list {
+		settings[s.IPN] = s
+	}
+
+	items := map[string]*mrpItem{}
+	get := func(ipn string) *mrpItem {
+		if it, ok := items[ipn]; ok {
+			return it
+		}
+		v := inv[ipn]
+		it := &mrpItem{ipn: ipn, onHand: v.onHand, safety: v.reorderPoint, leadTime: -1,
+			gross: map[string]float64{}, sched: map[string]float64{}}
+		if v.reorderQty > 0 {
+			it.lotSizing, it.lotQty = "min", v.reorderQty
+		}
+		if s, ok := settings[ipn]; ok {
+			it.lotSizing, it.lotQty = s.LotSizing, s.LotQty
+			if s.LeadTimeDays != nil {
+				it.leadTime = *s.LeadTimeDays
+			}
+			if s.SafetyStock != nil {
+				it.safety = *s.SafetyStock
+			}
+		}
+		if node, err := buildBOMTree(ipn, 0, 0); err == nil {
+			it.children = node.Children
+		}
+		items[ipn] = it
+		return it
+	}
+
+	for ipn, v := range inv {
+		if v.reorderPoint > 0 {
+			get(ipn)
+		}
+	}
+
+	// Independent demand: open sales order lines not yet shipped
+	rows, err = db.Query(`SELECT l.ipn, l.qty - l.qty_shipped FROM sales_order_lines l
+		JOIN sales_orders s ON s.id = l.sales_order_id
+		WHERE s.status IN ('confirmed','allocated','picked') AND l.qty > l.qty_shipped`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load sales demand: %w", err)
+	}
+	for rows.Next() {
+		var ipn string
+		var qty float64
+		rows.Scan(&ipn, &qty)
+		get(ipn).gross[todayS] += qty
+	}
+	rows.Close()
+
+	// Scheduled receipts: open PO lines by expected date
+	rows, err = db.Query(`SELECT l.ipn, l.qty_ordered - l.qty_received, COALESCE(p.expected_date,'') FROM po_lines l
+		JOIN purchase_orders p ON p.id = l.po_id
+		WHERE p.status IN ('draft','sent','confirmed','partial') AND l.qty_ordered > l.qty_received`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load open PO lines: %w", err)
+	}
+	for rows.Next() {
+		var ipn, expected string
+		var qty float64
+		rows.Scan(&ipn, &qty, &expected)
+		if d, ok := bucket(expected); ok {
+			get(ipn).sched[d] += qty
+		}
+	}
+	rows.Close()
+
+	// Open work orders receive their assembly and consume its components
+	type openWO struct {
+		id, ipn string
+		qty     float64
+		built   float64
+		due     string
+	}
+	var wos []openWO
+	rows, err = db.Query(`SELECT id, assembly_ipn, qty - COALESCE(qty_good,0), COALESCE(qty_good,0) + COALESCE(qty_scrap,0),
+		COALESCE(due_date,'') FROM work_orders WHERE status IN ('draft','open','in_progress','on_hold')`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load open work orders: %w", err)
+	}
+	for rows.Next() {
+		var wo openWO
+		rows.Scan(&wo.id, &wo.ipn, &wo.qty, &wo.built, &wo.due)
+		wos = append(wos, wo)
+	}
+	rows.Close()
+
+	// Components already issued or picked to a WO have left on-hand, so
+	// what isn't used by the units built yet is netted off its demand
+	type woPart struct{ wo, ipn string }
+	issued := map[woPart]float64{}
+	rows, err = db.Query(`SELECT t.reference, t.ipn, SUM(CASE t.type WHEN 'issue' THEN t.qty ELSE -t.qty END)
+		FROM inventory_transactions t JOIN work_orders w ON w.id = t.reference
+		WHERE w.status IN ('draft','open','in_progress','on_hold') AND t.type IN ('issue','return')
+		GROUP BY t.reference, t.ipn`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load work order issues: %w", err)
+	}
+	for rows.Next() {
+		var k woPart
+		var qty float64
+		rows.Scan(&k.wo, &k.ipn, &qty)
+		issued[k] = qty
+	}
+	rows.Close()
+
+	for _, wo := range wos {
+		d, ok := bucket(wo.due)
+		if !ok || wo.qty <= 0 {
+			continue
+		}
+		it := get(wo.ipn)
+		it.sched[d] += wo.qty
+		for _, c := range it.children {
+			need := wo.qty * c.Qty
+			if wip := issued[woPart{wo.id, c.IPN}] - wo.built*c.Qty; wip > 0 {
+				need -= wip
+			}
+			child := get(c.IPN)
+			if need > 0 {
+				child.gross[d] += need
+			}
+		}
+	}
+
+	// Low-level codes: an item is planned only after every assembly using it
+	var walk func(it *mrpItem, level int)
+	walk = func(it *mrpItem, level int) {
+		if level > 20 {
+			return
+		}
+		if level > it.llc {
+			it.llc = level
+		}
+		for _, c := range it.children {
+			child := get(c.IPN)
+			if level+1 > child.llc {
+				walk(child, level+1)
+			}
+		}
+	}
+	roots := make([]string, 0, len(items))
+	for ipn := range items {
+		roots = append(roots, ipn)
+	}
+	sort.Strings(roots)
+	for _, ipn := range roots {
+		walk(items[ipn], items[ipn].llc)
+	}
+
+	ordered := make([]*mrpItem, 0, len(items))
+	for _, it := range items {
+		ordered = append(ordered, it)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		if ordered[i].llc != ordered[j].llc {
+			return ordered[i].llc < ordered[j].llc
+		}
+		return ordered[i].ipn < ordered[j].ipn
+	})
+
+	var reqs []MRPRequirement
+	var planned []MRPPlannedOrder
+	for _, it := range ordered {
+		leadTime := it.leadTime
+		if !it.isMake() {
+			var vendorID sql.NullString
+			var price float64
+			var phLead sql.NullInt64
+			err := db.QueryRow(`SELECT vendor_id, unit_price, lead_time_days FROM price_history
+				WHERE ipn=? AND COALESCE(vendor_id,'') != '' ORDER BY recorded_at DESC, id DESC LIMIT 1`, it.ipn).
+				Scan(&vendorID, &price, &phLead)
+			if err == nil {
+				it.vendorID, it.unitPrice = vendorID.String, price
+				if leadTime < 0 && phLead.Int64 > 0 {
+					leadTime = int(phLead.Int64)
+				}
+				if leadTime < 0 {
+					var vLead int
+					db.QueryRow("SELECT COALESCE(lead_time_days,0) FROM vendors WHERE id=?", it.vendorID).Scan(&vLead)
+					if vLead > 0 {
+						leadTime = vLead
+					}
+				}
+			}
+		}
+		if leadTime < 0 {
+			leadTime = opts.DefaultLeadTimeDays
+		}
+
+		dates := []string{todayS}
+		for d := range it.gross {
+			if d != todayS {
+				dates = append(dates, d)
+			}
+		}
+		for d := range it.sched {
+			if _, dup := it.gross[d]; !dup && d != todayS {
+				dates = append(dates, d)
+			}
+		}
+		sort.Strings(dates)
+
+		poh := it.onHand
+		for _, d := range dates {
+			req := MRPRequirement{IPN: it.ipn, Period: d, GrossReq: it.gross[d], ScheduledReceipts: it.sched[d]}
+			poh += req.ScheduledReceipts - req.GrossReq
+			if poh < it.safety-1e-9 {
+				req.NetReq = it.safety - poh
+				req.PlannedReceipt = mrpLotSize(it.lotSizing, it.lotQty, req.NetReq)
+				poh += req.PlannedReceipt
+
+				due, _ := time.ParseInLocation(mrpDateFormat, d, today.Location())
+				release := due.AddDate(0, 0, -leadTime).Format(mrpDateFormat)
+				notes := ""
+				if release < todayS {
+					release = todayS
+					notes = fmt.Sprintf("Late: %d day lead time cannot be met", leadTime)
+				}
+				req.PlannedRelease = release
+
+				po := MRPPlannedOrder{OrderType: "po", IPN: it.ipn, Qty: req.PlannedReceipt, ReleaseDate: release,
+					DueDate: d, VendorID: it.vendorID, UnitPrice: it.unitPrice, Status: "planned", Notes: notes}
+				if it.isMake() {
+					po.OrderType, po.VendorID = "wo", ""
+					// Components are needed when the planned WO is released
+					for _, c := range it.children {
+						items[c.IPN].gross[release] += req.PlannedReceipt * c.Qty
+					}
+				}
+				planned = append(planned, po)
+			}
+			req.ProjectedOnHand = poh
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs, planned, nil
+}
+
+// runMRP plans and stores a run, returning its ID. A failed plan is still
+// recorded so the run history shows it.
+func runMRP(opts mrpOptions, today time.Time) (int, error) {
+	mrpMu.Lock()
+	defer mrpMu.Unlock()
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	res, err := db.Exec(`INSERT INTO mrp_runs (status, trigger_type, horizon_days, default_lead_time_days, notes, created_by, started_at)
+		VALUES ('running',?,?,?,?,?,?)`, opts.Trigger, opts.HorizonDays, opts.DefaultLeadTimeDays, opts.Notes, opts.CreatedBy, now)
+	if err != nil {
+		return 0, err
+	}
+	id64, _ := res.LastInsertId()
+	runID := int(id64)
+
+	fail := func(err error) (int, error) {
+		db.Exec("UPDATE mrp_runs SET status='failed', error=?, completed_at=? WHERE id=?",
+			err.Error(), time.Now().Format("2006-01-02 15:04:05"), runID)
+		return runID, err
+	}
+
+	reqs, planned, err := planMRP(opts, today)
+	if err != nil {
+		return fail(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+	itemSet := map[string]bool{}
+	for _, rq := range reqs {
+		itemSet[rq.IPN] = true
+		_, err := tx.Exec(`INSERT INTO mrp_requirements (run_id, ipn, period, gross_req, scheduled_receipts, projected_on_hand, net_req, planned_receipt, planned_release)
+			VALUES (?,?,?,?,?,?,?,?,?)`, runID, rq.IPN, rq.Period, rq.GrossReq, rq.ScheduledReceipts, rq.ProjectedOnHand, rq.NetReq, rq.PlannedReceipt, rq.PlannedRelease)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	poCount, woCount := 0, 0
+	for _, p := range planned {
+		if p.OrderType == "wo" {
+			woCount++
+		} else {
+			poCount++
+		}
+		_, err := tx.Exec(`INSERT INTO mrp_planned_orders (run_id, order_type, ipn, qty, release_date, due_date, vendor_id, unit_price, notes)
+			VALUES (?,?,?,?,?,?,?,?,?)`, runID, p.OrderType, p.IPN, p.Qty, p.ReleaseDate, p.DueDate, p.VendorID, p.UnitPrice, p.Notes)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	_, err = tx.Exec(`UPDATE mrp_runs SET status='completed', completed_at=?, item_count=?, planned_po_count=?, planned_wo_count=? WHERE id=?`,
+		time.Now().Format("2006-01-02 15:04:05"), len(itemSet), poCount, woCount, runID)
+	if err != nil {
+		return fail(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fail(err)
+	}
+	logAudit(db, opts.CreatedBy, "created", "mrp_run", strconv.Itoa(runID),
+		fmt.Sprintf("MRP run #%d: %d planned POs, %d planned WOs", runID, poCount, woCount))
+	return runID, nil
+}
+
+// startMRPScheduler runs MRP once a day at runTime (HH:MM). Scheduled runs
+// are off unless ZRP_MRP_TIME is set.
+func startMRPScheduler(runTime string) {
+	if runTime == "" {
+		return
+	}
+	err := runDaily(runTime, func() {
+		log.Println("Running scheduled MRP...")
+		id, err := runMRP(mrpOptions{HorizonDays: mrpDefaultHorizonDays, DefaultLeadTimeDays: mrpDefaultLeadTimeDays,
+			Trigger: "scheduled", CreatedBy: "system"}, time.Now())
+		if err != nil {
+			log.Printf("Scheduled MRP run failed: %v", err)
+		} else {
+			log.Printf("Scheduled MRP run #%d completed", id)
+		}
+	})
+	if err != nil {
+		log.Printf("ZRP_MRP_TIME: %v; scheduled MRP runs are off", err)
+	}
+}
+
+const mrpRunColumns = `id, status, trigger_type, horizon_days, default_lead_time_days, COALESCE(notes,''), COALESCE(created_by,''),
+	started_at, completed_at, item_count, planned_po_count, planned_wo_count, COALESCE(error,'')`
+
+func scanMRPRun(row interface{ Scan(...interface{}) error }) (MRPRun, error) {
+	var run MRPRun
+	var ca sql.NullString
+	err := row.Scan(&run.ID, &run.Status, &run.Trigger, &run.HorizonDays, &run.DefaultLeadTimeDays, &run.Notes, &run.CreatedBy,
+		&run.StartedAt, &ca, &run.ItemCount, &run.PlannedPOCount, &run.PlannedWOCount, &run.Error)
+	run.CompletedAt = sp(ca)
+	return run, err
+}
+
+func loadMRPPlannedOrders(where string, args ...interface{}) ([]MRPPlannedOrder, error) {
+	rows, err := db.Query(`SELECT id, run_id, order_type, ipn, qty, release_date, due_date, COALESCE(vendor_id,''), unit_price,
+		status, suggestion_id, COALESCE(wo_id,''), COALESCE(notes,'') FROM mrp_planned_orders WHERE `+where+` ORDER BY due_date, ipn, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []MRPPlannedOrder{}
+	for rows.Next() {
+		var p MRPPlannedOrder
+		var sid sql.NullInt64
+		if err := rows.Scan(&p.ID, &p.RunID, &p.OrderType, &p.IPN, &p.Qty, &p.ReleaseDate, &p.DueDate, &p.VendorID, &p.UnitPrice,
+			&p.Status, &sid, &p.WOID, &p.Notes); err != nil {
+			return nil, err
+		}
+		if sid.Valid {
+			v := int(sid.Int64)
+			p.SuggestionID = &v
+		}
+		items = append(items, p)
+	}
+	return items, rows.Err()
+}
+
+func loadMRPItemSettings() ([]MRPItemSetting, error) {
+	rows, err := db.Query("SELECT ipn, lot_sizing, lot_qty, lead_time_days, safety_stock FROM mrp_item_settings ORDER BY ipn")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load MRP item settings: %w", err)
+	}
+	defer rows.Close()
+	items := []MRPItemSetting{}
+	for rows.Next() {
+		var s MRPItemSetting
+		var lead sql.NullInt64
+		var safety sql.NullFloat64
+		rows.Scan(&s.IPN, &s.LotSizing, &s.LotQty, &lead, &safety)
+		if lead.Valid {
+			v := int(lead.Int64)
+			s.LeadTimeDays = &v
+		}
+		if safety.Valid {
+			v := safety.Float64
+			s.SafetyStock = &v
+		}
+		items = append(items, s)
+	}
+	return items, rows.Err()
+}
+
+func handleCreateMRPRun(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		HorizonDays         int    `json:"horizon_days"`
+		DefaultLeadTimeDays *int   `json:"default_lead_time_days"`
+		Notes               string `json:"notes"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	opts := mrpOptions{HorizonDays: body.HorizonDays, DefaultLeadTimeDays: mrpDefaultLeadTimeDays,
+		Notes: body.Notes, Trigger: "manual", CreatedBy: getUsername(r)}
+	if opts.HorizonDays == 0 {
+		opts.HorizonDays = mrpDefaultHorizonDays
+	}
+	if body.DefaultLeadTimeDays != nil {
+		opts.DefaultLeadTimeDays = *body.DefaultLeadTimeDays
+	}
+
+	ve := &ValidationErrors{}
+	validateIntRange(ve, "horizon_days", opts.HorizonDays, 1, 730)
+	validateIntRange(ve, "default_lead_time_days", opts.DefaultLeadTimeDays, 0, 365)
+	validateMaxLength(ve, "notes", opts.Notes, 1000)
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	id, err := runMRP(opts, time.Now())
+	if err != nil {
+		jsonErr(w, "MRP run failed: "+err.Error(), 500)
+		return
+	}
+	handleGetMRPRun(w, r, strconv.Itoa(id))
+}
+
+func handleListMRPRuns(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT " + mrpRunColumns + " FROM mrp_runs ORDER BY id DESC LIMIT 100")
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	items := []MRPRun{}
+	for rows.Next() {
+		run, err := scanMRPRun(rows)
+		if err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		items = append(items, run)
+	}
+	jsonResp(w, items)
+}
+
+// handleGetMRPRun returns a run with its planned orders and time-phased
+// requirements. ?ipn= narrows both to one item.
+func handleGetMRPRun(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		jsonErr(w, "invalid run id", 400)
+		return
+	}
+	run, err := scanMRPRun(db.QueryRow("SELECT "+mrpRunColumns+" FROM mrp_runs WHERE id=?", id))
+	if err == sql.ErrNoRows {
+		jsonErr(w, "MRP run not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+
+	where, args := "run_id=?", []interface{}{id}
+	if ipn := r.URL.Query().Get("ipn"); ipn != "" {
+		where += " AND ipn=?"
+		args = append(args, ipn)
+	}
+	orders, err := loadMRPPlannedOrders(where, args...)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+
+	rows, err := db.Query(`SELECT ipn, period, gross_req, scheduled_receipts, projected_on_hand, net_req, planned_receipt, COALESCE(planned_release,'')
+		FROM mrp_requirements WHERE `+where+` ORDER BY ipn, period`, args...)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	reqs := []MRPRequirement{}
+	for rows.Next() {
+		var rq MRPRequirement
+		rows.Scan(&rq.IPN, &rq.Period, &rq.GrossReq, &rq.ScheduledReceipts, &rq.ProjectedOnHand, &rq.NetReq, &rq.PlannedReceipt, &rq.PlannedRelease)
+		reqs = append(reqs, rq)
+	}
+
+	jsonResp(w, map[string]interface{}{
+		"run":            run,
+		"planned_orders": orders,
+		"requirements":   reqs,
+	})
+}
+
+// MRPCompareRow is the planned quantity of one item and order type in two runs.
+type MRPCompareRow struct {
+	IPN             string  `json:"ipn"`
+	OrderType       string  `json:"order_type"`
+	BaseQty         float64 `json:"base_qty"`
+	CompareQty      float64 `json:"compare_qty"`
+	Delta           float64 `json:"delta"`
+	BaseFirstDue    string  `json:"base_first_due"`
+	CompareFirstDue string  `json:"compare_first_due"`
+	Change          string  `json:"change"`
+}
+
+// handleCompareMRPRuns diffs the planned orders of run id against ?with=.
+func handleCompareMRPRuns(w http.ResponseWriter, r *http.Request, idStr string) {
+	baseID, err := strconv.Atoi(idStr)
+	if err != nil {
+		jsonErr(w, "invalid run id", 400)
+		return
+	}
+	withID, err := strconv.Atoi(r.URL.Query().Get("with"))
+	if err != nil {
+		jsonErr(w, "with must be the ID of the run to compare against", 400)
+		return
+	}
+	for _, id := range []int{baseID, withID} {
+		var n int
+		db.QueryRow("SELECT COUNT(*) FROM mrp_runs WHERE id=?", id).Scan(&n)
+		if n == 0 {
+			jsonErr(w, fmt.Sprintf("MRP run %d not found", id), 404)
+			return
+		}
+	}
+
+	rows, err := db.Query(`SELECT run_id, ipn, order_type, SUM(qty), MIN(due_date) FROM mrp_planned_orders
+		WHERE run_id IN (?,?) AND status != 'cancelled' GROUP BY run_id, ipn, order_type`, baseID, withID)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	byKey := map[string]*MRPCompareRow{}
+	var keys []string
+	for rows.Next() {
+		var runID int
+		var ipn, orderType, due string
+		var qty float64
+		rows.Scan(&runID, &ipn, &orderType, &qty, &due)
+		key := orderType + "\x00" + ipn
+		row, ok := byKey[key]
+		if !ok {
+			row = &MRPCompareRow{IPN: ipn, OrderType: orderType}
+			byKey[key] = row
+			keys = append(keys, key)
+		}
+		if runID == baseID {
+			row.BaseQty, row.BaseFirstDue = qty, due
+		}
+		if runID == withID {
+			row.CompareQty, row.CompareFirstDue = qty, due
+		}
+	}
+	sort.Strings(keys)
+
+	items := []MRPCompareRow{}
+	for _, key := range keys {
+		row := byKey[key]
+		row.Delta = row.CompareQty - row.BaseQty
+		switch {
+		case row.BaseQty == 0:
+			row.Change = "added"
+		case row.CompareQty == 0:
+			row.Change = "removed"
+		case row.Delta != 0 || row.BaseFirstDue != row.CompareFirstDue:
+			row.Change = "changed"
+		default:
+			row.Change = "unchanged"
+		}
+		items = append(items, *row)
+	}
+	jsonResp(w, map[string]interface{}{"base_run_id": baseID, "compare_run_id": withID, "items": items})
+}
+
+// handleFirmMRPRun firms planned orders of a run. Planned POs are grouped by
+// vendor into pending po_suggestions for the usual review flow; planned WOs
+// become draft work orders with their routing operations. Without
+// planned_order_ids every still-planned order of the run is firmed.
+func handleFirmMRPRun(w http.ResponseWriter, r *http.Request, idStr string) {
+	runID, err := strconv.Atoi(idStr)
+	if err != nil {
+		jsonErr(w, "invalid run id", 400)
+		return
+	}
+	var body struct {
+		PlannedOrderIDs []int `json:"planned_order_ids"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	var status string
+	if err := db.QueryRow("SELECT status FROM mrp_runs WHERE id=?", runID).Scan(&status); err != nil {
+		jsonErr(w, "MRP run not found", 404)
+		return
+	}
+	if status != "completed" {
+		jsonErr(w, "only completed MRP runs can be firmed", 400)
+		return
+	}
+
+	where, args := "run_id=? AND status='planned'", []interface{}{runID}
+	if len(body.PlannedOrderIDs) > 0 {
+		where += " AND id IN (?" + strings.Repeat(",?", len(body.PlannedOrderIDs)-1) + ")"
+		for _, id := range body.PlannedOrderIDs {
+			args = append(args, id)
+		}
+	}
+	orders, err := loadMRPPlannedOrders(where, args...)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if len(orders) == 0 {
+		jsonErr(w, "no planned orders to firm", 400)
+		return
+	}
+
+	user := getUsername(r)
+	now := time.Now().Format("2006-01-02 15:04:05")
+	type skipped struct {
+		ID     int    `json:"id"`
+		IPN    string `json:"ipn"`
+		Reason string `json:"reason"`
+	}
+	skips := []skipped{}
+	suggestionIDs := []int{}
+	woIDs := []string{}
+
+	var vendors []string
+	byVendor := map[string][]MRPPlannedOrder{}
+	for _, p := range orders {
+		switch {
+		case p.OrderType == "wo":
+			woID := nextID("WO", "work_orders", 4)
+			tx, err := db.Begin()
+			if err != nil {
+				jsonErr(w, err.Error(), 500)
+				return
+			}
+			_, err = tx.Exec(`INSERT INTO work_orders (id,assembly_ipn,qty,status,priority,notes,due_date,created_at) VALUES (?,?,?,'draft','normal',?,?,?)`,
+				woID, p.IPN, int(math.Ceil(p.Qty)), fmt.Sprintf("Planned by MRP run #%d, release %s", runID, p.ReleaseDate), p.DueDate, now)
+			if err == nil {
+				_, err = instantiateWorkOrderOperations(tx, woID, p.IPN)
+			}
+			if err == nil {
+				_, err = tx.Exec("UPDATE mrp_planned_orders SET status='firmed', wo_id=? WHERE id=?", woID, p.ID)
+			}
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				tx.Rollback()
+				jsonErr(w, err.Error(), 500)
+				return
+			}
+			logAudit(db, user, "created", "workorder", woID, fmt.Sprintf("Created WO %s for %s from MRP run #%d", woID, p.IPN, runID))
+			woIDs = append(woIDs, woID)
+		case p.VendorID == "":
+			skips = append(skips, skipped{p.ID, p.IPN, "no vendor price history for this part"})
+		default:
+			if _, ok := byVendor[p.VendorID]; !ok {
+				vendors = append(vendors, p.VendorID)
+			}
+			byVendor[p.VendorID] = append(byVendor[p.VendorID], p)
+		}
+	}
+
+	for _, vendorID := range vendors {
+		tx, err := db.Begin()
+		if err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		res, err := tx.Exec(`INSERT INTO po_suggestions (wo_id, vendor_id, status, notes, created_at, mrp_run_id) VALUES ('', ?, 'pending', ?, ?, ?)`,
+			vendorID, fmt.Sprintf("Planned by MRP run #%d", runID), now, runID)
+		if err != nil {
+			tx.Rollback()
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		sid64, _ := res.LastInsertId()
+		for _, p := range byVendor[vendorID] {
+			var mpn string
+			tx.QueryRow("SELECT COALESCE(mpn,'') FROM inventory WHERE ipn=?", p.IPN).Scan(&mpn)
+			_, err = tx.Exec(`INSERT INTO po_suggestion_lines (suggestion_id, ipn, mpn, qty_needed, estimated_unit_price, notes) VALUES (?,?,?,?,?,?)`,
+				sid64, p.IPN, mpn, p.Qty, p.UnitPrice, fmt.Sprintf("Release %s, due %s", p.ReleaseDate, p.DueDate))
+			if err == nil {
+				_, err = tx.Exec("UPDATE mrp_planned_orders SET status='firmed', suggestion_id=? WHERE id=?", sid64, p.ID)
+			}
+			if err != nil {
+				tx.Rollback()
+				jsonErr(w, err.Error(), 500)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		logAudit(db, user, "created", "po_suggestion", strconv.FormatInt(sid64, 10),
+			fmt.Sprintf("Created PO suggestion #%d for %s from MRP run #%d", sid64, vendorID, runID))
+		suggestionIDs = append(suggestionIDs, int(sid64))
+	}
+
+	jsonResp(w, map[string]interface{}{
+		"run_id":         runID,
+		"suggestion_ids": suggestionIDs,
+		"wo_ids":         woIDs,
+		"skipped":        skips,
+	})
+}
+
+// handleCancelMRPPlannedOrder drops a planned order the planner won't act on.
+func handleCancelMRPPlannedOrder(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		jsonErr(w, "invalid planned order id", 400)
+		return
+	}
+	var status string
+	if err := db.QueryRow("SELECT status FROM mrp_planned_orders WHERE id=?", id).Scan(&status); err != nil {
+		jsonErr(w, "planned order not found", 404)
+		return
+	}
+	if status != "planned" {
+		jsonErr(w, "planned order is already "+status, 400)
+		return
+	}
+	if _, err := db.Exec("UPDATE mrp_planned_orders SET status='cancelled' WHERE id=?", id); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, getUsername(r), "cancelled", "mrp_planned_order", idStr, "Cancelled MRP planned order "+idStr)
+	orders, _ := loadMRPPlannedOrders("id=?", id)
+	jsonResp(w, orders[0])
+}
+
+func handleListMRPItemSettings(w http.ResponseWriter, r *http.Request) {
+	items, err := loadMRPItemSettings()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	jsonResp(w, items)
+}
+
+func handleUpdateMRPItemSetting(w http.ResponseWriter, r *http.Request, ipn string) {
+	var s MRPItemSetting
+	if err := decodeBody(r, &s); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	s.IPN = ipn
+	if s.LotSizing == "" {
+		s.LotSizing = "lot_for_lot"
+	}
+	ve := &ValidationErrors{}
+	validateEnum(ve, "lot_sizing", s.LotSizing, validLotSizing)
+	if s.LotQty < 0 {
+		ve.Add("lot_qty", "must be non-negative")
+	}
+	if s.LotSizing == "fixed" && s.LotQty <= 0 {
+		ve.Add("lot_qty", "required for fixed lot sizing")
+	}
+	if s.LeadTimeDays != nil {
+		validateIntRange(ve, "lead_time_days", *s.LeadTimeDays, 0, 365)
+	}
+	if s.SafetyStock != nil && *s.SafetyStock < 0 {
+		ve.Add("safety_stock", "must be non-negative")
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	_, err := db.Exec(`INSERT INTO mrp_item_settings (ipn, lot_sizing, lot_qty, lead_time_days, safety_stock) VALUES (?,?,?,?,?)
+		ON CONFLICT(ipn) DO UPDATE SET lot_sizing=excluded.lot_sizing, lot_qty=excluded.lot_qty,
+		lead_time_days=excluded.lead_time_days, safety_stock=excluded.safety_stock`,
+		s.IPN, s.LotSizing, s.LotQty, s.LeadTimeDays, s.SafetyStock)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, getUsername(r), "updated", "mrp_item_setting", ipn, "Updated MRP settings for "+ipn)
+	jsonResp(w, s)
+}
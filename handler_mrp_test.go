@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var mrpTestToday = time.Date(2026, 3, 2, 0, 0, 0, 0, time.Local)
+
+// seedMRPScenario sets up ASY-100 -> PCA-200 -> RES-1/CAP-1 with sales
+// demand for ASY-100, an open WO for PCA-200 and an open PO for RES-1.
+func seedMRPScenario(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	partsDir = dir
+	createBOMFile(t, dir, "ASY-100", [][]string{{"IPN", "Qty"}, {"PCA-200", "1"}, {"SCR-1", "4"}})
+	createBOMFile(t, dir, "PCA-200", [][]string{{"IPN", "Qty"}, {"RES-1", "10"}, {"CAP-1", "2"}})
+
+	stmts := []string{
+		`INSERT INTO inventory (ipn, qty_on_hand, reorder_point, reorder_qty) VALUES ('PCA-200', 2, 0, 0)`,
+		`INSERT INTO inventory (ipn, qty_on_hand, reorder_point, reorder_qty) VALUES ('RES-1', 50, 0, 0)`,
+		`INSERT INTO inventory (ipn, qty_on_hand, reorder_point, reorder_qty) VALUES ('CAP-1', 0, 100, 500)`,
+		`INSERT INTO inventory (ipn, qty_on_hand, reorder_point, reorder_qty) VALUES ('SCR-1', 1000, 0, 0)`,
+		`INSERT INTO vendors (id, name, lead_time_days) VALUES ('V-001', 'Digikey', 10)`,
+		`INSERT INTO price_history (ipn, vendor_id, unit_price, lead_time_days) VALUES ('RES-1', 'V-001', 0.01, 5)`,
+		`INSERT INTO price_history (ipn, vendor_id, unit_price) VALUES ('CAP-1', 'V-001', 0.05)`,
+		`INSERT INTO sales_orders (id, customer, status) VALUES ('SO-1', 'Acme', 'confirmed')`,
+		`INSERT INTO sales_order_lines (sales_order_id, ipn, qty) VALUES ('SO-1', 'ASY-100', 10)`,
+		`INSERT INTO work_orders (id, assembly_ipn, qty, status, due_date) VALUES ('WO-M1', 'PCA-200', 5, 'open', '2026-03-10')`,
+		`INSERT INTO purchase_orders (id, vendor_id, status, expected_date) VALUES ('PO-M1', 'V-001', 'sent', '2026-03-20')`,
+		`INSERT INTO po_lines (po_id, ipn, qty_ordered) VALUES ('PO-M1', 'RES-1', 30)`,
+		`INSERT INTO mrp_item_settings (ipn, lot_sizing, lot_qty, lead_time_days) VALUES ('ASY-100', 'fixed', 4, 2)`,
+		`INSERT INTO mrp_item_settings (ipn, lot_sizing, lead_time_days) VALUES ('PCA-200', 'lot_for_lot', 3)`,
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("seed failed: %v\n%s", err, s)
+		}
+	}
+}
+
+func runTestMRP(t *testing.T) int {
+	t.Helper()
+	id, err := runMRP(mrpOptions{HorizonDays: 90, DefaultLeadTimeDays: 7, Trigger: "manual", CreatedBy: "planner"}, mrpTestToday)
+	if err != nil {
+		t.Fatalf("MRP run failed: %v", err)
+	}
+	return id
+}
+
+func TestMRPLotSize(t *testing.T) {
+	tests := []struct {
+		method string
+		lotQty float64
+		net    float64
+		want   float64
+	}{
+		{"lot_for_lot", 0, 7.2, 8},
+		{"", 0, 5, 5},
+		{"fixed", 4, 10, 12},
+		{"fixed", 4, 8, 8},
+		{"min", 500, 120, 500},
+		{"min", 50, 120, 120},
+	}
+	for _, tt := range tests {
+		if got := mrpLotSize(tt.method, tt.lotQty, tt.net); got != tt.want {
+			t.Errorf("mrpLotSize(%q, %v, %v) = %v, want %v", tt.method, tt.lotQty, tt.net, got, tt.want)
+		}
+	}
+}
+
+func TestMRPRun_PlansThroughBOM(t *testing.T) {
+	oldDB, oldPartsDir := db, partsDir
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB; partsDir = oldPartsDir }()
+	seedMRPScenario(t)
+
+	runID := runTestMRP(t)
+	orders, err := loadMRPPlannedOrders("run_id=?", runID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type key struct{ ipn, due string }
+	got := map[key]MRPPlannedOrder{}
+	for _, p := range orders {
+		got[key{p.IPN, p.DueDate}] = p
+	}
+	expect := []struct {
+		ipn, orderType, due, release string
+		qty                          float64
+	}{
+		// 10 short, fixed lots of 4
+		{"ASY-100", "wo", "2026-03-02", "2026-03-02", 12},
+		// 12 for the planned ASY WO less 2 on hand
+		{"PCA-200", "wo", "2026-03-02", "2026-03-02", 10},
+		// 100 for the planned PCA WO less 50 on hand
+		{"RES-1", "po", "2026-03-02", "2026-03-02", 50},
+		// 50 for the open PCA WO; the PO due 03-20 arrives too late
+		{"RES-1", "po", "2026-03-10", "2026-03-05", 50},
+		// back up to the 100 reorder point, 500 minimum lot
+		{"CAP-1", "po", "2026-03-02", "2026-03-02", 500},
+	}
+	if len(orders) != len(expect) {
+		t.Errorf("expected %d planned orders, got %d: %+v", len(expect), len(orders), orders)
+	}
+	for _, e := range expect {
+		p, ok := got[key{e.ipn, e.due}]
+		if !ok {
+			t.Errorf("missing planned order for %s due %s", e.ipn, e.due)
+			continue
+		}
+		if p.OrderType != e.orderType || p.Qty != e.qty || p.ReleaseDate != e.release {
+			t.Errorf("%s due %s: expected %s qty %v release %s, got %+v", e.ipn, e.due, e.orderType, e.qty, e.release, p)
+		}
+	}
+	if p := got[key{"RES-1", "2026-03-10"}]; p.VendorID != "V-001" || p.UnitPrice != 0.01 {
+		t.Errorf("expected RES-1 sourced from V-001 at 0.01, got %+v", p)
+	}
+
+	var run MRPRun
+	run, err = scanMRPRun(db.QueryRow("SELECT "+mrpRunColumns+" FROM mrp_runs WHERE id=?", runID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != "completed" || run.PlannedPOCount != 3 || run.PlannedWOCount != 2 || run.ItemCount != 5 {
+		t.Errorf("unexpected run summary: %+v", run)
+	}
+
+	// The open PO still shows up as a scheduled receipt on its own date
+	var poh float64
+	db.QueryRow("SELECT projected_on_hand FROM mrp_requirements WHERE run_id=? AND ipn='RES-1' AND period='2026-03-20'", runID).Scan(&poh)
+	if poh != 30 {
+		t.Errorf("expected RES-1 projected on hand 30 on 2026-03-20, got %v", poh)
+	}
+}
+
+func TestMRPRun_NetsWOIssues(t *testing.T) {
+	oldDB, oldPartsDir := db, partsDir
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB; partsDir = oldPartsDir }()
+	seedMRPScenario(t)
+
+	// 35 RES-1 went to the open PCA WO and 5 came back: 30 of its 50 are
+	// in WIP and no longer on hand
+	for _, s := range []string{
+		`UPDATE inventory SET qty_on_hand = 20 WHERE ipn='RES-1'`,
+		`INSERT INTO inventory_transactions (ipn, type, qty, reference) VALUES ('RES-1', 'issue', 35, 'WO-M1'), ('RES-1', 'return', 5, 'WO-M1')`,
+	} {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("seed failed: %v\n%s", err, s)
+		}
+	}
+	orders, err := loadMRPPlannedOrders("run_id=? AND ipn='RES-1'", runTestMRP(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	for _, p := range orders {
+		got[p.DueDate] = p.Qty
+	}
+	// 100 for the planned PCA WO less 20 on hand; 20 still to issue to WO-M1
+	if len(got) != 2 || got["2026-03-02"] != 80 || got["2026-03-10"] != 20 {
+		t.Errorf("expected RES-1 orders of 80 and 20, got %+v", got)
+	}
+}
+
+func TestMRPFirmAndCompare(t *testing.T) {
+	oldDB, oldPartsDir := db, partsDir
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB; partsDir = oldPartsDir }()
+	seedMRPScenario(t)
+
+	run1 := strconv.Itoa(runTestMRP(t))
+	w := httptest.NewRecorder()
+	handleFirmMRPRun(w, httptest.NewRequest("POST", "/api/v1/mrp/runs/"+run1+"/firm", bytes.NewBufferString(`{}`)), run1)
+	if w.Code != 200 {
+		t.Fatalf("firm failed: %d %s", w.Code, w.Body.String())
+	}
+	var firm struct {
+		Data struct {
+			SuggestionIDs []int    `json:"suggestion_ids"`
+			WOIDs         []string `json:"wo_ids"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &firm)
+	if len(firm.Data.SuggestionIDs) != 1 || len(firm.Data.WOIDs) != 2 {
+		t.Fatalf("expected 1 suggestion and 2 WOs, got %+v", firm.Data)
+	}
+	var status, due string
+	db.QueryRow("SELECT status, due_date FROM work_orders WHERE assembly_ipn='ASY-100'").Scan(&status, &due)
+	if status != "draft" || due != "2026-03-02" {
+		t.Errorf("expected draft ASY-100 WO due 2026-03-02, got %s %s", status, due)
+	}
+
+	// Firming twice has nothing left to do
+	w = httptest.NewRecorder()
+	handleFirmMRPRun(w, httptest.NewRequest("POST", "/api/v1/mrp/runs/"+run1+"/firm", bytes.NewBufferString(`{}`)), run1)
+	if w.Code != 400 {
+		t.Errorf("expected 400 firming an already firmed run, got %d", w.Code)
+	}
+
+	// The suggestion goes through the existing review flow
+	w = httptest.NewRecorder()
+	handleListPOSuggestions(w, httptest.NewRequest("GET", "/api/v1/pos/suggestions?mrp_run_id="+run1, nil))
+	var list struct {
+		Data []POSuggestion `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Data) != 1 || len(list.Data[0].Lines) != 3 {
+		t.Fatalf("expected 1 suggestion with 3 lines, got %+v", list.Data)
+	}
+	sid := list.Data[0].ID
+	w = httptest.NewRecorder()
+	handleReviewPOSuggestion(w, httptest.NewRequest("POST", "/api/v1/pos/suggestions/"+strconv.Itoa(sid)+"/review",
+		bytes.NewBufferString(`{"status":"approved","create_po":true}`)), sid)
+	if w.Code != 200 {
+		t.Fatalf("review failed: %d %s", w.Code, w.Body.String())
+	}
+	var lineCount int
+	db.QueryRow("SELECT COUNT(*) FROM po_lines l JOIN po_suggestions s ON s.po_id = l.po_id WHERE s.id=?", sid).Scan(&lineCount)
+	if lineCount != 3 {
+		t.Errorf("expected 3 PO lines from the approved suggestion, got %d", lineCount)
+	}
+
+	// With the firmed WOs and PO as supply the next run plans nothing
+	run2 := strconv.Itoa(runTestMRP(t))
+	w = httptest.NewRecorder()
+	handleCompareMRPRuns(w, httptest.NewRequest("GET", "/api/v1/mrp/runs/"+run1+"/compare?with="+run2, nil), run1)
+	if w.Code != 200 {
+		t.Fatalf("compare failed: %d %s", w.Code, w.Body.String())
+	}
+	var cmp struct {
+		Data struct {
+			Items []MRPCompareRow `json:"items"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &cmp)
+	if len(cmp.Data.Items) != 4 {
+		t.Fatalf("expected 4 compared items, got %+v", cmp.Data.Items)
+	}
+	for _, row := range cmp.Data.Items {
+		if row.Change != "removed" || row.CompareQty != 0 {
+			t.Errorf("expected %s %s removed in the second run, got %+v", row.OrderType, row.IPN, row)
+		}
+	}
+}
+
+func TestMRPValidation(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+
+	tests := []struct {
+		name string
+		call func(w *httptest.ResponseRecorder)
+		code int
+	}{
+		{"horizon out of range", func(w *httptest.ResponseRecorder) {
+			handleCreateMRPRun(w, httptest.NewRequest("POST", "/api/v1/mrp/runs", bytes.NewBufferString(`{"horizon_days":-5}`)))
+		}, 400},
+		{"fixed lot without qty", func(w *httptest.ResponseRecorder) {
+			handleUpdateMRPItemSetting(w, httptest.NewRequest("PUT", "/api/v1/mrp/settings/RES-1", bytes.NewBufferString(`{"lot_sizing":"fixed"}`)), "RES-1")
+		}, 400},
+		{"unknown lot sizing", func(w *httptest.ResponseRecorder) {
+			handleUpdateMRPItemSetting(w, httptest.NewRequest("PUT", "/api/v1/mrp/settings/RES-1", bytes.NewBufferString(`{"lot_sizing":"eoq"}`)), "RES-1")
+		}, 400},
+		{"valid setting", func(w *httptest.ResponseRecorder) {
+			handleUpdateMRPItemSetting(w, httptest.NewRequest("PUT", "/api/v1/mrp/settings/RES-1", bytes.NewBufferString(`{"lot_sizing":"min","lot_qty":1000,"lead_time_days":21}`)), "RES-1")
+		}, 200},
+		{"unknown run", func(w *httptest.ResponseRecorder) {
+			handleGetMRPRun(w, httptest.NewRequest("GET", "/api/v1/mrp/runs/99", nil), "99")
+		}, 404},
+		{"compare without other run", func(w *httptest.ResponseRecorder) {
+			handleCompareMRPRuns(w, httptest.NewRequest("GET", "/api/v1/mrp/runs/1/compare", nil), "1")
+		}, 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.call(w)
+			if w.Code != tt.code {
+				t.Errorf("expected %d, got %d: %s", tt.code, w.Code, w.Body.String())
+			}
+		})
+	}
+}
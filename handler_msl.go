@@ -0,0 +1,345 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mslFloorLifeHours is the J-STD-033 floor life of each MSL level at
+// 30°C/60% RH. Level 1 parts have no limit. Level 6 parts are baked before
+// use and get the time on their label, taken as 6 hours unless the part
+// has a floor_life_hours column.
+var mslFloorLifeHours = map[string]float64{"2": 8760, "2a": 672, "3": 168, "4": 72, "5": 48, "5a": 24, "6": 6}
+
+// LotMSL is the floor life clock of a moisture-sensitive lot. It runs while
+// the lot is open, pauses in dry storage and is reset by a bake.
+// FloorLifeHours and RemainingHours are nil for parts with no limit.
+type LotMSL struct {
+	Level          string   `json:"level"`
+	State          string   `json:"state"`
+	FloorLifeHours *float64 `json:"floor_life_hours"`
+	ExposureHours  float64  `json:"exposure_hours"`
+	RemainingHours *float64 `json:"remaining_hours"`
+	Exceeded       bool     `json:"exceeded"`
+	OpenedAt       *string  `json:"opened_at"`
+}
+
+type MSLEvent struct {
+	ID            int     `json:"id"`
+	LotID         int     `json:"lot_id"`
+	IPN           string  `json:"ipn"`
+	Event         string  `json:"event"`
+	ExposureHours float64 `json:"exposure_hours"`
+	Notes         string  `json:"notes"`
+	CreatedBy     string  `json:"created_by"`
+	CreatedAt     string  `json:"created_at"`
+}
+
+const lotMSLColumns = `COALESCE(msl_level,''), msl_floor_life_hours, COALESCE(msl_state,'sealed'), COALESCE(msl_exposure_hours,0), msl_opened_at`
+
+// lotMSLRow holds the MSL columns of a lot as stored.
+type lotMSLRow struct {
+	level     string
+	floorLife sql.NullFloat64
+	state     string
+	exposure  float64
+	openedAt  sql.NullString
+}
+
+func (m *lotMSLRow) targets() []interface{} {
+	return []interface{}{&m.level, &m.floorLife, &m.state, &m.exposure, &m.openedAt}
+}
+
+// exposureAt is the floor exposure in hours at now: what was built up
+// before, plus the time since the lot was last opened if it still is.
+func (m *lotMSLRow) exposureAt(now time.Time) float64 {
+	exposure := m.exposure
+	if m.state == "open" && m.openedAt.Valid {
+		if opened, err := parseLaborTime(m.openedAt.String, now.Location()); err == nil && now.After(opened) {
+			exposure += now.Sub(opened).Hours()
+		}
+	}
+	return exposure
+}
+
+// status is the lot's clock at now, or nil for a lot that was never
+// opened as moisture sensitive.
+func (m *lotMSLRow) status(now time.Time) *LotMSL {
+	if m.level == "" {
+		return nil
+	}
+	s := &LotMSL{Level: m.level, State: m.state, ExposureHours: math.Round(m.exposureAt(now)*100) / 100}
+	if m.state == "open" {
+		s.OpenedAt = sp(m.openedAt)
+	}
+	if m.floorLife.Valid {
+		life := m.floorLife.Float64
+		remaining := math.Round((life-s.ExposureHours)*100) / 100
+		s.FloorLifeHours, s.RemainingHours = &life, &remaining
+		s.Exceeded = remaining <= 0
+	}
+	return s
+}
+
+// normalizeMSLLevel turns "MSL 3", "msl-2A" or "3" into a level key of
+// mslFloorLifeHours, "1", or "" if it isn't a level.
+func normalizeMSLLevel(v string) string {
+	v = strings.ToLower(strings.TrimSpace(v))
+	v = strings.TrimLeft(strings.TrimPrefix(v, "msl"), " -")
+	if _, ok := mslFloorLifeHours[v]; ok || v == "1" {
+		return v
+	}
+	return ""
+}
+
+// partMSL reads a part's MSL level from its msl, msl_level or
+// moisture_sensitivity_level column, and its floor life: the level's, or a
+// floor_life_hours column if set. The floor life is nil for level 1.
+func partMSL(ipn string) (string, *float64) {
+	fields, err := getPartByIPN(partsDir, ipn)
+	if err != nil {
+		return "", nil
+	}
+	var level string
+	var override float64
+	for k, v := range fields {
+		switch strings.ToLower(k) {
+		case "msl", "msl_level", "moisture_sensitivity_level":
+			if l := normalizeMSLLevel(v); l != "" {
+				level = l
+			}
+		case "floor_life_hours":
+			override, _ = strconv.ParseFloat(strings.TrimSpace(v), 64)
+		}
+	}
+	if level == "" || level == "1" {
+		return level, nil
+	}
+	life := mslFloorLifeHours[level]
+	if override > 0 {
+		life = override
+	}
+	return level, &life
+}
+
+// checkLotFloorLife refuses a lot whose floor life is used up. The error
+// is meant for the client.
+func checkLotFloorLife(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, lotID int, now time.Time) error {
+	var m lotMSLRow
+	if err := q.QueryRow("SELECT "+lotMSLColumns+" FROM inventory_lots WHERE id=?", lotID).Scan(m.targets()...); err != nil {
+		return nil
+	}
+	if s := m.status(now); s != nil && s.Exceeded {
+		return fmt.Errorf("lot %d is past its MSL %s floor life (%g of %g hours); bake it before use", lotID, s.Level, s.ExposureHours, *s.FloorLifeHours)
+	}
+	return nil
+}
+
+// handleLotMSLEvent opens a moisture-sensitive lot, puts it in dry storage
+// or records a bake. Opening starts the floor life clock, dry storage
+// pauses it and a bake resets it, leaving the lot in dry storage. The lot
+// takes its MSL level from the part the first time.
+func handleLotMSLEvent(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		jsonErr(w, "invalid lot id", 400)
+		return
+	}
+	var body struct {
+		Event string `json:"event"`
+		Notes string `json:"notes"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	ve := &ValidationErrors{}
+	requireField(ve, "event", body.Event)
+	validateEnum(ve, "event", body.Event, validMSLEvents)
+	validateMaxLength(ve, "notes", body.Notes, 10000)
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	lot, err := loadLot(id)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "lot not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	var m lotMSLRow
+	if err := db.QueryRow("SELECT "+lotMSLColumns+" FROM inventory_lots WHERE id=?", id).Scan(m.targets()...); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if m.level == "" {
+		level, life := partMSL(lot.IPN)
+		if level == "" || level == "1" {
+			jsonErr(w, lot.IPN+" is not moisture sensitive (no MSL level above 1)", 400)
+			return
+		}
+		m.level = level
+		m.floorLife = sql.NullFloat64{Float64: *life, Valid: true}
+	}
+
+	switch {
+	case lot.Status == "depleted":
+		ve.Add("event", "lot is depleted")
+	case body.Event == "open" && m.state == "open":
+		ve.Add("event", "lot is already open")
+	case body.Event == "dry" && m.state != "open":
+		ve.Add("event", "only an open lot can go into dry storage")
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	now := time.Now()
+	stamp := now.Format("2006-01-02 15:04:05")
+	exposure := m.exposureAt(now)
+	var openedAt interface{}
+	state, newExposure := m.state, exposure
+	switch body.Event {
+	case "open":
+		state, openedAt = "open", stamp
+	case "dry":
+		state = "dry"
+	case "bake":
+		state, newExposure = "dry", 0
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`UPDATE inventory_lots SET msl_level=?, msl_floor_life_hours=?, msl_state=?, msl_exposure_hours=?, msl_opened_at=? WHERE id=?`,
+		m.level, m.floorLife, state, newExposure, openedAt, id)
+	if err == nil {
+		_, err = tx.Exec(`INSERT INTO msl_events (lot_id, ipn, event, exposure_hours, notes, created_by, created_at) VALUES (?,?,?,?,?,?,?)`,
+			id, lot.IPN, body.Event, math.Round(exposure*100)/100, body.Notes, getUsername(r), stamp)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+
+	summaries := map[string]string{"open": "Opened", "dry": "Put in dry storage", "bake": "Baked"}
+	logAudit(db, getUsername(r), body.Event, "lot", idStr, fmt.Sprintf("%s lot %s of %s at %.1f hours floor exposure",
+		summaries[body.Event], lot.LotNumber, lot.IPN, exposure))
+	lot, _ = loadLot(id)
+	jsonResp(w, lot)
+}
+
+// handleListLotMSLEvents returns a lot's floor life clock and its events.
+func handleListLotMSLEvents(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		jsonErr(w, "invalid lot id", 400)
+		return
+	}
+	lot, err := loadLot(id)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "lot not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	rows, err := db.Query(`SELECT id, lot_id, ipn, event, COALESCE(exposure_hours,0), COALESCE(notes,''), COALESCE(created_by,''), created_at
+		FROM msl_events WHERE lot_id=? ORDER BY id`, id)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	events := []MSLEvent{}
+	for rows.Next() {
+		var e MSLEvent
+		rows.Scan(&e.ID, &e.LotID, &e.IPN, &e.Event, &e.ExposureHours, &e.Notes, &e.CreatedBy, &e.CreatedAt)
+		events = append(events, e)
+	}
+	jsonResp(w, map[string]interface{}{"lot": lot, "msl": lot.MSL, "events": events})
+}
+
+// floorLifeLots loads the lots with stock whose clock has started, least
+// floor life left first.
+func floorLifeLots(now time.Time) ([]InventoryLot, error) {
+	rows, err := db.Query("SELECT " + lotColumns + " FROM inventory_lots WHERE COALESCE(msl_level,'') != '' AND qty_on_hand > 0 AND status != 'depleted'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lots := []InventoryLot{}
+	for rows.Next() {
+		l, err := scanLot(rows)
+		if err != nil {
+			return nil, err
+		}
+		if l.MSL != nil && l.MSL.FloorLifeHours != nil {
+			lots = append(lots, l)
+		}
+	}
+	sort.SliceStable(lots, func(i, j int) bool {
+		return *lots[i].MSL.RemainingHours < *lots[j].MSL.RemainingHours
+	})
+	return lots, rows.Err()
+}
+
+// handleListFloorLifeLots lists moisture-sensitive lots by floor life left,
+// filterable by ?state= and ?exceeded=true.
+func handleListFloorLifeLots(w http.ResponseWriter, r *http.Request) {
+	lots, err := floorLifeLots(time.Now())
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	state, exceeded := r.URL.Query().Get("state"), r.URL.Query().Get("exceeded") == "true"
+	items := []InventoryLot{}
+	for _, l := range lots {
+		if (state == "" || l.MSL.State == state) && (!exceeded || l.MSL.Exceeded) {
+			items = append(items, l)
+		}
+	}
+	jsonResp(w, items)
+}
+
+// mslFloorLifeAlerts warns about open lots with warnHours or less of floor
+// life left and flags lots past it.
+func mslFloorLifeAlerts(warnHours float64) []pendingNotif {
+	lots, err := floorLifeLots(time.Now())
+	if err != nil {
+		return nil
+	}
+	var pending []pendingNotif
+	for _, l := range lots {
+		m := l.MSL
+		switch {
+		case m.Exceeded:
+			pending = append(pending, pendingNotif{ntype: "msl_floor_life_exceeded", severity: "error", title: "MSL Floor Life Exceeded: " + l.LotNumber,
+				message:  stringPtr(fmt.Sprintf("%s lot %s: %.1f of %g hours used, bake before use", l.IPN, l.LotNumber, m.ExposureHours, *m.FloorLifeHours)),
+				recordID: stringPtr(strconv.Itoa(l.ID)), module: stringPtr("inventory")})
+		case m.State == "open" && *m.RemainingHours <= warnHours:
+			pending = append(pending, pendingNotif{ntype: "msl_floor_life", severity: "warning", title: "MSL Floor Life Ending: " + l.LotNumber,
+				message:  stringPtr(fmt.Sprintf("%s lot %s: %.1f hours left", l.IPN, l.LotNumber, *m.RemainingHours)),
+				recordID: stringPtr(strconv.Itoa(l.ID)), module: stringPtr("inventory")})
+		}
+	}
+	return pending
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func postMSLEvent(t *testing.T, lotID int, body string) (*httptest.ResponseRecorder, InventoryLot) {
+	t.Helper()
+	id := strconv.Itoa(lotID)
+	w := httptest.NewRecorder()
+	handleLotMSLEvent(w, httptest.NewRequest("POST", "/api/v1/lots/"+id+"/msl", bytes.NewBufferString(body)), id)
+	var resp struct {
+		Data InventoryLot `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp.Data
+}
+
+func TestMSLFloorLife(t *testing.T) {
+	oldDB, oldPartsDir := db, partsDir
+	db = setupTestDB(t)
+	partsDir = t.TempDir()
+	defer func() { db.Close(); db = oldDB; partsDir = oldPartsDir }()
+
+	os.WriteFile(filepath.Join(partsDir, "ics.csv"), []byte("IPN,Description,MSL\nIC-1,MCU,MSL 3\nRES-1,Resistor,1\n"), 0644)
+	db.Exec(`INSERT INTO inventory (ipn, qty_on_hand) VALUES ('IC-1', 100), ('RES-1', 10)`)
+	older, newer := "2026-01-05 08:00:00", "2026-02-05 08:00:00"
+	reel := seedLot(t, InventoryLot{IPN: "IC-1", LotNumber: "REEL-1", QtyReceived: 60, QtyOnHand: 60, ReceivedAt: &older})
+	reel2 := seedLot(t, InventoryLot{IPN: "IC-1", LotNumber: "REEL-2", QtyReceived: 40, QtyOnHand: 40, ReceivedAt: &newer})
+	res := seedLot(t, InventoryLot{IPN: "RES-1", LotNumber: "R-1", QtyReceived: 10, QtyOnHand: 10})
+
+	if w, _ := postMSLEvent(t, res, `{"event":"open"}`); w.Code != 400 {
+		t.Errorf("expected a level 1 part to be refused, got %d", w.Code)
+	}
+	if w, _ := postMSLEvent(t, reel, `{"event":"dry"}`); w.Code != 400 {
+		t.Errorf("expected dry storage of a sealed lot to be refused, got %d", w.Code)
+	}
+	w, lot := postMSLEvent(t, reel, `{"event":"open","notes":"Line 2"}`)
+	if w.Code != 200 || lot.MSL == nil || lot.MSL.Level != "3" || lot.MSL.State != "open" || *lot.MSL.FloorLifeHours != 168 {
+		t.Fatalf("open failed: %d %s", w.Code, w.Body.String())
+	}
+	if w, _ := postMSLEvent(t, reel, `{"event":"open"}`); w.Code != 400 {
+		t.Errorf("expected opening an open lot to be refused, got %d", w.Code)
+	}
+
+	// 200 hours on the floor is past the 168 hours of MSL 3
+	db.Exec("UPDATE inventory_lots SET msl_opened_at=? WHERE id=?", time.Now().Add(-200*time.Hour).Format("2006-01-02 15:04:05"), reel)
+	if lot, _ := loadLot(reel); !lot.MSL.Exceeded || *lot.MSL.RemainingHours > -31 {
+		t.Fatalf("expected the floor life exceeded, got %+v", lot.MSL)
+	}
+	if w := postTransact(t, `{"ipn":"IC-1","type":"issue","lots":[{"lot_id":`+strconv.Itoa(reel)+`,"qty":5}]}`); w.Code != 400 {
+		t.Errorf("expected issuing from an exceeded lot to be refused, got %d", w.Code)
+	}
+	// FIFO goes past it to the newer reel
+	if w := postTransact(t, `{"ipn":"IC-1","type":"issue","qty":10,"reference":"WO-1"}`); w.Code != 200 {
+		t.Fatalf("issue failed: %d %s", w.Code, w.Body.String())
+	}
+	if q, _ := lotQty(t, reel); q != 60 {
+		t.Errorf("expected the exceeded reel untouched, got %v", q)
+	}
+	if q, _ := lotQty(t, reel2); q != 30 {
+		t.Errorf("expected 30 left on the newer reel, got %v", q)
+	}
+	// but won't book what the newer reel can't cover as untracked stock
+	if w := postTransact(t, `{"ipn":"IC-1","type":"issue","qty":40}`); w.Code != 400 {
+		t.Errorf("expected an issue past the usable stock to be refused, got %d %s", w.Code, w.Body.String())
+	}
+	tx, _ := db.Begin()
+	tx.Exec("UPDATE inventory SET qty_on_hand = qty_on_hand - 40 WHERE ipn='IC-1'")
+	if _, err := issueFromLots(tx, "IC-1", 40, nil, "issue", "WO-1", "", time.Now().Format("2006-01-02 15:04:05")); err == nil {
+		t.Errorf("expected issueFromLots to refuse stock held in an exceeded lot")
+	}
+	tx.Rollback()
+	if q, _ := lotQty(t, reel); q != 60 || onHand("IC-1") != 90 {
+		t.Errorf("expected 60 in the exceeded reel of 90 on hand, got %v of %v", q, onHand("IC-1"))
+	}
+
+	alerts := mslFloorLifeAlerts(4)
+	if len(alerts) != 1 || alerts[0].ntype != "msl_floor_life_exceeded" || *alerts[0].recordID != strconv.Itoa(reel) {
+		t.Errorf("unexpected alerts: %+v", alerts)
+	}
+	w = httptest.NewRecorder()
+	handleListFloorLifeLots(w, httptest.NewRequest("GET", "/api/v1/lots/floor-life?exceeded=true", nil))
+	var list struct {
+		Data []InventoryLot `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Data) != 1 || list.Data[0].ID != reel {
+		t.Errorf("unexpected floor life list: %s", w.Body.String())
+	}
+
+	// A bake resets the clock and leaves the reel in dry storage
+	if w, lot := postMSLEvent(t, reel, `{"event":"bake"}`); w.Code != 200 || lot.MSL.State != "dry" || lot.MSL.ExposureHours != 0 || lot.MSL.Exceeded {
+		t.Fatalf("bake failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := postTransact(t, `{"ipn":"IC-1","type":"issue","lots":[{"lot_id":`+strconv.Itoa(reel)+`,"qty":5}]}`); w.Code != 200 {
+		t.Errorf("expected a baked lot to issue, got %d %s", w.Code, w.Body.String())
+	}
+
+	// Dry storage pauses the clock where it stood
+	postMSLEvent(t, reel, `{"event":"open"}`)
+	db.Exec("UPDATE inventory_lots SET msl_opened_at=? WHERE id=?", time.Now().Add(-10*time.Hour).Format("2006-01-02 15:04:05"), reel)
+	if w, lot := postMSLEvent(t, reel, `{"event":"dry"}`); w.Code != 200 || lot.MSL.ExposureHours != 10 || *lot.MSL.RemainingHours != 158 || lot.MSL.OpenedAt != nil {
+		t.Fatalf("dry failed: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handleListLotMSLEvents(w, httptest.NewRequest("GET", "/api/v1/lots/"+strconv.Itoa(reel)+"/msl", nil), strconv.Itoa(reel))
+	var events struct {
+		Data struct {
+			Events []MSLEvent `json:"events"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &events)
+	e := events.Data.Events
+	if len(e) != 4 || e[0].Event != "open" || e[0].Notes != "Line 2" || e[1].Event != "bake" || e[1].ExposureHours != 200 || e[3].Event != "dry" {
+		t.Errorf("unexpected events: %s", w.Body.String())
+	}
+}
@@ -30,6 +30,7 @@ func handleGetNCR(w http.ResponseWriter, r *http.Request, id string) {
 		Scan(&n.ID, &n.Title, &n.Description, &n.IPN, &n.SerialNumber, &n.DefectType, &n.Severity, &n.Status, &n.RootCause, &n.CorrectiveAction, &n.CreatedBy, &n.CreatedAt, &ra)
 	if err != nil { jsonErr(w, "not found", 404); return }
 	n.ResolvedAt = sp(ra)
+	attachNCRRework(&n)
 	jsonResp(w, n)
 }
 
@@ -94,6 +95,7 @@ func handleUpdateNCR(w http.ResponseWriter, r *http.Request, id string) {
 	rootCause := getString("root_cause")
 	correctiveAction := getString("corrective_action")
 	createECO := getBool("create_eco")
+	disposition := getString("disposition")
 
 	ve := &ValidationErrors{}
 	validateMaxLength(ve, "title", title, 255)
@@ -103,7 +105,28 @@ func handleUpdateNCR(w http.ResponseWriter, r *http.Request, id string) {
 	validateMaxLength(ve, "defect_type", defectType, 255)
 	validateMaxLength(ve, "root_cause", rootCause, 1000)
 	validateMaxLength(ve, "corrective_action", correctiveAction, 1000)
+	validateEnum(ve, "disposition", disposition, validNCRDispositions)
 	if ve.HasErrors() { jsonErr(w, ve.Error(), 400); return }
+
+	// Dispositioning as rework raises a rework order unless there is one already
+	var reworkWOID string
+	if disposition == "rework" && oldSnap != nil {
+		var existing int
+		db.QueryRow("SELECT COUNT(*) FROM rework_orders WHERE ncr_id=?", id).Scan(&existing)
+		if existing == 0 {
+			req := ReworkRequest{IPN: ipn, Instructions: correctiveAction}
+			if serialNumber != "" { req.Serials = []string{serialNumber} }
+			woID, err := createReworkOrder(id, req, getUsername(r))
+			if ve, ok := err.(*ValidationErrors); ok {
+				jsonErr(w, "cannot create rework order: "+ve.Error(), 400)
+				return
+			} else if err != nil {
+				jsonErr(w, err.Error(), 500)
+				return
+			}
+			reworkWOID = woID
+		}
+	}
 	
 	now := time.Now().Format("2006-01-02 15:04:05")
 	var resolvedAt interface{}
@@ -113,6 +136,9 @@ func handleUpdateNCR(w http.ResponseWriter, r *http.Request, id string) {
 	_, err := db.Exec("UPDATE ncrs SET title=?,description=?,ipn=?,serial_number=?,defect_type=?,severity=?,status=?,root_cause=?,corrective_action=?,resolved_at=COALESCE(?,resolved_at) WHERE id=?",
 		title, description, ipn, serialNumber, defectType, severity, status, rootCause, correctiveAction, resolvedAt, id)
 	if err != nil { jsonErr(w, err.Error(), 500); return }
+	if _, ok := body["disposition"]; ok {
+		db.Exec("UPDATE ncrs SET disposition=? WHERE id=?", disposition, id)
+	}
 	logAudit(db, getUsername(r), "updated", "ncr", id, "Updated "+id+": "+title)
 	newSnap, _ := getNCRSnapshot(id)
 	recordChangeJSON(getUsername(r), "ncrs", id, "update", oldSnap, newSnap)
@@ -139,15 +165,18 @@ func handleUpdateNCR(w http.ResponseWriter, r *http.Request, id string) {
 		Scan(&n.ID, &n.Title, &n.Description, &n.IPN, &n.SerialNumber, &n.DefectType, &n.Severity, &n.Status, &n.RootCause, &n.CorrectiveAction, &n.CreatedAt, &ra)
 	if err != nil { jsonErr(w, "not found", 404); return }
 	n.ResolvedAt = sp(ra)
+	attachNCRRework(&n)
 
-	if linkedECOID != "" {
+	if linkedECOID != "" || reworkWOID != "" {
 		resp := map[string]interface{}{
 			"id": n.ID, "title": n.Title, "description": n.Description,
 			"ipn": n.IPN, "serial_number": n.SerialNumber, "defect_type": n.DefectType,
 			"severity": n.Severity, "status": n.Status, "root_cause": n.RootCause,
 			"corrective_action": n.CorrectiveAction, "created_at": n.CreatedAt,
-			"resolved_at": n.ResolvedAt, "linked_eco_id": linkedECOID,
+			"resolved_at": n.ResolvedAt, "disposition": n.Disposition,
 		}
+		if linkedECOID != "" { resp["linked_eco_id"] = linkedECOID }
+		if reworkWOID != "" { resp["rework_wo_id"] = reworkWOID }
 		jsonResp(w, resp)
 	} else {
 		jsonResp(w, n)
@@ -37,6 +37,9 @@ var notificationTypes = []NotificationTypeInfo{
 	{Type: "po_received", Name: "PO Received", Description: "When a purchase order is received", Icon: "truck", HasThreshold: false},
 	{Type: "wo_completed", Name: "Work Order Completed", Description: "When a work order is completed", Icon: "check", HasThreshold: false},
 	{Type: "field_report_critical", Name: "Critical Field Report", Description: "When a field report is marked as critical", Icon: "alert-circle", HasThreshold: false},
+	{Type: "msl_floor_life", Name: "MSL Floor Life", Description: "When an open moisture-sensitive lot is near or past its floor life", Icon: "droplet", HasThreshold: true, ThresholdLabel: stringPtr("Hours Left"), ThresholdDefault: float64Ptr(4)},
+	{Type: "lot_expiry", Name: "Lot Expiry", Description: "When a lot is within the threshold days of its expiry date or has expired", Icon: "calendar", HasThreshold: true, ThresholdLabel: stringPtr("Days Before Expiry"), ThresholdDefault: float64Ptr(30)},
+	{Type: "spc_violation", Name: "SPC Violation", Description: "When a newly tested unit breaks a Western Electric rule on a spec'd measurement", Icon: "activity", HasThreshold: false},
 }
 
 func float64Ptr(f float64) *float64 { return &f }
@@ -321,6 +324,32 @@ func generateNotificationsForUser(userID int) {
 		}
 	}
 
+	// Moisture-sensitive lots near or past their floor life
+	enabled, deliveryMethod, threshold = getUserNotifPref(userID, "msl_floor_life")
+	if enabled {
+		warnHours := 4.0
+		if threshold != nil {
+			warnHours = *threshold
+		}
+		for _, p := range mslFloorLifeAlerts(warnHours) {
+			p.deliveryMethod, p.userID = deliveryMethod, userID
+			pending = append(pending, p)
+		}
+	}
+
+	// Lots near or past their expiry date
+	enabled, deliveryMethod, threshold = getUserNotifPref(userID, "lot_expiry")
+	if enabled {
+		warnDays := 30
+		if threshold != nil {
+			warnDays = int(*threshold)
+		}
+		for _, p := range lotExpiryAlerts(warnDays) {
+			p.deliveryMethod, p.userID = deliveryMethod, userID
+			pending = append(pending, p)
+		}
+	}
+
 	for _, p := range pending {
 		createNotificationIfNew(p.ntype, p.severity, p.title, p.message, p.recordID, p.module)
 		if p.deliveryMethod == "email" || p.deliveryMethod == "both" {
@@ -37,8 +37,8 @@ func TestListNotificationTypes(t *testing.T) {
 
 	var types []NotificationTypeInfo
 	decodeAPIResp(t, w, &types)
-	if len(types) != 8 {
-		t.Fatalf("expected 8 notification types, got %d", len(types))
+	if len(types) != 11 {
+		t.Fatalf("expected 11 notification types, got %d", len(types))
 	}
 
 	for _, nt := range types {
@@ -79,8 +79,8 @@ func TestGetNotificationPreferencesDefaults(t *testing.T) {
 
 	var prefs []NotificationPreference
 	decodeAPIResp(t, w, &prefs)
-	if len(prefs) != 8 {
-		t.Fatalf("expected 8 default prefs, got %d", len(prefs))
+	if len(prefs) != 11 {
+		t.Fatalf("expected 11 default prefs, got %d", len(prefs))
 	}
 
 	for _, p := range prefs {
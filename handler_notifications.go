@@ -123,6 +123,12 @@ func generateNotifications() {
 		}
 	}()
 
+	// Moisture-sensitive lots near or past their floor life
+	pending = append(pending, mslFloorLifeAlerts(4)...)
+
+	// Lots near or past their expiry date
+	pending = append(pending, lotExpiryAlerts(30)...)
+
 	// Now insert all collected notifications
 	for _, p := range pending {
 		createNotificationIfNew(p.ntype, p.severity, p.title, p.message, p.recordID, p.module)
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OwnershipBalance is stock of an IPN that isn't simply ours: customer-owned
+// stock held here, which is part of inventory.qty_on_hand, or our stock
+// consigned to a contract manufacturer, which is not on hand. Everything
+// else on hand is ours.
+type OwnershipBalance struct {
+	IPN       string  `json:"ipn"`
+	OwnerType string  `json:"owner_type"`
+	Owner     string  `json:"owner"`
+	Qty       float64 `json:"qty"`
+	UpdatedAt string  `json:"updated_at"`
+}
+
+// OwnershipMove is one entry of the ownership ledger: customer stock coming
+// in or going out, or a kit going to, being consumed at or coming back from
+// a contract manufacturer.
+type OwnershipMove struct {
+	ID        int     `json:"id"`
+	IPN       string  `json:"ipn"`
+	OwnerType string  `json:"owner_type"`
+	Owner     string  `json:"owner"`
+	Type      string  `json:"type"`
+	Qty       float64 `json:"qty"`
+	Reference string  `json:"reference"`
+	Notes     string  `json:"notes"`
+	CreatedBy string  `json:"created_by"`
+	CreatedAt string  `json:"created_at"`
+}
+
+// ownershipQty returns how much of ipn is customer-owned and how much is
+// consigned to contract manufacturers. Databases without ownership count
+// everything as ours.
+func ownershipQty(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, ipn string) (customer, consigned float64) {
+	q.QueryRow(`SELECT COALESCE(SUM(CASE WHEN owner_type='customer' THEN qty END),0), COALESCE(SUM(CASE WHEN owner_type='consigned' THEN qty END),0)
+		FROM inventory_ownership WHERE ipn=?`, ipn).Scan(&customer, &consigned)
+	return customer, consigned
+}
+
+// addOwnership moves an ownership balance by delta and records the move.
+// Balances that reach zero are dropped.
+func addOwnership(tx *sql.Tx, ipn, ownerType, owner string, delta float64, moveType, reference, notes, user, now string) error {
+	var have float64
+	tx.QueryRow("SELECT qty FROM inventory_ownership WHERE ipn=? AND owner_type=? AND owner=?", ipn, ownerType, owner).Scan(&have)
+	if have+delta < -1e-9 {
+		return fmt.Errorf("only %g %s held for %s", have, ipn, owner)
+	}
+	var err error
+	if have+delta <= 1e-9 {
+		_, err = tx.Exec("DELETE FROM inventory_ownership WHERE ipn=? AND owner_type=? AND owner=?", ipn, ownerType, owner)
+	} else {
+		_, err = tx.Exec(`INSERT INTO inventory_ownership (ipn, owner_type, owner, qty, updated_at) VALUES (?,?,?,?,?)
+			ON CONFLICT(ipn, owner_type, owner) DO UPDATE SET qty = excluded.qty, updated_at = excluded.updated_at`, ipn, ownerType, owner, have+delta, now)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update %s stock of %s: %w", owner, ipn, err)
+	}
+	_, err = tx.Exec(`INSERT INTO ownership_moves (ipn, owner_type, owner, type, qty, reference, notes, created_by, created_at) VALUES (?,?,?,?,?,?,?,?,?)`,
+		ipn, ownerType, owner, moveType, math.Abs(delta), reference, notes, user, now)
+	return err
+}
+
+// takeOwnedStock settles whose stock an issue of qty of ipn used: the
+// customer's own stock first when there is a customer, then ours. Other
+// customers' stock is never used. Call it after inventory.qty_on_hand is
+// drawn down and before the cost layers are synced. The error is meant for
+// the client.
+func takeOwnedStock(tx *sql.Tx, ipn string, qty float64, customer, reference, notes, user, now string) error {
+	held := map[string]float64{}
+	total := 0.0
+	rows, err := tx.Query("SELECT owner, qty FROM inventory_ownership WHERE ipn=? AND owner_type='customer'", ipn)
+	if err != nil {
+		return nil
+	}
+	for rows.Next() {
+		var owner string
+		var q float64
+		rows.Scan(&owner, &q)
+		held[owner] = q
+		total += q
+	}
+	rows.Close()
+	if total <= 0 {
+		return nil
+	}
+
+	fromCustomer := math.Min(qty, held[customer])
+	var onHand float64
+	tx.QueryRow("SELECT qty_on_hand FROM inventory WHERE ipn=?", ipn).Scan(&onHand)
+	if ours := onHand + qty - total; qty-fromCustomer > ours+1e-9 {
+		return fmt.Errorf("only %g of %s is ours; %g belongs to customers", math.Max(0, ours), ipn, total)
+	}
+	if fromCustomer <= 0 {
+		return nil
+	}
+	return addOwnership(tx, ipn, "customer", customer, -fromCustomer, "issue", reference, notes, user, now)
+}
+
+// returnOwnedStock gives customers back what was issued from their stock
+// against reference and now comes back, e.g. leftovers of a WO kit. The
+// rest of qty is ours.
+func returnOwnedStock(tx *sql.Tx, ipn string, qty float64, reference, notes, user, now string) error {
+	if reference == "" {
+		return nil
+	}
+	rows, err := tx.Query(`SELECT owner, SUM(CASE WHEN type='issue' THEN qty ELSE -qty END) FROM ownership_moves
+		WHERE ipn=? AND reference=? AND owner_type='customer' AND type IN ('issue','return') GROUP BY owner ORDER BY MAX(id) DESC`, ipn, reference)
+	if err != nil {
+		return nil
+	}
+	type owed struct {
+		owner string
+		qty   float64
+	}
+	var list []owed
+	for rows.Next() {
+		var o owed
+		rows.Scan(&o.owner, &o.qty)
+		list = append(list, o)
+	}
+	rows.Close()
+	for _, o := range list {
+		back := math.Min(qty, o.qty)
+		if back <= 1e-9 {
+			continue
+		}
+		if err := addOwnership(tx, ipn, "customer", o.owner, back, "return", reference, notes, user, now); err != nil {
+			return err
+		}
+		qty -= back
+	}
+	return nil
+}
+
+// workOrderCustomer is the customer a WO builds for, if any.
+func workOrderCustomer(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, woID string) string {
+	var customer string
+	q.QueryRow("SELECT COALESCE(customer,'') FROM work_orders WHERE id=?", woID).Scan(&customer)
+	return customer
+}
+
+// ownershipTotals returns the customer-owned and the consigned qty of
+// every IPN that has some.
+func ownershipTotals() (customer, consigned map[string]float64) {
+	customer, consigned = map[string]float64{}, map[string]float64{}
+	rows, err := db.Query("SELECT ipn, owner_type, SUM(qty) FROM inventory_ownership GROUP BY ipn, owner_type")
+	if err != nil {
+		return customer, consigned
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ipn, ownerType string
+		var qty float64
+		rows.Scan(&ipn, &ownerType, &qty)
+		if ownerType == "customer" {
+			customer[ipn] = qty
+		} else {
+			consigned[ipn] = qty
+		}
+	}
+	return customer, consigned
+}
+
+func loadOwnershipBalances(where string, args ...interface{}) ([]OwnershipBalance, error) {
+	rows, err := db.Query("SELECT ipn, owner_type, owner, qty, COALESCE(updated_at,'') FROM inventory_ownership WHERE "+where+" ORDER BY ipn, owner_type, owner", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []OwnershipBalance{}
+	for rows.Next() {
+		var b OwnershipBalance
+		if err := rows.Scan(&b.IPN, &b.OwnerType, &b.Owner, &b.Qty, &b.UpdatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, b)
+	}
+	return list, rows.Err()
+}
+
+// handleListOwnership lists customer-owned and consigned stock, filterable
+// by ?ipn=, ?owner_type= and ?owner=.
+func handleListOwnership(w http.ResponseWriter, r *http.Request) {
+	where := "qty > 0"
+	var args []interface{}
+	for _, f := range []string{"ipn", "owner_type", "owner"} {
+		if v := r.URL.Query().Get(f); v != "" {
+			where += " AND " + f + " = ?"
+			args = append(args, v)
+		}
+	}
+	list, err := loadOwnershipBalances(where, args...)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	jsonResp(w, list)
+}
+
+// handleListOwnershipMoves returns the ownership ledger, filterable by
+// ?ipn=, ?owner= and ?reference=.
+func handleListOwnershipMoves(w http.ResponseWriter, r *http.Request) {
+	query := `SELECT id, ipn, owner_type, owner, type, qty, COALESCE(reference,''), COALESCE(notes,''), COALESCE(created_by,''), created_at
+		FROM ownership_moves WHERE 1=1`
+	var args []interface{}
+	for _, f := range []string{"ipn", "owner", "reference"} {
+		if v := r.URL.Query().Get(f); v != "" {
+			query += " AND " + f + " = ?"
+			args = append(args, v)
+		}
+	}
+	rows, err := db.Query(query+" ORDER BY id DESC", args...)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	moves := []OwnershipMove{}
+	for rows.Next() {
+		var m OwnershipMove
+		rows.Scan(&m.ID, &m.IPN, &m.OwnerType, &m.Owner, &m.Type, &m.Qty, &m.Reference, &m.Notes, &m.CreatedBy, &m.CreatedAt)
+		moves = append(moves, m)
+	}
+	jsonResp(w, moves)
+}
+
+type consignmentLine struct {
+	IPN string  `json:"ipn"`
+	Qty float64 `json:"qty"`
+}
+
+// validateConsignment checks the contract manufacturer and lines of a
+// consignment request.
+func validateConsignment(ve *ValidationErrors, cm string, lines []consignmentLine, field string) {
+	requireField(ve, "cm", cm)
+	if cm != "" {
+		var exists int
+		if db.QueryRow("SELECT 1 FROM vendors WHERE id=?", cm).Scan(&exists) != nil {
+			ve.Add("cm", "unknown vendor "+cm)
+		}
+	}
+	if len(lines) == 0 {
+		ve.Add(field, "at least one line is required")
+	}
+	for i := range lines {
+		lines[i].IPN = strings.TrimSpace(lines[i].IPN)
+		if lines[i].IPN == "" {
+			ve.Add(fmt.Sprintf("%s[%d].ipn", field, i), "is required")
+		}
+		if lines[i].Qty <= 0 {
+			ve.Add(fmt.Sprintf("%s[%d].qty", field, i), "must be positive")
+		}
+	}
+}
+
+// handleShipToCM sends a kit of our stock to a contract manufacturer. The
+// stock leaves inventory (first to expire first, like any issue) and is
+// held as consigned at the CM, still ours and still valued.
+func handleShipToCM(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		CM        string            `json:"cm"`
+		Reference string            `json:"reference"`
+		Notes     string            `json:"notes"`
+		Lines     []consignmentLine `json:"lines"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	ve := &ValidationErrors{}
+	validateConsignment(ve, body.CM, body.Lines, "lines")
+	validateMaxLength(ve, "reference", body.Reference, 100)
+	validateMaxLength(ve, "notes", body.Notes, 10000)
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+	if body.Reference == "" {
+		body.Reference = "CM:" + body.CM
+	}
+
+	user := getUsername(r)
+	now := time.Now().Format("2006-01-02 15:04:05")
+	note := "Kit to " + body.CM
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+	for _, l := range body.Lines {
+		if err := checkUsableStock(tx, l.IPN, l.Qty, time.Now()); err != nil {
+			jsonErr(w, err.Error(), 400)
+			return
+		}
+		if _, err := tx.Exec("UPDATE inventory SET qty_on_hand = qty_on_hand - ?, updated_at = ? WHERE ipn = ?", l.Qty, now, l.IPN); err != nil {
+			jsonErr(w, fmt.Sprintf("not enough %s on hand", l.IPN), 400)
+			return
+		}
+		if err := takeOwnedStock(tx, l.IPN, l.Qty, "", body.Reference, note, user, now); err != nil {
+			jsonErr(w, err.Error(), 400)
+			return
+		}
+		if err := addOwnership(tx, l.IPN, "consigned", body.CM, l.Qty, "ship_to_cm", body.Reference, body.Notes, user, now); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		if _, err := issueFromLots(tx, l.IPN, l.Qty, nil, "issue", body.Reference, note, now); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, user, "shipped", "consignment", body.Reference, fmt.Sprintf("Shipped %d line(s) to %s", len(body.Lines), body.CM))
+	balances, _ := loadOwnershipBalances("owner_type='consigned' AND owner=?", body.CM)
+	jsonResp(w, map[string]interface{}{"reference": body.Reference, "consigned": balances})
+}
+
+// handleReceiveFromCM receives finished assemblies back from a contract
+// manufacturer together with the components it reports having used. The
+// consumed stock comes out of what is consigned there, and the assemblies
+// come in at that component cost plus the CM's conversion cost per unit.
+func handleReceiveFromCM(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		CM             string            `json:"cm"`
+		Reference      string            `json:"reference"`
+		AssemblyIPN    string            `json:"assembly_ipn"`
+		Qty            float64           `json:"qty"`
+		LotNumber      string            `json:"lot_number"`
+		ConversionCost float64           `json:"conversion_cost"`
+		Notes          string            `json:"notes"`
+		Consumed       []consignmentLine `json:"consumed"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	ve := &ValidationErrors{}
+	validateConsignment(ve, body.CM, body.Consumed, "consumed")
+	requireField(ve, "reference", body.Reference)
+	requireField(ve, "assembly_ipn", body.AssemblyIPN)
+	validateMaxLength(ve, "reference", body.Reference, 100)
+	validateMaxLength(ve, "lot_number", body.LotNumber, 100)
+	validateMaxLength(ve, "notes", body.Notes, 10000)
+	if body.Qty <= 0 {
+		ve.Add("qty", "must be positive")
+	}
+	if body.ConversionCost < 0 {
+		ve.Add("conversion_cost", "must not be negative")
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	user := getUsername(r)
+	now := time.Now().Format("2006-01-02 15:04:05")
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+
+	// What the CM used leaves our books at the cost its layers carry
+	mark := costIssueMark(tx)
+	for i, c := range body.Consumed {
+		if err := addOwnership(tx, c.IPN, "consigned", body.CM, -c.Qty, "cm_consumed", body.Reference, body.Notes, user, now); err != nil {
+			ve.Add(fmt.Sprintf("consumed[%d].qty", i), err.Error())
+			continue
+		}
+		if err := syncCostLayers(tx, c.IPN, "issue", body.Reference, 0, now); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+	var componentCost float64
+	tx.QueryRow("SELECT COALESCE(SUM(qty*unit_cost),0) FROM cost_layer_issues WHERE reference=? AND id > ?", body.Reference, mark).Scan(&componentCost)
+
+	if _, err := tx.Exec("INSERT OR IGNORE INTO inventory (ipn) VALUES (?)", body.AssemblyIPN); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if _, err := tx.Exec("UPDATE inventory SET qty_on_hand = qty_on_hand + ?, updated_at = ? WHERE ipn = ?", body.Qty, now, body.AssemblyIPN); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	note := "Built by " + body.CM
+	lotID, err := createLot(tx, InventoryLot{IPN: body.AssemblyIPN, LotNumber: body.LotNumber, VendorID: body.CM,
+		QtyReceived: body.Qty, QtyOnHand: body.Qty, ReceivedAt: &now, Notes: body.Notes}, body.Reference)
+	if err == nil {
+		err = recordLotTransaction(tx, lotID, body.AssemblyIPN, "receive", body.Qty, body.Reference, note, now)
+	}
+	if err == nil {
+		unitCost := (componentCost + body.ConversionCost*body.Qty) / body.Qty
+		err = syncCostLayers(tx, body.AssemblyIPN, "receipt", body.Reference, unitCost, now)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, user, "received", "consignment", body.Reference, fmt.Sprintf("Received %g %s from %s, %d component(s) consumed",
+		body.Qty, body.AssemblyIPN, body.CM, len(body.Consumed)))
+	lot, _ := loadLot(lotID)
+	jsonResp(w, map[string]interface{}{"lot": lot, "component_cost": math.Round(componentCost*100) / 100})
+}
+
+// handleReturnFromCM takes unused consigned stock back from a contract
+// manufacturer into inventory.
+func handleReturnFromCM(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		CM        string            `json:"cm"`
+		Reference string            `json:"reference"`
+		Notes     string            `json:"notes"`
+		Lines     []consignmentLine `json:"lines"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	ve := &ValidationErrors{}
+	validateConsignment(ve, body.CM, body.Lines, "lines")
+	validateMaxLength(ve, "reference", body.Reference, 100)
+	validateMaxLength(ve, "notes", body.Notes, 10000)
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+	if body.Reference == "" {
+		body.Reference = "CM:" + body.CM
+	}
+
+	user := getUsername(r)
+	now := time.Now().Format("2006-01-02 15:04:05")
+	note := "Returned from " + body.CM
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+	for i, l := range body.Lines {
+		if err := addOwnership(tx, l.IPN, "consigned", body.CM, -l.Qty, "return_from_cm", body.Reference, body.Notes, user, now); err != nil {
+			ve.Add(fmt.Sprintf("lines[%d].qty", i), err.Error())
+			continue
+		}
+		if _, err := tx.Exec("UPDATE inventory SET qty_on_hand = qty_on_hand + ?, updated_at = ? WHERE ipn = ?", l.Qty, now, l.IPN); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		if _, err := tx.Exec("INSERT INTO inventory_transactions (ipn,type,qty,reference,notes,created_at) VALUES (?,?,?,?,?,?)",
+			l.IPN, "return", l.Qty, body.Reference, note, now); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, user, "returned", "consignment", body.Reference, fmt.Sprintf("Returned %d line(s) from %s", len(body.Lines), body.CM))
+	balances, _ := loadOwnershipBalances("owner_type='consigned' AND owner=?", body.CM)
+	jsonResp(w, map[string]interface{}{"reference": body.Reference, "consigned": balances})
+}
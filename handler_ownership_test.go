@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postConsignment(t *testing.T, handler func(http.ResponseWriter, *http.Request), action, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/api/v1/consignment/"+action, bytes.NewBufferString(body)))
+	return w
+}
+
+func ownedQty(ownerType, owner, ipn string) float64 {
+	var qty float64
+	db.QueryRow("SELECT COALESCE(SUM(qty),0) FROM inventory_ownership WHERE owner_type=? AND owner=? AND ipn=?", ownerType, owner, ipn).Scan(&qty)
+	return qty
+}
+
+func TestCustomerOwnedAndConsignedStock(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+
+	stmts := []string{
+		`INSERT INTO vendors (id, name) VALUES ('CM-1', 'Board Works')`,
+		`INSERT INTO purchase_orders (id, vendor_id, status, created_at) VALUES ('PO-1', 'V-1', 'sent', '2026-01-01 00:00:00')`,
+		`INSERT INTO po_lines (id, po_id, ipn, qty_ordered, unit_price) VALUES (1, 'PO-1', 'RES-1', 100, 2)`,
+		`INSERT INTO work_orders (id, assembly_ipn, qty, status, customer) VALUES ('WO-1', 'ASY-9', 10, 'in_progress', 'ACME')`,
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("seed failed: %v\n%s", err, s)
+		}
+	}
+
+	// Our reel comes in at its PO price; the customer's reel isn't ours to cost
+	if w := postTransact(t, `{"ipn":"RES-1","type":"receive","qty":100,"lot_number":"R-OWN"}`); w.Code != 200 {
+		t.Fatalf("receive failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := postTransact(t, `{"ipn":"RES-1","type":"receive","qty":50,"lot_number":"R-ACME","customer":"ACME"}`); w.Code != 200 {
+		t.Fatalf("customer receive failed: %d %s", w.Code, w.Body.String())
+	}
+	if q := onHand("RES-1"); q != 150 {
+		t.Fatalf("expected 150 on hand, got %v", q)
+	}
+	if c := costLayers(t, "RES-1"); c.Qty != 100 || c.Value != 200 {
+		t.Errorf("expected only our 100 in cost layers, got %v worth %v", c.Qty, c.Value)
+	}
+
+	// Another job can't dip into the customer's stock
+	if w := postTransact(t, `{"ipn":"RES-1","type":"issue","qty":120}`); w.Code != 400 || !strings.Contains(w.Body.String(), "belongs to customers") {
+		t.Errorf("expected issuing customer stock to be refused, got %d %s", w.Code, w.Body.String())
+	}
+	// Their own WO uses their stock first, then ours
+	if w := postTransact(t, `{"ipn":"RES-1","type":"issue","qty":60,"reference":"WO-1"}`); w.Code != 200 {
+		t.Fatalf("WO issue failed: %d %s", w.Code, w.Body.String())
+	}
+	if q := ownedQty("customer", "ACME", "RES-1"); q != 0 {
+		t.Errorf("expected the customer's 50 used first, %v left", q)
+	}
+	if c := costLayers(t, "RES-1"); c.Qty != 90 {
+		t.Errorf("expected 10 of ours relieved, %v layered", c.Qty)
+	}
+	// Leftovers go back to the customer
+	if w := postTransact(t, `{"ipn":"RES-1","type":"return","qty":20,"reference":"WO-1"}`); w.Code != 200 {
+		t.Fatalf("return failed: %d %s", w.Code, w.Body.String())
+	}
+	if q := ownedQty("customer", "ACME", "RES-1"); q != 20 {
+		t.Errorf("expected 20 back with the customer, got %v", q)
+	}
+
+	// A kit goes to the CM and stays ours
+	if w := postConsignment(t, handleShipToCM, "ship", `{"cm":"CM-1","reference":"CMK-1","lines":[{"ipn":"RES-1","qty":30}]}`); w.Code != 200 {
+		t.Fatalf("ship to CM failed: %d %s", w.Code, w.Body.String())
+	}
+	if q, c := onHand("RES-1"), ownedQty("consigned", "CM-1", "RES-1"); q != 80 || c != 30 {
+		t.Errorf("expected 80 on hand and 30 at the CM, got %v and %v", q, c)
+	}
+	if c := costLayers(t, "RES-1"); c.Qty != 90 {
+		t.Errorf("expected consigned stock still costed, %v layered", c.Qty)
+	}
+	if w := postConsignment(t, handleShipToCM, "ship", `{"cm":"CM-1","lines":[{"ipn":"RES-1","qty":70}]}`); w.Code != 400 {
+		t.Errorf("expected shipping customer stock to the CM to be refused, got %d", w.Code)
+	}
+	if w := postConsignment(t, handleShipToCM, "ship", `{"cm":"NOPE","lines":[{"ipn":"RES-1","qty":1}]}`); w.Code != 400 {
+		t.Errorf("expected an unknown CM to be refused, got %d", w.Code)
+	}
+
+	// Finished boards come back at the components used plus conversion
+	body := `{"cm":"CM-1","reference":"CMR-1","assembly_ipn":"ASY-1","qty":10,"conversion_cost":5,"consumed":[{"ipn":"RES-1","qty":40}]}`
+	if w := postConsignment(t, handleReceiveFromCM, "receive", body); w.Code != 400 {
+		t.Errorf("expected consuming more than consigned to be refused, got %d", w.Code)
+	}
+	body = strings.Replace(body, `"qty":40`, `"qty":25`, 1)
+	w := postConsignment(t, handleReceiveFromCM, "receive", body)
+	if w.Code != 200 {
+		t.Fatalf("receive from CM failed: %d %s", w.Code, w.Body.String())
+	}
+	if q := onHand("ASY-1"); q != 10 {
+		t.Errorf("expected 10 assemblies on hand, got %v", q)
+	}
+	if c := costLayers(t, "ASY-1"); c.Qty != 10 || c.UnitCost != 10 {
+		t.Errorf("expected the assemblies at (25*2 + 10*5)/10 = 10, got %+v", c)
+	}
+	if c := costLayers(t, "RES-1"); c.Qty != 65 {
+		t.Errorf("expected the consumed 25 relieved, %v layered", c.Qty)
+	}
+
+	// The rest comes back unused
+	if w := postConsignment(t, handleReturnFromCM, "return", `{"cm":"CM-1","lines":[{"ipn":"RES-1","qty":5}]}`); w.Code != 200 {
+		t.Fatalf("return from CM failed: %d %s", w.Code, w.Body.String())
+	}
+	if q, c := onHand("RES-1"), ownedQty("consigned", "CM-1", "RES-1"); q != 85 || c != 0 {
+		t.Errorf("expected 85 on hand and nothing at the CM, got %v and %v", q, c)
+	}
+
+	// Valuation counts only our stock
+	w = httptest.NewRecorder()
+	handleReportInventoryValuation(w, httptest.NewRequest("GET", "/api/v1/reports/inventory-valuation", nil))
+	var report struct {
+		Data InvValuationReport `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &report)
+	items := map[string]InvValuationItem{}
+	for _, g := range report.Data.Groups {
+		for _, it := range g.Items {
+			items[it.IPN] = it
+		}
+	}
+	if it := items["RES-1"]; it.QtyOnHand != 65 || it.QtyCustomerOwned != 20 || it.Subtotal != 130 {
+		t.Errorf("unexpected RES-1 valuation: %+v", it)
+	}
+	if report.Data.GrandTotal != 230 {
+		t.Errorf("expected 230 in total, got %v", report.Data.GrandTotal)
+	}
+
+	w = httptest.NewRecorder()
+	handleListOwnership(w, httptest.NewRequest("GET", "/api/v1/consignment?owner_type=customer", nil))
+	var list struct {
+		Data []OwnershipBalance `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Data) != 1 || list.Data[0].Owner != "ACME" || list.Data[0].Qty != 20 {
+		t.Errorf("unexpected balances: %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handleListOwnershipMoves(w, httptest.NewRequest("GET", "/api/v1/consignment/moves?owner=CM-1", nil))
+	var moves struct {
+		Data []OwnershipMove `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &moves)
+	if len(moves.Data) != 3 || moves.Data[0].Type != "return_from_cm" || moves.Data[1].Type != "cm_consumed" || moves.Data[2].Type != "ship_to_cm" {
+		t.Errorf("unexpected moves: %s", w.Body.String())
+	}
+}
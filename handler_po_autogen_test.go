@@ -120,6 +120,7 @@ func setupPOAutogenTestDB(t *testing.T) *sql.DB {
 			reviewed_by TEXT,
 			reviewed_at DATETIME,
 			po_id TEXT,
+			source TEXT DEFAULT '',
 			FOREIGN KEY (vendor_id) REFERENCES vendors(id),
 			FOREIGN KEY (wo_id) REFERENCES work_orders(id)
 		)`,
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PrintTemplate is an admin-managed layout for a document type. Every change
+// to the body is kept as a new version.
+type PrintTemplate struct {
+	ID          int    `json:"id"`
+	DocType     string `json:"doc_type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	IsDefault   bool   `json:"is_default"`
+	Version     int    `json:"version"`
+	Body        string `json:"body,omitempty"`
+	CreatedBy   string `json:"created_by"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+}
+
+type PrintTemplateVersion struct {
+	ID         int    `json:"id"`
+	TemplateID int    `json:"template_id"`
+	Version    int    `json:"version"`
+	Body       string `json:"body"`
+	ChangeNote string `json:"change_note"`
+	CreatedBy  string `json:"created_by"`
+	CreatedAt  string `json:"created_at"`
+}
+
+const maxPrintTemplateSize = 256 * 1024
+
+// checkPrintTemplate parses a template body and runs it against a sample
+// record of its document type, so a bad field name fails on save rather
+// than when someone prints.
+func checkPrintTemplate(docType, body string) error {
+	if isLabelDocType(docType) {
+		return checkLabelTemplate(docType, body)
+	}
+	tmpl, err := parsePrintTemplate(docType, body)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(io.Discard, printSampleData(docType))
+}
+
+func getPrintTemplate(id string) (PrintTemplate, error) {
+	var t PrintTemplate
+	var isDefault int
+	err := db.QueryRow(`SELECT t.id, t.doc_type, t.name, COALESCE(t.description,''), t.is_default, t.current_version, v.body,
+		COALESCE(t.created_by,''), t.created_at, t.updated_at
+		FROM print_templates t JOIN print_template_versions v ON v.template_id = t.id AND v.version = t.current_version
+		WHERE t.id = ?`, id).
+		Scan(&t.ID, &t.DocType, &t.Name, &t.Description, &isDefault, &t.Version, &t.Body, &t.CreatedBy, &t.CreatedAt, &t.UpdatedAt)
+	t.IsDefault = isDefault != 0
+	return t, err
+}
+
+// savePrintTemplateVersion records body as the template's next version and
+// makes it current.
+func savePrintTemplateVersion(tx *sql.Tx, id int, body, note, user, now string) (int, error) {
+	var version int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(version),0)+1 FROM print_template_versions WHERE template_id=?", id).Scan(&version); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("INSERT INTO print_template_versions (template_id, version, body, change_note, created_by, created_at) VALUES (?,?,?,?,?,?)",
+		id, version, body, note, user, now); err != nil {
+		return 0, err
+	}
+	_, err := tx.Exec("UPDATE print_templates SET current_version=?, updated_at=? WHERE id=?", version, now, id)
+	return version, err
+}
+
+// setDefaultPrintTemplate makes a template the only default of its type.
+func setDefaultPrintTemplate(tx *sql.Tx, id int, docType string) error {
+	if _, err := tx.Exec("UPDATE print_templates SET is_default=0 WHERE doc_type=? AND id<>?", docType, id); err != nil {
+		return err
+	}
+	_, err := tx.Exec("UPDATE print_templates SET is_default=1 WHERE id=?", id)
+	return err
+}
+
+func handleListPrintTemplates(w http.ResponseWriter, r *http.Request) {
+	q := `SELECT id, doc_type, name, COALESCE(description,''), is_default, current_version, COALESCE(created_by,''), created_at, updated_at FROM print_templates`
+	var args []interface{}
+	if dt := r.URL.Query().Get("doc_type"); dt != "" {
+		q += " WHERE doc_type=?"
+		args = append(args, dt)
+	}
+	rows, err := db.Query(q+" ORDER BY doc_type, name", args...)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	items := []PrintTemplate{}
+	for rows.Next() {
+		var t PrintTemplate
+		var isDefault int
+		if err := rows.Scan(&t.ID, &t.DocType, &t.Name, &t.Description, &isDefault, &t.Version, &t.CreatedBy, &t.CreatedAt, &t.UpdatedAt); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		t.IsDefault = isDefault != 0
+		items = append(items, t)
+	}
+	jsonResp(w, items)
+}
+
+func handleGetPrintTemplate(w http.ResponseWriter, r *http.Request, id string) {
+	t, err := getPrintTemplate(id)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "print template not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	jsonResp(w, t)
+}
+
+// handleGetBuiltinPrintTemplate returns the layout a document type prints
+// with when it has no default template, as a starting point for new ones.
+func handleGetBuiltinPrintTemplate(w http.ResponseWriter, r *http.Request, docType string) {
+	body, ok := builtinPrintTemplates[docType]
+	if !ok {
+		jsonErr(w, "unknown document type "+docType, 404)
+		return
+	}
+	jsonResp(w, PrintTemplate{DocType: docType, Name: "built-in", Body: body})
+}
+
+func handleCreatePrintTemplate(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		PrintTemplate
+		ChangeNote string `json:"change_note"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	t := body.PrintTemplate
+	t.Name = strings.TrimSpace(t.Name)
+
+	ve := &ValidationErrors{}
+	requireField(ve, "doc_type", t.DocType)
+	validateEnum(ve, "doc_type", t.DocType, validPrintDocTypes)
+	requireField(ve, "name", t.Name)
+	validateMaxLength(ve, "name", t.Name, 100)
+	requireField(ve, "body", t.Body)
+	validateMaxLength(ve, "body", t.Body, maxPrintTemplateSize)
+	if !ve.HasErrors() {
+		if err := checkPrintTemplate(t.DocType, t.Body); err != nil {
+			ve.Add("body", err.Error())
+		}
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	user := getUsername(r)
+	now := time.Now().Format("2006-01-02 15:04:05")
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("INSERT INTO print_templates (doc_type, name, description, is_default, current_version, created_by, created_at, updated_at) VALUES (?,?,?,0,0,?,?,?)",
+		t.DocType, t.Name, t.Description, user, now, now)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			jsonErr(w, fmt.Sprintf("a %s template named %q already exists", t.DocType, t.Name), 400)
+		} else {
+			jsonErr(w, err.Error(), 500)
+		}
+		return
+	}
+	id, _ := res.LastInsertId()
+	note := body.ChangeNote
+	if note == "" {
+		note = "Created"
+	}
+	if _, err := savePrintTemplateVersion(tx, int(id), t.Body, note, user, now); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if t.IsDefault {
+		if err := setDefaultPrintTemplate(tx, int(id), t.DocType); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, user, "created", "print_template", strconv.Itoa(int(id)), fmt.Sprintf("Created %s print template %q", t.DocType, t.Name))
+	handleGetPrintTemplate(w, r, strconv.Itoa(int(id)))
+}
+
+// handleUpdatePrintTemplate changes a template's details; a new body becomes
+// its next version.
+func handleUpdatePrintTemplate(w http.ResponseWriter, r *http.Request, id string) {
+	existing, err := getPrintTemplate(id)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "print template not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	var body struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+		Body        *string `json:"body"`
+		IsDefault   *bool   `json:"is_default"`
+		ChangeNote  string  `json:"change_note"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	t := existing
+	if body.Name != nil {
+		t.Name = strings.TrimSpace(*body.Name)
+	}
+	if body.Description != nil {
+		t.Description = *body.Description
+	}
+	ve := &ValidationErrors{}
+	requireField(ve, "name", t.Name)
+	validateMaxLength(ve, "name", t.Name, 100)
+	newBody := body.Body != nil && *body.Body != existing.Body
+	if newBody {
+		requireField(ve, "body", *body.Body)
+		validateMaxLength(ve, "body", *body.Body, maxPrintTemplateSize)
+		if !ve.HasErrors() {
+			if err := checkPrintTemplate(t.DocType, *body.Body); err != nil {
+				ve.Add("body", err.Error())
+			}
+		}
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	user := getUsername(r)
+	now := time.Now().Format("2006-01-02 15:04:05")
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE print_templates SET name=?, description=?, updated_at=? WHERE id=?", t.Name, t.Description, now, t.ID); err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			jsonErr(w, fmt.Sprintf("a %s template named %q already exists", t.DocType, t.Name), 400)
+		} else {
+			jsonErr(w, err.Error(), 500)
+		}
+		return
+	}
+	summary := fmt.Sprintf("Updated %s print template %q", t.DocType, t.Name)
+	if newBody {
+		v, err := savePrintTemplateVersion(tx, t.ID, *body.Body, body.ChangeNote, user, now)
+		if err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		summary += fmt.Sprintf(" to version %d", v)
+	}
+	if body.IsDefault != nil {
+		if *body.IsDefault {
+			err = setDefaultPrintTemplate(tx, t.ID, t.DocType)
+		} else {
+			_, err = tx.Exec("UPDATE print_templates SET is_default=0 WHERE id=?", t.ID)
+		}
+		if err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, user, "updated", "print_template", id, summary)
+	handleGetPrintTemplate(w, r, id)
+}
+
+func handleDeletePrintTemplate(w http.ResponseWriter, r *http.Request, id string) {
+	t, err := getPrintTemplate(id)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "print template not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+	tx.Exec("DELETE FROM print_template_versions WHERE template_id=?", t.ID)
+	if _, err := tx.Exec("DELETE FROM print_templates WHERE id=?", t.ID); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, getUsername(r), "deleted", "print_template", id, fmt.Sprintf("Deleted %s print template %q", t.DocType, t.Name))
+	jsonResp(w, map[string]string{"status": "deleted"})
+}
+
+func handleListPrintTemplateVersions(w http.ResponseWriter, r *http.Request, id string) {
+	if _, err := getPrintTemplate(id); err == sql.ErrNoRows {
+		jsonErr(w, "print template not found", 404)
+		return
+	}
+	rows, err := db.Query(`SELECT id, template_id, version, body, COALESCE(change_note,''), COALESCE(created_by,''), created_at
+		FROM print_template_versions WHERE template_id=? ORDER BY version DESC`, id)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	versions := []PrintTemplateVersion{}
+	for rows.Next() {
+		var v PrintTemplateVersion
+		if err := rows.Scan(&v.ID, &v.TemplateID, &v.Version, &v.Body, &v.ChangeNote, &v.CreatedBy, &v.CreatedAt); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		versions = append(versions, v)
+	}
+	jsonResp(w, versions)
+}
+
+// handleRevertPrintTemplate brings back an earlier version's body as a new
+// version, so the history is never rewritten.
+func handleRevertPrintTemplate(w http.ResponseWriter, r *http.Request, id string) {
+	t, err := getPrintTemplate(id)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "print template not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	var body struct {
+		Version int `json:"version"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	var old string
+	if err := db.QueryRow("SELECT body FROM print_template_versions WHERE template_id=? AND version=?", t.ID, body.Version).Scan(&old); err != nil {
+		jsonErr(w, fmt.Sprintf("version %d not found", body.Version), 400)
+		return
+	}
+	if body.Version == t.Version {
+		jsonErr(w, fmt.Sprintf("version %d is already current", body.Version), 400)
+		return
+	}
+
+	user := getUsername(r)
+	now := time.Now().Format("2006-01-02 15:04:05")
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+	v, err := savePrintTemplateVersion(tx, t.ID, old, fmt.Sprintf("Reverted to version %d", body.Version), user, now)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, user, "updated", "print_template", id, fmt.Sprintf("Reverted print template %q to version %d as version %d", t.Name, body.Version, v))
+	handleGetPrintTemplate(w, r, id)
+}
+
+func handleGetPrintSettings(w http.ResponseWriter, r *http.Request) {
+	jsonResp(w, printCompany())
+}
+
+// handlePutPrintSettings sets the letterhead templates print with. The logo
+// is stored inline as a data: image URI so printed pages need no fetches.
+func handlePutPrintSettings(w http.ResponseWriter, r *http.Request) {
+	var s struct {
+		Name    string `json:"company_name"`
+		Email   string `json:"company_email"`
+		Address string `json:"company_address"`
+		Logo    string `json:"logo"`
+	}
+	if err := decodeBody(r, &s); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	ve := &ValidationErrors{}
+	validateMaxLength(ve, "company_name", s.Name, 200)
+	validateMaxLength(ve, "company_email", s.Email, 200)
+	validateMaxLength(ve, "company_address", s.Address, 1000)
+	validateMaxLength(ve, "logo", s.Logo, 512*1024)
+	if s.Logo != "" && !validLogoURI(s.Logo) {
+		ve.Add("logo", "must be a data:image/png, jpeg, gif or svg+xml base64 URI")
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+	for k, v := range map[string]string{printCompanyNameKey: s.Name, printCompanyEmailKey: s.Email, printCompanyAddressKey: s.Address, printCompanyLogoKey: s.Logo} {
+		if err := setAppSetting(k, v); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+	}
+	logAudit(db, getUsername(r), "updated", "settings", "print", "Updated print letterhead")
+	jsonResp(w, printCompany())
+}
+
+func validLogoURI(s string) bool {
+	for _, t := range []string{"png", "jpeg", "gif", "svg+xml"} {
+		if strings.HasPrefix(s, "data:image/"+t+";base64,") {
+			return !strings.ContainsAny(s, "\"'<> ")
+		}
+	}
+	return false
+}
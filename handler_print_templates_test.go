@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// seedTravelerWO creates WO-PDF for 2 x ASY-TOP with two serials assigned.
+func seedTravelerWO(t *testing.T) {
+	t.Helper()
+	setupMultiLevelBOM(t)
+	stmts := []string{
+		`INSERT INTO inventory (ipn, qty_on_hand) VALUES ('PCA-STK', 4)`,
+		`INSERT INTO work_orders (id, assembly_ipn, qty, status, created_at) VALUES ('WO-PDF', 'ASY-TOP', 2, 'open', '2026-01-01 00:00:00')`,
+		`INSERT INTO wo_serials (wo_id, serial_number) VALUES ('WO-PDF', 'SN-0001'), ('WO-PDF', 'SN-0002')`,
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("seed failed: %v\n%s", err, s)
+		}
+	}
+}
+
+func createPrintTemplate(t *testing.T, body string) (*httptest.ResponseRecorder, PrintTemplate) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleCreatePrintTemplate(w, httptest.NewRequest("POST", "/api/v1/print-templates", bytes.NewBufferString(body)))
+	var resp struct {
+		Data PrintTemplate `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp.Data
+}
+
+func updatePrintTemplate(t *testing.T, id int, body string) (*httptest.ResponseRecorder, PrintTemplate) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	sid := strconv.Itoa(id)
+	handleUpdatePrintTemplate(w, httptest.NewRequest("PUT", "/api/v1/print-templates/"+sid, bytes.NewBufferString(body)), sid)
+	var resp struct {
+		Data PrintTemplate `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp.Data
+}
+
+func printTraveler(t *testing.T, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleWorkOrderPDF(w, httptest.NewRequest("GET", "/api/v1/workorders/WO-PDF/pdf"+query, nil), "WO-PDF")
+	return w
+}
+
+func TestPrintTemplateVersionsAndDefaults(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedTravelerWO(t)
+
+	bad := []string{
+		`{"doc_type":"traveler","name":"Broken","body":"{{if}}"}`,
+		`{"doc_type":"traveler","name":"Unknown field","body":"{{.WO.Nope}}"}`,
+		`{"doc_type":"traveler","name":"Field in a range","body":"{{range .BOM}}{{.Nope}}{{end}}"}`,
+		`{"doc_type":"packing_slip","name":"X","body":"hi"}`,
+		`{"doc_type":"traveler","body":"hi"}`,
+	}
+	for _, b := range bad {
+		if w, _ := createPrintTemplate(t, b); w.Code != 400 {
+			t.Errorf("%s: expected 400, got %d %s", b, w.Code, w.Body.String())
+		}
+	}
+
+	v1 := `<h1>{{.Company.Name}} {{.WO.ID}}</h1>{{range .BOM}}<p>{{.IPN}} {{.RefDes}}</p>{{end}}{{range .Serials}}{{barcode .SerialNumber}}{{end}}`
+	body, _ := json.Marshal(map[string]interface{}{"doc_type": "traveler", "name": "Compact", "body": v1, "is_default": true})
+	w, tmpl := createPrintTemplate(t, string(body))
+	if w.Code != 200 || tmpl.Version != 1 || !tmpl.IsDefault {
+		t.Fatalf("create failed: %d %s", w.Code, w.Body.String())
+	}
+	if w, _ := createPrintTemplate(t, string(body)); w.Code != 400 {
+		t.Errorf("expected a duplicate name to be rejected, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handlePutPrintSettings(w, httptest.NewRequest("PUT", "/api/v1/settings/print", bytes.NewBufferString(`{"company_name":"Acme Labs","logo":"data:image/png;base64,iVBORw0KGgo="}`)))
+	if w.Code != 200 {
+		t.Fatalf("print settings failed: %d %s", w.Code, w.Body.String())
+	}
+	out := printTraveler(t, "").Body.String()
+	for _, want := range []string{"<h1>Acme Labs WO-PDF</h1>", "R1,R2,R3,R9", `data-barcode="SN-0002"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("default template output missing %q: %s", want, out)
+		}
+	}
+
+	// Editing the body keeps the old one as a version
+	w, tmpl = updatePrintTemplate(t, tmpl.ID, `{"body":"<h1>{{.WO.ID}} v2</h1>","change_note":"Shorter"}`)
+	if w.Code != 200 || tmpl.Version != 2 || !strings.Contains(printTraveler(t, "").Body.String(), "WO-PDF v2") {
+		t.Fatalf("expected version 2 in use, got %d %s", w.Code, w.Body.String())
+	}
+	if w, _ := updatePrintTemplate(t, tmpl.ID, `{"body":"{{.WO.Missing}}"}`); w.Code != 400 {
+		t.Errorf("expected a bad edit to be rejected, got %d", w.Code)
+	}
+	sid := strconv.Itoa(tmpl.ID)
+	w = httptest.NewRecorder()
+	handleRevertPrintTemplate(w, httptest.NewRequest("POST", "/api/v1/print-templates/"+sid+"/revert", bytes.NewBufferString(`{"version":1}`)), sid)
+	var reverted struct {
+		Data PrintTemplate `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &reverted)
+	if w.Code != 200 || reverted.Data.Version != 3 || reverted.Data.Body != v1 {
+		t.Errorf("expected version 1 restored as version 3, got %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handleListPrintTemplateVersions(w, httptest.NewRequest("GET", "/api/v1/print-templates/"+sid+"/versions", nil), sid)
+	var versions struct {
+		Data []PrintTemplateVersion `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &versions)
+	if len(versions.Data) != 3 || versions.Data[1].ChangeNote != "Shorter" || versions.Data[0].ChangeNote != "Reverted to version 1" {
+		t.Errorf("unexpected history: %+v", versions.Data)
+	}
+
+	// A second default takes over; with none, the built-in layout prints
+	_, other := createPrintTemplate(t, `{"doc_type":"traveler","name":"Other","body":"other {{.WO.ID}}","is_default":true}`)
+	if got, _ := getPrintTemplate(sid); got.IsDefault {
+		t.Error("expected only one default traveler template")
+	}
+	if !strings.HasPrefix(printTraveler(t, "").Body.String(), "other WO-PDF") {
+		t.Error("expected the new default to print")
+	}
+	if !strings.Contains(printTraveler(t, "?template="+sid).Body.String(), "Acme Labs WO-PDF") {
+		t.Error("expected ?template to pick a non-default template")
+	}
+	updatePrintTemplate(t, other.ID, `{"is_default":false}`)
+	if out := printTraveler(t, "").Body.String(); !strings.Contains(out, "Work Order Traveler") || !strings.Contains(out, `src="data:image/png;base64,iVBORw0KGgo="`) {
+		t.Errorf("expected the built-in traveler with the logo, got %s", out)
+	}
+	if w := printTraveler(t, "?template=999"); w.Code != 404 {
+		t.Errorf("expected 404 for an unknown template, got %d", w.Code)
+	}
+	// A quote can't be printed with a traveler template
+	w = httptest.NewRecorder()
+	handleQuotePDF(w, httptest.NewRequest("GET", "/api/v1/quotes/Q-1/pdf?template="+sid, nil), "Q-1")
+	if w.Code == 200 {
+		t.Error("expected the quote to refuse a traveler template")
+	}
+
+	w = httptest.NewRecorder()
+	handlePutPrintSettings(w, httptest.NewRequest("PUT", "/api/v1/settings/print", bytes.NewBufferString(`{"logo":"javascript:alert(1)"}`)))
+	if w.Code != 400 {
+		t.Errorf("expected a non-image logo to be rejected, got %d", w.Code)
+	}
+}
+
+func TestTravelerPDFWithBarcodes(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedTravelerWO(t)
+
+	w := printTraveler(t, "?format=pdf")
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/pdf" {
+		t.Fatalf("PDF failed: %d %s", w.Code, w.Body.String())
+	}
+	pdf := w.Body.String()
+	for _, want := range []string{"%PDF-1.4", "(Bill of Materials)", "R1,R2,R3,R9", "(SN-0001)", " re f\n", "%%EOF"} {
+		if !strings.Contains(pdf, want) {
+			t.Errorf("PDF missing %q", want)
+		}
+	}
+	// The cross-reference table has to point at the objects
+	var xref int
+	fmt.Sscanf(pdf[strings.LastIndex(pdf, "startxref")+len("startxref\n"):], "%d", &xref)
+	if !strings.HasPrefix(pdf[xref:], "xref") {
+		t.Fatalf("startxref %d doesn't point at the xref table", xref)
+	}
+	var off int
+	fmt.Sscanf(strings.Split(pdf[xref:], "\n")[3], "%d", &off)
+	if !strings.HasPrefix(pdf[off:], "1 0 obj") {
+		t.Errorf("xref entry for object 1 points at %q", pdf[off:off+10])
+	}
+
+	if w := printTraveler(t, "?format=docx"); w.Code != 400 {
+		t.Errorf("expected 400 for an unknown format, got %d", w.Code)
+	}
+}
+
+func TestCode128(t *testing.T) {
+	for i, p := range code128Patterns {
+		sum := 0
+		for _, d := range p {
+			sum += int(d - '0')
+		}
+		if want := map[bool]int{true: 13, false: 11}[i == 106]; sum != want {
+			t.Errorf("pattern %d is %d modules wide, want %d", i, sum, want)
+		}
+	}
+	// Start B, Z R P, check symbol (104+58+2*50+3*48) % 103 = 97, stop
+	widths, err := code128Widths("ZRP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, w := range widths {
+		total += w
+	}
+	if total != 5*11+13 || fmt.Sprint(widths[24:30]) != "[4 1 1 1 1 3]" {
+		t.Errorf("unexpected encoding of ZRP: %v", widths)
+	}
+	if _, err := code128Widths("naïve"); err == nil {
+		t.Error("expected non-ASCII to be refused")
+	}
+	if svg := string(barcodeSVG(`<"x">`)); !strings.Contains(svg, `data-barcode="&lt;&#34;x&#34;&gt;"`) {
+		t.Errorf("expected the barcode text escaped, got %s", svg)
+	}
+}
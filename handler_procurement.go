@@ -112,37 +112,19 @@ func handleGeneratePOFromWO(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get BOM shortages (same logic as handleWorkOrderBOM)
-	rows, err := db.Query("SELECT ipn, qty_on_hand FROM inventory")
+	// Buy only the purchased parts that are short; stocked sub-assemblies are built, not ordered
+	bom, err := explodeWorkOrderBOM(body.WOID, assemblyIPN, qty)
 	if err != nil {
 		jsonErr(w, err.Error(), 500)
 		return
 	}
-	defer rows.Close()
 
 	var lines []POLine
-	for rows.Next() {
-		var ipn string
-		var onHand float64
-		rows.Scan(&ipn, &onHand)
-		qtyRequired := float64(qty)
-		shortage := qtyRequired - onHand
-		if shortage > 0 {
-			var mpn, manufacturer string
-			fields, ferr := getPartByIPN(partsDir, ipn)
-			if ferr == nil {
-				for k, v := range fields {
-					kl := strings.ToLower(k)
-					if kl == "mpn" {
-						mpn = v
-					}
-					if kl == "manufacturer" {
-						manufacturer = v
-					}
-				}
-			}
-			lines = append(lines, POLine{IPN: ipn, MPN: mpn, Manufacturer: manufacturer, QtyOrdered: shortage})
+	for _, bl := range bom {
+		if bl.Shortage <= 0 || bl.SubAssembly {
+			continue
 		}
+		lines = append(lines, POLine{IPN: bl.IPN, MPN: bl.MPN, Manufacturer: bl.Manufacturer, QtyOrdered: bl.Shortage})
 	}
 
 	if len(lines) == 0 {
@@ -169,41 +151,89 @@ func handleGeneratePOFromWO(w http.ResponseWriter, r *http.Request) {
 	jsonResp(w, map[string]interface{}{"po_id": poID, "lines": len(lines)})
 }
 
+// POReceiptLine is a quantity received against a PO line.
+type POReceiptLine struct {
+	ID        int     `json:"id"`
+	Qty       float64 `json:"qty"`
+	LotNumber string  `json:"lot_number"`
+	DateCode  string  `json:"date_code"`
+	ExpiresAt string  `json:"expires_at"`
+}
+
 func handleReceivePO(w http.ResponseWriter, r *http.Request, id string) {
 	var body struct {
-		Lines []struct {
-			ID  int     `json:"id"`
-			Qty float64 `json:"qty"`
-		} `json:"lines"`
-		SkipInspection bool `json:"skip_inspection"`
+		Lines          []POReceiptLine `json:"lines"`
+		SkipInspection bool            `json:"skip_inspection"`
 	}
 	if err := decodeBody(r, &body); err != nil { jsonErr(w, "invalid body", 400); return }
+	ve := &ValidationErrors{}
+	for _, l := range body.Lines {
+		if l.ExpiresAt != "" { validateExpiryDate(ve, l.ExpiresAt) }
+	}
+	if ve.HasErrors() { jsonErr(w, ve.Error(), 400); return }
+	if err := receivePOLines(id, body.Lines, body.SkipInspection, nil); err != nil { jsonErr(w, err.Error(), 500); return }
+	logAudit(db, getUsername(r), "received", "po", id, "Received items on PO "+id)
+	go emailOnPOReceived(id)
+	handleGetPO(w, r, id)
+}
+
+// receivePOLines books receipts against a PO's lines, each into a new lot
+// (held for inspection unless skipInspection), and updates the PO's status.
+// posted, if not nil, runs in each line's transaction before it commits.
+func receivePOLines(id string, lines []POReceiptLine, skipInspection bool, posted func(*sql.Tx) error) error {
 	// Get vendor_id for price recording
 	var poVendorID string
 	db.QueryRow("SELECT COALESCE(vendor_id,'') FROM purchase_orders WHERE id=?", id).Scan(&poVendorID)
 
 	now := time.Now().Format("2006-01-02 15:04:05")
-	for _, l := range body.Lines {
-		db.Exec("UPDATE po_lines SET qty_received=qty_received+? WHERE id=?", l.Qty, l.ID)
+	for _, l := range lines {
 		var ipn string
 		var unitPrice float64
 		db.QueryRow("SELECT ipn, COALESCE(unit_price,0) FROM po_lines WHERE id=?", l.ID).Scan(&ipn, &unitPrice)
+		if ipn == "" {
+			db.Exec("UPDATE po_lines SET qty_received=qty_received+? WHERE id=?", l.Qty, l.ID)
+		}
 		// Record price history
 		if ipn != "" && unitPrice > 0 {
 			recordPriceFromPO(id, ipn, unitPrice, poVendorID)
 		}
 
 		if ipn != "" {
-			if body.SkipInspection {
+			// Every receipt becomes a lot; without a vendor lot number one is
+			// generated from the PO line
+			lineID := l.ID
+			lot := InventoryLot{IPN: ipn, LotNumber: l.LotNumber, DateCode: l.DateCode, VendorID: poVendorID,
+				POID: id, POLineID: &lineID, QtyReceived: l.Qty}
+			if l.ExpiresAt != "" { lot.ExpiresAt = &l.ExpiresAt }
+			defaultLot := fmt.Sprintf("%s-%d", id, l.ID)
+			tx, err := db.Begin()
+			if err != nil { return err }
+			// The line's received qty moves with its lot
+			if _, err = tx.Exec("UPDATE po_lines SET qty_received=qty_received+? WHERE id=?", l.Qty, l.ID); err != nil { tx.Rollback(); return err }
+			if skipInspection {
 				// Legacy behavior: directly update inventory
-				db.Exec("INSERT OR IGNORE INTO inventory (ipn) VALUES (?)", ipn)
-				db.Exec("UPDATE inventory SET qty_on_hand=qty_on_hand+?,updated_at=? WHERE ipn=?", l.Qty, now, ipn)
-				db.Exec("INSERT INTO inventory_transactions (ipn,type,qty,reference,created_at) VALUES (?,?,?,?,?)", ipn, "receive", l.Qty, id, now)
+				tx.Exec("INSERT OR IGNORE INTO inventory (ipn) VALUES (?)", ipn)
+				tx.Exec("UPDATE inventory SET qty_on_hand=qty_on_hand+?,updated_at=? WHERE ipn=?", l.Qty, now, ipn)
+				lot.QtyOnHand, lot.ReceivedAt = l.Qty, &now
+				var lotID int
+				lotID, err = createLot(tx, lot, defaultLot)
+				if err == nil { err = recordLotTransaction(tx, lotID, ipn, "receive", l.Qty, id, "", now) }
+				if err == nil { err = syncCostLayers(tx, ipn, "receipt", id, unitPrice, now) }
 			} else {
 				// Create receiving inspection record (inventory updated after inspection)
-				db.Exec(`INSERT INTO receiving_inspections (po_id,po_line_id,ipn,qty_received,created_at) VALUES (?,?,?,?,?)`,
+				var res sql.Result
+				res, err = tx.Exec(`INSERT INTO receiving_inspections (po_id,po_line_id,ipn,qty_received,created_at) VALUES (?,?,?,?,?)`,
 					id, l.ID, ipn, l.Qty, now)
+				if err == nil {
+					riID64, _ := res.LastInsertId()
+					riID := int(riID64)
+					lot.ReceivingInspectionID, lot.Status = &riID, "inspection"
+					_, err = createLot(tx, lot, defaultLot)
+				}
 			}
+			if err == nil && posted != nil { err = posted(tx) }
+			if err == nil { err = tx.Commit() }
+			if err != nil { tx.Rollback(); return err }
 		}
 	}
 	// Check if all received
@@ -214,9 +244,7 @@ func handleReceivePO(w http.ResponseWriter, r *http.Request, id string) {
 	} else {
 		db.Exec("UPDATE purchase_orders SET status='partial' WHERE id=?", id)
 	}
-	logAudit(db, getUsername(r), "received", "po", id, "Received items on PO "+id)
-	go emailOnPOReceived(id)
-	handleGetPO(w, r, id)
+	return nil
 }
 
 // handleGeneratePOSuggestions analyzes BOM shortages and creates PO suggestions (not actual POs)
@@ -369,6 +397,194 @@ func handleGeneratePOSuggestions(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// POSuggestion is a proposed PO awaiting review, from BOM shortage analysis
+// of a work order, an MRP run or the reorder point job (source "reorder").
+type POSuggestion struct {
+	ID         int                `json:"id"`
+	WOID       string             `json:"wo_id"`
+	MRPRunID   *int               `json:"mrp_run_id"`
+	Source     string             `json:"source"`
+	VendorID   string             `json:"vendor_id"`
+	Status     string             `json:"status"`
+	Notes      string             `json:"notes"`
+	CreatedAt  string             `json:"created_at"`
+	ReviewedBy string             `json:"reviewed_by"`
+	ReviewedAt *string            `json:"reviewed_at"`
+	POID       string             `json:"po_id"`
+	Lines      []POSuggestionLine `json:"lines"`
+}
+
+type POSuggestionLine struct {
+	ID                 int                  `json:"id"`
+	IPN                string               `json:"ipn"`
+	MPN                string               `json:"mpn"`
+	Manufacturer       string               `json:"manufacturer"`
+	QtyNeeded          float64              `json:"qty_needed"`
+	EstimatedUnitPrice float64              `json:"estimated_unit_price"`
+	Notes              string               `json:"notes"`
+	Reorder            *POSuggestionReorder `json:"reorder,omitempty"`
+}
+
+// POSuggestionReorder is the stock position a reorder point suggestion was
+// made from. Demand is what open reservations still need.
+type POSuggestionReorder struct {
+	OnHand       float64 `json:"on_hand"`
+	OnOrder      float64 `json:"on_order"`
+	Demand       float64 `json:"demand"`
+	ReorderPoint float64 `json:"reorder_point"`
+	ReorderQty   float64 `json:"reorder_qty"`
+}
+
+// loadPOSuggestions loads the suggestions matching where, newest first,
+// with their lines.
+func loadPOSuggestions(where string, args ...interface{}) ([]POSuggestion, error) {
+	rows, err := db.Query(`SELECT id, COALESCE(wo_id,''), mrp_run_id, COALESCE(source,''), vendor_id, status, COALESCE(notes,''), created_at,
+		COALESCE(reviewed_by,''), reviewed_at, COALESCE(po_id,'') FROM po_suggestions WHERE `+where+` ORDER BY id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	items := []POSuggestion{}
+	for rows.Next() {
+		var s POSuggestion
+		var runID sql.NullInt64
+		var ra sql.NullString
+		rows.Scan(&s.ID, &s.WOID, &runID, &s.Source, &s.VendorID, &s.Status, &s.Notes, &s.CreatedAt, &s.ReviewedBy, &ra, &s.POID)
+		if runID.Valid {
+			v := int(runID.Int64)
+			s.MRPRunID = &v
+		}
+		s.ReviewedAt = sp(ra)
+		items = append(items, s)
+	}
+	rows.Close()
+
+	for i := range items {
+		items[i].Lines = []POSuggestionLine{}
+		lines, err := db.Query(`SELECT id, ipn, COALESCE(mpn,''), COALESCE(manufacturer,''), qty_needed, COALESCE(estimated_unit_price,0), COALESCE(notes,''),
+			on_hand, COALESCE(on_order,0), COALESCE(demand,0), COALESCE(reorder_point,0), COALESCE(reorder_qty,0)
+			FROM po_suggestion_lines WHERE suggestion_id = ? ORDER BY id`, items[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		for lines.Next() {
+			var l POSuggestionLine
+			var onHand sql.NullFloat64
+			var ro POSuggestionReorder
+			lines.Scan(&l.ID, &l.IPN, &l.MPN, &l.Manufacturer, &l.QtyNeeded, &l.EstimatedUnitPrice, &l.Notes,
+				&onHand, &ro.OnOrder, &ro.Demand, &ro.ReorderPoint, &ro.ReorderQty)
+			if onHand.Valid {
+				ro.OnHand = onHand.Float64
+				l.Reorder = &ro
+			}
+			items[i].Lines = append(items[i].Lines, l)
+		}
+		lines.Close()
+	}
+	return items, nil
+}
+
+// handleListPOSuggestions lists PO suggestions with their lines, filterable
+// by ?status=, ?mrp_run_id= and ?source=.
+func handleListPOSuggestions(w http.ResponseWriter, r *http.Request) {
+	where := "1=1"
+	var args []interface{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		where += " AND status = ?"
+		args = append(args, status)
+	}
+	if runID := r.URL.Query().Get("mrp_run_id"); runID != "" {
+		where += " AND mrp_run_id = ?"
+		args = append(args, runID)
+	}
+	if source := r.URL.Query().Get("source"); source != "" {
+		where += " AND source = ?"
+		args = append(args, source)
+	}
+	items, err := loadPOSuggestions(where, args...)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	jsonResp(w, items)
+}
+
+// poSuggestionSource describes where a suggestion came from for audit and
+// PO notes.
+func poSuggestionSource(woID, source string) string {
+	switch {
+	case woID != "":
+		return "WO " + woID
+	case source == "reorder":
+		return "reorder point"
+	}
+	// MRP suggestions aren't tied to a single work order
+	return "MRP"
+}
+
+// createPOFromSuggestions creates one draft PO for vendorID holding the
+// lines of the given suggestions and links each suggestion to it.
+func createPOFromSuggestions(vendorID string, suggestionIDs []int, notes, user, now string) (string, error) {
+	poID := nextID("PO", "purchase_orders", 4)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`
+		INSERT INTO purchase_orders (id, vendor_id, status, notes, created_at, created_by)
+		VALUES (?, ?, 'draft', ?, ?, ?)
+	`, poID, vendorID, notes, now, user); err != nil {
+		return "", err
+	}
+
+	// Read all lines before inserting so the query isn't held open
+	// across the writes
+	type suggestionLine struct {
+		ipn, mpn, manufacturer, notes string
+		qtyNeeded, unitPrice          float64
+	}
+	for _, sid := range suggestionIDs {
+		rows, err := tx.Query(`
+			SELECT ipn, COALESCE(mpn, ''), COALESCE(manufacturer, ''), qty_needed, estimated_unit_price, COALESCE(notes, '')
+			FROM po_suggestion_lines
+			WHERE suggestion_id = ?
+		`, sid)
+		if err != nil {
+			return "", err
+		}
+		var lines []suggestionLine
+		for rows.Next() {
+			var l suggestionLine
+			rows.Scan(&l.ipn, &l.mpn, &l.manufacturer, &l.qtyNeeded, &l.unitPrice, &l.notes)
+			lines = append(lines, l)
+		}
+		rows.Close()
+
+		for _, l := range lines {
+			// Skip lines with zero or negative quantity
+			if l.qtyNeeded <= 0 {
+				continue
+			}
+			if _, err := tx.Exec(`
+				INSERT INTO po_lines (po_id, ipn, mpn, manufacturer, qty_ordered, unit_price, notes)
+				VALUES (?, ?, ?, ?, ?, ?, ?)
+			`, poID, l.ipn, l.mpn, l.manufacturer, l.qtyNeeded, l.unitPrice, l.notes); err != nil {
+				return "", err
+			}
+		}
+
+		// Link PO back to suggestion
+		if _, err := tx.Exec("UPDATE po_suggestions SET po_id = ? WHERE id = ?", poID, sid); err != nil {
+			return "", err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return poID, nil
+}
+
 // handleReviewPOSuggestion approves or rejects a PO suggestion, optionally creating the PO
 func handleReviewPOSuggestion(w http.ResponseWriter, r *http.Request, suggestionID int) {
 	var body struct {
@@ -387,9 +603,9 @@ func handleReviewPOSuggestion(w http.ResponseWriter, r *http.Request, suggestion
 	}
 
 	// Verify suggestion exists
-	var woID, vendorID, currentStatus string
-	err := db.QueryRow("SELECT wo_id, vendor_id, status FROM po_suggestions WHERE id = ?", suggestionID).
-		Scan(&woID, &vendorID, &currentStatus)
+	var woID, vendorID, currentStatus, sourceType string
+	err := db.QueryRow("SELECT COALESCE(wo_id,''), vendor_id, status, COALESCE(source,'') FROM po_suggestions WHERE id = ?", suggestionID).
+		Scan(&woID, &vendorID, &currentStatus, &sourceType)
 	if err != nil {
 		jsonErr(w, "suggestion not found", 404)
 		return
@@ -416,62 +632,21 @@ func handleReviewPOSuggestion(w http.ResponseWriter, r *http.Request, suggestion
 		return
 	}
 
+	source := poSuggestionSource(woID, sourceType)
+
 	logAudit(db, reviewedBy, body.Status, "po_suggestion", fmt.Sprintf("%d", suggestionID), 
-		fmt.Sprintf("%s PO suggestion #%d for WO %s", strings.Title(body.Status), suggestionID, woID))
+		fmt.Sprintf("%s PO suggestion #%d for %s", strings.Title(body.Status), suggestionID, source))
 
 	var poID string
 
 	// If approved and create_po is true, create the actual PO
 	if body.Status == "approved" && body.CreatePO {
-		poID = nextID("PO", "purchase_orders", 4)
-		
-		// Create PO header
-		_, err = db.Exec(`
-			INSERT INTO purchase_orders (id, vendor_id, status, notes, created_at, created_by)
-			VALUES (?, ?, 'draft', ?, ?, ?)
-		`, poID, vendorID, fmt.Sprintf("Created from suggestion #%d for WO %s", suggestionID, woID), now, reviewedBy)
-
-		if err != nil {
-			jsonErr(w, err.Error(), 500)
-			return
-		}
-
-		// Copy suggestion lines to PO lines
-		rows, err := db.Query(`
-			SELECT ipn, COALESCE(mpn, ''), COALESCE(manufacturer, ''), qty_needed, estimated_unit_price, COALESCE(notes, '')
-			FROM po_suggestion_lines
-			WHERE suggestion_id = ?
-		`, suggestionID)
-
+		poID, err = createPOFromSuggestions(vendorID, []int{suggestionID},
+			fmt.Sprintf("Created from suggestion #%d for %s", suggestionID, source), reviewedBy, now)
 		if err != nil {
 			jsonErr(w, err.Error(), 500)
 			return
 		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var ipn, mpn, manufacturer, notes string
-			var qtyNeeded, unitPrice float64
-			rows.Scan(&ipn, &mpn, &manufacturer, &qtyNeeded, &unitPrice, &notes)
-
-			// Skip lines with zero or negative quantity
-			if qtyNeeded <= 0 {
-				continue
-			}
-
-			_, err = db.Exec(`
-				INSERT INTO po_lines (po_id, ipn, mpn, manufacturer, qty_ordered, unit_price, notes)
-				VALUES (?, ?, ?, ?, ?, ?, ?)
-			`, poID, ipn, mpn, manufacturer, qtyNeeded, unitPrice, notes)
-
-			if err != nil {
-				jsonErr(w, err.Error(), 500)
-				return
-			}
-		}
-
-		// Link PO back to suggestion
-		db.Exec("UPDATE po_suggestions SET po_id = ? WHERE id = ?", poID, suggestionID)
 
 		logAudit(db, reviewedBy, "created", "po", poID, fmt.Sprintf("Created PO %s from approved suggestion #%d", poID, suggestionID))
 		recordChangeJSON(reviewedBy, "purchase_orders", poID, "create", nil, map[string]interface{}{
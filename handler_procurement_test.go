@@ -175,6 +175,33 @@ func setupProcurementTestDB(t *testing.T) *sql.DB {
 			qty REAL NOT NULL,
 			reference TEXT,
 			notes TEXT,
+			lot_id INTEGER,
+			location TEXT DEFAULT '',
+			to_location TEXT DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE inventory_lots (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ipn TEXT NOT NULL,
+			lot_number TEXT NOT NULL,
+			date_code TEXT DEFAULT '',
+			vendor_id TEXT DEFAULT '',
+			po_id TEXT DEFAULT '',
+			po_line_id INTEGER,
+			receiving_inspection_id INTEGER,
+			wo_id TEXT DEFAULT '',
+			qty_received REAL DEFAULT 0,
+			qty_on_hand REAL DEFAULT 0,
+			status TEXT DEFAULT 'available',
+			received_at DATETIME,
+			notes TEXT DEFAULT '',
+			location TEXT DEFAULT '',
+			msl_level TEXT DEFAULT '',
+			msl_floor_life_hours REAL,
+			msl_state TEXT DEFAULT 'sealed',
+			msl_exposure_hours REAL DEFAULT 0,
+			msl_opened_at DATETIME,
+			expires_at DATE,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		)
 	`)
@@ -513,6 +540,17 @@ func TestHandleGeneratePOFromWO_Success(t *testing.T) {
 
 	db.Exec(`INSERT INTO vendors (id, name) VALUES ('VEN-001', 'Test Vendor')`)
 
+	// BOM: 1x IPN-001 and 2x IPN-002 per assembly
+	dir := t.TempDir()
+	oldPartsDir := partsDir
+	partsDir = dir
+	defer func() { partsDir = oldPartsDir }()
+	createBOMFile(t, dir, "ASSY-001", [][]string{
+		{"IPN", "qty", "ref"},
+		{"IPN-001", "1", "U1"},
+		{"IPN-002", "2", "C1,C2"},
+	})
+
 	reqBody := `{
 		"wo_id": "WO-001",
 		"vendor_id": "VEN-001"
@@ -546,6 +584,29 @@ func TestHandleGeneratePOFromWO_Success(t *testing.T) {
 	if vendorID != "VEN-001" {
 		t.Errorf("Expected vendor VEN-001, got %s", vendorID)
 	}
+
+	// Shortages: IPN-001 needs 10 (5 on hand), IPN-002 needs 20 (8 on hand)
+	want := map[string]float64{"IPN-001": 5, "IPN-002": 12}
+	rows, err := db.Query("SELECT ipn, qty_ordered FROM po_lines WHERE po_id=?", poID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := map[string]float64{}
+	for rows.Next() {
+		var ipn string
+		var q float64
+		rows.Scan(&ipn, &q)
+		got[ipn] = q
+	}
+	for ipn, q := range want {
+		if got[ipn] != q {
+			t.Errorf("Expected %s ordered qty %v, got %v", ipn, q, got[ipn])
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("Expected %d PO lines, got %d: %v", len(want), len(got), got)
+	}
 }
 
 func TestHandleGeneratePOFromWO_MissingWOID(t *testing.T) {
@@ -3,7 +3,6 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"html"
 	"math"
 	"net/http"
 	"time"
@@ -43,6 +42,7 @@ func handleGetQuote(w http.ResponseWriter, r *http.Request, id string) {
 		}
 	}
 	if q.Lines == nil { q.Lines = []QuoteLine{} }
+	attachQuoteATP(q.Lines)
 	jsonResp(w, q)
 }
 
@@ -75,6 +75,8 @@ func handleCreateQuote(w http.ResponseWriter, r *http.Request) {
 	q.CreatedAt = now
 	logAudit(db, getUsername(r), "created", "quote", q.ID, "Created "+q.ID+" for "+q.Customer)
 	recordChangeJSON(getUsername(r), "quotes", q.ID, "create", nil, q)
+	// Sales sees straight away what can ship from stock and from when
+	attachQuoteATP(q.Lines)
 	jsonResp(w, q)
 }
 
@@ -172,88 +174,15 @@ func handleQuotePDF(w http.ResponseWriter, r *http.Request, id string) {
 		}
 	}
 
-	lineRows := ""
-	total := 0.0
+	data := QuotePrint{Company: printCompany(), Generated: time.Now().Format("2006-01-02 15:04"), Quote: q, Date: q.CreatedAt}
+	if len(data.Date) > 10 {
+		data.Date = data.Date[:10]
+	}
 	for _, l := range q.Lines {
 		lineTotal := float64(l.Qty) * l.UnitPrice
-		total += lineTotal
-		lineRows += fmt.Sprintf(`<tr><td>%s</td><td>%s</td><td style="text-align:center">%d</td><td style="text-align:right">$%.2f</td><td style="text-align:right">$%.2f</td></tr>`,
-			html.EscapeString(l.IPN), html.EscapeString(l.Description), l.Qty, l.UnitPrice, lineTotal)
-	}
-	if lineRows == "" {
-		lineRows = `<tr><td colspan="5" style="text-align:center;color:#999">No line items</td></tr>`
-	}
-
-	date := q.CreatedAt
-	if len(date) > 10 {
-		date = date[:10]
+		data.Total += lineTotal
+		data.Lines = append(data.Lines, QuotePrintLine{QuoteLine: l, Total: lineTotal})
 	}
 
-	htmlOutput := fmt.Sprintf(`<!DOCTYPE html>
-<html><head><meta charset="UTF-8"><title>Quote — %s</title>
-<style>
-  * { margin: 0; padding: 0; box-sizing: border-box; }
-  body { font-family: Arial, Helvetica, sans-serif; font-size: 11pt; color: #000; padding: 0.5in; }
-  h1 { font-size: 18pt; margin-bottom: 2pt; }
-  h2 { font-size: 13pt; margin: 16pt 0 6pt; border-bottom: 2px solid #000; padding-bottom: 3pt; }
-  table { width: 100%%; border-collapse: collapse; margin-bottom: 12pt; }
-  th, td { border: 1px solid #000; padding: 4pt 6pt; text-align: left; font-size: 10pt; }
-  th { background: #eee; font-weight: bold; }
-  .header { display: flex; justify-content: space-between; align-items: flex-start; border-bottom: 3px solid #000; padding-bottom: 8pt; margin-bottom: 12pt; }
-  .info-grid { display: grid; grid-template-columns: auto 1fr; gap: 4pt 12pt; margin-bottom: 12pt; font-size: 10pt; }
-  .info-grid dt { font-weight: bold; }
-  .total-row td { font-weight: bold; font-size: 11pt; }
-  .footer { margin-top: 24pt; font-size: 9pt; color: #555; border-top: 1px solid #999; padding-top: 8pt; }
-  @media print { body { padding: 0; } @page { margin: 0.5in; } }
-</style>
-</head><body>
-<div class="header">
-  <div>
-    <h1>ZRP — Quote</h1>
-    <div style="font-size:10pt;color:#555">` + companyName + `</div>
-  </div>
-  <div style="text-align:right;font-size:10pt">
-    <div><strong>Quote:</strong> %s</div>
-    <div><strong>Date:</strong> %s</div>
-    <div><strong>Valid Until:</strong> %s</div>
-    <div><strong>Status:</strong> %s</div>
-  </div>
-</div>
-
-<h2>Customer</h2>
-<div class="info-grid">
-  <dt>Customer:</dt><dd>%s</dd>
-</div>
-
-<h2>Line Items</h2>
-<table>
-  <thead><tr><th>IPN</th><th>Description</th><th style="text-align:center">Qty</th><th style="text-align:right">Unit Price</th><th style="text-align:right">Total</th></tr></thead>
-  <tbody>%s
-    <tr class="total-row"><td colspan="4" style="text-align:right;border-top:2px solid #000">Subtotal:</td><td style="text-align:right;border-top:2px solid #000">$%.2f</td></tr>
-  </tbody>
-</table>
-
-%s
-
-<div class="footer">
-  <p><strong>Terms:</strong> Net 30. Prices valid through the date shown above.</p>
-  <p><strong>Contact:</strong> ` + companyEmail + ` | ` + companyName + `</p>
-</div>
-
-<script>window.onload = () => window.print()</script>
-</body></html>`,
-		html.EscapeString(q.ID), html.EscapeString(q.ID), html.EscapeString(date), html.EscapeString(q.ValidUntil), html.EscapeString(q.Status),
-		html.EscapeString(q.Customer), lineRows, total,
-		func() string {
-			if q.Notes != "" {
-				return fmt.Sprintf(`<h2>Notes</h2><p style="font-size:10pt">%s</p>`, html.EscapeString(q.Notes))
-			}
-			return ""
-		}())
-
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.Header().Set("X-Frame-Options", "DENY")
-	w.Write([]byte(htmlOutput))
+	renderPrintDocument(w, r, "quote", "html", "quote_"+q.ID, data)
 }
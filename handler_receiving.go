@@ -113,19 +113,52 @@ func handleInspectReceiving(w http.ResponseWriter, r *http.Request, idStr string
 	}
 
 	now := time.Now().Format("2006-01-02 15:04:05")
-	_, err = db.Exec(`UPDATE receiving_inspections SET qty_passed=?, qty_failed=?, qty_on_hold=?, inspector=?, inspected_at=?, notes=? WHERE id=?`,
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`UPDATE receiving_inspections SET qty_passed=?, qty_failed=?, qty_on_hold=?, inspector=?, inspected_at=?, notes=? WHERE id=?`,
 		body.QtyPassed, body.QtyFailed, body.QtyOnHold, inspector, now, body.Notes, id)
 	if err != nil {
 		jsonErr(w, err.Error(), 500)
 		return
 	}
 
-	// If items passed, update inventory
-	if body.QtyPassed > 0 {
-		db.Exec("INSERT OR IGNORE INTO inventory (ipn) VALUES (?)", ri.IPN)
-		db.Exec("UPDATE inventory SET qty_on_hand=qty_on_hand+?,updated_at=? WHERE ipn=?", body.QtyPassed, now, ri.IPN)
-		db.Exec("INSERT INTO inventory_transactions (ipn,type,qty,reference,notes,created_at) VALUES (?,?,?,?,?,?)",
-			ri.IPN, "receive", body.QtyPassed, ri.POID, fmt.Sprintf("Inspection passed (RI-%d)", id), now)
+	// Passed qty goes into the receipt's lot and into inventory
+	var lotID int
+	err = tx.QueryRow("SELECT id FROM inventory_lots WHERE receiving_inspection_id=?", id).Scan(&lotID)
+	if err == sql.ErrNoRows {
+		// Received before lot tracking
+		var vendorID string
+		tx.QueryRow("SELECT COALESCE(vendor_id,'') FROM purchase_orders WHERE id=?", ri.POID).Scan(&vendorID)
+		lotID, err = createLot(tx, InventoryLot{IPN: ri.IPN, VendorID: vendorID, POID: ri.POID, POLineID: &ri.POLineID,
+			ReceivingInspectionID: &id, QtyReceived: ri.QtyReceived, Status: "inspection"}, fmt.Sprintf("%s-%d", ri.POID, ri.POLineID))
+	}
+	if err == nil {
+		lotStatus := "depleted"
+		if body.QtyPassed > 0 {
+			lotStatus = "available"
+		}
+		_, err = tx.Exec("UPDATE inventory_lots SET qty_on_hand=?, status=?, received_at=? WHERE id=?", body.QtyPassed, lotStatus, now, lotID)
+	}
+	if err == nil && body.QtyPassed > 0 {
+		tx.Exec("INSERT OR IGNORE INTO inventory (ipn) VALUES (?)", ri.IPN)
+		tx.Exec("UPDATE inventory SET qty_on_hand=qty_on_hand+?,updated_at=? WHERE ipn=?", body.QtyPassed, now, ri.IPN)
+		err = recordLotTransaction(tx, lotID, ri.IPN, "receive", body.QtyPassed, ri.POID, fmt.Sprintf("Inspection passed (RI-%d)", id), now)
+	}
+	if err == nil && body.QtyPassed > 0 {
+		var unitPrice float64
+		tx.QueryRow("SELECT COALESCE(unit_price,0) FROM po_lines WHERE id=?", ri.POLineID).Scan(&unitPrice)
+		err = syncCostLayers(tx, ri.IPN, "receipt", ri.POID, unitPrice, now)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
 	}
 
 	// If items failed, auto-create NCR
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReorderSkip is a part at or below its reorder point that got no
+// suggestion.
+type ReorderSkip struct {
+	IPN    string `json:"ipn"`
+	Reason string `json:"reason"`
+}
+
+// reorderMu keeps on-demand and scheduled runs from suggesting the same
+// parts twice.
+var reorderMu sync.Mutex
+
+// reorderLotQty is what to order to lift a stock position back above the
+// reorder point: whole reorder qty lots, the reorder point itself being the
+// lot when no reorder qty is set, and at least the vendor's minimum.
+func reorderLotQty(position, reorderPoint, reorderQty, minQty float64) float64 {
+	lot := reorderQty
+	if lot <= 0 {
+		lot = reorderPoint
+	}
+	qty := lot * (math.Floor((reorderPoint-position)/lot) + 1)
+	return math.Max(qty, minQty)
+}
+
+// generateReorderSuggestions finds parts whose stock position (on hand plus
+// on order less open reservations) is at or below their reorder point and
+// suggests replenishing them from their vendor, one pending suggestion per
+// vendor. The vendor is the latest one in price history, preferring vendors
+// marked preferred and leaving out blocked or inactive ones. Parts already
+// on a pending suggestion are left for the buyer to review first.
+func generateReorderSuggestions(user string, now time.Time) ([]int, []ReorderSkip, error) {
+	reorderMu.Lock()
+	defer reorderMu.Unlock()
+
+	pending := map[string]bool{}
+	rows, err := db.Query(`SELECT DISTINCT l.ipn FROM po_suggestion_lines l JOIN po_suggestions s ON s.id = l.suggestion_id
+		WHERE s.status = 'pending'`)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var ipn string
+		rows.Scan(&ipn)
+		pending[ipn] = true
+	}
+	rows.Close()
+
+	onOrder := map[string]float64{}
+	rows, err = db.Query(`SELECT l.ipn, SUM(l.qty_ordered - l.qty_received) FROM po_lines l
+		JOIN purchase_orders p ON p.id = l.po_id
+		WHERE p.status IN ('draft','sent','confirmed','partial') AND l.qty_ordered > l.qty_received GROUP BY l.ipn`)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var ipn string
+		var qty float64
+		rows.Scan(&ipn, &qty)
+		onOrder[ipn] = qty
+	}
+	rows.Close()
+
+	type need struct {
+		ipn, mpn       string
+		reason         POSuggestionReorder
+		qty, unitPrice float64
+	}
+	// Stock customers own isn't ours to build with
+	customerOwned, _ := ownershipTotals()
+	var needs []need
+	rows, err = db.Query(`SELECT ipn, qty_on_hand, qty_reserved, reorder_point, reorder_qty, COALESCE(mpn,'') FROM inventory
+		WHERE reorder_point > 0 ORDER BY ipn`)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var n need
+		rows.Scan(&n.ipn, &n.reason.OnHand, &n.reason.Demand, &n.reason.ReorderPoint, &n.reason.ReorderQty, &n.mpn)
+		n.reason.OnHand = math.Max(0, n.reason.OnHand-customerOwned[n.ipn])
+		n.reason.OnOrder = onOrder[n.ipn]
+		if pending[n.ipn] || n.reason.OnHand+n.reason.OnOrder-n.reason.Demand > n.reason.ReorderPoint {
+			continue
+		}
+		needs = append(needs, n)
+	}
+	rows.Close()
+
+	skips := []ReorderSkip{}
+	var vendors []string
+	byVendor := map[string][]need{}
+	for _, n := range needs {
+		var vendorID string
+		var minQty float64
+		err := db.QueryRow(`SELECT ph.vendor_id, ph.unit_price, COALESCE(ph.min_qty,1) FROM price_history ph
+			LEFT JOIN vendors v ON v.id = ph.vendor_id
+			WHERE ph.ipn = ? AND COALESCE(ph.vendor_id,'') != '' AND COALESCE(v.status,'active') NOT IN ('blocked','inactive')
+			ORDER BY COALESCE(v.status,'') = 'preferred' DESC, ph.recorded_at DESC, ph.id DESC LIMIT 1`, n.ipn).
+			Scan(&vendorID, &n.unitPrice, &minQty)
+		if err != nil {
+			skips = append(skips, ReorderSkip{n.ipn, "no usable vendor in price history for this part"})
+			continue
+		}
+		position := n.reason.OnHand + n.reason.OnOrder - n.reason.Demand
+		n.qty = reorderLotQty(position, n.reason.ReorderPoint, n.reason.ReorderQty, minQty)
+		if _, ok := byVendor[vendorID]; !ok {
+			vendors = append(vendors, vendorID)
+		}
+		byVendor[vendorID] = append(byVendor[vendorID], n)
+	}
+
+	stamp := now.Format("2006-01-02 15:04:05")
+	ids := []int{}
+	for _, vendorID := range vendors {
+		tx, err := db.Begin()
+		if err != nil {
+			return ids, skips, err
+		}
+		res, err := tx.Exec(`INSERT INTO po_suggestions (wo_id, vendor_id, status, notes, created_at, source) VALUES ('', ?, 'pending', ?, ?, 'reorder')`,
+			vendorID, "Reorder point replenishment", stamp)
+		if err != nil {
+			tx.Rollback()
+			return ids, skips, err
+		}
+		sid64, _ := res.LastInsertId()
+		for _, n := range byVendor[vendorID] {
+			r := n.reason
+			_, err = tx.Exec(`INSERT INTO po_suggestion_lines (suggestion_id, ipn, mpn, qty_needed, estimated_unit_price, notes,
+				on_hand, on_order, demand, reorder_point, reorder_qty) VALUES (?,?,?,?,?,?,?,?,?,?,?)`,
+				sid64, n.ipn, n.mpn, n.qty, n.unitPrice,
+				fmt.Sprintf("On hand %g + on order %g - reserved %g is at or below reorder point %g", r.OnHand, r.OnOrder, r.Demand, r.ReorderPoint),
+				r.OnHand, r.OnOrder, r.Demand, r.ReorderPoint, r.ReorderQty)
+			if err != nil {
+				tx.Rollback()
+				return ids, skips, err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return ids, skips, err
+		}
+		logAudit(db, user, "created", "po_suggestion", strconv.FormatInt(sid64, 10),
+			fmt.Sprintf("Created PO suggestion #%d for %s from reorder points (%d parts)", sid64, vendorID, len(byVendor[vendorID])))
+		ids = append(ids, int(sid64))
+	}
+	return ids, skips, nil
+}
+
+// startReorderScheduler suggests reorders once a day at runTime (HH:MM).
+// It is off unless ZRP_REORDER_TIME is set.
+func startReorderScheduler(runTime string) {
+	if runTime == "" {
+		return
+	}
+	err := runDaily(runTime, func() {
+		ids, skips, err := generateReorderSuggestions("system", time.Now())
+		if err != nil {
+			log.Printf("Scheduled reorder suggestions failed: %v", err)
+		} else {
+			log.Printf("Created %d reorder suggestions (%d parts skipped)", len(ids), len(skips))
+		}
+	})
+	if err != nil {
+		log.Printf("ZRP_REORDER_TIME: %v; scheduled reorder suggestions are off", err)
+	}
+}
+
+// runDaily calls fn in the background once a day at runTime (HH:MM, local
+// time), starting with its next occurrence. A runTime that doesn't parse is
+// refused rather than read as some other time of day.
+func runDaily(runTime string, fn func()) error {
+	at, err := time.Parse("15:04", strings.TrimSpace(runTime))
+	if err != nil {
+		return fmt.Errorf("invalid time %q, want HH:MM", runTime)
+	}
+
+	go func() {
+		for {
+			now := time.Now()
+			next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+			if next.Before(now) {
+				next = next.Add(24 * time.Hour)
+			}
+			time.Sleep(time.Until(next))
+			fn()
+		}
+	}()
+	return nil
+}
+
+// suggestionIDsWhere is an "id IN (...)" clause for ids.
+func suggestionIDsWhere(ids []int) (string, []interface{}) {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return "id IN (?" + strings.Repeat(",?", len(ids)-1) + ")", args
+}
+
+// handleGenerateReorderSuggestions runs the reorder point check now.
+func handleGenerateReorderSuggestions(w http.ResponseWriter, r *http.Request) {
+	ids, skips, err := generateReorderSuggestions(getUsername(r), time.Now())
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	suggestions := []POSuggestion{}
+	if len(ids) > 0 {
+		where, args := suggestionIDsWhere(ids)
+		if suggestions, err = loadPOSuggestions(where, args...); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+	}
+	jsonResp(w, map[string]interface{}{"suggestions": suggestions, "skipped": skips})
+}
+
+// handleBulkApprovePOSuggestions approves pending suggestions and turns them
+// into draft POs, one per vendor. Suggestions that aren't pending are
+// skipped.
+func handleBulkApprovePOSuggestions(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		SuggestionIDs []int `json:"suggestion_ids"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	if len(body.SuggestionIDs) == 0 {
+		jsonErr(w, "suggestion_ids is required", 400)
+		return
+	}
+	where, args := suggestionIDsWhere(body.SuggestionIDs)
+	suggestions, err := loadPOSuggestions(where, args...)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+
+	type skipped struct {
+		SuggestionID int    `json:"suggestion_id"`
+		Reason       string `json:"reason"`
+	}
+	skips := []skipped{}
+	found := map[int]bool{}
+	var vendors []string
+	byVendor := map[string][]POSuggestion{}
+	// Oldest first, so PO lines keep the order they were suggested in
+	for i := len(suggestions) - 1; i >= 0; i-- {
+		s := suggestions[i]
+		found[s.ID] = true
+		if s.Status != "pending" {
+			skips = append(skips, skipped{s.ID, "suggestion already " + s.Status})
+			continue
+		}
+		if _, ok := byVendor[s.VendorID]; !ok {
+			vendors = append(vendors, s.VendorID)
+		}
+		byVendor[s.VendorID] = append(byVendor[s.VendorID], s)
+	}
+	for _, id := range body.SuggestionIDs {
+		if !found[id] {
+			skips = append(skips, skipped{id, "suggestion not found"})
+		}
+	}
+
+	user := getUsername(r)
+	now := time.Now().Format("2006-01-02 15:04:05")
+	poIDs := []string{}
+	approved := []int{}
+	for _, vendorID := range vendors {
+		var ids []int
+		var labels []string
+		for _, s := range byVendor[vendorID] {
+			ids = append(ids, s.ID)
+			labels = append(labels, fmt.Sprintf("#%d (%s)", s.ID, poSuggestionSource(s.WOID, s.Source)))
+		}
+		poID, err := createPOFromSuggestions(vendorID, ids, "Created from suggestions "+strings.Join(labels, ", "), user, now)
+		if err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		for _, id := range ids {
+			if _, err := db.Exec("UPDATE po_suggestions SET status = 'approved', reviewed_by = ?, reviewed_at = ? WHERE id = ?", user, now, id); err != nil {
+				jsonErr(w, err.Error(), 500)
+				return
+			}
+			logAudit(db, user, "approved", "po_suggestion", strconv.Itoa(id), fmt.Sprintf("Approved PO suggestion #%d into %s", id, poID))
+		}
+		logAudit(db, user, "created", "po", poID, fmt.Sprintf("Created PO %s from %d approved suggestions", poID, len(ids)))
+		recordChangeJSON(user, "purchase_orders", poID, "create", nil, map[string]interface{}{
+			"id":        poID,
+			"vendor_id": vendorID,
+			"status":    "draft",
+			"source":    "suggestions",
+		})
+		poIDs = append(poIDs, poID)
+		approved = append(approved, ids...)
+	}
+
+	jsonResp(w, map[string]interface{}{"approved": approved, "po_ids": poIDs, "skipped": skips})
+}
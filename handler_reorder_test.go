@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+type reorderResp struct {
+	Data struct {
+		Suggestions []POSuggestion `json:"suggestions"`
+		Skipped     []ReorderSkip  `json:"skipped"`
+	} `json:"data"`
+}
+
+func generateReorders(t *testing.T) reorderResp {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleGenerateReorderSuggestions(w, httptest.NewRequest("POST", "/api/v1/pos/suggestions/reorder", nil))
+	if w.Code != 200 {
+		t.Fatalf("reorder failed: %d %s", w.Code, w.Body.String())
+	}
+	var resp reorderResp
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp
+}
+
+func TestReorderSuggestions(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+
+	stmts := []string{
+		`INSERT INTO vendors (id, name, status) VALUES ('V-1', 'Active', 'active'), ('V-2', 'Preferred', 'preferred'), ('V-3', 'Blocked', 'blocked')`,
+		`INSERT INTO inventory (ipn, qty_on_hand, qty_reserved, reorder_point, reorder_qty) VALUES
+			('R-1', 5, 0, 10, 50), ('R-2', 10, 8, 10, 0), ('R-3', 100, 0, 10, 0), ('R-4', 0, 0, 5, 0)`,
+		`INSERT INTO price_history (ipn, vendor_id, unit_price, min_qty, recorded_at) VALUES
+			('R-1', 'V-2', 0.12, 1, '2026-01-01 00:00:00'), ('R-1', 'V-1', 0.10, 1, '2026-02-01 00:00:00'),
+			('R-2', 'V-1', 0.5, 25, '2026-01-01 00:00:00'), ('R-4', 'V-3', 1, 1, '2026-01-01 00:00:00')`,
+		`INSERT INTO purchase_orders (id, vendor_id, status) VALUES ('PO-0001', 'V-1', 'sent')`,
+		`INSERT INTO po_lines (po_id, ipn, qty_ordered, qty_received) VALUES ('PO-0001', 'R-2', 3, 0)`,
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("seed failed: %v\n%s", err, s)
+		}
+	}
+
+	// R-1 goes to the preferred vendor, a whole lot; R-2 (10 on hand, 3 on
+	// order, 8 reserved) orders the vendor minimum; R-4's only vendor is blocked
+	resp := generateReorders(t)
+	s := resp.Data.Suggestions
+	if len(s) != 2 || len(resp.Data.Skipped) != 1 || resp.Data.Skipped[0].IPN != "R-4" {
+		t.Fatalf("unexpected suggestions: %+v", resp.Data)
+	}
+	byVendor := map[string]POSuggestion{}
+	for _, sg := range s {
+		byVendor[sg.VendorID] = sg
+	}
+	r1, r2 := byVendor["V-2"].Lines, byVendor["V-1"].Lines
+	if len(r1) != 1 || r1[0].IPN != "R-1" || r1[0].QtyNeeded != 50 || r1[0].EstimatedUnitPrice != 0.12 || byVendor["V-2"].Source != "reorder" {
+		t.Errorf("unexpected R-1 suggestion: %+v", byVendor["V-2"])
+	}
+	if len(r2) != 1 || r2[0].QtyNeeded != 25 || r2[0].Reorder == nil || r2[0].Reorder.OnOrder != 3 || r2[0].Reorder.Demand != 8 || r2[0].Reorder.OnHand != 10 {
+		t.Errorf("unexpected R-2 suggestion: %+v", r2)
+	}
+	if again := generateReorders(t); len(again.Data.Suggestions) != 0 {
+		t.Errorf("expected parts on pending suggestions to be left alone, got %+v", again.Data.Suggestions)
+	}
+
+	approve := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleBulkApprovePOSuggestions(w, httptest.NewRequest("POST", "/api/v1/pos/suggestions/approve", bytes.NewBufferString(body)))
+		return w
+	}
+	if w := approve(`{"suggestion_ids":[]}`); w.Code != 400 {
+		t.Errorf("expected 400 without ids, got %d", w.Code)
+	}
+	ids := strconv.Itoa(s[0].ID) + "," + strconv.Itoa(s[1].ID)
+	w := approve(`{"suggestion_ids":[` + ids + `,999]}`)
+	var result struct {
+		Data struct {
+			Approved []int    `json:"approved"`
+			POIDs    []string `json:"po_ids"`
+			Skipped  []struct {
+				SuggestionID int `json:"suggestion_id"`
+			} `json:"skipped"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if w.Code != 200 || len(result.Data.Approved) != 2 || len(result.Data.POIDs) != 2 || len(result.Data.Skipped) != 1 {
+		t.Fatalf("unexpected bulk approval: %d %s", w.Code, w.Body.String())
+	}
+	var qty, price float64
+	var status string
+	db.QueryRow(`SELECT l.qty_ordered, l.unit_price, p.status FROM po_lines l JOIN purchase_orders p ON p.id = l.po_id
+		WHERE l.ipn = 'R-1' AND p.vendor_id = 'V-2'`).Scan(&qty, &price, &status)
+	if qty != 50 || price != 0.12 || status != "draft" {
+		t.Errorf("expected a draft PO for 50 R-1 at 0.12, got %v at %v (%s)", qty, price, status)
+	}
+	if approved, _ := loadPOSuggestions("status = 'approved' AND po_id != ''"); len(approved) != 2 {
+		t.Errorf("expected both suggestions approved and linked, got %+v", approved)
+	}
+	if w := approve(`{"suggestion_ids":[` + ids + `]}`); !bytes.Contains(w.Body.Bytes(), []byte("already approved")) {
+		t.Errorf("expected approved suggestions to be skipped, got %s", w.Body.String())
+	}
+
+	// What's now on order lifts both parts above their reorder points
+	if again := generateReorders(t); len(again.Data.Suggestions) != 0 {
+		t.Errorf("expected nothing more to reorder, got %+v", again.Data.Suggestions)
+	}
+}
+
+func TestRunDailyRejectsBadTimes(t *testing.T) {
+	for _, bad := range []string{"25:00", "04:60", "4", "noon", "04-30"} {
+		if err := runDaily(bad, func() {}); err == nil {
+			t.Errorf("expected %q to be refused", bad)
+		}
+	}
+	if err := runDaily("04:30", func() {}); err != nil {
+		t.Errorf("expected 04:30 to be accepted, got %v", err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -19,6 +20,19 @@ type InvValuationItem struct {
 	UnitPrice float64 `json:"unit_price"`
 	Subtotal  float64 `json:"subtotal"`
 	PORef     string  `json:"po_ref"`
+	// Customer-owned stock on hand, left out of QtyOnHand, and our stock
+	// consigned to CMs, counted in it
+	QtyCustomerOwned float64 `json:"qty_customer_owned,omitempty"`
+	QtyConsigned     float64 `json:"qty_consigned,omitempty"`
+}
+
+// ownHere is the share of the stock physically on hand that is ours.
+func (it InvValuationItem) ownHere() float64 {
+	own := it.QtyOnHand - it.QtyConsigned
+	if it.QtyCustomerOwned <= 0 || own+it.QtyCustomerOwned <= 0 {
+		return 1
+	}
+	return own / (own + it.QtyCustomerOwned)
 }
 
 type InvValuationGroup struct {
@@ -27,12 +41,105 @@ type InvValuationGroup struct {
 	Subtotal float64            `json:"subtotal"`
 }
 
+// InvValuationSite is the value held at one site. Stock that isn't in any
+// location is reported with an empty site.
+type InvValuationSite struct {
+	Site  string  `json:"site"`
+	Name  string  `json:"name"`
+	Total float64 `json:"total"`
+}
+
 type InvValuationReport struct {
+	Method     string              `json:"costing_method"`
+	Site       string              `json:"site,omitempty"`
 	Groups     []InvValuationGroup `json:"groups"`
 	GrandTotal float64             `json:"grand_total"`
+	BySite     []InvValuationSite  `json:"by_site,omitempty"`
+}
+
+// siteParam reads ?site= and checks it names a site. ok is false once an
+// error has been written.
+func siteParam(w http.ResponseWriter, r *http.Request) (site string, stock map[string]float64, ok bool) {
+	site = r.URL.Query().Get("site")
+	if site == "" {
+		return "", nil, true
+	}
+	var locType string
+	if db.QueryRow("SELECT type FROM locations WHERE code=?", site).Scan(&locType) != nil || locType != "site" {
+		jsonErr(w, "unknown site "+site, 400)
+		return "", nil, false
+	}
+	stock, err := subtreeStock(site)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return "", nil, false
+	}
+	return site, stock, true
+}
+
+// valuationBySite splits the value of located stock by site, at the unit
+// prices of the valuation items. Stock consigned to CMs is a line of its
+// own.
+func valuationBySite(items map[string]InvValuationItem, grandTotal float64) []InvValuationSite {
+	sites := locationSites()
+	rows, err := db.Query("SELECT ipn, location_code, qty_on_hand FROM inventory_locations WHERE qty_on_hand > 0")
+	if err != nil {
+		return nil
+	}
+	totals := map[string]float64{}
+	for rows.Next() {
+		var ipn, code string
+		var qty float64
+		rows.Scan(&ipn, &code, &qty)
+		totals[sites[code]] += qty * items[ipn].ownHere() * items[ipn].UnitPrice
+	}
+	rows.Close()
+	consigned := 0.0
+	for _, it := range items {
+		consigned += it.QtyConsigned * it.UnitPrice
+	}
+	if len(totals) == 0 && consigned <= 0 {
+		return nil
+	}
+
+	var list []InvValuationSite
+	siteRows, err := db.Query("SELECT code, name FROM locations WHERE type='site' ORDER BY code")
+	if err != nil {
+		return nil
+	}
+	defer siteRows.Close()
+	located := 0.0
+	for siteRows.Next() {
+		var s InvValuationSite
+		siteRows.Scan(&s.Site, &s.Name)
+		s.Total = math.Round(totals[s.Site]*100) / 100
+		located += totals[s.Site]
+		list = append(list, s)
+	}
+	if rest := grandTotal - located - consigned; rest > 0.005 {
+		list = append(list, InvValuationSite{Name: "Unassigned", Total: math.Round(rest*100) / 100})
+	}
+	if consigned > 0.005 {
+		list = append(list, InvValuationSite{Name: "Consigned", Total: math.Round(consigned*100) / 100})
+	}
+	return list
 }
 
+// handleReportInventoryValuation values stock at the cost its layers carry,
+// FIFO or moving average. Stock without a layer is valued at the last PO
+// price. Only our stock is valued: customer-owned stock is left out and
+// stock consigned to CMs is counted. With ?site= only stock held at that
+// site is counted; otherwise the total is also split by site.
 func handleReportInventoryValuation(w http.ResponseWriter, r *http.Request) {
+	site, siteStock, ok := siteParam(w, r)
+	if !ok {
+		return
+	}
+	layers, err := layerValues()
+	if err != nil {
+		layers = map[string][2]float64{}
+	}
+	customerOwned, consigned := ownershipTotals()
 	rows, err := db.Query(`
 		SELECT i.ipn, COALESCE(i.description,''), COALESCE(i.mpn,''), i.qty_on_hand,
 			COALESCE((SELECT pl.unit_price FROM po_lines pl JOIN purchase_orders po ON pl.po_id=po.id
@@ -47,11 +154,28 @@ func handleReportInventoryValuation(w http.ResponseWriter, r *http.Request) {
 	defer rows.Close()
 
 	catMap := map[string][]InvValuationItem{}
+	byIPN := map[string]InvValuationItem{}
 	var catOrder []string
 	for rows.Next() {
 		var item InvValuationItem
 		var mpn string
-		rows.Scan(&item.IPN, &item.Desc, &mpn, &item.QtyOnHand, &item.UnitPrice, &item.PORef)
+		var onHand float64
+		rows.Scan(&item.IPN, &item.Desc, &mpn, &onHand, &item.UnitPrice, &item.PORef)
+		item.QtyCustomerOwned, item.QtyConsigned = customerOwned[item.IPN], consigned[item.IPN]
+		item.QtyOnHand = math.Max(0, onHand-item.QtyCustomerOwned) + item.QtyConsigned
+		if l := layers[item.IPN]; l[0] > 0 && item.QtyOnHand > 0 {
+			unlayered := math.Max(0, item.QtyOnHand-l[0])
+			item.UnitPrice = (l[1] + unlayered*item.UnitPrice) / math.Max(item.QtyOnHand, l[0])
+		}
+		if site != "" {
+			qty, held := siteStock[item.IPN]
+			if !held {
+				continue
+			}
+			item.QtyOnHand = qty * item.ownHere()
+			item.QtyCustomerOwned, item.QtyConsigned = qty-item.QtyOnHand, 0
+		}
+		byIPN[item.IPN] = item
 		item.Subtotal = item.QtyOnHand * item.UnitPrice
 		// Derive category from IPN prefix
 		item.Category = ipnCategory(item.IPN)
@@ -61,7 +185,9 @@ func handleReportInventoryValuation(w http.ResponseWriter, r *http.Request) {
 		catMap[item.Category] = append(catMap[item.Category], item)
 	}
 
-	report := InvValuationReport{}
+	rows.Close()
+
+	report := InvValuationReport{Method: costingMethod(db), Site: site}
 	for _, cat := range catOrder {
 		items := catMap[cat]
 		grp := InvValuationGroup{Category: cat, Items: items}
@@ -71,6 +197,9 @@ func handleReportInventoryValuation(w http.ResponseWriter, r *http.Request) {
 		report.GrandTotal += grp.Subtotal
 		report.Groups = append(report.Groups, grp)
 	}
+	if site == "" {
+		report.BySite = valuationBySite(byIPN, report.GrandTotal)
+	}
 
 	if r.URL.Query().Get("format") == "csv" {
 		writeCSV(w, "inventory-valuation", []string{"IPN", "Description", "Category", "Qty On Hand", "Unit Price", "Subtotal", "PO Ref"}, func(cw *csv.Writer) {
@@ -202,8 +331,18 @@ type LowStockItem struct {
 	SuggestedOrder  float64 `json:"suggested_order"`
 }
 
+// handleReportLowStock lists IPNs below their reorder point. With ?site= it
+// compares what the site holds instead, for the IPNs stocked there.
 func handleReportLowStock(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query(`SELECT ipn, COALESCE(description,''), qty_on_hand, reorder_point, reorder_qty FROM inventory WHERE qty_on_hand < reorder_point AND reorder_point > 0 ORDER BY (reorder_point - qty_on_hand) DESC`)
+	site, siteStock, ok := siteParam(w, r)
+	if !ok {
+		return
+	}
+	query := `SELECT ipn, COALESCE(description,''), qty_on_hand, reorder_point, reorder_qty FROM inventory WHERE qty_on_hand < reorder_point AND reorder_point > 0 ORDER BY (reorder_point - qty_on_hand) DESC`
+	if site != "" {
+		query = `SELECT ipn, COALESCE(description,''), qty_on_hand, reorder_point, reorder_qty FROM inventory WHERE reorder_point > 0 ORDER BY ipn`
+	}
+	rows, err := db.Query(query)
 	if err != nil {
 		jsonErr(w, err.Error(), 500)
 		return
@@ -213,6 +352,13 @@ func handleReportLowStock(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var it LowStockItem
 		rows.Scan(&it.IPN, &it.Description, &it.QtyOnHand, &it.ReorderPoint, &it.ReorderQty)
+		if site != "" {
+			qty, held := siteStock[it.IPN]
+			if !held || qty >= it.ReorderPoint {
+				continue
+			}
+			it.QtyOnHand = qty
+		}
 		it.SuggestedOrder = it.ReorderQty
 		if it.SuggestedOrder == 0 {
 			it.SuggestedOrder = it.ReorderPoint - it.QtyOnHand
@@ -222,6 +368,11 @@ func handleReportLowStock(w http.ResponseWriter, r *http.Request) {
 	if items == nil {
 		items = []LowStockItem{}
 	}
+	if site != "" {
+		sort.SliceStable(items, func(i, j int) bool {
+			return items[i].ReorderPoint-items[i].QtyOnHand > items[j].ReorderPoint-items[j].QtyOnHand
+		})
+	}
 
 	if r.URL.Query().Get("format") == "csv" {
 		writeCSV(w, "low-stock", []string{"IPN", "Description", "Qty On Hand", "Reorder Point", "Reorder Qty", "Suggested Order"}, func(cw *csv.Writer) {
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InventoryReservation is one row of the reservation ledger. Every reserving
+// path (WO kitting, SO allocation) writes here; inventory.qty_reserved is the
+// sum of open rows per IPN.
+type InventoryReservation struct {
+	ID          int     `json:"id"`
+	RefType     string  `json:"ref_type"`
+	RefID       string  `json:"ref_id"`
+	IPN         string  `json:"ipn"`
+	Qty         float64 `json:"qty"`
+	QtyConsumed float64 `json:"qty_consumed"`
+	Status      string  `json:"status"`
+	CreatedBy   string  `json:"created_by"`
+	CreatedAt   string  `json:"created_at"`
+	UpdatedAt   string  `json:"updated_at"`
+	ClosedAt    *string `json:"closed_at"`
+}
+
+const reservationColumns = `id, ref_type, ref_id, ipn, qty, qty_consumed, status, COALESCE(created_by,''),
+	created_at, updated_at, closed_at`
+
+func scanReservation(rows *sql.Rows) (InventoryReservation, error) {
+	var res InventoryReservation
+	var closedAt sql.NullString
+	err := rows.Scan(&res.ID, &res.RefType, &res.RefID, &res.IPN, &res.Qty, &res.QtyConsumed, &res.Status,
+		&res.CreatedBy, &res.CreatedAt, &res.UpdatedAt, &closedAt)
+	res.ClosedAt = sp(closedAt)
+	return res, err
+}
+
+// syncReservedQty recomputes inventory.qty_reserved for an IPN from the open
+// ledger rows.
+func syncReservedQty(tx *sql.Tx, ipn string) error {
+	now := time.Now().Format("2006-01-02 15:04:05")
+	_, err := tx.Exec(`UPDATE inventory SET qty_reserved = (
+		SELECT COALESCE(SUM(qty),0) FROM inventory_reservations WHERE ipn = ? AND status = 'open'
+	), updated_at = ? WHERE ipn = ?`, ipn, now, ipn)
+	if err != nil {
+		return fmt.Errorf("failed to sync reserved qty for %s: %w", ipn, err)
+	}
+	return nil
+}
+
+// reserveInventory adds qty to the open reservation held by a reference for an
+// IPN, creating the ledger row if the reference doesn't hold one yet.
+func reserveInventory(tx *sql.Tx, refType, refID, ipn string, qty float64, username string) error {
+	if qty <= 0 {
+		return nil
+	}
+	now := time.Now().Format("2006-01-02 15:04:05")
+	res, err := tx.Exec(`UPDATE inventory_reservations SET qty = qty + ?, updated_at = ?
+		WHERE ref_type = ? AND ref_id = ? AND ipn = ? AND status = 'open'`, qty, now, refType, refID, ipn)
+	if err != nil {
+		return fmt.Errorf("failed to reserve %s: %w", ipn, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err = tx.Exec(`INSERT INTO inventory_reservations (ref_type,ref_id,ipn,qty,status,created_by,created_at,updated_at)
+			VALUES (?,?,?,?,'open',?,?,?)`, refType, refID, ipn, qty, username, now, now)
+		if err != nil {
+			return fmt.Errorf("failed to reserve %s: %w", ipn, err)
+		}
+	}
+	return syncReservedQty(tx, ipn)
+}
+
+// consumeReservation draws down up to qty from the open reservation a
+// reference holds for an IPN and returns how much was actually drawn. A row
+// that reaches zero is closed as consumed. Stock on hand is not touched; the
+// caller records the issue itself.
+func consumeReservation(tx *sql.Tx, refType, refID, ipn string, qty float64) (float64, error) {
+	var id int
+	var open float64
+	err := tx.QueryRow(`SELECT id, qty FROM inventory_reservations
+		WHERE ref_type = ? AND ref_id = ? AND ipn = ? AND status = 'open' ORDER BY id LIMIT 1`,
+		refType, refID, ipn).Scan(&id, &open)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up reservation for %s: %w", ipn, err)
+	}
+
+	consumed := qty
+	if consumed > open {
+		consumed = open
+	}
+	now := time.Now().Format("2006-01-02 15:04:05")
+	_, err = tx.Exec(`UPDATE inventory_reservations SET qty = qty - ?, qty_consumed = qty_consumed + ?, updated_at = ?,
+		status = CASE WHEN qty - ? <= 0 THEN 'consumed' ELSE status END,
+		closed_at = CASE WHEN qty - ? <= 0 THEN ? ELSE closed_at END
+		WHERE id = ?`, consumed, consumed, now, consumed, consumed, now, id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to consume reservation for %s: %w", ipn, err)
+	}
+	return consumed, syncReservedQty(tx, ipn)
+}
+
+// releaseReservations closes every open reservation held by a reference
+// without consuming stock.
+func releaseReservations(tx *sql.Tx, refType, refID string) error {
+	open, err := openReservationsFor(tx, refType, refID)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Format("2006-01-02 15:04:05")
+	_, err = tx.Exec(`UPDATE inventory_reservations SET status = 'released', updated_at = ?, closed_at = ?
+		WHERE ref_type = ? AND ref_id = ? AND status = 'open'`, now, now, refType, refID)
+	if err != nil {
+		return fmt.Errorf("failed to release reservations for %s: %w", refID, err)
+	}
+	for ipn := range open {
+		if err := syncReservedQty(tx, ipn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openReservationsFor returns the open qty per IPN held by a reference.
+func openReservationsFor(tx *sql.Tx, refType, refID string) (map[string]float64, error) {
+	rows, err := tx.Query(`SELECT ipn, SUM(qty) FROM inventory_reservations
+		WHERE ref_type = ? AND ref_id = ? AND status = 'open' GROUP BY ipn`, refType, refID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query reservations for %s: %w", refID, err)
+	}
+	defer rows.Close()
+	open := map[string]float64{}
+	for rows.Next() {
+		var ipn string
+		var qty float64
+		if err := rows.Scan(&ipn, &qty); err != nil {
+			return nil, err
+		}
+		open[ipn] = qty
+	}
+	return open, rows.Err()
+}
+
+// reservationRefFromReference maps a free-text inventory transaction reference
+// to a ledger reference. Sales orders use the "SO:<id>" form written by the
+// sales order handlers; otherwise the reference is a work order if a WO with
+// that ID exists. Any other reference maps to an empty ref type, which holds
+// no reservations. Accepts either the db or an open transaction.
+func reservationRefFromReference(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, reference string) (string, string) {
+	reference = strings.TrimSpace(reference)
+	if strings.HasPrefix(reference, "SO:") {
+		return "sales_order", strings.TrimPrefix(reference, "SO:")
+	}
+	var n int
+	if q.QueryRow("SELECT COUNT(*) FROM work_orders WHERE id=?", reference).Scan(&n); n == 0 {
+		return "", reference
+	}
+	return "work_order", reference
+}
+
+func listReservations(w http.ResponseWriter, where []string, args []interface{}) {
+	query := "SELECT " + reservationColumns + " FROM inventory_reservations"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY created_at, id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+
+	var items []InventoryReservation
+	for rows.Next() {
+		res, err := scanReservation(rows)
+		if err != nil {
+			continue
+		}
+		items = append(items, res)
+	}
+	if items == nil {
+		items = []InventoryReservation{}
+	}
+	jsonResp(w, items)
+}
+
+// handleListReservations lists ledger rows, open ones by default. Supports
+// ipn, ref_type, ref_id and status (open, consumed, released, all) filters.
+func handleListReservations(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	ve := &ValidationErrors{}
+	status := q.Get("status")
+	if status == "" {
+		status = "open"
+	}
+	if status != "all" {
+		validateEnum(ve, "status", status, validReservationStatuses)
+	}
+	if refType := q.Get("ref_type"); refType != "" {
+		validateEnum(ve, "ref_type", refType, validReservationRefTypes)
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	var where []string
+	var args []interface{}
+	if status != "all" {
+		where = append(where, "status = ?")
+		args = append(args, status)
+	}
+	for _, f := range []string{"ipn", "ref_type", "ref_id"} {
+		if v := q.Get(f); v != "" {
+			where = append(where, f+" = ?")
+			args = append(args, v)
+		}
+	}
+	listReservations(w, where, args)
+}
+
+func handleInventoryReservations(w http.ResponseWriter, r *http.Request, ipn string) {
+	listReservations(w, []string{"ipn = ?", "status = 'open'"}, []interface{}{ipn})
+}
+
+func handleWorkOrderReservations(w http.ResponseWriter, r *http.Request, id string) {
+	var exists int
+	if err := db.QueryRow("SELECT 1 FROM work_orders WHERE id=?", id).Scan(&exists); err != nil {
+		jsonErr(w, "work order not found", 404)
+		return
+	}
+	listReservations(w, []string{"ref_type = 'work_order'", "ref_id = ?", "status = 'open'"}, []interface{}{id})
+}
+
+// handleReleaseReservation releases a single open ledger row. Mainly for
+// clearing legacy reservations carried over from before the ledger existed.
+func handleReleaseReservation(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		jsonErr(w, "invalid id", 400)
+		return
+	}
+
+	var ipn, status string
+	if err := db.QueryRow("SELECT ipn, status FROM inventory_reservations WHERE id=?", id).Scan(&ipn, &status); err != nil {
+		jsonErr(w, "reservation not found", 404)
+		return
+	}
+	if status != "open" {
+		jsonErr(w, "reservation is already "+status, 400)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	if _, err := tx.Exec("UPDATE inventory_reservations SET status='released', updated_at=?, closed_at=? WHERE id=?", now, now, id); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if err := syncReservedQty(tx, ipn); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+
+	logAudit(db, getUsername(r), "released", "inventory", ipn, fmt.Sprintf("Released reservation %d on %s", id, ipn))
+	jsonResp(w, map[string]interface{}{"id": id, "status": "released"})
+}
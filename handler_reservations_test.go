@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func seedReservationFixtures(t *testing.T) {
+	t.Helper()
+	stmts := []string{
+		`INSERT INTO inventory (ipn, qty_on_hand, qty_reserved) VALUES ('RES-001', 100, 0)`,
+		`INSERT INTO work_orders (id, assembly_ipn, qty, status, created_at) VALUES ('WO-A', 'ASY-A', 5, 'in_progress', '2026-01-01 00:00:00')`,
+		`INSERT INTO work_orders (id, assembly_ipn, qty, status, created_at) VALUES ('WO-B', 'ASY-B', 5, 'in_progress', '2026-01-01 00:00:00')`,
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct {
+		refType, refID string
+		qty            float64
+	}{
+		{"work_order", "WO-A", 10},
+		{"work_order", "WO-B", 20},
+		{"sales_order", "SO-X", 30},
+	} {
+		if err := reserveInventory(tx, r.refType, r.refID, "RES-001", r.qty, "tester"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func reservationState(t *testing.T, ipn string) (onHand, reserved float64) {
+	t.Helper()
+	if err := db.QueryRow("SELECT qty_on_hand, qty_reserved FROM inventory WHERE ipn=?", ipn).Scan(&onHand, &reserved); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func openQty(t *testing.T, refType, refID string) float64 {
+	t.Helper()
+	var qty float64
+	db.QueryRow("SELECT COALESCE(SUM(qty),0) FROM inventory_reservations WHERE ref_type=? AND ref_id=? AND status='open'",
+		refType, refID).Scan(&qty)
+	return qty
+}
+
+func TestReserveInventory_DerivesQtyReserved(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedReservationFixtures(t)
+
+	_, reserved := reservationState(t, "RES-001")
+	if reserved != 60 {
+		t.Errorf("expected qty_reserved 60, got %v", reserved)
+	}
+
+	// Reserving again for the same reference tops up the existing row
+	tx, _ := db.Begin()
+	if err := reserveInventory(tx, "work_order", "WO-A", "RES-001", 5, "tester"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	var rowCount int
+	db.QueryRow("SELECT COUNT(*) FROM inventory_reservations WHERE ref_id='WO-A'").Scan(&rowCount)
+	if rowCount != 1 {
+		t.Errorf("expected 1 ledger row for WO-A, got %d", rowCount)
+	}
+	if got := openQty(t, "work_order", "WO-A"); got != 15 {
+		t.Errorf("expected WO-A open qty 15, got %v", got)
+	}
+}
+
+func TestWorkOrderCompletion_ConsumesOnlyOwnReservation(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedReservationFixtures(t)
+
+	body := `{"assembly_ipn":"ASY-A","qty":5,"status":"completed","priority":"normal"}`
+	req := httptest.NewRequest("PUT", "/api/v1/workorders/WO-A", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	handleUpdateWorkOrder(w, req, "WO-A")
+	if w.Code != 200 {
+		t.Fatalf("completion failed: %d %s", w.Code, w.Body.String())
+	}
+
+	onHand, reserved := reservationState(t, "RES-001")
+	if onHand != 90 {
+		t.Errorf("expected on_hand 90 after consuming WO-A's 10, got %v", onHand)
+	}
+	if reserved != 50 {
+		t.Errorf("expected 50 still reserved for WO-B and SO-X, got %v", reserved)
+	}
+	if got := openQty(t, "work_order", "WO-B"); got != 20 {
+		t.Errorf("WO-B reservation should be untouched, got %v", got)
+	}
+	if got := openQty(t, "sales_order", "SO-X"); got != 30 {
+		t.Errorf("SO-X reservation should be untouched, got %v", got)
+	}
+
+	var status string
+	var consumed float64
+	db.QueryRow("SELECT status, qty_consumed FROM inventory_reservations WHERE ref_id='WO-A'").Scan(&status, &consumed)
+	if status != "consumed" || consumed != 10 {
+		t.Errorf("expected WO-A row consumed with qty_consumed 10, got %s/%v", status, consumed)
+	}
+}
+
+// Material reserved to a build that expires before the WO closes was still
+// used: the close consumes it rather than refusing, and with no good units
+// left it receives nothing.
+func TestWorkOrderCompletion_ConsumesExpiredReservedStock(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedReservationFixtures(t)
+	expired := "2020-01-01"
+	lotID := seedLot(t, InventoryLot{IPN: "RES-001", LotNumber: "OLD", QtyReceived: 100, QtyOnHand: 100, Status: "quarantine", ExpiresAt: &expired})
+
+	body := `{"assembly_ipn":"ASY-A","qty":5,"qty_good":0,"qty_scrap":5,"status":"completed","priority":"normal"}`
+	w := httptest.NewRecorder()
+	handleUpdateWorkOrder(w, httptest.NewRequest("PUT", "/api/v1/workorders/WO-A", bytes.NewBufferString(body)), "WO-A")
+	if w.Code != 200 {
+		t.Fatalf("expected the WO to close on expired reserved stock, got %d %s", w.Code, w.Body.String())
+	}
+	if onHand, _ := reservationState(t, "RES-001"); onHand != 90 {
+		t.Errorf("expected on_hand 90 after consuming WO-A's 10, got %v", onHand)
+	}
+	if lot, _ := loadLot(lotID); lot.QtyOnHand != 90 {
+		t.Errorf("expected the 10 drawn from the expired lot, got %v left", lot.QtyOnHand)
+	}
+	var receipts int
+	db.QueryRow("SELECT COUNT(*) FROM inventory_transactions WHERE ipn='ASY-A' AND type='receive'").Scan(&receipts)
+	if receipts != 0 {
+		t.Errorf("expected no receive for 0 good units, got %d", receipts)
+	}
+}
+
+func TestWorkOrderCancellation_ReleasesOnlyOwnReservation(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedReservationFixtures(t)
+
+	body := `{"assembly_ipn":"ASY-B","qty":5,"status":"cancelled","priority":"normal"}`
+	req := httptest.NewRequest("PUT", "/api/v1/workorders/WO-B", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	handleUpdateWorkOrder(w, req, "WO-B")
+	if w.Code != 200 {
+		t.Fatalf("cancellation failed: %d %s", w.Code, w.Body.String())
+	}
+
+	onHand, reserved := reservationState(t, "RES-001")
+	if onHand != 100 {
+		t.Errorf("cancellation must not consume stock, on_hand=%v", onHand)
+	}
+	if reserved != 40 {
+		t.Errorf("expected 40 reserved after releasing WO-B, got %v", reserved)
+	}
+	if got := openQty(t, "work_order", "WO-A"); got != 10 {
+		t.Errorf("WO-A reservation should be untouched, got %v", got)
+	}
+}
+
+func TestInventoryIssue_PartiallyConsumesReferencedReservation(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedReservationFixtures(t)
+
+	body := `{"ipn":"RES-001","type":"issue","qty":4,"reference":"WO-A"}`
+	req := httptest.NewRequest("POST", "/api/v1/inventory/transact", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	handleInventoryTransact(w, req)
+	if w.Code != 200 {
+		t.Fatalf("issue failed: %d %s", w.Code, w.Body.String())
+	}
+
+	onHand, reserved := reservationState(t, "RES-001")
+	if onHand != 96 {
+		t.Errorf("expected on_hand 96, got %v", onHand)
+	}
+	if reserved != 56 {
+		t.Errorf("expected qty_reserved 56, got %v", reserved)
+	}
+	if got := openQty(t, "work_order", "WO-A"); got != 6 {
+		t.Errorf("expected WO-A open qty 6 after partial issue, got %v", got)
+	}
+
+	// Issuing against a sales order reference uses the SO: prefix
+	body = `{"ipn":"RES-001","type":"issue","qty":30,"reference":"SO:SO-X"}`
+	req = httptest.NewRequest("POST", "/api/v1/inventory/transact", bytes.NewBufferString(body))
+	w = httptest.NewRecorder()
+	handleInventoryTransact(w, req)
+	if w.Code != 200 {
+		t.Fatalf("SO issue failed: %d %s", w.Code, w.Body.String())
+	}
+	if got := openQty(t, "sales_order", "SO-X"); got != 0 {
+		t.Errorf("expected SO-X fully consumed, got %v", got)
+	}
+
+	// Only references to real work orders map to a WO reservation
+	if refType, _ := reservationRefFromReference(db, "WO-A"); refType != "work_order" {
+		t.Errorf("expected WO-A to map to a work order, got %q", refType)
+	}
+	if refType, _ := reservationRefFromReference(db, "RMA-9"); refType != "" {
+		t.Errorf("expected a stray reference to map to nothing, got %q", refType)
+	}
+}
+
+func TestListReservations_PerIPNAndWorkOrder(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedReservationFixtures(t)
+
+	decode := func(w *httptest.ResponseRecorder) []InventoryReservation {
+		t.Helper()
+		var resp struct {
+			Data []InventoryReservation `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Data
+	}
+
+	w := httptest.NewRecorder()
+	handleInventoryReservations(w, httptest.NewRequest("GET", "/api/v1/inventory/RES-001/reservations", nil), "RES-001")
+	if items := decode(w); len(items) != 3 {
+		t.Errorf("expected 3 open reservations on RES-001, got %d", len(items))
+	}
+
+	w = httptest.NewRecorder()
+	handleWorkOrderReservations(w, httptest.NewRequest("GET", "/api/v1/workorders/WO-B/reservations", nil), "WO-B")
+	items := decode(w)
+	if len(items) != 1 || items[0].Qty != 20 || items[0].RefID != "WO-B" {
+		t.Errorf("unexpected WO-B reservations: %+v", items)
+	}
+
+	w = httptest.NewRecorder()
+	handleWorkOrderReservations(w, httptest.NewRequest("GET", "/api/v1/workorders/WO-NOPE/reservations", nil), "WO-NOPE")
+	if w.Code != 404 {
+		t.Errorf("expected 404 for unknown WO, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handleListReservations(w, httptest.NewRequest("GET", "/api/v1/reservations?ref_type=sales_order", nil))
+	if items := decode(w); len(items) != 1 || items[0].RefID != "SO-X" {
+		t.Errorf("unexpected sales order reservations: %+v", items)
+	}
+
+	w = httptest.NewRecorder()
+	handleListReservations(w, httptest.NewRequest("GET", "/api/v1/reservations?status=bogus", nil))
+	if w.Code != 400 {
+		t.Errorf("expected 400 for invalid status, got %d", w.Code)
+	}
+}
+
+func TestReleaseReservation(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedReservationFixtures(t)
+
+	var id string
+	db.QueryRow("SELECT id FROM inventory_reservations WHERE ref_id='SO-X'").Scan(&id)
+
+	w := httptest.NewRecorder()
+	handleReleaseReservation(w, httptest.NewRequest("POST", "/api/v1/reservations/"+id+"/release", nil), id)
+	if w.Code != 200 {
+		t.Fatalf("release failed: %d %s", w.Code, w.Body.String())
+	}
+	if _, reserved := reservationState(t, "RES-001"); reserved != 30 {
+		t.Errorf("expected 30 reserved after release, got %v", reserved)
+	}
+
+	w = httptest.NewRecorder()
+	handleReleaseReservation(w, httptest.NewRequest("POST", "/api/v1/reservations/"+id+"/release", nil), id)
+	if w.Code != 400 {
+		t.Errorf("expected 400 releasing an already released reservation, got %d", w.Code)
+	}
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ReworkOrder is a work order raised to rework the units of an NCR
+// dispositioned as rework. Replacement material is issued to it when it is
+// created; completing it returns the good units to stock and rolls its
+// labor and material cost up onto the NCR.
+type ReworkOrder struct {
+	WOID         string           `json:"wo_id"`
+	NCRID        string           `json:"ncr_id"`
+	IPN          string           `json:"ipn"`
+	Qty          int              `json:"qty"`
+	QtyGood      int              `json:"qty_good"`
+	QtyScrap     int              `json:"qty_scrap"`
+	Status       string           `json:"status"`
+	Priority     string           `json:"priority"`
+	Instructions string           `json:"instructions"`
+	Serials      []string         `json:"serials"`
+	LotID        *int             `json:"lot_id"`
+	FromStock    bool             `json:"from_stock"`
+	Materials    []ReworkMaterial `json:"materials"`
+	LaborMinutes float64          `json:"labor_minutes"`
+	LaborCost    float64          `json:"labor_cost"`
+	MaterialCost float64          `json:"material_cost"`
+	TotalCost    float64          `json:"total_cost"`
+	CreatedBy    string           `json:"created_by"`
+	CreatedAt    string           `json:"created_at"`
+	CompletedAt  *string          `json:"completed_at"`
+}
+
+// ReworkMaterial is a replacement component issued to a rework order,
+// costed at its last PO price when it was issued.
+type ReworkMaterial struct {
+	ID         int     `json:"id"`
+	IPN        string  `json:"ipn"`
+	Qty        float64 `json:"qty"`
+	UnitCost   float64 `json:"unit_cost"`
+	Cost       float64 `json:"cost"`
+	IssuedAt   string  `json:"issued_at"`
+	ReturnedAt *string `json:"returned_at"`
+}
+
+// ReworkRequest describes a rework order to raise against an NCR. Blank
+// fields default from the NCR: its IPN, its serial number as the one
+// affected unit, and its corrective action as the instructions. Units
+// pulled from stock (the default when a lot is given) leave inventory
+// while they are reworked.
+type ReworkRequest struct {
+	IPN          string   `json:"ipn"`
+	Serials      []string `json:"serials"`
+	LotID        *int     `json:"lot_id"`
+	Qty          int      `json:"qty"`
+	FromStock    *bool    `json:"from_stock"`
+	Instructions string   `json:"instructions"`
+	Priority     string   `json:"priority"`
+	DueDate      string   `json:"due_date"`
+	Materials    []struct {
+		IPN  string    `json:"ipn"`
+		Qty  float64   `json:"qty"`
+		Lots []LotPick `json:"lots"`
+	} `json:"materials"`
+}
+
+// reworkNCRID returns the NCR a work order reworks, or "" for a production
+// WO (or a schema without rework orders).
+func reworkNCRID(woID string) string {
+	var ncrID string
+	db.QueryRow("SELECT ncr_id FROM rework_orders WHERE wo_id=?", woID).Scan(&ncrID)
+	return ncrID
+}
+
+// lastPOUnitPrice is the most recent non-zero PO price of a part, used to
+// cost rework material that was not drawn from any cost layer.
+func lastPOUnitPrice(tx *sql.Tx, ipn string) float64 {
+	var price float64
+	tx.QueryRow(`SELECT pl.unit_price FROM po_lines pl JOIN purchase_orders po ON po.id = pl.po_id
+		WHERE pl.ipn=? AND pl.unit_price > 0 ORDER BY po.created_at DESC, pl.id DESC LIMIT 1`, ipn).Scan(&price)
+	return price
+}
+
+func roundCost(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+const reworkOrderColumns = `ro.wo_id, ro.ncr_id, wo.assembly_ipn, wo.qty, COALESCE(wo.qty_good,0), COALESCE(wo.qty_scrap,0),
+	wo.status, wo.priority, COALESCE(ro.instructions,''), ro.lot_id, COALESCE(ro.from_stock,0),
+	COALESCE(ro.created_by,''), ro.created_at, wo.completed_at`
+
+// loadReworkOrders returns the rework orders matching where, with their
+// units, materials and cost to date. Labor still clocked in counts up to now.
+func loadReworkOrders(where string, args ...interface{}) ([]ReworkOrder, error) {
+	rows, err := db.Query("SELECT "+reworkOrderColumns+` FROM rework_orders ro
+		JOIN work_orders wo ON wo.id = ro.wo_id WHERE `+where+" ORDER BY ro.created_at, ro.wo_id", args...)
+	if err != nil {
+		return nil, err
+	}
+	orders := []ReworkOrder{}
+	for rows.Next() {
+		var o ReworkOrder
+		var lotID sql.NullInt64
+		var ca sql.NullString
+		if err := rows.Scan(&o.WOID, &o.NCRID, &o.IPN, &o.Qty, &o.QtyGood, &o.QtyScrap, &o.Status, &o.Priority,
+			&o.Instructions, &lotID, &o.FromStock, &o.CreatedBy, &o.CreatedAt, &ca); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if lotID.Valid {
+			id := int(lotID.Int64)
+			o.LotID = &id
+		}
+		o.CompletedAt = sp(ca)
+		orders = append(orders, o)
+	}
+	rows.Close()
+
+	for i := range orders {
+		o := &orders[i]
+		o.Serials = []string{}
+		urows, err := db.Query("SELECT serial_number FROM rework_units WHERE wo_id=? ORDER BY id", o.WOID)
+		if err != nil {
+			return nil, err
+		}
+		for urows.Next() {
+			var sn string
+			urows.Scan(&sn)
+			o.Serials = append(o.Serials, sn)
+		}
+		urows.Close()
+
+		o.Materials = []ReworkMaterial{}
+		mrows, err := db.Query("SELECT id, ipn, qty, COALESCE(unit_cost,0), issued_at, returned_at FROM rework_materials WHERE wo_id=? ORDER BY id", o.WOID)
+		if err != nil {
+			return nil, err
+		}
+		for mrows.Next() {
+			var m ReworkMaterial
+			var ra sql.NullString
+			mrows.Scan(&m.ID, &m.IPN, &m.Qty, &m.UnitCost, &m.IssuedAt, &ra)
+			m.ReturnedAt = sp(ra)
+			m.Cost = roundCost(m.Qty * m.UnitCost)
+			// Material given back on cancellation costs nothing
+			if m.ReturnedAt == nil {
+				o.MaterialCost += m.Qty * m.UnitCost
+			}
+			o.Materials = append(o.Materials, m)
+		}
+		mrows.Close()
+
+		entries, err := loadLaborEntries([]string{"l.wo_id = ?"}, []interface{}{o.WOID})
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			o.LaborMinutes += e.Minutes
+			o.LaborCost += laborCost(e, 0)
+		}
+		o.LaborMinutes = math.Round(o.LaborMinutes*100) / 100
+		o.LaborCost = roundCost(o.LaborCost)
+		o.MaterialCost = roundCost(o.MaterialCost)
+		o.TotalCost = roundCost(o.LaborCost + o.MaterialCost)
+	}
+	return orders, nil
+}
+
+// createReworkOrder raises a rework WO against an NCR: it pulls the affected
+// units out of stock if asked to, issues the replacement material and marks
+// the NCR dispositioned as rework. Problems with the request come back as
+// *ValidationErrors.
+func createReworkOrder(ncrID string, req ReworkRequest, username string) (string, error) {
+	var ncrIPN, ncrSerial, corrective, severity, ncrStatus string
+	err := db.QueryRow("SELECT COALESCE(ipn,''), COALESCE(serial_number,''), COALESCE(corrective_action,''), COALESCE(severity,''), status FROM ncrs WHERE id=?", ncrID).
+		Scan(&ncrIPN, &ncrSerial, &corrective, &severity, &ncrStatus)
+	if err != nil {
+		return "", fmt.Errorf("NCR %s not found", ncrID)
+	}
+	if strings.TrimSpace(req.IPN) == "" {
+		req.IPN = ncrIPN
+	}
+	req.IPN = strings.TrimSpace(req.IPN)
+	if req.Instructions == "" {
+		req.Instructions = corrective
+	}
+	if req.Priority == "" {
+		switch severity {
+		case "critical":
+			req.Priority = "critical"
+		case "major":
+			req.Priority = "high"
+		default:
+			req.Priority = "normal"
+		}
+	}
+	var serials []string
+	seen := map[string]bool{}
+	for _, sn := range req.Serials {
+		sn = strings.TrimSpace(sn)
+		if sn != "" && !seen[sn] {
+			seen[sn] = true
+			serials = append(serials, sn)
+		}
+	}
+	if len(serials) == 0 && req.LotID == nil && req.Qty == 0 && ncrSerial != "" {
+		serials = []string{ncrSerial}
+	}
+	fromStock := req.LotID != nil
+	if req.FromStock != nil {
+		fromStock = *req.FromStock
+	}
+
+	ve := &ValidationErrors{}
+	if ncrStatus == "closed" {
+		ve.Add("ncr", ncrID+" is closed")
+	}
+	requireField(ve, "ipn", req.IPN)
+	validateMaxLength(ve, "ipn", req.IPN, 100)
+	validateMaxLength(ve, "instructions", req.Instructions, 10000)
+	validateEnum(ve, "priority", req.Priority, validWOPriorities)
+	validateDate(ve, "due_date", req.DueDate)
+	for _, sn := range serials {
+		validateMaxLength(ve, "serials", sn, 100)
+	}
+	switch {
+	case len(serials) > 0 && req.Qty != 0 && req.Qty != len(serials):
+		ve.Add("qty", fmt.Sprintf("must match the %d serials given", len(serials)))
+	case len(serials) > 0:
+		req.Qty = len(serials)
+	case req.Qty == 0:
+		req.Qty = 1
+	}
+	validateIntRange(ve, "qty", req.Qty, 1, MaxWorkOrderQty)
+	for i, m := range req.Materials {
+		field := fmt.Sprintf("materials[%d]", i)
+		requireField(ve, field+".ipn", m.IPN)
+		if m.Qty <= 0 {
+			ve.Add(field+".qty", "must be positive")
+		}
+	}
+	if ve.HasErrors() {
+		return "", ve
+	}
+
+	woID := nextID("WO", "work_orders", 4)
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// A unit can only be in one open rework order at a time
+	for _, sn := range serials {
+		var other string
+		err := tx.QueryRow(`SELECT ru.wo_id FROM rework_units ru JOIN work_orders wo ON wo.id = ru.wo_id
+			WHERE ru.serial_number=? AND wo.status NOT IN ('completed','cancelled')`, sn).Scan(&other)
+		if err == nil {
+			ve.Add("serials", sn+" is already in rework order "+other)
+		}
+	}
+
+	// Stock needed per IPN: the units pulled for rework and the material
+	need := map[string]float64{}
+	if fromStock {
+		need[req.IPN] += float64(req.Qty)
+	}
+	if req.LotID != nil {
+		var lotIPN string
+		var onHand float64
+		if err := tx.QueryRow("SELECT ipn, qty_on_hand FROM inventory_lots WHERE id=?", *req.LotID).Scan(&lotIPN, &onHand); err != nil {
+			ve.Add("lot_id", fmt.Sprintf("lot %d not found", *req.LotID))
+		} else if lotIPN != req.IPN {
+			ve.Add("lot_id", fmt.Sprintf("lot %d is %s, not %s", *req.LotID, lotIPN, req.IPN))
+		} else if fromStock && float64(req.Qty) > onHand+1e-9 {
+			ve.Add("lot_id", fmt.Sprintf("lot %d has only %g left", *req.LotID, onHand))
+		}
+	}
+	for i, m := range req.Materials {
+		need[m.IPN] += m.Qty
+		if len(m.Lots) > 0 {
+			if err := validateLotPicks(tx, m.IPN, m.Lots); err != nil {
+				ve.Add(fmt.Sprintf("materials[%d].lots", i), err.Error())
+			}
+			picked := 0.0
+			for _, p := range m.Lots {
+				picked += p.Qty
+			}
+			if math.Abs(picked-m.Qty) > 1e-9 {
+				ve.Add(fmt.Sprintf("materials[%d].lots", i), fmt.Sprintf("lots add up to %g, not %g", picked, m.Qty))
+			}
+		}
+	}
+	for ipn, qty := range need {
+		var onHand, reserved float64
+		if err := tx.QueryRow("SELECT qty_on_hand, COALESCE(qty_reserved,0) FROM inventory WHERE ipn=?", ipn).Scan(&onHand, &reserved); err != nil {
+			ve.Add("materials", ipn+" is not in inventory")
+			continue
+		}
+		available := onHand - reserved
+		if ipn == req.IPN && fromStock {
+			// The affected units may well be reserved; they come out regardless
+			available = onHand
+		}
+		if qty > available+1e-9 {
+			ve.Add("materials", fmt.Sprintf("%s needs %g but only %g is available", ipn, qty, available))
+		}
+	}
+	if ve.HasErrors() {
+		return "", ve
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	notes := "Rework for " + ncrID
+	if req.Instructions != "" {
+		notes += ": " + req.Instructions
+	}
+	_, err = tx.Exec("INSERT INTO work_orders (id,assembly_ipn,qty,status,priority,notes,created_at) VALUES (?,?,?,?,?,?,?)",
+		woID, req.IPN, req.Qty, "open", req.Priority, notes, now)
+	if err != nil {
+		return "", err
+	}
+	if req.DueDate != "" {
+		if _, err := tx.Exec("UPDATE work_orders SET due_date=? WHERE id=?", req.DueDate, woID); err != nil {
+			return "", err
+		}
+	}
+	_, err = tx.Exec("INSERT INTO rework_orders (wo_id,ncr_id,instructions,lot_id,from_stock,created_by,created_at) VALUES (?,?,?,?,?,?,?)",
+		woID, ncrID, req.Instructions, req.LotID, fromStock, username, now)
+	if err != nil {
+		return "", fmt.Errorf("failed to create rework order: %w", err)
+	}
+	for _, sn := range serials {
+		if _, err := tx.Exec("INSERT INTO rework_units (wo_id,serial_number) VALUES (?,?)", woID, sn); err != nil {
+			return "", fmt.Errorf("failed to record unit %s: %w", sn, err)
+		}
+	}
+
+	// Units pulled for rework leave stock until the rework order completes
+	if fromStock {
+		var picks []LotPick
+		if req.LotID != nil {
+			picks = []LotPick{{LotID: *req.LotID, Qty: float64(req.Qty)}}
+		}
+		if err := checkUsableStock(tx, req.IPN, float64(req.Qty), time.Now()); err != nil {
+			return "", &ValidationErrors{Errors: []ValidationError{{Field: "qty", Message: err.Error()}}}
+		}
+		if _, err := tx.Exec("UPDATE inventory SET qty_on_hand = qty_on_hand - ?, updated_at = ? WHERE ipn = ?", req.Qty, now, req.IPN); err != nil {
+			return "", fmt.Errorf("failed to pull %s for rework: %w", req.IPN, err)
+		}
+		if _, err := issueFromLots(tx, req.IPN, float64(req.Qty), picks, "issue", woID, "Pulled for rework "+woID+" ("+ncrID+")", now); err != nil {
+			return "", err
+		}
+	}
+
+	for _, m := range req.Materials {
+		if err := checkUsableStock(tx, m.IPN, m.Qty, time.Now()); err != nil {
+			return "", &ValidationErrors{Errors: []ValidationError{{Field: "materials", Message: err.Error()}}}
+		}
+		mark := costIssueMark(tx)
+		if _, err := tx.Exec("UPDATE inventory SET qty_on_hand = qty_on_hand - ?, updated_at = ? WHERE ipn = ?", m.Qty, now, m.IPN); err != nil {
+			return "", fmt.Errorf("failed to issue %s: %w", m.IPN, err)
+		}
+		if err := takeOwnedStock(tx, m.IPN, m.Qty, "", woID, "Rework "+woID+" material ("+ncrID+")", username, now); err != nil {
+			return "", err
+		}
+		if _, err := issueFromLots(tx, m.IPN, m.Qty, m.Lots, "issue", woID, "Rework "+woID+" material ("+ncrID+")", now); err != nil {
+			return "", err
+		}
+		// Cost the material at the layers it was drawn from; parts with no
+		// layers fall back to their last PO price.
+		unitCost := lastPOUnitPrice(tx, m.IPN)
+		var drawn, cost float64
+		tx.QueryRow("SELECT COALESCE(SUM(qty),0), COALESCE(SUM(qty*unit_cost),0) FROM cost_layer_issues WHERE id > ? AND ipn=? AND reference=?",
+			mark, m.IPN, woID).Scan(&drawn, &cost)
+		if drawn > 0 {
+			unitCost = cost / drawn
+		}
+		_, err := tx.Exec("INSERT INTO rework_materials (wo_id,ipn,qty,unit_cost,issued_at) VALUES (?,?,?,?,?)",
+			woID, m.IPN, m.Qty, unitCost, now)
+		if err != nil {
+			return "", fmt.Errorf("failed to record rework material %s: %w", m.IPN, err)
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE ncrs SET disposition='rework' WHERE id=?", ncrID); err != nil {
+		return "", fmt.Errorf("failed to disposition %s: %w", ncrID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	logAudit(db, username, "created", "workorder", woID, fmt.Sprintf("Created rework WO %s for %s: %d x %s", woID, ncrID, req.Qty, req.IPN))
+	logAudit(db, username, "updated", "ncr", ncrID, "Dispositioned "+ncrID+" as rework ("+woID+")")
+	return woID, nil
+}
+
+// completeReworkOrder returns a completed rework order's good units to
+// stock: back into the lot they were pulled from, otherwise into a lot
+// named after the WO the way a production WO receives its output.
+func completeReworkOrder(tx *sql.Tx, woID, ipn string, good int, username string) error {
+	var lotID sql.NullInt64
+	var fromStock bool
+	if err := tx.QueryRow("SELECT lot_id, COALESCE(from_stock,0) FROM rework_orders WHERE wo_id=?", woID).Scan(&lotID, &fromStock); err != nil {
+		return fmt.Errorf("rework order %s not found: %w", woID, err)
+	}
+	if good <= 0 {
+		return clockOutWorkOrder(tx, woID, time.Now())
+	}
+	if !fromStock {
+		// Units reworked where they are, by serial or on the NCR alone,
+		// never left stock, so none come back in. Their cost still rolls
+		// up onto the NCR.
+		return clockOutWorkOrder(tx, woID, time.Now())
+	}
+	if !lotID.Valid {
+		return handleWorkOrderCompletion(tx, woID, ipn, good, username)
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	if _, err := tx.Exec("INSERT OR IGNORE INTO inventory (ipn, description) VALUES (?, ?)", ipn, ipn); err != nil {
+		return fmt.Errorf("failed to create inventory record: %w", err)
+	}
+	if _, err := tx.Exec("UPDATE inventory SET qty_on_hand = qty_on_hand + ?, updated_at = ? WHERE ipn = ?", good, now, ipn); err != nil {
+		return fmt.Errorf("failed to return reworked units: %w", err)
+	}
+	if err := returnToLot(tx, int(lotID.Int64), float64(good), woID, "Reworked by "+woID, now); err != nil {
+		return err
+	}
+	if err := capitalizeWO(tx, woID, ipn, float64(good), 0, true, now); err != nil {
+		return err
+	}
+	return clockOutWorkOrder(tx, woID, time.Now())
+}
+
+// cancelReworkOrder puts back everything a cancelled rework order took out
+// of stock: the units pulled for it and the material issued to it.
+func cancelReworkOrder(tx *sql.Tx, woID string) error {
+	type issued struct {
+		ipn   string
+		qty   float64
+		lotID sql.NullInt64
+	}
+	rows, err := tx.Query("SELECT ipn, qty, lot_id FROM inventory_transactions WHERE reference=? AND type='issue' ORDER BY id", woID)
+	if err != nil {
+		return fmt.Errorf("failed to load issues of %s: %w", woID, err)
+	}
+	var issues []issued
+	for rows.Next() {
+		var i issued
+		rows.Scan(&i.ipn, &i.qty, &i.lotID)
+		issues = append(issues, i)
+	}
+	rows.Close()
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	note := "Rework " + woID + " cancelled"
+	for _, i := range issues {
+		if _, err := tx.Exec("UPDATE inventory SET qty_on_hand = qty_on_hand + ?, updated_at = ? WHERE ipn = ?", i.qty, now, i.ipn); err != nil {
+			return fmt.Errorf("failed to return %s: %w", i.ipn, err)
+		}
+		if i.lotID.Valid {
+			err = returnToLot(tx, int(i.lotID.Int64), i.qty, woID, note, now)
+		} else {
+			_, err = tx.Exec("INSERT INTO inventory_transactions (ipn,type,qty,reference,notes,created_at) VALUES (?,?,?,?,?,?)",
+				i.ipn, "return", i.qty, woID, note, now)
+		}
+		if err == nil {
+			err = syncCostLayers(tx, i.ipn, "return", woID, 0, now)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to return %s: %w", i.ipn, err)
+		}
+	}
+	if _, err := tx.Exec("UPDATE rework_materials SET returned_at=? WHERE wo_id=? AND returned_at IS NULL", now, woID); err != nil {
+		return err
+	}
+	return clockOutWorkOrder(tx, woID, time.Now())
+}
+
+// rollUpNCRRework stores the rework cost of an NCR and, once its last rework
+// order has closed with at least one completed, resolves the NCR.
+func rollUpNCRRework(ncrID, username string) {
+	orders, err := loadReworkOrders("ro.ncr_id = ?", ncrID)
+	if err != nil {
+		log.Printf("rolling up rework of %s: %v", ncrID, err)
+		return
+	}
+	var labor, material float64
+	open, completed := false, []string{}
+	for _, o := range orders {
+		labor += o.LaborCost
+		material += o.MaterialCost
+		if !woClosed(o.Status) {
+			open = true
+		} else if o.Status == "completed" {
+			completed = append(completed, o.WOID)
+		}
+	}
+	if _, err := db.Exec("UPDATE ncrs SET rework_labor_cost=?, rework_material_cost=? WHERE id=?", roundCost(labor), roundCost(material), ncrID); err != nil {
+		log.Printf("rolling up rework of %s: %v", ncrID, err)
+		return
+	}
+	if open || len(completed) == 0 {
+		return
+	}
+	now := time.Now().Format("2006-01-02 15:04:05")
+	res, err := db.Exec("UPDATE ncrs SET status='resolved', resolved_at=COALESCE(resolved_at,?) WHERE id=? AND status IN ('open','investigating')", now, ncrID)
+	if err != nil {
+		log.Printf("resolving %s: %v", ncrID, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		logAudit(db, username, "resolved", "ncr", ncrID, fmt.Sprintf("Resolved %s by rework %s (cost %.2f)", ncrID, strings.Join(completed, ", "), roundCost(labor+material)))
+	}
+}
+
+// attachNCRRework fills in an NCR's disposition and, when it has rework
+// orders, their IDs and cost to date.
+func attachNCRRework(n *NCR) {
+	if db.QueryRow("SELECT COALESCE(disposition,'') FROM ncrs WHERE id=?", n.ID).Scan(&n.Disposition) != nil {
+		return
+	}
+	orders, err := loadReworkOrders("ro.ncr_id = ?", n.ID)
+	if err != nil || len(orders) == 0 {
+		return
+	}
+	total := 0.0
+	for _, o := range orders {
+		n.ReworkWOIDs = append(n.ReworkWOIDs, o.WOID)
+		total += o.TotalCost
+	}
+	total = roundCost(total)
+	n.ReworkCost = &total
+}
+
+// handleCreateReworkOrder dispositions an NCR as rework and raises a rework
+// order for it.
+// POST /api/v1/ncrs/{id}/rework
+func handleCreateReworkOrder(w http.ResponseWriter, r *http.Request, ncrID string) {
+	var exists int
+	if err := db.QueryRow("SELECT 1 FROM ncrs WHERE id=?", ncrID).Scan(&exists); err != nil {
+		jsonErr(w, "NCR not found", 404)
+		return
+	}
+	var req ReworkRequest
+	if r.ContentLength != 0 {
+		if err := decodeBody(r, &req); err != nil {
+			jsonErr(w, "invalid body", 400)
+			return
+		}
+	}
+	woID, err := createReworkOrder(ncrID, req, getUsername(r))
+	if ve, ok := err.(*ValidationErrors); ok {
+		jsonErr(w, ve.Error(), 400)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	orders, err := loadReworkOrders("ro.wo_id = ?", woID)
+	if err != nil || len(orders) == 0 {
+		jsonErr(w, "failed to load rework order", 500)
+		return
+	}
+	recordChangeJSON(getUsername(r), "work_orders", woID, "create", nil, orders[0])
+	jsonResp(w, orders[0])
+}
+
+// handleListNCRRework returns an NCR's rework orders and their total cost.
+// GET /api/v1/ncrs/{id}/rework
+func handleListNCRRework(w http.ResponseWriter, r *http.Request, ncrID string) {
+	var disposition string
+	if err := db.QueryRow("SELECT COALESCE(disposition,'') FROM ncrs WHERE id=?", ncrID).Scan(&disposition); err != nil {
+		jsonErr(w, "NCR not found", 404)
+		return
+	}
+	orders, err := loadReworkOrders("ro.ncr_id = ?", ncrID)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	var labor, material float64
+	for _, o := range orders {
+		labor += o.LaborCost
+		material += o.MaterialCost
+	}
+	jsonResp(w, map[string]interface{}{
+		"ncr_id":        ncrID,
+		"disposition":   disposition,
+		"orders":        orders,
+		"labor_cost":    roundCost(labor),
+		"material_cost": roundCost(material),
+		"total_cost":    roundCost(labor + material),
+	})
+}
+
+// handleGetReworkOrder returns the rework details of a work order.
+// GET /api/v1/workorders/{id}/rework
+func handleGetReworkOrder(w http.ResponseWriter, r *http.Request, woID string) {
+	orders, err := loadReworkOrders("ro.wo_id = ?", woID)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if len(orders) == 0 {
+		jsonErr(w, "not a rework order", 404)
+		return
+	}
+	jsonResp(w, orders[0])
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// seedReworkNCR sets up NCR-001 against 10 x ASY-1 held in lot A-1, with
+// RES-1 in stock at a last PO price of 0.50 and a 60/h rework bench.
+func seedReworkNCR(t *testing.T) (lotID int) {
+	t.Helper()
+	stmts := []string{
+		`INSERT INTO inventory (ipn, qty_on_hand) VALUES ('ASY-1', 10), ('RES-1', 100)`,
+		`INSERT INTO purchase_orders (id, vendor_id, status, created_at) VALUES ('PO-1', 'V-1', 'received', '2026-01-01 00:00:00')`,
+		`INSERT INTO po_lines (po_id, ipn, qty_ordered, unit_price) VALUES ('PO-1', 'RES-1', 100, 0.5)`,
+		`INSERT INTO work_centers (id, name, labor_rate) VALUES ('WC-RW', 'Rework bench', 60)`,
+		`INSERT INTO ncrs (id, title, ipn, severity, status, corrective_action) VALUES ('NCR-001', 'Wrong R1 value', 'ASY-1', 'major', 'investigating', 'Replace R1 and R2')`,
+		`INSERT INTO ncrs (id, title, ipn, serial_number, status) VALUES ('NCR-002', 'Scratched case', 'ASY-1', 'SN-9', 'open')`,
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("seed failed: %v\n%s", err, s)
+		}
+	}
+	return seedLot(t, InventoryLot{IPN: "ASY-1", LotNumber: "A-1", QtyReceived: 10, QtyOnHand: 10})
+}
+
+func postRework(t *testing.T, ncrID, body string) (*httptest.ResponseRecorder, ReworkOrder) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleCreateReworkOrder(w, httptest.NewRequest("POST", "/api/v1/ncrs/"+ncrID+"/rework", bytes.NewBufferString(body)), ncrID)
+	var resp struct {
+		Data ReworkOrder `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp.Data
+}
+
+func setReworkStatus(t *testing.T, o ReworkOrder, status string, scrap int) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"assembly_ipn": o.IPN, "qty": o.Qty, "status": status, "priority": o.Priority, "qty_scrap": scrap})
+	w := httptest.NewRecorder()
+	handleUpdateWorkOrder(w, httptest.NewRequest("PUT", "/api/v1/workorders/"+o.WOID, bytes.NewBuffer(body)), o.WOID)
+	if w.Code != 200 {
+		t.Fatalf("setting %s to %s failed: %d %s", o.WOID, status, w.Code, w.Body.String())
+	}
+}
+
+func TestReworkOrderLifecycle(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	lotID := seedReworkNCR(t)
+
+	for _, body := range []string{
+		`{"lot_id":` + strconv.Itoa(lotID) + `,"qty":11}`,
+		`{"qty":3,"materials":[{"ipn":"RES-1","qty":101}]}`,
+		`{"qty":3,"materials":[{"ipn":"NOPE","qty":1}]}`,
+		`{"serials":["SN-1","SN-2"],"qty":3}`,
+		`{"ipn":"OTHER","lot_id":` + strconv.Itoa(lotID) + `,"qty":1}`,
+	} {
+		if w, _ := postRework(t, "NCR-001", body); w.Code != 400 {
+			t.Errorf("%s: expected 400, got %d %s", body, w.Code, w.Body.String())
+		}
+	}
+	if w, _ := postRework(t, "NCR-404", `{}`); w.Code != 404 {
+		t.Errorf("expected 404 for an unknown NCR, got %d", w.Code)
+	}
+
+	w, o := postRework(t, "NCR-001", `{"lot_id":`+strconv.Itoa(lotID)+`,"qty":3,"materials":[{"ipn":"RES-1","qty":6}]}`)
+	if w.Code != 200 {
+		t.Fatalf("create failed: %d %s", w.Code, w.Body.String())
+	}
+	if o.Priority != "high" || o.Instructions != "Replace R1 and R2" || !o.FromStock || o.MaterialCost != 3 || len(o.Materials) != 1 {
+		t.Errorf("unexpected rework order: %+v", o)
+	}
+	// The units come off the lot and the material is issued to the order
+	if onHand("ASY-1") != 7 || onHand("RES-1") != 94 {
+		t.Errorf("expected 7 ASY-1 and 94 RES-1 left, got %g and %g", onHand("ASY-1"), onHand("RES-1"))
+	}
+	if lot, _ := loadLot(lotID); lot.QtyOnHand != 7 {
+		t.Errorf("expected 7 left in the lot, got %g", lot.QtyOnHand)
+	}
+	var disposition string
+	db.QueryRow("SELECT disposition FROM ncrs WHERE id='NCR-001'").Scan(&disposition)
+	if disposition != "rework" {
+		t.Errorf("expected the NCR dispositioned as rework, got %q", disposition)
+	}
+
+	// Half an hour on the bench
+	res, _ := db.Exec("INSERT INTO wo_operations (wo_id, seq, name, work_center_id) VALUES (?, 10, 'Rework', 'WC-RW')", o.WOID)
+	opID, _ := res.LastInsertId()
+	db.Exec(`INSERT INTO labor_entries (wo_id, operation_id, username, clock_in, clock_out, accrued_at, minutes)
+		VALUES (?, ?, 'tech', '2026-01-02 09:00:00', '2026-01-02 09:30:00', '2026-01-02 09:30:00', 30)`, o.WOID, opID)
+
+	w = httptest.NewRecorder()
+	handleCompleteWorkOrderUnits(w, httptest.NewRequest("POST", "/api/v1/workorders/"+o.WOID+"/completions", bytes.NewBufferString(`{"qty":1}`)), o.WOID)
+	if w.Code != 400 {
+		t.Errorf("expected partial completion of a rework order to be refused, got %d", w.Code)
+	}
+
+	setReworkStatus(t, o, "in_progress", 0)
+	setReworkStatus(t, o, "completed", 1)
+	if onHand("ASY-1") != 9 {
+		t.Errorf("expected the 2 good units back in stock, got %g", onHand("ASY-1"))
+	}
+	if lot, _ := loadLot(lotID); lot.QtyOnHand != 9 {
+		t.Errorf("expected the good units back in lot A-1, got %g", lot.QtyOnHand)
+	}
+
+	w = httptest.NewRecorder()
+	handleGetNCR(w, httptest.NewRequest("GET", "/api/v1/ncrs/NCR-001", nil), "NCR-001")
+	var ncr struct {
+		Data NCR `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &ncr)
+	if ncr.Data.Status != "resolved" || ncr.Data.ResolvedAt == nil || ncr.Data.ReworkCost == nil || *ncr.Data.ReworkCost != 33 {
+		t.Errorf("expected NCR resolved with 30 labor + 3 material, got %s", w.Body.String())
+	}
+	var labor, material float64
+	db.QueryRow("SELECT rework_labor_cost, rework_material_cost FROM ncrs WHERE id='NCR-001'").Scan(&labor, &material)
+	if labor != 30 || material != 3 {
+		t.Errorf("expected the cost stored on the NCR, got %g + %g", labor, material)
+	}
+}
+
+func TestReworkFromDispositionAndCancel(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedReworkNCR(t)
+
+	// Dispositioning as rework raises an order for the NCR's serial
+	w := httptest.NewRecorder()
+	handleUpdateNCR(w, httptest.NewRequest("PUT", "/api/v1/ncrs/NCR-002", bytes.NewBufferString(
+		`{"title":"Scratched case","ipn":"ASY-1","serial_number":"SN-9","severity":"minor","status":"investigating","corrective_action":"Replace case","disposition":"rework"}`)), "NCR-002")
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	woID, _ := resp.Data["rework_wo_id"].(string)
+	if w.Code != 200 || woID == "" || resp.Data["disposition"] != "rework" {
+		t.Fatalf("expected a rework order from the disposition, got %d %s", w.Code, w.Body.String())
+	}
+	orders, _ := loadReworkOrders("ro.wo_id = ?", woID)
+	if len(orders) != 1 || len(orders[0].Serials) != 1 || orders[0].Serials[0] != "SN-9" || orders[0].Instructions != "Replace case" || orders[0].FromStock {
+		t.Fatalf("unexpected rework order: %+v", orders)
+	}
+	if w, _ := postRework(t, "NCR-002", `{"serials":["SN-9"]}`); w.Code != 400 {
+		t.Errorf("expected a unit already in rework to be refused, got %d", w.Code)
+	}
+
+	// Cancelling gives the material back and costs nothing
+	w, o := postRework(t, "NCR-002", `{"serials":["SN-10"],"materials":[{"ipn":"RES-1","qty":4}]}`)
+	if w.Code != 200 || onHand("RES-1") != 96 {
+		t.Fatalf("create failed: %d %s", w.Code, w.Body.String())
+	}
+	setReworkStatus(t, o, "cancelled", 0)
+	if onHand("RES-1") != 100 {
+		t.Errorf("expected the material returned, got %g", onHand("RES-1"))
+	}
+	w = httptest.NewRecorder()
+	handleListNCRRework(w, httptest.NewRequest("GET", "/api/v1/ncrs/NCR-002/rework", nil), "NCR-002")
+	var list struct {
+		Data struct {
+			Orders    []ReworkOrder `json:"orders"`
+			TotalCost float64       `json:"total_cost"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Data.Orders) != 2 || list.Data.TotalCost != 0 || list.Data.Orders[1].Materials[0].ReturnedAt == nil {
+		t.Errorf("unexpected rework list: %s", w.Body.String())
+	}
+	// One order is still open, so the NCR stays open
+	var status string
+	db.QueryRow("SELECT status FROM ncrs WHERE id='NCR-002'").Scan(&status)
+	if status != "investigating" {
+		t.Errorf("expected the NCR to stay investigating, got %s", status)
+	}
+}
+
+func TestReworkMaterialCostFromLayers(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedReworkNCR(t)
+	db.Exec(`INSERT INTO cost_layers (ipn, source_type, qty_received, qty_remaining, unit_cost, original_cost, created_at) VALUES
+		('RES-1', 'opening', 4, 4, 1, 1, '2026-01-01 00:00:00'), ('RES-1', 'receipt', 96, 96, 2, 2, '2026-02-01 00:00:00')`)
+
+	// Six drawn FIFO: 4 at 1.00 and 2 at 2.00, not the 0.50 last PO price
+	w, o := postRework(t, "NCR-001", `{"qty":1,"materials":[{"ipn":"RES-1","qty":6}]}`)
+	if w.Code != 200 {
+		t.Fatalf("create failed: %d %s", w.Code, w.Body.String())
+	}
+	if o.MaterialCost != 8 || len(o.Materials) != 1 || o.Materials[0].Cost != 8 {
+		t.Errorf("expected 8 of material at the layer cost, got %+v", o)
+	}
+}
+
+func TestReworkInPlaceLeavesStock(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedReworkNCR(t)
+
+	// A unit reworked by serial was never pulled, so none comes back in
+	w, o := postRework(t, "NCR-002", `{"serials":["SN-9"],"materials":[{"ipn":"RES-1","qty":2}]}`)
+	if w.Code != 200 || o.FromStock {
+		t.Fatalf("create failed: %d %s", w.Code, w.Body.String())
+	}
+	setReworkStatus(t, o, "in_progress", 0)
+	setReworkStatus(t, o, "completed", 0)
+	if onHand("ASY-1") != 10 || onHand("RES-1") != 98 {
+		t.Errorf("expected 10 ASY-1 and 98 RES-1, got %g and %g", onHand("ASY-1"), onHand("RES-1"))
+	}
+	var lots, receipts int
+	db.QueryRow("SELECT COUNT(*) FROM inventory_lots WHERE ipn='ASY-1'").Scan(&lots)
+	db.QueryRow("SELECT COUNT(*) FROM inventory_transactions WHERE ipn='ASY-1' AND type='receive'").Scan(&receipts)
+	if lots != 1 || receipts != 0 {
+		t.Errorf("expected no ASY-1 received, got %d lots and %d receipts", lots, receipts)
+	}
+	var material float64
+	db.QueryRow("SELECT rework_material_cost FROM ncrs WHERE id='NCR-002'").Scan(&material)
+	if material != 1 {
+		t.Errorf("expected the material cost rolled up onto the NCR, got %g", material)
+	}
+}
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// WorkCenter is a station or cell operations are performed at (SMT line,
+// reflow oven, AOI, test bench, ...).
+type WorkCenter struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	LaborRate   float64 `json:"labor_rate"`
+	Active      bool    `json:"active"`
+	CreatedAt   string  `json:"created_at"`
+}
+
+// RoutingStep is one step of the routing template for an assembly IPN.
+type RoutingStep struct {
+	ID           int     `json:"id"`
+	AssemblyIPN  string  `json:"assembly_ipn"`
+	Seq          int     `json:"seq"`
+	Name         string  `json:"name"`
+	WorkCenterID string  `json:"work_center_id"`
+	Instructions string  `json:"instructions"`
+	StdMinutes   float64 `json:"std_minutes"`
+}
+
+// WOOperation is a routing step instantiated for a work order. Operators
+// start and complete operations in sequence, recording good and scrapped
+// quantities as they go.
+type WOOperation struct {
+	ID             int     `json:"id"`
+	WOID           string  `json:"wo_id"`
+	Seq            int     `json:"seq"`
+	Name           string  `json:"name"`
+	WorkCenterID   string  `json:"work_center_id"`
+	WorkCenterName string  `json:"work_center_name"`
+	Instructions   string  `json:"instructions"`
+	Status         string  `json:"status"`
+	QtyGood        int     `json:"qty_good"`
+	QtyScrap       int     `json:"qty_scrap"`
+	StartedAt      *string `json:"started_at"`
+	StartedBy      string  `json:"started_by"`
+	CompletedAt    *string `json:"completed_at"`
+	CompletedBy    string  `json:"completed_by"`
+	Notes          string  `json:"notes"`
+}
+
+// ── Work centers ──
+
+func handleListWorkCenters(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT id,name,COALESCE(description,''),COALESCE(labor_rate,0),active,created_at FROM work_centers ORDER BY id")
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	var items []WorkCenter
+	for rows.Next() {
+		var wc WorkCenter
+		rows.Scan(&wc.ID, &wc.Name, &wc.Description, &wc.LaborRate, &wc.Active, &wc.CreatedAt)
+		items = append(items, wc)
+	}
+	if items == nil {
+		items = []WorkCenter{}
+	}
+	jsonResp(w, items)
+}
+
+func handleGetWorkCenter(w http.ResponseWriter, r *http.Request, id string) {
+	var wc WorkCenter
+	err := db.QueryRow("SELECT id,name,COALESCE(description,''),COALESCE(labor_rate,0),active,created_at FROM work_centers WHERE id=?", id).
+		Scan(&wc.ID, &wc.Name, &wc.Description, &wc.LaborRate, &wc.Active, &wc.CreatedAt)
+	if err != nil {
+		jsonErr(w, "not found", 404)
+		return
+	}
+	jsonResp(w, wc)
+}
+
+func handleCreateWorkCenter(w http.ResponseWriter, r *http.Request) {
+	var wc WorkCenter
+	if err := decodeBody(r, &wc); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+
+	ve := &ValidationErrors{}
+	requireField(ve, "name", wc.Name)
+	validateMaxLength(ve, "name", wc.Name, 255)
+	validateMaxLength(ve, "description", wc.Description, 10000)
+	if wc.LaborRate < 0 {
+		ve.Add("labor_rate", "must be non-negative")
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	var maxNum int
+	db.QueryRow("SELECT COALESCE(MAX(CAST(SUBSTR(id,4) AS INTEGER)),0) FROM work_centers WHERE id LIKE 'WC-%'").Scan(&maxNum)
+	wc.ID = fmt.Sprintf("WC-%03d", maxNum+1)
+	wc.Active = true
+	wc.CreatedAt = time.Now().Format("2006-01-02 15:04:05")
+	_, err := db.Exec("INSERT INTO work_centers (id,name,description,labor_rate,active,created_at) VALUES (?,?,?,?,1,?)",
+		wc.ID, wc.Name, wc.Description, wc.LaborRate, wc.CreatedAt)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, getUsername(r), "created", "workcenter", wc.ID, "Created work center "+wc.Name)
+	recordChangeJSON(getUsername(r), "work_centers", wc.ID, "create", nil, wc)
+	jsonResp(w, wc)
+}
+
+func handleUpdateWorkCenter(w http.ResponseWriter, r *http.Request, id string) {
+	var old WorkCenter
+	err := db.QueryRow("SELECT id,name,COALESCE(description,''),COALESCE(labor_rate,0),active,created_at FROM work_centers WHERE id=?", id).
+		Scan(&old.ID, &old.Name, &old.Description, &old.LaborRate, &old.Active, &old.CreatedAt)
+	if err != nil {
+		jsonErr(w, "not found", 404)
+		return
+	}
+
+	var wc WorkCenter
+	if err := decodeBody(r, &wc); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+
+	ve := &ValidationErrors{}
+	requireField(ve, "name", wc.Name)
+	validateMaxLength(ve, "name", wc.Name, 255)
+	validateMaxLength(ve, "description", wc.Description, 10000)
+	if wc.LaborRate < 0 {
+		ve.Add("labor_rate", "must be non-negative")
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	_, err = db.Exec("UPDATE work_centers SET name=?,description=?,labor_rate=?,active=? WHERE id=?", wc.Name, wc.Description, wc.LaborRate, wc.Active, id)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	wc.ID = id
+	wc.CreatedAt = old.CreatedAt
+	logAudit(db, getUsername(r), "updated", "workcenter", id, "Updated work center "+wc.Name)
+	recordChangeJSON(getUsername(r), "work_centers", id, "update", old, wc)
+	handleGetWorkCenter(w, r, id)
+}
+
+// ── Routing templates ──
+
+func loadRoutingSteps(ipn string) ([]RoutingStep, error) {
+	rows, err := db.Query(`SELECT id,assembly_ipn,seq,name,COALESCE(work_center_id,''),COALESCE(instructions,''),COALESCE(std_minutes,0)
+		FROM routing_steps WHERE assembly_ipn=? ORDER BY seq`, ipn)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	steps := []RoutingStep{}
+	for rows.Next() {
+		var s RoutingStep
+		if err := rows.Scan(&s.ID, &s.AssemblyIPN, &s.Seq, &s.Name, &s.WorkCenterID, &s.Instructions, &s.StdMinutes); err != nil {
+			return nil, err
+		}
+		steps = append(steps, s)
+	}
+	return steps, rows.Err()
+}
+
+// handleListRoutings summarises which assemblies have a routing template.
+func handleListRoutings(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT assembly_ipn, COUNT(*), COALESCE(SUM(std_minutes),0)
+		FROM routing_steps GROUP BY assembly_ipn ORDER BY assembly_ipn`)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	type routingSummary struct {
+		AssemblyIPN string  `json:"assembly_ipn"`
+		StepCount   int     `json:"step_count"`
+		StdMinutes  float64 `json:"std_minutes"`
+	}
+	items := []routingSummary{}
+	for rows.Next() {
+		var s routingSummary
+		rows.Scan(&s.AssemblyIPN, &s.StepCount, &s.StdMinutes)
+		items = append(items, s)
+	}
+	jsonResp(w, items)
+}
+
+func handleGetRouting(w http.ResponseWriter, r *http.Request, ipn string) {
+	steps, err := loadRoutingSteps(ipn)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	jsonResp(w, map[string]interface{}{"assembly_ipn": ipn, "steps": steps})
+}
+
+// handleUpdateRouting replaces the routing template for an assembly. Steps
+// without a seq are numbered 10, 20, 30... in the order given. Work orders
+// already created keep the operations they were released with.
+func handleUpdateRouting(w http.ResponseWriter, r *http.Request, ipn string) {
+	var body struct {
+		Steps []RoutingStep `json:"steps"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+
+	ve := &ValidationErrors{}
+	validateMaxLength(ve, "assembly_ipn", ipn, 100)
+	seen := map[int]bool{}
+	for i := range body.Steps {
+		s := &body.Steps[i]
+		field := fmt.Sprintf("steps[%d]", i)
+		if s.Seq == 0 {
+			s.Seq = (i + 1) * 10
+		}
+		if s.Seq < 0 {
+			ve.Add(field+".seq", "must be positive")
+		} else if seen[s.Seq] {
+			ve.Add(field+".seq", fmt.Sprintf("duplicate seq %d", s.Seq))
+		}
+		seen[s.Seq] = true
+		requireField(ve, field+".name", s.Name)
+		validateMaxLength(ve, field+".name", s.Name, 255)
+		validateMaxLength(ve, field+".instructions", s.Instructions, 10000)
+		if s.StdMinutes < 0 {
+			ve.Add(field+".std_minutes", "must be non-negative")
+		}
+		if s.WorkCenterID != "" {
+			var exists int
+			if err := db.QueryRow("SELECT 1 FROM work_centers WHERE id=?", s.WorkCenterID).Scan(&exists); err != nil {
+				ve.Add(field+".work_center_id", "unknown work center "+s.WorkCenterID)
+			}
+		}
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	oldSteps, _ := loadRoutingSteps(ipn)
+
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM routing_steps WHERE assembly_ipn=?", ipn); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	for _, s := range body.Steps {
+		_, err := tx.Exec("INSERT INTO routing_steps (assembly_ipn,seq,name,work_center_id,instructions,std_minutes) VALUES (?,?,?,?,?,?)",
+			ipn, s.Seq, s.Name, s.WorkCenterID, s.Instructions, s.StdMinutes)
+		if err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+
+	steps, _ := loadRoutingSteps(ipn)
+	logAudit(db, getUsername(r), "updated", "routing", ipn, fmt.Sprintf("Updated routing for %s (%d steps)", ipn, len(steps)))
+	recordChangeJSON(getUsername(r), "routing_steps", ipn, "update", oldSteps, steps)
+	jsonResp(w, map[string]interface{}{"assembly_ipn": ipn, "steps": steps})
+}
+
+// ── Work order operations ──
+
+// instantiateWorkOrderOperations copies the assembly's routing template onto
+// a work order as pending operations and returns how many were created.
+func instantiateWorkOrderOperations(tx *sql.Tx, woID, assemblyIPN string) (int, error) {
+	res, err := tx.Exec(`INSERT INTO wo_operations (wo_id,seq,name,work_center_id,instructions,status)
+		SELECT ?, seq, name, COALESCE(work_center_id,''), COALESCE(instructions,''), 'pending'
+		FROM routing_steps WHERE assembly_ipn=? ORDER BY seq`, woID, assemblyIPN)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create operations for %s: %w", woID, err)
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+const woOperationColumns = `o.id, o.wo_id, o.seq, o.name, COALESCE(o.work_center_id,''), COALESCE(wc.name,''),
+	COALESCE(o.instructions,''), o.status, COALESCE(o.qty_good,0), COALESCE(o.qty_scrap,0),
+	o.started_at, COALESCE(o.started_by,''), o.completed_at, COALESCE(o.completed_by,''), COALESCE(o.notes,'')`
+
+// loadWorkOrderOperations returns a work order's operations in sequence.
+// Accepts either the db or an open transaction.
+func loadWorkOrderOperations(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, woID string) ([]WOOperation, error) {
+	rows, err := q.Query(`SELECT `+woOperationColumns+` FROM wo_operations o
+		LEFT JOIN work_centers wc ON wc.id = o.work_center_id
+		WHERE o.wo_id=? ORDER BY o.seq`, woID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ops := []WOOperation{}
+	for rows.Next() {
+		var op WOOperation
+		var sa, ca sql.NullString
+		if err := rows.Scan(&op.ID, &op.WOID, &op.Seq, &op.Name, &op.WorkCenterID, &op.WorkCenterName, &op.Instructions,
+			&op.Status, &op.QtyGood, &op.QtyScrap, &sa, &op.StartedBy, &ca, &op.CompletedBy, &op.Notes); err != nil {
+			return nil, err
+		}
+		op.StartedAt = sp(sa)
+		op.CompletedAt = sp(ca)
+		ops = append(ops, op)
+	}
+	return ops, rows.Err()
+}
+
+func opDone(op WOOperation) bool {
+	return op.Status == "completed" || op.Status == "skipped"
+}
+
+func handleListWorkOrderOperations(w http.ResponseWriter, r *http.Request, id string) {
+	var exists int
+	if err := db.QueryRow("SELECT 1 FROM work_orders WHERE id=?", id).Scan(&exists); err != nil {
+		jsonErr(w, "work order not found", 404)
+		return
+	}
+	ops, err := loadWorkOrderOperations(db, id)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	jsonResp(w, ops)
+}
+
+// handleReloadWorkOrderOperations re-copies the current routing template onto
+// a work order. Only allowed while no operation has been started, so a WO
+// created before its routing existed can still pick it up.
+func handleReloadWorkOrderOperations(w http.ResponseWriter, r *http.Request, id string) {
+	var assemblyIPN, status string
+	if err := db.QueryRow("SELECT assembly_ipn, status FROM work_orders WHERE id=?", id).Scan(&assemblyIPN, &status); err != nil {
+		jsonErr(w, "work order not found", 404)
+		return
+	}
+	if status == "completed" || status == "cancelled" {
+		jsonErr(w, "work order is "+status, 400)
+		return
+	}
+	var started int
+	db.QueryRow("SELECT COUNT(*) FROM wo_operations WHERE wo_id=? AND status != 'pending'", id).Scan(&started)
+	if started > 0 {
+		jsonErr(w, "operations already in progress; routing can no longer be reloaded", 409)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM wo_operations WHERE wo_id=?", id); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	n, err := instantiateWorkOrderOperations(tx, id, assemblyIPN)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+
+	logAudit(db, getUsername(r), "updated", "workorder", id, fmt.Sprintf("Loaded %d routing operations onto WO %s", n, id))
+	handleListWorkOrderOperations(w, r, id)
+}
+
+// handleWorkOrderOperationAction starts, completes or skips one operation and
+// advances the work order: the first start moves it to in_progress, and
+// finishing the last operation completes it with the final good quantity.
+func handleWorkOrderOperationAction(w http.ResponseWriter, r *http.Request, woID, opIDStr, action string) {
+	opID, err := strconv.Atoi(opIDStr)
+	if err != nil {
+		jsonErr(w, "invalid operation id", 400)
+		return
+	}
+
+	var body struct {
+		QtyGood  *int   `json:"qty_good"`
+		QtyScrap int    `json:"qty_scrap"`
+		Notes    string `json:"notes"`
+	}
+	if action == "complete" || action == "skip" {
+		if r.ContentLength != 0 {
+			if err := decodeBody(r, &body); err != nil {
+				jsonErr(w, "invalid body", 400)
+				return
+			}
+		}
+	}
+
+	var assemblyIPN, woStatus string
+	var woQty int
+	if err := db.QueryRow("SELECT assembly_ipn, qty, status FROM work_orders WHERE id=?", woID).Scan(&assemblyIPN, &woQty, &woStatus); err != nil {
+		jsonErr(w, "work order not found", 404)
+		return
+	}
+	if woStatus != "open" && woStatus != "in_progress" {
+		jsonErr(w, "work order is "+woStatus+"; operations can only be worked on open or in-progress work orders", 400)
+		return
+	}
+	if action == "start" && woStatus == "open" {
+		if msg := childWOStartBlock(woID); msg != "" {
+			jsonErr(w, msg, 400)
+			return
+		}
+	}
+	// Finishing the last operation closes the WO the same way a status
+	// update does, so what that needs is read before the transaction
+	ncrID := reworkNCRID(woID)
+	var stagedUse map[string]float64
+	if action != "start" && ncrID == "" {
+		stagedUse = stagedUseForClose(woID, assemblyIPN, woQty)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+
+	ops, err := loadWorkOrderOperations(tx, woID)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	idx := -1
+	for i, op := range ops {
+		if op.ID == opID {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		jsonErr(w, "operation not found", 404)
+		return
+	}
+	op := ops[idx]
+
+	// Quantity arriving at this operation is what the last completed
+	// operation passed as good, or the WO quantity for the first one
+	qtyIn := woQty
+	for _, prev := range ops[:idx] {
+		if !opDone(prev) {
+			jsonErr(w, fmt.Sprintf("operation %d (%s) must be completed first", prev.Seq, prev.Name), 400)
+			return
+		}
+		if prev.Status == "completed" {
+			qtyIn = prev.QtyGood
+		}
+	}
+
+	username := getUsername(r)
+	now := time.Now().Format("2006-01-02 15:04:05")
+	var summary string
+
+	switch action {
+	case "start":
+		if op.Status != "pending" {
+			jsonErr(w, "operation is already "+op.Status, 400)
+			return
+		}
+		if _, err := tx.Exec("UPDATE wo_operations SET status='in_progress', started_at=?, started_by=? WHERE id=?", now, username, opID); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		if woStatus == "open" {
+			if _, err := tx.Exec("UPDATE work_orders SET status='in_progress', started_at=COALESCE(started_at, ?) WHERE id=?", now, woID); err != nil {
+				jsonErr(w, err.Error(), 500)
+				return
+			}
+			woStatus = "in_progress"
+		}
+		summary = fmt.Sprintf("Started operation %d (%s) on WO %s", op.Seq, op.Name, woID)
+
+	case "complete":
+		if op.Status != "in_progress" {
+			jsonErr(w, "operation must be started before it can be completed", 400)
+			return
+		}
+		good := qtyIn - body.QtyScrap
+		if body.QtyGood != nil {
+			good = *body.QtyGood
+		}
+		ve := &ValidationErrors{}
+		if good < 0 {
+			ve.Add("qty_good", "must be non-negative")
+		}
+		if body.QtyScrap < 0 {
+			ve.Add("qty_scrap", "must be non-negative")
+		}
+		if good+body.QtyScrap > qtyIn {
+			ve.Add("qty_good", fmt.Sprintf("good + scrap (%d) exceeds the %d units available at this operation", good+body.QtyScrap, qtyIn))
+		}
+		validateMaxLength(ve, "notes", body.Notes, 10000)
+		if ve.HasErrors() {
+			jsonErr(w, ve.Error(), 400)
+			return
+		}
+		_, err := tx.Exec("UPDATE wo_operations SET status='completed', qty_good=?, qty_scrap=?, completed_at=?, completed_by=?, notes=? WHERE id=?",
+			good, body.QtyScrap, now, username, body.Notes, opID)
+		if err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		ops[idx].Status, ops[idx].QtyGood, ops[idx].QtyScrap = "completed", good, body.QtyScrap
+		summary = fmt.Sprintf("Completed operation %d (%s) on WO %s: %d good, %d scrap", op.Seq, op.Name, woID, good, body.QtyScrap)
+
+	case "skip":
+		if op.Status != "pending" {
+			jsonErr(w, "only pending operations can be skipped", 400)
+			return
+		}
+		ve := &ValidationErrors{}
+		validateMaxLength(ve, "notes", body.Notes, 10000)
+		if ve.HasErrors() {
+			jsonErr(w, ve.Error(), 400)
+			return
+		}
+		if _, err := tx.Exec("UPDATE wo_operations SET status='skipped', completed_at=?, completed_by=?, notes=? WHERE id=?", now, username, body.Notes, opID); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		ops[idx].Status = "skipped"
+		summary = fmt.Sprintf("Skipped operation %d (%s) on WO %s", op.Seq, op.Name, woID)
+
+	default:
+		jsonErr(w, "unknown operation action "+action, 400)
+		return
+	}
+
+	// Finishing the last open operation completes the work order with what
+	// came out of the final completed operation
+	allDone := true
+	finalGood, totalScrap := woQty, 0
+	for _, o := range ops {
+		if !opDone(o) {
+			allDone = false
+			break
+		}
+		if o.Status == "completed" {
+			finalGood = o.QtyGood
+			totalScrap += o.QtyScrap
+		}
+	}
+	if allDone {
+		// Good units already received by partial completions are in stock
+		var received int
+		tx.QueryRow("SELECT COALESCE(SUM(qty),0) FROM wo_completions WHERE wo_id=? AND event_type='complete' AND reversed_at IS NULL", woID).Scan(&received)
+		_, err := tx.Exec("UPDATE work_orders SET status='completed', qty_good=?, qty_scrap=?, started_at=COALESCE(started_at, ?), completed_at=? WHERE id=?",
+			finalGood, totalScrap, now, now, woID)
+		if err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		fg := finalGood - received
+		if fg < 0 {
+			fg = 0
+		}
+		if err := closeWorkOrder(tx, woID, assemblyIPN, ncrID, fg, stagedUse, username); err != nil {
+			jsonErr(w, "failed to update inventory on completion: "+err.Error(), 500)
+			return
+		}
+		woStatus = "completed"
+	}
+
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+
+	logAudit(db, username, action, "workorder", woID, summary)
+	if woStatus == "completed" {
+		logAudit(db, username, "completed", "workorder", woID, fmt.Sprintf("WO %s completed from routing: %d good, %d scrap", woID, finalGood, totalScrap))
+		if ncrID != "" {
+			rollUpNCRRework(ncrID, username)
+		}
+	}
+
+	updated, _ := loadWorkOrderOperations(db, woID)
+	for _, o := range updated {
+		if o.ID == opID {
+			op = o
+		}
+	}
+	jsonResp(w, map[string]interface{}{"operation": op, "wo_status": woStatus})
+}
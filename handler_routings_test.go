@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func createTestWorkCenter(t *testing.T, name string) WorkCenter {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/api/v1/work-centers", bytes.NewBufferString(`{"name":"`+name+`"}`))
+	w := httptest.NewRecorder()
+	handleCreateWorkCenter(w, req)
+	if w.Code != 200 {
+		t.Fatalf("create work center failed: %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Data WorkCenter `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp.Data
+}
+
+func putTestRouting(t *testing.T, ipn, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("PUT", "/api/v1/routings/"+ipn, bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	handleUpdateRouting(w, req, ipn)
+	return w
+}
+
+func createTestWorkOrder(t *testing.T, ipn string, qty int) string {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"assembly_ipn": ipn, "qty": qty, "status": "open"})
+	w := httptest.NewRecorder()
+	handleCreateWorkOrder(w, httptest.NewRequest("POST", "/api/v1/workorders", bytes.NewReader(body)))
+	if w.Code != 200 {
+		t.Fatalf("create work order failed: %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Data WorkOrder `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp.Data.ID
+}
+
+func operationAction(t *testing.T, woID string, opID int, action, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	id := strconv.Itoa(opID)
+	req := httptest.NewRequest("POST", "/api/v1/workorders/"+woID+"/operations/"+id+"/"+action, bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	handleWorkOrderOperationAction(w, req, woID, id, action)
+	return w
+}
+
+func woStatusAndQty(t *testing.T, id string) (status string, good, scrap int) {
+	t.Helper()
+	if err := db.QueryRow("SELECT status, COALESCE(qty_good,0), COALESCE(qty_scrap,0) FROM work_orders WHERE id=?", id).Scan(&status, &good, &scrap); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestWorkCenterCRUD(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+
+	smt := createTestWorkCenter(t, "SMT Line 1")
+	if smt.ID != "WC-001" || !smt.Active {
+		t.Errorf("unexpected work center: %+v", smt)
+	}
+	if aoi := createTestWorkCenter(t, "AOI"); aoi.ID != "WC-002" {
+		t.Errorf("expected WC-002, got %s", aoi.ID)
+	}
+
+	w := httptest.NewRecorder()
+	handleCreateWorkCenter(w, httptest.NewRequest("POST", "/api/v1/work-centers", bytes.NewBufferString(`{"name":""}`)))
+	if w.Code != 400 {
+		t.Errorf("expected 400 for missing name, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handleUpdateWorkCenter(w, httptest.NewRequest("PUT", "/api/v1/work-centers/WC-001",
+		bytes.NewBufferString(`{"name":"SMT Line 1","description":"Retired","active":false}`)), "WC-001")
+	if w.Code != 200 {
+		t.Fatalf("update failed: %d %s", w.Code, w.Body.String())
+	}
+	var active bool
+	db.QueryRow("SELECT active FROM work_centers WHERE id='WC-001'").Scan(&active)
+	if active {
+		t.Error("expected WC-001 to be inactive")
+	}
+
+	w = httptest.NewRecorder()
+	handleUpdateWorkCenter(w, httptest.NewRequest("PUT", "/api/v1/work-centers/WC-999", bytes.NewBufferString(`{"name":"x"}`)), "WC-999")
+	if w.Code != 404 {
+		t.Errorf("expected 404 for unknown work center, got %d", w.Code)
+	}
+}
+
+func TestUpdateRouting(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	createTestWorkCenter(t, "SMT")
+
+	w := putTestRouting(t, "PCA-100", `{"steps":[
+		{"name":"SMT","work_center_id":"WC-001","std_minutes":12},
+		{"name":"Reflow"},
+		{"name":"Test","std_minutes":5}]}`)
+	if w.Code != 200 {
+		t.Fatalf("put routing failed: %d %s", w.Code, w.Body.String())
+	}
+	steps, _ := loadRoutingSteps("PCA-100")
+	if len(steps) != 3 || steps[0].Seq != 10 || steps[2].Seq != 30 || steps[2].Name != "Test" {
+		t.Errorf("unexpected steps: %+v", steps)
+	}
+
+	// Replacing the routing drops the old steps
+	if w := putTestRouting(t, "PCA-100", `{"steps":[{"seq":5,"name":"Pack"}]}`); w.Code != 200 {
+		t.Fatalf("replace routing failed: %d %s", w.Code, w.Body.String())
+	}
+	if steps, _ := loadRoutingSteps("PCA-100"); len(steps) != 1 || steps[0].Name != "Pack" {
+		t.Errorf("expected routing replaced, got %+v", steps)
+	}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"unknown work center", `{"steps":[{"name":"SMT","work_center_id":"WC-404"}]}`},
+		{"duplicate seq", `{"steps":[{"seq":10,"name":"A"},{"seq":10,"name":"B"}]}`},
+		{"missing name", `{"steps":[{"seq":10}]}`},
+		{"negative minutes", `{"steps":[{"name":"A","std_minutes":-1}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := putTestRouting(t, "PCA-100", tt.body); w.Code != 400 {
+				t.Errorf("expected 400, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWorkOrderOperations_AdvanceWorkOrder(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+
+	putTestRouting(t, "PCA-200", `{"steps":[{"name":"SMT"},{"name":"AOI"},{"name":"Test"}]}`)
+	woID := createTestWorkOrder(t, "PCA-200", 10)
+
+	ops, err := loadWorkOrderOperations(db, woID)
+	if err != nil || len(ops) != 3 {
+		t.Fatalf("expected 3 operations from routing, got %d (%v)", len(ops), err)
+	}
+
+	// Operations must run in sequence
+	if w := operationAction(t, woID, ops[1].ID, "start", ""); w.Code != 400 {
+		t.Errorf("expected 400 starting AOI before SMT, got %d", w.Code)
+	}
+	if w := operationAction(t, woID, ops[0].ID, "complete", `{"qty_good":10}`); w.Code != 400 {
+		t.Errorf("expected 400 completing an operation that wasn't started, got %d", w.Code)
+	}
+
+	if w := operationAction(t, woID, ops[0].ID, "start", ""); w.Code != 200 {
+		t.Fatalf("start SMT failed: %d %s", w.Code, w.Body.String())
+	}
+	if status, _, _ := woStatusAndQty(t, woID); status != "in_progress" {
+		t.Errorf("expected WO in_progress after first start, got %s", status)
+	}
+
+	if w := operationAction(t, woID, ops[0].ID, "complete", `{"qty_good":9,"qty_scrap":2}`); w.Code != 400 {
+		t.Errorf("expected 400 when good+scrap exceeds WO qty, got %d", w.Code)
+	}
+	if w := operationAction(t, woID, ops[0].ID, "complete", `{"qty_good":8,"qty_scrap":2}`); w.Code != 200 {
+		t.Fatalf("complete SMT failed: %d %s", w.Code, w.Body.String())
+	}
+
+	// AOI only receives the 8 good boards from SMT
+	operationAction(t, woID, ops[1].ID, "start", "")
+	if w := operationAction(t, woID, ops[1].ID, "complete", `{"qty_good":9}`); w.Code != 400 {
+		t.Errorf("expected 400 completing more than the 8 boards available, got %d", w.Code)
+	}
+	if w := operationAction(t, woID, ops[1].ID, "complete", `{"qty_scrap":1}`); w.Code != 200 {
+		t.Fatalf("complete AOI failed: %d %s", w.Code, w.Body.String())
+	}
+	ops, _ = loadWorkOrderOperations(db, woID)
+	if ops[1].QtyGood != 7 {
+		t.Errorf("expected qty_good to default to 7 remaining boards, got %d", ops[1].QtyGood)
+	}
+	if status, _, _ := woStatusAndQty(t, woID); status != "in_progress" {
+		t.Errorf("WO should stay in_progress until the last operation, got %s", status)
+	}
+
+	operationAction(t, woID, ops[2].ID, "start", "")
+	w := operationAction(t, woID, ops[2].ID, "complete", `{"qty_good":6,"qty_scrap":1,"notes":"1 failed ICT"}`)
+	if w.Code != 200 {
+		t.Fatalf("complete Test failed: %d %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), `"wo_status":"completed"`) {
+		t.Errorf("expected wo_status completed in response, got %s", w.Body.String())
+	}
+
+	status, good, scrap := woStatusAndQty(t, woID)
+	if status != "completed" || good != 6 || scrap != 4 {
+		t.Errorf("expected completed with 6 good / 4 scrap, got %s %d/%d", status, good, scrap)
+	}
+	var onHand float64
+	db.QueryRow("SELECT qty_on_hand FROM inventory WHERE ipn='PCA-200'").Scan(&onHand)
+	if onHand != 6 {
+		t.Errorf("expected 6 finished assemblies received, got %v", onHand)
+	}
+
+	if w := operationAction(t, woID, ops[2].ID, "start", ""); w.Code != 400 {
+		t.Errorf("expected 400 working on a completed WO, got %d", w.Code)
+	}
+}
+
+func TestWorkOrderOperations_SkipAndReload(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+
+	// WO created before its routing exists has no operations until reloaded
+	woID := createTestWorkOrder(t, "PCA-300", 5)
+	if ops, _ := loadWorkOrderOperations(db, woID); len(ops) != 0 {
+		t.Fatalf("expected no operations, got %d", len(ops))
+	}
+	putTestRouting(t, "PCA-300", `{"steps":[{"name":"SMT"},{"name":"Conformal coat"}]}`)
+
+	w := httptest.NewRecorder()
+	handleReloadWorkOrderOperations(w, httptest.NewRequest("POST", "/api/v1/workorders/"+woID+"/operations", nil), woID)
+	if w.Code != 200 {
+		t.Fatalf("reload failed: %d %s", w.Code, w.Body.String())
+	}
+	ops, _ := loadWorkOrderOperations(db, woID)
+	if len(ops) != 2 {
+		t.Fatalf("expected 2 operations after reload, got %d", len(ops))
+	}
+
+	operationAction(t, woID, ops[0].ID, "start", "")
+	w = httptest.NewRecorder()
+	handleReloadWorkOrderOperations(w, httptest.NewRequest("POST", "/api/v1/workorders/"+woID+"/operations", nil), woID)
+	if w.Code != 409 {
+		t.Errorf("expected 409 reloading once work has started, got %d", w.Code)
+	}
+
+	operationAction(t, woID, ops[0].ID, "complete", `{"qty_good":5}`)
+	if w := operationAction(t, woID, ops[1].ID, "skip", `{"notes":"not required for this customer"}`); w.Code != 200 {
+		t.Fatalf("skip failed: %d %s", w.Code, w.Body.String())
+	}
+	if status, good, _ := woStatusAndQty(t, woID); status != "completed" || good != 5 {
+		t.Errorf("expected WO completed with 5 good after skipping the last op, got %s/%d", status, good)
+	}
+}
+
+func TestWorkOrderPDF_PrintsRouting(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+
+	createTestWorkCenter(t, "Reflow Oven")
+	putTestRouting(t, "PCA-400", `{"steps":[{"name":"Reflow","work_center_id":"WC-001"},{"name":"Final inspection"}]}`)
+	woID := createTestWorkOrder(t, "PCA-400", 2)
+
+	w := httptest.NewRecorder()
+	handleWorkOrderPDF(w, httptest.NewRequest("GET", "/api/v1/workorders/"+woID+"/pdf", nil), woID)
+	body := w.Body.String()
+	for _, want := range []string{"<h2>Routing</h2>", "Reflow Oven", "Final inspection", "<th>Signature</th>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("traveler missing %q", want)
+		}
+	}
+}
@@ -219,29 +219,66 @@ func handleConfirmSalesOrder(w http.ResponseWriter, r *http.Request, id string)
 }
 
 func handleAllocateSalesOrder(w http.ResponseWriter, r *http.Request, id string) {
-	// Check inventory availability
+	var status string
+	if err := db.QueryRow("SELECT status FROM sales_orders WHERE id=?", id).Scan(&status); err != nil {
+		jsonErr(w, "not found", 404)
+		return
+	}
+	if status != "confirmed" {
+		jsonErr(w, fmt.Sprintf("order must be in 'confirmed' status (currently '%s')", status), 400)
+		return
+	}
+
+	// Check availability to promise: free stock now that no other confirmed
+	// order or later demand needs
 	lines := getSalesOrderLines(id)
+	need := map[string]float64{}
+	var ipns []string
 	for _, l := range lines {
-		var qtyOnHand, qtyReserved float64
-		err := db.QueryRow("SELECT COALESCE(qty_on_hand,0), COALESCE(qty_reserved,0) FROM inventory WHERE ipn=?", l.IPN).Scan(&qtyOnHand, &qtyReserved)
-		if err != nil {
+		var exists int
+		if db.QueryRow("SELECT 1 FROM inventory WHERE ipn=?", l.IPN).Scan(&exists) != nil {
 			jsonErr(w, fmt.Sprintf("inventory record not found for %s", l.IPN), 400)
 			return
 		}
-		available := qtyOnHand - qtyReserved
-		if available < float64(l.Qty) {
-			jsonErr(w, fmt.Sprintf("insufficient inventory for %s: need %d, available %.0f", l.IPN, l.Qty, available), 400)
+		if _, ok := need[l.IPN]; !ok {
+			ipns = append(ipns, l.IPN)
+		}
+		need[l.IPN] += float64(l.Qty)
+	}
+	for _, ipn := range ipns {
+		p, err := projectATP(ipn, id, time.Now())
+		if err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		if math.Min(p.atpOn(p.today), p.Start) < need[ipn]-1e-9 {
+			jsonErr(w, p.shortfall(need[ipn]), 400)
 			return
 		}
 	}
 
-	// Reserve inventory
-	now := time.Now().Format("2006-01-02 15:04:05")
+	// Reserve inventory against this order in the ledger
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+
+	username := getUsername(r)
 	for _, l := range lines {
-		db.Exec("UPDATE inventory SET qty_reserved = qty_reserved + ?, updated_at = ? WHERE ipn=?", l.Qty, now, l.IPN)
-		db.Exec("UPDATE sales_order_lines SET qty_allocated=? WHERE id=?", l.Qty, l.ID)
-		db.Exec("INSERT INTO inventory_transactions (ipn,type,qty,reference,notes,created_at) VALUES (?,?,?,?,?,?)",
-			l.IPN, "adjust", 0, fmt.Sprintf("SO:%s", id), fmt.Sprintf("Reserved %d for %s", l.Qty, id), now)
+		if err := reserveInventory(tx, "sales_order", id, l.IPN, float64(l.Qty), username); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		if _, err := tx.Exec("UPDATE sales_order_lines SET qty_allocated=? WHERE id=?", l.Qty, l.ID); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
 	}
 
 	transitionSalesOrder(w, r, id, "confirmed", "allocated")
@@ -276,22 +313,66 @@ func handleShipSalesOrder(w http.ResponseWriter, r *http.Request, id string) {
 
 	// Create outbound shipment
 	shipID := nextID("SH", "shipments", 4)
-	db.Exec("INSERT INTO shipments (id,type,status,to_address,notes,created_by,created_at,updated_at) VALUES (?,?,?,?,?,?,?,?)",
-		shipID, "outbound", "packed", o.Customer, fmt.Sprintf("Shipment for %s", id), username, now, now)
+
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO shipments (id,type,status,to_address,notes,created_by,created_at,updated_at) VALUES (?,?,?,?,?,?,?,?)",
+		shipID, "outbound", "packed", o.Customer, fmt.Sprintf("Shipment for %s", id), username, now, now); err != nil {
+		jsonErr(w, fmt.Sprintf("failed to create shipment: %v", err), 500)
+		return
+	}
 
 	for _, l := range lines {
 		// Create shipment line
-		db.Exec("INSERT INTO shipment_lines (shipment_id,ipn,qty,sales_order_id) VALUES (?,?,?,?)",
-			shipID, l.IPN, l.Qty, id)
-		// Reduce inventory (issue)
-		db.Exec("UPDATE inventory SET qty_on_hand = qty_on_hand - ?, qty_reserved = qty_reserved - ?, updated_at = ? WHERE ipn=?",
-			l.Qty, l.Qty, now, l.IPN)
-		db.Exec("INSERT INTO inventory_transactions (ipn,type,qty,reference,notes,created_at) VALUES (?,?,?,?,?,?)",
-			l.IPN, "issue", float64(l.Qty), fmt.Sprintf("SO:%s", id), fmt.Sprintf("Shipped %d for %s", l.Qty, id), now)
-		db.Exec("UPDATE sales_order_lines SET qty_shipped=? WHERE id=?", l.Qty, l.ID)
+		if _, err := tx.Exec("INSERT INTO shipment_lines (shipment_id,ipn,qty,sales_order_id) VALUES (?,?,?,?)",
+			shipID, l.IPN, l.Qty, id); err != nil {
+			jsonErr(w, fmt.Sprintf("failed to add %s to the shipment: %v", l.IPN, err), 500)
+			return
+		}
+		// Reduce inventory (issue) and draw down this order's reservation.
+		// Stock comes out of the lots that expire first; expired lots can't
+		// be shipped.
+		if err := checkUsableStock(tx, l.IPN, float64(l.Qty), time.Now()); err != nil {
+			jsonErr(w, err.Error(), 400)
+			return
+		}
+		if _, err := tx.Exec("UPDATE inventory SET qty_on_hand = qty_on_hand - ?, updated_at = ? WHERE ipn=?",
+			l.Qty, now, l.IPN); err != nil {
+			jsonErr(w, fmt.Sprintf("failed to issue %s: %v", l.IPN, err), 400)
+			return
+		}
+		if _, err := consumeReservation(tx, "sales_order", id, l.IPN, float64(l.Qty)); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		// The customer's own stock goes back to them first
+		if err := takeOwnedStock(tx, l.IPN, float64(l.Qty), o.Customer, fmt.Sprintf("SO:%s", id), "Shipped for "+id, username, now); err != nil {
+			jsonErr(w, err.Error(), 400)
+			return
+		}
+		if _, err := issueFromLots(tx, l.IPN, float64(l.Qty), nil, "issue", fmt.Sprintf("SO:%s", id), fmt.Sprintf("Shipped %d for %s", l.Qty, id), now); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		if _, err := tx.Exec("UPDATE sales_order_lines SET qty_shipped=? WHERE id=?", l.Qty, l.ID); err != nil {
+			jsonErr(w, fmt.Sprintf("failed to record %s shipped: %v", l.IPN, err), 500)
+			return
+		}
 	}
 
-	db.Exec("UPDATE sales_orders SET status='shipped',updated_at=? WHERE id=?", now, id)
+	if _, err := tx.Exec("UPDATE sales_orders SET status='shipped',updated_at=? WHERE id=?", now, id); err != nil {
+		jsonErr(w, fmt.Sprintf("failed to mark %s shipped: %v", id, err), 500)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
 	logAudit(db, username, "shipped", "sales_order", id, fmt.Sprintf("Shipped %s via shipment %s", id, shipID))
 	handleGetSalesOrder(w, r, id)
 }
@@ -247,6 +247,21 @@ func TestSalesOrderWorkflow(t *testing.T) {
 		t.Errorf("expected picked, got %s", so.Status)
 	}
 
+	// A shipment that can't be written leaves the order and stock as they were
+	db.Exec("CREATE TRIGGER fail_shipment_lines BEFORE INSERT ON shipment_lines BEGIN SELECT RAISE(ABORT, 'disk full'); END")
+	req = authedRequest("POST", "/api/v1/sales-orders/"+id+"/ship", nil, cookie)
+	w = httptest.NewRecorder()
+	handleShipSalesOrder(w, req, id)
+	var status string
+	var onHand, shipments float64
+	db.QueryRow("SELECT status FROM sales_orders WHERE id=?", id).Scan(&status)
+	db.QueryRow("SELECT qty_on_hand FROM inventory WHERE ipn='WIDGET-01'").Scan(&onHand)
+	db.QueryRow("SELECT COUNT(*) FROM shipments").Scan(&shipments)
+	if w.Code != 500 || status != "picked" || onHand != 100 || shipments != 0 {
+		t.Errorf("expected the failed ship rolled back, got %d %s: %s, %v on hand, %v shipments", w.Code, w.Body.String(), status, onHand, shipments)
+	}
+	db.Exec("DROP TRIGGER fail_shipment_lines")
+
 	// Ship
 	req = authedRequest("POST", "/api/v1/sales-orders/"+id+"/ship", nil, cookie)
 	w = httptest.NewRecorder()
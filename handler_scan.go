@@ -20,6 +20,26 @@ func handleScanLookup(w http.ResponseWriter, r *http.Request, code string) {
 		return
 	}
 
+	// A distributor reel label decodes to its part and the PO receipt it
+	// fills, ready to post to /receiving/scan
+	if label, ok := parseReelLabel(code); ok {
+		resp := map[string]interface{}{"code": code, "reel": label}
+		results := []ScanResult{}
+		if ipn := ipnForLabel(label); ipn != "" {
+			results = append(results, ScanResult{Type: "part", ID: ipn, Label: fmt.Sprintf("%s - %s", ipn, label.MPN), Link: fmt.Sprintf("/parts/%s", ipn)})
+		}
+		if rc, _, err := planReelReceipt(label, ""); err != nil {
+			resp["receive_error"] = err.Error()
+		} else {
+			resp["receive"] = rc
+			results = append(results, ScanResult{Type: "po", ID: rc.POID, Label: fmt.Sprintf("Receive %g %s on %s", rc.Qty, rc.IPN, rc.POID), Link: fmt.Sprintf("/purchase-orders/%s", rc.POID)})
+		}
+		resp["results"] = results
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
 	var results []ScanResult
 	codeLower := strings.ToLower(code)
 
@@ -39,7 +59,7 @@ func handleScanLookup(w http.ResponseWriter, r *http.Request, code string) {
 	}
 
 	// Search inventory
-	rows, err := db.Query(`SELECT ipn, location, qty FROM inventory WHERE LOWER(ipn) = LOWER(?) OR LOWER(ipn) LIKE ?`, code, "%"+codeLower+"%")
+	rows, err := db.Query(`SELECT ipn, COALESCE(location,''), qty_on_hand FROM inventory WHERE LOWER(ipn) = LOWER(?) OR LOWER(ipn) LIKE ?`, code, "%"+codeLower+"%")
 	if err == nil {
 		defer rows.Close()
 		seen := map[string]bool{}
@@ -60,16 +80,16 @@ func handleScanLookup(w http.ResponseWriter, r *http.Request, code string) {
 	}
 
 	// Search devices by serial number
-	devRows, err := db.Query(`SELECT serial_number, model, status FROM devices WHERE LOWER(serial_number) = LOWER(?) OR LOWER(serial_number) LIKE ?`, code, "%"+codeLower+"%")
+	devRows, err := db.Query(`SELECT serial_number, ipn, COALESCE(status,'') FROM devices WHERE LOWER(serial_number) = LOWER(?) OR LOWER(serial_number) LIKE ?`, code, "%"+codeLower+"%")
 	if err == nil {
 		defer devRows.Close()
 		for devRows.Next() {
-			var sn, model, status string
-			devRows.Scan(&sn, &model, &status)
+			var sn, ipn, status string
+			devRows.Scan(&sn, &ipn, &status)
 			results = append(results, ScanResult{
 				Type:  "device",
 				ID:    sn,
-				Label: fmt.Sprintf("%s - %s (%s)", sn, model, status),
+				Label: fmt.Sprintf("%s - %s (%s)", sn, ipn, status),
 				Link:  fmt.Sprintf("/devices/%s", sn),
 			})
 		}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ReelLabel is what a distributor's 2D reel or bag label says: an ECIA /
+// ANSI MH10.8.2 Data Matrix (DigiKey, Mouser) or an LCSC QR code. Fields
+// holds every field as printed, by data identifier or key.
+type ReelLabel struct {
+	Format       string            `json:"format"`
+	MPN          string            `json:"mpn"`
+	CustomerPN   string            `json:"customer_pn,omitempty"`
+	SupplierPN   string            `json:"supplier_pn,omitempty"`
+	Manufacturer string            `json:"manufacturer,omitempty"`
+	Qty          float64           `json:"qty"`
+	PO           string            `json:"po,omitempty"`
+	SalesOrder   string            `json:"sales_order,omitempty"`
+	Lot          string            `json:"lot,omitempty"`
+	DateCode     string            `json:"date_code,omitempty"`
+	Country      string            `json:"country,omitempty"`
+	Fields       map[string]string `json:"fields"`
+}
+
+// Scanners in keyboard mode can't type the separator characters and send
+// one of these stand-ins instead.
+var scanSeparators = strings.NewReplacer(
+	"{RS}", "\x1e", "<RS>", "\x1e", "␞", "\x1e",
+	"{GS}", "\x1d", "<GS>", "\x1d", "␝", "\x1d",
+	"{EOT}", "\x04", "<EOT>", "\x04", "␄", "\x04",
+)
+
+var (
+	reECIAField = regexp.MustCompile(`^(\d{0,3}[A-Z])(.*)$`)
+	reLCSCLabel = regexp.MustCompile(`^\{[a-z]+:.*\}$`)
+)
+
+// parseReelLabel decodes a scanned distributor label. ok is false if the
+// code isn't one.
+func parseReelLabel(code string) (ReelLabel, bool) {
+	s := strings.TrimSpace(scanSeparators.Replace(code))
+	switch {
+	case strings.HasPrefix(s, "[)>"):
+		return parseECIALabel(s)
+	case reLCSCLabel.MatchString(s):
+		return parseLCSCLabel(s)
+	}
+	return ReelLabel{}, false
+}
+
+// parseECIALabel reads a format 06 message: "[)>" RS "06" GS, then fields
+// of a data identifier and its data separated by GS, ending RS EOT.
+func parseECIALabel(s string) (ReelLabel, bool) {
+	s = strings.TrimPrefix(s, "[)>")
+	s = strings.TrimLeft(s, "\x1e")
+	if !strings.HasPrefix(s, "06\x1d") {
+		return ReelLabel{}, false
+	}
+	l := ReelLabel{Format: "ecia", Fields: map[string]string{}}
+	for _, f := range strings.Split(strings.TrimSuffix(strings.TrimRight(s[3:], "\x04"), "\x1e"), "\x1d") {
+		m := reECIAField.FindStringSubmatch(strings.TrimSpace(f))
+		if m == nil {
+			continue
+		}
+		if _, dup := l.Fields[m[1]]; !dup {
+			l.Fields[m[1]] = strings.TrimSpace(m[2])
+		}
+	}
+	l.CustomerPN = l.Fields["P"]
+	l.MPN = l.Fields["1P"]
+	l.SupplierPN = l.Fields["30P"]
+	l.Manufacturer = l.Fields["1V"]
+	l.PO = l.Fields["K"]
+	l.SalesOrder = l.Fields["1K"]
+	l.Lot = l.Fields["1T"]
+	l.Country = l.Fields["4L"]
+	l.DateCode = l.Fields["10D"]
+	if l.DateCode == "" {
+		l.DateCode = l.Fields["9D"]
+	}
+	l.Qty, _ = strconv.ParseFloat(l.Fields["Q"], 64)
+	return l, len(l.Fields) > 0
+}
+
+// parseLCSCLabel reads LCSC's {key:value,...} QR payload. LCSC prints no
+// manufacturer lot, so the pick batch number stands in for one.
+func parseLCSCLabel(s string) (ReelLabel, bool) {
+	l := ReelLabel{Format: "lcsc", Fields: map[string]string{}}
+	for _, f := range strings.Split(strings.Trim(s, "{}"), ",") {
+		k, v, ok := strings.Cut(f, ":")
+		if !ok {
+			continue
+		}
+		if v = strings.TrimSpace(v); v == "null" {
+			v = ""
+		}
+		l.Fields[strings.TrimSpace(k)] = v
+	}
+	l.MPN = l.Fields["pm"]
+	l.SupplierPN = l.Fields["pc"]
+	l.SalesOrder = l.Fields["on"]
+	l.Lot = l.Fields["pbn"]
+	l.Qty, _ = strconv.ParseFloat(l.Fields["qty"], 64)
+	return l, l.MPN != "" || l.SupplierPN != ""
+}
+
+// ipnForLabel finds our part for a label: its customer part number if
+// that is one of our IPNs, else the part whose MPN it carries, looked up in
+// the parts database, inventory and past PO lines in that order.
+func ipnForLabel(l ReelLabel) string {
+	cats, _, _, _ := loadPartsFromDir()
+	if l.CustomerPN != "" {
+		for _, parts := range cats {
+			for _, p := range parts {
+				if strings.EqualFold(p.IPN, l.CustomerPN) {
+					return p.IPN
+				}
+			}
+		}
+		var ipn string
+		if db.QueryRow("SELECT ipn FROM inventory WHERE ipn=? COLLATE NOCASE", l.CustomerPN).Scan(&ipn) == nil {
+			return ipn
+		}
+	}
+	if l.MPN == "" {
+		return ""
+	}
+	for _, parts := range cats {
+		for _, p := range parts {
+			for k, v := range p.Fields {
+				if (strings.EqualFold(k, "mpn") || strings.EqualFold(k, "manufacturer_part_number")) && strings.EqualFold(strings.TrimSpace(v), l.MPN) {
+					return p.IPN
+				}
+			}
+		}
+	}
+	var ipn string
+	if db.QueryRow("SELECT ipn FROM inventory WHERE mpn=? COLLATE NOCASE", l.MPN).Scan(&ipn) == nil {
+		return ipn
+	}
+	db.QueryRow("SELECT ipn FROM po_lines WHERE mpn=? COLLATE NOCASE ORDER BY id DESC LIMIT 1", l.MPN).Scan(&ipn)
+	return ipn
+}
+
+// ReelReceipt is the receipt a scanned label stands for: the open PO line
+// it fills and the quantity, lot and date code to book.
+type ReelReceipt struct {
+	POID      string  `json:"po_id"`
+	POLineID  int     `json:"po_line_id"`
+	IPN       string  `json:"ipn"`
+	Qty       float64 `json:"qty"`
+	QtyOpen   float64 `json:"qty_open"`
+	LotNumber string  `json:"lot_number"`
+	DateCode  string  `json:"date_code"`
+}
+
+// planReelReceipt matches a label to an open PO line. The line must be on
+// poID if one is given, else on the label's PO if we have it, else on the
+// oldest open PO for the part. Lines are matched by MPN or by IPN.
+func planReelReceipt(l ReelLabel, poID string) (ReelReceipt, int, error) {
+	ipn := ipnForLabel(l)
+	if ipn == "" && l.MPN == "" {
+		return ReelReceipt{}, 400, fmt.Errorf("the label has no part number we know")
+	}
+	if l.Qty <= 0 {
+		return ReelReceipt{}, 400, fmt.Errorf("the label has no quantity")
+	}
+	strict := poID != ""
+	if !strict && l.PO != "" {
+		var exists int
+		db.QueryRow("SELECT COUNT(*) FROM purchase_orders WHERE id=?", l.PO).Scan(&exists)
+		if exists > 0 {
+			poID = l.PO
+		}
+	}
+	if poID != "" {
+		var status string
+		if db.QueryRow("SELECT status FROM purchase_orders WHERE id=?", poID).Scan(&status) != nil {
+			return ReelReceipt{}, 404, fmt.Errorf("purchase order %s not found", poID)
+		}
+		if status != "sent" && status != "confirmed" && status != "partial" {
+			return ReelReceipt{}, 400, fmt.Errorf("purchase order %s is %s, not open for receiving", poID, status)
+		}
+	}
+
+	q := `SELECT l.id, l.po_id, l.ipn, COALESCE(l.mpn,''), l.qty_ordered - l.qty_received FROM po_lines l
+		JOIN purchase_orders p ON p.id = l.po_id
+		WHERE p.status IN ('sent','confirmed','partial') AND l.qty_ordered > l.qty_received`
+	args := []interface{}{}
+	if poID != "" {
+		q += " AND l.po_id = ?"
+		args = append(args, poID)
+	}
+	rows, err := db.Query(q+" ORDER BY p.created_at, p.id, l.id", args...)
+	if err != nil {
+		return ReelReceipt{}, 500, err
+	}
+	var rc ReelReceipt
+	found := false
+	for rows.Next() {
+		var line ReelReceipt
+		var mpn string
+		rows.Scan(&line.POLineID, &line.POID, &line.IPN, &mpn, &line.QtyOpen)
+		if (l.MPN != "" && strings.EqualFold(mpn, l.MPN)) || (ipn != "" && line.IPN == ipn) {
+			rc, found = line, true
+			break
+		}
+	}
+	rows.Close()
+	part := l.MPN
+	if ipn != "" {
+		part = ipn
+	}
+	if !found {
+		if poID != "" {
+			return ReelReceipt{}, 404, fmt.Errorf("no open line for %s on %s", part, poID)
+		}
+		return ReelReceipt{}, 404, fmt.Errorf("no open PO line for %s", part)
+	}
+	rc.Qty, rc.LotNumber, rc.DateCode = l.Qty, l.Lot, l.DateCode
+	if rc.Qty > rc.QtyOpen+1e-9 {
+		return rc, 400, fmt.Errorf("the label's %g %s is more than the %g still open on %s", rc.Qty, rc.IPN, rc.QtyOpen, rc.POID)
+	}
+	return rc, 200, nil
+}
+
+// handleScanReceive receives a scanned reel label against its PO line in
+// one step.
+func handleScanReceive(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Code           string `json:"code"`
+		POID           string `json:"po_id"`
+		ExpiresAt      string `json:"expires_at"`
+		SkipInspection bool   `json:"skip_inspection"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	ve := &ValidationErrors{}
+	requireField(ve, "code", body.Code)
+	if body.ExpiresAt != "" {
+		validateExpiryDate(ve, body.ExpiresAt)
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+	label, ok := parseReelLabel(body.Code)
+	if !ok {
+		jsonErr(w, "not a distributor reel label", 400)
+		return
+	}
+	rc, status, err := planReelReceipt(label, strings.TrimSpace(body.POID))
+	if err != nil {
+		jsonErr(w, err.Error(), status)
+		return
+	}
+
+	user := getUsername(r)
+	line := POReceiptLine{ID: rc.POLineID, Qty: rc.Qty, LotNumber: rc.LotNumber, DateCode: rc.DateCode, ExpiresAt: body.ExpiresAt}
+	if err := receivePOLines(rc.POID, []POReceiptLine{line}, body.SkipInspection, nil); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, user, "received", "po", rc.POID, fmt.Sprintf("Received %g %s on PO %s from a scanned %s label", rc.Qty, rc.IPN, rc.POID, label.Format))
+	go emailOnPOReceived(rc.POID)
+
+	var lotID int
+	db.QueryRow("SELECT id FROM inventory_lots WHERE po_line_id=? ORDER BY id DESC LIMIT 1", rc.POLineID).Scan(&lotID)
+	jsonResp(w, map[string]interface{}{"label": label, "receipt": rc, "lot_id": lotID})
+}
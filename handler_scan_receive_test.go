@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	digikeyLabel = "[)>\x1e06\x1dP296-1234-1-ND\x1d1PSN74LVC1G14DBVR\x1dKPO-1\x1d1K75001234\x1d10K8765\x1d9D2341\x1d1TLOT-A1\x1d4LMY\x1dQ250\x1e\x04"
+	mouserLabel  = "[)>{RS}06{GS}KPO-1{GS}14K002{GS}1PGRM155R71C104KA88D{GS}Q1000{GS}11K123{GS}4LJP{GS}1VMurata{RS}{EOT}"
+	lcscLabel    = "{pbn:PICK2301010001,on:WM2301010001,pc:C2040,pm:RP2040,qty:10,mc:,cc:1,pdi:80071234,hp:null,wc:JS}"
+)
+
+func TestParseReelLabel(t *testing.T) {
+	l, ok := parseReelLabel(digikeyLabel)
+	if !ok || l.Format != "ecia" || l.MPN != "SN74LVC1G14DBVR" || l.CustomerPN != "296-1234-1-ND" || l.Qty != 250 ||
+		l.PO != "PO-1" || l.Lot != "LOT-A1" || l.DateCode != "2341" || l.Country != "MY" || l.SalesOrder != "75001234" {
+		t.Errorf("unexpected DigiKey label: %+v", l)
+	}
+	l, ok = parseReelLabel(mouserLabel)
+	if !ok || l.MPN != "GRM155R71C104KA88D" || l.Qty != 1000 || l.Manufacturer != "Murata" || l.Fields["14K"] != "002" {
+		t.Errorf("unexpected Mouser label: %+v", l)
+	}
+	l, ok = parseReelLabel(lcscLabel)
+	if !ok || l.Format != "lcsc" || l.MPN != "RP2040" || l.SupplierPN != "C2040" || l.Qty != 10 || l.Lot != "PICK2301010001" || l.Fields["hp"] != "" {
+		t.Errorf("unexpected LCSC label: %+v", l)
+	}
+	for _, code := range []string{"RES-0001", "[)>\x1e05\x1dQ1", "{json}"} {
+		if _, ok := parseReelLabel(code); ok {
+			t.Errorf("expected %q not to parse as a reel label", code)
+		}
+	}
+}
+
+func TestScanReceive(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+
+	stmts := []string{
+		`INSERT INTO inventory (ipn, mpn) VALUES ('IC-1', 'SN74LVC1G14DBVR')`,
+		`INSERT INTO purchase_orders (id, vendor_id, status) VALUES ('PO-1', 'V-1', 'sent'), ('PO-2', 'V-1', 'draft')`,
+		`INSERT INTO po_lines (po_id, ipn, mpn, qty_ordered) VALUES ('PO-1', 'IC-1', NULL, 500), ('PO-1', 'CAP-1', 'GRM155R71C104KA88D', 500), ('PO-2', 'MCU-1', 'RP2040', 10)`,
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("seed failed: %v\n%s", err, s)
+		}
+	}
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleScanReceive(w, httptest.NewRequest("POST", "/api/v1/receiving/scan", bytes.NewBufferString(body)))
+		return w
+	}
+	codeJSON := func(code string) string {
+		b, _ := json.Marshal(code)
+		return string(b)
+	}
+
+	// A scan shows the receipt it would book
+	w := httptest.NewRecorder()
+	handleScanLookup(w, httptest.NewRequest("GET", "/api/v1/scan/x", nil), digikeyLabel)
+	var lookup struct {
+		Reel    ReelLabel    `json:"reel"`
+		Receive *ReelReceipt `json:"receive"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &lookup)
+	if rc := lookup.Receive; rc == nil || rc.POID != "PO-1" || rc.IPN != "IC-1" || rc.Qty != 250 || rc.LotNumber != "LOT-A1" || rc.DateCode != "2341" {
+		t.Fatalf("unexpected scan prefill: %s", w.Body.String())
+	}
+
+	// Posting it receives the bag into a lot held for inspection
+	for i := 0; i < 2; i++ {
+		if w := post(`{"code":` + codeJSON(digikeyLabel) + `}`); w.Code != 200 {
+			t.Fatalf("scan receive %d failed: %d %s", i, w.Code, w.Body.String())
+		}
+	}
+	var received float64
+	db.QueryRow("SELECT qty_received FROM po_lines WHERE po_id='PO-1' AND ipn='IC-1'").Scan(&received)
+	var lots int
+	db.QueryRow("SELECT COUNT(*) FROM inventory_lots WHERE ipn='IC-1' AND lot_number LIKE 'LOT-A1%' AND date_code='2341' AND status='inspection'").Scan(&lots)
+	if received != 500 || lots != 2 {
+		t.Errorf("expected 500 received in 2 lots, got %v in %d", received, lots)
+	}
+	if w := post(`{"code":` + codeJSON(digikeyLabel) + `}`); w.Code != 404 {
+		t.Errorf("expected a filled line to refuse more, got %d %s", w.Code, w.Body.String())
+	}
+
+	// The Mouser reel matches its PO line by MPN but is more than was ordered
+	if w := post(`{"code":` + codeJSON(mouserLabel) + `}`); w.Code != 400 || !strings.Contains(w.Body.String(), "more than the 500") {
+		t.Errorf("expected an over-receipt to be refused, got %d %s", w.Code, w.Body.String())
+	}
+	if w := post(`{"code":` + codeJSON(lcscLabel) + `,"po_id":"PO-2"}`); w.Code != 400 || !strings.Contains(w.Body.String(), "not open") {
+		t.Errorf("expected a draft PO to be refused, got %d %s", w.Code, w.Body.String())
+	}
+	db.Exec("UPDATE purchase_orders SET status='confirmed' WHERE id='PO-2'")
+	w = post(`{"code":` + codeJSON(lcscLabel) + `,"skip_inspection":true}`)
+	if w.Code != 200 {
+		t.Fatalf("LCSC receive failed: %d %s", w.Code, w.Body.String())
+	}
+	if q := onHand("MCU-1"); q != 10 {
+		t.Errorf("expected 10 MCU-1 on hand, got %v", q)
+	}
+	if w := post(`{"code":"RES-1"}`); w.Code != 400 {
+		t.Errorf("expected a plain code to be refused, got %d", w.Code)
+	}
+}
@@ -0,0 +1,1071 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScanSession is a handheld scanner's transaction in the making. Each scan
+// of an order, location, part, lot, label or quantity barcode adds to the
+// pending state; once a part and its quantity are known they become a line,
+// and the lines are posted together on commit. The state is kept in the
+// database, so a scanner that drops its connection carries on where it left
+// off.
+type ScanSession struct {
+	ID        int    `json:"id"`
+	Mode      string `json:"mode"`
+	Status    string `json:"status"`
+	Reference string `json:"reference"`
+	// Location is the bin worked in; in move mode it is the bin moved from
+	// and ToLocation the bin the pending part goes to
+	Location   string            `json:"location"`
+	ToLocation string            `json:"to_location"`
+	Pending    ScanPending       `json:"pending"`
+	Username   string            `json:"username"`
+	CreatedAt  string            `json:"created_at"`
+	UpdatedAt  string            `json:"updated_at"`
+	ClosedAt   *string           `json:"closed_at"`
+	Lines      []ScanSessionLine `json:"lines"`
+	LastScan   *ScanSessionEvent `json:"last_scan"`
+	Prompt     string            `json:"prompt"`
+}
+
+// ScanPending is the line being scanned.
+type ScanPending struct {
+	IPN       string   `json:"ipn"`
+	LotID     *int     `json:"lot_id"`
+	LotNumber string   `json:"lot_number"`
+	DateCode  string   `json:"date_code"`
+	Qty       *float64 `json:"qty"`
+}
+
+// ScanSessionLine is a scanned part and quantity waiting to be committed.
+// Reference is the PO a receipt goes against.
+type ScanSessionLine struct {
+	ID         int     `json:"id"`
+	IPN        string  `json:"ipn"`
+	LotID      *int    `json:"lot_id"`
+	LotNumber  string  `json:"lot_number"`
+	DateCode   string  `json:"date_code"`
+	Qty        float64 `json:"qty"`
+	Location   string  `json:"location"`
+	ToLocation string  `json:"to_location"`
+	Reference  string  `json:"reference"`
+	Status     string  `json:"status"`
+	Error      string  `json:"error"`
+	CreatedAt  string  `json:"created_at"`
+}
+
+// ScanSessionEvent is one scan and what it was taken for.
+type ScanSessionEvent struct {
+	ID        int    `json:"id"`
+	ScanID    string `json:"scan_id"`
+	Code      string `json:"code"`
+	Kind      string `json:"kind"`
+	Message   string `json:"message"`
+	Username  string `json:"username"`
+	CreatedAt string `json:"created_at"`
+}
+
+var validScanModes = []string{"receive", "issue", "pick", "move", "count"}
+
+// scanReferenceNames are the orders each mode works against.
+var scanReferenceNames = map[string]string{"receive": "purchase order", "issue": "work order", "pick": "sales order"}
+
+const scanSessionColumns = `id, mode, status, COALESCE(reference,''), COALESCE(location,''), COALESCE(to_location,''),
+	COALESCE(pending_ipn,''), pending_lot_id, COALESCE(pending_lot_number,''), COALESCE(pending_date_code,''), pending_qty,
+	username, created_at, updated_at, closed_at`
+
+func scanScanSession(row interface{ Scan(...interface{}) error }) (ScanSession, error) {
+	var s ScanSession
+	var lotID sql.NullInt64
+	var qty sql.NullFloat64
+	var closed sql.NullString
+	err := row.Scan(&s.ID, &s.Mode, &s.Status, &s.Reference, &s.Location, &s.ToLocation,
+		&s.Pending.IPN, &lotID, &s.Pending.LotNumber, &s.Pending.DateCode, &qty,
+		&s.Username, &s.CreatedAt, &s.UpdatedAt, &closed)
+	if lotID.Valid {
+		v := int(lotID.Int64)
+		s.Pending.LotID = &v
+	}
+	if qty.Valid {
+		s.Pending.Qty = &qty.Float64
+	}
+	s.ClosedAt = sp(closed)
+	return s, err
+}
+
+// loadScanSession returns a session with its lines and last scan.
+func loadScanSession(id string) (ScanSession, error) {
+	s, err := scanScanSession(db.QueryRow("SELECT "+scanSessionColumns+" FROM scan_sessions WHERE id=?", id))
+	if err != nil {
+		return s, err
+	}
+	rows, err := db.Query(`SELECT id, ipn, lot_id, COALESCE(lot_number,''), COALESCE(date_code,''), qty, COALESCE(location,''),
+		COALESCE(to_location,''), COALESCE(reference,''), status, COALESCE(error,''), created_at
+		FROM scan_session_lines WHERE session_id=? ORDER BY id`, s.ID)
+	if err != nil {
+		return s, err
+	}
+	s.Lines = []ScanSessionLine{}
+	for rows.Next() {
+		var l ScanSessionLine
+		var lotID sql.NullInt64
+		rows.Scan(&l.ID, &l.IPN, &lotID, &l.LotNumber, &l.DateCode, &l.Qty, &l.Location, &l.ToLocation, &l.Reference, &l.Status, &l.Error, &l.CreatedAt)
+		if lotID.Valid {
+			v := int(lotID.Int64)
+			l.LotID = &v
+		}
+		s.Lines = append(s.Lines, l)
+	}
+	rows.Close()
+	if events, err := loadScanSessionEvents(s.ID, 1); err == nil && len(events) > 0 {
+		s.LastScan = &events[0]
+	}
+	s.Prompt = scanPrompt(s)
+	return s, nil
+}
+
+// loadScanSessionEvents returns a session's scans, newest first.
+func loadScanSessionEvents(sessionID, limit int) ([]ScanSessionEvent, error) {
+	rows, err := db.Query(`SELECT id, COALESCE(scan_id,''), code, kind, COALESCE(message,''), username, created_at
+		FROM scan_session_events WHERE session_id=? ORDER BY id DESC LIMIT ?`, sessionID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []ScanSessionEvent{}
+	for rows.Next() {
+		var e ScanSessionEvent
+		rows.Scan(&e.ID, &e.ScanID, &e.Code, &e.Kind, &e.Message, &e.Username, &e.CreatedAt)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// scanPrompt tells the operator what to scan next.
+func scanPrompt(s ScanSession) string {
+	if s.Status != "open" {
+		return "Session " + s.Status
+	}
+	p := s.Pending
+	switch {
+	case s.Reference == "" && (s.Mode == "issue" || s.Mode == "pick"):
+		return "Scan the " + scanReferenceNames[s.Mode]
+	case s.Mode == "move" && s.Location == "" && p.IPN == "":
+		return "Scan the location to move from"
+	case p.IPN == "" && p.Qty != nil:
+		return "Scan the part or lot"
+	case p.IPN == "":
+		return "Scan a part, lot or reel label"
+	case p.Qty == nil:
+		return "Scan or enter the quantity of " + p.IPN
+	case s.Mode == "move" && s.ToLocation == "":
+		return "Scan the location to move " + p.IPN + " to"
+	}
+	return "Scan the next part or commit"
+}
+
+// parseScanQty reads a quantity barcode: a number, or a number after the
+// Q data identifier as on ECIA labels.
+func parseScanQty(code string) (float64, bool) {
+	s := code
+	if len(s) > 1 && (s[0] == 'Q' || s[0] == 'q') {
+		s = s[1:]
+	}
+	q, err := strconv.ParseFloat(s, 64)
+	if err != nil || q < 0 || math.IsInf(q, 0) || math.IsNaN(q) {
+		return 0, false
+	}
+	return q, true
+}
+
+// scanOutcome is what a scan was taken for, and the line it completed.
+type scanOutcome struct {
+	Kind    string
+	Message string
+	Line    *ScanSessionLine
+}
+
+// applyScan works out what code is and updates s with it. Codes are tried
+// as a Q-prefixed quantity, the mode's order, a location, one of our reel
+// labels (IPN|lot|qty), a distributor label, a lot number, an IPN, and
+// finally a bare number as a quantity, so numeric lot numbers aren't taken
+// for quantities. It returns the HTTP status to report with an error; s is
+// only saved if there is none.
+func applyScan(s *ScanSession, code string) (scanOutcome, int, error) {
+	p := &s.Pending
+	needsRef := s.Reference == "" && (s.Mode == "issue" || s.Mode == "pick")
+	q, isQty := parseScanQty(code)
+	if isQty && (code[0] == 'Q' || code[0] == 'q') && !needsRef {
+		p.Qty = &q
+		return completeScanLine(s, scanOutcome{Kind: "qty", Message: fmt.Sprintf("Quantity %g", q)}, nil)
+	}
+
+	if out, ok, status, err := scanReference(s, code); ok {
+		return out, status, err
+	}
+	if needsRef {
+		return scanOutcome{}, 400, fmt.Errorf("scan the %s first", scanReferenceNames[s.Mode])
+	}
+
+	var active bool
+	if db.QueryRow("SELECT active FROM locations WHERE code=?", code).Scan(&active) == nil {
+		if !active {
+			return scanOutcome{}, 400, fmt.Errorf("location %s is inactive", code)
+		}
+		// In move mode a location scanned with a part pending is where it
+		// goes; otherwise it is where the work is
+		if s.Mode == "move" && p.IPN != "" {
+			if code == s.Location {
+				return scanOutcome{}, 400, fmt.Errorf("%s is the location moving from", code)
+			}
+			s.ToLocation = code
+			return completeScanLine(s, scanOutcome{Kind: "to_location", Message: "Move to " + code}, nil)
+		}
+		s.Location, s.ToLocation = code, ""
+		return scanOutcome{Kind: "location", Message: "Location " + code}, 200, nil
+	}
+
+	if parts := strings.Split(code, "|"); len(parts) == 3 && scanKnownIPN(parts[0]) {
+		q, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil || q < 0 {
+			return scanOutcome{}, 400, fmt.Errorf("the label's quantity %q is not a number", parts[2])
+		}
+		setScanPart(s, parts[0])
+		if s.Mode == "receive" {
+			p.LotNumber = parts[1]
+		} else if parts[1] != "" {
+			if err := setScanLot(s, parts[0], parts[1], ""); err != nil {
+				return scanOutcome{}, 404, err
+			}
+		}
+		p.Qty = &q
+		return completeScanLine(s, scanOutcome{Kind: "label", Message: fmt.Sprintf("%g %s", q, parts[0])}, nil)
+	}
+
+	if label, ok := parseReelLabel(code); ok {
+		ipn := ipnForLabel(label)
+		if s.Mode == "receive" {
+			// The PO line decides the IPN when the label only has an MPN
+			rc, status, err := planReelReceipt(label, s.Reference)
+			if err != nil {
+				return scanOutcome{}, status, err
+			}
+			ipn = rc.IPN
+		}
+		if ipn == "" {
+			return scanOutcome{}, 404, fmt.Errorf("no part for %s label %s", label.Format, label.MPN)
+		}
+		setScanPart(s, ipn)
+		p.LotNumber, p.DateCode = label.Lot, label.DateCode
+		if label.Lot != "" && s.Mode != "receive" {
+			if err := setScanLot(s, ipn, label.Lot, label.DateCode); err != nil {
+				return scanOutcome{}, 404, err
+			}
+		}
+		out := scanOutcome{Kind: "label", Message: fmt.Sprintf("%s label: %s", label.Format, ipn)}
+		if label.Qty > 0 {
+			p.Qty = &label.Qty
+			out.Message = fmt.Sprintf("%s label: %g %s", label.Format, label.Qty, ipn)
+		}
+		return completeScanLine(s, out, &label)
+	}
+
+	if s.Mode != "receive" {
+		rows, err := db.Query("SELECT ipn FROM inventory_lots WHERE lot_number=? ORDER BY id", code)
+		if err != nil {
+			return scanOutcome{}, 500, err
+		}
+		var ipns []string
+		for rows.Next() {
+			var ipn string
+			rows.Scan(&ipn)
+			if p.IPN == "" || ipn == p.IPN {
+				ipns = append(ipns, ipn)
+			}
+		}
+		rows.Close()
+		if len(ipns) > 1 {
+			return scanOutcome{}, 400, fmt.Errorf("lot %s is on more than one part; scan the part first", code)
+		}
+		if len(ipns) == 1 {
+			setScanPart(s, ipns[0])
+			if err := setScanLot(s, ipns[0], code, ""); err != nil {
+				return scanOutcome{}, 404, err
+			}
+			return completeScanLine(s, scanOutcome{Kind: "lot", Message: fmt.Sprintf("Lot %s of %s", code, ipns[0])}, nil)
+		}
+	}
+
+	if scanKnownIPN(code) {
+		setScanPart(s, code)
+		return completeScanLine(s, scanOutcome{Kind: "part", Message: "Part " + code}, nil)
+	}
+
+	if isQty {
+		p.Qty = &q
+		return completeScanLine(s, scanOutcome{Kind: "qty", Message: fmt.Sprintf("Quantity %g", q)}, nil)
+	}
+	return scanOutcome{}, 404, fmt.Errorf("%s is not an order, location, part, lot or label we know", code)
+}
+
+// scanReference takes code as the order the session works against, if it
+// is one for the mode. ok is false if it isn't.
+func scanReference(s *ScanSession, code string) (out scanOutcome, ok bool, status int, err error) {
+	var recordStatus string
+	switch s.Mode {
+	case "receive":
+		if db.QueryRow("SELECT status FROM purchase_orders WHERE id=?", code).Scan(&recordStatus) != nil {
+			return
+		}
+		if recordStatus != "sent" && recordStatus != "confirmed" && recordStatus != "partial" {
+			return out, true, 400, fmt.Errorf("purchase order %s is %s, not open for receiving", code, recordStatus)
+		}
+	case "issue":
+		if db.QueryRow("SELECT status FROM work_orders WHERE id=?", code).Scan(&recordStatus) != nil {
+			return
+		}
+		if woClosed(recordStatus) {
+			return out, true, 400, fmt.Errorf("work order %s is %s", code, recordStatus)
+		}
+	case "pick":
+		if db.QueryRow("SELECT status FROM sales_orders WHERE id=?", code).Scan(&recordStatus) != nil {
+			return
+		}
+		if recordStatus != "allocated" {
+			return out, true, 400, fmt.Errorf("sales order %s is %s; only allocated orders are picked", code, recordStatus)
+		}
+	default:
+		return
+	}
+	if s.Reference != "" && s.Reference != code {
+		for _, l := range s.Lines {
+			if l.Status != "committed" {
+				return out, true, 400, fmt.Errorf("the session has lines for %s; commit or cancel it first", s.Reference)
+			}
+		}
+	}
+	s.Reference = code
+	name := scanReferenceNames[s.Mode]
+	return scanOutcome{Kind: "reference", Message: strings.ToUpper(name[:1]) + name[1:] + " " + code}, true, 200, nil
+}
+
+// scanKnownIPN reports whether ipn is in inventory or the parts database.
+func scanKnownIPN(ipn string) bool {
+	var n int
+	if db.QueryRow("SELECT COUNT(*) FROM inventory WHERE ipn=?", ipn).Scan(&n); n > 0 {
+		return true
+	}
+	_, err := getPartByIPN(partsDir, ipn)
+	return err == nil
+}
+
+// setScanPart starts the pending line on ipn. A quantity scanned ahead of
+// the part is kept; lot details of another part aren't.
+func setScanPart(s *ScanSession, ipn string) {
+	if s.Pending.IPN != ipn {
+		s.Pending = ScanPending{IPN: ipn, Qty: s.Pending.Qty}
+	}
+}
+
+// setScanLot sets the pending lot to ipn's lot by that number.
+func setScanLot(s *ScanSession, ipn, number, dateCode string) error {
+	var id int
+	var dc string
+	if err := db.QueryRow("SELECT id, COALESCE(date_code,'') FROM inventory_lots WHERE ipn=? AND lot_number=? ORDER BY id DESC LIMIT 1", ipn, number).Scan(&id, &dc); err != nil {
+		return fmt.Errorf("%s has no lot %s", ipn, number)
+	}
+	if dateCode == "" {
+		dateCode = dc
+	}
+	s.Pending.LotID, s.Pending.LotNumber, s.Pending.DateCode = &id, number, dateCode
+	return nil
+}
+
+// completeScanLine turns the pending state into a line once it has a part
+// and a quantity (and in move mode a location to move to). label is the
+// distributor label scanned, if any, for matching a receipt to its PO line.
+func completeScanLine(s *ScanSession, out scanOutcome, label *ReelLabel) (scanOutcome, int, error) {
+	p := s.Pending
+	if p.IPN == "" || p.Qty == nil || (s.Mode == "move" && s.ToLocation == "") {
+		return out, 200, nil
+	}
+	l := ScanSessionLine{IPN: p.IPN, LotID: p.LotID, LotNumber: p.LotNumber, DateCode: p.DateCode, Qty: *p.Qty,
+		Location: s.Location, ToLocation: s.ToLocation, Reference: s.Reference, Status: "pending"}
+	if l.Qty <= 0 && s.Mode != "count" {
+		return out, 400, fmt.Errorf("quantity must be positive")
+	}
+	// Quantities already scanned for the same part count against what's open
+	var scanned float64
+	for _, x := range s.Lines {
+		if x.Status != "committed" && x.IPN == l.IPN {
+			scanned += x.Qty
+		}
+	}
+
+	switch s.Mode {
+	case "receive":
+		rl := ReelLabel{CustomerPN: l.IPN, Qty: l.Qty, Lot: l.LotNumber, DateCode: l.DateCode}
+		if label != nil {
+			rl = *label
+			rl.Qty = l.Qty
+		}
+		rc, status, err := planReelReceipt(rl, s.Reference)
+		if err != nil {
+			return out, status, err
+		}
+		scanned = 0
+		for _, x := range s.Lines {
+			if x.Status != "committed" && x.IPN == rc.IPN && x.Reference == rc.POID {
+				scanned += x.Qty
+			}
+		}
+		if l.Qty+scanned > rc.QtyOpen+1e-9 {
+			return out, 400, fmt.Errorf("only %g %s still open on %s, %g already scanned", rc.QtyOpen, rc.IPN, rc.POID, scanned)
+		}
+		l.IPN, l.Reference = rc.IPN, rc.POID
+	case "issue":
+		var onHand float64
+		db.QueryRow("SELECT qty_on_hand FROM inventory WHERE ipn=?", l.IPN).Scan(&onHand)
+		if l.Qty+scanned > onHand+1e-9 {
+			return out, 400, fmt.Errorf("only %g %s on hand, %g already scanned", onHand, l.IPN, scanned)
+		}
+	case "pick":
+		if l.Qty != math.Trunc(l.Qty) {
+			return out, 400, fmt.Errorf("sales orders are picked in whole units")
+		}
+		var open float64
+		db.QueryRow("SELECT COALESCE(SUM(qty - qty_picked),0) FROM sales_order_lines WHERE sales_order_id=? AND ipn=?", s.Reference, l.IPN).Scan(&open)
+		if l.Qty+scanned > open+1e-9 {
+			return out, 400, fmt.Errorf("%s needs %g more %s, %g already scanned", s.Reference, open, l.IPN, scanned)
+		}
+	}
+
+	out.Line = &l
+	out.Message += fmt.Sprintf("; line added: %g %s", l.Qty, l.IPN)
+	s.Pending = ScanPending{}
+	s.ToLocation = ""
+	return out, 200, nil
+}
+
+// saveScanSession writes the session's pending state, and its new line if
+// the scan completed one.
+func saveScanSession(s ScanSession, line *ScanSessionLine, now string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`UPDATE scan_sessions SET reference=?, location=?, to_location=?, pending_ipn=?, pending_lot_id=?,
+		pending_lot_number=?, pending_date_code=?, pending_qty=?, updated_at=? WHERE id=?`,
+		s.Reference, s.Location, s.ToLocation, s.Pending.IPN, s.Pending.LotID, s.Pending.LotNumber, s.Pending.DateCode, s.Pending.Qty, now, s.ID)
+	if err == nil && line != nil {
+		_, err = tx.Exec(`INSERT INTO scan_session_lines (session_id, ipn, lot_id, lot_number, date_code, qty, location, to_location, reference, created_at)
+			VALUES (?,?,?,?,?,?,?,?,?,?)`, s.ID, line.IPN, line.LotID, line.LotNumber, line.DateCode, line.Qty, line.Location, line.ToLocation, line.Reference, now)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// handleListScanSessions lists sessions, newest first, by ?status=, ?mode=
+// and ?username=.
+func handleListScanSessions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	where := []string{"1=1"}
+	var args []interface{}
+	for _, param := range []string{"status", "mode", "username"} {
+		if v := q.Get(param); v != "" {
+			where = append(where, param+" = ?")
+			args = append(args, v)
+		}
+	}
+	rows, err := db.Query("SELECT "+scanSessionColumns+" FROM scan_sessions WHERE "+strings.Join(where, " AND ")+" ORDER BY id DESC LIMIT 200", args...)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	sessions := []ScanSession{}
+	for rows.Next() {
+		s, err := scanScanSession(rows)
+		if err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		s.Prompt = scanPrompt(s)
+		sessions = append(sessions, s)
+	}
+	jsonResp(w, sessions)
+}
+
+// handleCreateScanSession opens a session. The order it works against can
+// be given here or scanned.
+func handleCreateScanSession(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Mode      string `json:"mode"`
+		Reference string `json:"reference"`
+		Location  string `json:"location"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	body.Reference, body.Location = strings.TrimSpace(body.Reference), strings.TrimSpace(body.Location)
+	ve := &ValidationErrors{}
+	requireField(ve, "mode", body.Mode)
+	validateEnum(ve, "mode", body.Mode, validScanModes)
+	if body.Reference != "" && scanReferenceNames[body.Mode] == "" {
+		ve.Add("reference", "not used in "+body.Mode+" mode")
+	}
+	if body.Location != "" {
+		checkStockLocation(ve, "location", body.Location)
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+	s := ScanSession{Mode: body.Mode, Location: body.Location}
+	if body.Reference != "" {
+		_, ok, status, err := scanReference(&s, body.Reference)
+		if !ok {
+			jsonErr(w, fmt.Sprintf("%s %s not found", scanReferenceNames[body.Mode], body.Reference), 404)
+			return
+		} else if err != nil {
+			jsonErr(w, err.Error(), status)
+			return
+		}
+	}
+
+	user := getUsername(r)
+	now := time.Now().Format("2006-01-02 15:04:05")
+	res, err := db.Exec("INSERT INTO scan_sessions (mode, reference, location, username, created_at, updated_at) VALUES (?,?,?,?,?,?)",
+		s.Mode, s.Reference, s.Location, user, now, now)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	id64, _ := res.LastInsertId()
+	id := strconv.FormatInt(id64, 10)
+	logAudit(db, user, "created", "scan_session", id, fmt.Sprintf("Opened %s scanner session %s", s.Mode, id))
+	handleGetScanSession(w, r, id)
+}
+
+func handleGetScanSession(w http.ResponseWriter, r *http.Request, id string) {
+	s, err := loadScanSession(id)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "scan session not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	jsonResp(w, s)
+}
+
+// handleListScanSessionEvents lists every scan made in a session, newest
+// first.
+func handleListScanSessionEvents(w http.ResponseWriter, r *http.Request, id string) {
+	s, err := loadScanSession(id)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "scan session not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	events, err := loadScanSessionEvents(s.ID, -1)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	jsonResp(w, events)
+}
+
+// handleScanSessionScan takes one scan. Every scan is recorded, including
+// those refused. A scanner resending a scan after a dropped connection
+// passes the same scan_id, and the repeat is ignored.
+func handleScanSessionScan(w http.ResponseWriter, r *http.Request, id string) {
+	var body struct {
+		Code   string `json:"code"`
+		ScanID string `json:"scan_id"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	code := strings.TrimSpace(body.Code)
+	ve := &ValidationErrors{}
+	requireField(ve, "code", code)
+	validateMaxLength(ve, "code", code, 1000)
+	validateMaxLength(ve, "scan_id", body.ScanID, 100)
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+	s, err := loadScanSession(id)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "scan session not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if s.Status != "open" {
+		jsonErr(w, "scan session is "+s.Status, 400)
+		return
+	}
+	if body.ScanID != "" {
+		var seen int
+		db.QueryRow("SELECT COUNT(*) FROM scan_session_events WHERE session_id=? AND scan_id=?", s.ID, body.ScanID).Scan(&seen)
+		if seen > 0 {
+			jsonResp(w, s)
+			return
+		}
+	}
+
+	user := getUsername(r)
+	now := time.Now().Format("2006-01-02 15:04:05")
+	out, status, err := applyScan(&s, code)
+	if err == nil {
+		if err = saveScanSession(s, out.Line, now); err != nil {
+			status = 500
+		}
+	}
+	if err != nil {
+		out = scanOutcome{Kind: "error", Message: err.Error()}
+	}
+	db.Exec("INSERT INTO scan_session_events (session_id, scan_id, code, kind, message, username, created_at) VALUES (?,?,?,?,?,?,?)",
+		s.ID, body.ScanID, code, out.Kind, out.Message, user, now)
+	if err != nil {
+		jsonErr(w, err.Error(), status)
+		return
+	}
+	handleGetScanSession(w, r, id)
+}
+
+// handleDeleteScanSessionLine takes back a line that hasn't been committed.
+func handleDeleteScanSessionLine(w http.ResponseWriter, r *http.Request, id, lineID string) {
+	s, err := loadScanSession(id)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "scan session not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if s.Status != "open" {
+		jsonErr(w, "scan session is "+s.Status, 400)
+		return
+	}
+	var line *ScanSessionLine
+	for i := range s.Lines {
+		if strconv.Itoa(s.Lines[i].ID) == lineID {
+			line = &s.Lines[i]
+		}
+	}
+	if line == nil {
+		jsonErr(w, "line not found", 404)
+		return
+	}
+	if line.Status == "committed" {
+		jsonErr(w, "line is already committed", 400)
+		return
+	}
+	user := getUsername(r)
+	now := time.Now().Format("2006-01-02 15:04:05")
+	if _, err := db.Exec("DELETE FROM scan_session_lines WHERE id=?", line.ID); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	db.Exec("UPDATE scan_sessions SET updated_at=? WHERE id=?", now, s.ID)
+	db.Exec("INSERT INTO scan_session_events (session_id, code, kind, message, username, created_at) VALUES (?,?,?,?,?,?)",
+		s.ID, "", "undo", fmt.Sprintf("Removed line %d: %g %s", line.ID, line.Qty, line.IPN), user, now)
+	handleGetScanSession(w, r, id)
+}
+
+// handleCancelScanSession abandons a session; nothing is posted.
+func handleCancelScanSession(w http.ResponseWriter, r *http.Request, id string) {
+	s, err := loadScanSession(id)
+	if err == sql.ErrNoRows {
+		jsonErr(w, "scan session not found", 404)
+		return
+	} else if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if s.Status != "open" {
+		jsonErr(w, "scan session is "+s.Status, 400)
+		return
+	}
+	for _, l := range s.Lines {
+		if l.Status == "committed" {
+			jsonErr(w, "some lines are already committed; commit or remove the rest", 400)
+			return
+		}
+	}
+	user := getUsername(r)
+	now := time.Now().Format("2006-01-02 15:04:05")
+	db.Exec("UPDATE scan_sessions SET status='cancelled', updated_at=?, closed_at=? WHERE id=?", now, now, s.ID)
+	logAudit(db, user, "cancelled", "scan_session", id, fmt.Sprintf("Cancelled %s scanner session %s with %d line(s)", s.Mode, id, len(s.Lines)))
+	handleGetScanSession(w, r, id)
+}
+
+// handleCommitScanSession posts a session's lines. Each line is posted on
+// its own and marked committed in the same transaction; lines that fail
+// keep their error and the session stays open to fix and commit them
+// again. The session is claimed for the commit first, so two commits of it
+// can't post the same lines. Committing a committed session is a no-op, so
+// a scanner can retry a commit whose response it lost.
+func handleCommitScanSession(w http.ResponseWriter, r *http.Request, id string) {
+	var body struct {
+		SkipInspection bool `json:"skip_inspection"`
+	}
+	if r.ContentLength > 0 {
+		if err := decodeBody(r, &body); err != nil {
+			jsonErr(w, "invalid body", 400)
+			return
+		}
+	}
+	now := time.Now().Format("2006-01-02 15:04:05")
+	res, err := db.Exec("UPDATE scan_sessions SET status='committing', updated_at=? WHERE id=? AND status='open'", now, id)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		s, err := loadScanSession(id)
+		switch {
+		case err == sql.ErrNoRows:
+			jsonErr(w, "scan session not found", 404)
+		case err != nil:
+			jsonErr(w, err.Error(), 500)
+		case s.Status == "committed":
+			jsonResp(w, s)
+		case s.Status == "committing":
+			jsonErr(w, "scan session is already being committed", 409)
+		default:
+			jsonErr(w, "scan session is "+s.Status, 400)
+		}
+		return
+	}
+	// Lines are read once the session is ours, so a commit that finished
+	// in the meantime isn't posted again
+	s, err := loadScanSession(id)
+	if err != nil {
+		db.Exec("UPDATE scan_sessions SET status='open' WHERE id=?", id)
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	var lines []ScanSessionLine
+	for _, l := range s.Lines {
+		if l.Status != "committed" {
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) == 0 {
+		db.Exec("UPDATE scan_sessions SET status='open' WHERE id=?", s.ID)
+		jsonErr(w, "nothing scanned to commit", 400)
+		return
+	}
+
+	user := getUsername(r)
+	notes := fmt.Sprintf("Scanner session %d", s.ID)
+	var errs map[int]error
+	switch s.Mode {
+	case "receive":
+		errs = commitScanReceive(lines, body.SkipInspection, user, notes)
+	case "issue", "move":
+		errs = commitScanTransactions(s, lines, user, notes)
+	case "pick":
+		errs = commitScanPick(s, lines, user)
+	case "count":
+		errs = commitScanCount(s, lines, user, notes)
+	}
+
+	// A line with an error that was posted anyway (a receipt that couldn't
+	// be put away) stays committed and keeps the error as a warning
+	for _, l := range lines {
+		if err := errs[l.ID]; err != nil {
+			db.Exec("UPDATE scan_session_lines SET status=CASE status WHEN 'committed' THEN status ELSE 'failed' END, error=? WHERE id=?", err.Error(), l.ID)
+		}
+	}
+	var failed int
+	db.QueryRow("SELECT COUNT(*) FROM scan_session_lines WHERE session_id=? AND status!='committed'", s.ID).Scan(&failed)
+	summary := fmt.Sprintf("Committed %d of %d line(s) of %s scanner session %s", len(lines)-failed, len(lines), s.Mode, id)
+	if s.Reference != "" {
+		summary += " for " + s.Reference
+	}
+	now = time.Now().Format("2006-01-02 15:04:05")
+	if failed == 0 {
+		db.Exec("UPDATE scan_sessions SET status='committed', updated_at=?, closed_at=? WHERE id=?", now, now, s.ID)
+	} else {
+		db.Exec("UPDATE scan_sessions SET status='open', updated_at=? WHERE id=?", now, s.ID)
+	}
+	logAudit(db, user, "committed", "scan_session", id, summary)
+	handleGetScanSession(w, r, id)
+}
+
+// markScanLines marks session lines committed in the transaction that
+// posts them.
+func markScanLines(ids ...int) func(*sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, id := range ids {
+			if _, err := tx.Exec("UPDATE scan_session_lines SET status='committed', error='' WHERE id=?", id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// commitScanReceive receives each line against its PO line.
+func commitScanReceive(lines []ScanSessionLine, skipInspection bool, user, notes string) map[int]error {
+	errs := map[int]error{}
+	received := map[string]bool{}
+	for _, l := range lines {
+		var lineID int
+		var open float64
+		err := db.QueryRow(`SELECT l.id, l.qty_ordered - l.qty_received FROM po_lines l JOIN purchase_orders p ON p.id = l.po_id
+			WHERE l.po_id=? AND l.ipn=? AND p.status IN ('sent','confirmed','partial') AND l.qty_ordered > l.qty_received
+			ORDER BY l.id LIMIT 1`, l.Reference, l.IPN).Scan(&lineID, &open)
+		if err != nil {
+			errs[l.ID] = fmt.Errorf("no open line for %s on %s", l.IPN, l.Reference)
+			continue
+		}
+		if l.Qty > open+1e-9 {
+			errs[l.ID] = fmt.Errorf("only %g %s still open on %s", open, l.IPN, l.Reference)
+			continue
+		}
+		receipt := POReceiptLine{ID: lineID, Qty: l.Qty, LotNumber: l.LotNumber, DateCode: l.DateCode}
+		if err := receivePOLines(l.Reference, []POReceiptLine{receipt}, skipInspection, markScanLines(l.ID)); err != nil {
+			errs[l.ID] = err
+			continue
+		}
+		received[l.Reference] = true
+		logAudit(db, user, "received", "po", l.Reference, fmt.Sprintf("Received %g %s on PO %s (%s)", l.Qty, l.IPN, l.Reference, notes))
+		if l.Location == "" {
+			continue
+		}
+		// The lot is put away where it was scanned; stock that skipped
+		// inspection is on hand and moves there too
+		db.Exec("UPDATE inventory_lots SET location=? WHERE id=(SELECT MAX(id) FROM inventory_lots WHERE po_line_id=?)", l.Location, lineID)
+		if skipInspection {
+			t := InventoryTransaction{IPN: l.IPN, Type: "transfer", Qty: l.Qty, ToLocation: l.Location, Reference: l.Reference, Notes: notes}
+			if _, err := applyInventoryTransaction(t, user, nil); err != nil {
+				errs[l.ID] = fmt.Errorf("received, but not put away in %s: %v", l.Location, err)
+			}
+		}
+	}
+	for po := range received {
+		go emailOnPOReceived(po)
+	}
+	return errs
+}
+
+// commitScanTransactions posts issue lines as issues to the session's WO
+// and move lines as transfers. A lot moved whole goes with its stock.
+func commitScanTransactions(s ScanSession, lines []ScanSessionLine, user, notes string) map[int]error {
+	errs := map[int]error{}
+	for _, l := range lines {
+		t := InventoryTransaction{IPN: l.IPN, Type: "issue", Qty: l.Qty, Reference: s.Reference, Notes: notes, Location: l.Location}
+		if s.Mode == "move" {
+			t = InventoryTransaction{IPN: l.IPN, Type: "transfer", Qty: l.Qty, Reference: fmt.Sprintf("SCAN-%d", s.ID), Notes: notes,
+				Location: l.Location, ToLocation: l.ToLocation}
+		} else if l.LotID != nil {
+			t.Lots = []LotPick{{LotID: *l.LotID, Qty: l.Qty}}
+		}
+		mark := markScanLines(l.ID)
+		posted := func(tx *sql.Tx) error {
+			if s.Mode == "move" && l.LotID != nil {
+				if _, err := tx.Exec("UPDATE inventory_lots SET location=? WHERE id=? AND qty_on_hand <= ?", l.ToLocation, *l.LotID, l.Qty+1e-9); err != nil {
+					return err
+				}
+			}
+			return mark(tx)
+		}
+		if _, err := applyInventoryTransaction(t, user, posted); err != nil {
+			errs[l.ID] = err
+		}
+	}
+	return errs
+}
+
+// commitScanPick records picked quantities on the sales order's lines. The
+// stock leaves when the order ships; once every line is picked the order
+// moves to picked.
+func commitScanPick(s ScanSession, lines []ScanSessionLine, user string) map[int]error {
+	errs := map[int]error{}
+	for _, l := range lines {
+		if err := pickScanLine(s.Reference, l); err != nil {
+			errs[l.ID] = err
+			continue
+		}
+		logAudit(db, user, "picked", "sales_order", s.Reference, fmt.Sprintf("Picked %g %s for %s in scanner session %d", l.Qty, l.IPN, s.Reference, s.ID))
+	}
+
+	var unpicked int
+	var status string
+	db.QueryRow("SELECT COUNT(*) FROM sales_order_lines WHERE sales_order_id=? AND qty_picked < qty", s.Reference).Scan(&unpicked)
+	db.QueryRow("SELECT status FROM sales_orders WHERE id=?", s.Reference).Scan(&status)
+	if unpicked == 0 && status == "allocated" {
+		now := time.Now().Format("2006-01-02 15:04:05")
+		db.Exec("UPDATE sales_orders SET status='picked',updated_at=? WHERE id=?", now, s.Reference)
+		logAudit(db, user, "picked", "sales_order", s.Reference, fmt.Sprintf("Transitioned %s from allocated to picked", s.Reference))
+	}
+	return errs
+}
+
+// pickScanLine spreads a pick line over the order's open lines for its IPN
+// and marks it committed, in one transaction.
+func pickScanLine(soID string, l ScanSessionLine) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT id, qty - qty_picked FROM sales_order_lines WHERE sales_order_id=? AND ipn=? AND qty_picked < qty ORDER BY id", soID, l.IPN)
+	if err != nil {
+		return err
+	}
+	type openLine struct {
+		id   int
+		open float64
+	}
+	var open []openLine
+	total := 0.0
+	for rows.Next() {
+		var o openLine
+		rows.Scan(&o.id, &o.open)
+		open = append(open, o)
+		total += o.open
+	}
+	rows.Close()
+	if l.Qty > total+1e-9 {
+		return fmt.Errorf("%s needs only %g more %s", soID, total, l.IPN)
+	}
+	left := l.Qty
+	for _, o := range open {
+		if left <= 0 {
+			break
+		}
+		q := math.Min(left, o.open)
+		if _, err := tx.Exec("UPDATE sales_order_lines SET qty_picked = qty_picked + ? WHERE id=?", q, o.id); err != nil {
+			return err
+		}
+		left -= q
+	}
+	if err := markScanLines(l.ID)(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// commitScanCount posts counts. An IPN with an open cycle count due is
+// counted against it when the count takes in all of its stock: no location
+// was scanned for it, or every bin holding it was. The task gets the total
+// of the lines, and once it posts each bin is set to what was counted in
+// it. Other counts set the stock at the location counted, or the total if
+// no location was scanned.
+func commitScanCount(s ScanSession, lines []ScanSessionLine, user, notes string) map[int]error {
+	errs := map[int]error{}
+	type countKey struct{ ipn, location string }
+	var keys []countKey
+	counted := map[countKey]float64{}
+	byKey := map[countKey][]int{}
+	byIPN := map[string][]int{}
+	totals := map[string]float64{}
+	bins := map[string]map[string]float64{}
+	unlocated := map[string]bool{}
+	for _, l := range lines {
+		k := countKey{l.IPN, l.Location}
+		if _, ok := counted[k]; !ok {
+			keys = append(keys, k)
+		}
+		counted[k] += l.Qty
+		byKey[k] = append(byKey[k], l.ID)
+		byIPN[l.IPN] = append(byIPN[l.IPN], l.ID)
+		totals[l.IPN] += l.Qty
+		if l.Location == "" {
+			unlocated[l.IPN] = true
+		} else {
+			if bins[l.IPN] == nil {
+				bins[l.IPN] = map[string]float64{}
+			}
+			bins[l.IPN][l.Location] += l.Qty
+		}
+	}
+	today := time.Now().Format("2006-01-02")
+	done := map[string]bool{}
+	for _, k := range keys {
+		if done[k.ipn] {
+			continue
+		}
+		if scanCountCoversStock(k.ipn, bins[k.ipn], unlocated[k.ipn]) {
+			tasks, err := loadCycleCountTasks("ipn = ? AND status = 'open' AND scheduled_date <= ?", k.ipn, today)
+			if err == nil && len(tasks) > 0 {
+				done[k.ipn] = true
+				task, ipnBins, mark := tasks[0], bins[k.ipn], markScanLines(byIPN[k.ipn]...)
+				_, _, err = countCycleCountTask(task, totals[k.ipn], notes, user, func(tx *sql.Tx) error {
+					var status string
+					tx.QueryRow("SELECT status FROM cycle_count_tasks WHERE id=?", task.ID).Scan(&status)
+					if status == "completed" {
+						now := time.Now().Format("2006-01-02 15:04:05")
+						for code, q := range ipnBins {
+							if err := addLocationStock(tx, task.IPN, code, q-stockAt(tx, task.IPN, code), now); err != nil {
+								return err
+							}
+						}
+					}
+					return mark(tx)
+				})
+				for _, id := range byIPN[k.ipn] {
+					errs[id] = err
+				}
+				continue
+			}
+		}
+		t := InventoryTransaction{IPN: k.ipn, Type: "adjust", Qty: counted[k], Location: k.location, Reference: fmt.Sprintf("SCAN-%d", s.ID), Notes: notes}
+		_, err := applyInventoryTransaction(t, user, markScanLines(byKey[k]...))
+		for _, id := range byKey[k] {
+			errs[id] = err
+		}
+	}
+	return errs
+}
+
+// scanCountCoversStock reports whether a count of ipn takes in all of its
+// stock: nothing was counted by location, or only by location with every
+// bin holding it counted and none of it unassigned.
+func scanCountCoversStock(ipn string, bins map[string]float64, unlocated bool) bool {
+	if len(bins) == 0 {
+		return true
+	}
+	if unlocated {
+		return false
+	}
+	rows, err := db.Query("SELECT location_code FROM inventory_locations WHERE ipn=? AND qty_on_hand > 0", ipn)
+	if err != nil {
+		return false
+	}
+	covered := true
+	for rows.Next() {
+		var code string
+		rows.Scan(&code)
+		if _, ok := bins[code]; !ok {
+			covered = false
+		}
+	}
+	rows.Close()
+	var onHand, located float64
+	db.QueryRow("SELECT qty_on_hand FROM inventory WHERE ipn=?", ipn).Scan(&onHand)
+	db.QueryRow("SELECT COALESCE(SUM(qty_on_hand),0) FROM inventory_locations WHERE ipn=?", ipn).Scan(&located)
+	return covered && onHand-located <= 1e-9
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScanSessions(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+
+	for _, body := range []string{
+		`{"code":"MAIN","name":"Main plant","type":"site"}`,
+		`{"code":"MAIN-STK","name":"Stockroom","type":"area","parent_code":"MAIN"}`,
+		`{"code":"A1","name":"Shelf A1","type":"bin","parent_code":"MAIN-STK"}`,
+		`{"code":"B1","name":"Shelf B1","type":"bin","parent_code":"MAIN-STK"}`,
+	} {
+		if w := createLocation(t, body); w.Code != 200 {
+			t.Fatalf("%s: %d %s", body, w.Code, w.Body.String())
+		}
+	}
+	stmts := []string{
+		`INSERT INTO inventory (ipn) VALUES ('IC-1')`,
+		`INSERT INTO purchase_orders (id, vendor_id, status) VALUES ('PO-1', 'V-1', 'sent')`,
+		`INSERT INTO po_lines (po_id, ipn, qty_ordered) VALUES ('PO-1', 'IC-1', 100)`,
+		`INSERT INTO work_orders (id, assembly_ipn, qty, status) VALUES ('WO-1', 'ASM-1', 5, 'open')`,
+		`INSERT INTO sales_orders (id, customer, status) VALUES ('SO-1', 'Acme', 'allocated')`,
+		`INSERT INTO sales_order_lines (sales_order_id, ipn, qty) VALUES ('SO-1', 'IC-1', 20)`,
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("seed failed: %v\n%s", err, s)
+		}
+	}
+
+	open := func(body string) ScanSession {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handleCreateScanSession(w, httptest.NewRequest("POST", "/api/v1/scan-sessions", bytes.NewBufferString(body)))
+		if w.Code != 200 {
+			t.Fatalf("open %s failed: %d %s", body, w.Code, w.Body.String())
+		}
+		var resp struct {
+			Data ScanSession `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Data
+	}
+	scanID := func(s ScanSession, code, id string) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(map[string]string{"code": code, "scan_id": id})
+		w := httptest.NewRecorder()
+		handleScanSessionScan(w, httptest.NewRequest("POST", "/api/v1/scan-sessions/x/scan", bytes.NewBuffer(b)), strconv.Itoa(s.ID))
+		return w
+	}
+	scan := func(s ScanSession, codes ...string) {
+		t.Helper()
+		for _, code := range codes {
+			if w := scanID(s, code, ""); w.Code != 200 {
+				t.Fatalf("scan %q failed: %d %s", code, w.Code, w.Body.String())
+			}
+		}
+	}
+	commit := func(s ScanSession, body string) ScanSession {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handleCommitScanSession(w, httptest.NewRequest("POST", "/api/v1/scan-sessions/x/commit", bytes.NewBufferString(body)), strconv.Itoa(s.ID))
+		if w.Code != 200 {
+			t.Fatalf("commit failed: %d %s", w.Code, w.Body.String())
+		}
+		got, _ := loadScanSession(strconv.Itoa(s.ID))
+		return got
+	}
+	at := func(ipn, location string) float64 {
+		tx, _ := db.Begin()
+		defer tx.Rollback()
+		return stockAt(tx, ipn, location)
+	}
+
+	// Receive: order, bin, then part and qty or one of our reel labels
+	rs := open(`{"mode":"receive"}`)
+	scan(rs, "PO-1", "A1", "IC-1", "Q60")
+	if w := scanID(rs, "IC-1|LOT-9|50", ""); w.Code != 400 || !strings.Contains(w.Body.String(), "60 already scanned") {
+		t.Errorf("expected an over-receipt to be refused, got %d %s", w.Code, w.Body.String())
+	}
+	scan(rs, "IC-1|LOT-9|40")
+	if rs = commit(rs, `{"skip_inspection":true}`); rs.Status != "committed" || len(rs.Lines) != 2 || rs.Lines[1].LotNumber != "LOT-9" {
+		t.Fatalf("unexpected receive session: %+v", rs)
+	}
+	var poStatus, lotLocation string
+	db.QueryRow("SELECT status FROM purchase_orders WHERE id='PO-1'").Scan(&poStatus)
+	db.QueryRow("SELECT location FROM inventory_lots WHERE lot_number='LOT-9'").Scan(&lotLocation)
+	if onHand("IC-1") != 100 || at("IC-1", "A1") != 100 || poStatus != "received" || lotLocation != "A1" {
+		t.Errorf("expected 100 received into A1, got %v (%v in A1), PO %s, lot in %q", onHand("IC-1"), at("IC-1", "A1"), poStatus, lotLocation)
+	}
+	if w := scanID(rs, "IC-1", ""); w.Code != 400 {
+		t.Errorf("expected a committed session to refuse scans, got %d", w.Code)
+	}
+
+	// Issue: nothing before the WO; a lot then a quantity makes a line, and
+	// a scan resent after a dropped connection is only taken once
+	is := open(`{"mode":"issue"}`)
+	if w := scanID(is, "IC-1", ""); w.Code != 400 || !strings.Contains(w.Body.String(), "work order first") {
+		t.Errorf("expected the WO to be asked for first, got %d %s", w.Code, w.Body.String())
+	}
+	scan(is, "WO-1", "A1", "LOT-9", "25", "IC-1")
+	for i := 0; i < 2; i++ {
+		if w := scanID(is, "Q5", "scan-1"); w.Code != 200 {
+			t.Fatalf("resent scan failed: %d %s", w.Code, w.Body.String())
+		}
+	}
+	is, _ = loadScanSession(strconv.Itoa(is.ID))
+	if len(is.Lines) != 2 || is.Lines[0].LotID == nil || is.Lines[0].Qty != 25 || is.Lines[1].Qty != 5 || is.Prompt != "Scan a part, lot or reel label" {
+		t.Fatalf("unexpected issue session: %+v", is)
+	}
+	if is = commit(is, ""); is.Status != "committed" {
+		t.Fatalf("issue not committed: %+v", is)
+	}
+	var lotQty float64
+	db.QueryRow("SELECT qty_on_hand FROM inventory_lots WHERE lot_number='LOT-9'").Scan(&lotQty)
+	var issued float64
+	db.QueryRow("SELECT COALESCE(SUM(qty),0) FROM inventory_transactions WHERE type='issue' AND reference='WO-1'").Scan(&issued)
+	if onHand("IC-1") != 70 || at("IC-1", "A1") != 70 || lotQty != 15 || issued != 30 {
+		t.Errorf("expected 30 issued to WO-1 from A1 and 25 from LOT-9, got %v on hand, %v in A1, lot %v, issued %v", onHand("IC-1"), at("IC-1", "A1"), lotQty, issued)
+	}
+
+	// Move: from bin, part, qty, to bin
+	ms := open(`{"mode":"move"}`)
+	scan(ms, "A1", "IC-1", "10", "B1")
+	if ms = commit(ms, ""); ms.Status != "committed" || ms.Lines[0].Location != "A1" || ms.Lines[0].ToLocation != "B1" {
+		t.Fatalf("unexpected move session: %+v", ms)
+	}
+	if at("IC-1", "A1") != 60 || at("IC-1", "B1") != 10 || onHand("IC-1") != 70 {
+		t.Errorf("expected 60/10 after the move, got %v/%v", at("IC-1", "A1"), at("IC-1", "B1"))
+	}
+
+	// Pick: quantities are checked against the order, which is picked once
+	// every line is
+	ps := open(`{"mode":"pick","reference":"SO-1"}`)
+	scan(ps, "IC-1")
+	if w := scanID(ps, "Q25", ""); w.Code != 400 {
+		t.Errorf("expected an over-pick to be refused, got %d %s", w.Code, w.Body.String())
+	}
+	scan(ps, "Q20")
+	ps = commit(ps, "")
+	var picked int
+	var soStatus string
+	db.QueryRow("SELECT qty_picked FROM sales_order_lines WHERE sales_order_id='SO-1'").Scan(&picked)
+	db.QueryRow("SELECT status FROM sales_orders WHERE id='SO-1'").Scan(&soStatus)
+	if ps.Status != "committed" || picked != 20 || soStatus != "picked" {
+		t.Errorf("expected SO-1 picked, got %d picked, %s", picked, soStatus)
+	}
+	w := httptest.NewRecorder()
+	handleCreateScanSession(w, httptest.NewRequest("POST", "/api/v1/scan-sessions", bytes.NewBufferString(`{"mode":"pick","reference":"SO-1"}`)))
+	if w.Code != 400 {
+		t.Errorf("expected a picked order to be refused, got %d", w.Code)
+	}
+
+	// Count: a due cycle count takes a count of all the part's stock; one
+	// bin of it only sets that bin
+	today := time.Now().Format("2006-01-02")
+	db.Exec("INSERT INTO cycle_count_tasks (ipn, abc_class, scheduled_date) VALUES ('IC-1', 'C', ?)", today)
+	cs := open(`{"mode":"count"}`)
+	scan(cs, "B1", "IC-1", "10")
+	if cs = commit(cs, ""); cs.Status != "committed" {
+		t.Fatalf("bin count not committed: %+v", cs)
+	}
+	if task, _ := loadCycleCountTask("1"); task.Status != "open" || at("IC-1", "A1") != 60 || at("IC-1", "B1") != 10 || onHand("IC-1") != 70 {
+		t.Errorf("expected B1 counted without the cycle count, got %+v, %v/%v of %v", task, at("IC-1", "A1"), at("IC-1", "B1"), onHand("IC-1"))
+	}
+	cs = open(`{"mode":"count"}`)
+	scan(cs, "IC-1", "68")
+	if cs = commit(cs, ""); cs.Status != "committed" {
+		t.Fatalf("count not committed: %+v", cs)
+	}
+	task, _ := loadCycleCountTask("1")
+	if task.Status != "completed" || task.CountedQty == nil || *task.CountedQty != 68 || onHand("IC-1") != 68 {
+		t.Errorf("expected the cycle count completed at 68, got %+v, %v on hand", task, onHand("IC-1"))
+	}
+	cs = open(`{"mode":"count"}`)
+	scan(cs, "B1", "IC-1", "12")
+	commit(cs, "")
+	if at("IC-1", "B1") != 12 || onHand("IC-1") != 70 {
+		t.Errorf("expected 12 counted in B1 of 70, got %v of %v", at("IC-1", "B1"), onHand("IC-1"))
+	}
+
+	// A numeric lot number is taken as the lot, not a quantity
+	db.Exec("INSERT INTO inventory_lots (ipn, lot_number, qty_received, qty_on_hand, status) VALUES ('IC-1', '2024', 0, 0, 'depleted')")
+	ns := open(`{"mode":"issue","reference":"WO-1"}`)
+	scan(ns, "IC-1", "2024")
+	if ns, _ = loadScanSession(strconv.Itoa(ns.ID)); ns.Pending.LotNumber != "2024" || ns.Pending.Qty != nil || len(ns.Lines) != 0 {
+		t.Errorf("expected lot 2024 pending without a quantity, got %+v", ns)
+	}
+	w = httptest.NewRecorder()
+	handleCancelScanSession(w, httptest.NewRequest("POST", "/api/v1/scan-sessions/x/cancel", nil), strconv.Itoa(ns.ID))
+
+	// A line that can't be posted keeps the session open with its error;
+	// it can be taken back and the session cancelled
+	fs := open(`{"mode":"issue","reference":"WO-1"}`)
+	scan(fs, "B1", "IC-1", "12")
+	postTransact(t, `{"ipn":"IC-1","type":"transfer","qty":12,"location":"B1","to_location":"A1"}`)
+	fs = commit(fs, "")
+	if fs.Status != "open" || fs.Lines[0].Status != "failed" || !strings.Contains(fs.Lines[0].Error, "only 0 IC-1 in B1") {
+		t.Fatalf("expected the line to fail, got %+v", fs)
+	}
+	// A session already being committed isn't committed again alongside
+	db.Exec("UPDATE scan_sessions SET status='committing' WHERE id=?", fs.ID)
+	w = httptest.NewRecorder()
+	handleCommitScanSession(w, httptest.NewRequest("POST", "/api/v1/scan-sessions/x/commit", nil), strconv.Itoa(fs.ID))
+	if w.Code != 409 {
+		t.Errorf("expected a second commit to be refused, got %d %s", w.Code, w.Body.String())
+	}
+	db.Exec("UPDATE scan_sessions SET status='open' WHERE id=?", fs.ID)
+	w = httptest.NewRecorder()
+	handleDeleteScanSessionLine(w, httptest.NewRequest("DELETE", "/api/v1/scan-sessions/x/lines/y", nil), strconv.Itoa(fs.ID), strconv.Itoa(fs.Lines[0].ID))
+	if w.Code != 200 {
+		t.Fatalf("undo failed: %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handleCancelScanSession(w, httptest.NewRequest("POST", "/api/v1/scan-sessions/x/cancel", nil), strconv.Itoa(fs.ID))
+	if fs, _ = loadScanSession(strconv.Itoa(fs.ID)); w.Code != 200 || fs.Status != "cancelled" || len(fs.Lines) != 0 {
+		t.Errorf("expected the session cancelled, got %d %+v", w.Code, fs)
+	}
+
+	// Every scan is kept, refused ones included
+	w = httptest.NewRecorder()
+	handleListScanSessionEvents(w, httptest.NewRequest("GET", "/api/v1/scan-sessions/x/events", nil), strconv.Itoa(is.ID))
+	var events struct {
+		Data []ScanSessionEvent `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &events)
+	if len(events.Data) != 7 || events.Data[6].Kind != "error" || events.Data[0].Kind != "qty" || events.Data[0].Username != "system" {
+		t.Errorf("unexpected events: %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handleListScanSessions(w, httptest.NewRequest("GET", "/api/v1/scan-sessions?username=system&status=committed", nil))
+	var list struct {
+		Data []ScanSession `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Data) != 7 {
+		t.Errorf("expected 7 committed sessions, got %d", len(list.Data))
+	}
+}
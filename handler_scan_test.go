@@ -28,7 +28,7 @@ func setupScanTestDB(t *testing.T) *sql.DB {
 		CREATE TABLE inventory (
 			ipn TEXT PRIMARY KEY,
 			location TEXT,
-			qty REAL DEFAULT 0,
+			qty_on_hand REAL DEFAULT 0,
 			description TEXT
 		)
 	`)
@@ -40,7 +40,7 @@ func setupScanTestDB(t *testing.T) *sql.DB {
 	_, err = testDB.Exec(`
 		CREATE TABLE devices (
 			serial_number TEXT PRIMARY KEY,
-			model TEXT,
+			ipn TEXT,
 			status TEXT DEFAULT 'active',
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		)
@@ -74,32 +74,32 @@ func setupScanTestDB(t *testing.T) *sql.DB {
 
 func insertScanTestData(t *testing.T, testDB *sql.DB, partsDir string) {
 	// Insert inventory items
-	_, err := testDB.Exec("INSERT INTO inventory (ipn, location, qty, description) VALUES (?, ?, ?, ?)",
+	_, err := testDB.Exec("INSERT INTO inventory (ipn, location, qty_on_hand, description) VALUES (?, ?, ?, ?)",
 		"PART-001", "A1", 100.0, "Resistor 10K")
 	if err != nil {
 		t.Fatalf("Failed to insert inventory: %v", err)
 	}
 
-	_, err = testDB.Exec("INSERT INTO inventory (ipn, location, qty, description) VALUES (?, ?, ?, ?)",
+	_, err = testDB.Exec("INSERT INTO inventory (ipn, location, qty_on_hand, description) VALUES (?, ?, ?, ?)",
 		"PART-002", "B2", 50.0, "Capacitor 100uF")
 	if err != nil {
 		t.Fatalf("Failed to insert inventory: %v", err)
 	}
 
 	// Insert devices
-	_, err = testDB.Exec("INSERT INTO devices (serial_number, model, status) VALUES (?, ?, ?)",
+	_, err = testDB.Exec("INSERT INTO devices (serial_number, ipn, status) VALUES (?, ?, ?)",
 		"SN12345", "MODEL-A", "active")
 	if err != nil {
 		t.Fatalf("Failed to insert device: %v", err)
 	}
 
-	_, err = testDB.Exec("INSERT INTO devices (serial_number, model, status) VALUES (?, ?, ?)",
+	_, err = testDB.Exec("INSERT INTO devices (serial_number, ipn, status) VALUES (?, ?, ?)",
 		"SN67890", "MODEL-B", "inactive")
 	if err != nil {
 		t.Fatalf("Failed to insert device: %v", err)
 	}
 
-	_, err = testDB.Exec("INSERT INTO devices (serial_number, model, status) VALUES (?, ?, ?)",
+	_, err = testDB.Exec("INSERT INTO devices (serial_number, ipn, status) VALUES (?, ?, ?)",
 		"SCAN-TEST-001", "TEST-MODEL", "active")
 	if err != nil {
 		t.Fatalf("Failed to insert test device: %v", err)
@@ -474,9 +474,9 @@ func TestHandleScanLookup_XSSInResults(t *testing.T) {
 
 	partsDir = t.TempDir()
 
-	// Insert device with XSS payload in model field
+	// Insert device with XSS payload in ipn field
 	xssPayload := "<script>alert('xss')</script>"
-	_, err := db.Exec("INSERT INTO devices (serial_number, model, status) VALUES (?, ?, ?)",
+	_, err := db.Exec("INSERT INTO devices (serial_number, ipn, status) VALUES (?, ?, ?)",
 		"XSS-TEST", xssPayload, "active")
 	if err != nil {
 		t.Fatalf("Failed to insert XSS test device: %v", err)
@@ -571,9 +571,9 @@ func TestHandleScanLookup_DeduplicationInventory(t *testing.T) {
 	partsDir = t.TempDir()
 
 	// Insert multiple inventory entries with same IPN (different locations)
-	db.Exec("INSERT INTO inventory (ipn, location, qty) VALUES (?, ?, ?)",
+	db.Exec("INSERT INTO inventory (ipn, location, qty_on_hand) VALUES (?, ?, ?)",
 		"DUP-PART", "A1", 10.0)
-	db.Exec("INSERT INTO inventory (ipn, location, qty) VALUES (?, ?, ?)",
+	db.Exec("INSERT INTO inventory (ipn, location, qty_on_hand) VALUES (?, ?, ?)",
 		"DUP-PART", "B2", 20.0)
 
 	req := httptest.NewRequest("GET", "/api/scan?code=DUP-PART", nil)
@@ -47,6 +47,42 @@ func setupSerialTestDB(t *testing.T) *sql.DB {
 			notes TEXT,
 			FOREIGN KEY (wo_id) REFERENCES work_orders(id) ON DELETE CASCADE
 		)`,
+		`CREATE TABLE serial_components (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			parent_serial TEXT NOT NULL,
+			component_type TEXT NOT NULL,
+			child_serial TEXT DEFAULT '',
+			lot_id INTEGER,
+			ipn TEXT DEFAULT '',
+			qty REAL DEFAULT 1,
+			wo_id TEXT DEFAULT '',
+			installed_by TEXT DEFAULT '',
+			installed_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE inventory_lots (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ipn TEXT NOT NULL,
+			lot_number TEXT NOT NULL,
+			date_code TEXT DEFAULT '',
+			vendor_id TEXT DEFAULT '',
+			po_id TEXT DEFAULT '',
+			po_line_id INTEGER,
+			receiving_inspection_id INTEGER,
+			wo_id TEXT DEFAULT '',
+			qty_received REAL DEFAULT 0,
+			qty_on_hand REAL DEFAULT 0,
+			status TEXT DEFAULT 'available',
+			received_at DATETIME,
+			notes TEXT DEFAULT '',
+			location TEXT DEFAULT '',
+			msl_level TEXT DEFAULT '',
+			msl_floor_life_hours REAL,
+			msl_state TEXT DEFAULT 'sealed',
+			msl_exposure_hours REAL DEFAULT 0,
+			msl_opened_at DATETIME,
+			expires_at DATE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
 		`CREATE TABLE inventory (
 			ipn TEXT PRIMARY KEY,
 			qty_on_hand REAL NOT NULL DEFAULT 0,
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// SPCPoint is one reading on the individuals chart.
+type SPCPoint struct {
+	Index        int      `json:"index"`
+	RecordID     int      `json:"record_id"`
+	SerialNumber string   `json:"serial_number"`
+	TestedAt     string   `json:"tested_at"`
+	Value        float64  `json:"value"`
+	MovingRange  *float64 `json:"moving_range"`
+	Subgroup     int      `json:"subgroup"`
+}
+
+// SPCSubgroup is one point on the X-bar and R charts.
+type SPCSubgroup struct {
+	Index       int     `json:"index"`
+	FirstSerial string  `json:"first_serial"`
+	LastSerial  string  `json:"last_serial"`
+	RecordID    int     `json:"record_id"`
+	Mean        float64 `json:"mean"`
+	Range       float64 `json:"range"`
+}
+
+// SPCIndividuals is the individuals (I-MR) chart.
+type SPCIndividuals struct {
+	Center float64 `json:"center"`
+	UCL    float64 `json:"ucl"`
+	LCL    float64 `json:"lcl"`
+	MRBar  float64 `json:"mr_bar"`
+	MRUCL  float64 `json:"mr_ucl"`
+	Sigma  float64 `json:"sigma"`
+}
+
+// SPCXbarR is the X-bar and R chart over consecutive subgroups.
+type SPCXbarR struct {
+	SubgroupSize int           `json:"subgroup_size"`
+	Center       float64       `json:"center"`
+	UCL          float64       `json:"ucl"`
+	LCL          float64       `json:"lcl"`
+	RBar         float64       `json:"r_bar"`
+	RUCL         float64       `json:"r_ucl"`
+	RLCL         float64       `json:"r_lcl"`
+	Subgroups    []SPCSubgroup `json:"subgroups"`
+}
+
+// SPCCapability compares the process spread with the spec limits.
+type SPCCapability struct {
+	LowLimit  *float64 `json:"low_limit"`
+	HighLimit *float64 `json:"high_limit"`
+	Mean      float64  `json:"mean"`
+	Sigma     float64  `json:"sigma"`
+	Cp        *float64 `json:"cp"`
+	Cpk       *float64 `json:"cpk"`
+}
+
+// SPCViolation is a Western Electric rule broken on one of the charts.
+type SPCViolation struct {
+	Chart        string `json:"chart"`
+	Rule         int    `json:"rule"`
+	Index        int    `json:"index"`
+	RecordID     int    `json:"record_id"`
+	SerialNumber string `json:"serial_number"`
+	Description  string `json:"description"`
+}
+
+// SPCAnalysis is the control chart set for one measurement of an IPN.
+type SPCAnalysis struct {
+	IPN         string         `json:"ipn"`
+	Name        string         `json:"name"`
+	TestType    string         `json:"test_type,omitempty"`
+	Unit        string         `json:"unit"`
+	Count       int            `json:"count"`
+	Points      []SPCPoint     `json:"points"`
+	Individuals SPCIndividuals `json:"individuals"`
+	XbarR       *SPCXbarR      `json:"xbar_r"`
+	Capability  SPCCapability  `json:"capability"`
+	Violations  []SPCViolation `json:"violations"`
+}
+
+// SPCWindow selects the readings to chart. Readings are taken in test order;
+// Limit keeps only the latest ones.
+type SPCWindow struct {
+	TestType   string
+	From       string
+	To         string
+	SerialFrom string
+	SerialTo   string
+	Limit      int
+}
+
+const (
+	spcDefaultLimit    = 100
+	spcMaxLimit        = 10000
+	spcDefaultSubgroup = 5
+)
+
+// spcConstants are the control chart factors A2, D3, D4 and d2 by subgroup
+// size.
+var spcConstants = map[int][4]float64{
+	2:  {1.880, 0, 3.267, 1.128},
+	3:  {1.023, 0, 2.574, 1.693},
+	4:  {0.729, 0, 2.282, 2.059},
+	5:  {0.577, 0, 2.114, 2.326},
+	6:  {0.483, 0, 2.004, 2.534},
+	7:  {0.419, 0.076, 1.924, 2.704},
+	8:  {0.373, 0.136, 1.864, 2.847},
+	9:  {0.337, 0.184, 1.816, 2.970},
+	10: {0.308, 0.223, 1.777, 3.078},
+}
+
+func loadSPCReadings(ipn, name string, win SPCWindow) ([]SPCPoint, string, error) {
+	q := `SELECT t.id, t.serial_number, t.tested_at, m.value, COALESCE(m.unit,'') FROM test_measurements m
+		JOIN test_records t ON t.id = m.test_record_id
+		WHERE t.ipn = ? AND LOWER(m.name) = LOWER(?)`
+	args := []interface{}{ipn, name}
+	if win.TestType != "" {
+		q += " AND t.test_type = ?"
+		args = append(args, win.TestType)
+	}
+	if win.From != "" {
+		q += " AND substr(t.tested_at,1,10) >= ?"
+		args = append(args, win.From)
+	}
+	if win.To != "" {
+		q += " AND substr(t.tested_at,1,10) <= ?"
+		args = append(args, win.To)
+	}
+	if win.SerialFrom != "" {
+		q += " AND t.serial_number >= ?"
+		args = append(args, win.SerialFrom)
+	}
+	if win.SerialTo != "" {
+		q += " AND t.serial_number <= ?"
+		args = append(args, win.SerialTo)
+	}
+	q += " ORDER BY t.tested_at DESC, t.id DESC, m.id DESC LIMIT ?"
+	args = append(args, win.Limit)
+
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	var points []SPCPoint
+	unit := ""
+	for rows.Next() {
+		var p SPCPoint
+		var u string
+		if err := rows.Scan(&p.RecordID, &p.SerialNumber, &p.TestedAt, &p.Value, &u); err != nil {
+			return nil, "", err
+		}
+		if unit == "" {
+			unit = u
+		}
+		points = append(points, p)
+	}
+	// Newest first from the query; charts run oldest first
+	for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+		points[i], points[j] = points[j], points[i]
+	}
+	return points, unit, rows.Err()
+}
+
+// analyzeSPC builds the charts for a measurement. Limits come from the test
+// spec, or the station's limits on the latest reading when there is none.
+func analyzeSPC(ipn, name string, win SPCWindow, subgroupSize int) (*SPCAnalysis, error) {
+	points, unit, err := loadSPCReadings(ipn, name, win)
+	if err != nil {
+		return nil, err
+	}
+	if len(points) < 2 {
+		return nil, fmt.Errorf("need at least 2 readings of %s for %s, found %d", name, ipn, len(points))
+	}
+	a := &SPCAnalysis{IPN: ipn, Name: name, TestType: win.TestType, Unit: unit, Count: len(points), Points: points}
+
+	values := make([]float64, len(points))
+	sum, mrSum := 0.0, 0.0
+	for i := range points {
+		points[i].Index = i + 1
+		values[i] = points[i].Value
+		sum += values[i]
+		if i > 0 {
+			mr := math.Abs(values[i] - values[i-1])
+			points[i].MovingRange = &mr
+			mrSum += mr
+		}
+	}
+	mean := sum / float64(len(values))
+	mrBar := mrSum / float64(len(values)-1)
+	sigma := mrBar / spcConstants[2][3]
+	a.Individuals = SPCIndividuals{Center: mean, UCL: mean + 3*sigma, LCL: mean - 3*sigma, MRBar: mrBar, MRUCL: spcConstants[2][2] * mrBar, Sigma: sigma}
+	a.Violations = westernElectricViolations("individuals", values, mean, sigma, func(i int) (int, string) {
+		return points[i].RecordID, points[i].SerialNumber
+	})
+
+	if k := spcConstants[subgroupSize]; len(points)/subgroupSize >= 2 {
+		xr := &SPCXbarR{SubgroupSize: subgroupSize}
+		var means []float64
+		rSum := 0.0
+		for g := 0; (g+1)*subgroupSize <= len(points); g++ {
+			group := points[g*subgroupSize : (g+1)*subgroupSize]
+			lo, hi, gs := group[0].Value, group[0].Value, 0.0
+			for i := range group {
+				group[i].Subgroup = g + 1
+				gs += group[i].Value
+				lo = math.Min(lo, group[i].Value)
+				hi = math.Max(hi, group[i].Value)
+			}
+			sg := SPCSubgroup{Index: g + 1, FirstSerial: group[0].SerialNumber, LastSerial: group[len(group)-1].SerialNumber,
+				RecordID: group[len(group)-1].RecordID, Mean: gs / float64(subgroupSize), Range: hi - lo}
+			xr.Subgroups = append(xr.Subgroups, sg)
+			means = append(means, sg.Mean)
+			rSum += sg.Range
+		}
+		grand := 0.0
+		for _, m := range means {
+			grand += m
+		}
+		xr.Center = grand / float64(len(means))
+		xr.RBar = rSum / float64(len(means))
+		xr.UCL = xr.Center + k[0]*xr.RBar
+		xr.LCL = xr.Center - k[0]*xr.RBar
+		xr.RUCL = k[2] * xr.RBar
+		xr.RLCL = k[1] * xr.RBar
+		a.XbarR = xr
+
+		sgRef := func(i int) (int, string) { return xr.Subgroups[i].RecordID, xr.Subgroups[i].LastSerial }
+		a.Violations = append(a.Violations, westernElectricViolations("xbar", means, xr.Center, k[0]*xr.RBar/3, sgRef)...)
+		for i, sg := range xr.Subgroups {
+			if sg.Range > xr.RUCL+1e-12 || sg.Range < xr.RLCL-1e-12 {
+				a.Violations = append(a.Violations, SPCViolation{Chart: "range", Rule: 1, Index: i + 1, RecordID: sg.RecordID, SerialNumber: sg.LastSerial,
+					Description: fmt.Sprintf("subgroup range %.4g outside %.4g..%.4g", sg.Range, xr.RLCL, xr.RUCL)})
+			}
+		}
+	}
+
+	a.Capability = SPCCapability{Mean: mean, Sigma: sigma}
+	if spec, ok := spcSpecLimits(ipn, name, win.TestType); ok {
+		a.Capability.LowLimit, a.Capability.HighLimit = spec.LowLimit, spec.HighLimit
+	} else {
+		db.QueryRow(`SELECT m.low_limit, m.high_limit FROM test_measurements m WHERE m.test_record_id = ? AND LOWER(m.name) = LOWER(?)`,
+			points[len(points)-1].RecordID, name).Scan(&a.Capability.LowLimit, &a.Capability.HighLimit)
+	}
+	a.Capability.Cp, a.Capability.Cpk = processCapability(mean, sigma, a.Capability.LowLimit, a.Capability.HighLimit)
+	if a.Violations == nil {
+		a.Violations = []SPCViolation{}
+	}
+	return a, nil
+}
+
+func spcSpecLimits(ipn, name, testType string) (TestSpec, bool) {
+	specs, err := loadTestSpecs(ipn, testType)
+	if err != nil {
+		return TestSpec{}, false
+	}
+	s, ok := specs[strings.ToLower(name)]
+	return s, ok
+}
+
+// processCapability gives Cp (both limits needed) and Cpk (the nearer limit)
+// for a process with the given mean and within-subgroup sigma.
+func processCapability(mean, sigma float64, lo, hi *float64) (cp, cpk *float64) {
+	if sigma <= 0 {
+		return nil, nil
+	}
+	if lo != nil && hi != nil {
+		v := (*hi - *lo) / (6 * sigma)
+		cp = &v
+	}
+	k := math.Inf(1)
+	if hi != nil {
+		k = (*hi - mean) / (3 * sigma)
+	}
+	if lo != nil {
+		k = math.Min(k, (mean-*lo)/(3*sigma))
+	}
+	if !math.IsInf(k, 1) {
+		cpk = &k
+	}
+	return cp, cpk
+}
+
+// westernElectricViolations checks a chart's series against the four Western
+// Electric rules. A rule is reported on the point that completes the run.
+func westernElectricViolations(chart string, values []float64, center, sigma float64, ref func(int) (int, string)) []SPCViolation {
+	if sigma <= 0 {
+		return nil
+	}
+	z := make([]float64, len(values))
+	for i, v := range values {
+		z[i] = (v - center) / sigma
+	}
+	// beyond counts the points of the last n, ending at i, more than k sigma
+	// out on the same side as point i
+	beyond := func(i, n int, k float64) int {
+		if i+1 < n || math.Abs(z[i]) <= k {
+			return 0
+		}
+		side := math.Copysign(1, z[i])
+		c := 0
+		for j := i - n + 1; j <= i; j++ {
+			if z[j]*side > k {
+				c++
+			}
+		}
+		return c
+	}
+	var out []SPCViolation
+	add := func(i, rule int, desc string) {
+		id, sn := ref(i)
+		out = append(out, SPCViolation{Chart: chart, Rule: rule, Index: i + 1, RecordID: id, SerialNumber: sn, Description: desc})
+	}
+	for i := range values {
+		if math.Abs(z[i]) > 3 {
+			add(i, 1, fmt.Sprintf("%.4g is beyond 3 sigma of %.4g", values[i], center))
+		}
+		if beyond(i, 3, 2) >= 2 {
+			add(i, 2, "2 of 3 points beyond 2 sigma on one side")
+		}
+		if beyond(i, 5, 1) >= 4 {
+			add(i, 3, "4 of 5 points beyond 1 sigma on one side")
+		}
+		if beyond(i, 8, 0) == 8 {
+			add(i, 4, "8 points in a row on one side of the center line")
+		}
+	}
+	return out
+}
+
+// notifySPCViolations raises a notification per test record and
+// measurement with a rule violation; only is the set of records to report,
+// or nil for all of them. The record ID and measurement name make the
+// dedup key, so a unit out on two measurements raises both.
+func notifySPCViolations(a *SPCAnalysis, only map[int]bool) {
+	for _, v := range a.Violations {
+		if only != nil && !only[v.RecordID] {
+			continue
+		}
+		msg := fmt.Sprintf("%s rule %d on the %s chart at %s: %s", a.Name, v.Rule, v.Chart, v.SerialNumber, v.Description)
+		key := strconv.Itoa(v.RecordID) + ":" + strings.ToLower(a.Name)
+		createNotificationIfNew("spc_violation", "warning", "SPC Violation: "+a.IPN+" "+a.Name,
+			&msg, &key, stringPtr("testing"))
+	}
+}
+
+// checkSPCAfterIngest charts every spec'd measurement of newly ingested
+// records and notifies on violations at those records.
+func checkSPCAfterIngest(records []TestRecord) {
+	type key struct{ ipn, testType, name string }
+	fresh := map[key]map[int]bool{}
+	var order []key
+	for _, t := range records {
+		specs, err := loadTestSpecs(t.IPN, t.TestType)
+		if err != nil {
+			continue
+		}
+		for _, m := range t.Readings {
+			if _, ok := specs[strings.ToLower(m.Name)]; !ok {
+				continue
+			}
+			k := key{t.IPN, t.TestType, strings.ToLower(m.Name)}
+			if fresh[k] == nil {
+				fresh[k] = map[int]bool{}
+				order = append(order, k)
+			}
+			fresh[k][t.ID] = true
+		}
+	}
+	for _, k := range order {
+		a, err := analyzeSPC(k.ipn, k.name, SPCWindow{TestType: k.testType, Limit: spcDefaultLimit}, spcDefaultSubgroup)
+		if err != nil {
+			continue
+		}
+		notifySPCViolations(a, fresh[k])
+	}
+}
+
+func handleTestSPC(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	ipn, name := strings.TrimSpace(q.Get("ipn")), strings.TrimSpace(q.Get("name"))
+	win := SPCWindow{TestType: q.Get("test_type"), From: q.Get("from"), To: q.Get("to"),
+		SerialFrom: q.Get("serial_from"), SerialTo: q.Get("serial_to"), Limit: spcDefaultLimit}
+	subgroup := spcDefaultSubgroup
+	format := q.Get("format")
+
+	ve := &ValidationErrors{}
+	requireField(ve, "ipn", ipn)
+	requireField(ve, "name", name)
+	validateEnum(ve, "test_type", win.TestType, validTestTypes)
+	validateDate(ve, "from", win.From)
+	validateDate(ve, "to", win.To)
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 2 || n > spcMaxLimit {
+			ve.Add("limit", fmt.Sprintf("must be between 2 and %d", spcMaxLimit))
+		}
+		win.Limit = n
+	}
+	if s := q.Get("subgroup"); s != "" {
+		n, err := strconv.Atoi(s)
+		if _, ok := spcConstants[n]; err != nil || !ok {
+			ve.Add("subgroup", "must be between 2 and 10")
+		}
+		subgroup = n
+	}
+	validateEnum(ve, "format", format, []string{"json", "csv", "xlsx"})
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	a, err := analyzeSPC(ipn, name, win, subgroup)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "need at least") {
+			jsonErr(w, err.Error(), 400)
+		} else {
+			jsonErr(w, err.Error(), 500)
+		}
+		return
+	}
+
+	if format == "csv" || format == "xlsx" {
+		exportSPC(w, r, a, format)
+		return
+	}
+	jsonResp(w, a)
+}
+
+// exportSPC writes one row per reading with its chart limits and the rules
+// it breaks.
+func exportSPC(w http.ResponseWriter, r *http.Request, a *SPCAnalysis, format string) {
+	broken := map[string][]string{}
+	for _, v := range a.Violations {
+		idx := v.Index
+		if v.Chart != "individuals" {
+			// Subgroup rules land on the subgroup's last reading
+			idx = v.Index * a.XbarR.SubgroupSize
+		}
+		k := strconv.Itoa(idx)
+		broken[k] = append(broken[k], fmt.Sprintf("%s rule %d", v.Chart, v.Rule))
+	}
+	num := func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+
+	headers := []string{"Index", "Serial Number", "Record ID", "Tested At", "Value", "Moving Range", "CL", "UCL", "LCL",
+		"Subgroup", "Subgroup Mean", "Subgroup Range", "Violations"}
+	var data [][]string
+	for _, p := range a.Points {
+		mr := ""
+		if p.MovingRange != nil {
+			mr = num(*p.MovingRange)
+		}
+		sg, sgMean, sgRange := "", "", ""
+		if p.Subgroup > 0 {
+			s := a.XbarR.Subgroups[p.Subgroup-1]
+			sg, sgMean, sgRange = strconv.Itoa(s.Index), num(s.Mean), num(s.Range)
+		}
+		data = append(data, []string{
+			strconv.Itoa(p.Index),
+			p.SerialNumber,
+			strconv.Itoa(p.RecordID),
+			p.TestedAt,
+			num(p.Value),
+			mr,
+			num(a.Individuals.Center),
+			num(a.Individuals.UCL),
+			num(a.Individuals.LCL),
+			sg,
+			sgMean,
+			sgRange,
+			strings.Join(broken[strconv.Itoa(p.Index)], "; "),
+		})
+	}
+
+	LogDataExport(db, r, "spc", format, len(data))
+	if format == "xlsx" {
+		exportExcel(w, "SPC", headers, data)
+	} else {
+		exportCSV(w, fmt.Sprintf("spc_%s_%s.csv", a.IPN, a.Name), headers, data)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// seedSPCReadings stores one VOUT reading per value as factory tests of
+// PCA-1, a day apart from 2026-01-01, serials SN-01 upwards.
+func seedSPCReadings(t *testing.T, values []float64) {
+	t.Helper()
+	for i, v := range values {
+		res, err := db.Exec(`INSERT INTO test_records (serial_number, ipn, test_type, result, tested_at) VALUES (?, 'PCA-1', 'factory', 'pass', ?)`,
+			fmt.Sprintf("SN-%02d", i+1), fmt.Sprintf("2026-01-%02d 10:00:00", i+1))
+		if err != nil {
+			t.Fatalf("seeding test record: %v", err)
+		}
+		id, _ := res.LastInsertId()
+		if _, err := db.Exec(`INSERT INTO test_measurements (test_record_id, name, value, unit, result) VALUES (?, 'VOUT', ?, 'V', 'pass')`, id, v); err != nil {
+			t.Fatalf("seeding measurement: %v", err)
+		}
+	}
+}
+
+func getSPC(t *testing.T, query string) (*httptest.ResponseRecorder, SPCAnalysis) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleTestSPC(w, httptest.NewRequest("GET", "/api/v1/tests/spc?"+query, nil))
+	var resp struct {
+		Data SPCAnalysis `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp.Data
+}
+
+func TestWesternElectricRules(t *testing.T) {
+	ref := func(i int) (int, string) { return i, "" }
+	tests := []struct {
+		name   string
+		values []float64
+		rule   int
+		index  int
+	}{
+		{"beyond 3 sigma", []float64{0, -3.5, 0}, 1, 2},
+		{"2 of 3 beyond 2 sigma", []float64{0, 2.5, 0.5, 2.5}, 2, 4},
+		{"4 of 5 beyond 1 sigma", []float64{-0.5, 1.5, 1.5, 0.5, 1.5, 1.5}, 3, 6},
+		{"8 in a row", []float64{-0.1, 0.2, 0.2, 0.2, 0.2, 0.2, 0.2, 0.2, 0.2}, 4, 9},
+	}
+	for _, tt := range tests {
+		got := westernElectricViolations("individuals", tt.values, 0, 1, ref)
+		if len(got) != 1 || got[0].Rule != tt.rule || got[0].Index != tt.index {
+			t.Errorf("%s: expected rule %d at %d, got %+v", tt.name, tt.rule, tt.index, got)
+		}
+	}
+	if got := westernElectricViolations("individuals", []float64{0.5, -0.5, 0.5, -0.5}, 0, 1, ref); len(got) != 0 {
+		t.Errorf("expected an in-control series to pass, got %+v", got)
+	}
+}
+
+func TestSPCChartsCapabilityAndExport(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedTestSpecs(t)
+	seedSPCReadings(t, []float64{3.30, 3.31, 3.29, 3.30, 3.31, 3.29, 3.30, 3.31, 3.29, 3.30})
+
+	w, a := getSPC(t, "ipn=PCA-1&name=vout")
+	if w.Code != 200 {
+		t.Fatalf("SPC failed: %d %s", w.Code, w.Body.String())
+	}
+	if a.Count != 10 || a.Points[0].SerialNumber != "SN-01" || a.XbarR == nil || len(a.XbarR.Subgroups) != 2 || len(a.Violations) != 0 {
+		t.Fatalf("unexpected analysis: %s", w.Body.String())
+	}
+	// MR-bar 0.12/9, sigma MR-bar/1.128; spec 3.2..3.4 around a 3.30 mean
+	sigma := 0.12 / 9 / 1.128
+	if math.Abs(a.Individuals.Center-3.30) > 1e-9 || math.Abs(a.Individuals.Sigma-sigma) > 1e-9 {
+		t.Errorf("unexpected individuals chart: %+v", a.Individuals)
+	}
+	if a.Capability.Cp == nil || a.Capability.Cpk == nil || math.Abs(*a.Capability.Cp-0.2/(6*sigma)) > 1e-6 || math.Abs(*a.Capability.Cpk-*a.Capability.Cp) > 1e-6 {
+		t.Errorf("unexpected capability: %+v", a.Capability)
+	}
+	if sg := a.XbarR.Subgroups[0]; math.Abs(sg.Mean-3.302) > 1e-9 || math.Abs(sg.Range-0.02) > 1e-9 || sg.LastSerial != "SN-05" {
+		t.Errorf("unexpected first subgroup: %+v", sg)
+	}
+
+	// A jump on a freshly ingested unit raises a notification against it
+	_, ing := postIngest(t, "application/json", "/api/v1/tests/ingest",
+		`{"records":[{"serial_number":"SN-11","ipn":"PCA-1","measurements":[{"name":"VOUT","value":3.39,"unit":"V"},{"name":"IDLE_CURRENT","value":10,"unit":"mA"}]}]}`)
+	if len(ing.Data.Records) != 1 {
+		t.Fatalf("ingest failed")
+	}
+	recID := strconv.Itoa(ing.Data.Records[0].ID)
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM notifications WHERE type='spc_violation' AND record_id=?", recID+":vout").Scan(&n)
+	if n != 1 {
+		t.Errorf("expected an SPC notification for record %s, got %d", recID, n)
+	}
+	// Another measurement out on the same unit raises its own
+	notifySPCViolations(&SPCAnalysis{IPN: "PCA-1", Name: "IDLE_CURRENT", Violations: []SPCViolation{{RecordID: ing.Data.Records[0].ID, Rule: 1}}}, nil)
+	db.QueryRow("SELECT COUNT(*) FROM notifications WHERE type='spc_violation'").Scan(&n)
+	if n != 2 {
+		t.Errorf("expected a notification per measurement, got %d", n)
+	}
+
+	// Viewing the chart doesn't raise notifications
+	db.Exec("DELETE FROM notifications")
+	_, a = getSPC(t, "ipn=PCA-1&name=VOUT&test_type=factory")
+	if a.Count != 11 || len(a.Violations) == 0 || a.Violations[0].Rule != 1 || a.Violations[0].SerialNumber != "SN-11" {
+		t.Errorf("expected rule 1 at SN-11, got %+v", a.Violations)
+	}
+	if db.QueryRow("SELECT COUNT(*) FROM notifications").Scan(&n); n != 0 {
+		t.Errorf("expected no notifications from a GET, got %d", n)
+	}
+
+	// Time and serial windows
+	if _, a = getSPC(t, "ipn=PCA-1&name=VOUT&from=2026-01-03&to=2026-01-08"); a.Count != 6 || a.XbarR != nil {
+		t.Errorf("expected 6 readings and no X-bar chart in the date window, got %d", a.Count)
+	}
+	if _, a = getSPC(t, "ipn=PCA-1&name=VOUT&serial_from=SN-05&serial_to=SN-09&subgroup=2"); a.Count != 5 || len(a.XbarR.Subgroups) != 2 {
+		t.Errorf("expected 5 readings in 2 subgroups in the serial window, got %+v", a)
+	}
+	if _, a = getSPC(t, "ipn=PCA-1&name=VOUT&limit=4"); a.Count != 4 || a.Points[3].SerialNumber != "SN-11" {
+		t.Errorf("expected the latest 4 readings, got %+v", a.Points)
+	}
+
+	w = httptest.NewRecorder()
+	handleTestSPC(w, httptest.NewRequest("GET", "/api/v1/tests/spc?ipn=PCA-1&name=VOUT&format=csv", nil))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if w.Header().Get("Content-Type") != "text/csv" || len(lines) != 12 || !strings.HasPrefix(lines[0], "Index,Serial Number") {
+		t.Fatalf("unexpected CSV export: %s", w.Body.String())
+	}
+	if !strings.Contains(lines[11], "individuals rule 1") {
+		t.Errorf("expected the violation in the last CSV row, got %s", lines[11])
+	}
+
+	for _, q := range []string{"ipn=PCA-1", "ipn=PCA-1&name=VOUT&subgroup=11", "ipn=PCA-1&name=VOUT&from=Jan", "ipn=PCA-1&name=VOUT&format=pdf", "ipn=PCA-1&name=TEMP"} {
+		if w, _ := getSPC(t, q); w.Code != 400 {
+			t.Errorf("%s: expected 400, got %d %s", q, w.Code, w.Body.String())
+		}
+	}
+}
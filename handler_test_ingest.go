@@ -0,0 +1,571 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TestSpec is the limit a named measurement of an IPN is checked against. A
+// spec with a blank test_type applies to every test type; one for the exact
+// type wins over it.
+type TestSpec struct {
+	ID        int      `json:"id"`
+	IPN       string   `json:"ipn"`
+	TestType  string   `json:"test_type"`
+	Name      string   `json:"name"`
+	Unit      string   `json:"unit"`
+	LowLimit  *float64 `json:"low_limit"`
+	HighLimit *float64 `json:"high_limit"`
+	Required  bool     `json:"required"`
+	CreatedAt string   `json:"created_at"`
+	UpdatedAt string   `json:"updated_at"`
+}
+
+// TestMeasurement is one reading of a test record with the limits it was
+// judged against. Result is "none" when there was nothing to judge it by.
+type TestMeasurement struct {
+	ID        int      `json:"id,omitempty"`
+	Name      string   `json:"name"`
+	Value     float64  `json:"value"`
+	Unit      string   `json:"unit"`
+	LowLimit  *float64 `json:"low_limit"`
+	HighLimit *float64 `json:"high_limit"`
+	SpecID    *int     `json:"spec_id,omitempty"`
+	Result    string   `json:"result"`
+	Notes     string   `json:"notes,omitempty"`
+}
+
+// TestIngestRecord is one unit's results in an ingest batch.
+type TestIngestRecord struct {
+	SerialNumber    string            `json:"serial_number"`
+	IPN             string            `json:"ipn"`
+	TestType        string            `json:"test_type"`
+	FirmwareVersion string            `json:"firmware_version"`
+	Notes           string            `json:"notes"`
+	TestedAt        string            `json:"tested_at"`
+	Measurements    []TestMeasurement `json:"measurements"`
+}
+
+const (
+	maxTestIngestRecords = 1000
+	testSpecColumns      = "id, ipn, COALESCE(test_type,''), name, COALESCE(unit,''), low_limit, high_limit, required, created_at, updated_at"
+)
+
+func scanTestSpec(row interface{ Scan(...interface{}) error }) (TestSpec, error) {
+	var s TestSpec
+	var lo, hi sql.NullFloat64
+	err := row.Scan(&s.ID, &s.IPN, &s.TestType, &s.Name, &s.Unit, &lo, &hi, &s.Required, &s.CreatedAt, &s.UpdatedAt)
+	if lo.Valid {
+		s.LowLimit = &lo.Float64
+	}
+	if hi.Valid {
+		s.HighLimit = &hi.Float64
+	}
+	return s, err
+}
+
+// loadTestSpecs returns the specs that apply to a test of an IPN, keyed by
+// lower-cased measurement name.
+func loadTestSpecs(ipn, testType string) (map[string]TestSpec, error) {
+	rows, err := db.Query("SELECT "+testSpecColumns+" FROM test_specs WHERE ipn=? AND COALESCE(test_type,'') IN ('',?) ORDER BY test_type", ipn, testType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	specs := map[string]TestSpec{}
+	for rows.Next() {
+		s, err := scanTestSpec(rows)
+		if err != nil {
+			return nil, err
+		}
+		specs[strings.ToLower(s.Name)] = s
+	}
+	return specs, rows.Err()
+}
+
+// judgeTestRecord sets the result of every reading and returns the unit's
+// result with the names of what failed. Spec limits replace any the station
+// sent; readings without a spec are judged by the station's limits, if it
+// sent any. A required spec with no reading fails the unit.
+func judgeTestRecord(rec *TestIngestRecord, specs map[string]TestSpec) (string, []string) {
+	var failed []string
+	seen := map[string]bool{}
+	for i := range rec.Measurements {
+		m := &rec.Measurements[i]
+		key := strings.ToLower(m.Name)
+		seen[key] = true
+		if s, ok := specs[key]; ok {
+			id := s.ID
+			m.SpecID, m.LowLimit, m.HighLimit = &id, s.LowLimit, s.HighLimit
+			if m.Unit == "" {
+				m.Unit = s.Unit
+			} else if s.Unit != "" && !strings.EqualFold(m.Unit, s.Unit) {
+				m.Result = "fail"
+				m.Notes = fmt.Sprintf("unit %s does not match spec unit %s", m.Unit, s.Unit)
+				failed = append(failed, m.Name)
+				continue
+			}
+		}
+		switch {
+		case m.LowLimit == nil && m.HighLimit == nil:
+			m.Result = "none"
+		case (m.LowLimit != nil && m.Value < *m.LowLimit) || (m.HighLimit != nil && m.Value > *m.HighLimit):
+			m.Result = "fail"
+			failed = append(failed, m.Name)
+		default:
+			m.Result = "pass"
+		}
+	}
+	for key, s := range specs {
+		if s.Required && !seen[key] {
+			failed = append(failed, s.Name+" (missing)")
+		}
+	}
+	if len(failed) > 0 {
+		return "fail", failed
+	}
+	return "pass", nil
+}
+
+func testLimitsText(m TestMeasurement) string {
+	lo, hi := "-", "-"
+	if m.LowLimit != nil {
+		lo = strconv.FormatFloat(*m.LowLimit, 'g', -1, 64)
+	}
+	if m.HighLimit != nil {
+		hi = strconv.FormatFloat(*m.HighLimit, 'g', -1, 64)
+	}
+	return lo + ".." + hi
+}
+
+// parseTestCSV reads one measurement per row, STDF parametric-record style,
+// and groups consecutive rows into records by serial, IPN and test type.
+func parseTestCSV(rd io.Reader, defaultType string) ([]TestIngestRecord, error) {
+	cr := csv.NewReader(rd)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	headers, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %v", err)
+	}
+	aliases := map[string]string{
+		"serial": "serial_number", "sn": "serial_number", "part_number": "ipn",
+		"test_name": "name", "test_txt": "name", "measurement": "name",
+		"result": "value", "units": "unit", "lo_limit": "low_limit", "hi_limit": "high_limit",
+	}
+	idx := map[string]int{}
+	for i, h := range headers {
+		h = strings.TrimSpace(strings.ToLower(h))
+		if a, ok := aliases[h]; ok {
+			h = a
+		}
+		idx[h] = i
+	}
+	for _, col := range []string{"serial_number", "ipn", "name", "value"} {
+		if _, ok := idx[col]; !ok {
+			return nil, fmt.Errorf("CSV is missing a %s column", col)
+		}
+	}
+	colOf := func(row []string, name string) string {
+		if i, ok := idx[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	limit := func(row []string, name string, line int) (*float64, error) {
+		v := colOf(row, name)
+		if v == "" {
+			return nil, nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s %q is not a number", line, name, v)
+		}
+		return &f, nil
+	}
+
+	var records []TestIngestRecord
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		m := TestMeasurement{Name: colOf(row, "name"), Unit: colOf(row, "unit")}
+		if m.Value, err = strconv.ParseFloat(colOf(row, "value"), 64); err != nil {
+			return nil, fmt.Errorf("line %d: value %q is not a number", line, colOf(row, "value"))
+		}
+		if m.LowLimit, err = limit(row, "low_limit", line); err != nil {
+			return nil, err
+		}
+		if m.HighLimit, err = limit(row, "high_limit", line); err != nil {
+			return nil, err
+		}
+		rec := TestIngestRecord{SerialNumber: colOf(row, "serial_number"), IPN: colOf(row, "ipn"), TestType: colOf(row, "test_type"),
+			FirmwareVersion: colOf(row, "firmware_version"), TestedAt: colOf(row, "tested_at")}
+		if rec.TestType == "" {
+			rec.TestType = defaultType
+		}
+		if n := len(records); n > 0 && records[n-1].SerialNumber == rec.SerialNumber && records[n-1].IPN == rec.IPN && records[n-1].TestType == rec.TestType {
+			records[n-1].Measurements = append(records[n-1].Measurements, m)
+			continue
+		}
+		rec.Measurements = []TestMeasurement{m}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// openTestFailureNCR raises an NCR for a unit that failed test, or returns
+// the open one the serial already has so repeated failures don't pile up.
+func openTestFailureNCR(rec TestIngestRecord, recordID int, failed []string, user, now string) (string, error) {
+	var ncrID string
+	err := db.QueryRow(`SELECT id FROM ncrs WHERE serial_number=? AND defect_type='test_failure' AND status IN ('open','investigating')
+		ORDER BY created_at DESC LIMIT 1`, rec.SerialNumber).Scan(&ncrID)
+	if err == nil {
+		return ncrID, nil
+	}
+	ncrID = nextID("NCR", "ncrs", 3)
+	title := fmt.Sprintf("Test failure: %s (%s %s test)", rec.SerialNumber, rec.IPN, rec.TestType)
+	desc := fmt.Sprintf("Test record #%d failed: %s", recordID, strings.Join(failed, ", "))
+	for _, m := range rec.Measurements {
+		if m.Result == "fail" {
+			desc += fmt.Sprintf("\n%s = %g %s (limits %s)", m.Name, m.Value, m.Unit, testLimitsText(m))
+		}
+	}
+	_, err = db.Exec(`INSERT INTO ncrs (id,title,description,ipn,serial_number,defect_type,severity,status,created_at) VALUES (?,?,?,?,?,?,?,?,?)`,
+		ncrID, title, desc, rec.IPN, rec.SerialNumber, "test_failure", "minor", "open", now)
+	if err != nil {
+		return "", err
+	}
+	logAudit(db, user, "created", "ncr", ncrID, fmt.Sprintf("Auto-created from failed test record #%d", recordID))
+	return ncrID, nil
+}
+
+// handleIngestTests records a batch of test results. JSON bodies carry
+// records with their measurements; a CSV body (or multipart "file") has one
+// measurement per row. Results are judged against the IPN's test specs and
+// each failing unit gets an NCR.
+func handleIngestTests(w http.ResponseWriter, r *http.Request) {
+	station := r.URL.Query().Get("station")
+	var records []TestIngestRecord
+	ct := r.Header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(ct, "multipart/form-data"):
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			jsonErr(w, "file required", 400)
+			return
+		}
+		defer file.Close()
+		if records, err = parseTestCSV(file, r.URL.Query().Get("test_type")); err != nil {
+			jsonErr(w, err.Error(), 400)
+			return
+		}
+	case strings.Contains(ct, "csv"):
+		var err error
+		if records, err = parseTestCSV(r.Body, r.URL.Query().Get("test_type")); err != nil {
+			jsonErr(w, err.Error(), 400)
+			return
+		}
+	default:
+		var body struct {
+			Station string             `json:"station"`
+			Records []TestIngestRecord `json:"records"`
+		}
+		if err := decodeBody(r, &body); err != nil {
+			jsonErr(w, "invalid body", 400)
+			return
+		}
+		records = body.Records
+		if body.Station != "" {
+			station = body.Station
+		}
+	}
+
+	if len(records) == 0 {
+		jsonErr(w, "no test records", 400)
+		return
+	}
+	if len(records) > maxTestIngestRecords {
+		jsonErr(w, fmt.Sprintf("at most %d records per batch", maxTestIngestRecords), 400)
+		return
+	}
+	ve := &ValidationErrors{}
+	for i := range records {
+		rec := &records[i]
+		field := fmt.Sprintf("records[%d].", i)
+		rec.SerialNumber, rec.IPN = strings.TrimSpace(rec.SerialNumber), strings.TrimSpace(rec.IPN)
+		requireField(ve, field+"serial_number", rec.SerialNumber)
+		requireField(ve, field+"ipn", rec.IPN)
+		if rec.TestType == "" {
+			rec.TestType = "factory"
+		}
+		validateEnum(ve, field+"test_type", rec.TestType, validTestTypes)
+		validateMaxLength(ve, field+"notes", rec.Notes, 10000)
+		if len(rec.Measurements) == 0 {
+			ve.Add(field+"measurements", "at least one measurement is required")
+		}
+		for j := range rec.Measurements {
+			m := &rec.Measurements[j]
+			m.Name = strings.TrimSpace(m.Name)
+			requireField(ve, fmt.Sprintf("%smeasurements[%d].name", field, j), m.Name)
+		}
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	user := getUsername(r)
+	testedBy := station
+	if testedBy == "" {
+		testedBy = user
+	}
+	now := time.Now().Format("2006-01-02 15:04:05")
+	results := make([]TestRecord, len(records))
+	failures := make([][]string, len(records))
+	for i := range records {
+		rec := &records[i]
+		specs, err := loadTestSpecs(rec.IPN, rec.TestType)
+		if err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		result, failed := judgeTestRecord(rec, specs)
+		summary := fmt.Sprintf("%d measurements", len(rec.Measurements))
+		if len(failed) > 0 {
+			summary += ", failed: " + strings.Join(failed, ", ")
+		}
+		if rec.TestedAt == "" {
+			rec.TestedAt = now
+		}
+		results[i] = TestRecord{SerialNumber: rec.SerialNumber, IPN: rec.IPN, FirmwareVersion: rec.FirmwareVersion, TestType: rec.TestType,
+			Result: result, Measurements: summary, Notes: rec.Notes, TestedBy: testedBy, TestedAt: rec.TestedAt}
+		failures[i] = failed
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+	for i := range records {
+		t := &results[i]
+		res, err := tx.Exec("INSERT INTO test_records (serial_number,ipn,firmware_version,test_type,result,measurements,notes,tested_by,tested_at) VALUES (?,?,?,?,?,?,?,?,?)",
+			t.SerialNumber, t.IPN, t.FirmwareVersion, t.TestType, t.Result, t.Measurements, t.Notes, t.TestedBy, t.TestedAt)
+		if err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		id, _ := res.LastInsertId()
+		t.ID = int(id)
+		for _, m := range records[i].Measurements {
+			res, err := tx.Exec(`INSERT INTO test_measurements (test_record_id,name,value,unit,low_limit,high_limit,spec_id,result,notes) VALUES (?,?,?,?,?,?,?,?,?)`,
+				t.ID, m.Name, m.Value, m.Unit, m.LowLimit, m.HighLimit, m.SpecID, m.Result, m.Notes)
+			if err != nil {
+				jsonErr(w, err.Error(), 500)
+				return
+			}
+			mid, _ := res.LastInsertId()
+			m.ID = int(mid)
+			t.Readings = append(t.Readings, m)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+
+	passed, failedCount := 0, 0
+	var ncrIDs []string
+	for i := range results {
+		t := &results[i]
+		if t.Result == "pass" {
+			passed++
+			continue
+		}
+		failedCount++
+		ncrID, err := openTestFailureNCR(records[i], t.ID, failures[i], user, now)
+		if err != nil {
+			jsonErr(w, "test records saved but NCR creation failed: "+err.Error(), 500)
+			return
+		}
+		db.Exec("UPDATE test_records SET ncr_id=? WHERE id=?", ncrID, t.ID)
+		t.NCRID = ncrID
+		ncrIDs = append(ncrIDs, ncrID)
+	}
+	checkSPCAfterIngest(results)
+	logAudit(db, user, "created", "test", "", fmt.Sprintf("Ingested %d test records: %d passed, %d failed", len(results), passed, failedCount))
+	if ncrIDs == nil {
+		ncrIDs = []string{}
+	}
+	jsonResp(w, map[string]interface{}{
+		"records": results,
+		"passed":  passed,
+		"failed":  failedCount,
+		"ncr_ids": ncrIDs,
+	})
+}
+
+// attachTestReadings adds the structured measurements and NCR of a record
+// taken through ingest.
+func attachTestReadings(t *TestRecord) {
+	db.QueryRow("SELECT COALESCE(ncr_id,'') FROM test_records WHERE id=?", t.ID).Scan(&t.NCRID)
+	rows, err := db.Query(`SELECT id, name, value, COALESCE(unit,''), low_limit, high_limit, spec_id, result, COALESCE(notes,'')
+		FROM test_measurements WHERE test_record_id=? ORDER BY id`, t.ID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m TestMeasurement
+		var lo, hi sql.NullFloat64
+		var specID sql.NullInt64
+		rows.Scan(&m.ID, &m.Name, &m.Value, &m.Unit, &lo, &hi, &specID, &m.Result, &m.Notes)
+		if lo.Valid {
+			m.LowLimit = &lo.Float64
+		}
+		if hi.Valid {
+			m.HighLimit = &hi.Float64
+		}
+		if specID.Valid {
+			id := int(specID.Int64)
+			m.SpecID = &id
+		}
+		t.Readings = append(t.Readings, m)
+	}
+}
+
+// ── Test specs ──
+
+func validateTestSpec(ve *ValidationErrors, s *TestSpec) {
+	s.IPN, s.Name = strings.TrimSpace(s.IPN), strings.TrimSpace(s.Name)
+	requireField(ve, "ipn", s.IPN)
+	requireField(ve, "name", s.Name)
+	validateMaxLength(ve, "name", s.Name, 255)
+	validateMaxLength(ve, "unit", s.Unit, 50)
+	if s.TestType != "" {
+		validateEnum(ve, "test_type", s.TestType, validTestTypes)
+	}
+	if s.LowLimit == nil && s.HighLimit == nil {
+		ve.Add("low_limit", "a low or high limit is required")
+	} else if s.LowLimit != nil && s.HighLimit != nil && *s.LowLimit > *s.HighLimit {
+		ve.Add("low_limit", "must not be above high_limit")
+	}
+}
+
+func handleListTestSpecs(w http.ResponseWriter, r *http.Request) {
+	query, args := "SELECT "+testSpecColumns+" FROM test_specs", []interface{}{}
+	if ipn := r.URL.Query().Get("ipn"); ipn != "" {
+		query += " WHERE ipn=?"
+		args = append(args, ipn)
+	}
+	rows, err := db.Query(query+" ORDER BY ipn, test_type, name", args...)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	specs := []TestSpec{}
+	for rows.Next() {
+		s, err := scanTestSpec(rows)
+		if err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		specs = append(specs, s)
+	}
+	jsonResp(w, specs)
+}
+
+func handleCreateTestSpec(w http.ResponseWriter, r *http.Request) {
+	s := TestSpec{Required: true}
+	if err := decodeBody(r, &s); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	ve := &ValidationErrors{}
+	validateTestSpec(ve, &s)
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+	now := time.Now().Format("2006-01-02 15:04:05")
+	res, err := db.Exec(`INSERT INTO test_specs (ipn,test_type,name,unit,low_limit,high_limit,required,created_at,updated_at) VALUES (?,?,?,?,?,?,?,?,?)`,
+		s.IPN, s.TestType, s.Name, s.Unit, s.LowLimit, s.HighLimit, s.Required, now, now)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			jsonErr(w, fmt.Sprintf("%s already has a %q spec for this test type", s.IPN, s.Name), 400)
+			return
+		}
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	id, _ := res.LastInsertId()
+	s.ID, s.CreatedAt, s.UpdatedAt = int(id), now, now
+	logAudit(db, getUsername(r), "created", "test_spec", strconv.Itoa(s.ID), fmt.Sprintf("Created %s spec %s %s", s.IPN, s.Name, testLimitsText(TestMeasurement{LowLimit: s.LowLimit, HighLimit: s.HighLimit})))
+	jsonResp(w, s)
+}
+
+func handleUpdateTestSpec(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		jsonErr(w, "invalid spec id", 400)
+		return
+	}
+	s, err := scanTestSpec(db.QueryRow("SELECT "+testSpecColumns+" FROM test_specs WHERE id=?", id))
+	if err != nil {
+		jsonErr(w, "test spec not found", 404)
+		return
+	}
+	// Limits are replaced as sent, so a limit can be removed with null
+	s.LowLimit, s.HighLimit = nil, nil
+	if err := decodeBody(r, &s); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	s.ID = id
+	ve := &ValidationErrors{}
+	validateTestSpec(ve, &s)
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+	s.UpdatedAt = time.Now().Format("2006-01-02 15:04:05")
+	_, err = db.Exec(`UPDATE test_specs SET ipn=?,test_type=?,name=?,unit=?,low_limit=?,high_limit=?,required=?,updated_at=? WHERE id=?`,
+		s.IPN, s.TestType, s.Name, s.Unit, s.LowLimit, s.HighLimit, s.Required, s.UpdatedAt, id)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			jsonErr(w, fmt.Sprintf("%s already has a %q spec for this test type", s.IPN, s.Name), 400)
+			return
+		}
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, getUsername(r), "updated", "test_spec", idStr, fmt.Sprintf("Updated %s spec %s %s", s.IPN, s.Name, testLimitsText(TestMeasurement{LowLimit: s.LowLimit, HighLimit: s.HighLimit})))
+	jsonResp(w, s)
+}
+
+func handleDeleteTestSpec(w http.ResponseWriter, r *http.Request, idStr string) {
+	res, err := db.Exec("DELETE FROM test_specs WHERE id=?", idStr)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		jsonErr(w, "test spec not found", 404)
+		return
+	}
+	logAudit(db, getUsername(r), "deleted", "test_spec", idStr, "Deleted test spec "+idStr)
+	jsonResp(w, map[string]string{"status": "deleted"})
+}
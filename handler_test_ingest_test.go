@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type ingestResp struct {
+	Data struct {
+		Records []TestRecord `json:"records"`
+		Passed  int          `json:"passed"`
+		Failed  int          `json:"failed"`
+		NCRIDs  []string     `json:"ncr_ids"`
+	} `json:"data"`
+}
+
+func postIngest(t *testing.T, contentType, url, body string) (*httptest.ResponseRecorder, ingestResp) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", url, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", contentType)
+	handleIngestTests(w, req)
+	var resp ingestResp
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp
+}
+
+func seedTestSpecs(t *testing.T) {
+	t.Helper()
+	specs := []string{
+		`{"ipn":"PCA-1","name":"VOUT","unit":"V","low_limit":3.2,"high_limit":3.4}`,
+		`{"ipn":"PCA-1","name":"IDLE_CURRENT","unit":"mA","high_limit":50}`,
+		// Final test is held to a tighter VOUT window
+		`{"ipn":"PCA-1","test_type":"final","name":"VOUT","unit":"V","low_limit":3.25,"high_limit":3.35}`,
+		`{"ipn":"PCA-1","name":"TEMP","unit":"C","high_limit":85,"required":false}`,
+	}
+	for _, s := range specs {
+		w := httptest.NewRecorder()
+		handleCreateTestSpec(w, httptest.NewRequest("POST", "/api/v1/test-specs", bytes.NewBufferString(s)))
+		if w.Code != 200 {
+			t.Fatalf("creating spec %s failed: %d %s", s, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestTestSpecValidation(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedTestSpecs(t)
+
+	bad := []string{
+		`{"ipn":"PCA-1","name":"NOLIMIT"}`,
+		`{"ipn":"PCA-1","name":"BACKWARDS","low_limit":5,"high_limit":1}`,
+		`{"name":"VOUT","high_limit":1}`,
+		`{"ipn":"PCA-1","test_type":"bench","name":"X","high_limit":1}`,
+		`{"ipn":"PCA-1","name":"VOUT","high_limit":1}`,
+	}
+	for _, b := range bad {
+		w := httptest.NewRecorder()
+		handleCreateTestSpec(w, httptest.NewRequest("POST", "/api/v1/test-specs", bytes.NewBufferString(b)))
+		if w.Code != 400 {
+			t.Errorf("%s: expected 400, got %d %s", b, w.Code, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handleListTestSpecs(w, httptest.NewRequest("GET", "/api/v1/test-specs?ipn=PCA-1", nil))
+	var list struct {
+		Data []TestSpec `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Data) != 4 {
+		t.Fatalf("expected 4 specs, got %d", len(list.Data))
+	}
+	id := strconv.Itoa(list.Data[0].ID)
+	w = httptest.NewRecorder()
+	handleUpdateTestSpec(w, httptest.NewRequest("PUT", "/api/v1/test-specs/"+id, bytes.NewBufferString(`{"high_limit":40}`)), id)
+	var upd struct {
+		Data TestSpec `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &upd)
+	if w.Code != 200 || upd.Data.Name != "IDLE_CURRENT" || *upd.Data.HighLimit != 40 {
+		t.Errorf("unexpected update: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestIngestJSONJudgesAgainstSpecs(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedTestSpecs(t)
+
+	body := `{"station":"ATE-3","records":[
+		{"serial_number":"SN-1","ipn":"PCA-1","measurements":[
+			{"name":"VOUT","value":3.31,"unit":"V","low_limit":0,"high_limit":99},
+			{"name":"idle_current","value":42,"unit":"mA"},
+			{"name":"RIPPLE","value":12,"unit":"mV","high_limit":20}]},
+		{"serial_number":"SN-2","ipn":"PCA-1","test_type":"final","measurements":[
+			{"name":"VOUT","value":3.38},
+			{"name":"IDLE_CURRENT","value":0.03,"unit":"A"}]},
+		{"serial_number":"SN-3","ipn":"PCA-1","measurements":[{"name":"VOUT","value":3.3}]}
+	]}`
+	w, resp := postIngest(t, "application/json", "/api/v1/tests/ingest", body)
+	if w.Code != 200 {
+		t.Fatalf("ingest failed: %d %s", w.Code, w.Body.String())
+	}
+	if resp.Data.Passed != 1 || resp.Data.Failed != 2 || len(resp.Data.NCRIDs) != 2 {
+		t.Fatalf("expected 1 pass, 2 fails with NCRs, got %s", w.Body.String())
+	}
+
+	sn1 := resp.Data.Records[0]
+	if sn1.Result != "pass" || sn1.TestedBy != "ATE-3" || len(sn1.Readings) != 3 {
+		t.Fatalf("unexpected SN-1 record: %+v", sn1)
+	}
+	// The spec's limits replace what the station sent
+	if v := sn1.Readings[0]; v.SpecID == nil || *v.LowLimit != 3.2 || *v.HighLimit != 3.4 || v.Result != "pass" {
+		t.Errorf("expected VOUT judged by spec, got %+v", v)
+	}
+	if v := sn1.Readings[2]; v.SpecID != nil || *v.HighLimit != 20 || v.Result != "pass" {
+		t.Errorf("expected RIPPLE judged by the station's limit, got %+v", v)
+	}
+
+	// Final test uses the tighter VOUT spec; a unit mismatch fails too
+	sn2 := resp.Data.Records[1]
+	if sn2.Result != "fail" || sn2.Readings[0].Result != "fail" || sn2.Readings[1].Result != "fail" || sn2.NCRID == "" {
+		t.Errorf("expected SN-2 to fail VOUT and IDLE_CURRENT, got %+v", sn2)
+	}
+	// A required measurement that wasn't sent fails the unit
+	sn3 := resp.Data.Records[2]
+	if sn3.Result != "fail" || !strings.Contains(sn3.Measurements, "IDLE_CURRENT (missing)") {
+		t.Errorf("expected SN-3 to fail for the missing IDLE_CURRENT, got %+v", sn3)
+	}
+
+	var ncr struct{ serial, ipn, defect, desc string }
+	db.QueryRow("SELECT serial_number, ipn, defect_type, description FROM ncrs WHERE id=?", sn2.NCRID).Scan(&ncr.serial, &ncr.ipn, &ncr.defect, &ncr.desc)
+	if ncr.serial != "SN-2" || ncr.ipn != "PCA-1" || ncr.defect != "test_failure" || !strings.Contains(ncr.desc, "VOUT = 3.38 V (limits 3.25..3.35)") {
+		t.Errorf("unexpected NCR: %+v", ncr)
+	}
+
+	// A repeat failure joins the open NCR rather than raising another
+	_, again := postIngest(t, "application/json", "/api/v1/tests/ingest",
+		`{"records":[{"serial_number":"SN-2","ipn":"PCA-1","test_type":"final","measurements":[{"name":"VOUT","value":3.5}]}]}`)
+	if len(again.Data.NCRIDs) != 1 || again.Data.NCRIDs[0] != sn2.NCRID {
+		t.Errorf("expected the retest to reuse %s, got %v", sn2.NCRID, again.Data.NCRIDs)
+	}
+
+	w = httptest.NewRecorder()
+	handleGetTestByID(w, httptest.NewRequest("GET", "/api/v1/tests/"+strconv.Itoa(sn2.ID), nil), strconv.Itoa(sn2.ID))
+	var got struct {
+		Data TestRecord `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &got)
+	if got.Data.NCRID != sn2.NCRID || len(got.Data.Readings) != 2 || got.Data.Readings[1].Notes == "" {
+		t.Errorf("expected stored readings and NCR on the record, got %+v", got.Data)
+	}
+}
+
+func TestIngestCSVAndValidation(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedTestSpecs(t)
+
+	csvBody := "SN,IPN,TEST_NUM,TEST_TXT,RESULT,UNITS,LO_LIMIT,HI_LIMIT\n" +
+		"SN-10,PCA-1,1,VOUT,3.3,V,,\n" +
+		"SN-10,PCA-1,2,IDLE_CURRENT,12,mA,,\n" +
+		"SN-11,PCA-1,1,VOUT,3.1,V,,\n" +
+		"SN-11,PCA-1,2,IDLE_CURRENT,12,mA,,\n"
+	w, resp := postIngest(t, "text/csv", "/api/v1/tests/ingest?station=ATE-1", csvBody)
+	if w.Code != 200 {
+		t.Fatalf("CSV ingest failed: %d %s", w.Code, w.Body.String())
+	}
+	if len(resp.Data.Records) != 2 || resp.Data.Passed != 1 || resp.Data.Failed != 1 || resp.Data.Records[1].SerialNumber != "SN-11" {
+		t.Errorf("expected SN-10 to pass and SN-11 to fail, got %s", w.Body.String())
+	}
+	if resp.Data.Records[0].TestType != "factory" || resp.Data.Records[0].TestedBy != "ATE-1" {
+		t.Errorf("unexpected defaults: %+v", resp.Data.Records[0])
+	}
+
+	bad := []struct{ name, ct, body string }{
+		{"empty batch", "application/json", `{"records":[]}`},
+		{"no serial", "application/json", `{"records":[{"ipn":"PCA-1","measurements":[{"name":"VOUT","value":1}]}]}`},
+		{"no measurements", "application/json", `{"records":[{"serial_number":"S","ipn":"PCA-1"}]}`},
+		{"bad test type", "application/json", `{"records":[{"serial_number":"S","ipn":"PCA-1","test_type":"bench","measurements":[{"name":"VOUT","value":1}]}]}`},
+		{"CSV missing value column", "text/csv", "serial_number,ipn,name\nS,PCA-1,VOUT\n"},
+		{"CSV bad number", "text/csv", "serial_number,ipn,name,value\nS,PCA-1,VOUT,abc\n"},
+	}
+	for _, tt := range bad {
+		if w, _ := postIngest(t, tt.ct, "/api/v1/tests/ingest", tt.body); w.Code != 400 {
+			t.Errorf("%s: expected 400, got %d %s", tt.name, w.Code, w.Body.String())
+		}
+	}
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM test_records").Scan(&n)
+	if n != 2 {
+		t.Errorf("expected only the 2 CSV records stored, got %d", n)
+	}
+}
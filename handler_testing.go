@@ -64,5 +64,6 @@ func handleGetTestByID(w http.ResponseWriter, r *http.Request, idStr string) {
 		handleGetTests(w, r, idStr)
 		return
 	}
+	attachTestReadings(&t)
 	jsonResp(w, t)
 }
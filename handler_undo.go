@@ -46,6 +46,8 @@ func snapshotEntity(entityType, entityID string) (string, error) {
 		data, err = getQuoteSnapshot(entityID)
 	case "po":
 		data, err = getPOSnapshot(entityID)
+	case "wo_completion":
+		data, err = getRowAsMap("SELECT * FROM wo_completions WHERE id=?", entityID)
 	default:
 		return "", fmt.Errorf("unsupported entity type: %s", entityType)
 	}
@@ -102,6 +104,9 @@ func performUndo(entry UndoLogEntry) error {
 		return restoreQuote(entry.PreviousData)
 	case "po":
 		return restorePO(entry.PreviousData)
+	case "wo_completion":
+		// Completion events are reversed rather than restored from the snapshot
+		return undoWOCompletion(entry)
 	default:
 		return fmt.Errorf("unsupported entity type: %s", entry.EntityType)
 	}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ChildWorkOrder is a WO building a stocked sub-assembly for its parent WO.
+type ChildWorkOrder struct {
+	ID          string `json:"id"`
+	AssemblyIPN string `json:"assembly_ipn"`
+	Qty         int    `json:"qty"`
+	QtyGood     int    `json:"qty_good"`
+	QtyScrap    int    `json:"qty_scrap"`
+	Status      string `json:"status"`
+	DueDate     string `json:"due_date"`
+}
+
+// ChildWOProposal is a sub-assembly shortage of a WO that no open child WO
+// covers yet.
+type ChildWOProposal struct {
+	IPN      string  `json:"ipn"`
+	Qty      int     `json:"qty"`
+	Shortage float64 `json:"shortage"`
+	Covered  float64 `json:"covered"`
+	DueDate  string  `json:"due_date"`
+	Notes    string  `json:"notes,omitempty"`
+}
+
+// WorkOrderSettings are the app-wide work order options.
+type WorkOrderSettings struct {
+	AutoCreateChildWOs bool `json:"auto_create_child_wos"`
+}
+
+const (
+	woAutoChildWOsKey = "wo_auto_create_child_wos"
+	maxChildWODepth   = 5
+)
+
+func woClosed(status string) bool {
+	return status == "completed" || status == "cancelled"
+}
+
+// woLeadTimeDays is how long it takes to build an assembly, from its MRP item
+// setting or the MRP default.
+func woLeadTimeDays(ipn string) int {
+	var lead sql.NullInt64
+	db.QueryRow("SELECT lead_time_days FROM mrp_item_settings WHERE ipn=?", ipn).Scan(&lead)
+	if lead.Valid {
+		return int(lead.Int64)
+	}
+	return mrpDefaultLeadTimeDays
+}
+
+func loadChildWorkOrders(parentID string) ([]ChildWorkOrder, error) {
+	rows, err := db.Query(`SELECT id, assembly_ipn, qty, COALESCE(qty_good,0), COALESCE(qty_scrap,0), status, COALESCE(due_date,'')
+		FROM work_orders WHERE parent_wo_id=? ORDER BY id`, parentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var children []ChildWorkOrder
+	for rows.Next() {
+		var c ChildWorkOrder
+		if err := rows.Scan(&c.ID, &c.AssemblyIPN, &c.Qty, &c.QtyGood, &c.QtyScrap, &c.Status, &c.DueDate); err != nil {
+			return nil, err
+		}
+		children = append(children, c)
+	}
+	return children, rows.Err()
+}
+
+// proposeChildWorkOrders nets the stocked sub-assemblies a WO still needs
+// against available stock and what its open child WOs will deliver. A child
+// is due when the parent has to start: the parent's due date less its lead
+// time, or the child's own lead time from today when the parent has no due
+// date.
+func proposeChildWorkOrders(woID string, today time.Time) ([]ChildWOProposal, error) {
+	var ipn, status, due string
+	var qty, good, scrap int
+	err := db.QueryRow("SELECT assembly_ipn, qty, COALESCE(qty_good,0), COALESCE(qty_scrap,0), status, COALESCE(due_date,'') FROM work_orders WHERE id=?", woID).
+		Scan(&ipn, &qty, &good, &scrap, &status, &due)
+	if err != nil {
+		return nil, err
+	}
+	remaining := qty - good - scrap
+	if woClosed(status) || remaining <= 0 {
+		return nil, nil
+	}
+	lines, err := explodeWorkOrderBOM(woID, ipn, remaining)
+	if err != nil {
+		return nil, err
+	}
+	children, err := loadChildWorkOrders(woID)
+	if err != nil {
+		return nil, err
+	}
+	covered := map[string]float64{}
+	for _, c := range children {
+		if !woClosed(c.Status) {
+			covered[c.AssemblyIPN] += float64(c.Qty - c.QtyGood - c.QtyScrap)
+		}
+	}
+
+	todayS := today.Format(mrpDateFormat)
+	var proposals []ChildWOProposal
+	for _, l := range lines {
+		if !l.SubAssembly || l.Shortage <= 0 {
+			continue
+		}
+		open := l.Shortage - covered[l.IPN]
+		if open <= 1e-9 {
+			continue
+		}
+		p := ChildWOProposal{IPN: l.IPN, Qty: int(math.Ceil(open - 1e-9)), Shortage: l.Shortage, Covered: covered[l.IPN]}
+		if len(due) >= 10 {
+			if d, err := time.ParseInLocation(mrpDateFormat, due[:10], today.Location()); err == nil {
+				lead := woLeadTimeDays(ipn)
+				p.DueDate = d.AddDate(0, 0, -lead).Format(mrpDateFormat)
+				if p.DueDate < todayS {
+					p.DueDate = todayS
+					p.Notes = fmt.Sprintf("Late: %s is due %s with a %d day lead time", woID, due[:10], lead)
+				}
+			}
+		}
+		if p.DueDate == "" {
+			p.DueDate = today.AddDate(0, 0, woLeadTimeDays(l.IPN)).Format(mrpDateFormat)
+		}
+		proposals = append(proposals, p)
+	}
+	return proposals, nil
+}
+
+// createChildWorkOrders turns a WO's proposals (all of them, or those for
+// ipns) into linked child WOs. Children of a draft parent are drafts too;
+// otherwise they are released straight away.
+func createChildWorkOrders(parentID string, ipns []string, user string, depth int) ([]ChildWorkOrder, error) {
+	var parentStatus, priority string
+	if err := db.QueryRow("SELECT status, priority FROM work_orders WHERE id=?", parentID).Scan(&parentStatus, &priority); err != nil {
+		return nil, err
+	}
+	proposals, err := proposeChildWorkOrders(parentID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	want := map[string]bool{}
+	for _, ipn := range ipns {
+		want[ipn] = true
+	}
+	status := "open"
+	if parentStatus == "draft" {
+		status = "draft"
+	}
+
+	var created []ChildWorkOrder
+	for _, p := range proposals {
+		if len(want) > 0 && !want[p.IPN] {
+			continue
+		}
+		id := nextID("WO", "work_orders", 4)
+		notes := "Sub-assembly for WO " + parentID
+		if p.Notes != "" {
+			notes += ". " + p.Notes
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return created, err
+		}
+		_, err = tx.Exec(`INSERT INTO work_orders (id,assembly_ipn,qty,status,priority,notes,due_date,parent_wo_id,created_at) VALUES (?,?,?,?,?,?,?,?,?)`,
+			id, p.IPN, p.Qty, status, priority, notes, p.DueDate, parentID, time.Now().Format("2006-01-02 15:04:05"))
+		if err == nil {
+			_, err = instantiateWorkOrderOperations(tx, id, p.IPN)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return created, err
+		}
+		logAudit(db, user, "created", "workorder", id, fmt.Sprintf("Created WO %s for %d x %s as child of WO %s", id, p.Qty, p.IPN, parentID))
+		created = append(created, ChildWorkOrder{ID: id, AssemblyIPN: p.IPN, Qty: p.Qty, Status: status, DueDate: p.DueDate})
+		autoCreateChildWorkOrders(id, user, depth+1)
+	}
+	return created, nil
+}
+
+// autoCreateChildWorkOrders runs when a WO is created or released. With the
+// work order setting on, short sub-assemblies get child WOs straight away,
+// and so do theirs; otherwise the shortages are only proposed on the WO.
+func autoCreateChildWorkOrders(woID, user string, depth int) {
+	if depth >= maxChildWODepth || getAppSetting(woAutoChildWOsKey) != "true" {
+		return
+	}
+	if _, err := createChildWorkOrders(woID, nil, user, depth); err != nil {
+		log.Printf("creating child work orders for %s: %v", woID, err)
+	}
+}
+
+// childWOStartBlock says why a WO can't start yet: child WOs that haven't
+// completed. An override recorded on the WO lifts the block.
+func childWOStartBlock(woID string) string {
+	var override int
+	db.QueryRow("SELECT COALESCE(child_wo_override,0) FROM work_orders WHERE id=?", woID).Scan(&override)
+	if override != 0 {
+		return ""
+	}
+	children, _ := loadChildWorkOrders(woID)
+	var open []string
+	for _, c := range children {
+		if !woClosed(c.Status) {
+			open = append(open, c.ID+" ("+c.Status+")")
+		}
+	}
+	if len(open) == 0 {
+		return ""
+	}
+	return "waiting on child work orders " + strings.Join(open, ", ") + "; set override_child_wos to start anyway"
+}
+
+// attachChildWorkOrders fills in a WO's parent link, its child WOs and,
+// until it starts, the sub-assembly shortages still to cover.
+func attachChildWorkOrders(wo *WorkOrder) {
+	var override int
+	err := db.QueryRow("SELECT COALESCE(due_date,''), COALESCE(parent_wo_id,''), COALESCE(child_wo_override,0) FROM work_orders WHERE id=?", wo.ID).
+		Scan(&wo.DueDate, &wo.ParentWOID, &override)
+	if err != nil {
+		return
+	}
+	wo.OverrideChildWOs = override != 0
+	wo.ChildWOs, _ = loadChildWorkOrders(wo.ID)
+	if wo.Status == "draft" || wo.Status == "open" || wo.Status == "on_hold" {
+		wo.ChildWOProposals, _ = proposeChildWorkOrders(wo.ID, time.Now())
+	}
+}
+
+func handleListChildWorkOrders(w http.ResponseWriter, r *http.Request, id string) {
+	var status string
+	if err := db.QueryRow("SELECT status FROM work_orders WHERE id=?", id).Scan(&status); err != nil {
+		jsonErr(w, "work order not found", 404)
+		return
+	}
+	children, err := loadChildWorkOrders(id)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	proposals, err := proposeChildWorkOrders(id, time.Now())
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if children == nil {
+		children = []ChildWorkOrder{}
+	}
+	if proposals == nil {
+		proposals = []ChildWOProposal{}
+	}
+	jsonResp(w, map[string]interface{}{
+		"wo_id":       id,
+		"child_wos":   children,
+		"proposals":   proposals,
+		"start_block": childWOStartBlock(id),
+	})
+}
+
+// handleCreateChildWorkOrders accepts a WO's proposals, optionally only those
+// for the given sub-assembly IPNs.
+func handleCreateChildWorkOrders(w http.ResponseWriter, r *http.Request, id string) {
+	var body struct {
+		IPNs []string `json:"ipns"`
+	}
+	if r.ContentLength != 0 {
+		if err := decodeBody(r, &body); err != nil {
+			jsonErr(w, "invalid body", 400)
+			return
+		}
+	}
+	var status string
+	if err := db.QueryRow("SELECT status FROM work_orders WHERE id=?", id).Scan(&status); err != nil {
+		jsonErr(w, "work order not found", 404)
+		return
+	}
+	if woClosed(status) {
+		jsonErr(w, "work order is "+status, 400)
+		return
+	}
+	created, err := createChildWorkOrders(id, body.IPNs, getUsername(r), 0)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if len(created) == 0 {
+		jsonErr(w, "no sub-assembly shortages to cover", 400)
+		return
+	}
+	jsonResp(w, map[string]interface{}{"wo_id": id, "created": created})
+}
+
+func handleGetWorkOrderSettings(w http.ResponseWriter, r *http.Request) {
+	jsonResp(w, WorkOrderSettings{AutoCreateChildWOs: getAppSetting(woAutoChildWOsKey) == "true"})
+}
+
+func handlePutWorkOrderSettings(w http.ResponseWriter, r *http.Request) {
+	var s WorkOrderSettings
+	if err := decodeBody(r, &s); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	if err := setAppSetting(woAutoChildWOsKey, fmt.Sprint(s.AutoCreateChildWOs)); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, getUsername(r), "updated", "settings", "work-orders", fmt.Sprintf("Set automatic child WOs to %v", s.AutoCreateChildWOs))
+	jsonResp(w, s)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedChildWOBOM builds ASY-1 from 2 x PCA-1, and PCA-1 from 4 x PCA-2.
+// PCA-1 and PCA-2 are stocked sub-assemblies; there are 3 PCA-1 on hand.
+func seedChildWOBOM(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	partsDir = dir
+	createBOMFile(t, dir, "ASY-1", [][]string{{"IPN", "Qty"}, {"PCA-1", "2"}, {"RES-1", "1"}})
+	createBOMFile(t, dir, "PCA-1", [][]string{{"IPN", "Qty"}, {"PCA-2", "4"}})
+	createBOMFile(t, dir, "PCA-2", [][]string{{"IPN", "Qty"}, {"RES-1", "1"}})
+	db.Exec(`INSERT INTO inventory (ipn, qty_on_hand) VALUES ('PCA-1', 3), ('PCA-2', 0), ('RES-1', 1000)`)
+	db.Exec(`INSERT INTO mrp_item_settings (ipn, lead_time_days) VALUES ('ASY-1', 3), ('PCA-1', 5)`)
+}
+
+func createTestWO(t *testing.T, body string) WorkOrder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleCreateWorkOrder(w, httptest.NewRequest("POST", "/api/v1/workorders", bytes.NewBufferString(body)))
+	if w.Code != 200 {
+		t.Fatalf("create WO failed: %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Data WorkOrder `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp.Data
+}
+
+func putTestWO(t *testing.T, id, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleUpdateWorkOrder(w, httptest.NewRequest("PUT", "/api/v1/workorders/"+id, bytes.NewBufferString(body)), id)
+	return w
+}
+
+func TestChildWOProposalsAndStartBlock(t *testing.T) {
+	oldDB, oldPartsDir := db, partsDir
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB; partsDir = oldPartsDir }()
+	seedChildWOBOM(t)
+
+	today := time.Now()
+	due := today.AddDate(0, 0, 14).Format("2006-01-02")
+	parent := createTestWO(t, `{"assembly_ipn":"ASY-1","qty":5,"status":"open","due_date":"`+due+`"}`)
+	if len(parent.ChildWOs) != 0 || len(parent.ChildWOProposals) != 1 {
+		t.Fatalf("expected one proposal and no children, got %+v", parent)
+	}
+	p := parent.ChildWOProposals[0]
+	// 10 PCA-1 needed, 3 on hand; due when ASY-1 has to start
+	wantDue := today.AddDate(0, 0, 11).Format("2006-01-02")
+	if p.IPN != "PCA-1" || p.Qty != 7 || p.DueDate != wantDue {
+		t.Errorf("expected 7 x PCA-1 due %s, got %+v", wantDue, p)
+	}
+
+	w := httptest.NewRecorder()
+	handleCreateChildWorkOrders(w, httptest.NewRequest("POST", "/api/v1/workorders/"+parent.ID+"/children", nil), parent.ID)
+	if w.Code != 200 {
+		t.Fatalf("creating children failed: %d %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		Data struct {
+			Created []ChildWorkOrder `json:"created"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if len(created.Data.Created) != 1 {
+		t.Fatalf("expected one child WO, got %s", w.Body.String())
+	}
+	child := created.Data.Created[0]
+	if child.AssemblyIPN != "PCA-1" || child.Qty != 7 || child.Status != "open" || child.DueDate != wantDue {
+		t.Errorf("unexpected child WO: %+v", child)
+	}
+	// Without automatic creation the child's own shortage is only proposed
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM work_orders WHERE assembly_ipn='PCA-2'").Scan(&n)
+	if n != 0 {
+		t.Errorf("expected no PCA-2 WO, got %d", n)
+	}
+
+	w = httptest.NewRecorder()
+	handleGetWorkOrder(w, httptest.NewRequest("GET", "/api/v1/workorders/"+parent.ID, nil), parent.ID)
+	var got struct {
+		Data WorkOrder `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &got)
+	if len(got.Data.ChildWOs) != 1 || got.Data.ChildWOs[0].Status != "open" || len(got.Data.ChildWOProposals) != 0 || got.Data.DueDate != due {
+		t.Errorf("expected parent to show the open child and nothing left to propose, got %+v", got.Data)
+	}
+	w = httptest.NewRecorder()
+	handleGetWorkOrder(w, httptest.NewRequest("GET", "/api/v1/workorders/"+child.ID, nil), child.ID)
+	got.Data = WorkOrder{}
+	json.Unmarshal(w.Body.Bytes(), &got)
+	if got.Data.ParentWOID != parent.ID || len(got.Data.ChildWOProposals) != 1 || got.Data.ChildWOProposals[0].Qty != 28 {
+		t.Errorf("expected child linked to parent proposing 28 x PCA-2, got %+v", got.Data)
+	}
+	w = httptest.NewRecorder()
+	handleCreateChildWorkOrders(w, httptest.NewRequest("POST", "/api/v1/workorders/"+parent.ID+"/children", nil), parent.ID)
+	if w.Code != 400 {
+		t.Errorf("expected 400 with nothing left to cover, got %d", w.Code)
+	}
+
+	// The parent can't start until the child completes
+	start := `{"assembly_ipn":"ASY-1","qty":5,"status":"in_progress","priority":"normal"}`
+	if w := putTestWO(t, parent.ID, start); w.Code != 400 || !strings.Contains(w.Body.String(), child.ID) {
+		t.Errorf("expected start to be blocked by %s, got %d %s", child.ID, w.Code, w.Body.String())
+	}
+	if w, _ := postWOEventFor(t, parent.ID, `{"qty":1}`); w.Code != 400 {
+		t.Errorf("expected completions on the waiting parent to be blocked, got %d", w.Code)
+	}
+	db.Exec("UPDATE work_orders SET status='completed' WHERE id=?", child.ID)
+	if w := putTestWO(t, parent.ID, start); w.Code != 200 {
+		t.Errorf("expected start once the child completed, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func postWOEventFor(t *testing.T, woID, body string) (*httptest.ResponseRecorder, woEventResp) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleCompleteWorkOrderUnits(w, httptest.NewRequest("POST", "/api/v1/workorders/"+woID+"/completions", bytes.NewBufferString(body)), woID)
+	var resp woEventResp
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp
+}
+
+func TestChildWOAutoCreateAndOverride(t *testing.T) {
+	oldDB, oldPartsDir := db, partsDir
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB; partsDir = oldPartsDir }()
+	seedChildWOBOM(t)
+
+	w := httptest.NewRecorder()
+	handlePutWorkOrderSettings(w, httptest.NewRequest("PUT", "/api/v1/settings/work-orders", bytes.NewBufferString(`{"auto_create_child_wos":true}`)))
+	if w.Code != 200 || getAppSetting(woAutoChildWOsKey) != "true" {
+		t.Fatalf("enabling automatic child WOs failed: %d %s", w.Code, w.Body.String())
+	}
+
+	// A draft parent gets draft children; nothing more until release
+	parent := createTestWO(t, `{"assembly_ipn":"ASY-1","qty":2,"status":"draft"}`)
+	if len(parent.ChildWOs) != 1 || parent.ChildWOs[0].Status != "draft" || parent.ChildWOs[0].Qty != 1 {
+		t.Fatalf("expected a draft child for 1 x PCA-1, got %+v", parent.ChildWOs)
+	}
+	pca := parent.ChildWOs[0].ID
+	var subWO string
+	var subQty int
+	db.QueryRow("SELECT id, qty FROM work_orders WHERE parent_wo_id=?", pca).Scan(&subWO, &subQty)
+	if subWO == "" || subQty != 4 {
+		t.Errorf("expected the PCA-1 child to get a 4 x PCA-2 child of its own, got %q %d", subWO, subQty)
+	}
+
+	// Releasing covers only what is still short
+	db.Exec("UPDATE inventory SET qty_on_hand = 0 WHERE ipn='PCA-1'")
+	if w := putTestWO(t, parent.ID, `{"assembly_ipn":"ASY-1","qty":2,"status":"open","priority":"normal"}`); w.Code != 200 {
+		t.Fatalf("release failed: %d %s", w.Code, w.Body.String())
+	}
+	children, _ := loadChildWorkOrders(parent.ID)
+	if len(children) != 2 || children[1].Qty != 3 || children[1].Status != "open" {
+		t.Errorf("expected a second child for the 3 PCA-1 now short, got %+v", children)
+	}
+
+	start := `{"assembly_ipn":"ASY-1","qty":2,"status":"in_progress","priority":"normal"}`
+	if w := putTestWO(t, parent.ID, start); w.Code != 400 {
+		t.Errorf("expected start to be blocked, got %d", w.Code)
+	}
+	override := `{"assembly_ipn":"ASY-1","qty":2,"status":"in_progress","priority":"normal","override_child_wos":true}`
+	if w := putTestWO(t, parent.ID, override); w.Code != 200 {
+		t.Fatalf("expected override to start the parent, got %d %s", w.Code, w.Body.String())
+	}
+	if childWOStartBlock(parent.ID) != "" {
+		t.Error("expected the override to be kept on the WO")
+	}
+}
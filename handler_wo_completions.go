@@ -0,0 +1,591 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WOCompletion is one partial completion or scrap event on a work order.
+// Completions receive good units into a new lot; both kinds backflush the
+// components of the units they cover. The inventory transactions an event
+// wrote are the ones with IDs from FirstTxnID to LastTxnID.
+type WOCompletion struct {
+	ID           int                    `json:"id"`
+	WOID         string                 `json:"wo_id"`
+	EventType    string                 `json:"event_type"`
+	Qty          int                    `json:"qty"`
+	ReasonCode   string                 `json:"reason_code"`
+	Notes        string                 `json:"notes"`
+	OutputLotID  *int                   `json:"output_lot_id"`
+	ClosedWO     bool                   `json:"closed_wo"`
+	CreatedBy    string                 `json:"created_by"`
+	CreatedAt    string                 `json:"created_at"`
+	ReversedAt   *string                `json:"reversed_at"`
+	ReversedBy   string                 `json:"reversed_by"`
+	Transactions []InventoryTransaction `json:"transactions"`
+}
+
+// woReservationChanges records what an event did to the WO's reservations so
+// undoing it can put them back.
+type woReservationChanges struct {
+	Consumed map[string]float64 `json:"consumed"`
+	Released map[string]float64 `json:"released"`
+	Staged   map[string]float64 `json:"staged,omitempty"`
+}
+
+type ScrapReason struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+	Active      bool   `json:"active"`
+}
+
+var defaultScrapReasons = []ScrapReason{
+	{Code: "DAMAGED", Description: "Damaged in handling"},
+	{Code: "SOLDER", Description: "Solder defect"},
+	{Code: "COMPONENT", Description: "Defective component"},
+	{Code: "TEST_FAIL", Description: "Failed test"},
+	{Code: "OPERATOR", Description: "Operator error"},
+	{Code: "OTHER", Description: "Other"},
+}
+
+const woCompletionColumns = `id, wo_id, event_type, qty, COALESCE(reason_code,''), COALESCE(notes,''), output_lot_id, closed_wo,
+	first_txn_id, last_txn_id, COALESCE(reservation_changes,'{}'), COALESCE(created_by,''), created_at, reversed_at, COALESCE(reversed_by,'')`
+
+// woCompletionRow is a WOCompletion with the bookkeeping columns undo needs.
+type woCompletionRow struct {
+	WOCompletion
+	FirstTxnID, LastTxnID int
+	Changes               woReservationChanges
+}
+
+func scanWOCompletion(row interface{ Scan(...interface{}) error }) (woCompletionRow, error) {
+	var e woCompletionRow
+	var lotID sql.NullInt64
+	var ra sql.NullString
+	var changes string
+	err := row.Scan(&e.ID, &e.WOID, &e.EventType, &e.Qty, &e.ReasonCode, &e.Notes, &lotID, &e.ClosedWO,
+		&e.FirstTxnID, &e.LastTxnID, &changes, &e.CreatedBy, &e.CreatedAt, &ra, &e.ReversedBy)
+	if lotID.Valid {
+		v := int(lotID.Int64)
+		e.OutputLotID = &v
+	}
+	e.ReversedAt = sp(ra)
+	json.Unmarshal([]byte(changes), &e.Changes)
+	return e, err
+}
+
+// woEventTransactions loads the inventory transactions an event wrote.
+func woEventTransactions(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, e woCompletionRow) ([]InventoryTransaction, error) {
+	rows, err := q.Query(`SELECT id, ipn, type, qty, COALESCE(reference,''), COALESCE(notes,''), created_at, lot_id
+		FROM inventory_transactions WHERE id BETWEEN ? AND ? AND reference = ? ORDER BY id`, e.FirstTxnID, e.LastTxnID, e.WOID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	txns := []InventoryTransaction{}
+	for rows.Next() {
+		var t InventoryTransaction
+		var lotID sql.NullInt64
+		if err := rows.Scan(&t.ID, &t.IPN, &t.Type, &t.Qty, &t.Reference, &t.Notes, &t.CreatedAt, &lotID); err != nil {
+			return nil, err
+		}
+		if lotID.Valid {
+			v := int(lotID.Int64)
+			t.LotID = &v
+		}
+		txns = append(txns, t)
+	}
+	return txns, rows.Err()
+}
+
+func handleListWOCompletions(w http.ResponseWriter, r *http.Request, woID string) {
+	rows, err := db.Query("SELECT "+woCompletionColumns+" FROM wo_completions WHERE wo_id=? ORDER BY id", woID)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	var events []woCompletionRow
+	for rows.Next() {
+		e, err := scanWOCompletion(rows)
+		if err != nil {
+			rows.Close()
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+
+	items := []WOCompletion{}
+	for _, e := range events {
+		if e.Transactions, err = woEventTransactions(db, e); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		items = append(items, e.WOCompletion)
+	}
+	jsonResp(w, items)
+}
+
+func handleCompleteWorkOrderUnits(w http.ResponseWriter, r *http.Request, woID string) {
+	recordWOEvent(w, r, woID, "complete")
+}
+
+func handleScrapWorkOrderUnits(w http.ResponseWriter, r *http.Request, woID string) {
+	recordWOEvent(w, r, woID, "scrap")
+}
+
+// recordWOEvent completes or scraps qty units of a work order. Components are
+// backflushed per BOM quantity for every unit, drawing the WO's reservation
+// down first. Good units are received into a lot of their own. Once good plus
+// scrap reaches the ordered qty the WO is completed and whatever is still
+// reserved for it is released.
+func recordWOEvent(w http.ResponseWriter, r *http.Request, woID, eventType string) {
+	var body struct {
+		Qty        int    `json:"qty"`
+		ReasonCode string `json:"reason_code"`
+		Notes      string `json:"notes"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+
+	var assemblyIPN, status string
+	var ordered, good, scrap int
+	err := db.QueryRow("SELECT assembly_ipn, qty, COALESCE(qty_good,0), COALESCE(qty_scrap,0), status FROM work_orders WHERE id=?", woID).
+		Scan(&assemblyIPN, &ordered, &good, &scrap, &status)
+	if err != nil {
+		jsonErr(w, "work order not found", 404)
+		return
+	}
+	if status != "open" && status != "in_progress" {
+		jsonErr(w, "work order is "+status, 400)
+		return
+	}
+	if ncrID := reworkNCRID(woID); ncrID != "" {
+		jsonErr(w, "rework orders for "+ncrID+" are completed by closing the work order", 400)
+		return
+	}
+	if status == "open" {
+		if msg := childWOStartBlock(woID); msg != "" {
+			jsonErr(w, msg, 400)
+			return
+		}
+	}
+
+	ve := &ValidationErrors{}
+	remaining := ordered - good - scrap
+	if body.Qty <= 0 {
+		ve.Add("qty", "must be positive")
+	} else if body.Qty > remaining {
+		ve.Add("qty", fmt.Sprintf("only %d of %d units remain open", remaining, ordered))
+	}
+	body.ReasonCode = strings.ToUpper(strings.TrimSpace(body.ReasonCode))
+	if eventType == "scrap" {
+		requireField(ve, "reason_code", body.ReasonCode)
+		if body.ReasonCode != "" {
+			var active bool
+			if db.QueryRow("SELECT active FROM scrap_reasons WHERE code=?", body.ReasonCode).Scan(&active) != nil || !active {
+				ve.Add("reason_code", "unknown or inactive scrap reason "+body.ReasonCode)
+			}
+		}
+	} else if body.ReasonCode != "" {
+		ve.Add("reason_code", "only allowed for scrap")
+	}
+	validateMaxLength(ve, "notes", body.Notes, 10000)
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	bom, err := explodeWorkOrderBOM(woID, assemblyIPN, body.Qty)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	// Material picked to the WO's staging location is used before stock.
+	// The rest comes out of the WO's own reservation and then free stock,
+	// never stock reserved for other WOs and sales orders.
+	_, staged := woPickTotals(woID)
+	for _, line := range bom {
+		need := line.QtyRequired - staged[line.IPN]
+		if need > line.QtyAvailable+1e-9 {
+			ve.Add("qty", fmt.Sprintf("not enough %s available to backflush (need %g, have %g)", line.IPN, need, line.QtyAvailable))
+		}
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	username := getUsername(r)
+	now := time.Now().Format("2006-01-02 15:04:05")
+	note := fmt.Sprintf("WO %s backflush for %d good", woID, body.Qty)
+	if eventType == "scrap" {
+		note = fmt.Sprintf("WO %s backflush for %d scrapped", woID, body.Qty)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+
+	var firstTxn int
+	tx.QueryRow("SELECT COALESCE(MAX(id),0) + 1 FROM inventory_transactions").Scan(&firstTxn)
+	costMark := costIssueMark(tx)
+	changes := woReservationChanges{Consumed: map[string]float64{}, Released: map[string]float64{}, Staged: map[string]float64{}}
+	customer := workOrderCustomer(tx, woID)
+
+	for _, line := range bom {
+		if line.QtyRequired <= 0 {
+			continue
+		}
+		fromStock := line.QtyRequired
+		if staged[line.IPN] > 0 {
+			used, err := consumeStaged(tx, woID, line.IPN, line.QtyRequired)
+			if err != nil {
+				jsonErr(w, err.Error(), 500)
+				return
+			}
+			if used > 0 {
+				changes.Staged[line.IPN] = used
+			}
+			fromStock -= used
+		}
+		if fromStock <= 1e-9 {
+			continue
+		}
+		consumed, err := consumeReservation(tx, "work_order", woID, line.IPN, fromStock)
+		if err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		if consumed > 0 {
+			changes.Consumed[line.IPN] = consumed
+		}
+		if err := checkUsableStock(tx, line.IPN, fromStock, time.Now()); err != nil {
+			jsonErr(w, err.Error(), 400)
+			return
+		}
+		if _, err := tx.Exec("UPDATE inventory SET qty_on_hand = qty_on_hand - ?, updated_at = ? WHERE ipn = ?", fromStock, now, line.IPN); err != nil {
+			jsonErr(w, fmt.Sprintf("failed to backflush %s: %v", line.IPN, err), 500)
+			return
+		}
+		if err := takeOwnedStock(tx, line.IPN, fromStock, customer, woID, note, username, now); err != nil {
+			jsonErr(w, err.Error(), 400)
+			return
+		}
+		if _, err := issueFromLots(tx, line.IPN, fromStock, nil, "issue", woID, note, now); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+	}
+
+	var outputLot *int
+	if eventType == "complete" {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO inventory (ipn, description) VALUES (?, ?)", assemblyIPN, "Assembled "+assemblyIPN); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		if _, err := tx.Exec("UPDATE inventory SET qty_on_hand = qty_on_hand + ?, updated_at = ? WHERE ipn = ?", body.Qty, now, assemblyIPN); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		lotID, err := createLot(tx, InventoryLot{IPN: assemblyIPN, WOID: woID, QtyReceived: float64(body.Qty),
+			QtyOnHand: float64(body.Qty), ReceivedAt: &now, Notes: body.Notes}, woID)
+		if err == nil {
+			err = recordLotTransaction(tx, lotID, assemblyIPN, "receive", float64(body.Qty), woID,
+				fmt.Sprintf("WO %s partial completion: %d good", woID, body.Qty), now)
+		}
+		if err == nil {
+			err = capitalizeWO(tx, woID, assemblyIPN, float64(body.Qty), costMark, good+body.Qty+scrap >= ordered, now)
+		}
+		if err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		outputLot = &lotID
+		good += body.Qty
+	} else {
+		scrapNote := fmt.Sprintf("WO %s scrapped %d: %s", woID, body.Qty, body.ReasonCode)
+		if body.Notes != "" {
+			scrapNote += " - " + body.Notes
+		}
+		if _, err := tx.Exec("INSERT INTO inventory_transactions (ipn,type,qty,reference,notes,created_at) VALUES (?,?,?,?,?,?)",
+			assemblyIPN, "scrap", body.Qty, woID, scrapNote, now); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		scrap += body.Qty
+	}
+
+	var lastTxn int
+	tx.QueryRow("SELECT COALESCE(MAX(id),0) FROM inventory_transactions").Scan(&lastTxn)
+
+	closed := good+scrap >= ordered
+	newStatus := "in_progress"
+	if closed {
+		newStatus = "completed"
+		if changes.Released, err = openReservationsFor(tx, "work_order", woID); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		if err := releaseReservations(tx, "work_order", woID); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		if err := clockOutWorkOrder(tx, woID, time.Now()); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+	}
+	_, err = tx.Exec(`UPDATE work_orders SET qty_good=?, qty_scrap=?, status=?, started_at=COALESCE(started_at, ?),
+		completed_at=CASE WHEN ?='completed' THEN ? ELSE completed_at END WHERE id=?`,
+		good, scrap, newStatus, now, newStatus, now, woID)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+
+	changesJSON, _ := json.Marshal(changes)
+	res, err := tx.Exec(`INSERT INTO wo_completions (wo_id, event_type, qty, reason_code, notes, output_lot_id, closed_wo,
+		first_txn_id, last_txn_id, reservation_changes, created_by, created_at) VALUES (?,?,?,?,?,?,?,?,?,?,?,?)`,
+		woID, eventType, body.Qty, body.ReasonCode, body.Notes, outputLot, closed, firstTxn, lastTxn, string(changesJSON), username, now)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	eventID, _ := res.LastInsertId()
+
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+
+	undoID, _ := createUndoEntry(username, eventType, "wo_completion", strconv.FormatInt(eventID, 10))
+	summary := fmt.Sprintf("WO %s: %d good", woID, body.Qty)
+	if eventType == "scrap" {
+		summary = fmt.Sprintf("WO %s: %d scrapped (%s)", woID, body.Qty, body.ReasonCode)
+	}
+	logAudit(db, username, eventType, "workorder", woID, summary)
+	if closed {
+		logAudit(db, username, "completed", "workorder", woID, fmt.Sprintf("WO %s completed: %d good, %d scrap", woID, good, scrap))
+	}
+
+	e, err := scanWOCompletion(db.QueryRow("SELECT "+woCompletionColumns+" FROM wo_completions WHERE id=?", eventID))
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	e.Transactions, _ = woEventTransactions(db, e)
+	jsonResp(w, map[string]interface{}{
+		"event":     e.WOCompletion,
+		"wo_status": newStatus,
+		"qty_good":  good,
+		"qty_scrap": scrap,
+		"undo_id":   undoID,
+	})
+}
+
+// undoWOCompletion reverses the most recent event of a work order. Each of
+// its inventory transactions gets a mirror entry with the qty negated, lots
+// and stock are put back, the WO's reservations are restored and a WO the
+// event closed is reopened. Finished goods that have already left their lot
+// can't be taken back.
+func undoWOCompletion(entry UndoLogEntry) error {
+	id, err := strconv.Atoi(entry.EntityID)
+	if err != nil {
+		return fmt.Errorf("invalid completion id %s", entry.EntityID)
+	}
+	e, err := scanWOCompletion(db.QueryRow("SELECT "+woCompletionColumns+" FROM wo_completions WHERE id=?", id))
+	if err != nil {
+		return fmt.Errorf("completion %d not found", id)
+	}
+	if e.ReversedAt != nil {
+		return fmt.Errorf("completion %d was already undone", id)
+	}
+	var latest int
+	db.QueryRow("SELECT MAX(id) FROM wo_completions WHERE wo_id=? AND reversed_at IS NULL", e.WOID).Scan(&latest)
+	if latest != id {
+		return fmt.Errorf("only the latest completion on WO %s can be undone", e.WOID)
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	txns, err := woEventTransactions(tx, e)
+	if err != nil {
+		return err
+	}
+	for _, t := range txns {
+		sign := 0.0
+		switch t.Type {
+		case "receive":
+			sign = -1
+		case "issue":
+			sign = 1
+		}
+		if t.LotID != nil && sign != 0 {
+			var onHand float64
+			tx.QueryRow("SELECT qty_on_hand FROM inventory_lots WHERE id=?", *t.LotID).Scan(&onHand)
+			if sign < 0 && onHand < t.Qty {
+				return fmt.Errorf("%s from this completion has already been used", t.IPN)
+			}
+			_, err := tx.Exec(`UPDATE inventory_lots SET qty_on_hand = qty_on_hand + ?,
+				status = CASE WHEN qty_on_hand + ? <= 0 THEN 'depleted' WHEN status = 'depleted' THEN 'available' ELSE status END
+				WHERE id = ?`, sign*t.Qty, sign*t.Qty, *t.LotID)
+			if err != nil {
+				return fmt.Errorf("failed to restore lot %d: %w", *t.LotID, err)
+			}
+		}
+		if sign != 0 {
+			if _, err := tx.Exec("UPDATE inventory SET qty_on_hand = qty_on_hand + ?, updated_at = ? WHERE ipn = ?", sign*t.Qty, now, t.IPN); err != nil {
+				return fmt.Errorf("not enough %s on hand to undo: %w", t.IPN, err)
+			}
+			if err := fitLocatedStock(tx, t.IPN); err != nil {
+				return err
+			}
+			if sign > 0 {
+				if err := returnOwnedStock(tx, t.IPN, t.Qty, e.WOID, "Undo: "+t.Notes, entry.UserID, now); err != nil {
+					return err
+				}
+			}
+			if err := syncCostLayers(tx, t.IPN, "reversal", e.WOID, 0, now); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec("INSERT INTO inventory_transactions (ipn,type,qty,reference,notes,created_at,lot_id) VALUES (?,?,?,?,?,?,?)",
+			t.IPN, t.Type, -t.Qty, t.Reference, "Undo: "+t.Notes, now, t.LotID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, m := range []map[string]float64{e.Changes.Consumed, e.Changes.Released} {
+		for ipn, qty := range m {
+			if err := reserveInventory(tx, "work_order", e.WOID, ipn, qty, entry.UserID); err != nil {
+				return err
+			}
+		}
+	}
+	for ipn, qty := range e.Changes.Staged {
+		if err := unconsumeStaged(tx, e.WOID, ipn, qty); err != nil {
+			return err
+		}
+	}
+
+	col := "qty_good"
+	if e.EventType == "scrap" {
+		col = "qty_scrap"
+	}
+	query := "UPDATE work_orders SET " + col + " = MAX(COALESCE(" + col + ",0) - ?, 0)"
+	if e.ClosedWO {
+		query += ", status = 'in_progress', completed_at = NULL"
+	}
+	if _, err := tx.Exec(query+" WHERE id = ?", e.Qty, e.WOID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE wo_completions SET reversed_at=?, reversed_by=? WHERE id=?", now, entry.UserID, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func handleListScrapReasons(w http.ResponseWriter, r *http.Request) {
+	query := "SELECT code, COALESCE(description,''), active FROM scrap_reasons"
+	if r.URL.Query().Get("all") != "true" {
+		query += " WHERE active = 1"
+	}
+	rows, err := db.Query(query + " ORDER BY code")
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	items := []ScrapReason{}
+	for rows.Next() {
+		var s ScrapReason
+		rows.Scan(&s.Code, &s.Description, &s.Active)
+		items = append(items, s)
+	}
+	jsonResp(w, items)
+}
+
+func handleCreateScrapReason(w http.ResponseWriter, r *http.Request) {
+	var s ScrapReason
+	if err := decodeBody(r, &s); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	s.Code = strings.ToUpper(strings.TrimSpace(s.Code))
+	ve := &ValidationErrors{}
+	requireField(ve, "code", s.Code)
+	validateMaxLength(ve, "code", s.Code, 50)
+	validateMaxLength(ve, "description", s.Description, 255)
+	var exists int
+	if db.QueryRow("SELECT 1 FROM scrap_reasons WHERE code=?", s.Code).Scan(&exists) == nil {
+		ve.Add("code", "scrap reason already exists")
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+	s.Active = true
+	if _, err := db.Exec("INSERT INTO scrap_reasons (code, description, active) VALUES (?,?,1)", s.Code, s.Description); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, getUsername(r), "created", "scrap_reason", s.Code, "Created scrap reason "+s.Code)
+	jsonResp(w, s)
+}
+
+// handleUpdateScrapReason edits a reason's description or retires it.
+// Reasons are never deleted since past scrap events refer to them.
+func handleUpdateScrapReason(w http.ResponseWriter, r *http.Request, code string) {
+	var s ScrapReason
+	err := db.QueryRow("SELECT code, COALESCE(description,''), active FROM scrap_reasons WHERE code=?", code).Scan(&s.Code, &s.Description, &s.Active)
+	if err != nil {
+		jsonErr(w, "scrap reason not found", 404)
+		return
+	}
+	var body struct {
+		Description *string `json:"description"`
+		Active      *bool   `json:"active"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	if body.Description != nil {
+		ve := &ValidationErrors{}
+		validateMaxLength(ve, "description", *body.Description, 255)
+		if ve.HasErrors() {
+			jsonErr(w, ve.Error(), 400)
+			return
+		}
+		s.Description = *body.Description
+	}
+	if body.Active != nil {
+		s.Active = *body.Active
+	}
+	if _, err := db.Exec("UPDATE scrap_reasons SET description=?, active=? WHERE code=?", s.Description, s.Active, s.Code); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, getUsername(r), "updated", "scrap_reason", s.Code, "Updated scrap reason "+s.Code)
+	jsonResp(w, s)
+}
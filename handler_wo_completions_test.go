@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// seedCompletionWO sets up WO-1 for 10 x ASY-1 (2 x RES-1, 1 x CAP-1 each)
+// with its materials reserved. 60 of the RES-1 are in a lot.
+func seedCompletionWO(t *testing.T) (resLot int) {
+	t.Helper()
+	dir := t.TempDir()
+	partsDir = dir
+	createBOMFile(t, dir, "ASY-1", [][]string{{"IPN", "Qty"}, {"RES-1", "2"}, {"CAP-1", "1"}})
+	stmts := []string{
+		`INSERT INTO inventory (ipn, qty_on_hand) VALUES ('RES-1', 100), ('CAP-1', 50)`,
+		`INSERT INTO work_orders (id, assembly_ipn, qty, status) VALUES ('WO-1', 'ASY-1', 10, 'in_progress')`,
+		`INSERT INTO inventory_reservations (ref_type, ref_id, ipn, qty) VALUES ('work_order', 'WO-1', 'RES-1', 20), ('work_order', 'WO-1', 'CAP-1', 10)`,
+		`UPDATE inventory SET qty_reserved = CASE ipn WHEN 'RES-1' THEN 20 ELSE 10 END`,
+		`INSERT INTO scrap_reasons (code, description) VALUES ('SOLDER', 'Solder defect')`,
+		`INSERT INTO scrap_reasons (code, description, active) VALUES ('OLD', 'Retired', 0)`,
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("seed failed: %v\n%s", err, s)
+		}
+	}
+	return seedLot(t, InventoryLot{IPN: "RES-1", LotNumber: "R-1", QtyReceived: 60, QtyOnHand: 60})
+}
+
+type woEventResp struct {
+	Data struct {
+		Event    WOCompletion `json:"event"`
+		WOStatus string       `json:"wo_status"`
+		QtyGood  int          `json:"qty_good"`
+		QtyScrap int          `json:"qty_scrap"`
+		UndoID   int          `json:"undo_id"`
+	} `json:"data"`
+}
+
+func postWOEvent(t *testing.T, kind, body string) (*httptest.ResponseRecorder, woEventResp) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	if kind == "scrap" {
+		handleScrapWorkOrderUnits(w, httptest.NewRequest("POST", "/api/v1/workorders/WO-1/scrap", bytes.NewBufferString(body)), "WO-1")
+	} else {
+		handleCompleteWorkOrderUnits(w, httptest.NewRequest("POST", "/api/v1/workorders/WO-1/completions", bytes.NewBufferString(body)), "WO-1")
+	}
+	var resp woEventResp
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp
+}
+
+func undoEvent(t *testing.T, undoID int) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	id := strconv.Itoa(undoID)
+	handlePerformUndo(w, httptest.NewRequest("POST", "/api/v1/undo/"+id, nil), id)
+	return w
+}
+
+func onHand(ipn string) float64 {
+	var q float64
+	db.QueryRow("SELECT qty_on_hand FROM inventory WHERE ipn=?", ipn).Scan(&q)
+	return q
+}
+
+func openReserved(ipn string) float64 {
+	var q float64
+	db.QueryRow("SELECT COALESCE(SUM(qty),0) FROM inventory_reservations WHERE ref_id='WO-1' AND ipn=? AND status='open'", ipn).Scan(&q)
+	return q
+}
+
+func TestWOPartialCompletionAndScrap(t *testing.T) {
+	oldDB, oldPartsDir := db, partsDir
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB; partsDir = oldPartsDir }()
+	resLot := seedCompletionWO(t)
+
+	w, resp := postWOEvent(t, "complete", `{"qty":4}`)
+	if w.Code != 200 {
+		t.Fatalf("completion failed: %d %s", w.Code, w.Body.String())
+	}
+	if resp.Data.WOStatus != "in_progress" || resp.Data.QtyGood != 4 || resp.Data.Event.OutputLotID == nil || resp.Data.UndoID == 0 {
+		t.Fatalf("unexpected completion response: %+v", resp.Data)
+	}
+	if len(resp.Data.Event.Transactions) != 3 {
+		t.Errorf("expected 2 backflush issues and a receipt, got %+v", resp.Data.Event.Transactions)
+	}
+	if onHand("ASY-1") != 4 || onHand("RES-1") != 92 || onHand("CAP-1") != 46 {
+		t.Errorf("unexpected stock: ASY-1 %v RES-1 %v CAP-1 %v", onHand("ASY-1"), onHand("RES-1"), onHand("CAP-1"))
+	}
+	if q, _ := lotQty(t, resLot); q != 52 {
+		t.Errorf("expected RES-1 backflushed from lot R-1, %v left", q)
+	}
+	if openReserved("RES-1") != 12 {
+		t.Errorf("expected 12 RES-1 still reserved, got %v", openReserved("RES-1"))
+	}
+
+	bad := []struct{ kind, name, body string }{
+		{"complete", "more than remain", `{"qty":7}`},
+		{"complete", "zero", `{"qty":0}`},
+		{"complete", "reason on a completion", `{"qty":1,"reason_code":"SOLDER"}`},
+		{"scrap", "no reason", `{"qty":1}`},
+		{"scrap", "unknown reason", `{"qty":1,"reason_code":"NOPE"}`},
+		{"scrap", "retired reason", `{"qty":1,"reason_code":"OLD"}`},
+	}
+	for _, tt := range bad {
+		if w, _ := postWOEvent(t, tt.kind, tt.body); w.Code != 400 {
+			t.Errorf("%s: expected 400, got %d %s", tt.name, w.Code, w.Body.String())
+		}
+	}
+
+	w, resp = postWOEvent(t, "scrap", `{"qty":2,"reason_code":"solder","notes":"bridged U3"}`)
+	if w.Code != 200 {
+		t.Fatalf("scrap failed: %d %s", w.Code, w.Body.String())
+	}
+	if resp.Data.QtyScrap != 2 || resp.Data.Event.ReasonCode != "SOLDER" || onHand("RES-1") != 88 || onHand("ASY-1") != 4 {
+		t.Errorf("unexpected state after scrap: %+v RES-1 %v ASY-1 %v", resp.Data, onHand("RES-1"), onHand("ASY-1"))
+	}
+	var scrapped float64
+	db.QueryRow("SELECT qty FROM inventory_transactions WHERE ipn='ASY-1' AND type='scrap' AND reference='WO-1'").Scan(&scrapped)
+	if scrapped != 2 {
+		t.Errorf("expected a scrap transaction for 2 ASY-1, got %v", scrapped)
+	}
+
+	// The last 4 units close the WO and release what is left reserved
+	w, resp = postWOEvent(t, "complete", `{"qty":4}`)
+	if w.Code != 200 || resp.Data.WOStatus != "completed" || !resp.Data.Event.ClosedWO {
+		t.Fatalf("expected closing completion, got %d %s", w.Code, w.Body.String())
+	}
+	var status string
+	var good, scrap int
+	db.QueryRow("SELECT status, qty_good, qty_scrap FROM work_orders WHERE id='WO-1'").Scan(&status, &good, &scrap)
+	if status != "completed" || good != 8 || scrap != 2 {
+		t.Errorf("expected completed 8 good 2 scrap, got %s %d %d", status, good, scrap)
+	}
+	if openReserved("RES-1") != 0 || onHand("RES-1") != 80 || onHand("ASY-1") != 8 {
+		t.Errorf("unexpected state after close: reserved %v RES-1 %v ASY-1 %v", openReserved("RES-1"), onHand("RES-1"), onHand("ASY-1"))
+	}
+	if w, _ := postWOEvent(t, "complete", `{"qty":1}`); w.Code != 400 {
+		t.Errorf("expected 400 completing a closed WO, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handleListWOCompletions(w, httptest.NewRequest("GET", "/api/v1/workorders/WO-1/completions", nil), "WO-1")
+	var list struct {
+		Data []WOCompletion `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Data) != 3 || list.Data[1].EventType != "scrap" {
+		t.Errorf("expected 3 events, got %+v", list.Data)
+	}
+}
+
+func TestWOCompletionUndo(t *testing.T) {
+	oldDB, oldPartsDir := db, partsDir
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB; partsDir = oldPartsDir }()
+	resLot := seedCompletionWO(t)
+
+	_, first := postWOEvent(t, "complete", `{"qty":4}`)
+	_, closing := postWOEvent(t, "complete", `{"qty":6}`)
+	if closing.Data.WOStatus != "completed" {
+		t.Fatalf("expected WO completed, got %+v", closing.Data)
+	}
+
+	// Only the latest event can be undone
+	if w := undoEvent(t, first.Data.UndoID); w.Code != 500 {
+		t.Errorf("expected undo of an older event to fail, got %d %s", w.Code, w.Body.String())
+	}
+
+	if w := undoEvent(t, closing.Data.UndoID); w.Code != 200 {
+		t.Fatalf("undo failed: %d %s", w.Code, w.Body.String())
+	}
+	var status string
+	var good int
+	db.QueryRow("SELECT status, qty_good FROM work_orders WHERE id='WO-1'").Scan(&status, &good)
+	if status != "in_progress" || good != 4 {
+		t.Errorf("expected WO reopened with 4 good, got %s %d", status, good)
+	}
+	if onHand("ASY-1") != 4 || onHand("RES-1") != 92 || onHand("CAP-1") != 46 {
+		t.Errorf("unexpected stock after undo: ASY-1 %v RES-1 %v CAP-1 %v", onHand("ASY-1"), onHand("RES-1"), onHand("CAP-1"))
+	}
+	if openReserved("RES-1") != 12 || openReserved("CAP-1") != 6 {
+		t.Errorf("expected reservations restored to 12/6, got %v/%v", openReserved("RES-1"), openReserved("CAP-1"))
+	}
+	if q, _ := lotQty(t, resLot); q != 52 {
+		t.Errorf("expected lot R-1 back to 52, got %v", q)
+	}
+	var net float64
+	db.QueryRow("SELECT SUM(qty) FROM inventory_transactions WHERE ipn='RES-1' AND type='issue' AND reference='WO-1'").Scan(&net)
+	if net != 8 {
+		t.Errorf("expected net RES-1 issued to WO-1 of 8 after reversal, got %v", net)
+	}
+
+	// Finished goods that were already issued can't be taken back
+	db.Exec("UPDATE inventory_lots SET qty_on_hand = 0, status = 'depleted' WHERE id = ?", *first.Data.Event.OutputLotID)
+	if w := undoEvent(t, first.Data.UndoID); w.Code != 500 {
+		t.Errorf("expected undo to fail once finished goods are gone, got %d", w.Code)
+	}
+}
+
+func TestWOStatusCompletionAfterPartials(t *testing.T) {
+	oldDB, oldPartsDir := db, partsDir
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB; partsDir = oldPartsDir }()
+	seedCompletionWO(t)
+
+	postWOEvent(t, "complete", `{"qty":3}`)
+	postWOEvent(t, "scrap", `{"qty":1,"reason_code":"SOLDER"}`)
+
+	w := httptest.NewRecorder()
+	body := `{"assembly_ipn":"ASY-1","qty":10,"status":"completed","priority":"normal"}`
+	handleUpdateWorkOrder(w, httptest.NewRequest("PUT", "/api/v1/workorders/WO-1", bytes.NewBufferString(body)), "WO-1")
+	if w.Code != 200 {
+		t.Fatalf("update failed: %d %s", w.Code, w.Body.String())
+	}
+	var good, scrap int
+	db.QueryRow("SELECT qty_good, qty_scrap FROM work_orders WHERE id='WO-1'").Scan(&good, &scrap)
+	if good != 9 || scrap != 1 {
+		t.Errorf("expected 9 good 1 scrap, got %d %d", good, scrap)
+	}
+	if onHand("ASY-1") != 9 {
+		t.Errorf("expected 9 ASY-1 received in total, got %v", onHand("ASY-1"))
+	}
+}
+
+func TestWOCompletionLeavesOtherReservations(t *testing.T) {
+	oldDB, oldPartsDir := db, partsDir
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB; partsDir = oldPartsDir }()
+	seedCompletionWO(t)
+	// WO-1 holds 10 RES-1 and a sales order the other 90
+	for _, s := range []string{
+		`UPDATE inventory_reservations SET qty = 10 WHERE ref_id = 'WO-1' AND ipn = 'RES-1'`,
+		`INSERT INTO inventory_reservations (ref_type, ref_id, ipn, qty) VALUES ('sales_order', 'SO-1', 'RES-1', 90)`,
+		`UPDATE inventory SET qty_reserved = 100 WHERE ipn = 'RES-1'`,
+	} {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 10 units need 20, but only WO-1's 10 are available to it
+	if w, _ := postWOEvent(t, "complete", `{"qty":10}`); w.Code != 400 {
+		t.Errorf("expected a backflush into the SO's stock to be refused, got %d %s", w.Code, w.Body.String())
+	}
+	if w, _ := postWOEvent(t, "complete", `{"qty":5}`); w.Code != 200 {
+		t.Fatalf("completion failed: %d %s", w.Code, w.Body.String())
+	}
+	var soQty float64
+	db.QueryRow("SELECT qty FROM inventory_reservations WHERE ref_id='SO-1'").Scan(&soQty)
+	if soQty != 90 || onHand("RES-1") != 90 || openReserved("RES-1") != 0 {
+		t.Errorf("expected the SO's 90 untouched, got SO %v on hand %v WO-1 %v", soQty, onHand("RES-1"), openReserved("RES-1"))
+	}
+}
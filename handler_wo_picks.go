@@ -0,0 +1,625 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WOPick is material pulled from stock for a work order, one row per lot
+// drawn. It sits in the WO's staging location until backflush or closing
+// the WO consumes it; whatever is left can be returned to stock.
+type WOPick struct {
+	ID              int     `json:"id"`
+	WOID            string  `json:"wo_id"`
+	IPN             string  `json:"ipn"`
+	LotID           *int    `json:"lot_id"`
+	LotNumber       string  `json:"lot_number"`
+	FromLocation    string  `json:"from_location"`
+	StagingLocation string  `json:"staging_location"`
+	Qty             float64 `json:"qty"`
+	QtyReturned     float64 `json:"qty_returned"`
+	QtyConsumed     float64 `json:"qty_consumed"`
+	QtyStaged       float64 `json:"qty_staged"`
+	PickedBy        string  `json:"picked_by"`
+	PickedAt        string  `json:"picked_at"`
+}
+
+// PickSuggestion is a lot to pull for a pick list line, or untracked stock
+// when LotID is nil. WholeReel means the suggestion empties the lot.
+type PickSuggestion struct {
+	LotID     *int    `json:"lot_id"`
+	LotNumber string  `json:"lot_number"`
+	DateCode  string  `json:"date_code"`
+	Location  string  `json:"location"`
+	QtyOnHand float64 `json:"qty_on_hand"`
+	Qty       float64 `json:"qty"`
+	WholeReel bool    `json:"whole_reel"`
+}
+
+// PickListLine is one BOM line of a pick list. QtyPicked is net of returns,
+// so it can exceed QtyRequired when whole reels were pulled.
+type PickListLine struct {
+	IPN         string           `json:"ipn"`
+	Description string           `json:"description"`
+	MPN         string           `json:"mpn"`
+	RefDes      string           `json:"ref_des"`
+	Location    string           `json:"location"`
+	QtyRequired float64          `json:"qty_required"`
+	QtyPicked   float64          `json:"qty_picked"`
+	QtyStaged   float64          `json:"qty_staged"`
+	QtyToPick   float64          `json:"qty_to_pick"`
+	Shortage    float64          `json:"shortage"`
+	Status      string           `json:"status"`
+	Suggestions []PickSuggestion `json:"suggestions"`
+}
+
+// woPickLine is one line of a pick or return request. Without a lot_id a
+// pick takes the oldest lots first and a return goes back to the lots the
+// most recent picks came from.
+type woPickLine struct {
+	IPN   string  `json:"ipn"`
+	LotID *int    `json:"lot_id"`
+	Qty   float64 `json:"qty"`
+}
+
+// woStagingLocation names the place a WO's picked material is kept. It is a
+// label on the pick rows only, not a location from the locations table:
+// picking issues the material, so it leaves qty_on_hand and per-location
+// stock. Staged material therefore doesn't show in location, valuation or
+// ATP views; the WO's picks (and its WIP cost) are where to find it.
+func woStagingLocation(woID string) string {
+	return "STAGE-" + woID
+}
+
+// woPickTotals returns, per IPN, what has been picked for a WO net of
+// returns and what of that is still in staging. Databases without the
+// wo_picks table have picked nothing.
+func woPickTotals(woID string) (picked, staged map[string]float64) {
+	picked, staged = map[string]float64{}, map[string]float64{}
+	rows, err := db.Query(`SELECT ipn, SUM(qty - qty_returned), SUM(qty - qty_returned - qty_consumed)
+		FROM wo_picks WHERE wo_id=? GROUP BY ipn`, woID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ipn string
+		var p, s float64
+		rows.Scan(&ipn, &p, &s)
+		picked[ipn] = p
+		if s > 1e-9 {
+			staged[ipn] = s
+		}
+	}
+	return
+}
+
+func loadWOPicks(woID string) ([]WOPick, error) {
+	rows, err := db.Query(`SELECT p.id, p.wo_id, p.ipn, p.lot_id, COALESCE(l.lot_number,''), COALESCE(p.from_location,''),
+		p.staging_location, p.qty, p.qty_returned, p.qty_consumed, COALESCE(p.picked_by,''), p.picked_at
+		FROM wo_picks p LEFT JOIN inventory_lots l ON l.id = p.lot_id WHERE p.wo_id=? ORDER BY p.id`, woID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	picks := []WOPick{}
+	for rows.Next() {
+		var p WOPick
+		var lotID sql.NullInt64
+		if err := rows.Scan(&p.ID, &p.WOID, &p.IPN, &lotID, &p.LotNumber, &p.FromLocation, &p.StagingLocation,
+			&p.Qty, &p.QtyReturned, &p.QtyConsumed, &p.PickedBy, &p.PickedAt); err != nil {
+			return nil, err
+		}
+		if lotID.Valid {
+			v := int(lotID.Int64)
+			p.LotID = &v
+		}
+		p.QtyStaged = p.Qty - p.QtyReturned - p.QtyConsumed
+		picks = append(picks, p)
+	}
+	return picks, rows.Err()
+}
+
+// stagedRow is the part of a wo_picks row an update needs.
+type stagedRow struct {
+	id    int
+	lotID *int
+	qty   float64
+}
+
+func queryStagedRows(tx *sql.Tx, query string, args ...interface{}) ([]stagedRow, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load staged material: %w", err)
+	}
+	defer rows.Close()
+	var list []stagedRow
+	for rows.Next() {
+		var s stagedRow
+		var lotID sql.NullInt64
+		rows.Scan(&s.id, &lotID, &s.qty)
+		if lotID.Valid {
+			v := int(lotID.Int64)
+			s.lotID = &v
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// consumeStaged uses up to qty of ipn from the WO's staging location, oldest
+// picks first, and returns how much it used. The material was issued when it
+// was picked, so stock isn't touched.
+func consumeStaged(tx *sql.Tx, woID, ipn string, qty float64) (float64, error) {
+	list, err := queryStagedRows(tx, `SELECT id, lot_id, qty - qty_returned - qty_consumed FROM wo_picks
+		WHERE wo_id=? AND ipn=? AND qty - qty_returned - qty_consumed > 0 ORDER BY id`, woID, ipn)
+	if err != nil {
+		return 0, err
+	}
+	used := 0.0
+	for _, s := range list {
+		take := s.qty
+		if take > qty-used {
+			take = qty - used
+		}
+		if take <= 1e-9 {
+			break
+		}
+		if _, err := tx.Exec("UPDATE wo_picks SET qty_consumed = qty_consumed + ? WHERE id=?", take, s.id); err != nil {
+			return 0, fmt.Errorf("failed to consume staged %s: %w", ipn, err)
+		}
+		used += take
+	}
+	return used, nil
+}
+
+// unconsumeStaged puts qty of ipn back into staging, e.g. when a backflush
+// is undone. The most recently consumed picks go back first.
+func unconsumeStaged(tx *sql.Tx, woID, ipn string, qty float64) error {
+	list, err := queryStagedRows(tx, `SELECT id, lot_id, qty_consumed FROM wo_picks
+		WHERE wo_id=? AND ipn=? AND qty_consumed > 0 ORDER BY id DESC`, woID, ipn)
+	if err != nil {
+		return err
+	}
+	for _, s := range list {
+		take := s.qty
+		if take > qty {
+			take = qty
+		}
+		if take <= 1e-9 {
+			break
+		}
+		if _, err := tx.Exec("UPDATE wo_picks SET qty_consumed = qty_consumed - ? WHERE id=?", take, s.id); err != nil {
+			return fmt.Errorf("failed to restore staged %s: %w", ipn, err)
+		}
+		qty -= take
+	}
+	return nil
+}
+
+// stagedUseForClose works out how much staged material closing a WO uses:
+// the requirement for the units no partial completion has backflushed yet,
+// capped at what is staged. It reads outside any transaction, so call it
+// before starting one.
+func stagedUseForClose(woID, assemblyIPN string, qty int) map[string]float64 {
+	_, staged := woPickTotals(woID)
+	if len(staged) == 0 {
+		return nil
+	}
+	var backflushed int
+	db.QueryRow("SELECT COALESCE(SUM(qty),0) FROM wo_completions WHERE wo_id=? AND reversed_at IS NULL", woID).Scan(&backflushed)
+	if qty-backflushed <= 0 {
+		return nil
+	}
+	bom, err := explodeWorkOrderBOM(woID, assemblyIPN, qty-backflushed)
+	if err != nil {
+		return nil
+	}
+	use := map[string]float64{}
+	for _, line := range bom {
+		if s := staged[line.IPN]; s > 0 && line.QtyRequired > 0 {
+			use[line.IPN] = line.QtyRequired
+			if s < line.QtyRequired {
+				use[line.IPN] = s
+			}
+		}
+	}
+	return use
+}
+
+// suggestPickLots picks which lots to pull for qty of ipn, first to expire
+// first like issueFromLots, then untracked stock. Suggestions stop at what
+// is available to the WO.
+func suggestPickLots(ipn string, qty, available, onHand float64, location string) []PickSuggestion {
+	suggestions := []PickSuggestion{}
+	if qty > available {
+		qty = available
+	}
+	if qty <= 1e-9 {
+		return suggestions
+	}
+	var tracked float64
+	db.QueryRow("SELECT COALESCE(SUM(qty_on_hand),0) FROM inventory_lots WHERE ipn=?", ipn).Scan(&tracked)
+
+	now := time.Now()
+	rows, err := db.Query(`SELECT id, lot_number, COALESCE(date_code,''), COALESCE(location,''), qty_on_hand, `+lotMSLColumns+` FROM inventory_lots
+		WHERE ipn=? AND status='available' AND qty_on_hand > 0 AND `+lotNotExpired+` `+lotFEFOOrder, ipn, expiryToday(now))
+	if err == nil {
+		for rows.Next() && qty > 1e-9 {
+			var s PickSuggestion
+			var id int
+			var msl lotMSLRow
+			rows.Scan(append([]interface{}{&id, &s.LotNumber, &s.DateCode, &s.Location, &s.QtyOnHand}, msl.targets()...)...)
+			// Reels past their floor life have to be baked first
+			if m := msl.status(now); m != nil && m.Exceeded {
+				continue
+			}
+			s.LotID = &id
+			if s.Location == "" {
+				s.Location = location
+			}
+			s.Qty = s.QtyOnHand
+			if s.Qty > qty {
+				s.Qty = qty
+			}
+			s.WholeReel = s.Qty >= s.QtyOnHand-1e-9
+			qty -= s.Qty
+			suggestions = append(suggestions, s)
+		}
+		rows.Close()
+	}
+	if untracked := onHand - tracked; qty > 1e-9 && untracked > 1e-9 {
+		s := PickSuggestion{Location: location, QtyOnHand: untracked, Qty: qty}
+		if s.Qty > untracked {
+			s.Qty = untracked
+		}
+		suggestions = append(suggestions, s)
+	}
+	return suggestions
+}
+
+// handleWorkOrderPickList lists what to pull for a WO, sorted by storage
+// location so the picker can walk the stockroom once. Each line suggests
+// the lots to take and shows what has been picked already.
+func handleWorkOrderPickList(w http.ResponseWriter, r *http.Request, id string) {
+	var assemblyIPN, status string
+	var qty int
+	if err := db.QueryRow("SELECT assembly_ipn, qty, status FROM work_orders WHERE id=?", id).Scan(&assemblyIPN, &qty, &status); err != nil {
+		jsonErr(w, "work order not found", 404)
+		return
+	}
+	bom, err := explodeWorkOrderBOM(id, assemblyIPN, qty)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	picked, staged := woPickTotals(id)
+
+	lines := []PickListLine{}
+	for _, bl := range bom {
+		line := PickListLine{IPN: bl.IPN, Description: bl.Description, MPN: bl.MPN, RefDes: bl.RefDes,
+			QtyRequired: bl.QtyRequired, QtyPicked: picked[bl.IPN], QtyStaged: staged[bl.IPN]}
+		line.QtyToPick = line.QtyRequired - line.QtyPicked
+		if line.QtyToPick < 0 {
+			line.QtyToPick = 0
+		}
+		db.QueryRow("SELECT COALESCE(location,'') FROM inventory WHERE ipn=?", bl.IPN).Scan(&line.Location)
+		line.Suggestions = suggestPickLots(bl.IPN, line.QtyToPick, bl.QtyAvailable, bl.QtyOnHand, line.Location)
+		line.Shortage = line.QtyToPick
+		for i, s := range line.Suggestions {
+			if i == 0 && s.Location != "" {
+				line.Location = s.Location
+			}
+			line.Shortage -= s.Qty
+		}
+		if line.Shortage < 1e-9 {
+			line.Shortage = 0
+		}
+		switch {
+		case line.QtyPicked > line.QtyRequired+1e-9:
+			line.Status = "over_picked"
+		case line.QtyToPick <= 1e-9:
+			line.Status = "picked"
+		case line.Shortage > 0:
+			line.Status = "shortage"
+		case line.QtyPicked > 0:
+			line.Status = "partial"
+		default:
+			line.Status = "pending"
+		}
+		lines = append(lines, line)
+	}
+	// Lines without a location go last
+	sort.SliceStable(lines, func(i, j int) bool {
+		li, lj := lines[i].Location, lines[j].Location
+		if (li == "") != (lj == "") {
+			return lj == ""
+		}
+		if li != lj {
+			return li < lj
+		}
+		return lines[i].IPN < lines[j].IPN
+	})
+
+	jsonResp(w, map[string]interface{}{
+		"wo_id":            id,
+		"assembly_ipn":     assemblyIPN,
+		"qty":              qty,
+		"status":           status,
+		"staging_location": woStagingLocation(id),
+		"lines":            lines,
+	})
+}
+
+func handleListWorkOrderPicks(w http.ResponseWriter, r *http.Request, id string) {
+	var exists int
+	if db.QueryRow("SELECT 1 FROM work_orders WHERE id=?", id).Scan(&exists) != nil {
+		jsonErr(w, "work order not found", 404)
+		return
+	}
+	picks, err := loadWOPicks(id)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	jsonResp(w, picks)
+}
+
+// handleWorkOrderPick records material pulled for a WO and moves it to the
+// WO's staging location. Picks may exceed the requirement, e.g. when a whole
+// reel is pulled; the surplus is returned later. Picked stock is issued to
+// the WO and draws down its reservations.
+func handleWorkOrderPick(w http.ResponseWriter, r *http.Request, id string) {
+	var body struct {
+		Picks []woPickLine `json:"picks"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	var assemblyIPN, status string
+	var qty int
+	if err := db.QueryRow("SELECT assembly_ipn, qty, status FROM work_orders WHERE id=?", id).Scan(&assemblyIPN, &qty, &status); err != nil {
+		jsonErr(w, "work order not found", 404)
+		return
+	}
+	if woClosed(status) {
+		jsonErr(w, "cannot pick material for a "+status+" work order", 400)
+		return
+	}
+	bom, err := explodeWorkOrderBOM(id, assemblyIPN, qty)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	lines := map[string]WOBOMLine{}
+	for _, bl := range bom {
+		lines[bl.IPN] = bl
+	}
+
+	ve := &ValidationErrors{}
+	if len(body.Picks) == 0 {
+		ve.Add("picks", "at least one pick is required")
+	}
+	want := map[string]float64{}
+	lotPicks := map[string][]LotPick{}
+	for i := range body.Picks {
+		p := &body.Picks[i]
+		field := fmt.Sprintf("picks[%d]", i)
+		p.IPN = strings.TrimSpace(p.IPN)
+		if _, ok := lines[p.IPN]; !ok {
+			ve.Add(field+".ipn", p.IPN+" is not on the work order's BOM")
+		}
+		if p.Qty <= 0 {
+			ve.Add(field+".qty", "must be positive")
+			continue
+		}
+		want[p.IPN] += p.Qty
+		if p.LotID != nil {
+			lotPicks[p.IPN] = append(lotPicks[p.IPN], LotPick{LotID: *p.LotID, Qty: p.Qty})
+		}
+	}
+	for ipn, q := range want {
+		if line, ok := lines[ipn]; ok && q > line.QtyAvailable+1e-9 {
+			ve.Add("picks", fmt.Sprintf("only %g %s available to pick", line.QtyAvailable, ipn))
+		}
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	username := getUsername(r)
+	now := time.Now().Format("2006-01-02 15:04:05")
+	staging := woStagingLocation(id)
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+
+	for ipn, picks := range lotPicks {
+		if err := validateLotPicks(tx, ipn, picks); err != nil {
+			ve.Add("picks", err.Error())
+		}
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	// The customer the WO builds for gets their own stock picked first
+	customer := workOrderCustomer(tx, id)
+	for _, p := range body.Picks {
+		var picks []LotPick
+		if p.LotID != nil {
+			picks = []LotPick{{LotID: *p.LotID, Qty: p.Qty}}
+		}
+		if err := checkUsableStock(tx, p.IPN, p.Qty, time.Now()); err != nil {
+			jsonErr(w, err.Error(), 400)
+			return
+		}
+		if _, err := tx.Exec("UPDATE inventory SET qty_on_hand = qty_on_hand - ?, updated_at = ? WHERE ipn = ?", p.Qty, now, p.IPN); err != nil {
+			jsonErr(w, fmt.Sprintf("failed to pick %s: %v", p.IPN, err), 500)
+			return
+		}
+		if err := takeOwnedStock(tx, p.IPN, p.Qty, customer, id, "Picked to "+staging, username, now); err != nil {
+			jsonErr(w, err.Error(), 400)
+			return
+		}
+		draws, err := issueFromLots(tx, p.IPN, p.Qty, picks, "issue", id, "Picked to "+staging, now)
+		if err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		if _, err := consumeReservation(tx, "work_order", id, p.IPN, p.Qty); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		var binLocation string
+		tx.QueryRow("SELECT COALESCE(location,'') FROM inventory WHERE ipn=?", p.IPN).Scan(&binLocation)
+		for _, d := range draws {
+			from := binLocation
+			if d.LotID != nil {
+				var lotLocation string
+				tx.QueryRow("SELECT COALESCE(location,'') FROM inventory_lots WHERE id=?", *d.LotID).Scan(&lotLocation)
+				if lotLocation != "" {
+					from = lotLocation
+				}
+			}
+			_, err := tx.Exec(`INSERT INTO wo_picks (wo_id, ipn, lot_id, from_location, staging_location, qty, picked_by, picked_at)
+				VALUES (?,?,?,?,?,?,?,?)`, id, p.IPN, d.LotID, from, staging, d.Qty, username, now)
+			if err != nil {
+				jsonErr(w, err.Error(), 500)
+				return
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, username, "picked", "workorder", id, fmt.Sprintf("Picked %d line(s) for WO %s to %s", len(body.Picks), id, staging))
+	handleWorkOrderPickList(w, r, id)
+}
+
+// handleWorkOrderPickReturn puts unused staged material back into stock with
+// a return transaction referencing the WO. It works on closed WOs too, since
+// that is when leftovers usually come back.
+func handleWorkOrderPickReturn(w http.ResponseWriter, r *http.Request, id string) {
+	var body struct {
+		Returns []woPickLine `json:"returns"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		jsonErr(w, "invalid body", 400)
+		return
+	}
+	var exists int
+	if db.QueryRow("SELECT 1 FROM work_orders WHERE id=?", id).Scan(&exists) != nil {
+		jsonErr(w, "work order not found", 404)
+		return
+	}
+
+	ve := &ValidationErrors{}
+	if len(body.Returns) == 0 {
+		ve.Add("returns", "at least one return is required")
+	}
+	for i := range body.Returns {
+		body.Returns[i].IPN = strings.TrimSpace(body.Returns[i].IPN)
+		if body.Returns[i].Qty <= 0 {
+			ve.Add(fmt.Sprintf("returns[%d].qty", i), "must be positive")
+		}
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	username := getUsername(r)
+	now := time.Now().Format("2006-01-02 15:04:05")
+	note := "Returned from " + woStagingLocation(id)
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+
+	for i, ret := range body.Returns {
+		query := `SELECT id, lot_id, qty - qty_returned - qty_consumed FROM wo_picks
+			WHERE wo_id=? AND ipn=? AND qty - qty_returned - qty_consumed > 0`
+		args := []interface{}{id, ret.IPN}
+		if ret.LotID != nil {
+			query += " AND lot_id=?"
+			args = append(args, *ret.LotID)
+		}
+		list, err := queryStagedRows(tx, query+" ORDER BY id DESC", args...)
+		if err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		staged := 0.0
+		for _, s := range list {
+			staged += s.qty
+		}
+		if ret.Qty > staged+1e-9 {
+			ve.Add(fmt.Sprintf("returns[%d].qty", i), fmt.Sprintf("only %g %s is staged for this work order", staged, ret.IPN))
+			continue
+		}
+
+		remaining := ret.Qty
+		for _, s := range list {
+			take := s.qty
+			if take > remaining {
+				take = remaining
+			}
+			if take <= 1e-9 {
+				break
+			}
+			if _, err := tx.Exec("UPDATE wo_picks SET qty_returned = qty_returned + ? WHERE id=?", take, s.id); err != nil {
+				jsonErr(w, err.Error(), 500)
+				return
+			}
+			if s.lotID != nil {
+				err = returnToLot(tx, *s.lotID, take, id, note, now)
+			} else {
+				_, err = tx.Exec("INSERT INTO inventory_transactions (ipn,type,qty,reference,notes,created_at) VALUES (?,?,?,?,?,?)",
+					ret.IPN, "return", take, id, note, now)
+			}
+			if err != nil {
+				jsonErr(w, err.Error(), 500)
+				return
+			}
+			remaining -= take
+		}
+		if _, err := tx.Exec("UPDATE inventory SET qty_on_hand = qty_on_hand + ?, updated_at = ? WHERE ipn = ?", ret.Qty, now, ret.IPN); err != nil {
+			jsonErr(w, fmt.Sprintf("failed to return %s: %v", ret.IPN, err), 500)
+			return
+		}
+		if err := returnOwnedStock(tx, ret.IPN, ret.Qty, id, note, username, now); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+		if err := syncCostLayers(tx, ret.IPN, "return", id, 0, now); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+	}
+	if ve.HasErrors() {
+		jsonErr(w, ve.Error(), 400)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	logAudit(db, username, "returned", "workorder", id, fmt.Sprintf("Returned %d line(s) from %s to stock", len(body.Returns), woStagingLocation(id)))
+	handleListWorkOrderPicks(w, r, id)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+type pickListResp struct {
+	Data struct {
+		StagingLocation string         `json:"staging_location"`
+		Lines           []PickListLine `json:"lines"`
+	} `json:"data"`
+}
+
+func getPickList(t *testing.T) pickListResp {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleWorkOrderPickList(w, httptest.NewRequest("GET", "/api/v1/workorders/WO-1/pick-list", nil), "WO-1")
+	if w.Code != 200 {
+		t.Fatalf("pick list failed: %d %s", w.Code, w.Body.String())
+	}
+	var resp pickListResp
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp
+}
+
+func postPicks(t *testing.T, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/v1/workorders/WO-1/"+path, bytes.NewBufferString(body))
+	if path == "picks" {
+		handleWorkOrderPick(w, req, "WO-1")
+	} else {
+		handleWorkOrderPickReturn(w, req, "WO-1")
+	}
+	return w
+}
+
+func pickLine(resp pickListResp, ipn string) PickListLine {
+	for _, l := range resp.Data.Lines {
+		if l.IPN == ipn {
+			return l
+		}
+	}
+	return PickListLine{}
+}
+
+func TestWorkOrderPickList(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	r1 := seedCompletionWO(t)
+	r2 := seedLot(t, InventoryLot{IPN: "RES-1", LotNumber: "R-2", QtyReceived: 30, QtyOnHand: 30})
+	db.Exec("UPDATE inventory SET location = CASE ipn WHEN 'CAP-1' THEN 'A-05' ELSE 'C-01' END")
+
+	w := httptest.NewRecorder()
+	handleUpdateLot(w, httptest.NewRequest("PUT", "/api/v1/lots/"+strconv.Itoa(r1), bytes.NewBufferString(`{"location":"B-07"}`)), strconv.Itoa(r1))
+	if w.Code != 200 {
+		t.Fatalf("lot update failed: %d %s", w.Code, w.Body.String())
+	}
+
+	// Sorted by location; RES-1 comes from its oldest reel
+	list := getPickList(t)
+	if len(list.Data.Lines) != 2 || list.Data.Lines[0].IPN != "CAP-1" || list.Data.Lines[1].Location != "B-07" {
+		t.Fatalf("unexpected pick list order: %+v", list.Data.Lines)
+	}
+	res := pickLine(list, "RES-1")
+	if len(res.Suggestions) != 1 || *res.Suggestions[0].LotID != r1 || res.Suggestions[0].Qty != 20 || res.Suggestions[0].WholeReel {
+		t.Errorf("unexpected RES-1 suggestions: %+v", res.Suggestions)
+	}
+	if cap := pickLine(list, "CAP-1"); len(cap.Suggestions) != 1 || cap.Suggestions[0].LotID != nil || cap.Status != "pending" {
+		t.Errorf("expected CAP-1 from untracked stock: %+v", cap)
+	}
+
+	for _, body := range []string{
+		`{"picks":[]}`,
+		`{"picks":[{"ipn":"NOPE","qty":1}]}`,
+		`{"picks":[{"ipn":"CAP-1","qty":0}]}`,
+		`{"picks":[{"ipn":"CAP-1","qty":51}]}`,
+		`{"picks":[{"ipn":"RES-1","lot_id":` + strconv.Itoa(r2) + `,"qty":31}]}`,
+	} {
+		if w := postPicks(t, "picks", body); w.Code != 400 {
+			t.Errorf("%s: expected 400, got %d %s", body, w.Code, w.Body.String())
+		}
+	}
+
+	// A quarantined reel isn't available to kit or pick
+	db.Exec("UPDATE inventory_lots SET status='quarantine' WHERE id=?", r1)
+	if bom, _ := explodeWorkOrderBOM("WO-1", "ASY-1", 10); bom[1].IPN != "RES-1" || bom[1].QtyAvailable != 40 {
+		t.Errorf("expected 40 RES-1 available with R-1 quarantined, got %+v", bom)
+	}
+	if w := postPicks(t, "picks", `{"picks":[{"ipn":"RES-1","qty":50}]}`); w.Code != 400 || onHand("RES-1") != 100 {
+		t.Errorf("expected a pick from the quarantined reel refused, got %d %s", w.Code, w.Body.String())
+	}
+	db.Exec("UPDATE inventory_lots SET status='available' WHERE id=?", r1)
+
+	// A whole reel of RES-1 is over-picked; picking draws down the reservations
+	w = postPicks(t, "picks", `{"picks":[{"ipn":"RES-1","lot_id":`+strconv.Itoa(r2)+`,"qty":30},{"ipn":"CAP-1","qty":10}]}`)
+	if w.Code != 200 {
+		t.Fatalf("pick failed: %d %s", w.Code, w.Body.String())
+	}
+	if onHand("RES-1") != 70 || onHand("CAP-1") != 40 || openReserved("RES-1") != 0 || openReserved("CAP-1") != 0 {
+		t.Errorf("expected stock issued and reservations consumed, got %g/%g on hand, %g/%g reserved",
+			onHand("RES-1"), onHand("CAP-1"), openReserved("RES-1"), openReserved("CAP-1"))
+	}
+	if lot, _ := loadLot(r2); lot.Status != "depleted" {
+		t.Errorf("expected the picked reel empty, got %+v", lot)
+	}
+	list = getPickList(t)
+	if res := pickLine(list, "RES-1"); res.Status != "over_picked" || res.QtyStaged != 30 || res.QtyToPick != 0 || len(res.Suggestions) != 0 {
+		t.Errorf("unexpected RES-1 line after picking: %+v", res)
+	}
+	if list.Data.StagingLocation != "STAGE-WO-1" {
+		t.Errorf("unexpected staging location %q", list.Data.StagingLocation)
+	}
+
+	// Re-kitting doesn't reserve what was picked
+	w = httptest.NewRecorder()
+	handleWorkOrderKit(w, httptest.NewRequest("POST", "/api/v1/workorders/WO-1/kit", nil), "WO-1")
+	if w.Code != 200 || openReserved("RES-1") != 0 || openReserved("CAP-1") != 0 {
+		t.Errorf("expected nothing more reserved, got %d %s", w.Code, w.Body.String())
+	}
+
+	// Backflush uses staged material, and undoing it puts it back
+	w, ev := postWOEvent(t, "complete", `{"qty":4}`)
+	if w.Code != 200 || onHand("RES-1") != 70 || onHand("CAP-1") != 40 {
+		t.Fatalf("expected backflush from staging, got %d %s (%g/%g on hand)", w.Code, w.Body.String(), onHand("RES-1"), onHand("CAP-1"))
+	}
+	if res := pickLine(getPickList(t), "RES-1"); res.QtyStaged != 22 {
+		t.Errorf("expected 22 RES-1 left in staging, got %g", res.QtyStaged)
+	}
+	if w := undoEvent(t, ev.Data.UndoID); w.Code != 200 {
+		t.Fatalf("undo failed: %d %s", w.Code, w.Body.String())
+	}
+	if res := pickLine(getPickList(t), "RES-1"); res.QtyStaged != 30 {
+		t.Errorf("expected 30 RES-1 back in staging, got %g", res.QtyStaged)
+	}
+
+	// Closing the WO uses what the build needs; the rest of the reel goes back
+	body, _ := json.Marshal(map[string]interface{}{"assembly_ipn": "ASY-1", "qty": 10, "status": "completed", "priority": "normal"})
+	w = httptest.NewRecorder()
+	handleUpdateWorkOrder(w, httptest.NewRequest("PUT", "/api/v1/workorders/WO-1", bytes.NewBuffer(body)), "WO-1")
+	if w.Code != 200 || onHand("RES-1") != 70 || onHand("CAP-1") != 40 {
+		t.Fatalf("close failed: %d %s", w.Code, w.Body.String())
+	}
+	for _, body := range []string{
+		`{"returns":[{"ipn":"RES-1","qty":11}]}`,
+		`{"returns":[{"ipn":"CAP-1","qty":1}]}`,
+		`{"returns":[{"ipn":"RES-1","lot_id":` + strconv.Itoa(r1) + `,"qty":1}]}`,
+	} {
+		if w := postPicks(t, "picks/return", body); w.Code != 400 {
+			t.Errorf("%s: expected 400, got %d %s", body, w.Code, w.Body.String())
+		}
+	}
+	if w := postPicks(t, "picks/return", `{"returns":[{"ipn":"RES-1","qty":10}]}`); w.Code != 200 {
+		t.Fatalf("return failed: %d %s", w.Code, w.Body.String())
+	}
+	if lot, _ := loadLot(r2); onHand("RES-1") != 80 || lot.QtyOnHand != 10 || lot.Status != "available" {
+		t.Errorf("expected 10 back in reel R-2, got %g on hand and %+v", onHand("RES-1"), lot)
+	}
+	var ref string
+	db.QueryRow("SELECT reference FROM inventory_transactions WHERE type='return' AND lot_id=?", r2).Scan(&ref)
+	if ref != "WO-1" {
+		t.Errorf("expected the return to reference WO-1, got %q", ref)
+	}
+}
+
+func TestWorkOrderRoutingCloseUsesStaged(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	seedCompletionWO(t)
+	res, err := db.Exec("INSERT INTO wo_operations (wo_id, seq, name, status) VALUES ('WO-1', 10, 'Assemble', 'in_progress')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opID, _ := res.LastInsertId()
+
+	if w := postPicks(t, "picks", `{"picks":[{"ipn":"RES-1","qty":30},{"ipn":"CAP-1","qty":10}]}`); w.Code != 200 {
+		t.Fatalf("pick failed: %d %s", w.Code, w.Body.String())
+	}
+
+	// Finishing the last operation closes the WO and uses the staged material
+	if w := operationAction(t, "WO-1", int(opID), "complete", `{}`); w.Code != 200 {
+		t.Fatalf("operation complete failed: %d %s", w.Code, w.Body.String())
+	}
+	if status, good, _ := woStatusAndQty(t, "WO-1"); status != "completed" || good != 10 {
+		t.Fatalf("expected WO-1 completed with 10 good, got %s %d", status, good)
+	}
+	if res := pickLine(getPickList(t), "RES-1"); res.QtyStaged != 10 || onHand("RES-1") != 70 || onHand("CAP-1") != 40 {
+		t.Errorf("expected 10 RES-1 left in staging and nothing more issued, got %+v (%g/%g on hand)", res, onHand("RES-1"), onHand("CAP-1"))
+	}
+	if w := postPicks(t, "picks/return", `{"returns":[{"ipn":"CAP-1","qty":1}]}`); w.Code != 400 {
+		t.Errorf("expected the used CAP-1 not to be returnable, got %d %s", w.Code, w.Body.String())
+	}
+	if w := postPicks(t, "picks/return", `{"returns":[{"ipn":"RES-1","qty":10}]}`); w.Code != 200 || onHand("RES-1") != 80 {
+		t.Errorf("expected the 10 left over returned, got %d %s", w.Code, w.Body.String())
+	}
+}
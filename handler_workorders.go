@@ -3,8 +3,9 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"html"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -44,6 +45,9 @@ func handleGetWorkOrder(w http.ResponseWriter, r *http.Request, id string) {
 	wo.StartedAt = sp(sa); wo.CompletedAt = sp(ca)
 	if qtyGood.Valid { good := int(qtyGood.Int64); wo.QtyGood = &good }
 	if qtyScrap.Valid { scrap := int(qtyScrap.Int64); wo.QtyScrap = &scrap }
+	attachChildWorkOrders(&wo)
+	wo.NCRID = reworkNCRID(wo.ID)
+	wo.Customer = workOrderCustomer(db, wo.ID)
 	jsonResp(w, wo)
 }
 
@@ -62,6 +66,8 @@ func handleCreateWorkOrder(w http.ResponseWriter, r *http.Request) {
 	if wo.Priority != "" { validateEnum(ve, "priority", wo.Priority, validWOPriorities) }
 	if wo.Qty < 0 { ve.Add("qty", "must be non-negative") }
 	validateIntRange(ve, "qty", wo.Qty, 1, MaxWorkOrderQty)
+	validateDate(ve, "due_date", wo.DueDate)
+	validateMaxLength(ve, "customer", wo.Customer, 255)
 	if ve.HasErrors() { jsonErr(w, ve.Error(), 400); return }
 
 	wo.ID = nextID("WO", "work_orders", 4)
@@ -69,15 +75,45 @@ func handleCreateWorkOrder(w http.ResponseWriter, r *http.Request) {
 	if wo.Priority == "" { wo.Priority = "normal" }
 	if wo.Qty == 0 { wo.Qty = 1 }
 	now := time.Now().Format("2006-01-02 15:04:05")
-	_, err := db.Exec("INSERT INTO work_orders (id,assembly_ipn,qty,qty_good,qty_scrap,status,priority,notes,created_at) VALUES (?,?,?,?,?,?,?,?,?)",
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("INSERT INTO work_orders (id,assembly_ipn,qty,qty_good,qty_scrap,status,priority,notes,created_at) VALUES (?,?,?,?,?,?,?,?,?)",
 		wo.ID, wo.AssemblyIPN, wo.Qty, wo.QtyGood, wo.QtyScrap, wo.Status, wo.Priority, wo.Notes, now)
 	if err != nil {
 		jsonErr(w, err.Error(), 500)
 		return
 	}
+	if wo.DueDate != "" {
+		if _, err = tx.Exec("UPDATE work_orders SET due_date=? WHERE id=?", wo.DueDate, wo.ID); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+	}
+	if wo.Customer != "" {
+		if _, err = tx.Exec("UPDATE work_orders SET customer=? WHERE id=?", wo.Customer, wo.ID); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+	}
+	// Release the WO with the assembly's current routing as its operations
+	if _, err = instantiateWorkOrderOperations(tx, wo.ID, wo.AssemblyIPN); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
 	wo.CreatedAt = now
 	logAudit(db, getUsername(r), "created", "workorder", wo.ID, "Created WO "+wo.ID+" for "+wo.AssemblyIPN)
 	recordChangeJSON(getUsername(r), "work_orders", wo.ID, "create", nil, wo)
+	// Short sub-assemblies get child WOs or show up as proposals
+	autoCreateChildWorkOrders(wo.ID, getUsername(r), 0)
+	attachChildWorkOrders(&wo)
 	jsonResp(w, wo)
 }
 
@@ -118,9 +154,26 @@ func handleUpdateWorkOrder(w http.ResponseWriter, r *http.Request, id string) {
 	if wo.Qty < 0 { ve.Add("qty", "must be non-negative") }
 	if wo.QtyGood != nil && *wo.QtyGood < 0 { ve.Add("qty_good", "must be non-negative") }
 	if wo.QtyScrap != nil && *wo.QtyScrap < 0 { ve.Add("qty_scrap", "must be non-negative") }
+	validateDate(ve, "due_date", wo.DueDate)
+	validateMaxLength(ve, "customer", wo.Customer, 255)
 	if ve.HasErrors() { jsonErr(w, ve.Error(), 400); return }
 
+	// A parent WO waits for its child WOs unless told to start anyway
+	if wo.Status == "in_progress" && currentWO.Status != "in_progress" && !wo.OverrideChildWOs {
+		if msg := childWOStartBlock(id); msg != "" {
+			jsonErr(w, msg, 400)
+			return
+		}
+	}
+
 	now := time.Now().Format("2006-01-02 15:04:05")
+	// Rework orders return their units and material differently
+	ncrID := reworkNCRID(id)
+	// Staged material the close will use, read before the transaction
+	var stagedUse map[string]float64
+	if wo.Status == "completed" && currentWO.Status != "completed" && ncrID == "" {
+		stagedUse = stagedUseForClose(id, wo.AssemblyIPN, wo.Qty)
+	}
 	
 	// Start transaction for atomic updates
 	tx, err := db.Begin()
@@ -131,17 +184,50 @@ func handleUpdateWorkOrder(w http.ResponseWriter, r *http.Request, id string) {
 	defer tx.Rollback()
 
 	// Update work order
-	_, err = tx.Exec("UPDATE work_orders SET assembly_ipn=?,qty=?,qty_good=?,qty_scrap=?,status=?,priority=?,notes=?,started_at=CASE WHEN ?='in_progress' AND started_at IS NULL THEN ? ELSE started_at END,completed_at=CASE WHEN ?='completed' THEN ? ELSE completed_at END WHERE id=?",
+	_, err = tx.Exec("UPDATE work_orders SET assembly_ipn=?,qty=?,qty_good=COALESCE(?,qty_good),qty_scrap=COALESCE(?,qty_scrap),status=?,priority=?,notes=?,started_at=CASE WHEN ?='in_progress' AND started_at IS NULL THEN ? ELSE started_at END,completed_at=CASE WHEN ?='completed' THEN ? ELSE completed_at END WHERE id=?",
 		wo.AssemblyIPN, wo.Qty, wo.QtyGood, wo.QtyScrap, wo.Status, wo.Priority, wo.Notes, wo.Status, now, wo.Status, now, id)
 	if err != nil {
 		jsonErr(w, err.Error(), 500)
 		return
 	}
+	if wo.DueDate != "" {
+		if _, err = tx.Exec("UPDATE work_orders SET due_date=? WHERE id=?", wo.DueDate, id); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+	}
+	if wo.Customer != "" {
+		if _, err = tx.Exec("UPDATE work_orders SET customer=? WHERE id=?", wo.Customer, id); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+	}
+	if wo.OverrideChildWOs {
+		if _, err = tx.Exec("UPDATE work_orders SET child_wo_override=1 WHERE id=?", id); err != nil {
+			jsonErr(w, err.Error(), 500)
+			return
+		}
+	}
 
-	// Handle inventory integration on completion
+	// Handle inventory integration on completion. Units already received by
+	// partial completions aren't received again: closing the WO receives the
+	// good count less what is in stock already.
 	if wo.Status == "completed" && currentWO.Status != "completed" {
-		err = handleWorkOrderCompletion(tx, id, wo.AssemblyIPN, wo.Qty, getUsername(r))
-		if err != nil {
+		received, scrapped := 0, 0
+		tx.QueryRow("SELECT COALESCE(SUM(qty),0) FROM wo_completions WHERE wo_id=? AND event_type='complete' AND reversed_at IS NULL", id).Scan(&received)
+		if currentWO.QtyScrap != nil { scrapped = *currentWO.QtyScrap }
+		if wo.QtyScrap != nil { scrapped = *wo.QtyScrap }
+		good := wo.Qty - scrapped
+		if wo.QtyGood != nil { good = *wo.QtyGood }
+		fg := good - received
+		if fg < 0 { fg = 0 }
+		if wo.QtyGood == nil {
+			if _, err = tx.Exec("UPDATE work_orders SET qty_good=? WHERE id=?", received+fg, id); err != nil {
+				jsonErr(w, err.Error(), 500)
+				return
+			}
+		}
+		if err = closeWorkOrder(tx, id, wo.AssemblyIPN, ncrID, fg, stagedUse, getUsername(r)); err != nil {
 			jsonErr(w, "failed to update inventory on completion: "+err.Error(), 500)
 			return
 		}
@@ -149,6 +235,12 @@ func handleUpdateWorkOrder(w http.ResponseWriter, r *http.Request, id string) {
 
 	// Handle inventory reservation release on cancellation
 	if wo.Status == "cancelled" && currentWO.Status != "cancelled" {
+		if ncrID != "" {
+			if err = cancelReworkOrder(tx, id); err != nil {
+				jsonErr(w, "failed to return rework material on cancellation: "+err.Error(), 500)
+				return
+			}
+		}
 		err = handleWorkOrderCancellation(tx, id)
 		if err != nil {
 			jsonErr(w, "failed to release inventory on cancellation: "+err.Error(), 500)
@@ -162,6 +254,15 @@ func handleUpdateWorkOrder(w http.ResponseWriter, r *http.Request, id string) {
 	}
 
 	logAudit(db, getUsername(r), "updated", "workorder", id, "Updated WO "+id+": status="+wo.Status)
+	if wo.OverrideChildWOs {
+		logAudit(db, getUsername(r), "updated", "workorder", id, "Overrode child WO check on WO "+id)
+	}
+	if wo.Status == "open" && currentWO.Status == "draft" && ncrID == "" {
+		autoCreateChildWorkOrders(id, getUsername(r), 0)
+	}
+	if ncrID != "" && woClosed(wo.Status) && !woClosed(currentWO.Status) {
+		rollUpNCRRework(ncrID, getUsername(r))
+	}
 	newSnap, _ := getWorkOrderSnapshot(id)
 	recordChangeJSON(getUsername(r), "work_orders", id, "update", oldSnap, newSnap)
 	go emailOnOverdueWorkOrder(id)
@@ -192,6 +293,27 @@ func isValidStatusTransition(from, to string) bool {
 	return false
 }
 
+// closeWorkOrder is the inventory side of closing a WO with qty good units
+// still to put away, whether it is closed directly or by its last routing
+// operation. Rework orders (ncrID set) return the units they pulled; other
+// WOs receive their output, consume their reservations and use up the
+// staged material in stagedUse. Read ncrID with reworkNCRID and stagedUse
+// with stagedUseForClose before starting the transaction.
+func closeWorkOrder(tx *sql.Tx, woID, assemblyIPN, ncrID string, qty int, stagedUse map[string]float64, username string) error {
+	if ncrID != "" {
+		return completeReworkOrder(tx, woID, assemblyIPN, qty, username)
+	}
+	if err := handleWorkOrderCompletion(tx, woID, assemblyIPN, qty, username); err != nil {
+		return err
+	}
+	for ipn, q := range stagedUse {
+		if _, err := consumeStaged(tx, woID, ipn, q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func handleWorkOrderCompletion(tx *sql.Tx, woID, assemblyIPN string, qty int, username string) error {
 	now := time.Now().Format("2006-01-02 15:04:05")
 	
@@ -210,85 +332,210 @@ func handleWorkOrderCompletion(tx *sql.Tx, woID, assemblyIPN string, qty int, us
 		return fmt.Errorf("failed to update finished goods inventory: %w", err)
 	}
 	
-	// Log finished goods transaction
-	_, err = tx.Exec("INSERT INTO inventory_transactions (ipn,type,qty,reference,notes,created_at) VALUES (?,?,?,?,?,?)",
-		assemblyIPN, "receive", qty, woID, "WO "+woID+" completion", now)
-	if err != nil {
-		return fmt.Errorf("failed to log finished goods transaction: %w", err)
+	// Finished goods go into a lot named after the WO so they can be traced
+	// into the builds they are used in. Nothing is received when no good
+	// units are left to put away.
+	if qty > 0 {
+		lotID, err := createLot(tx, InventoryLot{IPN: assemblyIPN, WOID: woID, QtyReceived: float64(qty),
+			QtyOnHand: float64(qty), ReceivedAt: &now}, woID)
+		if err != nil {
+			return err
+		}
+		if err := recordLotTransaction(tx, lotID, assemblyIPN, "receive", float64(qty), woID, "WO "+woID+" completion", now); err != nil {
+			return fmt.Errorf("failed to log finished goods transaction: %w", err)
+		}
 	}
 	
-	// 2. Deduct consumed materials based on BOM (simplified - using all inventory items for now)
-	rows, err := tx.Query("SELECT ipn, qty_reserved FROM inventory WHERE qty_reserved > 0")
+	// Anyone still clocked in to the WO is clocked out as of completion
+	if err := clockOutWorkOrder(tx, woID, time.Now()); err != nil {
+		return err
+	}
+
+	// 2. Consume the materials reserved for this work order only, the
+	// customer's own stock first
+	reserved, err := openReservationsFor(tx, "work_order", woID)
 	if err != nil {
-		return fmt.Errorf("failed to query reserved materials: %w", err)
+		return err
 	}
-	defer rows.Close()
-	
-	for rows.Next() {
-		var ipn string
-		var reserved float64
-		if err := rows.Scan(&ipn, &reserved); err != nil {
+	customer := workOrderCustomer(tx, woID)
+	for ipn, qtyReserved := range reserved {
+		consumed, err := consumeReservation(tx, "work_order", woID, ipn, qtyReserved)
+		if err != nil {
+			return err
+		}
+		if consumed <= 0 {
 			continue
 		}
-		
-		// Consume the reserved quantity
-		// TODO: Track which inventory is reserved for which WO to avoid consuming
-		// inventory reserved for other WOs
-		consumed := reserved
-		
-		// Deduct from on_hand and release reservation
-		_, err = tx.Exec("UPDATE inventory SET qty_on_hand = qty_on_hand - ?, qty_reserved = qty_reserved - ?, updated_at = ? WHERE ipn = ?",
-			consumed, reserved, now, ipn)
+
+		_, err = tx.Exec("UPDATE inventory SET qty_on_hand = qty_on_hand - ?, updated_at = ? WHERE ipn = ?",
+			consumed, now, ipn)
 		if err != nil {
 			return fmt.Errorf("failed to consume material %s: %w", ipn, err)
 		}
-		
-		// Log material consumption
-		_, err = tx.Exec("INSERT INTO inventory_transactions (ipn,type,qty,reference,notes,created_at) VALUES (?,?,?,?,?,?)",
-			ipn, "issue", consumed, woID, "WO "+woID+" material consumption", now)
+		if err := takeOwnedStock(tx, ipn, consumed, customer, woID, "WO "+woID+" material consumption", username, now); err != nil {
+			return err
+		}
+
+		// Log material consumption, oldest usable lots first. Reserved
+		// material that expired or was quarantined during the build was
+		// used all the same, so it doesn't hold up the close.
+		picks, err := closeLotPicks(tx, ipn, consumed, time.Now())
 		if err != nil {
+			return err
+		}
+		if _, err := issueFromLots(tx, ipn, consumed, picks, "issue", woID, "WO "+woID+" material consumption", now); err != nil {
 			return fmt.Errorf("failed to log material consumption: %w", err)
 		}
 	}
-	
-	return nil
+
+	// 3. The output carries the component cost the WO consumed
+	return capitalizeWO(tx, woID, assemblyIPN, float64(qty), 0, true, now)
 }
 
 func handleWorkOrderCancellation(tx *sql.Tx, woID string) error {
-	now := time.Now().Format("2006-01-02 15:04:05")
-	
-	// Release all reserved inventory for this work order
-	// (Simplified implementation: releases ALL reserved inventory)
-	// TODO: Track which inventory items are reserved for which WO
-	rows, err := tx.Query("SELECT ipn, qty_reserved FROM inventory WHERE qty_reserved > 0")
+	if err := clockOutWorkOrder(tx, woID, time.Now()); err != nil {
+		return err
+	}
+	// Release only the reservations held by this work order; stock reserved
+	// for other WOs and sales orders is left alone
+	return releaseReservations(tx, "work_order", woID)
+}
+
+// WOBOMLine is one rolled-up material requirement of a work order, netted
+// against stock that isn't already reserved for something else.
+type WOBOMLine struct {
+	IPN              string  `json:"ipn"`
+	Description      string  `json:"description"`
+	MPN              string  `json:"mpn"`
+	Manufacturer     string  `json:"manufacturer"`
+	RefDes           string  `json:"ref_des"`
+	QtyPer           float64 `json:"qty_per"`
+	QtyRequired      float64 `json:"qty_required"`
+	QtyOnHand        float64 `json:"qty_on_hand"`
+	QtyReserved      float64 `json:"qty_reserved"`
+	QtyReservedOther float64 `json:"qty_reserved_other"`
+	QtyAvailable     float64 `json:"qty_available"`
+	Shortage         float64 `json:"shortage"`
+	Status           string  `json:"status"`
+	SubAssembly      bool    `json:"sub_assembly"`
+}
+
+// phantomAssemblies returns the IPNs of the sub-assemblies built in line
+// with their parent rather than pulled from stock. Only parts flagged with a
+// "phantom" column are; every other sub-assembly is stocked, whether or not
+// it has an inventory record yet. An IPN's rows in every parts file are
+// checked, as it also appears in its parents' BOMs without the flag. The
+// parts directory is read once, so callers load this once per explode.
+func phantomAssemblies() map[string]bool {
+	phantom := map[string]bool{}
+	if partsDir == "" {
+		return phantom
+	}
+	cats, _, _, err := loadPartsFromDir()
 	if err != nil {
-		return fmt.Errorf("failed to query reserved materials: %w", err)
+		return phantom
+	}
+	for _, parts := range cats {
+		for _, p := range parts {
+			for k, v := range p.Fields {
+				if strings.EqualFold(k, "phantom") {
+					switch strings.ToLower(strings.TrimSpace(v)) {
+					case "1", "y", "yes", "true":
+						phantom[p.IPN] = true
+					}
+				}
+			}
+		}
 	}
-	defer rows.Close()
-	
-	for rows.Next() {
-		var ipn string
-		var reserved float64
-		if err := rows.Scan(&ipn, &reserved); err != nil {
-			continue
+	return phantom
+}
+
+// explodeWorkOrderBOM flattens the assembly's multi-level BOM into one line
+// per IPN. Quantities are multiplied down through phantom sub-assemblies and
+// rolled up across every place a part is used; stocked sub-assemblies are
+// kept as a single line and not exploded further. Each line is netted
+// against on-hand minus what other orders have reserved, so stock already
+// reserved by woID counts as available to it.
+func explodeWorkOrderBOM(woID, assemblyIPN string, qty int) ([]WOBOMLine, error) {
+	root, err := buildBOMTree(assemblyIPN, 0, 5)
+	if err != nil {
+		return nil, err
+	}
+
+	phantom := phantomAssemblies()
+	lines := map[string]*WOBOMLine{}
+	var order []string
+	var walk func(node BOMNode, multiplier float64)
+	walk = func(node BOMNode, multiplier float64) {
+		for _, child := range node.Children {
+			perAssembly := child.Qty * multiplier
+			subAssembly := len(child.Children) > 0
+			if subAssembly && phantom[child.IPN] {
+				walk(child, perAssembly)
+				continue
+			}
+			line, ok := lines[child.IPN]
+			if !ok {
+				line = &WOBOMLine{IPN: child.IPN, Description: child.Description, SubAssembly: subAssembly}
+				lines[child.IPN] = line
+				order = append(order, child.IPN)
+			}
+			line.QtyPer += perAssembly
+			if child.Ref != "" {
+				if line.RefDes != "" {
+					line.RefDes += ","
+				}
+				line.RefDes += child.Ref
+			}
 		}
-		
-		// Release the reservation (don't consume inventory)
-		_, err = tx.Exec("UPDATE inventory SET qty_reserved = qty_reserved - ?, updated_at = ? WHERE ipn = ?",
-			reserved, now, ipn)
-		if err != nil {
-			return fmt.Errorf("failed to release reservation for %s: %w", ipn, err)
+	}
+	walk(*root, 1)
+
+	sort.Strings(order)
+	result := make([]WOBOMLine, 0, len(order))
+	for _, ipn := range order {
+		line := lines[ipn]
+		line.QtyRequired = line.QtyPer * float64(qty)
+
+		var totalReserved float64
+		db.QueryRow("SELECT qty_on_hand, qty_reserved FROM inventory WHERE ipn=?", ipn).Scan(&line.QtyOnHand, &totalReserved)
+		if woID != "" && totalReserved > 0 {
+			db.QueryRow(`SELECT COALESCE(SUM(qty),0) FROM inventory_reservations
+				WHERE ref_type='work_order' AND ref_id=? AND ipn=? AND status='open'`, woID, ipn).Scan(&line.QtyReserved)
 		}
-		
-		// Log the reservation release
-		_, err = tx.Exec("INSERT INTO inventory_transactions (ipn,type,qty,reference,notes,created_at) VALUES (?,?,?,?,?,?)",
-			ipn, "return", reserved, woID, "WO "+woID+" cancelled - reservation released", now)
-		if err != nil {
-			return fmt.Errorf("failed to log reservation release: %w", err)
+		line.QtyReservedOther = totalReserved - line.QtyReserved
+		// Expired, quarantined and held lots can't be kitted
+		line.QtyAvailable = line.QtyOnHand - line.QtyReservedOther - unusableLotStock(db, ipn, time.Now())
+		if line.QtyAvailable < 0 {
+			line.QtyAvailable = 0
+		}
+		line.Shortage = line.QtyRequired - line.QtyAvailable
+		if line.Shortage < 0 {
+			line.Shortage = 0
 		}
+		if line.Shortage == 0 {
+			line.Status = "ok"
+		} else if line.QtyAvailable > 0 {
+			line.Status = "low"
+		} else {
+			line.Status = "shortage"
+		}
+
+		if fields, ferr := getPartByIPN(partsDir, ipn); ferr == nil {
+			for k, v := range fields {
+				kl := strings.ToLower(k)
+				if (kl == "description" || kl == "desc") && line.Description == "" {
+					line.Description = v
+				} else if kl == "mpn" {
+					line.MPN = v
+				} else if kl == "manufacturer" || kl == "mfr" {
+					line.Manufacturer = v
+				}
+			}
+		}
+		result = append(result, *line)
 	}
-	
-	return nil
+	return result, nil
 }
 
 func handleWorkOrderBOM(w http.ResponseWriter, r *http.Request, id string) {
@@ -297,51 +544,14 @@ func handleWorkOrderBOM(w http.ResponseWriter, r *http.Request, id string) {
 	err := db.QueryRow("SELECT assembly_ipn,qty FROM work_orders WHERE id=?", id).Scan(&assemblyIPN, &qty)
 	if err != nil { jsonErr(w, "not found", 404); return }
 
-	type BOMLine struct {
-		IPN         string  `json:"ipn"`
-		Description string  `json:"description"`
-		QtyRequired float64 `json:"qty_required"`
-		QtyOnHand   float64 `json:"qty_on_hand"`
-		Shortage    float64 `json:"shortage"`
-		Status      string  `json:"status"`
-	}
-	
-	// PERFORMANCE NOTE: This loads all inventory instead of actual BOM from CSV.
-	// TODO: Use buildBOMTree() from handler_parts.go to get real BOM, then query only those IPNs
-	// Current optimization: Filter to only parts with stock or reserved quantities
-	rows, _ := db.Query(`SELECT ipn, qty_on_hand FROM inventory 
-		WHERE qty_on_hand > 0 OR qty_reserved > 0 
-		ORDER BY ipn LIMIT 1000`)
-	var bom []BOMLine
-	if rows != nil {
-		defer rows.Close()
-		for rows.Next() {
-			var bl BOMLine
-			rows.Scan(&bl.IPN, &bl.QtyOnHand)
-			bl.QtyRequired = float64(qty)
-			bl.Shortage = bl.QtyRequired - bl.QtyOnHand
-			if bl.Shortage < 0 { bl.Shortage = 0 }
-			if bl.QtyOnHand >= bl.QtyRequired {
-				bl.Status = "ok"
-			} else if bl.QtyOnHand > 0 {
-				bl.Status = "low"
-			} else {
-				bl.Status = "shortage"
-			}
-			fields, err := getPartByIPN(partsDir, bl.IPN)
-			if err == nil {
-				for k, v := range fields {
-					if strings.EqualFold(k, "description") || strings.EqualFold(k, "desc") {
-						bl.Description = v
-						break
-					}
-				}
-			}
-			bom = append(bom, bl)
-		}
+	bom, err := explodeWorkOrderBOM(id, assemblyIPN, qty)
+	if err != nil { jsonErr(w, err.Error(), 500); return }
+
+	var shortages int
+	for _, bl := range bom {
+		if bl.Shortage > 0 { shortages++ }
 	}
-	if bom == nil { bom = []BOMLine{} }
-	jsonResp(w, map[string]interface{}{"wo_id": id, "assembly_ipn": assemblyIPN, "qty": qty, "bom": bom})
+	jsonResp(w, map[string]interface{}{"wo_id": id, "assembly_ipn": assemblyIPN, "qty": qty, "bom": bom, "shortage_count": shortages})
 }
 
 func handleWorkOrderPDF(w http.ResponseWriter, r *http.Request, id string) {
@@ -355,141 +565,63 @@ func handleWorkOrderPDF(w http.ResponseWriter, r *http.Request, id string) {
 	}
 	wo.StartedAt = sp(sa)
 	wo.CompletedAt = sp(ca)
+	db.QueryRow("SELECT COALESCE(due_date,''), COALESCE(parent_wo_id,'') FROM work_orders WHERE id=?", id).Scan(&wo.DueDate, &wo.ParentWOID)
 
-	type BOMLine struct {
-		IPN          string
-		Description  string
-		MPN          string
-		Manufacturer string
-		QtyRequired  float64
-		QtyOnHand    float64
-		RefDes       string
+	data := TravelerPrint{Company: printCompany(), Generated: time.Now().Format("2006-01-02 15:04"), WO: wo, Date: wo.CreatedAt}
+	if len(data.Date) > 10 {
+		data.Date = data.Date[:10]
 	}
-	
-	// PERFORMANCE NOTE: This loads all inventory instead of actual BOM from CSV.
-	// TODO: Use buildBOMTree() from handler_parts.go to get real BOM, then query only those IPNs
-	// Current optimization: Filter to only parts with stock or reserved quantities
-	rows, _ := db.Query(`SELECT ipn, qty_on_hand FROM inventory 
-		WHERE qty_on_hand > 0 OR qty_reserved > 0 
-		ORDER BY ipn LIMIT 1000`)
-	var bom []BOMLine
-	if rows != nil {
-		defer rows.Close()
-		for rows.Next() {
-			var bl BOMLine
-			rows.Scan(&bl.IPN, &bl.QtyOnHand)
-			bl.QtyRequired = float64(wo.Qty)
-			fields, ferr := getPartByIPN(partsDir, bl.IPN)
-			if ferr == nil {
-				for k, v := range fields {
-					kl := strings.ToLower(k)
-					if kl == "description" || kl == "desc" {
-						bl.Description = v
-					} else if kl == "mpn" {
-						bl.MPN = v
-					} else if kl == "manufacturer" || kl == "mfr" {
-						bl.Manufacturer = v
-					} else if kl == "reference" || kl == "refdes" || kl == "ref_des" {
-						bl.RefDes = v
+	data.BOM, _ = explodeWorkOrderBOM(wo.ID, wo.AssemblyIPN, wo.Qty)
+
+	if fields, ferr := getPartByIPN(partsDir, wo.AssemblyIPN); ferr == nil {
+		for k, v := range fields {
+			if strings.EqualFold(k, "description") || strings.EqualFold(k, "desc") {
+				data.Description = v
+				break
+			}
+		}
+	}
+
+	// Routing: the WO's own operations, or the assembly's template for a WO
+	// released before its routing existed
+	ops, _ := loadWorkOrderOperations(db, wo.ID)
+	if len(ops) > 0 {
+		for _, op := range ops {
+			st := TravelerStep{Seq: op.Seq, Name: op.Name, WorkCenter: op.WorkCenterName}
+			if op.Status == "completed" {
+				st.QtyGood, st.QtyScrap = strconv.Itoa(op.QtyGood), strconv.Itoa(op.QtyScrap)
+			}
+			if op.Status == "completed" || op.Status == "skipped" {
+				st.Operator = op.CompletedBy
+				if op.CompletedAt != nil {
+					st.Date = *op.CompletedAt
+					if len(st.Date) > 10 {
+						st.Date = st.Date[:10]
 					}
 				}
 			}
-			bom = append(bom, bl)
+			if op.Status == "skipped" {
+				st.QtyGood = "skipped"
+			}
+			data.Routing = append(data.Routing, st)
+		}
+	} else if steps, _ := loadRoutingSteps(wo.AssemblyIPN); len(steps) > 0 {
+		for _, st := range steps {
+			data.Routing = append(data.Routing, TravelerStep{Seq: st.Seq, Name: st.Name, WorkCenter: st.WorkCenterID})
 		}
 	}
 
-	assemblyDesc := ""
-	if fields, ferr := getPartByIPN(partsDir, wo.AssemblyIPN); ferr == nil {
-		for k, v := range fields {
-			if strings.EqualFold(k, "description") || strings.EqualFold(k, "desc") {
-				assemblyDesc = v
-				break
+	if rows, err := db.Query("SELECT serial_number, COALESCE(status,'') FROM wo_serials WHERE wo_id=? ORDER BY serial_number", wo.ID); err == nil {
+		for rows.Next() {
+			var s TravelerSerial
+			if rows.Scan(&s.SerialNumber, &s.Status) == nil {
+				data.Serials = append(data.Serials, s)
 			}
 		}
+		rows.Close()
 	}
 
-	bomRows := ""
-	for _, bl := range bom {
-		bomRows += fmt.Sprintf(`<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td style="text-align:center">%.0f</td><td>%s</td></tr>`,
-			html.EscapeString(bl.IPN), html.EscapeString(bl.Description), html.EscapeString(bl.MPN), html.EscapeString(bl.Manufacturer), bl.QtyRequired, html.EscapeString(bl.RefDes))
-	}
-	if bomRows == "" {
-		bomRows = `<tr><td colspan="6" style="text-align:center;color:#999">No BOM data</td></tr>`
-	}
-
-	date := wo.CreatedAt
-	if len(date) > 10 {
-		date = date[:10]
-	}
-
-	htmlOutput := fmt.Sprintf(`<!DOCTYPE html>
-<html><head><meta charset="UTF-8"><title>Work Order Traveler — %s</title>
-<style>
-  * { margin: 0; padding: 0; box-sizing: border-box; }
-  body { font-family: Arial, Helvetica, sans-serif; font-size: 11pt; color: #000; padding: 0.5in; }
-  h1 { font-size: 18pt; margin-bottom: 2pt; }
-  h2 { font-size: 13pt; margin: 16pt 0 6pt; border-bottom: 2px solid #000; padding-bottom: 3pt; }
-  table { width: 100%%; border-collapse: collapse; margin-bottom: 12pt; }
-  th, td { border: 1px solid #000; padding: 4pt 6pt; text-align: left; font-size: 10pt; }
-  th { background: #eee; font-weight: bold; }
-  .header { display: flex; justify-content: space-between; align-items: flex-start; border-bottom: 3px solid #000; padding-bottom: 8pt; margin-bottom: 12pt; }
-  .header-left { }
-  .header-right { text-align: right; font-size: 10pt; }
-  .info-grid { display: grid; grid-template-columns: 1fr 1fr; gap: 4pt 20pt; margin-bottom: 12pt; font-size: 10pt; }
-  .info-grid dt { font-weight: bold; }
-  .signoff td { height: 40pt; vertical-align: bottom; }
-  .signoff td.label-cell { width: 120pt; font-weight: bold; }
-  @media print { body { padding: 0; } @page { margin: 0.5in; } }
-</style>
-</head><body>
-<div class="header">
-  <div class="header-left">
-    <h1>ZRP — Work Order Traveler</h1>
-    <div style="font-size:10pt;color:#555">`+companyName+`</div>
-  </div>
-  <div class="header-right">
-    <div><strong>WO:</strong> %s</div>
-    <div><strong>Date:</strong> %s</div>
-    <div><strong>Status:</strong> %s</div>
-    <div><strong>Priority:</strong> %s</div>
-  </div>
-</div>
-
-<h2>Assembly Information</h2>
-<div class="info-grid">
-  <dt>Assembly IPN:</dt><dd>%s</dd>
-  <dt>Description:</dt><dd>%s</dd>
-  <dt>Quantity:</dt><dd>%d</dd>
-  <dt>Notes:</dt><dd>%s</dd>
-</div>
-
-<h2>Bill of Materials</h2>
-<table>
-  <thead><tr><th>IPN</th><th>Description</th><th>MPN</th><th>Manufacturer</th><th>Qty Req</th><th>Ref Des</th></tr></thead>
-  <tbody>%s</tbody>
-</table>
-
-<h2>Sign-Off</h2>
-<table class="signoff">
-  <thead><tr><th style="width:120pt">Step</th><th>Name</th><th style="width:100pt">Date</th><th>Signature</th></tr></thead>
-  <tbody>
-    <tr><td class="label-cell">Kitted by</td><td></td><td></td><td></td></tr>
-    <tr><td class="label-cell">Built by</td><td></td><td></td><td></td></tr>
-    <tr><td class="label-cell">Tested by</td><td></td><td></td><td></td></tr>
-    <tr><td class="label-cell">QA Approved by</td><td></td><td></td><td></td></tr>
-  </tbody>
-</table>
-
-<script>window.onload = () => window.print()</script>
-</body></html>`,
-		html.EscapeString(wo.ID), html.EscapeString(wo.ID), html.EscapeString(date), html.EscapeString(wo.Status), html.EscapeString(wo.Priority),
-		html.EscapeString(wo.AssemblyIPN), html.EscapeString(assemblyDesc), wo.Qty, html.EscapeString(wo.Notes), bomRows)
-
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.Header().Set("X-Frame-Options", "DENY")
-	w.Write([]byte(htmlOutput))
+	renderPrintDocument(w, r, "traveler", "html", "traveler_"+wo.ID, data)
 }
 
 func handleWorkOrderKit(w http.ResponseWriter, r *http.Request, id string) {
@@ -509,7 +641,6 @@ func handleWorkOrderKit(w http.ResponseWriter, r *http.Request, id string) {
 		return
 	}
 
-	// Get BOM requirements (simplified - using inventory as BOM for now)
 	type KitResult struct {
 		IPN         string  `json:"ipn"`
 		Required    float64 `json:"required"`
@@ -519,29 +650,13 @@ func handleWorkOrderKit(w http.ResponseWriter, r *http.Request, id string) {
 		Status      string  `json:"status"`
 	}
 
-	// First, read all inventory data (close cursor before starting transaction)
-	rows, err := db.Query("SELECT ipn, qty_on_hand, qty_reserved FROM inventory")
+	// Requirements come from the exploded BOM (read before starting the transaction)
+	bom, err := explodeWorkOrderBOM(id, assemblyIPN, qty)
 	if err != nil {
 		jsonErr(w, err.Error(), 500)
 		return
 	}
-	
-	type inventorySnapshot struct {
-		ipn      string
-		onHand   float64
-		reserved float64
-	}
-	var snapshots []inventorySnapshot
-	
-	for rows.Next() {
-		var snap inventorySnapshot
-		err := rows.Scan(&snap.ipn, &snap.onHand, &snap.reserved)
-		if err != nil {
-			continue
-		}
-		snapshots = append(snapshots, snap)
-	}
-	rows.Close() // Close the query before starting transaction
+	picked, _ := woPickTotals(id)
 
 	var kitResults []KitResult
 	
@@ -552,45 +667,57 @@ func handleWorkOrderKit(w http.ResponseWriter, r *http.Request, id string) {
 	}
 	defer tx.Rollback()
 
-	// Now process each inventory item within the transaction
-	for _, snap := range snapshots {
+	// Quantities this WO already holds or has picked, so re-kitting only
+	// tops up the shortfall
+	held, err := openReservationsFor(tx, "work_order", id)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	username := getUsername(r)
+
+	for _, bl := range bom {
 		var result KitResult
-		result.IPN = snap.ipn
-		result.OnHand = snap.onHand
-		result.Reserved = snap.reserved
-		result.Required = float64(qty) // Simple 1:1 ratio for now
+		result.IPN = bl.IPN
+		result.OnHand = bl.QtyOnHand
+		result.Reserved = bl.QtyReserved + bl.QtyReservedOther
+		result.Required = bl.QtyRequired
 		available := result.OnHand - result.Reserved
-		
-		if available >= result.Required {
+		have := held[bl.IPN] + picked[bl.IPN]
+		toReserve := result.Required - have
+
+		if toReserve <= 0 {
+			result.Kitted = result.Required
+			result.Status = "kitted"
+		} else if available >= toReserve {
 			// Reserve the materials
 			result.Kitted = result.Required
 			result.Status = "kitted"
-			_, err = tx.Exec("UPDATE inventory SET qty_reserved = qty_reserved + ? WHERE ipn = ?", 
-				result.Required, result.IPN)
-			if err != nil {
+			if err := reserveInventory(tx, "work_order", id, result.IPN, toReserve, username); err != nil {
 				result.Status = "error"
-				result.Kitted = 0
+				result.Kitted = have
 			}
 		} else if available > 0 {
 			// Partial kit
-			result.Kitted = available
+			result.Kitted = have + available
 			result.Status = "partial"
-			_, err = tx.Exec("UPDATE inventory SET qty_reserved = qty_reserved + ? WHERE ipn = ?", 
-				available, result.IPN)
-			if err != nil {
+			if err := reserveInventory(tx, "work_order", id, result.IPN, available, username); err != nil {
 				result.Status = "error"
-				result.Kitted = 0
+				result.Kitted = have
 			}
 		} else {
+			result.Kitted = have
 			result.Status = "shortage"
 		}
-		
+
 		kitResults = append(kitResults, result)
 	}
 
 	// Allow kitting to succeed even with partial/shortage - just report the status
-	// In a real system, this would check BOM requirements, not all inventory
 	// Always commit what we can kit
+	if kitResults == nil {
+		kitResults = []KitResult{}
+	}
 	now := time.Now().Format("2006-01-02 15:04:05")
 	_, err = tx.Exec("UPDATE work_orders SET status = CASE WHEN status = 'open' THEN 'in_progress' ELSE status END WHERE id = ?", id)
 	if err != nil {
@@ -640,10 +767,26 @@ func handleWorkOrderSerials(w http.ResponseWriter, r *http.Request, id string) {
 		serials = append(serials, serial)
 	}
 	
+	rows.Close()
+
 	if serials == nil {
 		serials = []WOSerial{}
 	}
-	
+
+	// Attach each unit's as-built components
+	comps, err := loadSerialComponents("c.wo_id=?", id)
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	for i := range serials {
+		for _, c := range comps {
+			if c.ParentSerial == serials[i].SerialNumber {
+				serials[i].Components = append(serials[i].Components, c)
+			}
+		}
+	}
+
 	jsonResp(w, serials)
 }
 
@@ -663,11 +806,15 @@ func handleWorkOrderAddSerial(w http.ResponseWriter, r *http.Request, id string)
 		return
 	}
 
-	var serial WOSerial
-	if err := decodeBody(r, &serial); err != nil {
+	var body struct {
+		WOSerial
+		Components []SerialComponentInput `json:"components"`
+	}
+	if err := decodeBody(r, &body); err != nil {
 		jsonErr(w, "invalid body", 400)
 		return
 	}
+	serial := body.WOSerial
 
 	ve := &ValidationErrors{}
 	if serial.SerialNumber == "" {
@@ -692,23 +839,44 @@ func handleWorkOrderAddSerial(w http.ResponseWriter, r *http.Request, id string)
 		serial.Status = "building" // Default per wo_serials schema CHECK constraint
 	}
 
-	_, err = db.Exec("INSERT INTO wo_serials (wo_id,serial_number,status,notes) VALUES (?,?,?,?)",
+	tx, err := db.Begin()
+	if err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO wo_serials (wo_id,serial_number,status,notes) VALUES (?,?,?,?)",
 		serial.WOID, serial.SerialNumber, serial.Status, serial.Notes)
 	if err != nil {
 		jsonErr(w, err.Error(), 500)
 		return
 	}
 
-	logAudit(db, getUsername(r), "created", "serial", serial.SerialNumber, "Added serial "+serial.SerialNumber+" to WO "+id)
-	
+	// Components scanned while building the unit start its as-built record
+	if len(body.Components) > 0 {
+		added, code, err := addSerialComponents(tx, serial.SerialNumber, id, body.Components, getUsername(r))
+		if err != nil {
+			jsonErr(w, err.Error(), code)
+			return
+		}
+		serial.Components = added
+	}
+
 	// Get the created serial with ID
-	err = db.QueryRow("SELECT id,wo_id,serial_number,status,COALESCE(notes,'') FROM wo_serials WHERE wo_id=? AND serial_number=?", 
+	err = tx.QueryRow("SELECT id,wo_id,serial_number,status,COALESCE(notes,'') FROM wo_serials WHERE wo_id=? AND serial_number=?", 
 		id, serial.SerialNumber).Scan(&serial.ID, &serial.WOID, &serial.SerialNumber, &serial.Status, &serial.Notes)
 	if err != nil {
 		jsonErr(w, err.Error(), 500)
 		return
 	}
-	
+	if err := tx.Commit(); err != nil {
+		jsonErr(w, err.Error(), 500)
+		return
+	}
+
+	logAudit(db, getUsername(r), "created", "serial", serial.SerialNumber, "Added serial "+serial.SerialNumber+" to WO "+id)
+
 	jsonResp(w, serial)
 }
 
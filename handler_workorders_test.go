@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	_ "modernc.org/sqlite"
@@ -32,6 +33,42 @@ func setupWorkOrderTestDB(t *testing.T) *sql.DB {
 			started_at TEXT,
 			completed_at TEXT
 		)`,
+		`CREATE TABLE routing_steps (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			assembly_ipn TEXT NOT NULL,
+			seq INTEGER NOT NULL CHECK(seq > 0),
+			name TEXT NOT NULL,
+			work_center_id TEXT DEFAULT '',
+			instructions TEXT DEFAULT '',
+			std_minutes REAL DEFAULT 0 CHECK(std_minutes >= 0),
+			UNIQUE(assembly_ipn, seq)
+		)`,
+		`CREATE TABLE wo_operations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			wo_id TEXT NOT NULL,
+			seq INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			work_center_id TEXT DEFAULT '',
+			instructions TEXT DEFAULT '',
+			status TEXT DEFAULT 'pending' CHECK(status IN ('pending','in_progress','completed','skipped')),
+			qty_good INTEGER DEFAULT 0 CHECK(qty_good >= 0),
+			qty_scrap INTEGER DEFAULT 0 CHECK(qty_scrap >= 0),
+			started_at DATETIME, started_by TEXT DEFAULT '',
+			completed_at DATETIME, completed_by TEXT DEFAULT '',
+			notes TEXT DEFAULT '',
+			UNIQUE(wo_id, seq)
+		)`,
+		`CREATE TABLE labor_entries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			wo_id TEXT NOT NULL,
+			operation_id INTEGER,
+			username TEXT NOT NULL,
+			clock_in DATETIME NOT NULL,
+			clock_out DATETIME,
+			accrued_at DATETIME NOT NULL,
+			minutes REAL DEFAULT 0 CHECK(minutes >= 0),
+			notes TEXT DEFAULT ''
+		)`,
 		`CREATE TABLE wo_serials (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			wo_id TEXT NOT NULL,
@@ -39,6 +76,42 @@ func setupWorkOrderTestDB(t *testing.T) *sql.DB {
 			status TEXT NOT NULL DEFAULT 'assigned',
 			notes TEXT
 		)`,
+		`CREATE TABLE serial_components (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			parent_serial TEXT NOT NULL,
+			component_type TEXT NOT NULL,
+			child_serial TEXT DEFAULT '',
+			lot_id INTEGER,
+			ipn TEXT DEFAULT '',
+			qty REAL DEFAULT 1,
+			wo_id TEXT DEFAULT '',
+			installed_by TEXT DEFAULT '',
+			installed_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE inventory_lots (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ipn TEXT NOT NULL,
+			lot_number TEXT NOT NULL,
+			date_code TEXT DEFAULT '',
+			vendor_id TEXT DEFAULT '',
+			po_id TEXT DEFAULT '',
+			po_line_id INTEGER,
+			receiving_inspection_id INTEGER,
+			wo_id TEXT DEFAULT '',
+			qty_received REAL DEFAULT 0,
+			qty_on_hand REAL DEFAULT 0,
+			status TEXT DEFAULT 'available',
+			received_at DATETIME,
+			notes TEXT DEFAULT '',
+			location TEXT DEFAULT '',
+			msl_level TEXT DEFAULT '',
+			msl_floor_life_hours REAL,
+			msl_state TEXT DEFAULT 'sealed',
+			msl_exposure_hours REAL DEFAULT 0,
+			msl_opened_at DATETIME,
+			expires_at DATE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
 		`CREATE TABLE inventory (
 			ipn TEXT PRIMARY KEY,
 			qty_on_hand REAL NOT NULL DEFAULT 0,
@@ -57,7 +130,21 @@ func setupWorkOrderTestDB(t *testing.T) *sql.DB {
 			qty REAL NOT NULL,
 			reference TEXT,
 			notes TEXT,
-			created_at TEXT NOT NULL
+			created_at TEXT NOT NULL,
+			lot_id INTEGER
+		)`,
+		`CREATE TABLE inventory_reservations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ref_type TEXT NOT NULL,
+			ref_id TEXT NOT NULL,
+			ipn TEXT NOT NULL,
+			qty REAL NOT NULL DEFAULT 0,
+			qty_consumed REAL NOT NULL DEFAULT 0,
+			status TEXT DEFAULT 'open',
+			created_by TEXT DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			closed_at DATETIME
 		)`,
 		`CREATE TABLE audit_log (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -322,4 +409,159 @@ func TestGenerateSerialNumber(t *testing.T) {
 	}
 }
 
+// setupMultiLevelBOM writes a two-level BOM under a temp partsDir:
+//
+//	ASY-TOP: 2x PCA-PH (flagged phantom), 1x PCA-STK (stocked), 1x RES-001 (R9)
+//	PCA-PH:  3x RES-001 (R1,R2,R3), 1x CAP-001 (C1)
+//	PCA-STK: 5x RES-001
+func setupMultiLevelBOM(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	oldPartsDir := partsDir
+	partsDir = dir
+	t.Cleanup(func() { partsDir = oldPartsDir })
+
+	createBOMFile(t, dir, "z-parts", [][]string{
+		{"IPN", "description", "mpn", "phantom"},
+		{"PCA-PH", "Phantom board", "", "yes"},
+	})
+	createBOMFile(t, dir, "ASY-TOP", [][]string{
+		{"IPN", "qty", "ref"},
+		{"PCA-PH", "2", "A1,A2"},
+		{"PCA-STK", "1", "A3"},
+		{"RES-001", "1", "R9"},
+	})
+	createBOMFile(t, dir, "PCA-PH", [][]string{
+		{"IPN", "qty", "ref"},
+		{"RES-001", "3", "R1,R2,R3"},
+		{"CAP-001", "1", "C1"},
+	})
+	createBOMFile(t, dir, "PCA-STK", [][]string{
+		{"IPN", "qty", "ref"},
+		{"RES-001", "5", "R1-R5"},
+	})
+}
+
+func TestExplodeWorkOrderBOM_MultiLevel(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	setupMultiLevelBOM(t)
+
+	db.Exec(`INSERT INTO inventory (ipn, qty_on_hand) VALUES ('RES-001', 30), ('PCA-STK', 4), ('UNUSED-001', 500)`)
+	db.Exec(`INSERT INTO work_orders (id, assembly_ipn, qty, status, created_at) VALUES ('WO-BOM', 'ASY-TOP', 4, 'open', '2026-01-01 00:00:00')`)
+	tx, _ := db.Begin()
+	reserveInventory(tx, "work_order", "WO-OTHER", "RES-001", 10, "tester")
+	reserveInventory(tx, "work_order", "WO-BOM", "RES-001", 5, "tester")
+	tx.Commit()
+
+	req := httptest.NewRequest("GET", "/api/v1/workorders/WO-BOM/bom", nil)
+	w := httptest.NewRecorder()
+	handleWorkOrderBOM(w, req, "WO-BOM")
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp struct {
+		Data struct {
+			BOM           []WOBOMLine `json:"bom"`
+			ShortageCount int         `json:"shortage_count"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	lines := map[string]WOBOMLine{}
+	for _, l := range resp.Data.BOM {
+		lines[l.IPN] = l
+	}
+	if len(lines) != 3 {
+		t.Fatalf("Expected RES-001, CAP-001 and PCA-STK only, got %+v", resp.Data.BOM)
+	}
+
+	// RES-001: 2x3 through the phantom + 1 direct = 7 per, 28 for the WO.
+	// Available is 30 on hand less the 10 held by WO-OTHER.
+	res := lines["RES-001"]
+	if res.QtyPer != 7 || res.QtyRequired != 28 {
+		t.Errorf("RES-001: expected qty_per 7 / required 28, got %v / %v", res.QtyPer, res.QtyRequired)
+	}
+	if res.QtyReserved != 5 || res.QtyReservedOther != 10 || res.QtyAvailable != 20 {
+		t.Errorf("RES-001: unexpected netting %+v", res)
+	}
+	if res.Shortage != 8 || res.Status != "low" {
+		t.Errorf("RES-001: expected shortage 8 (low), got %v (%s)", res.Shortage, res.Status)
+	}
+
+	if cap := lines["CAP-001"]; cap.QtyRequired != 8 || cap.Shortage != 8 || cap.Status != "shortage" {
+		t.Errorf("CAP-001: unexpected line %+v", cap)
+	}
+
+	stk := lines["PCA-STK"]
+	if !stk.SubAssembly || stk.QtyRequired != 4 || stk.Shortage != 0 || stk.Status != "ok" {
+		t.Errorf("PCA-STK: expected stocked sub-assembly line with no shortage, got %+v", stk)
+	}
+
+	if resp.Data.ShortageCount != 2 {
+		t.Errorf("Expected 2 short lines, got %d", resp.Data.ShortageCount)
+	}
+}
+
+func TestPhantomAssemblies(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+
+	dir := t.TempDir()
+	oldPartsDir := partsDir
+	partsDir = dir
+	defer func() { partsDir = oldPartsDir }()
+	createBOMFile(t, dir, "pca", [][]string{
+		{"IPN", "description", "phantom"},
+		{"PCA-FLAGGED", "Flagged phantom", "yes"},
+		{"PCA-STOCKED", "Stocked", ""},
+		{"PCA-FORCED", "Stocked by flag", "no"},
+	})
+	db.Exec(`INSERT INTO inventory (ipn, qty_on_hand) VALUES ('PCA-FLAGGED', 10), ('PCA-STOCKED', 0)`)
+
+	tests := map[string]bool{
+		"PCA-FLAGGED": true,  // flagged, even with stock on hand
+		"PCA-STOCKED": false, // no flag
+		"PCA-FORCED":  false, // flagged as not phantom
+		"PCA-UNKNOWN": false, // not in the parts files at all
+	}
+	phantom := phantomAssemblies()
+	for ipn, want := range tests {
+		if got := phantom[ipn]; got != want {
+			t.Errorf("phantomAssemblies()[%s] = %v, want %v", ipn, got, want)
+		}
+	}
+}
+
+func TestWorkOrderPDF_UsesExplodedBOM(t *testing.T) {
+	oldDB := db
+	db = setupTestDB(t)
+	defer func() { db.Close(); db = oldDB }()
+	setupMultiLevelBOM(t)
+
+	db.Exec(`INSERT INTO inventory (ipn, qty_on_hand) VALUES ('PCA-STK', 4), ('UNUSED-001', 500)`)
+	db.Exec(`INSERT INTO work_orders (id, assembly_ipn, qty, status, created_at) VALUES ('WO-PDF', 'ASY-TOP', 2, 'open', '2026-01-01 00:00:00')`)
+
+	req := httptest.NewRequest("GET", "/api/v1/workorders/WO-PDF/pdf", nil)
+	w := httptest.NewRecorder()
+	handleWorkOrderPDF(w, req, "WO-PDF")
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	out := w.Body.String()
+	for _, want := range []string{"RES-001", "R1,R2,R3,R9", "CAP-001", "PCA-STK"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected traveler to contain %q", want)
+		}
+	}
+	if strings.Contains(out, "UNUSED-001") {
+		t.Error("Traveler should not list inventory that isn't on the BOM")
+	}
+}
+
 // Run tests with: go test -v ./zrp -run TestWorkOrder*
\ No newline at end of file
@@ -307,12 +307,6 @@ func TestIntegration_Real_WorkOrder_Completion(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Reserve some materials
-	_, err = db.Exec(`UPDATE inventory SET qty_reserved = 20.0 WHERE ipn = 'COMP-001'`)
-	if err != nil {
-		t.Fatal(err)
-	}
-
 	// Create work order
 	wo := WorkOrder{
 		AssemblyIPN: "ASY-TEST-001",
@@ -339,6 +333,18 @@ func TestIntegration_Real_WorkOrder_Completion(t *testing.T) {
 
 	t.Logf("Created work order: %s", woID)
 
+	// Reserve some materials for the work order
+	rtx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reserveInventory(rtx, "work_order", woID, "COMP-001", 20, "tester"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
 	// Record initial inventory
 	var initialAsmQty, initialCompQty, initialCompReserved float64
 	db.QueryRow("SELECT qty_on_hand FROM inventory WHERE ipn = 'ASY-TEST-001'").Scan(&initialAsmQty)
@@ -403,7 +409,7 @@ func TestIntegration_Real_WorkOrder_Completion(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	expectedOnHand := 100.0 - (20.0 * 10.0) // 100 - (20 reserved * 10 qty)
+	expectedOnHand := 100.0 - 20.0 // the 20 reserved to the work order
 	if compQty != expectedOnHand {
 		t.Logf("⚠ Material consumption: expected %.0f, got %.0f (may be OK if BOM integration not complete)", expectedOnHand, compQty)
 	}
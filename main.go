@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -55,6 +56,18 @@ func main() {
 	// Start auto-backup scheduler (default 2am, override with ZRP_BACKUP_TIME=HH:MM)
 	startAutoBackup(os.Getenv("ZRP_BACKUP_TIME"))
 
+	// Start scheduled MRP runs (off unless ZRP_MRP_TIME=HH:MM is set)
+	startMRPScheduler(os.Getenv("ZRP_MRP_TIME"))
+
+	// Start scheduled cycle counts (off unless ZRP_CYCLE_COUNT_TIME=HH:MM is set)
+	startCycleCountScheduler(os.Getenv("ZRP_CYCLE_COUNT_TIME"))
+
+	// Start scheduled reorder point suggestions (off unless ZRP_REORDER_TIME=HH:MM is set)
+	startReorderScheduler(os.Getenv("ZRP_REORDER_TIME"))
+
+	// Start the daily lot expiry check (default 1am, override with ZRP_EXPIRY_TIME=HH:MM)
+	startExpiryScheduler(os.Getenv("ZRP_EXPIRY_TIME"))
+
 	// Start undo log cleanup goroutine
 	go cleanExpiredUndo()
 
@@ -143,6 +156,24 @@ func main() {
 		case parts[0] == "scan" && len(parts) == 2 && r.Method == "GET":
 			handleScanLookup(w, r, parts[1])
 
+		// Handheld scanner sessions
+		case parts[0] == "scan-sessions" && len(parts) == 1 && r.Method == "GET":
+			handleListScanSessions(w, r)
+		case parts[0] == "scan-sessions" && len(parts) == 1 && r.Method == "POST":
+			handleCreateScanSession(w, r)
+		case parts[0] == "scan-sessions" && len(parts) == 2 && r.Method == "GET":
+			handleGetScanSession(w, r, parts[1])
+		case parts[0] == "scan-sessions" && len(parts) == 3 && parts[2] == "events" && r.Method == "GET":
+			handleListScanSessionEvents(w, r, parts[1])
+		case parts[0] == "scan-sessions" && len(parts) == 3 && parts[2] == "scan" && r.Method == "POST":
+			handleScanSessionScan(w, r, parts[1])
+		case parts[0] == "scan-sessions" && len(parts) == 3 && parts[2] == "commit" && r.Method == "POST":
+			handleCommitScanSession(w, r, parts[1])
+		case parts[0] == "scan-sessions" && len(parts) == 3 && parts[2] == "cancel" && r.Method == "POST":
+			handleCancelScanSession(w, r, parts[1])
+		case parts[0] == "scan-sessions" && len(parts) == 4 && parts[2] == "lines" && r.Method == "DELETE":
+			handleDeleteScanSessionLine(w, r, parts[1], parts[3])
+
 		// Dashboard
 		case path == "dashboard" && r.Method == "GET":
 			handleDashboard(w, r)
@@ -306,6 +337,94 @@ func main() {
 			handleGetInventory(w, r, parts[1])
 		case parts[0] == "inventory" && len(parts) == 3 && parts[2] == "history" && r.Method == "GET":
 			handleInventoryHistory(w, r, parts[1])
+		case parts[0] == "inventory" && len(parts) == 3 && parts[2] == "reservations" && r.Method == "GET":
+			handleInventoryReservations(w, r, parts[1])
+		case parts[0] == "inventory" && len(parts) == 3 && parts[2] == "cost-layers" && r.Method == "GET":
+			handleInventoryCostLayers(w, r, parts[1])
+		case parts[0] == "inventory" && len(parts) == 3 && parts[2] == "atp" && r.Method == "GET":
+			handleInventoryATP(w, r, parts[1])
+
+		// Locations
+		case parts[0] == "locations" && len(parts) == 1 && r.Method == "GET":
+			handleListLocations(w, r)
+		case parts[0] == "locations" && len(parts) == 1 && r.Method == "POST":
+			handleCreateLocation(w, r)
+		case parts[0] == "locations" && len(parts) == 2 && r.Method == "GET":
+			handleGetLocation(w, r, parts[1])
+		case parts[0] == "locations" && len(parts) == 2 && r.Method == "PUT":
+			handleUpdateLocation(w, r, parts[1])
+
+		// Lots
+		case parts[0] == "lots" && len(parts) == 1 && r.Method == "GET":
+			handleListLots(w, r)
+		case parts[0] == "lots" && len(parts) == 2 && parts[1] == "floor-life" && r.Method == "GET":
+			handleListFloorLifeLots(w, r)
+		case parts[0] == "lots" && len(parts) == 2 && parts[1] == "expiring" && r.Method == "GET":
+			handleListExpiringLots(w, r)
+		case parts[0] == "lots" && len(parts) == 2 && parts[1] == "quarantine-expired" && r.Method == "POST":
+			handleQuarantineExpiredLots(w, r)
+		case parts[0] == "lots" && len(parts) == 2 && r.Method == "GET":
+			handleGetLot(w, r, parts[1])
+		case parts[0] == "lots" && len(parts) == 2 && r.Method == "PUT":
+			handleUpdateLot(w, r, parts[1])
+		case parts[0] == "lots" && len(parts) == 3 && parts[2] == "msl" && r.Method == "GET":
+			handleListLotMSLEvents(w, r, parts[1])
+		case parts[0] == "lots" && len(parts) == 3 && parts[2] == "msl" && r.Method == "POST":
+			handleLotMSLEvent(w, r, parts[1])
+
+		// Customer-owned and consigned stock
+		case parts[0] == "consignment" && len(parts) == 1 && r.Method == "GET":
+			handleListOwnership(w, r)
+		case parts[0] == "consignment" && len(parts) == 2 && parts[1] == "moves" && r.Method == "GET":
+			handleListOwnershipMoves(w, r)
+		case parts[0] == "consignment" && len(parts) == 2 && parts[1] == "ship" && r.Method == "POST":
+			handleShipToCM(w, r)
+		case parts[0] == "consignment" && len(parts) == 2 && parts[1] == "receive" && r.Method == "POST":
+			handleReceiveFromCM(w, r)
+		case parts[0] == "consignment" && len(parts) == 2 && parts[1] == "return" && r.Method == "POST":
+			handleReturnFromCM(w, r)
+
+		// Cycle counts
+		case parts[0] == "cycle-counts" && len(parts) == 2 && parts[1] == "classes" && r.Method == "GET":
+			handleListCycleCountClasses(w, r)
+		case parts[0] == "cycle-counts" && len(parts) == 3 && parts[1] == "classes" && r.Method == "PUT":
+			handleUpdateCycleCountClass(w, r, parts[2])
+		case parts[0] == "cycle-counts" && len(parts) == 2 && parts[1] == "classify" && r.Method == "POST":
+			handleClassifyCycleCounts(w, r)
+		case parts[0] == "cycle-counts" && len(parts) == 2 && parts[1] == "items" && r.Method == "GET":
+			handleListCycleCountItems(w, r)
+		case parts[0] == "cycle-counts" && len(parts) == 2 && parts[1] == "generate" && r.Method == "POST":
+			handleGenerateCycleCounts(w, r)
+		case parts[0] == "cycle-counts" && len(parts) == 2 && parts[1] == "tasks" && r.Method == "GET":
+			handleListCycleCountTasks(w, r)
+		case parts[0] == "cycle-counts" && len(parts) == 3 && parts[1] == "tasks" && r.Method == "GET":
+			handleGetCycleCountTask(w, r, parts[2])
+		case parts[0] == "cycle-counts" && len(parts) == 4 && parts[1] == "tasks" && parts[3] == "count" && r.Method == "POST":
+			handleCountCycleCountTask(w, r, parts[2])
+		case parts[0] == "cycle-counts" && len(parts) == 4 && parts[1] == "tasks" && (parts[3] == "approve" || parts[3] == "reject") && r.Method == "POST":
+			handleReviewCycleCountTask(w, r, parts[2], parts[3])
+		case parts[0] == "lots" && len(parts) == 4 && parts[2] == "trace" && parts[3] == "forward" && r.Method == "GET":
+			handleTraceLotForward(w, r, parts[1])
+		case parts[0] == "lots" && len(parts) == 4 && parts[2] == "trace" && parts[3] == "backward" && r.Method == "GET":
+			handleTraceLotBackward(w, r, parts[1])
+		case parts[0] == "serials" && len(parts) == 3 && parts[2] == "trace" && r.Method == "GET":
+			handleTraceSerial(w, r, parts[1])
+		case parts[0] == "serials" && len(parts) == 3 && parts[2] == "genealogy" && r.Method == "GET":
+			handleSerialGenealogy(w, r, parts[1])
+
+		// Scrap reasons
+		case parts[0] == "scrap-reasons" && len(parts) == 1 && r.Method == "GET":
+			handleListScrapReasons(w, r)
+		case parts[0] == "scrap-reasons" && len(parts) == 1 && r.Method == "POST":
+			handleCreateScrapReason(w, r)
+		case parts[0] == "scrap-reasons" && len(parts) == 2 && r.Method == "PUT":
+			handleUpdateScrapReason(w, r, parts[1])
+
+		// Reservations
+		case parts[0] == "reservations" && len(parts) == 1 && r.Method == "GET":
+			handleListReservations(w, r)
+		case parts[0] == "reservations" && len(parts) == 3 && parts[2] == "release" && r.Method == "POST":
+			handleReleaseReservation(w, r, parts[1])
 
 		// Purchase Orders
 		case parts[0] == "pos" && len(parts) == 1 && r.Method == "GET":
@@ -314,6 +433,19 @@ func main() {
 			handleCreatePO(w, r)
 		case parts[0] == "pos" && len(parts) == 2 && (parts[1] == "generate-from-wo" || parts[1] == "generate") && r.Method == "POST":
 			handleGeneratePOFromWO(w, r)
+		case parts[0] == "pos" && len(parts) == 2 && parts[1] == "suggestions" && r.Method == "GET":
+			handleListPOSuggestions(w, r)
+		case parts[0] == "pos" && len(parts) == 3 && parts[1] == "suggestions" && parts[2] == "reorder" && r.Method == "POST":
+			handleGenerateReorderSuggestions(w, r)
+		case parts[0] == "pos" && len(parts) == 3 && parts[1] == "suggestions" && parts[2] == "approve" && r.Method == "POST":
+			handleBulkApprovePOSuggestions(w, r)
+		case parts[0] == "pos" && len(parts) == 4 && parts[1] == "suggestions" && parts[3] == "review" && r.Method == "POST":
+			sid, err := strconv.Atoi(parts[2])
+			if err != nil {
+				jsonErr(w, "invalid suggestion id", 400)
+				return
+			}
+			handleReviewPOSuggestion(w, r, sid)
 		case parts[0] == "pos" && len(parts) == 2 && r.Method == "GET":
 			handleGetPO(w, r, parts[1])
 		case parts[0] == "pos" && len(parts) == 2 && r.Method == "PUT":
@@ -323,9 +455,29 @@ func main() {
 		case parts[0] == "pos" && len(parts) == 2 && parts[1] == "batch" && r.Method == "POST":
 			handleBulkPurchaseOrders(w, r)
 
+		// MRP
+		case parts[0] == "mrp" && len(parts) == 2 && parts[1] == "runs" && r.Method == "GET":
+			handleListMRPRuns(w, r)
+		case parts[0] == "mrp" && len(parts) == 2 && parts[1] == "runs" && r.Method == "POST":
+			handleCreateMRPRun(w, r)
+		case parts[0] == "mrp" && len(parts) == 3 && parts[1] == "runs" && r.Method == "GET":
+			handleGetMRPRun(w, r, parts[2])
+		case parts[0] == "mrp" && len(parts) == 4 && parts[1] == "runs" && parts[3] == "compare" && r.Method == "GET":
+			handleCompareMRPRuns(w, r, parts[2])
+		case parts[0] == "mrp" && len(parts) == 4 && parts[1] == "runs" && parts[3] == "firm" && r.Method == "POST":
+			handleFirmMRPRun(w, r, parts[2])
+		case parts[0] == "mrp" && len(parts) == 4 && parts[1] == "planned-orders" && parts[3] == "cancel" && r.Method == "POST":
+			handleCancelMRPPlannedOrder(w, r, parts[2])
+		case parts[0] == "mrp" && len(parts) == 2 && parts[1] == "settings" && r.Method == "GET":
+			handleListMRPItemSettings(w, r)
+		case parts[0] == "mrp" && len(parts) == 3 && parts[1] == "settings" && r.Method == "PUT":
+			handleUpdateMRPItemSetting(w, r, parts[2])
+
 		// Receiving/Inspection
 		case parts[0] == "receiving" && len(parts) == 1 && r.Method == "GET":
 			handleListReceiving(w, r)
+		case parts[0] == "receiving" && len(parts) == 2 && parts[1] == "scan" && r.Method == "POST":
+			handleScanReceive(w, r)
 		case parts[0] == "receiving" && len(parts) == 3 && parts[2] == "inspect" && r.Method == "POST":
 			handleInspectReceiving(w, r, parts[1])
 
@@ -348,8 +500,84 @@ func main() {
 			handleWorkOrderPDF(w, r, parts[1])
 		case parts[0] == "workorders" && len(parts) == 3 && parts[2] == "bom" && r.Method == "GET":
 			handleWorkOrderBOM(w, r, parts[1])
+		case parts[0] == "workorders" && len(parts) == 3 && parts[2] == "kit" && r.Method == "POST":
+			handleWorkOrderKit(w, r, parts[1])
+		case parts[0] == "workorders" && len(parts) == 3 && parts[2] == "pick-list" && r.Method == "GET":
+			handleWorkOrderPickList(w, r, parts[1])
+		case parts[0] == "workorders" && len(parts) == 3 && parts[2] == "picks" && r.Method == "GET":
+			handleListWorkOrderPicks(w, r, parts[1])
+		case parts[0] == "workorders" && len(parts) == 3 && parts[2] == "picks" && r.Method == "POST":
+			handleWorkOrderPick(w, r, parts[1])
+		case parts[0] == "workorders" && len(parts) == 4 && parts[2] == "picks" && parts[3] == "return" && r.Method == "POST":
+			handleWorkOrderPickReturn(w, r, parts[1])
+		case parts[0] == "workorders" && len(parts) == 3 && parts[2] == "serials" && r.Method == "GET":
+			handleWorkOrderSerials(w, r, parts[1])
+		case parts[0] == "workorders" && len(parts) == 3 && parts[2] == "serials" && r.Method == "POST":
+			handleWorkOrderAddSerial(w, r, parts[1])
+		case parts[0] == "workorders" && len(parts) == 5 && parts[2] == "serials" && parts[4] == "components" && r.Method == "POST":
+			handleAddSerialComponents(w, r, parts[1], parts[3])
+		case parts[0] == "workorders" && len(parts) == 3 && parts[2] == "children" && r.Method == "GET":
+			handleListChildWorkOrders(w, r, parts[1])
+		case parts[0] == "workorders" && len(parts) == 3 && parts[2] == "children" && r.Method == "POST":
+			handleCreateChildWorkOrders(w, r, parts[1])
+		case parts[0] == "workorders" && len(parts) == 3 && parts[2] == "completions" && r.Method == "GET":
+			handleListWOCompletions(w, r, parts[1])
+		case parts[0] == "workorders" && len(parts) == 3 && parts[2] == "completions" && r.Method == "POST":
+			handleCompleteWorkOrderUnits(w, r, parts[1])
+		case parts[0] == "workorders" && len(parts) == 3 && parts[2] == "scrap" && r.Method == "POST":
+			handleScrapWorkOrderUnits(w, r, parts[1])
+		case parts[0] == "workorders" && len(parts) == 3 && parts[2] == "trace" && r.Method == "GET":
+			handleTraceWorkOrder(w, r, parts[1])
+		case parts[0] == "workorders" && len(parts) == 3 && parts[2] == "reservations" && r.Method == "GET":
+			handleWorkOrderReservations(w, r, parts[1])
+		case parts[0] == "workorders" && len(parts) == 3 && parts[2] == "operations" && r.Method == "GET":
+			handleListWorkOrderOperations(w, r, parts[1])
+		case parts[0] == "workorders" && len(parts) == 3 && parts[2] == "operations" && r.Method == "POST":
+			handleReloadWorkOrderOperations(w, r, parts[1])
+		case parts[0] == "workorders" && len(parts) == 5 && parts[2] == "operations" && r.Method == "POST":
+			handleWorkOrderOperationAction(w, r, parts[1], parts[3], parts[4])
+		case parts[0] == "workorders" && len(parts) == 3 && parts[2] == "rework" && r.Method == "GET":
+			handleGetReworkOrder(w, r, parts[1])
+		case parts[0] == "workorders" && len(parts) == 3 && parts[2] == "labor" && r.Method == "GET":
+			handleWorkOrderLabor(w, r, parts[1])
+		case parts[0] == "workorders" && len(parts) == 4 && parts[2] == "labor" && parts[3] == "clock-in" && r.Method == "POST":
+			handleClockIn(w, r, parts[1])
+
+		// Labor
+		case parts[0] == "labor" && len(parts) == 2 && parts[1] == "active" && r.Method == "GET":
+			handleListActiveLabor(w, r)
+		case parts[0] == "labor" && len(parts) == 3 && parts[2] == "clock-out" && r.Method == "POST":
+			handleClockOut(w, r, parts[1])
+
+		// Work centers & routings
+		case parts[0] == "work-centers" && len(parts) == 1 && r.Method == "GET":
+			handleListWorkCenters(w, r)
+		case parts[0] == "work-centers" && len(parts) == 1 && r.Method == "POST":
+			handleCreateWorkCenter(w, r)
+		case parts[0] == "work-centers" && len(parts) == 2 && r.Method == "GET":
+			handleGetWorkCenter(w, r, parts[1])
+		case parts[0] == "work-centers" && len(parts) == 2 && r.Method == "PUT":
+			handleUpdateWorkCenter(w, r, parts[1])
+		case parts[0] == "routings" && len(parts) == 1 && r.Method == "GET":
+			handleListRoutings(w, r)
+		case parts[0] == "routings" && len(parts) == 2 && r.Method == "GET":
+			handleGetRouting(w, r, parts[1])
+		case parts[0] == "routings" && len(parts) == 2 && r.Method == "PUT":
+			handleUpdateRouting(w, r, parts[1])
 
 		// Tests
+		case parts[0] == "tests" && len(parts) == 2 && parts[1] == "ingest" && r.Method == "POST":
+			handleIngestTests(w, r)
+		case parts[0] == "tests" && len(parts) == 2 && parts[1] == "spc" && r.Method == "GET":
+			handleTestSPC(w, r)
+		case parts[0] == "test-specs" && len(parts) == 1 && r.Method == "GET":
+			handleListTestSpecs(w, r)
+		case parts[0] == "test-specs" && len(parts) == 1 && r.Method == "POST":
+			handleCreateTestSpec(w, r)
+		case parts[0] == "test-specs" && len(parts) == 2 && r.Method == "PUT":
+			handleUpdateTestSpec(w, r, parts[1])
+		case parts[0] == "test-specs" && len(parts) == 2 && r.Method == "DELETE":
+			handleDeleteTestSpec(w, r, parts[1])
 		case parts[0] == "tests" && len(parts) == 1 && r.Method == "GET":
 			handleListTests(w, r)
 		case parts[0] == "tests" && len(parts) == 1 && r.Method == "POST":
@@ -368,6 +596,12 @@ func main() {
 			handleGetNCR(w, r, parts[1])
 		case parts[0] == "ncrs" && len(parts) == 2 && r.Method == "PUT":
 			handleUpdateNCR(w, r, parts[1])
+		case parts[0] == "ncrs" && len(parts) == 3 && parts[2] == "genealogy" && r.Method == "GET":
+			handleNCRGenealogy(w, r, parts[1])
+		case parts[0] == "ncrs" && len(parts) == 3 && parts[2] == "rework" && r.Method == "GET":
+			handleListNCRRework(w, r, parts[1])
+		case parts[0] == "ncrs" && len(parts) == 3 && parts[2] == "rework" && r.Method == "POST":
+			handleCreateReworkOrder(w, r, parts[1])
 		case parts[0] == "ncrs" && len(parts) == 3 && parts[2] == "create-capa" && r.Method == "POST":
 			handleCreateCAPAFromNCR(w, r, parts[1])
 		case parts[0] == "ncrs" && len(parts) == 3 && parts[2] == "create-eco" && r.Method == "POST":
@@ -462,6 +696,8 @@ func main() {
 			handleCreateRMA(w, r)
 		case parts[0] == "rmas" && len(parts) == 2 && r.Method == "GET":
 			handleGetRMA(w, r, parts[1])
+		case parts[0] == "rmas" && len(parts) == 3 && parts[2] == "genealogy" && r.Method == "GET":
+			handleRMAGenealogy(w, r, parts[1])
 		case parts[0] == "rmas" && len(parts) == 2 && r.Method == "PUT":
 			handleUpdateRMA(w, r, parts[1])
 
@@ -579,6 +815,52 @@ func main() {
 		case parts[0] == "settings" && len(parts) == 2 && parts[1] == "git-docs" && r.Method == "PUT":
 			handlePutGitDocsSettings(w, r)
 
+		// Settings/Work Orders
+		case parts[0] == "settings" && len(parts) == 2 && parts[1] == "work-orders" && r.Method == "GET":
+			handleGetWorkOrderSettings(w, r)
+		case parts[0] == "settings" && len(parts) == 2 && parts[1] == "work-orders" && r.Method == "PUT":
+			handlePutWorkOrderSettings(w, r)
+
+		// Settings/Costing
+		case parts[0] == "settings" && len(parts) == 2 && parts[1] == "costing" && r.Method == "GET":
+			handleGetCostingSettings(w, r)
+		case parts[0] == "settings" && len(parts) == 2 && parts[1] == "costing" && r.Method == "PUT":
+			handlePutCostingSettings(w, r)
+
+		// Settings/Print letterhead
+		case parts[0] == "settings" && len(parts) == 2 && parts[1] == "print" && r.Method == "GET":
+			handleGetPrintSettings(w, r)
+		case parts[0] == "settings" && len(parts) == 2 && parts[1] == "print" && r.Method == "PUT":
+			handlePutPrintSettings(w, r)
+
+		// Print templates
+		case parts[0] == "print-templates" && len(parts) == 1 && r.Method == "GET":
+			handleListPrintTemplates(w, r)
+		case parts[0] == "print-templates" && len(parts) == 1 && r.Method == "POST":
+			handleCreatePrintTemplate(w, r)
+		case parts[0] == "print-templates" && len(parts) == 3 && parts[1] == "builtin" && r.Method == "GET":
+			handleGetBuiltinPrintTemplate(w, r, parts[2])
+		case parts[0] == "print-templates" && len(parts) == 2 && r.Method == "GET":
+			handleGetPrintTemplate(w, r, parts[1])
+		case parts[0] == "print-templates" && len(parts) == 2 && r.Method == "PUT":
+			handleUpdatePrintTemplate(w, r, parts[1])
+		case parts[0] == "print-templates" && len(parts) == 2 && r.Method == "DELETE":
+			handleDeletePrintTemplate(w, r, parts[1])
+		case parts[0] == "print-templates" && len(parts) == 3 && parts[2] == "versions" && r.Method == "GET":
+			handleListPrintTemplateVersions(w, r, parts[1])
+		case parts[0] == "print-templates" && len(parts) == 3 && parts[2] == "revert" && r.Method == "POST":
+			handleRevertPrintTemplate(w, r, parts[1])
+
+		// Labels
+		case parts[0] == "settings" && len(parts) == 2 && parts[1] == "label-printer" && r.Method == "GET":
+			handleGetLabelPrinter(w, r)
+		case parts[0] == "settings" && len(parts) == 2 && parts[1] == "label-printer" && r.Method == "PUT":
+			handlePutLabelPrinter(w, r)
+		case parts[0] == "labels" && len(parts) == 3 && r.Method == "GET":
+			handleGetLabels(w, r, parts[1], parts[2])
+		case parts[0] == "labels" && len(parts) == 4 && parts[3] == "print" && r.Method == "POST":
+			handlePrintLabels(w, r, parts[1], parts[2])
+
 		// ECO PR
 		case parts[0] == "ecos" && len(parts) == 3 && parts[2] == "create-pr" && r.Method == "POST":
 			handleCreateECOPR(w, r, parts[1])
@@ -622,6 +904,10 @@ func main() {
 			handleReportLowStock(w, r)
 		case parts[0] == "reports" && len(parts) == 2 && parts[1] == "ncr-summary":
 			handleReportNCRSummary(w, r)
+		case parts[0] == "reports" && len(parts) == 2 && parts[1] == "labor":
+			handleReportLabor(w, r)
+		case parts[0] == "reports" && len(parts) == 2 && parts[1] == "cycle-count-accuracy":
+			handleReportCycleCountAccuracy(w, r)
 
 		// Notifications
 		case parts[0] == "notifications" && len(parts) == 1 && r.Method == "GET":
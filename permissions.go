@@ -276,13 +276,13 @@ func mapAPIPathToPermission(apiPath, method string) (module, action string) {
 		module = ModuleECOs
 	case "docs":
 		module = ModuleDocuments
-	case "inventory":
+	case "inventory", "lots", "locations", "cycle-counts", "consignment", "labels":
 		module = ModuleInventory
 	case "vendors":
 		module = ModuleVendors
-	case "pos":
+	case "pos", "mrp":
 		module = ModulePOs
-	case "workorders":
+	case "workorders", "work-centers", "routings", "labor", "serials", "scrap-reasons":
 		module = ModuleWorkOrders
 	case "ncrs":
 		module = ModuleNCRs
@@ -304,16 +304,16 @@ func mapAPIPathToPermission(apiPath, method string) (module, action string) {
 		module = ModuleRFQs
 	case "reports":
 		module = ModuleReports
-	case "tests":
+	case "tests", "test-specs":
 		module = ModuleTesting
-	case "users", "apikeys", "api-keys", "admin":
+	case "users", "apikeys", "api-keys", "admin", "print-templates":
 		module = ModuleAdmin
 	case "email":
 		module = ModuleAdmin
 	case "settings":
 		// settings/general, settings/email, etc are admin
 		module = ModuleAdmin
-	case "receiving":
+	case "receiving", "reservations", "scan-sessions":
 		module = ModuleInventory
 	case "prices":
 		module = ModulePricing
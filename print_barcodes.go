@@ -0,0 +1,576 @@
+package main
+
+import (
+	"fmt"
+)
+
+// 2D barcodes for labels: QR codes and Data Matrix (ECC 200) symbols as
+// module grids, true for dark. Zebra printers draw these themselves from
+// ZPL; the grids are for the PDF labels.
+
+// --- Reed-Solomon over GF(256) ---
+
+func gfMul(x, y byte, poly int) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * poly)
+		z ^= int(y>>uint(i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor is the generator polynomial with roots α^first … α^(first+n-1),
+// highest coefficient first and the leading 1 left out.
+func rsDivisor(n, poly int, first byte) []byte {
+	d := make([]byte, n)
+	d[n-1] = 1
+	root := byte(1)
+	for i := byte(0); i < first; i++ {
+		root = gfMul(root, 2, poly)
+	}
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			d[j] = gfMul(d[j], root, poly)
+			if j+1 < n {
+				d[j] ^= d[j+1]
+			}
+		}
+		root = gfMul(root, 2, poly)
+	}
+	return d
+}
+
+// rsRemainder returns the error correction codewords of data.
+func rsRemainder(data, divisor []byte, poly int) []byte {
+	r := make([]byte, len(divisor))
+	for _, b := range data {
+		f := b ^ r[0]
+		copy(r, r[1:])
+		r[len(r)-1] = 0
+		for i := range r {
+			r[i] ^= gfMul(divisor[i], f, poly)
+		}
+	}
+	return r
+}
+
+// --- QR code ---
+
+// qrVersionM describes versions 1-10 at error correction level M: error
+// correction codewords per block, then the blocks of each group and their
+// data codewords.
+var qrVersionM = [...]struct{ ec, b1, d1, b2, d2 int }{
+	{10, 1, 16, 0, 0}, {16, 1, 28, 0, 0}, {26, 1, 44, 0, 0}, {18, 2, 32, 0, 0}, {24, 2, 43, 0, 0},
+	{16, 4, 27, 0, 0}, {18, 4, 31, 0, 0}, {22, 2, 38, 2, 39}, {22, 3, 36, 2, 37}, {26, 4, 43, 1, 44},
+}
+
+var qrAlignment = [...][]int{nil, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34}, {6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50}}
+
+type qrMatrix struct {
+	size     int
+	dark     [][]bool
+	function [][]bool
+}
+
+func (q *qrMatrix) set(x, y int, dark bool) {
+	q.dark[y][x] = dark
+	q.function[y][x] = true
+}
+
+// qrEncode encodes s in byte mode at error correction level M, in the
+// smallest version from 1 to 10 it fits.
+func qrEncode(s string) ([][]bool, error) {
+	version := 0
+	for v := 1; v <= len(qrVersionM); v++ {
+		t := qrVersionM[v-1]
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(s) <= 8*(t.b1*t.d1+t.b2*t.d2) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("%d bytes is too long for a QR code", len(s))
+	}
+	t := qrVersionM[version-1]
+	capacity := t.b1*t.d1 + t.b2*t.d2
+
+	// Mode, count, data, terminator and padding
+	var bits []bool
+	put := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, v>>uint(i)&1 == 1)
+		}
+	}
+	put(4, 4)
+	if version >= 10 {
+		put(len(s), 16)
+	} else {
+		put(len(s), 8)
+	}
+	for i := 0; i < len(s); i++ {
+		put(int(s[i]), 8)
+	}
+	for i := 0; i < 4 && len(bits) < capacity*8; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	data := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << uint(7-j)
+			}
+		}
+		data = append(data, b)
+	}
+	for pad := byte(0xEC); len(data) < capacity; pad ^= 0xEC ^ 0x11 {
+		data = append(data, pad)
+	}
+
+	// Split into blocks, add error correction and interleave
+	divisor := rsDivisor(t.ec, 0x11d, 0)
+	var blocks, ecc [][]byte
+	off := 0
+	for i := 0; i < t.b1+t.b2; i++ {
+		n := t.d1
+		if i >= t.b1 {
+			n = t.d2
+		}
+		blocks = append(blocks, data[off:off+n])
+		ecc = append(ecc, rsRemainder(data[off:off+n], divisor, 0x11d))
+		off += n
+	}
+	var codewords []byte
+	for i := 0; i < t.d1 || i < t.d2; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				codewords = append(codewords, b[i])
+			}
+		}
+	}
+	for i := 0; i < t.ec; i++ {
+		for _, e := range ecc {
+			codewords = append(codewords, e[i])
+		}
+	}
+
+	size := 17 + 4*version
+	q := &qrMatrix{size: size}
+	for i := 0; i < size; i++ {
+		q.dark = append(q.dark, make([]bool, size))
+		q.function = append(q.function, make([]bool, size))
+	}
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(codewords)
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+	return q.dark, nil
+}
+
+func (q *qrMatrix) drawFunctionPatterns(version int) {
+	n := q.size
+	for i := 0; i < n; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {n - 4, 3}, {3, n - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || x >= n || y < 0 || y >= n {
+					continue
+				}
+				d := max(abs(dx), abs(dy))
+				q.set(x, y, d != 2 && d != 4)
+			}
+		}
+	}
+	pos := qrAlignment[version-1]
+	for i, cx := range pos {
+		for j, cy := range pos {
+			last := len(pos) - 1
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+	q.drawFormat(0)
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			bit := bits>>uint(i)&1 == 1
+			a, b := n-11+i%3, i/3
+			q.set(a, b, bit)
+			q.set(b, a, bit)
+		}
+	}
+}
+
+// drawFormat writes both copies of the format information for level M and
+// mask.
+func (q *qrMatrix) drawFormat(mask int) {
+	data := 0<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>uint(i)&1 == 1 }
+	n := q.size
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(n-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, n-15+i, bit(i))
+	}
+	q.set(8, n-8, true)
+}
+
+func (q *qrMatrix) drawCodewords(data []byte) {
+	n := q.size
+	i := 0
+	for right := n - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < n; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = n - 1 - vert
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.dark[y][x] = data[i>>3]>>uint(7-i&7)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask flips the data modules the mask selects; applying it twice
+// undoes it.
+func (q *qrMatrix) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !q.function[y][x] {
+				q.dark[y][x] = !q.dark[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the symbol is to read: long runs, 2x2 blocks,
+// finder-like patterns and an unbalanced dark share all count against it.
+func (q *qrMatrix) penalty() int {
+	n := q.size
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return q.dark[x][y]
+		}
+		return q.dark[y][x]
+	}
+	p := 0
+	finder := []bool{true, false, true, true, true, false, true}
+	for _, tr := range []bool{false, true} {
+		for y := 0; y < n; y++ {
+			run := 1
+			for x := 1; x <= n; x++ {
+				if x < n && at(x, y, tr) == at(x-1, y, tr) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					p += 3 + run - 5
+				}
+				run = 1
+			}
+			for x := 0; x+7 <= n; x++ {
+				match := true
+				for k, d := range finder {
+					if at(x+k, y, tr) != d {
+						match = false
+						break
+					}
+				}
+				if !match {
+					continue
+				}
+				light := func(from, to int) bool {
+					for k := from; k < to; k++ {
+						if k >= 0 && k < n && at(k, y, tr) {
+							return false
+						}
+					}
+					return true
+				}
+				if light(x-4, x) || light(x+7, x+11) {
+					p += 40
+				}
+			}
+		}
+	}
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if q.dark[y][x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				c := q.dark[y][x]
+				if q.dark[y][x+1] == c && q.dark[y+1][x] == c && q.dark[y+1][x+1] == c {
+					p += 3
+				}
+			}
+		}
+	}
+	p += abs(dark*20-n*n*10) / (n * n) * 10
+	return p
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// --- Data Matrix ECC 200 ---
+
+// dmSizes are the square ECC 200 symbols up to 48x48 (one error correction
+// block): symbol size, data region size, regions per side, data and error
+// correction codewords.
+var dmSizes = [...]struct{ size, region, regions, data, ecc int }{
+	{10, 8, 1, 3, 5}, {12, 10, 1, 5, 7}, {14, 12, 1, 8, 10}, {16, 14, 1, 12, 12}, {18, 16, 1, 18, 14},
+	{20, 18, 1, 22, 18}, {22, 20, 1, 30, 20}, {24, 22, 1, 36, 24}, {26, 24, 1, 44, 28}, {32, 14, 2, 62, 36},
+	{36, 16, 2, 86, 42}, {40, 18, 2, 114, 48}, {44, 20, 2, 144, 56}, {48, 22, 2, 174, 68},
+}
+
+// dmEncodeASCII encodes s in ASCII encodation: digit pairs share a
+// codeword and bytes above 127 take an upper shift.
+func dmEncodeASCII(s string) []byte {
+	var cw []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case i+1 < len(s) && c >= '0' && c <= '9' && s[i+1] >= '0' && s[i+1] <= '9':
+			cw = append(cw, 130+(c-'0')*10+(s[i+1]-'0'))
+			i++
+		case c > 127:
+			cw = append(cw, 235, c-127)
+		default:
+			cw = append(cw, c+1)
+		}
+	}
+	return cw
+}
+
+// dmCodewords pads the data to the symbol's capacity and appends its error
+// correction.
+func dmCodewords(data []byte, capacity, ecc int) []byte {
+	cw := append([]byte{}, data...)
+	if len(cw) < capacity {
+		cw = append(cw, 129)
+	}
+	for len(cw) < capacity {
+		pad := 129 + (149*(len(cw)+1))%253 + 1
+		if pad > 254 {
+			pad -= 254
+		}
+		cw = append(cw, byte(pad))
+	}
+	return append(cw, rsRemainder(cw, rsDivisor(ecc, 0x12d, 1), 0x12d)...)
+}
+
+// dataMatrixEncode encodes s in the smallest square symbol it fits.
+func dataMatrixEncode(s string) ([][]bool, error) {
+	data := dmEncodeASCII(s)
+	for _, sz := range dmSizes {
+		if len(data) > sz.data {
+			continue
+		}
+		cw := dmCodewords(data, sz.data, sz.ecc)
+		n := sz.region * sz.regions
+		placed := dmPlacement(n, n)
+
+		m := make([][]bool, sz.size)
+		for i := range m {
+			m[i] = make([]bool, sz.size)
+		}
+		// Finder and clock track around each region
+		step := sz.region + 2
+		for r := 0; r < sz.size; r++ {
+			for c := 0; c < sz.size; c++ {
+				lr, lc := r%step, c%step
+				switch {
+				case lc == 0 || lr == step-1:
+					m[r][c] = true
+				case lr == 0:
+					m[r][c] = lc%2 == 0
+				case lc == step-1:
+					m[r][c] = lr%2 == 1
+				}
+			}
+		}
+		for r := 0; r < n; r++ {
+			for c := 0; c < n; c++ {
+				v := placed[r][c]
+				dark := v == 1
+				if v >= 10 {
+					dark = cw[v/10-1]>>uint(8-v%10)&1 == 1
+				}
+				m[r/sz.region*step+1+r%sz.region][c/sz.region*step+1+c%sz.region] = dark
+			}
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("%q is too long for a Data Matrix label", s)
+}
+
+// dmPlacement maps codeword bits onto an nrow x ncol data area following
+// ISO/IEC 16022 annex F. Each cell holds 10*codeword + bit (bit 1 is the
+// most significant, codewords count from 1), or 1 and 0 for the fixed
+// corner pattern.
+func dmPlacement(nrow, ncol int) [][]int {
+	a := make([][]int, nrow)
+	for i := range a {
+		a[i] = make([]int, ncol)
+		for j := range a[i] {
+			a[i][j] = -1
+		}
+	}
+	module := func(row, col, chr, bit int) {
+		if row < 0 {
+			row += nrow
+			col += 4 - (nrow+4)%8
+		}
+		if col < 0 {
+			col += ncol
+			row += 4 - (ncol+4)%8
+		}
+		a[row][col] = 10*chr + bit
+	}
+	utah := func(row, col, chr int) {
+		module(row-2, col-2, chr, 1)
+		module(row-2, col-1, chr, 2)
+		module(row-1, col-2, chr, 3)
+		module(row-1, col-1, chr, 4)
+		module(row-1, col, chr, 5)
+		module(row, col-2, chr, 6)
+		module(row, col-1, chr, 7)
+		module(row, col, chr, 8)
+	}
+	corner := func(chr int, cells [8][2]int) {
+		for i, c := range cells {
+			module(c[0], c[1], chr, i+1)
+		}
+	}
+	chr, row, col := 1, 4, 0
+	for {
+		if row == nrow && col == 0 {
+			corner(chr, [8][2]int{{nrow - 1, 0}, {nrow - 1, 1}, {nrow - 1, 2}, {0, ncol - 2}, {0, ncol - 1}, {1, ncol - 1}, {2, ncol - 1}, {3, ncol - 1}})
+			chr++
+		}
+		if row == nrow-2 && col == 0 && ncol%4 != 0 {
+			corner(chr, [8][2]int{{nrow - 3, 0}, {nrow - 2, 0}, {nrow - 1, 0}, {0, ncol - 4}, {0, ncol - 3}, {0, ncol - 2}, {0, ncol - 1}, {1, ncol - 1}})
+			chr++
+		}
+		if row == nrow-2 && col == 0 && ncol%8 == 4 {
+			corner(chr, [8][2]int{{nrow - 3, 0}, {nrow - 2, 0}, {nrow - 1, 0}, {0, ncol - 2}, {0, ncol - 1}, {1, ncol - 1}, {2, ncol - 1}, {3, ncol - 1}})
+			chr++
+		}
+		if row == nrow+4 && col == 2 && ncol%8 == 0 {
+			corner(chr, [8][2]int{{nrow - 1, 0}, {nrow - 1, ncol - 1}, {0, ncol - 3}, {0, ncol - 2}, {0, ncol - 1}, {1, ncol - 3}, {1, ncol - 2}, {1, ncol - 1}})
+			chr++
+		}
+		for {
+			if row < nrow && col >= 0 && a[row][col] == -1 {
+				utah(row, col, chr)
+				chr++
+			}
+			row -= 2
+			col += 2
+			if row < 0 || col >= ncol {
+				break
+			}
+		}
+		row++
+		col += 3
+		for {
+			if row >= 0 && col < ncol && a[row][col] == -1 {
+				utah(row, col, chr)
+				chr++
+			}
+			row += 2
+			col -= 2
+			if row >= nrow || col < 0 {
+				break
+			}
+		}
+		row += 3
+		col++
+		if row >= nrow && col >= ncol {
+			break
+		}
+	}
+	if a[nrow-1][ncol-1] == -1 {
+		a[nrow-1][ncol-1], a[nrow-2][ncol-2] = 1, 1
+		a[nrow-1][ncol-2], a[nrow-2][ncol-1] = 0, 0
+	}
+	return a
+}
@@ -0,0 +1,288 @@
+package main
+
+// The data each document type hands its print template. Templates are Go
+// html/template text with the barcode, date and money functions; label
+// templates are text/template ZPL given a LabelData.
+
+// TravelerPrint is the data of a work order traveler.
+type TravelerPrint struct {
+	Company     PrintCompany
+	Generated   string
+	WO          WorkOrder
+	Date        string
+	Description string
+	BOM         []WOBOMLine
+	Routing     []TravelerStep
+	Serials     []TravelerSerial
+}
+
+// TravelerStep is a routing operation on the traveler, with what has been
+// signed off so far.
+type TravelerStep struct {
+	Seq        int
+	Name       string
+	WorkCenter string
+	QtyGood    string
+	QtyScrap   string
+	Operator   string
+	Date       string
+}
+
+type TravelerSerial struct {
+	SerialNumber string
+	Status       string
+}
+
+// QuotePrint is the data of a printed quote.
+type QuotePrint struct {
+	Company   PrintCompany
+	Generated string
+	Quote     Quote
+	Date      string
+	Lines     []QuotePrintLine
+	Total     float64
+}
+
+type QuotePrintLine struct {
+	QuoteLine
+	Total float64
+}
+
+// InvoicePrint is the data of a printed invoice.
+type InvoicePrint struct {
+	Company   PrintCompany
+	Generated string
+	Invoice   Invoice
+	Subtotal  float64
+}
+
+var validPrintDocTypes = append([]string{"traveler", "quote", "invoice"}, labelDocTypes...)
+
+// printSampleData is a record of each document type with one of everything,
+// so a template can be checked against every field it uses before it is
+// saved.
+func printSampleData(docType string) interface{} {
+	switch docType {
+	case "traveler":
+		return TravelerPrint{Company: printCompany(), WO: WorkOrder{ID: "WO-0001"}, BOM: []WOBOMLine{{}}, Routing: []TravelerStep{{}}, Serials: []TravelerSerial{{SerialNumber: "SN-0001"}}}
+	case "quote":
+		return QuotePrint{Company: printCompany(), Quote: Quote{ID: "Q-001"}, Lines: []QuotePrintLine{{}}}
+	case "invoice":
+		return InvoicePrint{Company: printCompany(), Invoice: Invoice{Lines: []InvoiceLine{{}}}}
+	case "reel_label", "bin_label", "serial_label", "carton_label":
+		return labelSampleData
+	}
+	return nil
+}
+
+var builtinPrintTemplates = map[string]string{
+	"traveler": builtinTravelerTemplate,
+	"quote":    builtinQuoteTemplate,
+	"invoice":  builtinInvoiceTemplate,
+
+	"reel_label":   builtinReelLabel,
+	"bin_label":    builtinBinLabel,
+	"serial_label": builtinSerialLabel,
+	"carton_label": builtinCartonLabel,
+}
+
+const builtinTravelerTemplate = `<!DOCTYPE html>
+<html><head><meta charset="UTF-8"><title>Work Order Traveler — {{.WO.ID}}</title>
+<style>
+  * { margin: 0; padding: 0; box-sizing: border-box; }
+  body { font-family: Arial, Helvetica, sans-serif; font-size: 11pt; color: #000; padding: 0.5in; }
+  h1 { font-size: 18pt; margin-bottom: 2pt; }
+  h2 { font-size: 13pt; margin: 16pt 0 6pt; border-bottom: 2px solid #000; padding-bottom: 3pt; }
+  table { width: 100%; border-collapse: collapse; margin-bottom: 12pt; }
+  th, td { border: 1px solid #000; padding: 4pt 6pt; text-align: left; font-size: 10pt; }
+  th { background: #eee; font-weight: bold; }
+  .header { display: flex; justify-content: space-between; align-items: flex-start; border-bottom: 3px solid #000; padding-bottom: 8pt; margin-bottom: 12pt; }
+  .header-left { }
+  .header-right { text-align: right; font-size: 10pt; }
+  .logo { max-height: 40pt; margin-bottom: 4pt; }
+  .info-grid { display: grid; grid-template-columns: 1fr 1fr; gap: 4pt 20pt; margin-bottom: 12pt; font-size: 10pt; }
+  .info-grid dt { font-weight: bold; }
+  .signoff td { height: 40pt; vertical-align: bottom; }
+  .signoff td.label-cell { width: 120pt; font-weight: bold; }
+  .serials { display: grid; grid-template-columns: repeat(3, 1fr); gap: 8pt; margin-bottom: 12pt; }
+  .serial { border: 1px solid #000; padding: 4pt; text-align: center; }
+  @media print { body { padding: 0; } @page { margin: 0.5in; } }
+</style>
+</head><body>
+<div class="header">
+  <div class="header-left">
+    {{if .Company.Logo}}<img class="logo" src="{{.Company.Logo}}" alt="">{{end}}
+    <h1>ZRP — Work Order Traveler</h1>
+    <div style="font-size:10pt;color:#555">{{.Company.Name}}</div>
+  </div>
+  <div class="header-right">
+    {{barcode .WO.ID}}
+    <div><strong>WO:</strong> {{.WO.ID}}</div>
+    <div><strong>Date:</strong> {{.Date}}</div>
+    {{if .WO.DueDate}}<div><strong>Due:</strong> {{.WO.DueDate}}</div>{{end}}
+    <div><strong>Status:</strong> {{.WO.Status}}</div>
+    <div><strong>Priority:</strong> {{.WO.Priority}}</div>
+  </div>
+</div>
+
+<h2>Assembly Information</h2>
+<div class="info-grid">
+  <dt>Assembly IPN:</dt><dd>{{.WO.AssemblyIPN}}</dd>
+  <dt>Description:</dt><dd>{{.Description}}</dd>
+  <dt>Quantity:</dt><dd>{{.WO.Qty}}</dd>
+  <dt>Notes:</dt><dd>{{.WO.Notes}}</dd>
+  {{if .WO.ParentWOID}}<dt>For WO:</dt><dd>{{.WO.ParentWOID}}</dd>{{end}}
+</div>
+
+<h2>Bill of Materials</h2>
+<table>
+  <thead><tr><th>IPN</th><th>Description</th><th>MPN</th><th>Manufacturer</th><th>Qty Req</th><th>Ref Des</th></tr></thead>
+  <tbody>
+  {{- range .BOM}}
+    <tr><td>{{.IPN}}</td><td>{{.Description}}</td><td>{{.MPN}}</td><td>{{.Manufacturer}}</td><td style="text-align:center">{{.QtyRequired}}</td><td>{{.RefDes}}</td></tr>
+  {{- else}}
+    <tr><td colspan="6" style="text-align:center;color:#999">No BOM data</td></tr>
+  {{- end}}
+  </tbody>
+</table>
+
+<h2>Routing</h2>
+<table class="signoff">
+  <thead><tr><th style="width:36pt">Seq</th><th>Operation</th><th>Work Center</th><th style="width:50pt">Qty Good</th><th style="width:50pt">Qty Scrap</th><th>Operator</th><th style="width:70pt">Date</th><th>Signature</th></tr></thead>
+  <tbody>
+  {{- range .Routing}}
+    <tr><td style="text-align:center">{{.Seq}}</td><td>{{.Name}}</td><td>{{.WorkCenter}}</td><td style="text-align:center">{{.QtyGood}}</td><td style="text-align:center">{{.QtyScrap}}</td><td>{{.Operator}}</td><td>{{.Date}}</td><td></td></tr>
+  {{- else}}
+    <tr><td colspan="8" style="text-align:center;color:#999">No routing defined</td></tr>
+  {{- end}}
+  </tbody>
+</table>
+
+<h2>Serial Numbers</h2>
+{{if .Serials}}<div class="serials">
+  {{- range .Serials}}
+  <div class="serial">{{barcode .SerialNumber}}</div>
+  {{- end}}
+</div>{{else}}<p style="font-size:10pt;color:#999">No serial numbers assigned</p>{{end}}
+
+<h2>Sign-Off</h2>
+<table class="signoff">
+  <thead><tr><th style="width:120pt">Step</th><th>Name</th><th style="width:100pt">Date</th><th>Signature</th></tr></thead>
+  <tbody>
+    <tr><td class="label-cell">Kitted by</td><td></td><td></td><td></td></tr>
+    <tr><td class="label-cell">Built by</td><td></td><td></td><td></td></tr>
+    <tr><td class="label-cell">Tested by</td><td></td><td></td><td></td></tr>
+    <tr><td class="label-cell">QA Approved by</td><td></td><td></td><td></td></tr>
+  </tbody>
+</table>
+
+<script>window.onload = () => window.print()</script>
+</body></html>
+`
+
+const builtinQuoteTemplate = `<!DOCTYPE html>
+<html><head><meta charset="UTF-8"><title>Quote — {{.Quote.ID}}</title>
+<style>
+  * { margin: 0; padding: 0; box-sizing: border-box; }
+  body { font-family: Arial, Helvetica, sans-serif; font-size: 11pt; color: #000; padding: 0.5in; }
+  h1 { font-size: 18pt; margin-bottom: 2pt; }
+  h2 { font-size: 13pt; margin: 16pt 0 6pt; border-bottom: 2px solid #000; padding-bottom: 3pt; }
+  table { width: 100%; border-collapse: collapse; margin-bottom: 12pt; }
+  th, td { border: 1px solid #000; padding: 4pt 6pt; text-align: left; font-size: 10pt; }
+  th { background: #eee; font-weight: bold; }
+  .header { display: flex; justify-content: space-between; align-items: flex-start; border-bottom: 3px solid #000; padding-bottom: 8pt; margin-bottom: 12pt; }
+  .logo { max-height: 40pt; margin-bottom: 4pt; }
+  .info-grid { display: grid; grid-template-columns: auto 1fr; gap: 4pt 12pt; margin-bottom: 12pt; font-size: 10pt; }
+  .info-grid dt { font-weight: bold; }
+  .total-row td { font-weight: bold; font-size: 11pt; }
+  .footer { margin-top: 24pt; font-size: 9pt; color: #555; border-top: 1px solid #999; padding-top: 8pt; }
+  @media print { body { padding: 0; } @page { margin: 0.5in; } }
+</style>
+</head><body>
+<div class="header">
+  <div>
+    {{if .Company.Logo}}<img class="logo" src="{{.Company.Logo}}" alt="">{{end}}
+    <h1>ZRP — Quote</h1>
+    <div style="font-size:10pt;color:#555">{{.Company.Name}}</div>
+  </div>
+  <div style="text-align:right;font-size:10pt">
+    <div><strong>Quote:</strong> {{.Quote.ID}}</div>
+    <div><strong>Date:</strong> {{.Date}}</div>
+    <div><strong>Valid Until:</strong> {{.Quote.ValidUntil}}</div>
+    <div><strong>Status:</strong> {{.Quote.Status}}</div>
+  </div>
+</div>
+
+<h2>Customer</h2>
+<div class="info-grid">
+  <dt>Customer:</dt><dd>{{.Quote.Customer}}</dd>
+</div>
+
+<h2>Line Items</h2>
+<table>
+  <thead><tr><th>IPN</th><th>Description</th><th style="text-align:center">Qty</th><th style="text-align:right">Unit Price</th><th style="text-align:right">Total</th></tr></thead>
+  <tbody>
+  {{- range .Lines}}
+    <tr><td>{{.IPN}}</td><td>{{.Description}}</td><td style="text-align:center">{{.Qty}}</td><td style="text-align:right">{{money .UnitPrice}}</td><td style="text-align:right">{{money .Total}}</td></tr>
+  {{- else}}
+    <tr><td colspan="5" style="text-align:center;color:#999">No line items</td></tr>
+  {{- end}}
+    <tr class="total-row"><td colspan="4" style="text-align:right;border-top:2px solid #000">Subtotal:</td><td style="text-align:right;border-top:2px solid #000">{{money .Total}}</td></tr>
+  </tbody>
+</table>
+
+{{if .Quote.Notes}}<h2>Notes</h2><p style="font-size:10pt">{{.Quote.Notes}}</p>{{end}}
+
+<div class="footer">
+  <p><strong>Terms:</strong> Net 30. Prices valid through the date shown above.</p>
+  <p><strong>Contact:</strong> {{.Company.Email}} | {{.Company.Name}}</p>
+</div>
+
+<script>window.onload = () => window.print()</script>
+</body></html>
+`
+
+const builtinInvoiceTemplate = `<!DOCTYPE html>
+<html><head><meta charset="UTF-8"><title>Invoice {{.Invoice.InvoiceNumber}}</title>
+<style>
+  * { margin: 0; padding: 0; box-sizing: border-box; }
+  body { font-family: Arial, Helvetica, sans-serif; font-size: 11pt; color: #000; padding: 0.5in; }
+  h1 { font-size: 18pt; margin-bottom: 2pt; }
+  h2 { font-size: 13pt; margin: 16pt 0 6pt; border-bottom: 2px solid #000; padding-bottom: 3pt; }
+  table { width: 100%; border-collapse: collapse; margin-bottom: 12pt; }
+  th, td { border: 1px solid #000; padding: 4pt 6pt; text-align: left; font-size: 10pt; }
+  th { background: #eee; font-weight: bold; }
+  .logo { max-height: 40pt; margin-bottom: 4pt; }
+  .paid { font-size: 24pt; font-weight: bold; color: #080; margin: 12pt 0; }
+  @media print { body { padding: 0; } @page { margin: 0.5in; } }
+</style>
+</head><body>
+{{if .Company.Logo}}<img class="logo" src="{{.Company.Logo}}" alt="">{{end}}
+<h1>INVOICE</h1>
+<div>{{.Company.Name}}</div>
+{{if .Company.Address}}<div>{{.Company.Address}}</div>{{end}}
+<div>{{.Company.Email}}</div>
+
+<h2>Details</h2>
+<div>Invoice Number: {{.Invoice.InvoiceNumber}}</div>
+<div>Customer: {{.Invoice.Customer}}</div>
+<div>Issue Date: {{.Invoice.IssueDate}}</div>
+<div>Due Date: {{.Invoice.DueDate}}</div>
+<div>Status: {{.Invoice.Status}}</div>
+
+<h2>Lines</h2>
+<table>
+  <thead><tr><th>Description</th><th>IPN</th><th>Qty</th><th>Unit Price</th><th>Total</th></tr></thead>
+  <tbody>
+  {{- range .Invoice.Lines}}
+    <tr><td>{{.Description}}</td><td>{{.IPN}}</td><td>{{.Quantity}}</td><td>{{money .UnitPrice}}</td><td>{{money .Total}}</td></tr>
+  {{- end}}
+  </tbody>
+</table>
+<div>Subtotal: {{money .Subtotal}}</div>
+<div>Tax: {{money .Invoice.Tax}}</div>
+<div><strong>Total: {{money .Invoice.Total}}</strong></div>
+{{if eq .Invoice.Status "paid"}}<div class="paid">PAID</div>{{end}}
+{{if .Invoice.Notes}}<h2>Notes</h2><p>{{.Invoice.Notes}}</p>{{end}}
+</body></html>
+`
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Labels are ZPL templates rather than HTML: the same payload goes to a
+// Zebra printer as is, or through zplToPDF onto laser label sheets.
+
+// LabelData is what a label template gets for one label. Every field is
+// already text, cleaned of ZPL command characters.
+type LabelData struct {
+	Company      string
+	IPN          string
+	Description  string
+	MPN          string
+	Manufacturer string
+	Lot          string
+	DateCode     string
+	Qty          string
+	Serial       string
+	PO           string
+	WO           string
+	Order        string
+	Location     string
+	Expires      string
+	Customer     string
+	ShipTo       string
+	Carrier      string
+	Tracking     string
+	Shipment     string
+	Carton       int
+	Cartons      int
+	Date         string
+}
+
+var labelDocTypes = []string{"reel_label", "bin_label", "serial_label", "carton_label"}
+
+func isLabelDocType(docType string) bool {
+	for _, t := range labelDocTypes {
+		if t == docType {
+			return true
+		}
+	}
+	return false
+}
+
+// zplText makes s safe inside a ^FD field: the command prefixes ^ and ~
+// and control characters would end the field or start a command.
+func zplText(s string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r == '^' || r == '~' || r < 32 || r == 127 {
+			return ' '
+		}
+		return r
+	}, s))
+}
+
+func (d LabelData) clean() LabelData {
+	for _, f := range []*string{&d.Company, &d.IPN, &d.Description, &d.MPN, &d.Manufacturer, &d.Lot, &d.DateCode, &d.Qty,
+		&d.Serial, &d.PO, &d.WO, &d.Order, &d.Location, &d.Expires, &d.Customer, &d.ShipTo, &d.Carrier, &d.Tracking, &d.Shipment, &d.Date} {
+		*f = zplText(*f)
+	}
+	return d
+}
+
+func labelQty(q float64) string {
+	return strconv.FormatFloat(q, 'f', -1, 64)
+}
+
+func parseLabelTemplate(name, body string) (*texttemplate.Template, error) {
+	return texttemplate.New(name).Funcs(texttemplate.FuncMap{"date": printFuncs["date"]}).Parse(body)
+}
+
+// renderLabelZPL runs each label through the template and joins the
+// results into one print job.
+func renderLabelZPL(name, body string, labels []LabelData) (string, error) {
+	tmpl, err := parseLabelTemplate(name, body)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	for _, l := range labels {
+		if err := tmpl.Execute(&buf, l.clean()); err != nil {
+			return "", err
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.String(), nil
+}
+
+// checkLabelTemplate is checkPrintTemplate for labels: the sample label
+// must also come out as a complete ^XA...^XZ format.
+func checkLabelTemplate(docType, body string) error {
+	zpl, err := renderLabelZPL(docType, body, []LabelData{labelSampleData})
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(zpl, "^XA") || !strings.Contains(zpl, "^XZ") {
+		return fmt.Errorf("a label template must start a label with ^XA and end it with ^XZ")
+	}
+	return nil
+}
+
+var labelSampleData = LabelData{Company: "ZRP", IPN: "RES-0001", Description: "10k 0402 resistor", MPN: "RC0402FR-0710KL",
+	Manufacturer: "Yageo", Lot: "LOT-0001", DateCode: "2601", Qty: "5000", Serial: "SN-0001", PO: "PO-0001", WO: "WO-0001",
+	Order: "SO-0001", Location: "A-01-01", Expires: "2027-01-01", Customer: "Acme", ShipTo: "Acme, 1 Main St", Carrier: "UPS",
+	Tracking: "1Z999AA10123456784", Shipment: "SH-0001", Carton: 1, Cartons: 1, Date: "2026-01-01"}
+
+// --- ZPL to PDF ---
+
+// zplDPI is the resolution ZPL coordinates are in (an 8 dot/mm printer).
+const zplDPI = 203
+
+type zplLabel struct {
+	width, height int
+	content       strings.Builder
+}
+
+func zplPt(dots float64) float64 { return dots * 72 / zplDPI }
+
+func (l *zplLabel) rect(x, y, w, h float64) {
+	fmt.Fprintf(&l.content, "%.2f %.2f %.2f %.2f re f\n", zplPt(x), zplPt(float64(l.height)-y-h), zplPt(w), zplPt(h))
+}
+
+func (l *zplLabel) text(x, y, h float64, s string) {
+	if s == "" {
+		return
+	}
+	fmt.Fprintf(&l.content, "BT /F1 %.2f Tf %.2f %.2f Td (%s) Tj ET\n", zplPt(h), zplPt(x), zplPt(float64(l.height)-y-h*0.8), pdfString(s))
+}
+
+// matrix draws a 2D symbol with modules of size dots.
+func (l *zplLabel) matrix(x, y float64, m [][]bool, size float64) {
+	for r, row := range m {
+		for c := 0; c < len(row); c++ {
+			if !row[c] {
+				continue
+			}
+			run := 1
+			for c+run < len(row) && row[c+run] {
+				run++
+			}
+			l.rect(x+float64(c)*size, y+float64(r)*size, float64(run)*size, size)
+			c += run - 1
+		}
+	}
+}
+
+func zplNum(params []string, i int, def float64) float64 {
+	if i < len(params) {
+		if v, err := strconv.ParseFloat(strings.TrimSpace(params[i]), 64); err == nil {
+			return v
+		}
+	}
+	return def
+}
+
+// parseZPL draws the commands labels use: ^XA/^XZ, ^PW/^LL, ^FO, ^A/^CF,
+// ^FB, ^FD/^FS, ^BY, ^BC (Code 128), ^BX (Data Matrix), ^BQ (QR) and ^GB.
+// Anything else is skipped.
+func parseZPL(zpl string) []*zplLabel {
+	var labels []*zplLabel
+	var cur *zplLabel
+	width, height := 812, 406
+	fontH, defFontH := 30.0, 30.0
+	moduleW, barH := 2.0, 10.0
+
+	var x, y float64
+	var kind string
+	var kindParams []string
+	var blockW, blockLines float64
+	var data string
+	hasData := false
+	resetField := func() {
+		kind, kindParams, data, hasData = "", nil, "", false
+		fontH, blockW, blockLines = defFontH, 0, 0
+	}
+	resetField()
+
+	drawField := func() {
+		if cur == nil {
+			return
+		}
+		switch kind {
+		case "BC":
+			h := zplNum(kindParams, 1, barH)
+			widths, err := code128Widths(data)
+			if err != nil || !hasData {
+				break
+			}
+			bx := x
+			for i, wd := range widths {
+				if i%2 == 0 {
+					cur.rect(bx, y, float64(wd)*moduleW, h)
+				}
+				bx += float64(wd) * moduleW
+			}
+			// The interpretation line prints unless turned off
+			if len(kindParams) < 3 || !strings.EqualFold(strings.TrimSpace(kindParams[2]), "N") {
+				cur.text(x, y+h+4, 20, data)
+			}
+		case "BX":
+			if m, err := dataMatrixEncode(data); err == nil && hasData {
+				cur.matrix(x, y, m, zplNum(kindParams, 1, 4))
+			}
+		case "BQ":
+			// Field data is <error correction><input mode>,<data>
+			if len(data) > 3 && data[2] == ',' {
+				data = data[3:]
+			}
+			if m, err := qrEncode(data); err == nil && hasData && data != "" {
+				cur.matrix(x, y, m, zplNum(kindParams, 2, 2))
+			}
+		case "GB":
+			t := zplNum(kindParams, 2, 1)
+			w, h := max(zplNum(kindParams, 0, t), t), max(zplNum(kindParams, 1, t), t)
+			if 2*t >= w || 2*t >= h {
+				cur.rect(x, y, w, h)
+			} else {
+				cur.rect(x, y, w, t)
+				cur.rect(x, y+h-t, w, t)
+				cur.rect(x, y, t, h)
+				cur.rect(x+w-t, y, t, h)
+			}
+		default:
+			if !hasData {
+				break
+			}
+			lines := []string{data}
+			if blockW > 0 {
+				lines = wrapPrintText(data, max(1, int(blockW/(fontH*0.55))))
+				if blockLines > 0 && len(lines) > int(blockLines) {
+					lines = lines[:int(blockLines)]
+				}
+			}
+			for i, s := range lines {
+				cur.text(x, y+float64(i)*fontH, fontH, s)
+			}
+		}
+	}
+
+	for i := 0; i < len(zpl); {
+		c := zpl[i]
+		if c != '^' && c != '~' {
+			i++
+			continue
+		}
+		if i+2 > len(zpl) {
+			break
+		}
+		cmd := strings.ToUpper(zpl[i+1 : min(i+3, len(zpl))])
+		start := i + 3
+		if cmd[0] == 'A' && cmd != "A@" {
+			// ^A takes its font name in place of a second letter
+			cmd, start = "A", i+2
+		}
+		end := strings.IndexAny(zpl[min(start, len(zpl)):], "^~")
+		if end < 0 {
+			end = len(zpl)
+		} else {
+			end += start
+		}
+		arg := zpl[min(start, end):end]
+		params := strings.Split(arg, ",")
+		i = end
+
+		switch cmd {
+		case "XA":
+			cur = &zplLabel{width: width, height: height}
+			resetField()
+		case "XZ":
+			if cur != nil {
+				labels = append(labels, cur)
+			}
+			cur = nil
+		case "PW":
+			width = int(zplNum(params, 0, float64(width)))
+			if cur != nil {
+				cur.width = width
+			}
+		case "LL":
+			height = int(zplNum(params, 0, float64(height)))
+			if cur != nil {
+				cur.height = height
+			}
+		case "FO":
+			x, y = zplNum(params, 0, 0), zplNum(params, 1, 0)
+		case "A":
+			fontH = zplNum(params, 1, fontH)
+		case "CF":
+			defFontH = zplNum(params, 1, defFontH)
+			fontH = defFontH
+		case "FB":
+			blockW, blockLines = zplNum(params, 0, 0), zplNum(params, 1, 1)
+		case "BY":
+			moduleW, barH = zplNum(params, 0, moduleW), zplNum(params, 2, barH)
+		case "BC", "BX", "BQ", "GB":
+			kind, kindParams = cmd, params
+		case "FD":
+			data, hasData = arg, true
+		case "FS":
+			drawField()
+			resetField()
+		}
+	}
+	return labels
+}
+
+// zplToPDF lays the labels of a ZPL job out on US Letter sheets, as many
+// to a page as fit, each with a light cut outline.
+func zplToPDF(zpl string) []byte {
+	const (
+		pageW, pageH = 612, 792
+		margin       = 18
+	)
+	var pages []string
+	var page strings.Builder
+	var col, row, cols, rows int
+	for _, l := range parseZPL(zpl) {
+		w, h := zplPt(float64(l.width)), zplPt(float64(l.height))
+		c := max(1, int((pageW-2*margin)/w))
+		r := max(1, int((pageH-2*margin)/h))
+		if page.Len() > 0 && (c != cols || r != rows || row >= rows) {
+			pages = append(pages, page.String())
+			page.Reset()
+			col, row = 0, 0
+		}
+		cols, rows = c, r
+		ox := margin + float64(col)*w
+		oy := pageH - margin - float64(row+1)*h
+		fmt.Fprintf(&page, "q 1 0 0 1 %.2f %.2f cm\n0.8 G 0.25 w 0 0 %.2f %.2f re S\n0 g\n%sQ\n", ox, oy, w, h, l.content.String())
+		if col++; col >= cols {
+			col = 0
+			row++
+		}
+	}
+	if page.Len() > 0 || len(pages) == 0 {
+		pages = append(pages, page.String())
+	}
+	return pdfDocument(pages, pageW, pageH)
+}
+
+const builtinReelLabel = `^XA
+^PW812
+^LL406
+^FO20,16^A0N,24,24^FD{{.Company}}^FS
+^FO20,46^A0N,36,36^FDIPN: {{.IPN}}^FS
+^FO20,88^BY2^BCN,50,N,N,N^FD{{.IPN}}^FS
+^FO20,146^FB560,1^A0N,22,22^FD{{.Description}}^FS
+^FO20,172^A0N,22,22^FD{{if .MPN}}MPN: {{.MPN}}{{end}}{{if .Manufacturer}} ({{.Manufacturer}}){{end}}^FS
+{{- if .Lot}}
+^FO20,204^A0N,26,26^FDLOT: {{.Lot}}^FS
+^FO20,232^BY2^BCN,40,N,N,N^FD{{.Lot}}^FS
+{{- end}}
+^FO20,284^A0N,26,26^FDQTY: {{.Qty}}^FS
+^FO20,312^BY2^BCN,40,N,N,N^FD{{.Qty}}^FS
+^FO440,284^A0N,22,22^FD{{if .DateCode}}D/C: {{.DateCode}}{{end}}^FS
+^FO440,310^A0N,22,22^FD{{if .PO}}PO: {{.PO}}{{else if .WO}}WO: {{.WO}}{{end}}^FS
+^FO440,336^A0N,22,22^FD{{if .Expires}}EXP: {{.Expires}}{{end}}^FS
+^FO620,40^BXN,6,200^FD{{.IPN}}|{{.Lot}}|{{.Qty}}^FS
+^XZ`
+
+const builtinBinLabel = `^XA
+^PW812
+^LL406
+^FO20,20^A0N,60,60^FD{{.IPN}}^FS
+^FO20,90^FB760,1^A0N,26,26^FD{{.Description}}^FS
+^FO20,130^BY3^BCN,100,N,N,N^FD{{.IPN}}^FS
+^FO20,256^A0N,30,30^FD{{if .Location}}LOC: {{.Location}}{{end}}^FS
+^FO20,296^A0N,24,24^FD{{if .MPN}}MPN: {{.MPN}}{{end}}^FS
+^FO620,210^BQN,2,6^FDMA,{{.IPN}}^FS
+^XZ`
+
+const builtinSerialLabel = `^XA
+^PW406
+^LL203
+^FO15,12^A0N,22,22^FD{{.IPN}}^FS
+^FO15,40^BY2^BCN,60,N,N,N^FD{{.Serial}}^FS
+^FO15,108^A0N,28,28^FDS/N {{.Serial}}^FS
+^FO15,145^A0N,20,20^FD{{if .WO}}WO {{.WO}}{{end}}^FS
+^FO300,100^BQN,2,3^FDMA,{{.Serial}}^FS
+^XZ`
+
+const builtinCartonLabel = `^XA
+^PW812
+^LL1218
+^FO30,30^A0N,36,36^FD{{.Company}}^FS
+^FO30,84^A0N,24,24^FDSHIP TO:^FS
+^FO30,114^FB750,4^A0N,32,32^FD{{.ShipTo}}^FS
+^FO30,290^GB752,3,3^FS
+^FO30,320^A0N,28,28^FDSHIPMENT: {{.Shipment}}^FS
+^FO30,360^BY3^BCN,100,N,N,N^FD{{.Shipment}}^FS
+{{- if .Tracking}}
+^FO30,490^A0N,28,28^FD{{.Carrier}} {{.Tracking}}^FS
+^FO30,530^BY2^BCN,100,N,N,N^FD{{.Tracking}}^FS
+{{- end}}
+^FO30,670^GB752,3,3^FS
+^FO30,700^A0N,28,28^FD{{if .Order}}ORDER: {{.Order}}{{end}}^FS
+^FO30,740^A0N,28,28^FD{{if .Customer}}CUSTOMER: {{.Customer}}{{end}}^FS
+^FO30,780^A0N,28,28^FDDATE: {{.Date}}^FS
+^FO30,900^A0N,70,70^FDCARTON {{.Carton}} OF {{.Cartons}}^FS
+^FO560,860^BQN,2,7^FDMA,{{.Shipment}}|{{.Carton}}/{{.Cartons}}^FS
+^XZ`
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// PrintCompany is the letterhead every print template gets as .Company.
+type PrintCompany struct {
+	Name    string       `json:"company_name"`
+	Email   string       `json:"company_email"`
+	Address string       `json:"company_address"`
+	Logo    template.URL `json:"logo"`
+}
+
+const (
+	printCompanyNameKey    = "print_company_name"
+	printCompanyEmailKey   = "print_company_email"
+	printCompanyAddressKey = "print_company_address"
+	printCompanyLogoKey    = "print_company_logo"
+
+	printCSP = "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; img-src data:"
+)
+
+// printCompany reads the print settings, falling back to the
+// ZRP_COMPANY_NAME/ZRP_COMPANY_EMAIL environment defaults.
+func printCompany() PrintCompany {
+	c := PrintCompany{
+		Name:    getAppSetting(printCompanyNameKey),
+		Email:   getAppSetting(printCompanyEmailKey),
+		Address: getAppSetting(printCompanyAddressKey),
+		// Only data: image URIs are ever stored
+		Logo: template.URL(getAppSetting(printCompanyLogoKey)),
+	}
+	if c.Name == "" {
+		c.Name = companyName
+	}
+	if c.Email == "" {
+		c.Email = companyEmail
+	}
+	return c
+}
+
+var printFuncs = template.FuncMap{
+	"barcode": barcodeSVG,
+	"date": func(s string) string {
+		if len(s) > 10 {
+			return s[:10]
+		}
+		return s
+	},
+	"money": func(f float64) string { return fmt.Sprintf("$%.2f", f) },
+}
+
+func parsePrintTemplate(name, body string) (*template.Template, error) {
+	return template.New(name).Funcs(printFuncs).Parse(body)
+}
+
+// loadPrintTemplate finds the template to print a document with: the one
+// asked for, else the document type's default, else the built-in layout. A
+// database without the template tables prints with the built-in layout.
+func loadPrintTemplate(docType, id string) (name, body string, err error) {
+	q := `SELECT t.name, v.body FROM print_templates t
+		JOIN print_template_versions v ON v.template_id = t.id AND v.version = t.current_version
+		WHERE t.doc_type = ?`
+	if id != "" {
+		err = db.QueryRow(q+" AND t.id = ?", docType, id).Scan(&name, &body)
+		if err == sql.ErrNoRows {
+			return "", "", fmt.Errorf("no %s template %s", docType, id)
+		}
+		return name, body, err
+	}
+	if db.QueryRow(q+" AND t.is_default = 1", docType).Scan(&name, &body) == nil {
+		return name, body, nil
+	}
+	return "built-in", builtinPrintTemplates[docType], nil
+}
+
+// renderPrintDocument prints data through the document type's template, as
+// HTML or (format=pdf) a PDF of the rendered text. It reports whether the
+// document was written.
+func renderPrintDocument(w http.ResponseWriter, r *http.Request, docType, defaultFormat, filename string, data interface{}) bool {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = defaultFormat
+	}
+	if format != "html" && format != "pdf" {
+		jsonErr(w, "format must be html or pdf", 400)
+		return false
+	}
+	name, body, err := loadPrintTemplate(docType, r.URL.Query().Get("template"))
+	if err != nil {
+		jsonErr(w, err.Error(), 404)
+		return false
+	}
+	tmpl, err := parsePrintTemplate(name, body)
+	if err != nil {
+		jsonErr(w, "template "+name+": "+err.Error(), 500)
+		return false
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		jsonErr(w, "template "+name+": "+err.Error(), 500)
+		return false
+	}
+
+	if format == "pdf" {
+		pdf := htmlToPDF(buf.String())
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.pdf\"", filename))
+		w.Header().Set("Content-Length", fmt.Sprint(len(pdf)))
+		w.Write(pdf)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", printCSP)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Write(buf.Bytes())
+	return true
+}
+
+// --- Code 128 barcodes ---
+
+// code128Patterns are the bar/space module widths of each Code 128 symbol;
+// 103-105 are the start codes and 106 is stop.
+var code128Patterns = [...]string{
+	"212222", "222122", "222221", "121223", "121322", "131222", "122213", "122312", "132212", "221213",
+	"221312", "231212", "112232", "122132", "122231", "113222", "123122", "123221", "223211", "221132",
+	"221231", "213212", "223112", "312131", "311222", "321122", "321221", "312212", "322112", "322211",
+	"212123", "212321", "232121", "111323", "131123", "131321", "112313", "132113", "132311", "211313",
+	"231113", "231311", "112133", "112331", "132131", "113123", "113321", "133121", "313121", "211331",
+	"231131", "213113", "213311", "213131", "311123", "311321", "331121", "312113", "312311", "332111",
+	"314111", "221411", "431111", "111224", "111422", "121124", "121421", "141122", "141221", "112214",
+	"112412", "122114", "122411", "142112", "142211", "241211", "221114", "413111", "241112", "134111",
+	"111242", "121142", "121241", "114212", "124112", "124211", "411212", "421112", "421211", "212141",
+	"214121", "412121", "111143", "111341", "131141", "114113", "114311", "411113", "411311", "113141",
+	"114131", "311141", "411131", "211412", "211214", "211232", "2331112",
+}
+
+// code128Widths encodes printable ASCII in code set B and returns the
+// alternating bar and space widths in modules, without quiet zones.
+func code128Widths(s string) ([]int, error) {
+	if s == "" {
+		return nil, fmt.Errorf("nothing to encode")
+	}
+	codes := []int{104}
+	sum := 104
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 32 || c > 126 {
+			return nil, fmt.Errorf("%q can't be encoded in Code 128 set B", s)
+		}
+		codes = append(codes, int(c)-32)
+		sum += (int(c) - 32) * (i + 1)
+	}
+	codes = append(codes, sum%103, 106)
+	var widths []int
+	for _, c := range codes {
+		for _, d := range code128Patterns[c] {
+			widths = append(widths, int(d-'0'))
+		}
+	}
+	return widths, nil
+}
+
+// barcodeSVG draws s as an inline Code 128 SVG with the text under it. The
+// data-barcode attribute lets the PDF renderer redraw it as bars.
+func barcodeSVG(s string) template.HTML {
+	widths, err := code128Widths(s)
+	if err != nil {
+		return template.HTML(html.EscapeString(s))
+	}
+	const quiet, height = 10, 40
+	var bars strings.Builder
+	x := quiet
+	for i, wd := range widths {
+		if i%2 == 0 {
+			fmt.Fprintf(&bars, `<rect x="%d" y="0" width="%d" height="%d"/>`, x, wd, height)
+		}
+		x += wd
+	}
+	total := x + quiet
+	esc := html.EscapeString(s)
+	return template.HTML(fmt.Sprintf(`<svg class="barcode" data-barcode="%s" xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+
+		`<rect width="%d" height="%d" fill="#fff"/><g fill="#000">%s</g>`+
+		`<text x="%d" y="%d" font-family="monospace" font-size="10" text-anchor="middle">%s</text></svg>`,
+		esc, total*3/2, (height+14)*3/2, total, height+14, total, height+14, bars.String(), total/2, height+11, esc))
+}
+
+// --- PDF output ---
+
+type printLine struct {
+	text    string
+	heading bool
+	barcode bool
+}
+
+var (
+	rePrintDrop    = []*regexp.Regexp{regexp.MustCompile(`(?is)<head\b.*?</head>`), regexp.MustCompile(`(?is)<script\b.*?</script>`), regexp.MustCompile(`(?is)<style\b.*?</style>`)}
+	rePrintBarcode = regexp.MustCompile(`(?is)<svg[^>]*\bdata-barcode="([^"]*)"[^>]*>.*?</svg>`)
+	rePrintSVG     = regexp.MustCompile(`(?is)<svg\b.*?</svg>`)
+	rePrintHeading = regexp.MustCompile(`(?i)<h[1-3]\b[^>]*>`)
+	rePrintCell    = regexp.MustCompile(`(?i)</(td|th)>`)
+	rePrintTerm    = regexp.MustCompile(`(?i)</dt>`)
+	rePrintBreak   = regexp.MustCompile(`(?i)<(br|tr|p|div|li|dt|table)\b[^>]*>|</(tr|p|div|li|dd|h[1-6]|table)>`)
+	rePrintTag     = regexp.MustCompile(`<[^>]*>`)
+	rePrintSpace   = regexp.MustCompile(`[ \t\r\f\v]+`)
+)
+
+// htmlToPrintLines flattens a rendered template into lines of text:
+// headings are kept bold, a table row's cells are joined with bars, and
+// barcodes become barcode lines.
+func htmlToPrintLines(src string) []printLine {
+	s := src
+	for _, re := range rePrintDrop {
+		s = re.ReplaceAllString(s, "")
+	}
+	s = rePrintBarcode.ReplaceAllString(s, "\n\x01$1\n")
+	s = rePrintSVG.ReplaceAllString(s, "")
+	s = rePrintHeading.ReplaceAllString(s, "\n\x02")
+	s = rePrintCell.ReplaceAllString(s, "\x03")
+	s = rePrintTerm.ReplaceAllString(s, " ")
+	s = rePrintBreak.ReplaceAllString(s, "\n")
+	s = rePrintTag.ReplaceAllString(s, "")
+
+	var lines []printLine
+	for _, l := range strings.Split(s, "\n") {
+		l = strings.TrimSpace(rePrintSpace.ReplaceAllString(l, " "))
+		if strings.Contains(l, "\x03") {
+			cells := strings.Split(strings.TrimRight(l, "\x03 "), "\x03")
+			for i := range cells {
+				cells[i] = strings.TrimSpace(cells[i])
+			}
+			l = strings.Join(cells, " | ")
+		}
+		if l == "" {
+			continue
+		}
+		switch l[0] {
+		case '\x01':
+			lines = append(lines, printLine{text: html.UnescapeString(l[1:]), barcode: true})
+		case '\x02':
+			lines = append(lines, printLine{text: html.UnescapeString(strings.TrimSpace(l[1:])), heading: true})
+		default:
+			lines = append(lines, printLine{text: html.UnescapeString(l)})
+		}
+	}
+	return lines
+}
+
+// pdfString escapes text for a PDF string in WinAnsi encoding.
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '—' || r == '–':
+			b.WriteByte('-')
+		case r >= 32 && r < 127:
+			b.WriteRune(r)
+		case r >= 160 && r < 256:
+			fmt.Fprintf(&b, "\\%03o", r)
+		case r >= 32:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// wrapPrintText splits text into lines of at most n characters, at spaces
+// where it can.
+func wrapPrintText(s string, n int) []string {
+	var out []string
+	for utf8.RuneCountInString(s) > n {
+		r := []rune(s)
+		cut := n
+		for i := n; i > n/2; i-- {
+			if r[i] == ' ' {
+				cut = i
+				break
+			}
+		}
+		out = append(out, strings.TrimSpace(string(r[:cut])))
+		s = strings.TrimSpace(string(r[cut:]))
+	}
+	return append(out, s)
+}
+
+// htmlToPDF lays a rendered template out as a text PDF on US Letter pages,
+// drawing its barcodes as bars.
+func htmlToPDF(src string) []byte {
+	const (
+		pageW, pageH = 612, 792
+		margin       = 50
+	)
+	var pages []string
+	var page strings.Builder
+	y := pageH - margin
+	newPage := func() {
+		pages = append(pages, page.String())
+		page.Reset()
+		y = pageH - margin
+	}
+	need := func(h int) {
+		if y-h < margin {
+			newPage()
+		}
+	}
+	for _, l := range htmlToPrintLines(src) {
+		switch {
+		case l.barcode:
+			widths, err := code128Widths(l.text)
+			if err != nil {
+				break
+			}
+			need(46)
+			page.WriteString("0 0 0 rg\n")
+			x := float64(margin)
+			for i, wd := range widths {
+				if i%2 == 0 {
+					fmt.Fprintf(&page, "%.2f %d %.2f 30 re f\n", x, y-30, float64(wd)*1.2)
+				}
+				x += float64(wd) * 1.2
+			}
+			fmt.Fprintf(&page, "BT /F1 9 Tf %d %d Td (%s) Tj ET\n", margin, y-41, pdfString(l.text))
+			y -= 48
+		case l.heading:
+			need(24)
+			y -= 6
+			fmt.Fprintf(&page, "BT /F2 13 Tf %d %d Td (%s) Tj ET\n", margin, y-13, pdfString(l.text))
+			y -= 18
+		default:
+			for _, part := range wrapPrintText(l.text, 100) {
+				need(14)
+				fmt.Fprintf(&page, "BT /F1 10 Tf %d %d Td (%s) Tj ET\n", margin, y-10, pdfString(part))
+				y -= 14
+			}
+		}
+	}
+	if page.Len() > 0 || len(pages) == 0 {
+		newPage()
+	}
+
+	return pdfDocument(pages, pageW, pageH)
+}
+
+// pdfDocument wraps page content streams into a PDF with Helvetica as /F1
+// and Helvetica-Bold as /F2.
+func pdfDocument(pages []string, pageW, pageH int) []byte {
+	// Objects: 1 catalog, 2 page tree, 3-4 fonts, then a content stream and
+	// page object per page
+	var objs []string
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 6+2*i)
+	}
+	objs = append(objs,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+	)
+	for i, content := range pages {
+		objs = append(objs,
+			fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", len(content), content),
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Contents %d 0 R /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> >>",
+				pageW, pageH, 5+2*i))
+	}
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objs))
+	for i, o := range objs {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, o)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objs)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R /Info << /Producer (ZRP) /CreationDate (D:%s) >> >>\nstartxref\n%d\n%%%%EOF\n",
+		len(objs)+1, time.Now().Format("20060102150405"), xref)
+	return b.Bytes()
+}
@@ -139,6 +139,7 @@ func buildTextSearchFilters(entityType string, searchText string) []string {
 			"description LIKE ?",
 			"mpn LIKE ?",
 			"location LIKE ?",
+			"ipn IN (SELECT ipn FROM inventory_locations WHERE location_code LIKE ? AND qty_on_hand > 0)",
 		}
 	case "ncrs":
 		fields = []string{
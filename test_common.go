@@ -211,6 +211,31 @@ func setupTestDB(t *testing.T) *sql.DB {
 			id INTEGER PRIMARY KEY AUTOINCREMENT, ipn TEXT NOT NULL,
 			type TEXT NOT NULL CHECK(type IN ('receive','issue','adjust','transfer','return','scrap')),
 			qty REAL NOT NULL, reference TEXT, notes TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP, lot_id INTEGER,
+			location TEXT DEFAULT '', to_location TEXT DEFAULT ''
+		);
+		CREATE TABLE IF NOT EXISTS inventory_lots (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ipn TEXT NOT NULL,
+			lot_number TEXT NOT NULL,
+			date_code TEXT DEFAULT '',
+			vendor_id TEXT DEFAULT '',
+			po_id TEXT DEFAULT '',
+			po_line_id INTEGER,
+			receiving_inspection_id INTEGER,
+			wo_id TEXT DEFAULT '',
+			qty_received REAL DEFAULT 0 CHECK(qty_received >= 0),
+			qty_on_hand REAL DEFAULT 0 CHECK(qty_on_hand >= 0),
+			status TEXT DEFAULT 'available' CHECK(status IN ('inspection','available','hold','quarantine','depleted')),
+			received_at DATETIME,
+			notes TEXT DEFAULT '',
+			location TEXT DEFAULT '',
+			msl_level TEXT DEFAULT '',
+			msl_floor_life_hours REAL,
+			msl_state TEXT DEFAULT 'sealed',
+			msl_exposure_hours REAL DEFAULT 0,
+			msl_opened_at DATETIME,
+			expires_at DATE,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		)
 	`)
@@ -218,6 +243,217 @@ func setupTestDB(t *testing.T) *sql.DB {
 		t.Fatalf("Failed to create inventory_transactions table: %v", err)
 	}
 
+	// Create receiving_inspections table
+	_, err = testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS receiving_inspections (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			po_id TEXT NOT NULL,
+			po_line_id INTEGER NOT NULL,
+			ipn TEXT NOT NULL,
+			qty_received REAL NOT NULL DEFAULT 0 CHECK(qty_received >= 0),
+			qty_passed REAL NOT NULL DEFAULT 0 CHECK(qty_passed >= 0),
+			qty_failed REAL NOT NULL DEFAULT 0 CHECK(qty_failed >= 0),
+			qty_on_hold REAL NOT NULL DEFAULT 0 CHECK(qty_on_hold >= 0),
+			inspector TEXT,
+			inspected_at DATETIME,
+			notes TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create receiving_inspections table: %v", err)
+	}
+
+	// Create inventory_reservations table
+	_, err = testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS inventory_reservations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ref_type TEXT NOT NULL,
+			ref_id TEXT NOT NULL,
+			ipn TEXT NOT NULL,
+			qty REAL NOT NULL DEFAULT 0 CHECK(qty >= 0),
+			qty_consumed REAL NOT NULL DEFAULT 0 CHECK(qty_consumed >= 0),
+			status TEXT DEFAULT 'open' CHECK(status IN ('open','consumed','released')),
+			created_by TEXT DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			closed_at DATETIME
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create inventory_reservations table: %v", err)
+	}
+
+	// Create routing tables
+	_, err = testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS work_centers (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			description TEXT DEFAULT '',
+			labor_rate REAL DEFAULT 0 CHECK(labor_rate >= 0),
+			active INTEGER DEFAULT 1,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS routing_steps (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			assembly_ipn TEXT NOT NULL,
+			seq INTEGER NOT NULL CHECK(seq > 0),
+			name TEXT NOT NULL,
+			work_center_id TEXT DEFAULT '',
+			instructions TEXT DEFAULT '',
+			std_minutes REAL DEFAULT 0 CHECK(std_minutes >= 0),
+			UNIQUE(assembly_ipn, seq)
+		);
+		CREATE TABLE IF NOT EXISTS wo_operations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			wo_id TEXT NOT NULL,
+			seq INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			work_center_id TEXT DEFAULT '',
+			instructions TEXT DEFAULT '',
+			status TEXT DEFAULT 'pending' CHECK(status IN ('pending','in_progress','completed','skipped')),
+			qty_good INTEGER DEFAULT 0 CHECK(qty_good >= 0),
+			qty_scrap INTEGER DEFAULT 0 CHECK(qty_scrap >= 0),
+			started_at DATETIME, started_by TEXT DEFAULT '',
+			completed_at DATETIME, completed_by TEXT DEFAULT '',
+			notes TEXT DEFAULT '',
+			UNIQUE(wo_id, seq)
+		);
+		CREATE TABLE IF NOT EXISTS labor_entries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			wo_id TEXT NOT NULL,
+			operation_id INTEGER,
+			username TEXT NOT NULL,
+			clock_in DATETIME NOT NULL,
+			clock_out DATETIME,
+			accrued_at DATETIME NOT NULL,
+			minutes REAL DEFAULT 0 CHECK(minutes >= 0),
+			notes TEXT DEFAULT ''
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create routing tables: %v", err)
+	}
+
+	// Create purchasing and MRP tables
+	_, err = testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS purchase_orders (
+			id TEXT PRIMARY KEY,
+			vendor_id TEXT NOT NULL,
+			status TEXT DEFAULT 'draft' CHECK(status IN ('draft','sent','confirmed','partial','received','cancelled')),
+			notes TEXT,
+			created_by TEXT DEFAULT '',
+			total REAL DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expected_date DATE,
+			received_at DATETIME
+		);
+		CREATE TABLE IF NOT EXISTS po_lines (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			po_id TEXT NOT NULL,
+			ipn TEXT NOT NULL,
+			mpn TEXT,
+			manufacturer TEXT,
+			qty_ordered REAL NOT NULL CHECK(qty_ordered > 0),
+			qty_received REAL DEFAULT 0 CHECK(qty_received >= 0),
+			unit_price REAL CHECK(unit_price >= 0),
+			notes TEXT
+		);
+		CREATE TABLE IF NOT EXISTS price_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ipn TEXT NOT NULL,
+			vendor_id TEXT,
+			vendor_name TEXT,
+			unit_price REAL NOT NULL,
+			currency TEXT DEFAULT 'USD',
+			min_qty INTEGER DEFAULT 1,
+			lead_time_days INTEGER,
+			po_id TEXT,
+			recorded_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			notes TEXT
+		);
+		CREATE TABLE IF NOT EXISTS po_suggestions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			wo_id TEXT DEFAULT '',
+			vendor_id TEXT NOT NULL,
+			status TEXT DEFAULT 'pending' CHECK(status IN ('pending','approved','rejected')),
+			notes TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			reviewed_by TEXT,
+			reviewed_at DATETIME,
+			po_id TEXT,
+			mrp_run_id INTEGER,
+			source TEXT DEFAULT ''
+		);
+		CREATE TABLE IF NOT EXISTS po_suggestion_lines (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			suggestion_id INTEGER NOT NULL,
+			ipn TEXT NOT NULL,
+			mpn TEXT,
+			manufacturer TEXT,
+			qty_needed REAL NOT NULL,
+			estimated_unit_price REAL DEFAULT 0,
+			notes TEXT,
+			on_hand REAL,
+			on_order REAL,
+			demand REAL,
+			reorder_point REAL,
+			reorder_qty REAL
+		);
+		CREATE TABLE IF NOT EXISTS mrp_runs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			status TEXT DEFAULT 'running' CHECK(status IN ('running','completed','failed')),
+			trigger_type TEXT DEFAULT 'manual' CHECK(trigger_type IN ('manual','scheduled')),
+			horizon_days INTEGER DEFAULT 90,
+			default_lead_time_days INTEGER DEFAULT 7,
+			notes TEXT DEFAULT '',
+			created_by TEXT DEFAULT '',
+			started_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			completed_at DATETIME,
+			item_count INTEGER DEFAULT 0,
+			planned_po_count INTEGER DEFAULT 0,
+			planned_wo_count INTEGER DEFAULT 0,
+			error TEXT DEFAULT ''
+		);
+		CREATE TABLE IF NOT EXISTS mrp_requirements (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			run_id INTEGER NOT NULL,
+			ipn TEXT NOT NULL,
+			period TEXT NOT NULL,
+			gross_req REAL DEFAULT 0,
+			scheduled_receipts REAL DEFAULT 0,
+			projected_on_hand REAL DEFAULT 0,
+			net_req REAL DEFAULT 0,
+			planned_receipt REAL DEFAULT 0,
+			planned_release TEXT DEFAULT ''
+		);
+		CREATE TABLE IF NOT EXISTS mrp_planned_orders (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			run_id INTEGER NOT NULL,
+			order_type TEXT NOT NULL CHECK(order_type IN ('po','wo')),
+			ipn TEXT NOT NULL,
+			qty REAL NOT NULL CHECK(qty > 0),
+			release_date TEXT NOT NULL,
+			due_date TEXT NOT NULL,
+			vendor_id TEXT DEFAULT '',
+			unit_price REAL DEFAULT 0,
+			status TEXT DEFAULT 'planned' CHECK(status IN ('planned','firmed','cancelled')),
+			suggestion_id INTEGER,
+			wo_id TEXT DEFAULT '',
+			notes TEXT DEFAULT ''
+		);
+		CREATE TABLE IF NOT EXISTS mrp_item_settings (
+			ipn TEXT PRIMARY KEY,
+			lot_sizing TEXT DEFAULT 'lot_for_lot' CHECK(lot_sizing IN ('lot_for_lot','fixed','min')),
+			lot_qty REAL DEFAULT 0 CHECK(lot_qty >= 0),
+			lead_time_days INTEGER,
+			safety_stock REAL
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create MRP tables: %v", err)
+	}
+
 	// Create ncrs table
 	_, err = testDB.Exec(`
 		CREATE TABLE IF NOT EXISTS ncrs (
@@ -232,6 +468,10 @@ func setupTestDB(t *testing.T) *sql.DB {
 			priority TEXT DEFAULT 'medium',
 			root_cause TEXT DEFAULT '',
 			corrective_action TEXT DEFAULT '',
+			created_by TEXT DEFAULT '',
+			disposition TEXT DEFAULT '',
+			rework_labor_cost REAL DEFAULT 0,
+			rework_material_cost REAL DEFAULT 0,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			resolved_at DATETIME
@@ -273,6 +513,9 @@ func setupTestDB(t *testing.T) *sql.DB {
 			priority TEXT DEFAULT 'normal' CHECK(priority IN ('low','normal','high','critical')),
 			notes TEXT,
 			due_date TEXT DEFAULT '',
+			parent_wo_id TEXT DEFAULT '',
+			child_wo_override INTEGER DEFAULT 0,
+			customer TEXT DEFAULT '',
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			started_at DATETIME, completed_at DATETIME
 		)
@@ -295,6 +538,390 @@ func setupTestDB(t *testing.T) *sql.DB {
 		t.Fatalf("Failed to create wo_serials table: %v", err)
 	}
 
+	// Create serial_components table
+	_, err = testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS serial_components (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			parent_serial TEXT NOT NULL,
+			component_type TEXT NOT NULL CHECK(component_type IN ('serial','lot')),
+			child_serial TEXT DEFAULT '',
+			lot_id INTEGER,
+			ipn TEXT DEFAULT '',
+			qty REAL DEFAULT 1 CHECK(qty > 0),
+			wo_id TEXT DEFAULT '',
+			installed_by TEXT DEFAULT '',
+			installed_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_serial_components_child ON serial_components(child_serial) WHERE component_type = 'serial'
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create serial_components table: %v", err)
+	}
+
+	// Create wo_completions, scrap_reasons and undo_log tables
+	_, err = testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS wo_completions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			wo_id TEXT NOT NULL,
+			event_type TEXT NOT NULL CHECK(event_type IN ('complete','scrap')),
+			qty INTEGER NOT NULL CHECK(qty > 0),
+			reason_code TEXT DEFAULT '',
+			notes TEXT DEFAULT '',
+			output_lot_id INTEGER,
+			closed_wo INTEGER DEFAULT 0,
+			first_txn_id INTEGER DEFAULT 0,
+			last_txn_id INTEGER DEFAULT 0,
+			reservation_changes TEXT DEFAULT '{}',
+			created_by TEXT DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			reversed_at DATETIME,
+			reversed_by TEXT DEFAULT ''
+		);
+		CREATE TABLE IF NOT EXISTS scrap_reasons (
+			code TEXT PRIMARY KEY,
+			description TEXT DEFAULT '',
+			active INTEGER DEFAULT 1,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS undo_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL,
+			action TEXT NOT NULL,
+			entity_type TEXT NOT NULL,
+			entity_id TEXT NOT NULL,
+			previous_data TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at DATETIME NOT NULL
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create wo_completions table: %v", err)
+	}
+
+	// Create rework_orders, rework_units and rework_materials tables
+	_, err = testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS rework_orders (
+			wo_id TEXT PRIMARY KEY,
+			ncr_id TEXT NOT NULL,
+			instructions TEXT DEFAULT '',
+			lot_id INTEGER,
+			from_stock INTEGER DEFAULT 0,
+			created_by TEXT DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS rework_units (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			wo_id TEXT NOT NULL,
+			serial_number TEXT NOT NULL,
+			UNIQUE(wo_id, serial_number)
+		);
+		CREATE TABLE IF NOT EXISTS rework_materials (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			wo_id TEXT NOT NULL,
+			ipn TEXT NOT NULL,
+			qty REAL NOT NULL CHECK(qty > 0),
+			unit_cost REAL DEFAULT 0,
+			issued_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			returned_at DATETIME
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create rework tables: %v", err)
+	}
+
+	// Create wo_picks table
+	_, err = testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS wo_picks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			wo_id TEXT NOT NULL,
+			ipn TEXT NOT NULL,
+			lot_id INTEGER,
+			from_location TEXT DEFAULT '',
+			staging_location TEXT NOT NULL,
+			qty REAL NOT NULL CHECK(qty > 0),
+			qty_returned REAL DEFAULT 0 CHECK(qty_returned >= 0),
+			qty_consumed REAL DEFAULT 0 CHECK(qty_consumed >= 0),
+			picked_by TEXT DEFAULT '',
+			picked_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create wo_picks table: %v", err)
+	}
+
+	// Create locations and inventory_locations tables
+	_, err = testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS locations (
+			code TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			type TEXT NOT NULL CHECK(type IN ('site','area','bin')),
+			parent_code TEXT DEFAULT '',
+			active INTEGER DEFAULT 1,
+			notes TEXT DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS inventory_locations (
+			ipn TEXT NOT NULL,
+			location_code TEXT NOT NULL,
+			qty_on_hand REAL DEFAULT 0 CHECK(qty_on_hand >= 0),
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (ipn, location_code)
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create location tables: %v", err)
+	}
+
+	// Create cycle count tables
+	_, err = testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS cycle_count_classes (
+			class TEXT PRIMARY KEY CHECK(class IN ('A','B','C')),
+			value_pct REAL NOT NULL CHECK(value_pct > 0 AND value_pct <= 100),
+			frequency_days INTEGER NOT NULL CHECK(frequency_days > 0),
+			tolerance_pct REAL DEFAULT 0 CHECK(tolerance_pct >= 0)
+		);
+		CREATE TABLE IF NOT EXISTS cycle_count_items (
+			ipn TEXT PRIMARY KEY,
+			abc_class TEXT NOT NULL CHECK(abc_class IN ('A','B','C')),
+			annual_value REAL DEFAULT 0,
+			classified_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			last_counted_at DATETIME
+		);
+		CREATE TABLE IF NOT EXISTS cycle_count_tasks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ipn TEXT NOT NULL,
+			abc_class TEXT NOT NULL,
+			scheduled_date TEXT NOT NULL,
+			status TEXT DEFAULT 'open' CHECK(status IN ('open','pending_approval','completed','rejected','cancelled')),
+			expected_qty REAL,
+			counted_qty REAL,
+			variance_qty REAL,
+			variance_pct REAL,
+			unit_cost REAL DEFAULT 0,
+			variance_value REAL,
+			within_tolerance INTEGER,
+			counted_by TEXT DEFAULT '',
+			counted_at DATETIME,
+			reviewed_by TEXT DEFAULT '',
+			reviewed_at DATETIME,
+			review_notes TEXT DEFAULT '',
+			notes TEXT DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create cycle count tables: %v", err)
+	}
+
+	// Create cost layer tables
+	_, err = testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS cost_layers (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ipn TEXT NOT NULL,
+			source_type TEXT NOT NULL CHECK(source_type IN ('opening','receipt','wo','return','adjust')),
+			source_ref TEXT DEFAULT '',
+			qty_received REAL NOT NULL,
+			qty_remaining REAL NOT NULL CHECK(qty_remaining >= 0),
+			unit_cost REAL DEFAULT 0,
+			original_cost REAL DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS cost_layer_issues (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			layer_id INTEGER,
+			ipn TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			reference TEXT DEFAULT '',
+			qty REAL NOT NULL,
+			unit_cost REAL DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create cost layer tables: %v", err)
+	}
+
+	// Create MSL events table
+	_, err = testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS msl_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			lot_id INTEGER NOT NULL,
+			ipn TEXT NOT NULL,
+			event TEXT NOT NULL CHECK(event IN ('open','dry','bake')),
+			exposure_hours REAL DEFAULT 0,
+			notes TEXT DEFAULT '',
+			created_by TEXT DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create MSL events table: %v", err)
+	}
+
+	// Create ownership tables
+	_, err = testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS inventory_ownership (
+			ipn TEXT NOT NULL,
+			owner_type TEXT NOT NULL CHECK(owner_type IN ('customer','consigned')),
+			owner TEXT NOT NULL,
+			qty REAL NOT NULL DEFAULT 0 CHECK(qty >= 0),
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (ipn, owner_type, owner)
+		);
+		CREATE TABLE IF NOT EXISTS ownership_moves (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ipn TEXT NOT NULL,
+			owner_type TEXT NOT NULL CHECK(owner_type IN ('customer','consigned')),
+			owner TEXT NOT NULL,
+			type TEXT NOT NULL CHECK(type IN ('receive','issue','return','ship_to_cm','cm_consumed','return_from_cm')),
+			qty REAL NOT NULL,
+			reference TEXT DEFAULT '',
+			notes TEXT DEFAULT '',
+			created_by TEXT DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create ownership tables: %v", err)
+	}
+
+	// Create scanner session tables
+	_, err = testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS scan_sessions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			mode TEXT NOT NULL CHECK(mode IN ('receive','issue','pick','move','count')),
+			status TEXT DEFAULT 'open' CHECK(status IN ('open','committing','committed','cancelled')),
+			reference TEXT DEFAULT '',
+			location TEXT DEFAULT '',
+			to_location TEXT DEFAULT '',
+			pending_ipn TEXT DEFAULT '',
+			pending_lot_id INTEGER,
+			pending_lot_number TEXT DEFAULT '',
+			pending_date_code TEXT DEFAULT '',
+			pending_qty REAL,
+			username TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			closed_at DATETIME
+		);
+		CREATE TABLE IF NOT EXISTS scan_session_lines (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			session_id INTEGER NOT NULL,
+			ipn TEXT NOT NULL,
+			lot_id INTEGER,
+			lot_number TEXT DEFAULT '',
+			date_code TEXT DEFAULT '',
+			qty REAL NOT NULL CHECK(qty >= 0),
+			location TEXT DEFAULT '',
+			to_location TEXT DEFAULT '',
+			reference TEXT DEFAULT '',
+			status TEXT DEFAULT 'pending' CHECK(status IN ('pending','committed','failed')),
+			error TEXT DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS scan_session_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			session_id INTEGER NOT NULL,
+			scan_id TEXT DEFAULT '',
+			code TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			message TEXT DEFAULT '',
+			username TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create scan session tables: %v", err)
+	}
+
+	// Create test_records, test_specs and test_measurements tables
+	_, err = testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS test_records (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, serial_number TEXT NOT NULL,
+			ipn TEXT NOT NULL, firmware_version TEXT,
+			test_type TEXT CHECK(test_type IN ('factory','incoming','final','field','calibration')),
+			result TEXT NOT NULL CHECK(result IN ('pass','fail','conditional')),
+			measurements TEXT, notes TEXT,
+			tested_by TEXT DEFAULT 'operator',
+			tested_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			ncr_id TEXT DEFAULT ''
+		);
+		CREATE TABLE IF NOT EXISTS test_specs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ipn TEXT NOT NULL,
+			test_type TEXT DEFAULT '',
+			name TEXT NOT NULL,
+			unit TEXT DEFAULT '',
+			low_limit REAL,
+			high_limit REAL,
+			required INTEGER DEFAULT 1,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(ipn, test_type, name)
+		);
+		CREATE TABLE IF NOT EXISTS test_measurements (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			test_record_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			value REAL NOT NULL,
+			unit TEXT DEFAULT '',
+			low_limit REAL,
+			high_limit REAL,
+			spec_id INTEGER,
+			result TEXT NOT NULL CHECK(result IN ('pass','fail','none')),
+			notes TEXT DEFAULT '',
+			FOREIGN KEY (test_record_id) REFERENCES test_records(id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create test_specs table: %v", err)
+	}
+
+	// Create print_templates and print_template_versions tables
+	_, err = testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS print_templates (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			doc_type TEXT NOT NULL,
+			name TEXT NOT NULL,
+			description TEXT DEFAULT '',
+			is_default INTEGER DEFAULT 0,
+			current_version INTEGER NOT NULL DEFAULT 0,
+			created_by TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(doc_type, name)
+		);
+		CREATE TABLE IF NOT EXISTS print_template_versions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			template_id INTEGER NOT NULL,
+			version INTEGER NOT NULL,
+			body TEXT NOT NULL,
+			change_note TEXT DEFAULT '',
+			created_by TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(template_id, version),
+			FOREIGN KEY (template_id) REFERENCES print_templates(id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create print_templates table: %v", err)
+	}
+
+	// Create rmas table
+	_, err = testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS rmas (
+			id TEXT PRIMARY KEY, serial_number TEXT NOT NULL,
+			customer TEXT, reason TEXT,
+			status TEXT DEFAULT 'open' CHECK(status IN ('open','received','diagnosing','repairing','resolved','closed','scrapped')),
+			defect_description TEXT, resolution TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			received_at DATETIME, resolved_at DATETIME
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create rmas table: %v", err)
+	}
+
 	// Create parts table
 	_, err = testDB.Exec(`
 		CREATE TABLE IF NOT EXISTS parts (
@@ -461,6 +1088,7 @@ func setupTestDB(t *testing.T) *sql.DB {
 			qty INTEGER DEFAULT 1 CHECK(qty > 0),
 			work_order_id TEXT DEFAULT '',
 			rma_id TEXT DEFAULT '',
+			sales_order_id TEXT DEFAULT '',
 			FOREIGN KEY (shipment_id) REFERENCES shipments(id) ON DELETE CASCADE
 		)
 	`)
@@ -468,6 +1096,21 @@ func setupTestDB(t *testing.T) *sql.DB {
 		t.Fatalf("Failed to create shipment_lines table: %v", err)
 	}
 
+	// Create devices table
+	_, err = testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS devices (
+			serial_number TEXT PRIMARY KEY, ipn TEXT NOT NULL,
+			firmware_version TEXT, customer TEXT, location TEXT,
+			status TEXT DEFAULT 'active' CHECK(status IN ('active','inactive','rma','decommissioned','maintenance')),
+			install_date DATE,
+			last_seen DATETIME, notes TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create devices table: %v", err)
+	}
+
 	// Create pack_lists table
 	_, err = testDB.Exec(`
 		CREATE TABLE IF NOT EXISTS pack_lists (
@@ -81,6 +81,9 @@ type InventoryItem struct {
 	Description  string  `json:"description"`
 	MPN          string  `json:"mpn"`
 	UpdatedAt    string  `json:"updated_at"`
+	// Breakdown by location; whatever isn't in a location is unassigned
+	Locations     []LocationStock `json:"locations,omitempty"`
+	QtyUnassigned *float64        `json:"qty_unassigned,omitempty"`
 }
 
 type InventoryTransaction struct {
@@ -91,6 +94,19 @@ type InventoryTransaction struct {
 	Reference string  `json:"reference"`
 	Notes     string  `json:"notes"`
 	CreatedAt string  `json:"created_at"`
+	LotID     *int    `json:"lot_id"`
+	// Location stock is taken from or put into; a transfer moves it from
+	// Location (unassigned stock if empty) to ToLocation
+	Location   string `json:"location,omitempty"`
+	ToLocation string `json:"to_location,omitempty"`
+	// Lot details for a receive, and explicit lot picks for an issue
+	LotNumber string    `json:"lot_number,omitempty"`
+	DateCode  string    `json:"date_code,omitempty"`
+	ExpiresAt string    `json:"expires_at,omitempty"`
+	Lots      []LotPick `json:"lots,omitempty"`
+	// Customer owning the stock received or returned, or whose stock an
+	// issue should use first (by default the customer of the WO issued to)
+	Customer string `json:"customer,omitempty"`
 }
 
 type PurchaseOrder struct {
@@ -128,14 +144,24 @@ type WorkOrder struct {
 	CreatedAt   string  `json:"created_at"`
 	StartedAt   *string `json:"started_at"`
 	CompletedAt *string `json:"completed_at"`
+
+	DueDate          string            `json:"due_date,omitempty"`
+	ParentWOID       string            `json:"parent_wo_id,omitempty"`
+	OverrideChildWOs bool              `json:"override_child_wos,omitempty"`
+	ChildWOs         []ChildWorkOrder  `json:"child_wos,omitempty"`
+	ChildWOProposals []ChildWOProposal `json:"child_wo_proposals,omitempty"`
+	NCRID            string            `json:"ncr_id,omitempty"`
+	// Customer the WO builds for; kitting uses their own stock first
+	Customer string `json:"customer,omitempty"`
 }
 
 type WOSerial struct {
 	ID           int    `json:"id"`
 	WOID         string `json:"wo_id"`
-	SerialNumber string `json:"serial_number"`
-	Status       string `json:"status"`
-	Notes        string `json:"notes"`
+	SerialNumber string            `json:"serial_number"`
+	Status       string            `json:"status"`
+	Notes        string            `json:"notes"`
+	Components   []SerialComponent `json:"components,omitempty"`
 }
 
 type TestRecord struct {
@@ -149,6 +175,9 @@ type TestRecord struct {
 	Notes           string `json:"notes"`
 	TestedBy        string `json:"tested_by"`
 	TestedAt        string `json:"tested_at"`
+
+	NCRID    string            `json:"ncr_id,omitempty"`
+	Readings []TestMeasurement `json:"readings,omitempty"`
 }
 
 type FieldReport struct {
@@ -187,6 +216,10 @@ type NCR struct {
 	CreatedBy        string  `json:"created_by"`
 	CreatedAt        string  `json:"created_at"`
 	ResolvedAt       *string `json:"resolved_at"`
+
+	Disposition string   `json:"disposition,omitempty"`
+	ReworkWOIDs []string `json:"rework_wo_ids,omitempty"`
+	ReworkCost  *float64 `json:"rework_cost,omitempty"`
 }
 
 type Device struct {
@@ -254,6 +287,7 @@ type QuoteLine struct {
 	Qty       int     `json:"qty"`
 	UnitPrice float64 `json:"unit_price"`
 	Notes     string  `json:"notes"`
+	ATP       *QuoteLineATP `json:"atp,omitempty"`
 }
 
 type DashboardData struct {
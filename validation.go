@@ -228,6 +228,7 @@ var (
 	validWOPriorities          = []string{"low", "normal", "high", "critical"}
 	validNCRSeverities         = []string{"minor", "major", "critical"}
 	validNCRStatuses           = []string{"open", "investigating", "resolved", "closed"}
+	validNCRDispositions       = []string{"use_as_is", "rework", "repair", "scrap", "return_to_vendor"}
 	validRMAStatuses           = []string{"open", "received", "diagnosing", "repairing", "resolved", "closed", "scrapped"}
 	validQuoteStatuses         = []string{"draft", "sent", "accepted", "rejected", "expired", "cancelled"}
 	validShipmentTypes         = []string{"inbound", "outbound", "transfer"}
@@ -240,12 +241,18 @@ var (
 	validCAPAStatuses          = []string{"open", "in_progress", "pending_review", "closed", "cancelled"}
 	validVendorStatuses        = []string{"active", "preferred", "inactive", "blocked"}
 	validInventoryTypes        = []string{"receive", "issue", "adjust", "transfer", "return", "scrap"}
+	validLocationTypes         = []string{"site", "area", "bin"}
+	validCostingMethods        = []string{"fifo", "average"}
+	validMSLEvents             = []string{"open", "dry", "bake"}
 	validRFQStatuses           = []string{"draft", "sent", "quoting", "awarded", "cancelled"}
 	validFieldReportTypes      = []string{"failure", "performance", "safety", "visit", "other"}
 	validFieldReportStatuses   = []string{"open", "investigating", "resolved", "closed"}
 	validSalesOrderStatuses    = []string{"draft", "confirmed", "allocated", "picked", "shipped", "invoiced", "closed"}
 	validInvoiceStatuses       = []string{"draft", "sent", "paid", "overdue", "cancelled"}
 	validFieldReportPriorities = []string{"low", "medium", "high", "critical"}
+	validReservationStatuses   = []string{"open", "consumed", "released"}
+	validReservationRefTypes   = []string{"work_order", "sales_order", "legacy"}
+	validTestTypes             = []string{"factory", "incoming", "final", "field", "calibration"}
 )
 
 // hasReferences checks if a record is referenced by other tables